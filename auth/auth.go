@@ -3,7 +3,12 @@ package auth
 
 import (
 	"errors"
+	"fmt"
+	"path"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 // Auther is a generic interface to implement password-based authentication and authorization
@@ -18,12 +23,23 @@ type Auther interface {
 	Authorize(user *User, topic string, perm Permission) error
 }
 
+// TokenAuther is implemented by Authers that can also authenticate users with bearer tokens
+type TokenAuther interface {
+	// AuthenticateToken checks the token (e.g. "Authorization: Bearer <token>") and returns the
+	// user it was issued to if it is valid.
+	AuthenticateToken(token string) (*User, error)
+}
+
 // Manager is an interface representing user and access management
 type Manager interface {
 	// AddUser adds a user with the given username, password and role. The password should be hashed
 	// before it is stored in a persistence layer.
 	AddUser(username, password string, role Role) error
 
+	// AddUserHash is like AddUser, but takes a password that was already hashed with HashPassword, e.g. for
+	// sign-ups that are only completed once the e-mail address is verified.
+	AddUserHash(username, hash string, role Role) error
+
 	// RemoveUser deletes the user with the given username. The function returns nil on success, even
 	// if the user did not exist in the first place.
 	RemoveUser(username string) error
@@ -46,12 +62,74 @@ type Manager interface {
 	// read/write access to a topic. The parameter topicPattern may include wildcards (*).
 	AllowAccess(username string, topicPattern string, read bool, write bool) error
 
+	// AllowPermissions is like AllowAccess, but only grants the given fine-grained permissions to a topic,
+	// e.g. PermissionPublish to allow publishing, but not attaching files or forwarding e-mails.
+	AllowPermissions(username string, topicPattern string, perms Permission) error
+
 	// ResetAccess removes an access control list entry for a specific username/topic, or (if topic is
 	// empty) for an entire user. The parameter topicPattern may include wildcards (*).
 	ResetAccess(username string, topicPattern string) error
 
 	// DefaultAccess returns the default read/write access if no access control entry matches
 	DefaultAccess() (read bool, write bool)
+
+	// AddToken creates a new access token for a user, which is limited to the given topics and permissions.
+	// At least one grant must be passed. If expires is zero, the token does not expire.
+	AddToken(username, label string, grants []Grant, expires time.Time) (*Token, error)
+
+	// Tokens returns the access tokens of a user, including expired tokens
+	Tokens(username string) ([]*Token, error)
+
+	// RemoveToken deletes an access token of a user. The function returns nil on success, even
+	// if the token did not exist in the first place.
+	RemoveToken(username, token string) error
+
+	// AddReservation reserves a topic for a user: the user is granted read-write access to the topic, and
+	// everyone else the given access. It returns ErrTopicReserved if the topic is reserved by another user.
+	AddReservation(username, topic string, everyoneRead, everyoneWrite bool) error
+
+	// Reservations returns the topics reserved by a user
+	Reservations(username string) ([]Reservation, error)
+
+	// RemoveReservation releases a topic reserved by a user. The function returns nil on success, even
+	// if the reservation did not exist in the first place.
+	RemoveReservation(username, topic string) error
+
+	// ChangeReservationIPs restricts from which IP addresses a topic reserved by the user can be published to.
+	// Both lists contain CIDR ranges, see Reservation. It returns ErrNotFound if the user did not reserve the topic.
+	ChangeReservationIPs(username, topic string, publishAllow, publishDeny []string) error
+
+	// ReservedTopicIPs returns the reservations of all users that restrict publishing by IP address
+	ReservedTopicIPs() ([]Reservation, error)
+
+	// AddTier creates a new tier
+	AddTier(tier *Tier) error
+
+	// UpdateTier changes the limits of an existing tier
+	UpdateTier(tier *Tier) error
+
+	// Tier returns the tier with the given code if it exists, or ErrNotFound otherwise
+	Tier(code string) (*Tier, error)
+
+	// Tiers returns all tiers
+	Tiers() ([]*Tier, error)
+
+	// RemoveTier deletes a tier. Users in this tier are no longer assigned to any tier afterwards.
+	RemoveTier(code string) error
+
+	// ChangeTier assigns a user to a tier, or removes the user from its tier if the code is empty
+	ChangeTier(username, code string) error
+
+	// EnrollTOTP generates a new TOTP secret for a user and returns it. The secret is only used for two-factor
+	// authentication once it is confirmed with EnableTOTP.
+	EnrollTOTP(username string) (string, error)
+
+	// EnableTOTP enables two-factor authentication for a user, if the code is valid for the secret generated by
+	// EnrollTOTP. It returns ErrNotFound if there is no pending secret, and ErrUnauthenticated if the code is invalid.
+	EnableTOTP(username, code string) error
+
+	// DisableTOTP disables two-factor authentication for a user, and discards any pending TOTP secret
+	DisableTOTP(username string) error
 }
 
 // User is a struct that represents a user
@@ -60,6 +138,41 @@ type User struct {
 	Hash   string // password hash (bcrypt)
 	Role   Role
 	Grants []Grant
+	Token  *Token // Set if the user was authenticated with an access token, which limits its permissions
+	Tier   *Tier  // May be nil if the user is not assigned to a tier
+	TOTP   string // TOTP secret (base32), if two-factor authentication is enabled, see ValidateTOTP
+}
+
+// Tier is a named set of limits that can be assigned to users, e.g. a "pro" tier with more reserved topics.
+// Except for ReservationsLimit, a zero limit means that the server-wide visitor limit applies.
+type Tier struct {
+	Code                     string
+	ReservationsLimit        int           // Number of topics a user in this tier can reserve
+	MessagesLimit            int64         // Messages a user in this tier can publish per day
+	EmailsLimit              int64         // E-mails a user in this tier can send per day
+	AttachmentTotalSizeLimit int64         // Total size of the attachments of a user in this tier, in bytes
+	MaxDelay                 time.Duration // How far in the future a user in this tier can schedule messages
+	SMSLimit                 int64         // SMS a user in this tier can send per day
+	CallsLimit               int64         // Phone calls a user in this tier can trigger per day
+}
+
+// Reservation is a topic reserved by a user. The user has read-write access to the topic, and
+// everyone else has the access defined by EveryoneRead and EveryoneWrite.
+type Reservation struct {
+	Topic         string
+	EveryoneRead  bool
+	EveryoneWrite bool
+	PublishAllow  []string // CIDR ranges that may publish to the topic; if empty, all that are not denied may
+	PublishDeny   []string // CIDR ranges that may never publish to the topic, not even the user
+}
+
+// Token is a long-lived access token of a user, which can be used instead of the user's password, e.g. in scripts.
+// It only grants access to the topics in its grants, and only if the user itself has access to them.
+type Token struct {
+	Value   string
+	Label   string
+	Grants  []Grant
+	Expires time.Time // Zero if the token does not expire
 }
 
 // Grant is a struct that represents an access control entry to a topic
@@ -67,17 +180,146 @@ type Grant struct {
 	TopicPattern string // May include wildcard (*)
 	AllowRead    bool
 	AllowWrite   bool
+	Deny         Permission // Fine-grained permissions excluded from AllowRead/AllowWrite, e.g. PermissionAttach
 }
 
-// Permission represents a read or write permission to a topic
+// Permissions returns the fine-grained permissions of the grant (see Permission)
+func (g Grant) Permissions() Permission {
+	return grantPermissions(g.AllowRead, g.AllowWrite, g.Deny)
+}
+
+// Permission represents a permission to a topic. Read and write access are made up of fine-grained permissions,
+// e.g. write access consists of PermissionPublish, PermissionAttach and PermissionEmail. Multiple permissions
+// can be combined with "|". PermissionRead and PermissionWrite are granted if any permission of the category is.
 type Permission int
 
 // Permissions to a topic
 const (
-	PermissionRead  = Permission(1)
-	PermissionWrite = Permission(2)
+	PermissionRead      = Permission(1)
+	PermissionWrite     = Permission(2)
+	PermissionSubscribe = Permission(4)  // Read: receive new messages
+	PermissionPoll      = Permission(8)  // Read: retrieve cached messages, e.g. with poll=1, since=... or search
+	PermissionPublish   = Permission(16) // Write: publish, update and delete messages
+	PermissionAttach    = Permission(32) // Write: attach files to messages
+	PermissionEmail     = Permission(64) // Write: forward messages via e-mail
+)
+
+const (
+	readPermissions  = PermissionRead | PermissionSubscribe | PermissionPoll
+	writePermissions = PermissionWrite | PermissionPublish | PermissionAttach | PermissionEmail
 )
 
+// permissionNames are the names of the fine-grained permissions, as used by ParsePermissions, in display order
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermissionSubscribe, "subscribe"},
+	{PermissionPoll, "poll"},
+	{PermissionPublish, "publish"},
+	{PermissionAttach, "attach"},
+	{PermissionEmail, "email"},
+}
+
+// ParsePermissions parses a permission of an access control entry: read-write (alias: rw), read-only (aliases:
+// read, ro), write-only (aliases: write, wo), deny (alias: none), or a comma-separated list of fine-grained
+// permissions (subscribe, poll, publish, attach, email), e.g. "publish,attach".
+func ParsePermissions(s string) (Permission, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "read-write", "rw":
+		return readPermissions | writePermissions, nil
+	case "read-only", "read", "ro":
+		return readPermissions, nil
+	case "write-only", "write", "wo":
+		return writePermissions, nil
+	case "deny", "none":
+		return 0, nil
+	}
+	var perms Permission
+	for _, name := range strings.Split(strings.ToLower(s), ",") {
+		perm := Permission(0)
+		for _, p := range permissionNames {
+			if p.name == strings.TrimSpace(name) {
+				perm = p.perm
+			}
+		}
+		if perm == 0 {
+			return 0, fmt.Errorf("invalid permission %s, expected read-write, read-only, write-only, deny, or a list of: subscribe, poll, publish, attach, email", s)
+		}
+		perms |= perm
+	}
+	return normalizePermissions(perms), nil
+}
+
+// String returns the permissions in the format understood by ParsePermissions, e.g. "read-only" or "publish,attach"
+func (p Permission) String() string {
+	p = normalizePermissions(p)
+	switch p {
+	case readPermissions | writePermissions:
+		return "read-write"
+	case readPermissions:
+		return "read-only"
+	case writePermissions:
+		return "write-only"
+	case 0:
+		return "deny"
+	}
+	names := make([]string, 0)
+	for _, perm := range permissionNames {
+		if p&perm.perm != 0 {
+			names = append(names, perm.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// normalizePermissions adds PermissionRead and PermissionWrite if any permission of the respective category
+// is included. PermissionRead and PermissionWrite by themselves include all permissions of the category.
+func normalizePermissions(perms Permission) Permission {
+	if perms&readPermissions == PermissionRead {
+		perms |= readPermissions
+	} else if perms&readPermissions != 0 {
+		perms |= PermissionRead
+	}
+	if perms&writePermissions == PermissionWrite {
+		perms |= writePermissions
+	} else if perms&writePermissions != 0 {
+		perms |= PermissionWrite
+	}
+	return perms
+}
+
+// grantPermissions returns the permissions granted by read/write access, minus the denied permissions
+func grantPermissions(read, write bool, deny Permission) Permission {
+	var perms Permission
+	if read {
+		perms |= readPermissions
+	}
+	if write {
+		perms |= writePermissions
+	}
+	perms &^= deny
+	if perms&readPermissions == PermissionRead {
+		perms &^= PermissionRead
+	}
+	if perms&writePermissions == PermissionWrite {
+		perms &^= PermissionWrite
+	}
+	return perms
+}
+
+// newGrant returns an access control entry that grants the given permissions to the topic pattern
+func newGrant(topicPattern string, perms Permission) Grant {
+	perms = normalizePermissions(perms)
+	read, write := perms&PermissionRead != 0, perms&PermissionWrite != 0
+	return Grant{
+		TopicPattern: topicPattern,
+		AllowRead:    read,
+		AllowWrite:   write,
+		Deny:         grantPermissions(read, write, 0) &^ perms,
+	}
+}
+
 // Role represents a user's role, either admin or regular user
 type Role string
 
@@ -94,8 +336,20 @@ const (
 )
 
 var (
-	allowedUsernameRegex     = regexp.MustCompile(`^[-_.@a-zA-Z0-9]+$`)     // Does not include Everyone (*)
-	allowedTopicPatternRegex = regexp.MustCompile(`^[-_*A-Za-z0-9]{1,64}$`) // Adds '*' for wildcards!
+	allowedUsernameRegex     = regexp.MustCompile(`^[-_.@a-zA-Z0-9]+$`) // Does not include Everyone (*)
+	allowedTopicRegex        = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+	allowedTopicPatternRegex = regexp.MustCompile(`^[-_*?\[\]^A-Za-z0-9]{1,64}$`) // Adds glob characters for wildcards!
+	allowedTierRegex         = regexp.MustCompile(`^[-_a-z0-9]{1,64}$`)
+)
+
+const (
+	maxTopicRegexLength = 256
+	maxTopicRegexes     = 1000 // Compiled topic regexes to cache, see compileTopicRegex
+)
+
+var (
+	topicRegexes   = make(map[string]*regexp.Regexp)
+	topicRegexesMu sync.Mutex
 )
 
 // AllowedRole returns true if the given role can be used for new users
@@ -108,9 +362,64 @@ func AllowedUsername(username string) bool {
 	return allowedUsernameRegex.MatchString(username)
 }
 
-// AllowedTopicPattern returns true if the given topic pattern is valid; this includes the wildcard character (*)
-func AllowedTopicPattern(username string) bool {
-	return allowedTopicPatternRegex.MatchString(username)
+// AllowedTopic returns true if the given topic name is valid; unlike AllowedTopicPattern, it does not allow wildcards
+func AllowedTopic(topic string) bool {
+	return allowedTopicRegex.MatchString(topic)
+}
+
+// AllowedTier returns true if the given tier code is valid, e.g. "pro"
+func AllowedTier(code string) bool {
+	return allowedTierRegex.MatchString(code)
+}
+
+// AllowedTopicPattern returns true if the given topic pattern is valid. A pattern is either a topic name with optional
+// glob wildcards, i.e. * (any characters), ? (a single character) and character classes (e.g. [0-9] or [^x]), or a
+// regular expression anchored with ^ and $, e.g. ^team[0-9]+$.
+func AllowedTopicPattern(pattern string) bool {
+	if isTopicRegex(pattern) {
+		if len(pattern) > maxTopicRegexLength || !strings.HasSuffix(pattern, "$") {
+			return false
+		}
+		_, err := regexp.Compile(pattern)
+		return err == nil
+	} else if !allowedTopicPatternRegex.MatchString(pattern) {
+		return false
+	}
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
+
+// topicPatternMatches returns true if the topic matches the pattern, see AllowedTopicPattern
+func topicPatternMatches(pattern, topic string) bool {
+	if isTopicRegex(pattern) {
+		re, err := compileTopicRegex(pattern)
+		return err == nil && re.MatchString(topic)
+	}
+	matched, _ := path.Match(pattern, topic) // Topics never contain '/', so '*' matches everything
+	return matched
+}
+
+// compileTopicRegex returns the compiled topic regex, which is cached, since the patterns of the access control
+// entries are matched on every access check. The cache is cleared when it is full.
+func compileTopicRegex(pattern string) (*regexp.Regexp, error) {
+	topicRegexesMu.Lock()
+	defer topicRegexesMu.Unlock()
+	if re, ok := topicRegexes[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(topicRegexes) >= maxTopicRegexes {
+		topicRegexes = make(map[string]*regexp.Regexp)
+	}
+	topicRegexes[pattern] = re
+	return re, nil
+}
+
+func isTopicRegex(pattern string) bool {
+	return strings.HasPrefix(pattern, "^")
 }
 
 // Error constants used by the package
@@ -119,4 +428,5 @@ var (
 	ErrUnauthorized    = errors.New("unauthorized")
 	ErrInvalidArgument = errors.New("invalid argument")
 	ErrNotFound        = errors.New("not found")
+	ErrTopicReserved   = errors.New("topic reserved by another user")
 )
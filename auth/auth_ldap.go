@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ldapTimeout               = 10 * time.Second
+	ldapDefaultUserFilter     = "(uid=%s)"
+	ldapDefaultGroupAttribute = "memberOf"
+)
+
+// LDAPConfig is the configuration of an LDAPAuth
+type LDAPConfig struct {
+	URL            string   // ldap://host[:port] or ldaps://host[:port]
+	BindDN         string   // DN of the service account used to look up users
+	BindPassword   string   // Password of the service account
+	UserBaseDN     string   // Users are searched below this DN
+	UserFilter     string   // Filter to find a user, with %s as placeholder for the username, e.g. (uid=%s)
+	GroupAttribute string   // Attribute of the user entry that lists the user's groups, e.g. memberOf
+	AdminGroup     string   // Members of this group are admins; DN, or value of the first RDN (e.g. the cn)
+	GroupAccess    []string // Access control entries for groups, format: <group>:<topic-pattern>:<permission>
+	DefaultRead    bool
+	DefaultWrite   bool
+}
+
+// LDAPAuth is an implementation of Auther that authenticates users against an LDAP directory, e.g.
+// OpenLDAP or Active Directory. Users are looked up with a service account, and then authenticated by
+// binding with their own DN and password. Access control entries are derived from their group memberships.
+//
+// LDAPAuth does not implement Manager, since users and groups are maintained in the directory.
+type LDAPAuth struct {
+	config *LDAPConfig
+	filter *ldapFilter
+	groups *groupAccess // Groups are referred to by their DN or their RDN value
+}
+
+var _ Auther = (*LDAPAuth)(nil)
+
+// NewLDAPAuth creates a new LDAPAuth instance. It connects to the directory once, to check the service
+// account credentials.
+func NewLDAPAuth(config *LDAPConfig) (*LDAPAuth, error) {
+	if config.UserFilter == "" {
+		config.UserFilter = ldapDefaultUserFilter
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = ldapDefaultGroupAttribute
+	}
+	filter, err := parseLDAPFilter(config.UserFilter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP user filter %s: %s", config.UserFilter, err.Error())
+	} else if !filter.hasPlaceholder() {
+		return nil, fmt.Errorf("invalid LDAP user filter %s: must contain %s as placeholder for the username", config.UserFilter, ldapFilterPlaceholder)
+	}
+	groups, err := newGroupAccess(config.AdminGroup, config.GroupAccess, config.DefaultRead, config.DefaultWrite)
+	if err != nil {
+		return nil, err
+	}
+	a := &LDAPAuth{
+		config: config,
+		filter: filter,
+		groups: groups,
+	}
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return a, nil
+}
+
+// Authenticate looks up the user in the directory, and checks the password by binding as the user. The
+// user's role and grants are derived from the groups listed in the group attribute of the user entry.
+func (a *LDAPAuth) Authenticate(username, password string) (*User, error) {
+	if username == Everyone || !AllowedUsername(username) || password == "" {
+		return nil, ErrUnauthenticated
+	}
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entries, err := conn.Search(a.config.UserBaseDN, a.filter.encode(username), []string{a.config.GroupAttribute})
+	if err != nil {
+		return nil, err
+	} else if len(entries) != 1 {
+		return nil, ErrUnauthenticated
+	}
+	if err := conn.Bind(entries[0].dn, password); err == errLDAPInvalidCredentials {
+		return nil, ErrUnauthenticated
+	} else if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0)
+	for _, group := range entries[0].attributes[strings.ToLower(a.config.GroupAttribute)] {
+		groups = append(groups, ldapGroupNames(group)...)
+	}
+	return a.groups.user(username, groups), nil
+}
+
+// Authorize returns nil if the given user has access to the given topic using the desired
+// permission. The user param may be nil to signal an anonymous user.
+func (a *LDAPAuth) Authorize(user *User, topic string, perm Permission) error {
+	return a.groups.authorize(user, topic, perm)
+}
+
+func (a *LDAPAuth) connect() (*ldapConn, error) {
+	conn, err := dialLDAP(a.config.URL, ldapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if a.config.BindDN != "" {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP bind as %s failed: %s", a.config.BindDN, err.Error())
+		}
+	}
+	return conn, nil
+}
+
+// ldapGroupNames returns the names a group can be referred to by in the config, in lower case: its DN, and the
+// value of its first RDN (e.g. "ntfy-admins" for cn=ntfy-admins,ou=groups,dc=example,dc=com)
+func ldapGroupNames(dn string) []string {
+	dn = strings.ToLower(strings.TrimSpace(dn))
+	names := []string{dn}
+	rdn := strings.SplitN(dn, ",", 2)[0]
+	if i := strings.Index(rdn, "="); i != -1 && rdn[i+1:] != "" {
+		names = append(names, rdn[i+1:])
+	}
+	return names
+}
@@ -0,0 +1,319 @@
+package auth
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLDAPAuth_FullScenario(t *testing.T) {
+	a := newTestLDAPAuth(t, false, false)
+
+	phil, err := a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	require.Equal(t, "phil", phil.Name)
+	require.Equal(t, RoleAdmin, phil.Role)
+
+	ben, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+	require.Equal(t, RoleUser, ben.Role)
+	require.Equal(t, []Grant{
+		{TopicPattern: "alerts*", AllowRead: true, AllowWrite: false},
+		{TopicPattern: "builds", AllowRead: true, AllowWrite: true},
+		{TopicPattern: "alerts-ops", AllowRead: false, AllowWrite: true},
+	}, ben.Grants)
+
+	marian, err := a.Authenticate("marian", "marian")
+	require.Nil(t, err)
+	require.Equal(t, []Grant{}, marian.Grants)
+
+	require.Nil(t, a.Authorize(phil, "sometopic", PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "alerts-db", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts-db", PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "alerts-ops", PermissionRead)) // Combined from both groups
+	require.Nil(t, a.Authorize(ben, "alerts-ops", PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "builds", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "announcements", PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "announcements", PermissionRead)) // Everyone
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "sometopic", PermissionRead))
+	require.Nil(t, a.Authorize(marian, "announcements", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(marian, "builds", PermissionRead))
+	require.Nil(t, a.Authorize(nil, "announcements", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "announcements", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "alerts-db", PermissionRead))
+}
+
+func TestLDAPAuth_Authorize_DefaultAccess(t *testing.T) {
+	a := newTestLDAPAuth(t, true, false)
+	marian, err := a.Authenticate("marian", "marian")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(marian, "sometopic", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(marian, "sometopic", PermissionWrite))
+	require.Nil(t, a.Authorize(nil, "sometopic", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "announcements", PermissionWrite))
+}
+
+func TestGroupAccess_Permissions(t *testing.T) {
+	g, err := newGroupAccess("", []string{
+		"sensors:readings:publish",
+		"viewers:readings:subscribe,poll",
+		"viewers:readings:publish",
+	}, false, false)
+	require.Nil(t, err)
+	sensor := g.user("sensor1", []string{"sensors"})
+	require.Equal(t, []Grant{{TopicPattern: "readings", AllowRead: false, AllowWrite: true, Deny: PermissionAttach | PermissionEmail}}, sensor.Grants)
+	require.Nil(t, g.authorize(sensor, "readings", PermissionPublish))
+	require.Equal(t, ErrUnauthorized, g.authorize(sensor, "readings", PermissionAttach))
+	require.Equal(t, ErrUnauthorized, g.authorize(sensor, "readings", PermissionPoll))
+
+	viewer := g.user("viewer1", []string{"viewers"})
+	require.Nil(t, g.authorize(viewer, "readings", PermissionPoll)) // Combined from both entries
+	require.Nil(t, g.authorize(viewer, "readings", PermissionPublish))
+	require.Equal(t, ErrUnauthorized, g.authorize(viewer, "readings", PermissionEmail))
+
+	_, err = newGroupAccess("", []string{"sensors:readings:publish,maybe"}, false, false)
+	require.Error(t, err)
+}
+
+func TestLDAPAuth_Authenticate_Fail(t *testing.T) {
+	a := newTestLDAPAuth(t, false, false)
+	_, err := a.Authenticate("ben", "wrong")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("ben", "")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("doesnotexist", "ben")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate(Everyone, "ben")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("ben)(uid=*", "ben")
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("svc", "svc") // Not a person
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestLDAPAuth_Authenticate_ServerDown(t *testing.T) {
+	a := newTestLDAPAuth(t, false, false)
+	a.config.URL = "ldap://127.0.0.1:1"
+	_, err := a.Authenticate("ben", "ben")
+	require.Error(t, err)
+	require.NotEqual(t, ErrUnauthenticated, err)
+}
+
+func TestNewLDAPAuth_Invalid(t *testing.T) {
+	url := newTestLDAPServer(t)
+	for _, conf := range []*LDAPConfig{
+		{URL: url, UserBaseDN: "dc=example,dc=com", UserFilter: "(uid=ben)"},
+		{URL: url, UserBaseDN: "dc=example,dc=com", UserFilter: "(uid=%s"},
+		{URL: url, UserBaseDN: "dc=example,dc=com", GroupAccess: []string{"ntfy-devs:alerts*"}},
+		{URL: url, UserBaseDN: "dc=example,dc=com", GroupAccess: []string{"ntfy-devs:alerts/*:rw"}},
+		{URL: url, UserBaseDN: "dc=example,dc=com", GroupAccess: []string{"ntfy-devs:alerts*:maybe"}},
+		{URL: url, UserBaseDN: "dc=example,dc=com", BindDN: "cn=svc,ou=services,dc=example,dc=com", BindPassword: "wrong"},
+		{URL: "http://127.0.0.1", UserBaseDN: "dc=example,dc=com"},
+	} {
+		_, err := NewLDAPAuth(conf)
+		require.Error(t, err, conf)
+	}
+}
+
+func TestParseLDAPFilter(t *testing.T) {
+	for _, s := range []string{"(uid=%s)", "(&(objectClass=person)(uid=%s))", "(|(uid=%s)(mail=%s))", "(&(uid=%s)(!(disabled=*)))", "(cn=John\\20Doe)"} {
+		_, err := parseLDAPFilter(s)
+		require.Nil(t, err, s)
+	}
+	for _, s := range []string{"", "uid=%s", "(uid=%s", "(uid=%s))", "(uid=j*)", "(uid>=1)", "(=x)", "(&)", "(!(a=b)(c=d))", "(cn=\\2)"} {
+		_, err := parseLDAPFilter(s)
+		require.Equal(t, errLDAPFilterInvalid, err, s)
+	}
+}
+
+func TestLDAPFilter_Encode(t *testing.T) {
+	f, err := parseLDAPFilter("(&(objectClass=person)(uid=%s))")
+	require.Nil(t, err)
+	require.True(t, f.hasPlaceholder())
+	expected := berEncode(ldapTagFilterAnd,
+		berEncode(ldapTagFilterEquality, berString(berTagOctetString, "objectClass"), berString(berTagOctetString, "person")),
+		berEncode(ldapTagFilterEquality, berString(berTagOctetString, "uid"), berString(berTagOctetString, "*)(uid=*")),
+	)
+	require.Equal(t, expected, f.encode("*)(uid=*")) // Not interpreted as filter
+
+	f, err = parseLDAPFilter("(cn=John\\20Doe)")
+	require.Nil(t, err)
+	require.False(t, f.hasPlaceholder())
+	require.Equal(t, "John Doe", f.value)
+}
+
+func TestBERLength(t *testing.T) {
+	require.Equal(t, []byte{0x7f}, berLength(127))
+	require.Equal(t, []byte{0x81, 0x80}, berLength(128))
+	require.Equal(t, []byte{0x82, 0x01, 0x00}, berLength(256))
+	require.Equal(t, []byte{0x02, 0x02, 0x00, 0x80}, berInt(berTagInteger, 128))
+}
+
+func newTestLDAPAuth(t *testing.T, defaultRead, defaultWrite bool) *LDAPAuth {
+	a, err := NewLDAPAuth(&LDAPConfig{
+		URL:          newTestLDAPServer(t),
+		BindDN:       "cn=svc,ou=services,dc=example,dc=com",
+		BindPassword: "svc",
+		UserBaseDN:   "ou=people,dc=example,dc=com",
+		UserFilter:   "(&(objectClass=person)(uid=%s))",
+		AdminGroup:   "cn=ntfy-admins,ou=groups,dc=example,dc=com",
+		GroupAccess: []string{
+			"ntfy-devs:alerts*:read-only",
+			"ntfy-devs:builds:rw",
+			"CN=ntfy-ops,ou=groups,dc=example,dc=com:alerts-ops:write-only",
+			"*:announcements:ro",
+		},
+		DefaultRead:  defaultRead,
+		DefaultWrite: defaultWrite,
+	})
+	require.Nil(t, err)
+	return a
+}
+
+type testLDAPEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string // Lower case names
+}
+
+var testLDAPEntries = []*testLDAPEntry{
+	{
+		dn:         "cn=svc,ou=services,dc=example,dc=com",
+		password:   "svc",
+		attributes: map[string][]string{"uid": {"svc"}, "objectclass": {"account"}},
+	},
+	{
+		dn:         "cn=phil,ou=people,dc=example,dc=com",
+		password:   "phil",
+		attributes: map[string][]string{"uid": {"phil"}, "objectclass": {"person"}, "memberof": {"cn=ntfy-admins,ou=groups,dc=example,dc=com"}},
+	},
+	{
+		dn:       "cn=ben,ou=people,dc=example,dc=com",
+		password: "ben",
+		attributes: map[string][]string{"uid": {"ben"}, "objectclass": {"person"}, "memberof": {
+			"cn=ntfy-devs,ou=groups,dc=example,dc=com",
+			"cn=ntfy-ops,ou=groups,dc=example,dc=com",
+			"cn=other,ou=groups,dc=example,dc=com",
+		}},
+	},
+	{
+		dn:         "cn=marian,ou=people,dc=example,dc=com",
+		password:   "marian",
+		attributes: map[string][]string{"uid": {"marian"}, "objectclass": {"person"}},
+	},
+}
+
+// newTestLDAPServer starts a fake LDAP server that only understands simple binds, searches and unbinds, and
+// returns its URL. Searches require a bind.
+func newTestLDAPServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleTestLDAPConn(conn)
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func handleTestLDAPConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	bound := false
+	for {
+		message, err := berReadElement(r)
+		if err != nil {
+			return
+		}
+		children, err := berChildren(message.content)
+		if err != nil || len(children) < 2 {
+			return
+		}
+		id, _ := berDecodeInt(children[0].content)
+		respond := func(op []byte) {
+			conn.Write(berEncode(berTagSequence, berInt(berTagInteger, id), op))
+		}
+		result := func(tag byte, code int) {
+			respond(berEncode(tag, berInt(berTagEnumerated, code), berString(berTagOctetString, ""), berString(berTagOctetString, "")))
+		}
+		op := children[1]
+		params, _ := berChildren(op.content)
+		switch op.tag {
+		case ldapTagBindRequest:
+			bound = false
+			for _, entry := range testLDAPEntries {
+				if entry.dn == string(params[1].content) && entry.password == string(params[2].content) {
+					bound = true
+				}
+			}
+			if bound {
+				result(ldapTagBindResponse, ldapResultSuccess)
+			} else {
+				result(ldapTagBindResponse, ldapResultInvalidCreds)
+			}
+		case ldapTagSearchRequest:
+			if !bound {
+				result(ldapTagSearchDone, 50) // insufficientAccessRights
+				continue
+			}
+			baseDN, filter := string(params[0].content), params[6]
+			requested, _ := berChildren(params[7].content)
+			for _, entry := range testLDAPEntries {
+				if !strings.HasSuffix(entry.dn, ","+baseDN) || !matchTestLDAPFilter(filter, entry) {
+					continue
+				}
+				attributes := make([][]byte, 0)
+				for _, name := range requested {
+					values := make([][]byte, 0)
+					for _, value := range entry.attributes[strings.ToLower(string(name.content))] {
+						values = append(values, berString(berTagOctetString, value))
+					}
+					attributes = append(attributes, berEncode(berTagSequence, berString(berTagOctetString, string(name.content)), berEncode(berTagSet, values...)))
+				}
+				respond(berEncode(ldapTagSearchEntry, berString(berTagOctetString, entry.dn), berEncode(berTagSequence, attributes...)))
+			}
+			result(ldapTagSearchDone, ldapResultSuccess)
+		default: // Unbind
+			return
+		}
+	}
+}
+
+func matchTestLDAPFilter(filter *berElement, entry *testLDAPEntry) bool {
+	children, _ := berChildren(filter.content)
+	switch filter.tag {
+	case ldapTagFilterAnd:
+		for _, child := range children {
+			if !matchTestLDAPFilter(child, entry) {
+				return false
+			}
+		}
+		return true
+	case ldapTagFilterOr:
+		for _, child := range children {
+			if matchTestLDAPFilter(child, entry) {
+				return true
+			}
+		}
+		return false
+	case ldapTagFilterNot:
+		return !matchTestLDAPFilter(children[0], entry)
+	case ldapTagFilterPresent:
+		return len(entry.attributes[strings.ToLower(string(filter.content))]) > 0
+	case ldapTagFilterEquality:
+		for _, value := range entry.attributes[strings.ToLower(string(children[0].content))] {
+			if strings.EqualFold(value, string(children[1].content)) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/util"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcTimeout              = 10 * time.Second
+	oidcClockSkew            = time.Minute // Leeway when checking the exp/nbf claims
+	oidcKeysRefreshInterval  = time.Minute // Min time between fetching the JWKS, if a token has an unknown key ID
+	oidcDefaultUsernameClaim = "preferred_username"
+	oidcDefaultGroupsClaim   = "groups"
+)
+
+var oidcDefaultScopes = []string{"openid", "profile", "email"}
+
+// OIDCConfig is the configuration of an OIDCAuth
+type OIDCConfig struct {
+	Issuer        string   // Issuer URL; the discovery document is fetched from <issuer>/.well-known/openid-configuration
+	ClientID      string   // Tokens must list the client ID in the aud (or azp) claim
+	ClientSecret  string   // Only used in the login flow, may be empty for public clients
+	Scopes        []string // Scopes requested in the login flow
+	UsernameClaim string   // Claim with the username, e.g. preferred_username
+	GroupsClaim   string   // Claim with the list of groups of the user, e.g. groups
+	AdminGroup    string   // Members of this group are admins
+	GroupAccess   []string // Access control entries for groups, format: <group>:<topic-pattern>:<permission>
+	DefaultRead   bool
+	DefaultWrite  bool
+}
+
+// OIDCAuth is an implementation of Auther and TokenAuther that authenticates users with tokens issued by an
+// OpenID Connect provider, e.g. Keycloak, Authentik or Okta. Tokens are JWTs that are validated with the signing
+// keys of the provider, so the provider is not contacted for every request. Access control entries are derived
+// from the groups listed in the token.
+//
+// OIDCAuth does not implement Manager, since users and groups are maintained by the provider.
+type OIDCAuth struct {
+	config      *OIDCConfig
+	provider    *oidcProviderMetadata
+	groups      *groupAccess
+	client      *http.Client
+	keys        map[string]crypto.PublicKey // Key ID -> key, see fetchJWKS
+	keysFetched time.Time
+	mu          sync.Mutex
+}
+
+var _ Auther = (*OIDCAuth)(nil)
+var _ TokenAuther = (*OIDCAuth)(nil)
+
+// NewOIDCAuth creates a new OIDCAuth instance. It fetches the discovery document and the signing keys of the provider.
+func NewOIDCAuth(config *OIDCConfig) (*OIDCAuth, error) {
+	if len(config.Scopes) == 0 {
+		config.Scopes = oidcDefaultScopes
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = oidcDefaultUsernameClaim
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = oidcDefaultGroupsClaim
+	}
+	groups, err := newGroupAccess(config.AdminGroup, config.GroupAccess, config.DefaultRead, config.DefaultWrite)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: oidcTimeout}
+	provider, err := fetchOIDCProviderMetadata(client, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := fetchJWKS(client, provider.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCAuth{
+		config:      config,
+		provider:    provider,
+		groups:      groups,
+		client:      client,
+		keys:        keys,
+		keysFetched: time.Now(),
+	}, nil
+}
+
+// Authenticate allows clients that only support Basic auth to pass a token as password. The username must
+// match the username in the token. Actual passwords are never sent to ntfy, only to the provider.
+func (a *OIDCAuth) Authenticate(username, password string) (*User, error) {
+	user, err := a.AuthenticateToken(password)
+	if err != nil {
+		return nil, err
+	} else if user.Name != username {
+		return nil, ErrUnauthenticated
+	}
+	return user, nil
+}
+
+// AuthenticateToken validates the signature and the claims of an ID or access token, and returns the user
+// with the role and grants of the groups in the token
+func (a *OIDCAuth) AuthenticateToken(token string) (*User, error) {
+	t, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return a.user(t)
+}
+
+// Authorize returns nil if the given user has access to the given topic using the desired
+// permission. The user param may be nil to signal an anonymous user.
+func (a *OIDCAuth) Authorize(user *User, topic string, perm Permission) error {
+	return a.groups.authorize(user, topic, perm)
+}
+
+// AuthCodeURL returns the URL of the provider's login page, for the authorization code flow with PKCE (RFC 7636).
+// The provider redirects back to redirectURL with the state and a code that can be passed to Exchange.
+func (a *OIDCAuth) AuthCodeURL(redirectURL, state, nonce, codeVerifier string) string {
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", a.config.ClientID)
+	query.Set("redirect_uri", redirectURL)
+	query.Set("scope", strings.Join(a.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(a.provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return a.provider.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange redeems the code from the login flow for an ID token at the provider's token endpoint. It returns
+// the ID token, and the user it was issued to. The nonce must match the one passed to AuthCodeURL.
+func (a *OIDCAuth) Exchange(code, redirectURL, nonce, codeVerifier string) (string, *User, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("client_id", a.config.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequest(http.MethodPost, a.provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if a.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(a.config.ClientID), url.QueryEscape(a.config.ClientSecret)) // See RFC 6749, section 2.3.1
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	var response oidcTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(&response); err != nil {
+		return "", nil, fmt.Errorf("unexpected response from token endpoint: %s", resp.Status)
+	} else if resp.StatusCode != http.StatusOK || response.IDToken == "" {
+		return "", nil, fmt.Errorf("token request failed: %s %s %s", resp.Status, response.Error, response.ErrorDescription)
+	}
+	t, err := a.verify(response.IDToken)
+	if err != nil {
+		return "", nil, err
+	} else if t.stringClaim("nonce") != nonce {
+		return "", nil, ErrUnauthenticated
+	}
+	user, err := a.user(t)
+	if err != nil {
+		return "", nil, err
+	}
+	return response.IDToken, user, nil
+}
+
+// verify checks the signature, issuer, audience and validity period of the token. Tokens that are not
+// valid for this server result in ErrUnauthenticated.
+func (a *OIDCAuth) verify(token string) (*jwt, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	key, err := a.key(t.header.Kid)
+	if err != nil {
+		return nil, err
+	} else if err := t.verify(key); err != nil {
+		return nil, ErrUnauthenticated
+	}
+	now := time.Now()
+	expires, ok := t.timeClaim("exp")
+	if !ok || now.Add(-oidcClockSkew).Unix() > expires {
+		return nil, ErrUnauthenticated
+	}
+	if notBefore, ok := t.timeClaim("nbf"); ok && now.Add(oidcClockSkew).Unix() < notBefore {
+		return nil, ErrUnauthenticated
+	}
+	if t.stringClaim("iss") != a.config.Issuer {
+		return nil, ErrUnauthenticated
+	}
+	if !util.InStringList(t.stringsClaim("aud"), a.config.ClientID) && t.stringClaim("azp") != a.config.ClientID {
+		return nil, ErrUnauthenticated
+	}
+	return t, nil
+}
+
+func (a *OIDCAuth) user(t *jwt) (*User, error) {
+	username := t.stringClaim(a.config.UsernameClaim)
+	if !AllowedUsername(username) {
+		return nil, ErrUnauthenticated
+	}
+	return a.groups.user(username, t.stringsClaim(a.config.GroupsClaim)), nil
+}
+
+// key returns the signing key with the given ID. If the key is unknown, e.g. because the provider rotated its keys,
+// the keys are fetched again, but not more often than every oidcKeysRefreshInterval.
+func (a *OIDCAuth) key(kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key := a.lookupKey(kid); key != nil {
+		return key, nil
+	} else if time.Since(a.keysFetched) < oidcKeysRefreshInterval {
+		return nil, ErrUnauthenticated
+	}
+	keys, err := fetchJWKS(a.client, a.provider.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	a.keys, a.keysFetched = keys, time.Now()
+	if key := a.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, ErrUnauthenticated
+}
+
+// lookupKey returns the key with the given ID, or the only key if the token has no key ID. The lock must be held.
+func (a *OIDCAuth) lookupKey(kid string) crypto.PublicKey {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key
+		}
+	}
+	return a.keys[kid]
+}
@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOIDCAuth_FullScenario(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	a := newTestOIDCAuth(t, p, false, false)
+
+	phil, err := a.AuthenticateToken(p.sign(t, "RS256", "rsa1", p.claims("phil", []string{"ntfy-admins"})))
+	require.Nil(t, err)
+	require.Equal(t, "phil", phil.Name)
+	require.Equal(t, RoleAdmin, phil.Role)
+
+	ben, err := a.AuthenticateToken(p.sign(t, "ES256", "ec1", p.claims("ben", []string{"ntfy-devs", "/NTFY-OPS", "other"})))
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+	require.Equal(t, RoleUser, ben.Role)
+	require.Equal(t, []Grant{
+		{TopicPattern: "alerts*", AllowRead: true, AllowWrite: false},
+		{TopicPattern: "builds", AllowRead: true, AllowWrite: true},
+		{TopicPattern: "alerts-ops", AllowRead: false, AllowWrite: true},
+	}, ben.Grants)
+
+	require.Nil(t, a.Authorize(phil, "sometopic", PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "alerts-ops", PermissionRead))
+	require.Nil(t, a.Authorize(ben, "alerts-ops", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts-db", PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "announcements", PermissionRead))
+	require.Nil(t, a.Authorize(nil, "announcements", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "builds", PermissionRead))
+}
+
+func TestOIDCAuth_AuthenticateToken_Invalid(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	a := newTestOIDCAuth(t, p, false, false)
+	for name, modify := range map[string]func(claims map[string]interface{}){
+		"expired":          func(c map[string]interface{}) { c["exp"] = time.Now().Add(-2 * time.Minute).Unix() },
+		"no expiry":        func(c map[string]interface{}) { delete(c, "exp") },
+		"not yet valid":    func(c map[string]interface{}) { c["nbf"] = time.Now().Add(2 * time.Minute).Unix() },
+		"wrong issuer":     func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"wrong audience":   func(c map[string]interface{}) { c["aud"] = []string{"other-client"} },
+		"no username":      func(c map[string]interface{}) { delete(c, "preferred_username") },
+		"invalid username": func(c map[string]interface{}) { c["preferred_username"] = "*" },
+	} {
+		claims := p.claims("ben", nil)
+		modify(claims)
+		_, err := a.AuthenticateToken(p.sign(t, "RS256", "rsa1", claims))
+		require.Equal(t, ErrUnauthenticated, err, name)
+	}
+
+	valid := p.sign(t, "RS256", "rsa1", p.claims("ben", nil))
+	parts := strings.Split(valid, ".")
+	payload, _ := json.Marshal(p.claims("phil", []string{"ntfy-admins"}))
+	for name, token := range map[string]string{
+		"tampered":      parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2],
+		"alg none":      p.signWithKey(`{"alg":"none"}`, nil, p.claims("ben", nil)),
+		"alg HS256":     p.signWithKey(`{"alg":"HS256","kid":"rsa1"}`, nil, p.claims("ben", nil)),
+		"key mismatch":  p.sign(t, "ES256", "rsa1", p.claims("ben", nil)),
+		"unknown key":   p.sign(t, "RS256", "doesnotexist", p.claims("ben", nil)),
+		"not a JWT":     "not-a-jwt",
+		"no signature":  parts[0] + "." + parts[1] + ".",
+		"invalid parts": "a.b.c",
+	} {
+		_, err := a.AuthenticateToken(token)
+		require.Equal(t, ErrUnauthenticated, err, name)
+	}
+}
+
+func TestOIDCAuth_AuthenticateToken_Audience(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	a := newTestOIDCAuth(t, p, false, false)
+
+	claims := p.claims("ben", nil)
+	claims["aud"] = "ntfy"
+	_, err := a.AuthenticateToken(p.sign(t, "RS256", "rsa1", claims))
+	require.Nil(t, err)
+
+	claims["aud"] = "account" // Access tokens, e.g. Keycloak
+	claims["azp"] = "ntfy"
+	_, err = a.AuthenticateToken(p.sign(t, "RS256", "rsa1", claims))
+	require.Nil(t, err)
+}
+
+func TestOIDCAuth_Authenticate_TokenAsPassword(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	a := newTestOIDCAuth(t, p, false, false)
+	token := p.sign(t, "RS256", "rsa1", p.claims("ben", []string{"ntfy-devs"}))
+
+	ben, err := a.Authenticate("ben", token)
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+
+	_, err = a.Authenticate("phil", token)
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.Authenticate("ben", "ben")
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestOIDCAuth_KeyRotation(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	a := newTestOIDCAuth(t, p, false, false)
+	p.addRSAKey(t, "rsa2")
+	token := p.sign(t, "RS256", "rsa2", p.claims("ben", nil))
+
+	_, err := a.AuthenticateToken(token) // Keys were just fetched
+	require.Equal(t, ErrUnauthenticated, err)
+
+	a.keysFetched = time.Now().Add(-2 * oidcKeysRefreshInterval)
+	ben, err := a.AuthenticateToken(token)
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+}
+
+func TestOIDCAuth_LoginFlow(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	a := newTestOIDCAuth(t, p, false, false)
+	redirectURL := "https://ntfy.example.com/auth/oidc/callback"
+
+	u, err := url.Parse(a.AuthCodeURL(redirectURL, "mystate", "mynonce", "myverifier"))
+	require.Nil(t, err)
+	require.Equal(t, p.server.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	require.Equal(t, "code", u.Query().Get("response_type"))
+	require.Equal(t, "ntfy", u.Query().Get("client_id"))
+	require.Equal(t, redirectURL, u.Query().Get("redirect_uri"))
+	require.Equal(t, "openid profile email", u.Query().Get("scope"))
+	require.Equal(t, "mystate", u.Query().Get("state"))
+	require.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+
+	code := p.authorize(t, u.Query(), p.claims("ben", []string{"ntfy-devs"}))
+	token, ben, err := a.Exchange(code, redirectURL, "mynonce", "myverifier")
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+	require.Equal(t, 2, len(ben.Grants))
+	user, err := a.AuthenticateToken(token)
+	require.Nil(t, err)
+	require.Equal(t, "ben", user.Name)
+
+	_, _, err = a.Exchange(code, redirectURL, "mynonce", "myverifier") // Codes can only be used once
+	require.Error(t, err)
+
+	code = p.authorize(t, u.Query(), p.claims("ben", nil))
+	_, _, err = a.Exchange(code, redirectURL, "mynonce", "wrongverifier")
+	require.Error(t, err)
+
+	code = p.authorize(t, u.Query(), p.claims("ben", nil))
+	_, _, err = a.Exchange(code, redirectURL, "othernonce", "myverifier")
+	require.Equal(t, ErrUnauthenticated, err)
+}
+
+func TestNewOIDCAuth_Invalid(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	for _, conf := range []*OIDCConfig{
+		{Issuer: p.server.URL + "/other", ClientID: "ntfy"},
+		{Issuer: p.server.URL, ClientID: "ntfy", GroupAccess: []string{"ntfy-devs:alerts*"}},
+		{Issuer: "http://127.0.0.1:1", ClientID: "ntfy"},
+	} {
+		_, err := NewOIDCAuth(conf)
+		require.Error(t, err, conf)
+	}
+}
+
+func newTestOIDCAuth(t *testing.T, p *testOIDCProvider, defaultRead, defaultWrite bool) *OIDCAuth {
+	a, err := NewOIDCAuth(&OIDCConfig{
+		Issuer:       p.server.URL,
+		ClientID:     "ntfy",
+		ClientSecret: "secret",
+		AdminGroup:   "ntfy-admins",
+		GroupAccess: []string{
+			"ntfy-devs:alerts*:read-only",
+			"ntfy-devs:builds:rw",
+			"/ntfy-ops:alerts-ops:write-only",
+			"*:announcements:ro",
+		},
+		DefaultRead:  defaultRead,
+		DefaultWrite: defaultWrite,
+	})
+	require.Nil(t, err)
+	return a
+}
+
+// testOIDCProvider is a fake OpenID Connect provider with an RSA and an EC signing key. Codes for the token
+// endpoint are issued with authorize, instead of a login page.
+type testOIDCProvider struct {
+	server *httptest.Server
+	keys   map[string]crypto.Signer
+	codes  map[string]*testOIDCCode
+	mu     sync.Mutex
+}
+
+type testOIDCCode struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	p := &testOIDCProvider{
+		keys:  make(map[string]crypto.Signer),
+		codes: make(map[string]*testOIDCCode),
+	}
+	p.addRSAKey(t, "rsa1")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	p.keys["ec1"] = ecKey
+	p.server = httptest.NewServer(http.HandlerFunc(p.handle))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *testOIDCProvider) addRSAKey(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	p.mu.Lock()
+	p.keys[kid] = key
+	p.mu.Unlock()
+}
+
+func (p *testOIDCProvider) handle(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch r.URL.Path {
+	case oidcDiscoveryPath:
+		json.NewEncoder(w).Encode(&oidcProviderMetadata{
+			Issuer:                p.server.URL,
+			AuthorizationEndpoint: p.server.URL + "/authorize",
+			TokenEndpoint:         p.server.URL + "/token",
+			JWKSURI:               p.server.URL + "/jwks",
+		})
+	case "/jwks":
+		keys := make([]*jwk, 0)
+		for kid, key := range p.keys {
+			switch k := key.Public().(type) {
+			case *rsa.PublicKey:
+				keys = append(keys, &jwk{Kty: "RSA", Kid: kid, Use: "sig", N: encodeTestJWKInt(k.N), E: encodeTestJWKInt(big.NewInt(int64(k.E)))})
+			case *ecdsa.PublicKey:
+				keys = append(keys, &jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: encodeTestJWKInt(k.X), Y: encodeTestJWKInt(k.Y)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	case "/token":
+		clientID, clientSecret, _ := r.BasicAuth()
+		code, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if clientID != "ntfy" || clientSecret != "secret" || !ok || code.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&oidcTokenResponse{Error: "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(&oidcTokenResponse{IDToken: p.signLocked("RS256", "rsa1", code.claims)})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorize simulates a successful login, and returns the code that is sent to the redirect URL
+func (p *testOIDCProvider) authorize(t *testing.T, query url.Values, claims map[string]interface{}) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	require.Nil(t, err)
+	code := base64.RawURLEncoding.EncodeToString(b)
+	claims["nonce"] = query.Get("nonce")
+	p.codes[code] = &testOIDCCode{challenge: query.Get("code_challenge"), claims: claims}
+	return code
+}
+
+func (p *testOIDCProvider) claims(username string, groups []string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                p.server.URL,
+		"aud":                []string{"ntfy", "other"},
+		"sub":                "f7c4c8a0-" + username,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"preferred_username": username,
+		"groups":             groups,
+	}
+}
+
+func (p *testOIDCProvider) sign(_ *testing.T, alg, kid string, claims map[string]interface{}) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.signLocked(alg, kid, claims)
+}
+
+func (p *testOIDCProvider) signLocked(alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(&jwtHeader{Alg: alg, Kid: kid})
+	key := p.keys[kid]
+	if key == nil {
+		key = p.keys["rsa1"]
+	}
+	if alg == "ES256" {
+		key = p.keys["ec1"]
+	}
+	return p.signWithKey(string(header), key, claims)
+}
+
+func (p *testOIDCProvider) signWithKey(header string, key crypto.Signer, claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		signature = []byte("invalid")
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeTestJWKInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
@@ -1,17 +1,25 @@
 package auth
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 	"golang.org/x/crypto/bcrypt"
+	"log"
+	"math/big"
+	"net"
 	"strings"
+	"time"
 )
 
 const (
 	bcryptCost              = 10
 	intentionalSlowDownHash = "$2a$10$YFCQvqQDwIIwnJM1xkAYOeih0dg17UVGanaTStnrSzC8NCWxcLDwy" // Cost should match bcryptCost
+	tokenPrefix             = "tk_"
+	tokenLength             = 32 // Including prefix
+	tokenCharset            = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 )
 
 // Auther-related queries
@@ -21,65 +29,224 @@ const (
 		CREATE TABLE IF NOT EXISTS user (
 			user TEXT NOT NULL PRIMARY KEY,
 			pass TEXT NOT NULL,
-			role TEXT NOT NULL
+			role TEXT NOT NULL,
+			tier TEXT NOT NULL DEFAULT(''),
+			totp_secret TEXT NOT NULL DEFAULT(''),
+			totp_pending TEXT NOT NULL DEFAULT('')
 		);
 		CREATE TABLE IF NOT EXISTS access (
 			user TEXT NOT NULL,		
 			topic TEXT NOT NULL,
 			read INT NOT NULL,
 			write INT NOT NULL,
+			owner TEXT NOT NULL DEFAULT(''),
+			deny INT NOT NULL DEFAULT(0),
 			PRIMARY KEY (topic, user)
 		);
+		CREATE TABLE IF NOT EXISTS token (
+			token TEXT NOT NULL PRIMARY KEY,
+			user TEXT NOT NULL,
+			label TEXT NOT NULL,
+			expires INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS token_access (
+			token TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			PRIMARY KEY (token, topic)
+		);
+		CREATE TABLE IF NOT EXISTS tier (
+			code TEXT NOT NULL PRIMARY KEY,
+			reservations_limit INT NOT NULL,
+			messages_limit INT NOT NULL DEFAULT(0),
+			emails_limit INT NOT NULL DEFAULT(0),
+			attachment_total_size_limit INT NOT NULL DEFAULT(0),
+			max_delay INT NOT NULL DEFAULT(0),
+			sms_limit INT NOT NULL DEFAULT(0),
+			calls_limit INT NOT NULL DEFAULT(0)
+		);
+		CREATE TABLE IF NOT EXISTS reservation_ip (
+			topic TEXT NOT NULL,
+			owner TEXT NOT NULL,
+			cidr TEXT NOT NULL,
+			deny INT NOT NULL,
+			PRIMARY KEY (topic, cidr)
+		);
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
 			version INT NOT NULL
 		);
 		COMMIT;
 	`
-	selectUserQuery       = `SELECT pass, role FROM user WHERE user = ?`
-	selectTopicPermsQuery = `
-		SELECT read, write 
+	selectUserQuery = `
+		SELECT u.pass, u.role, u.totp_secret, t.code, t.reservations_limit, t.messages_limit, t.emails_limit, t.attachment_total_size_limit, t.max_delay, t.sms_limit, t.calls_limit
+		FROM "user" u
+		LEFT JOIN tier t ON t.code = u.tier
+		WHERE u."user" = ?
+	`
+	selectTokenQuery       = `SELECT "user", label, expires FROM token WHERE token = ?`
+	selectTokenAccessQuery = `SELECT topic, read, write, 0 FROM token_access WHERE token = ? ORDER BY rowid`
+	selectTopicPermsQuery  = `
+		SELECT topic, read, write, deny
 		FROM access 
-		WHERE user IN ('*', ?) AND ? LIKE topic
-		ORDER BY user DESC
+		WHERE "user" IN ('*', ?)
+		ORDER BY "user" = '*', topic <> ?, owner = '', length(topic) DESC, topic
 	`
 )
 
 // Manager-related queries
 const (
-	insertUserQuery      = `INSERT INTO user (user, pass, role) VALUES (?, ?, ?)`
-	selectUsernamesQuery = `SELECT user FROM user ORDER BY role, user`
-	updateUserPassQuery  = `UPDATE user SET pass = ? WHERE user = ?`
-	updateUserRoleQuery  = `UPDATE user SET role = ? WHERE user = ?`
-	deleteUserQuery      = `DELETE FROM user WHERE user = ?`
+	insertUserQuery      = `INSERT INTO "user" ("user", pass, role) VALUES (?, ?, ?)`
+	selectUsernamesQuery = `SELECT "user" FROM "user" ORDER BY role, "user"`
+	updateUserPassQuery  = `UPDATE "user" SET pass = ? WHERE "user" = ?`
+	updateUserRoleQuery  = `UPDATE "user" SET role = ? WHERE "user" = ?`
+	updateUserTierQuery  = `UPDATE "user" SET tier = ? WHERE "user" = ?`
+	updateUserTOTPQuery  = `UPDATE "user" SET totp_secret = ?, totp_pending = ? WHERE "user" = ?`
+	selectUserTOTPQuery  = `SELECT totp_pending FROM "user" WHERE "user" = ?`
+	deleteUserQuery      = `DELETE FROM "user" WHERE "user" = ?`
 
 	upsertUserAccessQuery = `
-		INSERT INTO access (user, topic, read, write) 
-		VALUES (?, ?, ?, ?)
-		ON CONFLICT (user, topic) DO UPDATE SET read=excluded.read, write=excluded.write
+		INSERT INTO access ("user", topic, read, write, deny) 
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT ("user", topic) DO UPDATE SET read=excluded.read, write=excluded.write, deny=excluded.deny
+	`
+	selectUserAccessQuery    = `SELECT topic, read, write, deny FROM access WHERE "user" = ?`
+	deleteAllAccessQuery     = `DELETE FROM access`
+	deleteUserAccessQuery    = `DELETE FROM access WHERE "user" = ? OR owner = ?`
+	deleteTopicAccessQuery   = `DELETE FROM access WHERE ("user" = ? OR owner = ?) AND topic = ?`
+	deleteUnownedAccessQuery = `DELETE FROM access WHERE "user" = ? AND owner = ''`
+
+	upsertReservationAccessQuery = `
+		INSERT INTO access ("user", topic, read, write, deny, owner) 
+		VALUES (?, ?, ?, ?, 0, ?)
+		ON CONFLICT ("user", topic) DO UPDATE SET read=excluded.read, write=excluded.write, deny=0, owner=excluded.owner
+	`
+	selectTopicOwnersQuery      = `SELECT "user", owner FROM access WHERE topic = ?`
+	selectUserReservationsQuery = `
+		SELECT a_user.topic, a_everyone.read, a_everyone.write
+		FROM access a_user
+		LEFT JOIN access a_everyone ON a_everyone.topic = a_user.topic AND a_everyone."user" = '*'
+		WHERE a_user."user" = ? AND a_user.owner = a_user."user"
+		ORDER BY a_user.topic
 	`
-	selectUserAccessQuery  = `SELECT topic, read, write FROM access WHERE user = ?`
-	deleteAllAccessQuery   = `DELETE FROM access`
-	deleteUserAccessQuery  = `DELETE FROM access WHERE user = ?`
-	deleteTopicAccessQuery = `DELETE FROM access WHERE user = ? AND topic = ?`
+	deleteReservationQuery = `DELETE FROM access WHERE owner = ? AND topic = ?`
+
+	insertReservationIPQuery       = `INSERT INTO reservation_ip (topic, owner, cidr, deny) VALUES (?, ?, ?, ?)`
+	deleteTopicReservationIPsQuery = `DELETE FROM reservation_ip WHERE topic = ?`
+	deleteReservationIPsQuery      = `DELETE FROM reservation_ip WHERE owner = ? AND topic = ?`
+	deleteUserReservationIPsQuery  = `DELETE FROM reservation_ip WHERE owner = ?`
+	selectUserReservationIPsQuery  = `SELECT topic, cidr, deny FROM reservation_ip WHERE owner = ? ORDER BY topic, cidr`
+	selectReservationIPsQuery      = `
+		SELECT r.topic, r.cidr, r.deny
+		FROM reservation_ip r
+		JOIN access a ON a.topic = r.topic AND a."user" = r.owner AND a.owner = r.owner
+		ORDER BY r.topic, r.cidr
+	`
+
+	insertTierQuery     = `INSERT INTO tier (code, reservations_limit, messages_limit, emails_limit, attachment_total_size_limit, max_delay, sms_limit, calls_limit) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	updateTierQuery     = `UPDATE tier SET reservations_limit = ?, messages_limit = ?, emails_limit = ?, attachment_total_size_limit = ?, max_delay = ?, sms_limit = ?, calls_limit = ? WHERE code = ?`
+	selectTierQuery     = `SELECT code, reservations_limit, messages_limit, emails_limit, attachment_total_size_limit, max_delay, sms_limit, calls_limit FROM tier WHERE code = ?`
+	selectTiersQuery    = `SELECT code, reservations_limit, messages_limit, emails_limit, attachment_total_size_limit, max_delay, sms_limit, calls_limit FROM tier ORDER BY code`
+	deleteTierQuery     = `DELETE FROM tier WHERE code = ?`
+	resetUsersTierQuery = `UPDATE "user" SET tier = '' WHERE tier = ?`
+
+	insertTokenQuery           = `INSERT INTO token (token, "user", label, expires) VALUES (?, ?, ?, ?)`
+	insertTokenAccessQuery     = `INSERT INTO token_access (token, topic, read, write) VALUES (?, ?, ?, ?)`
+	selectUserTokensQuery      = `SELECT token FROM token WHERE "user" = ? ORDER BY rowid`
+	deleteTokenQuery           = `DELETE FROM token WHERE "user" = ? AND token = ?`
+	deleteTokenAccessQuery     = `DELETE FROM token_access WHERE token IN (SELECT token FROM token WHERE "user" = ? AND token = ?)`
+	deleteUserTokensQuery      = `DELETE FROM token WHERE "user" = ?`
+	deleteUserTokenAccessQuery = `DELETE FROM token_access WHERE token IN (SELECT token FROM token WHERE "user" = ?)`
 )
 
 // Schema management queries
 const (
-	currentSchemaVersion     = 1
+	currentSchemaVersion     = 9
 	insertSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
+	updateSchemaVersion      = `UPDATE schemaVersion SET version = ? WHERE id = 1`
 	selectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
+
+	// 1 -> 2
+	migrate1To2CreateTokenTablesQueries = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS token (
+			token TEXT NOT NULL PRIMARY KEY,
+			user TEXT NOT NULL,
+			label TEXT NOT NULL,
+			expires INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS token_access (
+			token TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			read INT NOT NULL,
+			write INT NOT NULL,
+			PRIMARY KEY (token, topic)
+		);
+		COMMIT;
+	`
+
+	// 2 -> 3
+	migrate2To3AddTiersAndReservationsQueries = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS tier (
+			code TEXT NOT NULL PRIMARY KEY,
+			reservations_limit INT NOT NULL
+		);
+		ALTER TABLE user ADD COLUMN tier TEXT NOT NULL DEFAULT('');
+		ALTER TABLE access ADD COLUMN owner TEXT NOT NULL DEFAULT('');
+		COMMIT;
+	`
+
+	// 3 -> 4
+	migrate3To4AddAccessDenyQuery = `ALTER TABLE access ADD COLUMN deny INT NOT NULL DEFAULT(0)`
+
+	// 4 -> 5
+	migrate4To5AddUserTOTPQueries = `
+		BEGIN;
+		ALTER TABLE "user" ADD COLUMN totp_secret TEXT NOT NULL DEFAULT('');
+		ALTER TABLE "user" ADD COLUMN totp_pending TEXT NOT NULL DEFAULT('');
+		COMMIT;
+	`
+
+	// 5 -> 6
+	migrate5To6AddTierLimitsQueries = `
+		BEGIN;
+		ALTER TABLE tier ADD COLUMN messages_limit INT NOT NULL DEFAULT(0);
+		ALTER TABLE tier ADD COLUMN emails_limit INT NOT NULL DEFAULT(0);
+		ALTER TABLE tier ADD COLUMN attachment_total_size_limit INT NOT NULL DEFAULT(0);
+		ALTER TABLE tier ADD COLUMN max_delay INT NOT NULL DEFAULT(0);
+		COMMIT;
+	`
+
+	// 6 -> 7
+	migrate6To7AddReservationIPsQuery = `
+		CREATE TABLE IF NOT EXISTS reservation_ip (
+			topic TEXT NOT NULL,
+			owner TEXT NOT NULL,
+			cidr TEXT NOT NULL,
+			deny INT NOT NULL,
+			PRIMARY KEY (topic, cidr)
+		)
+	`
+
+	// 7 -> 8
+	migrate7To8AddTierSMSLimitQuery = `ALTER TABLE tier ADD COLUMN sms_limit INT NOT NULL DEFAULT(0)`
+
+	// 8 -> 9
+	migrate8To9AddTierCallsLimitQuery = `ALTER TABLE tier ADD COLUMN calls_limit INT NOT NULL DEFAULT(0)`
 )
 
-// SQLiteAuth is an implementation of Auther and Manager. It stores users and access control list
-// in a SQLite database.
+// SQLiteAuth is an implementation of Auther, TokenAuther and Manager. It stores users, access control list
+// and access tokens in a SQLite database.
 type SQLiteAuth struct {
-	db           *sql.DB
+	db           *authDB
 	defaultRead  bool
 	defaultWrite bool
 }
 
 var _ Auther = (*SQLiteAuth)(nil)
+var _ TokenAuther = (*SQLiteAuth)(nil)
 var _ Manager = (*SQLiteAuth)(nil)
 
 // NewSQLiteAuth creates a new SQLiteAuth instance
@@ -92,7 +259,7 @@ func NewSQLiteAuth(filename string, defaultRead, defaultWrite bool) (*SQLiteAuth
 		return nil, err
 	}
 	return &SQLiteAuth{
-		db:           db,
+		db:           &authDB{DB: db},
 		defaultRead:  defaultRead,
 		defaultWrite: defaultWrite,
 	}, nil
@@ -117,9 +284,35 @@ func (a *SQLiteAuth) Authenticate(username, password string) (*User, error) {
 	return user, nil
 }
 
+// AuthenticateToken checks the access token and returns the user it belongs to, if the token
+// exists and has not expired. The token's grants are attached to the user (see User.Token).
+func (a *SQLiteAuth) AuthenticateToken(token string) (*User, error) {
+	if !strings.HasPrefix(token, tokenPrefix) || len(token) != tokenLength {
+		return nil, ErrUnauthenticated
+	}
+	username, t, err := a.token(token)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	} else if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+		return nil, ErrUnauthenticated
+	}
+	user, err := a.User(username)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	user.Token = t
+	return user, nil
+}
+
 // Authorize returns nil if the given user has access to the given topic using the desired
 // permission. The user param may be nil to signal an anonymous user.
 func (a *SQLiteAuth) Authorize(user *User, topic string, perm Permission) error {
+	if user != nil && user.Token != nil {
+		perms, _ := matchGrants(user.Token.Grants, topic)
+		if err := resolvePerms(perms, perm); err != nil {
+			return err // Tokens restrict access further, even for admins
+		}
+	}
 	if user != nil && user.Role == RoleAdmin {
 		return nil // Admin can do everything
 	}
@@ -127,30 +320,33 @@ func (a *SQLiteAuth) Authorize(user *User, topic string, perm Permission) error
 	if user != nil {
 		username = user.Name
 	}
-	// Select the read/write permissions for this user/topic combo. The query may return two
-	// rows (one for everyone, and one for the user), but prioritizes the user. The value for
-	// user.Name may be empty (= everyone).
+	// Select the read/write permissions (and denied fine-grained permissions) of the most specific entry
+	// matching this user/topic combo. The entries of the user are prioritized over the entries for
+	// everyone, and an exact match over patterns, of which longer ones go first. Topic patterns may be
+	// regular expressions, so they are matched here (with the compiled regexes cached), not in SQL.
 	rows, err := a.db.Query(selectTopicPermsQuery, username, topic)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
-	if !rows.Next() {
-		return a.resolvePerms(a.defaultRead, a.defaultWrite, perm)
+	for rows.Next() {
+		var pattern string
+		var read, write bool
+		var deny Permission
+		if err := rows.Scan(&pattern, &read, &write, &deny); err != nil {
+			return err
+		} else if topicPatternMatches(fromSQLWildcard(pattern), topic) {
+			return resolvePerms(grantPermissions(read, write, deny), perm)
+		}
 	}
-	var read, write bool
-	if err := rows.Scan(&read, &write); err != nil {
-		return err
-	} else if err := rows.Err(); err != nil {
+	if err := rows.Err(); err != nil {
 		return err
 	}
-	return a.resolvePerms(read, write, perm)
+	return resolvePerms(grantPermissions(a.defaultRead, a.defaultWrite, 0), perm)
 }
 
-func (a *SQLiteAuth) resolvePerms(read, write bool, perm Permission) error {
-	if perm == PermissionRead && read {
-		return nil
-	} else if perm == PermissionWrite && write {
+func resolvePerms(perms, perm Permission) error {
+	if perms&perm != 0 {
 		return nil
 	}
 	return ErrUnauthorized
@@ -162,16 +358,35 @@ func (a *SQLiteAuth) AddUser(username, password string, role Role) error {
 	if !AllowedUsername(username) || !AllowedRole(role) {
 		return ErrInvalidArgument
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	hash, err := HashPassword(password)
 	if err != nil {
 		return err
 	}
-	if _, err = a.db.Exec(insertUserQuery, username, hash, role); err != nil {
+	return a.AddUserHash(username, hash, role)
+}
+
+// AddUserHash is like AddUser, but takes a password that was already hashed with HashPassword
+func (a *SQLiteAuth) AddUserHash(username, hash string, role Role) error {
+	if !AllowedUsername(username) || !AllowedRole(role) {
+		return ErrInvalidArgument
+	} else if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return ErrInvalidArgument
+	}
+	if _, err := a.db.Exec(insertUserQuery, username, hash, role); err != nil {
 		return err
 	}
 	return nil
 }
 
+// HashPassword hashes a password with bcrypt, as stored by AddUser
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
 // RemoveUser deletes the user with the given username. The function returns nil on success, even
 // if the user did not exist in the first place.
 func (a *SQLiteAuth) RemoveUser(username string) error {
@@ -181,7 +396,16 @@ func (a *SQLiteAuth) RemoveUser(username string) error {
 	if _, err := a.db.Exec(deleteUserQuery, username); err != nil {
 		return err
 	}
-	if _, err := a.db.Exec(deleteUserAccessQuery, username); err != nil {
+	if _, err := a.db.Exec(deleteUserAccessQuery, username, username); err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(deleteUserTokenAccessQuery, username); err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(deleteUserTokensQuery, username); err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(deleteUserReservationIPsQuery, username); err != nil {
 		return err
 	}
 	return nil
@@ -232,25 +456,42 @@ func (a *SQLiteAuth) User(username string) (*User, error) {
 		return nil, err
 	}
 	defer rows.Close()
-	var hash, role string
+	var hash, role, totpSecret string
+	var tierCode sql.NullString
+	var tierReservationsLimit, tierMessagesLimit, tierEmailsLimit, tierAttachmentTotalSizeLimit, tierMaxDelay, tierSMSLimit, tierCallsLimit sql.NullInt64
 	if !rows.Next() {
 		return nil, ErrNotFound
 	}
-	if err := rows.Scan(&hash, &role); err != nil {
+	if err := rows.Scan(&hash, &role, &totpSecret, &tierCode, &tierReservationsLimit, &tierMessagesLimit, &tierEmailsLimit, &tierAttachmentTotalSizeLimit, &tierMaxDelay, &tierSMSLimit, &tierCallsLimit); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	rows.Close()
 	grants, err := a.readGrants(username)
 	if err != nil {
 		return nil, err
 	}
-	return &User{
+	user := &User{
 		Name:   username,
 		Hash:   hash,
 		Role:   Role(role),
 		Grants: grants,
-	}, nil
+		TOTP:   totpSecret,
+	}
+	if tierCode.Valid {
+		user.Tier = &Tier{
+			Code:                     tierCode.String,
+			ReservationsLimit:        int(tierReservationsLimit.Int64),
+			MessagesLimit:            tierMessagesLimit.Int64,
+			EmailsLimit:              tierEmailsLimit.Int64,
+			AttachmentTotalSizeLimit: tierAttachmentTotalSizeLimit.Int64,
+			MaxDelay:                 time.Duration(tierMaxDelay.Int64) * time.Second,
+			SMSLimit:                 tierSMSLimit.Int64,
+			CallsLimit:               tierCallsLimit.Int64,
+		}
+	}
+	return user, nil
 }
 
 func (a *SQLiteAuth) everyoneUser() (*User, error) {
@@ -267,7 +508,11 @@ func (a *SQLiteAuth) everyoneUser() (*User, error) {
 }
 
 func (a *SQLiteAuth) readGrants(username string) ([]Grant, error) {
-	rows, err := a.db.Query(selectUserAccessQuery, username)
+	return a.queryGrants(selectUserAccessQuery, username)
+}
+
+func (a *SQLiteAuth) queryGrants(query string, args ...interface{}) ([]Grant, error) {
+	rows, err := a.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -276,7 +521,8 @@ func (a *SQLiteAuth) readGrants(username string) ([]Grant, error) {
 	for rows.Next() {
 		var topic string
 		var read, write bool
-		if err := rows.Scan(&topic, &read, &write); err != nil {
+		var deny Permission
+		if err := rows.Scan(&topic, &read, &write, &deny); err != nil {
 			return nil, err
 		} else if err := rows.Err(); err != nil {
 			return nil, err
@@ -285,6 +531,7 @@ func (a *SQLiteAuth) readGrants(username string) ([]Grant, error) {
 			TopicPattern: fromSQLWildcard(topic),
 			AllowRead:    read,
 			AllowWrite:   write,
+			Deny:         deny,
 		})
 	}
 	return grants, nil
@@ -304,6 +551,7 @@ func (a *SQLiteAuth) ChangePassword(username, password string) error {
 
 // ChangeRole changes a user's role. When a role is changed from RoleUser to RoleAdmin,
 // all existing access control entries (Grant) are removed, since they are no longer needed.
+// Topics reserved by the user stay reserved.
 func (a *SQLiteAuth) ChangeRole(username string, role Role) error {
 	if !AllowedUsername(username) || !AllowedRole(role) {
 		return ErrInvalidArgument
@@ -312,7 +560,7 @@ func (a *SQLiteAuth) ChangeRole(username string, role Role) error {
 		return err
 	}
 	if role == RoleAdmin {
-		if _, err := a.db.Exec(deleteUserAccessQuery, username); err != nil {
+		if _, err := a.db.Exec(deleteUnownedAccessQuery, username); err != nil {
 			return err
 		}
 	}
@@ -322,17 +570,28 @@ func (a *SQLiteAuth) ChangeRole(username string, role Role) error {
 // AllowAccess adds or updates an entry in th access control list for a specific user. It controls
 // read/write access to a topic. The parameter topicPattern may include wildcards (*).
 func (a *SQLiteAuth) AllowAccess(username string, topicPattern string, read bool, write bool) error {
-	if (!AllowedUsername(username) && username != Everyone) || !AllowedTopicPattern(topicPattern) {
+	return a.allowGrant(username, Grant{TopicPattern: topicPattern, AllowRead: read, AllowWrite: write})
+}
+
+// AllowPermissions is like AllowAccess, but only grants the given fine-grained permissions to a topic,
+// e.g. PermissionPublish to allow publishing, but not attaching files or forwarding e-mails.
+func (a *SQLiteAuth) AllowPermissions(username string, topicPattern string, perms Permission) error {
+	return a.allowGrant(username, newGrant(topicPattern, perms))
+}
+
+func (a *SQLiteAuth) allowGrant(username string, grant Grant) error {
+	if (!AllowedUsername(username) && username != Everyone) || !AllowedTopicPattern(grant.TopicPattern) {
 		return ErrInvalidArgument
 	}
-	if _, err := a.db.Exec(upsertUserAccessQuery, username, toSQLWildcard(topicPattern), read, write); err != nil {
+	if _, err := a.db.Exec(upsertUserAccessQuery, username, toSQLWildcard(grant.TopicPattern), grant.AllowRead, grant.AllowWrite, grant.Deny); err != nil {
 		return err
 	}
 	return nil
 }
 
 // ResetAccess removes an access control list entry for a specific username/topic, or (if topic is
-// empty) for an entire user. The parameter topicPattern may include wildcards (*).
+// empty) for an entire user. The parameter topicPattern may include wildcards (*). Topics reserved
+// by the user are released as well.
 func (a *SQLiteAuth) ResetAccess(username string, topicPattern string) error {
 	if !AllowedUsername(username) && username != Everyone && username != "" {
 		return ErrInvalidArgument
@@ -340,13 +599,13 @@ func (a *SQLiteAuth) ResetAccess(username string, topicPattern string) error {
 		return ErrInvalidArgument
 	}
 	if username == "" && topicPattern == "" {
-		_, err := a.db.Exec(deleteAllAccessQuery, username)
+		_, err := a.db.Exec(deleteAllAccessQuery)
 		return err
 	} else if topicPattern == "" {
-		_, err := a.db.Exec(deleteUserAccessQuery, username)
+		_, err := a.db.Exec(deleteUserAccessQuery, username, username)
 		return err
 	}
-	_, err := a.db.Exec(deleteTopicAccessQuery, username, toSQLWildcard(topicPattern))
+	_, err := a.db.Exec(deleteTopicAccessQuery, username, username, toSQLWildcard(topicPattern))
 	return err
 }
 
@@ -355,11 +614,443 @@ func (a *SQLiteAuth) DefaultAccess() (read bool, write bool) {
 	return a.defaultRead, a.defaultWrite
 }
 
+// AddToken creates a new access token for a user, which is limited to the given topics and permissions.
+// At least one grant must be passed. If expires is zero, the token does not expire.
+func (a *SQLiteAuth) AddToken(username, label string, grants []Grant, expires time.Time) (*Token, error) {
+	if !AllowedUsername(username) || len(grants) == 0 {
+		return nil, ErrInvalidArgument
+	}
+	for _, grant := range grants {
+		if !AllowedTopicPattern(grant.TopicPattern) {
+			return nil, ErrInvalidArgument
+		}
+	}
+	if _, err := a.User(username); err != nil {
+		return nil, err
+	}
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	var expiresUnix int64
+	if !expires.IsZero() {
+		expiresUnix = expires.Unix()
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(a.db.rebind(insertTokenQuery), token, username, label, expiresUnix); err != nil {
+		return nil, err
+	}
+	for _, grant := range grants {
+		if _, err := tx.Exec(a.db.rebind(insertTokenAccessQuery), token, toSQLWildcard(grant.TopicPattern), grant.AllowRead, grant.AllowWrite); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	_, t, err := a.token(token)
+	return t, err
+}
+
+// Tokens returns the access tokens of a user, including expired tokens
+func (a *SQLiteAuth) Tokens(username string) ([]*Token, error) {
+	rows, err := a.db.Query(selectUserTokensQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	rows.Close()
+	tokens := make([]*Token, 0)
+	for _, value := range values {
+		_, token, err := a.token(value)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// RemoveToken deletes an access token of a user. The function returns nil on success, even
+// if the token did not exist in the first place.
+func (a *SQLiteAuth) RemoveToken(username, token string) error {
+	if _, err := a.db.Exec(deleteTokenAccessQuery, username, token); err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(deleteTokenQuery, username, token); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddReservation reserves a topic for a user: the user is granted read-write access to the topic, and everyone
+// else the given access. If the topic is already reserved by the user, the access for everyone is updated. It returns
+// ErrTopicReserved if the topic is reserved by another user, or if an admin defined an access entry for everyone.
+func (a *SQLiteAuth) AddReservation(username, topic string, everyoneRead, everyoneWrite bool) error {
+	if !AllowedUsername(username) || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	rows, err := a.db.Query(selectTopicOwnersQuery, topic)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user, owner string
+		if err := rows.Scan(&user, &owner); err != nil {
+			return err
+		} else if (owner != "" && owner != username) || (owner == "" && user == Everyone) {
+			return ErrTopicReserved
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(a.db.rebind(upsertReservationAccessQuery), username, topic, true, true, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(a.db.rebind(upsertReservationAccessQuery), Everyone, topic, everyoneRead, everyoneWrite, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reservations returns the topics reserved by a user, ordered by topic name
+func (a *SQLiteAuth) Reservations(username string) ([]Reservation, error) {
+	rows, err := a.db.Query(selectUserReservationsQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reservations := make([]Reservation, 0)
+	for rows.Next() {
+		var topic string
+		var everyoneRead, everyoneWrite sql.NullBool
+		if err := rows.Scan(&topic, &everyoneRead, &everyoneWrite); err != nil {
+			return nil, err
+		}
+		reservation := Reservation{
+			Topic:         topic,
+			EveryoneRead:  a.defaultRead,
+			EveryoneWrite: a.defaultWrite,
+		}
+		if everyoneRead.Valid && everyoneWrite.Valid { // Entry for everyone may have been reset by an admin
+			reservation.EveryoneRead = everyoneRead.Bool
+			reservation.EveryoneWrite = everyoneWrite.Bool
+		}
+		reservations = append(reservations, reservation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return a.withReservationIPs(reservations, selectUserReservationIPsQuery, username)
+}
+
+// RemoveReservation releases a topic reserved by a user, removing the access entries of the user and of
+// everyone for it. The function returns nil on success, even if the reservation did not exist in the first place.
+func (a *SQLiteAuth) RemoveReservation(username, topic string) error {
+	if !AllowedUsername(username) || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.db.Exec(deleteReservationQuery, username, topic); err != nil {
+		return err
+	}
+	_, err := a.db.Exec(deleteReservationIPsQuery, username, topic)
+	return err
+}
+
+// ChangeReservationIPs replaces the IP address restrictions of a topic reserved by the user. Restrictions
+// that another user left behind when releasing the topic are removed as well.
+func (a *SQLiteAuth) ChangeReservationIPs(username, topic string, publishAllow, publishDeny []string) error {
+	if !AllowedUsername(username) || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	for _, cidr := range append(append([]string{}, publishAllow...), publishDeny...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return ErrInvalidArgument
+		}
+	}
+	reservations, err := a.Reservations(username)
+	if err != nil {
+		return err
+	}
+	reserved := false
+	for _, reservation := range reservations {
+		if reservation.Topic == topic {
+			reserved = true
+		}
+	}
+	if !reserved {
+		return ErrNotFound
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(a.db.rebind(deleteTopicReservationIPsQuery), topic); err != nil {
+		return err
+	}
+	for _, cidr := range publishAllow {
+		if _, err := tx.Exec(a.db.rebind(insertReservationIPQuery), topic, username, cidr, 0); err != nil {
+			return err
+		}
+	}
+	for _, cidr := range publishDeny {
+		if _, err := tx.Exec(a.db.rebind(insertReservationIPQuery), topic, username, cidr, 1); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ReservedTopicIPs returns the reservations of all users that restrict publishing by IP address. Only
+// Topic, PublishAllow and PublishDeny are set.
+func (a *SQLiteAuth) ReservedTopicIPs() ([]Reservation, error) {
+	return a.withReservationIPs(make([]Reservation, 0), selectReservationIPsQuery)
+}
+
+// withReservationIPs adds the IP address restrictions returned by the query to the reservations, appending
+// reservations for topics that are not in the list yet
+func (a *SQLiteAuth) withReservationIPs(reservations []Reservation, query string, args ...interface{}) ([]Reservation, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var topic, cidr string
+		var deny int
+		if err := rows.Scan(&topic, &cidr, &deny); err != nil {
+			return nil, err
+		}
+		i := len(reservations)
+		for j, reservation := range reservations {
+			if reservation.Topic == topic {
+				i = j
+			}
+		}
+		if i == len(reservations) {
+			reservations = append(reservations, Reservation{Topic: topic})
+		}
+		if deny == 1 {
+			reservations[i].PublishDeny = append(reservations[i].PublishDeny, cidr)
+		} else {
+			reservations[i].PublishAllow = append(reservations[i].PublishAllow, cidr)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return reservations, nil
+}
+
+// AddTier creates a new tier
+func (a *SQLiteAuth) AddTier(tier *Tier) error {
+	if !AllowedTier(tier.Code) {
+		return ErrInvalidArgument
+	}
+	_, err := a.db.Exec(insertTierQuery, tier.Code, tier.ReservationsLimit, tier.MessagesLimit, tier.EmailsLimit, tier.AttachmentTotalSizeLimit, int64(tier.MaxDelay.Seconds()), tier.SMSLimit, tier.CallsLimit)
+	return err
+}
+
+// UpdateTier changes the limits of an existing tier
+func (a *SQLiteAuth) UpdateTier(tier *Tier) error {
+	_, err := a.db.Exec(updateTierQuery, tier.ReservationsLimit, tier.MessagesLimit, tier.EmailsLimit, tier.AttachmentTotalSizeLimit, int64(tier.MaxDelay.Seconds()), tier.SMSLimit, tier.CallsLimit, tier.Code)
+	return err
+}
+
+// Tier returns the tier with the given code if it exists, or ErrNotFound otherwise
+func (a *SQLiteAuth) Tier(code string) (*Tier, error) {
+	tiers, err := a.queryTiers(selectTierQuery, code)
+	if err != nil {
+		return nil, err
+	} else if len(tiers) == 0 {
+		return nil, ErrNotFound
+	}
+	return tiers[0], nil
+}
+
+// Tiers returns all tiers, ordered by code
+func (a *SQLiteAuth) Tiers() ([]*Tier, error) {
+	return a.queryTiers(selectTiersQuery)
+}
+
+func (a *SQLiteAuth) queryTiers(query string, args ...interface{}) ([]*Tier, error) {
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tiers := make([]*Tier, 0)
+	for rows.Next() {
+		var tier Tier
+		var maxDelay int64
+		if err := rows.Scan(&tier.Code, &tier.ReservationsLimit, &tier.MessagesLimit, &tier.EmailsLimit, &tier.AttachmentTotalSizeLimit, &maxDelay, &tier.SMSLimit, &tier.CallsLimit); err != nil {
+			return nil, err
+		}
+		tier.MaxDelay = time.Duration(maxDelay) * time.Second
+		tiers = append(tiers, &tier)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tiers, nil
+}
+
+// RemoveTier deletes a tier. Users in this tier are no longer assigned to any tier afterwards.
+func (a *SQLiteAuth) RemoveTier(code string) error {
+	if _, err := a.db.Exec(resetUsersTierQuery, code); err != nil {
+		return err
+	}
+	_, err := a.db.Exec(deleteTierQuery, code)
+	return err
+}
+
+// ChangeTier assigns a user to the tier with the given code, or removes the user from its tier if
+// the code is empty. It returns ErrNotFound if the tier does not exist.
+func (a *SQLiteAuth) ChangeTier(username, code string) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	if code != "" {
+		if _, err := a.Tier(code); err != nil {
+			return err
+		}
+	}
+	_, err := a.db.Exec(updateUserTierQuery, code, username)
+	return err
+}
+
+// EnrollTOTP generates a new TOTP secret for a user and returns it. The secret is stored as pending until it is
+// confirmed with EnableTOTP, so that an enrollment that is never completed does not lock out the user. If two-factor
+// authentication is already enabled, it stays enabled with the old secret until then.
+func (a *SQLiteAuth) EnrollTOTP(username string) (string, error) {
+	if !AllowedUsername(username) {
+		return "", ErrInvalidArgument
+	}
+	user, err := a.User(username)
+	if err != nil {
+		return "", err
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	if _, err := a.db.Exec(updateUserTOTPQuery, user.TOTP, secret, username); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// EnableTOTP enables two-factor authentication for a user, if the code is valid for the pending secret
+// generated by EnrollTOTP. It returns ErrNotFound if there is no pending secret, and ErrUnauthenticated
+// if the code is invalid.
+func (a *SQLiteAuth) EnableTOTP(username, code string) error {
+	var pending string
+	if err := a.db.QueryRow(selectUserTOTPQuery, username).Scan(&pending); err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	} else if pending == "" {
+		return ErrNotFound
+	} else if !ValidateTOTP(pending, code, time.Now()) {
+		return ErrUnauthenticated
+	}
+	_, err := a.db.Exec(updateUserTOTPQuery, pending, "", username)
+	return err
+}
+
+// DisableTOTP disables two-factor authentication for a user, and discards any pending TOTP secret
+func (a *SQLiteAuth) DisableTOTP(username string) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	_, err := a.db.Exec(updateUserTOTPQuery, "", "", username)
+	return err
+}
+
+// token returns the token with the given value and the name of its user, or ErrNotFound
+func (a *SQLiteAuth) token(value string) (string, *Token, error) {
+	rows, err := a.db.Query(selectTokenQuery, value)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", nil, ErrNotFound
+	}
+	var username, label string
+	var expires int64
+	if err := rows.Scan(&username, &label, &expires); err != nil {
+		return "", nil, err
+	} else if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+	rows.Close()
+	grants, err := a.queryGrants(selectTokenAccessQuery, value)
+	if err != nil {
+		return "", nil, err
+	}
+	token := &Token{
+		Value:  value,
+		Label:  label,
+		Grants: grants,
+	}
+	if expires > 0 {
+		token.Expires = time.Unix(expires, 0)
+	}
+	return username, token, nil
+}
+
+// generateToken returns a new random token, e.g. tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2. Unlike util.RandomString,
+// it uses a cryptographically secure random number generator.
+func generateToken() (string, error) {
+	b := make([]byte, tokenLength-len(tokenPrefix))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(tokenCharset))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = tokenCharset[n.Int64()]
+	}
+	return tokenPrefix + string(b), nil
+}
+
+// toSQLWildcard converts the wildcards of a glob pattern to the format they are stored in. Since topic patterns used
+// to be matched with LIKE, '*' is stored as '%'. Regular expressions are stored as is.
 func toSQLWildcard(s string) string {
+	if isTopicRegex(s) {
+		return s
+	}
 	return strings.ReplaceAll(s, "*", "%")
 }
 
 func fromSQLWildcard(s string) string {
+	if isTopicRegex(s) {
+		return s
+	}
 	return strings.ReplaceAll(s, "%", "*")
 }
 
@@ -384,6 +1075,22 @@ func setupAuthDB(db *sql.DB) error {
 	// Do migrations
 	if schemaVersion == currentSchemaVersion {
 		return nil
+	} else if schemaVersion == 1 {
+		return migrateFrom1(db)
+	} else if schemaVersion == 2 {
+		return migrateFrom2(db)
+	} else if schemaVersion == 3 {
+		return migrateFrom3(db)
+	} else if schemaVersion == 4 {
+		return migrateFrom4(db)
+	} else if schemaVersion == 5 {
+		return migrateFrom5(db)
+	} else if schemaVersion == 6 {
+		return migrateFrom6(db)
+	} else if schemaVersion == 7 {
+		return migrateFrom7(db)
+	} else if schemaVersion == 8 {
+		return migrateFrom8(db)
 	}
 	return fmt.Errorf("unexpected schema version found: %d", schemaVersion)
 }
@@ -397,3 +1104,91 @@ func setupNewAuthDB(db *sql.DB) error {
 	}
 	return nil
 }
+
+func migrateFrom1(db *sql.DB) error {
+	log.Print("Migrating user database schema: from 1 to 2")
+	if _, err := db.Exec(migrate1To2CreateTokenTablesQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 2); err != nil {
+		return err
+	}
+	return migrateFrom2(db)
+}
+
+func migrateFrom2(db *sql.DB) error {
+	log.Print("Migrating user database schema: from 2 to 3")
+	if _, err := db.Exec(migrate2To3AddTiersAndReservationsQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 3); err != nil {
+		return err
+	}
+	return migrateFrom3(db)
+}
+
+func migrateFrom3(db *sql.DB) error {
+	log.Print("Migrating user database schema: from 3 to 4")
+	if _, err := db.Exec(migrate3To4AddAccessDenyQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 4); err != nil {
+		return err
+	}
+	return migrateFrom4(db)
+}
+
+func migrateFrom4(db *sql.DB) error {
+	log.Print("Migrating user database schema: from 4 to 5")
+	if _, err := db.Exec(migrate4To5AddUserTOTPQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 5); err != nil {
+		return err
+	}
+	return migrateFrom5(db)
+}
+
+func migrateFrom5(db *sql.DB) error {
+	log.Print("Migrating user database schema: from 5 to 6")
+	if _, err := db.Exec(migrate5To6AddTierLimitsQueries); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 6); err != nil {
+		return err
+	}
+	return migrateFrom6(db)
+}
+
+func migrateFrom6(db *sql.DB) error {
+	log.Print("Migrating user database schema: from 6 to 7")
+	if _, err := db.Exec(migrate6To7AddReservationIPsQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 7); err != nil {
+		return err
+	}
+	return migrateFrom7(db)
+}
+
+func migrateFrom7(db *sql.DB) error {
+	log.Print("Migrating user database schema: from 7 to 8")
+	if _, err := db.Exec(migrate7To8AddTierSMSLimitQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 8); err != nil {
+		return err
+	}
+	return migrateFrom8(db)
+}
+
+func migrateFrom8(db *sql.DB) error {
+	log.Print("Migrating user database schema: from 8 to 9")
+	if _, err := db.Exec(migrate8To9AddTierCallsLimitQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 9); err != nil {
+		return err
+	}
+	return nil
+}
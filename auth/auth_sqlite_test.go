@@ -1,6 +1,7 @@
 package auth_test
 
 import (
+	"database/sql"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/auth"
 	"path/filepath"
@@ -36,10 +37,10 @@ func TestSQLiteAuth_FullScenario_Default_DenyAll(t *testing.T) {
 	require.True(t, strings.HasPrefix(ben.Hash, "$2a$10$"))
 	require.Equal(t, auth.RoleUser, ben.Role)
 	require.Equal(t, []auth.Grant{
-		{"mytopic", true, true},
-		{"readme", true, false},
-		{"writeme", false, true},
-		{"everyonewrite", false, false},
+		{TopicPattern: "mytopic", AllowRead: true, AllowWrite: true},
+		{TopicPattern: "readme", AllowRead: true, AllowWrite: false},
+		{TopicPattern: "writeme", AllowRead: false, AllowWrite: true},
+		{TopicPattern: "everyonewrite", AllowRead: false, AllowWrite: false},
 	}, ben.Grants)
 
 	notben, err := a.Authenticate("ben", "this is wrong")
@@ -90,6 +91,17 @@ func TestSQLiteAuth_AddUser_Invalid(t *testing.T) {
 	require.Equal(t, auth.ErrInvalidArgument, a.AddUser("validuser", "pass", "invalid-role"))
 }
 
+func TestSQLiteAuth_AddUserHash(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	hash, err := auth.HashPassword("pass")
+	require.Nil(t, err)
+	require.Nil(t, a.AddUserHash("phil", hash, auth.RoleUser))
+	user, err := a.Authenticate("phil", "pass")
+	require.Nil(t, err)
+	require.Equal(t, auth.RoleUser, user.Role)
+	require.Equal(t, auth.ErrInvalidArgument, a.AddUserHash("ben", "pass", auth.RoleUser)) // Not a hash
+}
+
 func TestSQLiteAuth_AddUser_Timing(t *testing.T) {
 	a := newTestAuth(t, false, false)
 	start := time.Now().UnixMilli()
@@ -145,10 +157,10 @@ func TestSQLiteAuth_UserManagement(t *testing.T) {
 	require.True(t, strings.HasPrefix(ben.Hash, "$2a$10$"))
 	require.Equal(t, auth.RoleUser, ben.Role)
 	require.Equal(t, []auth.Grant{
-		{"mytopic", true, true},
-		{"readme", true, false},
-		{"writeme", false, true},
-		{"everyonewrite", false, false},
+		{TopicPattern: "mytopic", AllowRead: true, AllowWrite: true},
+		{TopicPattern: "readme", AllowRead: true, AllowWrite: false},
+		{TopicPattern: "writeme", AllowRead: false, AllowWrite: true},
+		{TopicPattern: "everyonewrite", AllowRead: false, AllowWrite: false},
 	}, ben.Grants)
 
 	everyone, err := a.User(auth.Everyone)
@@ -157,8 +169,8 @@ func TestSQLiteAuth_UserManagement(t *testing.T) {
 	require.Equal(t, "", everyone.Hash)
 	require.Equal(t, auth.RoleAnonymous, everyone.Role)
 	require.Equal(t, []auth.Grant{
-		{"announcements", true, false},
-		{"everyonewrite", true, true},
+		{TopicPattern: "announcements", AllowRead: true, AllowWrite: false},
+		{TopicPattern: "everyonewrite", AllowRead: true, AllowWrite: true},
 	}, everyone.Grants)
 
 	// Ben: Before revoking
@@ -235,6 +247,442 @@ func TestSQLiteAuth_ChangeRole(t *testing.T) {
 	require.Equal(t, 0, len(ben.Grants))
 }
 
+func TestSQLiteAuth_Tokens(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", true, true))
+	require.Nil(t, a.AllowAccess("ben", "backups", true, true))
+
+	token, err := a.AddToken("ben", "backup script", []auth.Grant{{TopicPattern: "backups", AllowRead: false, AllowWrite: true}}, time.Time{})
+	require.Nil(t, err)
+	require.Regexp(t, `^tk_[A-Za-z0-9]{29}$`, token.Value)
+	require.Equal(t, "backup script", token.Label)
+	require.True(t, token.Expires.IsZero())
+
+	ben, err := a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Equal(t, "ben", ben.Name)
+	require.Equal(t, token.Value, ben.Token.Value)
+	require.Nil(t, a.Authorize(ben, "backups", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "backups", auth.PermissionRead)) // Token is write-only
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "mytopic", auth.PermissionWrite))
+
+	// The token cannot grant more than the user has
+	token2, err := a.AddToken("ben", "", []auth.Grant{{TopicPattern: "*", AllowRead: true, AllowWrite: true}}, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	ben, err = a.AuthenticateToken(token2.Value)
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "mytopic", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "othertopic", auth.PermissionRead))
+
+	tokens, err := a.Tokens("ben")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(tokens))
+	require.Equal(t, token.Value, tokens[0].Value)
+	require.Equal(t, []auth.Grant{{TopicPattern: "backups", AllowRead: false, AllowWrite: true}}, tokens[0].Grants)
+	require.Equal(t, token2.Value, tokens[1].Value)
+	require.False(t, tokens[1].Expires.IsZero())
+
+	require.Nil(t, a.RemoveToken("phil", token.Value)) // Not phil's token
+	_, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Nil(t, a.RemoveToken("ben", token.Value))
+	_, err = a.AuthenticateToken(token.Value)
+	require.Equal(t, auth.ErrUnauthenticated, err)
+
+	require.Nil(t, a.RemoveUser("ben"))
+	_, err = a.AuthenticateToken(token2.Value)
+	require.Equal(t, auth.ErrUnauthenticated, err)
+}
+
+func TestSQLiteAuth_Tokens_Expired(t *testing.T) {
+	a := newTestAuth(t, true, true)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	token, err := a.AddToken("ben", "", []auth.Grant{{TopicPattern: "mytopic", AllowRead: true, AllowWrite: true}}, time.Now().Add(-time.Second))
+	require.Nil(t, err)
+	_, err = a.AuthenticateToken(token.Value)
+	require.Equal(t, auth.ErrUnauthenticated, err)
+}
+
+func TestSQLiteAuth_Tokens_Invalid(t *testing.T) {
+	a := newTestAuth(t, true, true)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	_, err := a.AddToken("ben", "", []auth.Grant{}, time.Time{})
+	require.Equal(t, auth.ErrInvalidArgument, err)
+	_, err = a.AddToken("ben", "", []auth.Grant{{TopicPattern: "no/slashes", AllowRead: true, AllowWrite: true}}, time.Time{})
+	require.Equal(t, auth.ErrInvalidArgument, err)
+	_, err = a.AddToken("phil", "", []auth.Grant{{TopicPattern: "mytopic", AllowRead: true, AllowWrite: true}}, time.Time{})
+	require.Equal(t, auth.ErrNotFound, err)
+	_, err = a.AuthenticateToken("tk_doesnotexistdoesnotexist12345")
+	require.Equal(t, auth.ErrUnauthenticated, err)
+	_, err = a.AuthenticateToken("ben")
+	require.Equal(t, auth.ErrUnauthenticated, err)
+}
+
+func TestSQLiteAuth_MigrateFrom1(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "user.db")
+	db, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE user (user TEXT NOT NULL PRIMARY KEY, pass TEXT NOT NULL, role TEXT NOT NULL);
+		CREATE TABLE access (user TEXT NOT NULL, topic TEXT NOT NULL, read INT NOT NULL, write INT NOT NULL, PRIMARY KEY (topic, user));
+		CREATE TABLE schemaVersion (id INT PRIMARY KEY, version INT NOT NULL);
+		INSERT INTO schemaVersion VALUES (1, 1);
+	`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	a, err := auth.NewSQLiteAuth(filename, false, false)
+	require.Nil(t, err)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	_, err = a.AddToken("ben", "", []auth.Grant{{TopicPattern: "mytopic", AllowRead: true, AllowWrite: false}}, time.Time{})
+	require.Nil(t, err)
+}
+
+func TestSQLiteAuth_Reservations(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess(auth.Everyone, "announcements", true, false))
+
+	require.Nil(t, a.AddReservation("phil", "mytopic", true, false))
+	require.Equal(t, auth.ErrTopicReserved, a.AddReservation("ben", "mytopic", true, true))
+	require.Equal(t, auth.ErrTopicReserved, a.AddReservation("ben", "announcements", false, false))
+	require.Equal(t, auth.ErrInvalidArgument, a.AddReservation("ben", "my*", false, false))
+
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(phil, "mytopic", auth.PermissionRead))
+	require.Nil(t, a.Authorize(phil, "mytopic", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "mytopic", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "mytopic", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "mytopic", auth.PermissionWrite))
+
+	require.Nil(t, a.AddReservation("phil", "mytopic", false, false)) // Update
+	require.Nil(t, a.AddReservation("phil", "another", false, true))
+	reservations, err := a.Reservations("phil")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Reservation{
+		{Topic: "another", EveryoneRead: false, EveryoneWrite: true},
+		{Topic: "mytopic", EveryoneRead: false, EveryoneWrite: false},
+	}, reservations)
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "mytopic", auth.PermissionRead))
+
+	require.Nil(t, a.RemoveReservation("phil", "mytopic"))
+	require.Nil(t, a.AddReservation("ben", "mytopic", true, true))
+	reservations, err = a.Reservations("phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(reservations))
+
+	require.Nil(t, a.RemoveUser("phil"))
+	everyone, err := a.User(auth.Everyone)
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{{TopicPattern: "announcements", AllowRead: true, AllowWrite: false}, {TopicPattern: "mytopic", AllowRead: true, AllowWrite: true}}, everyone.Grants)
+}
+
+func TestSQLiteAuth_Reservations_ChangeRoleKeepsReservation(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("phil", "other", true, true))
+	require.Nil(t, a.AddReservation("phil", "mytopic", false, false))
+	require.Nil(t, a.ChangeRole("phil", auth.RoleAdmin))
+
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{{TopicPattern: "mytopic", AllowRead: true, AllowWrite: true}}, phil.Grants)
+	reservations, err := a.Reservations("phil")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(reservations))
+}
+
+func TestSQLiteAuth_ReservationIPs(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AddReservation("phil", "doorbell", false, false))
+	require.Nil(t, a.AddReservation("phil", "mytopic", false, false))
+
+	require.Nil(t, a.ChangeReservationIPs("phil", "doorbell", []string{"1.2.3.4/32", "10.0.0.0/8"}, []string{"10.1.0.0/16"}))
+	require.Equal(t, auth.ErrNotFound, a.ChangeReservationIPs("ben", "doorbell", []string{"5.6.7.8/32"}, nil))
+	require.Equal(t, auth.ErrInvalidArgument, a.ChangeReservationIPs("phil", "doorbell", []string{"1.2.3.4"}, nil))
+
+	reservations, err := a.Reservations("phil")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Reservation{
+		{Topic: "doorbell", PublishAllow: []string{"1.2.3.4/32", "10.0.0.0/8"}, PublishDeny: []string{"10.1.0.0/16"}},
+		{Topic: "mytopic"},
+	}, reservations)
+	reservations, err = a.ReservedTopicIPs()
+	require.Nil(t, err)
+	require.Equal(t, []auth.Reservation{
+		{Topic: "doorbell", PublishAllow: []string{"1.2.3.4/32", "10.0.0.0/8"}, PublishDeny: []string{"10.1.0.0/16"}},
+	}, reservations)
+
+	// Restrictions are gone with the reservation, and do not apply to a new reservation of the topic
+	require.Nil(t, a.ResetAccess("phil", "doorbell"))
+	reservations, err = a.ReservedTopicIPs()
+	require.Nil(t, err)
+	require.Empty(t, reservations)
+	require.Nil(t, a.AddReservation("ben", "doorbell", false, false))
+	require.Nil(t, a.ChangeReservationIPs("ben", "doorbell", []string{"1.2.3.4/32"}, nil))
+	reservations, err = a.ReservedTopicIPs()
+	require.Nil(t, err)
+	require.Equal(t, []auth.Reservation{{Topic: "doorbell", PublishAllow: []string{"1.2.3.4/32"}}}, reservations)
+	require.Nil(t, a.RemoveReservation("ben", "doorbell"))
+	reservations, err = a.ReservedTopicIPs()
+	require.Nil(t, err)
+	require.Empty(t, reservations)
+}
+
+func TestSQLiteAuth_Tiers(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, a.AddTier(&auth.Tier{Code: "pro", ReservationsLimit: 10}))
+	require.Nil(t, a.AddTier(&auth.Tier{Code: "basic", ReservationsLimit: 2}))
+	require.NotNil(t, a.AddTier(&auth.Tier{Code: "pro", ReservationsLimit: 3}))
+	require.Equal(t, auth.ErrInvalidArgument, a.AddTier(&auth.Tier{Code: "Pro Plan"}))
+
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, phil.Tier)
+
+	require.Nil(t, a.ChangeTier("phil", "pro"))
+	require.Equal(t, auth.ErrNotFound, a.ChangeTier("phil", "doesnotexist"))
+	require.Nil(t, a.UpdateTier(&auth.Tier{Code: "pro", ReservationsLimit: 20}))
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, &auth.Tier{Code: "pro", ReservationsLimit: 20}, phil.Tier)
+
+	tiers, err := a.Tiers()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(tiers))
+	require.Equal(t, "basic", tiers[0].Code)
+	require.Equal(t, "pro", tiers[1].Code)
+
+	require.Nil(t, a.RemoveTier("pro"))
+	_, err = a.Tier("pro")
+	require.Equal(t, auth.ErrNotFound, err)
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, phil.Tier)
+}
+
+func TestSQLiteAuth_TierLimits(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	pro := &auth.Tier{
+		Code:                     "pro",
+		ReservationsLimit:        10,
+		MessagesLimit:            5000,
+		EmailsLimit:              100,
+		AttachmentTotalSizeLimit: 5 * 1024 * 1024 * 1024, // Does not fit in 32 bits
+		MaxDelay:                 30 * 24 * time.Hour,
+		SMSLimit:                 20,
+		CallsLimit:               2,
+	}
+	require.Nil(t, a.AddTier(pro))
+	require.Nil(t, a.ChangeTier("phil", "pro"))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, pro, phil.Tier)
+
+	pro.MessagesLimit = 10000
+	pro.MaxDelay = 0
+	pro.SMSLimit = 0
+	require.Nil(t, a.UpdateTier(pro))
+	tier, err := a.Tier("pro")
+	require.Nil(t, err)
+	require.Equal(t, pro, tier)
+}
+
+func TestSQLiteAuth_MigrateFrom2(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "user.db")
+	a, err := auth.NewSQLiteAuth(filename, false, false)
+	require.Nil(t, err)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", true, true))
+
+	db, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	_, err = db.Exec(`
+		DROP TABLE tier;
+		ALTER TABLE user DROP COLUMN tier;
+		ALTER TABLE access DROP COLUMN owner;
+		ALTER TABLE access DROP COLUMN deny;
+		ALTER TABLE user DROP COLUMN totp_secret;
+		ALTER TABLE user DROP COLUMN totp_pending;
+		UPDATE schemaVersion SET version = 2 WHERE id = 1;
+	`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	a, err = auth.NewSQLiteAuth(filename, false, false)
+	require.Nil(t, err)
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, []auth.Grant{{TopicPattern: "mytopic", AllowRead: true, AllowWrite: true}}, ben.Grants)
+	require.Nil(t, a.AddReservation("ben", "reserved", false, false))
+}
+
+func TestSQLiteAuth_Permissions(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("sensor", "sensor", auth.RoleUser))
+	require.Nil(t, a.AddUser("viewer", "viewer", auth.RoleUser))
+	require.Nil(t, a.AllowPermissions("sensor", "readings", auth.PermissionPublish))
+	require.Nil(t, a.AllowPermissions("viewer", "readings", auth.PermissionSubscribe|auth.PermissionPoll|auth.PermissionPublish))
+	require.Nil(t, a.AllowPermissions(auth.Everyone, "live", auth.PermissionSubscribe))
+
+	sensor, err := a.User("sensor")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(sensor, "readings", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(sensor, "readings", auth.PermissionPublish))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(sensor, "readings", auth.PermissionAttach))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(sensor, "readings", auth.PermissionEmail))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(sensor, "readings", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(sensor, "readings", auth.PermissionPoll))
+	require.Equal(t, []auth.Grant{{TopicPattern: "readings", AllowRead: false, AllowWrite: true, Deny: auth.PermissionAttach | auth.PermissionEmail}}, sensor.Grants)
+	require.Equal(t, "publish", sensor.Grants[0].Permissions().String())
+
+	viewer, err := a.User("viewer")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(viewer, "readings", auth.PermissionRead))
+	require.Nil(t, a.Authorize(viewer, "readings", auth.PermissionPoll))
+	require.Nil(t, a.Authorize(viewer, "readings", auth.PermissionPublish))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(viewer, "readings", auth.PermissionAttach))
+
+	require.Nil(t, a.Authorize(nil, "live", auth.PermissionSubscribe))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "live", auth.PermissionPoll))
+
+	// AllowAccess resets fine-grained permissions
+	require.Nil(t, a.AllowAccess("sensor", "readings", true, true))
+	require.Nil(t, a.Authorize(sensor, "readings", auth.PermissionAttach))
+	require.Nil(t, a.Authorize(sensor, "readings", auth.PermissionPoll))
+}
+
+func TestSQLiteAuth_TopicPatterns(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "alerts-*-prod", true, false))
+	require.Nil(t, a.AllowAccess("ben", "^team[0-9]+$", true, true))
+	require.Nil(t, a.AllowAccess("ben", "build?", false, true))
+	require.Nil(t, a.AllowAccess("ben", "my_topic", true, true))
+	require.Nil(t, a.AllowAccess(auth.Everyone, "up[0-9]*", false, true))
+
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, "alerts-*-prod", ben.Grants[0].TopicPattern)
+	require.Equal(t, "^team[0-9]+$", ben.Grants[1].TopicPattern)
+	require.Nil(t, a.Authorize(ben, "alerts-db-prod", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts-db-dev", auth.PermissionRead))
+	require.Nil(t, a.Authorize(ben, "team42", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "team42x", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "myteam1", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "build1", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "build12", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "myXtopic", auth.PermissionRead)) // '_' is not a wildcard
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "MY_TOPIC", auth.PermissionRead))
+	require.Nil(t, a.Authorize(nil, "up1234", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "upx", auth.PermissionWrite))
+
+	require.Nil(t, a.ResetAccess("ben", "^team[0-9]+$"))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "team42", auth.PermissionWrite))
+}
+
+func TestSQLiteAuth_TopicPatternsOverlapping(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "alerts-prod", false, false))
+	require.Nil(t, a.AllowAccess("ben", "alerts*", true, true))
+	require.Nil(t, a.AllowAccess("ben", "alerts-prod-*", true, false))
+	require.Nil(t, a.AllowAccess("ben", "^alerts-test-[0-9]+$", false, false))
+	require.Nil(t, a.AllowAccess(auth.Everyone, "alerts-dev", false, false))
+
+	// The most specific entry wins, regardless of the order the entries were added in
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "alerts-dev", auth.PermissionWrite))
+	require.Nil(t, a.Authorize(ben, "alerts-prod-db", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts-prod-db", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts-prod", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts-test-1", auth.PermissionRead))
+	require.Nil(t, a.Authorize(ben, "alerts-test-x", auth.PermissionWrite))
+
+	// Re-adding the broad pattern after the specific ones does not change that
+	require.Nil(t, a.ResetAccess("ben", "alerts*"))
+	require.Nil(t, a.AllowAccess("ben", "alerts*", true, true))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts-prod", auth.PermissionRead))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(ben, "alerts-prod-db", auth.PermissionWrite))
+	require.Equal(t, auth.ErrUnauthorized, a.Authorize(nil, "alerts-dev", auth.PermissionRead))
+}
+
+func TestAllowedTopicPattern(t *testing.T) {
+	for _, pattern := range []string{"mytopic", "alerts*", "alerts-*-prod", "build?", "team[0-9]", "up[^x]*", "^team[0-9]+$", "^(a|b)-.*$"} {
+		require.True(t, auth.AllowedTopicPattern(pattern), pattern)
+	}
+	for _, pattern := range []string{"", "my/topic", "team[0-9", "^team[0-9]+", "^team(+$", "^" + strings.Repeat("a", 300) + "$"} {
+		require.False(t, auth.AllowedTopicPattern(pattern), pattern)
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	for _, s := range []string{"read-write", "rw", "read-only", "ro", "write-only", "wo", "deny", "publish", "subscribe,poll", "publish,attach", "subscribe,publish,email"} {
+		perms, err := auth.ParsePermissions(s)
+		require.Nil(t, err, s)
+		expected, err := auth.ParsePermissions(perms.String())
+		require.Nil(t, err, s)
+		require.Equal(t, expected, perms, s)
+	}
+	perms, err := auth.ParsePermissions("subscribe, poll")
+	require.Nil(t, err)
+	require.Equal(t, "read-only", perms.String())
+	perms, err = auth.ParsePermissions("attach,publish")
+	require.Nil(t, err)
+	require.Equal(t, "publish,attach", perms.String())
+	_, err = auth.ParsePermissions("publish,maybe")
+	require.Error(t, err)
+	_, err = auth.ParsePermissions("")
+	require.Error(t, err)
+}
+
+func TestSQLiteAuth_TOTP(t *testing.T) {
+	a := newTestAuth(t, false, false)
+	require.Nil(t, a.AddUser("phil", "phil", auth.RoleUser))
+	require.Equal(t, auth.ErrNotFound, a.EnableTOTP("phil", "123456")) // Not enrolled
+
+	secret, err := a.EnrollTOTP("phil")
+	require.Nil(t, err)
+	require.Len(t, secret, 32)
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "", phil.TOTP) // Not enabled until confirmed
+
+	require.Equal(t, auth.ErrUnauthenticated, a.EnableTOTP("phil", "000000"))
+	code, err := auth.TOTPCode(secret, time.Now())
+	require.Nil(t, err)
+	require.Nil(t, a.EnableTOTP("phil", code))
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, secret, phil.TOTP)
+	require.Equal(t, auth.ErrNotFound, a.EnableTOTP("phil", code)) // Pending secret was used up
+
+	newSecret, err := a.EnrollTOTP("phil") // Re-enrollment keeps the old secret until confirmed
+	require.Nil(t, err)
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, secret, phil.TOTP)
+	require.NotEqual(t, secret, newSecret)
+
+	require.Nil(t, a.DisableTOTP("phil"))
+	phil, err = a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "", phil.TOTP)
+	require.Equal(t, auth.ErrNotFound, a.EnableTOTP("phil", code))
+	_, err = a.EnrollTOTP("notauser")
+	require.Equal(t, auth.ErrNotFound, err)
+}
+
 func newTestAuth(t *testing.T, defaultRead, defaultWrite bool) *auth.SQLiteAuth {
 	filename := filepath.Join(t.TempDir(), "user.db")
 	a, err := auth.NewSQLiteAuth(filename, defaultRead, defaultWrite)
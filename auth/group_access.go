@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// groupAccess maps the groups of users from an external identity provider (e.g. an LDAP directory, or an OpenID
+// Connect provider) to a role and access control entries, since these users do not exist in the auth database.
+type groupAccess struct {
+	adminGroup   string             // Lower case, may be empty
+	grants       map[string][]Grant // Group name (lower case) -> grants; Everyone applies to all users
+	defaultRead  bool
+	defaultWrite bool
+}
+
+// newGroupAccess parses the access control entries, in the format <group>:<topic-pattern>:<permission>
+func newGroupAccess(adminGroup string, entries []string, defaultRead, defaultWrite bool) (*groupAccess, error) {
+	grants := make(map[string][]Grant)
+	for _, entry := range entries {
+		group, grant, err := parseGroupAccess(entry)
+		if err != nil {
+			return nil, err
+		}
+		grants[group] = append(grants[group], grant)
+	}
+	return &groupAccess{
+		adminGroup:   strings.ToLower(strings.TrimSpace(adminGroup)),
+		grants:       grants,
+		defaultRead:  defaultRead,
+		defaultWrite: defaultWrite,
+	}, nil
+}
+
+// user returns a user with the role and grants of the given groups (matched case-insensitively)
+func (g *groupAccess) user(username string, groups []string) *User {
+	user := &User{
+		Name:   username,
+		Role:   RoleUser,
+		Grants: make([]Grant, 0),
+	}
+	for _, group := range groups {
+		group = strings.ToLower(strings.TrimSpace(group))
+		if g.adminGroup != "" && group == g.adminGroup {
+			user.Role = RoleAdmin
+		}
+		user.Grants = append(user.Grants, g.grants[group]...)
+	}
+	return user
+}
+
+// authorize returns nil if the given user (or nil for anonymous) has access to the topic.
+//
+// If multiple of the user's grants match the topic (e.g. because the user is in multiple groups), their
+// permissions are combined. Grants for Everyone only apply if none of the user's grants match.
+func (g *groupAccess) authorize(user *User, topic string, perm Permission) error {
+	if user != nil && user.Role == RoleAdmin {
+		return nil // Admin can do everything
+	}
+	var perms Permission
+	var found bool
+	if user != nil {
+		perms, found = matchGrants(user.Grants, topic)
+	}
+	if !found {
+		perms, found = matchGrants(g.grants[Everyone], topic)
+	}
+	if !found {
+		perms = grantPermissions(g.defaultRead, g.defaultWrite, 0)
+	}
+	return resolvePerms(perms, perm)
+}
+
+// parseGroupAccess parses an access control entry like cn=devs,ou=groups,dc=example,dc=com:alerts*:rw. Since group
+// names may contain colons (e.g. URNs), the entry is split at the last two colons.
+func parseGroupAccess(entry string) (string, Grant, error) {
+	last := strings.LastIndex(entry, ":")
+	if last == -1 {
+		return "", Grant{}, fmt.Errorf("invalid group access %s, expected format <group>:<topic-pattern>:<permission>", entry)
+	}
+	middle := strings.LastIndex(entry[:last], ":")
+	if middle <= 0 {
+		return "", Grant{}, fmt.Errorf("invalid group access %s, expected format <group>:<topic-pattern>:<permission>", entry)
+	}
+	group, topicPattern, perms := strings.ToLower(strings.TrimSpace(entry[:middle])), entry[middle+1:last], entry[last+1:]
+	if !AllowedTopicPattern(topicPattern) {
+		return "", Grant{}, fmt.Errorf("invalid group access %s: invalid topic pattern %s", entry, topicPattern)
+	}
+	perm, err := ParsePermissions(perms)
+	if err != nil {
+		return "", Grant{}, fmt.Errorf("invalid group access %s: %s", entry, err.Error())
+	}
+	return group, newGrant(topicPattern, perm), nil
+}
+
+// matchGrants combines the permissions of all grants whose topic pattern matches the topic
+func matchGrants(grants []Grant, topic string) (perms Permission, found bool) {
+	for _, grant := range grants {
+		if topicPatternMatches(grant.TopicPattern, topic) {
+			perms, found = perms|grant.Permissions(), true
+		}
+	}
+	return
+}
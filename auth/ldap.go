@@ -0,0 +1,503 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// This file implements the small subset of the LDAPv3 protocol (RFC 4511) that is needed to authenticate users:
+// simple binds and searches. Messages are encoded with the Basic Encoding Rules (BER) of ASN.1.
+
+// BER tags of the LDAP messages and their elements
+const (
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagBoolean     = 0x01
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+	berTagSet         = 0x31
+
+	ldapTagBindRequest      = 0x60 // [APPLICATION 0], constructed
+	ldapTagBindResponse     = 0x61
+	ldapTagUnbindRequest    = 0x42 // [APPLICATION 2], primitive
+	ldapTagSearchRequest    = 0x63
+	ldapTagSearchEntry      = 0x64
+	ldapTagSearchDone       = 0x65
+	ldapTagSearchReference  = 0x73
+	ldapTagSimpleAuth       = 0x80 // [0], primitive
+	ldapTagFilterAnd        = 0xa0
+	ldapTagFilterOr         = 0xa1
+	ldapTagFilterNot        = 0xa2
+	ldapTagFilterEquality   = 0xa3
+	ldapTagFilterPresent    = 0x87
+	ldapScopeWholeSubtree   = 2
+	ldapDerefAliasesNever   = 0
+	ldapResultSuccess       = 0
+	ldapResultInvalidCreds  = 49
+	ldapProtocolVersion     = 3
+	ldapMaxMessageSize      = 4 * 1024 * 1024
+	ldapFilterPlaceholder   = "%s"
+	ldapDefaultPort         = "389"
+	ldapDefaultPortTLS      = "636"
+	ldapSearchSizeLimit     = 2 // We only ever expect one entry
+	ldapSearchTimeLimitSecs = 10
+)
+
+var (
+	errLDAPInvalidCredentials = errors.New("invalid credentials")
+	errLDAPMalformed          = errors.New("malformed LDAP message")
+	errLDAPFilterInvalid      = errors.New("invalid LDAP filter")
+)
+
+// berElement is a decoded BER element; for constructed elements, content contains the encoded children
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+func berEncode(tag byte, content ...[]byte) []byte {
+	length := 0
+	for _, c := range content {
+		length += len(c)
+	}
+	b := append([]byte{tag}, berLength(length)...)
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	b := make([]byte, 0)
+	for v := n; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for v := n >> 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...) // Keep it positive
+	}
+	return berEncode(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berEncode(berTagBoolean, []byte{0xff})
+	}
+	return berEncode(berTagBoolean, []byte{0})
+}
+
+// berDecodeInt decodes the content of an INTEGER or ENUMERATED element
+func berDecodeInt(b []byte) (int, error) {
+	if len(b) == 0 || len(b) > 4 {
+		return 0, errLDAPMalformed
+	}
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n, nil
+}
+
+// berReadElement reads a single element from the reader
+func berReadElement(r *bufio.Reader) (*berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		num := int(first & 0x7f)
+		if num == 0 || num > 4 {
+			return nil, errLDAPMalformed // Indefinite lengths are not allowed in LDAP
+		}
+		length = 0
+		for i := 0; i < num; i++ {
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(c)
+		}
+	}
+	if length > ldapMaxMessageSize {
+		return nil, errLDAPMalformed
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return &berElement{tag: tag, content: content}, nil
+}
+
+// berChildren decodes the children of a constructed element
+func berChildren(b []byte) ([]*berElement, error) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	children := make([]*berElement, 0)
+	for {
+		e, err := berReadElement(r)
+		if err == io.EOF {
+			return children, nil
+		} else if err != nil {
+			return nil, errLDAPMalformed
+		}
+		children = append(children, e)
+	}
+}
+
+// ldapEntry is a search result entry, with attribute names in lower case
+type ldapEntry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// ldapConn is a connection to an LDAP server. It is not safe for concurrent use.
+type ldapConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	messageID int
+}
+
+// dialLDAP connects to an ldap:// or ldaps:// URL; the connection expires after the timeout
+func dialLDAP(rawURL string, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: timeout}
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), ldapDefaultPort)
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), ldapDefaultPortTLS)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("invalid LDAP URL %s, must start with ldap:// or ldaps://", rawURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Bind authenticates with dn and password (simple bind). Empty passwords are rejected, since they would result
+// in an unauthenticated bind, which most servers allow for any DN (RFC 4513, section 5.1.2).
+func (c *ldapConn) Bind(dn, password string) error {
+	if password == "" {
+		return errLDAPInvalidCredentials
+	}
+	request := berEncode(ldapTagBindRequest,
+		berInt(berTagInteger, ldapProtocolVersion),
+		berString(berTagOctetString, dn),
+		berString(ldapTagSimpleAuth, password),
+	)
+	op, err := c.roundtrip(request)
+	if err != nil {
+		return err
+	} else if op.tag != ldapTagBindResponse {
+		return errLDAPMalformed
+	}
+	code, message, err := ldapResult(op)
+	if err != nil {
+		return err
+	} else if code == ldapResultInvalidCreds {
+		return errLDAPInvalidCredentials
+	} else if code != ldapResultSuccess {
+		return fmt.Errorf("LDAP bind failed with result code %d: %s", code, message)
+	}
+	return nil
+}
+
+// Search returns the entries below baseDN that match the filter, including the given attributes
+func (c *ldapConn) Search(baseDN string, filter []byte, attributes []string) ([]*ldapEntry, error) {
+	attrs := make([][]byte, 0)
+	for _, a := range attributes {
+		attrs = append(attrs, berString(berTagOctetString, a))
+	}
+	request := berEncode(ldapTagSearchRequest,
+		berString(berTagOctetString, baseDN),
+		berInt(berTagEnumerated, ldapScopeWholeSubtree),
+		berInt(berTagEnumerated, ldapDerefAliasesNever),
+		berInt(berTagInteger, ldapSearchSizeLimit),
+		berInt(berTagInteger, ldapSearchTimeLimitSecs),
+		berBool(false),
+		filter,
+		berEncode(berTagSequence, attrs...),
+	)
+	if err := c.send(request); err != nil {
+		return nil, err
+	}
+	entries := make([]*ldapEntry, 0)
+	for {
+		op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapTagSearchEntry:
+			entry, err := ldapDecodeEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapTagSearchReference:
+			// Referrals to other servers are not followed
+		case ldapTagSearchDone:
+			code, message, err := ldapResult(op)
+			if err != nil {
+				return nil, err
+			} else if code != ldapResultSuccess {
+				return nil, fmt.Errorf("LDAP search failed with result code %d: %s", code, message)
+			}
+			return entries, nil
+		default:
+			return nil, errLDAPMalformed
+		}
+	}
+}
+
+// Close sends an unbind request and closes the connection
+func (c *ldapConn) Close() error {
+	c.send(berEncode(ldapTagUnbindRequest))
+	return c.conn.Close()
+}
+
+func (c *ldapConn) roundtrip(op []byte) (*berElement, error) {
+	if err := c.send(op); err != nil {
+		return nil, err
+	}
+	return c.receive()
+}
+
+func (c *ldapConn) send(op []byte) error {
+	c.messageID++
+	_, err := c.conn.Write(berEncode(berTagSequence, berInt(berTagInteger, c.messageID), op))
+	return err
+}
+
+// receive reads the next message and returns its protocol operation
+func (c *ldapConn) receive() (*berElement, error) {
+	message, err := berReadElement(c.r)
+	if err != nil {
+		return nil, err
+	} else if message.tag != berTagSequence {
+		return nil, errLDAPMalformed
+	}
+	children, err := berChildren(message.content)
+	if err != nil {
+		return nil, err
+	} else if len(children) < 2 {
+		return nil, errLDAPMalformed
+	}
+	id, err := berDecodeInt(children[0].content)
+	if err != nil {
+		return nil, err
+	} else if id != c.messageID {
+		return nil, errLDAPMalformed // Message ID 0 is an unsolicited notification, e.g. before disconnecting
+	}
+	return children[1], nil
+}
+
+// ldapResult decodes the result code and diagnostic message of an LDAPResult
+func ldapResult(op *berElement) (int, string, error) {
+	children, err := berChildren(op.content)
+	if err != nil {
+		return 0, "", err
+	} else if len(children) < 3 || children[0].tag != berTagEnumerated {
+		return 0, "", errLDAPMalformed
+	}
+	code, err := berDecodeInt(children[0].content)
+	if err != nil {
+		return 0, "", err
+	}
+	return code, string(children[2].content), nil
+}
+
+func ldapDecodeEntry(op *berElement) (*ldapEntry, error) {
+	children, err := berChildren(op.content)
+	if err != nil {
+		return nil, err
+	} else if len(children) != 2 || children[0].tag != berTagOctetString || children[1].tag != berTagSequence {
+		return nil, errLDAPMalformed
+	}
+	attributes, err := berChildren(children[1].content)
+	if err != nil {
+		return nil, err
+	}
+	entry := &ldapEntry{dn: string(children[0].content), attributes: make(map[string][]string)}
+	for _, attribute := range attributes {
+		parts, err := berChildren(attribute.content)
+		if err != nil {
+			return nil, err
+		} else if len(parts) != 2 {
+			return nil, errLDAPMalformed
+		}
+		values, err := berChildren(parts[1].content)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(parts[0].content))
+		for _, value := range values {
+			entry.attributes[name] = append(entry.attributes[name], string(value.content))
+		}
+	}
+	return entry, nil
+}
+
+// ldapFilter is a parsed search filter (RFC 4515). Only the and (&), or (|), not (!), equality (attr=value) and
+// presence (attr=*) filters are supported. Values equal to ldapFilterPlaceholder are replaced when encoding it.
+type ldapFilter struct {
+	tag       byte
+	attribute string
+	value     string
+	children  []*ldapFilter
+}
+
+// parseLDAPFilter parses a filter such as (&(objectClass=person)(uid=%s))
+func parseLDAPFilter(s string) (*ldapFilter, error) {
+	filter, rest, err := parseLDAPFilterPart(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	} else if rest != "" {
+		return nil, errLDAPFilterInvalid
+	}
+	return filter, nil
+}
+
+func parseLDAPFilterPart(s string) (*ldapFilter, string, error) {
+	if len(s) < 3 || s[0] != '(' {
+		return nil, "", errLDAPFilterInvalid
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|', '!':
+		filter := &ldapFilter{tag: map[byte]byte{'&': ldapTagFilterAnd, '|': ldapTagFilterOr, '!': ldapTagFilterNot}[s[0]]}
+		s = s[1:]
+		for len(s) > 0 && s[0] == '(' {
+			child, rest, err := parseLDAPFilterPart(s)
+			if err != nil {
+				return nil, "", err
+			}
+			filter.children = append(filter.children, child)
+			s = rest
+		}
+		if len(s) == 0 || s[0] != ')' || len(filter.children) == 0 || (filter.tag == ldapTagFilterNot && len(filter.children) != 1) {
+			return nil, "", errLDAPFilterInvalid
+		}
+		return filter, s[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end == -1 {
+		return nil, "", errLDAPFilterInvalid
+	}
+	eq := strings.IndexByte(s[:end], '=')
+	if eq == -1 {
+		return nil, "", errLDAPFilterInvalid
+	}
+	attribute, value := s[:eq], s[eq+1:end]
+	if attribute == "" || strings.ContainsAny(attribute, "~<>:*(") {
+		return nil, "", errLDAPFilterInvalid
+	} else if value == "*" {
+		return &ldapFilter{tag: ldapTagFilterPresent, attribute: attribute}, s[end+1:], nil
+	} else if strings.Contains(value, "*") || value == "" {
+		return nil, "", errLDAPFilterInvalid // Substring filters are not supported
+	}
+	unescaped, err := unescapeLDAPFilterValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return &ldapFilter{tag: ldapTagFilterEquality, attribute: attribute, value: unescaped}, s[end+1:], nil
+}
+
+// unescapeLDAPFilterValue decodes the \XX hex escapes in a filter value
+func unescapeLDAPFilterValue(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		} else if i+2 >= len(s) {
+			return "", errLDAPFilterInvalid
+		}
+		decoded, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", errLDAPFilterInvalid
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// encode returns the BER encoding of the filter; exact matches of ldapFilterPlaceholder are replaced with value.
+// Since the value never passes through the filter parser, it does not have to be escaped.
+func (f *ldapFilter) encode(value string) []byte {
+	switch f.tag {
+	case ldapTagFilterPresent:
+		return berString(ldapTagFilterPresent, f.attribute)
+	case ldapTagFilterEquality:
+		v := f.value
+		if v == ldapFilterPlaceholder {
+			v = value
+		}
+		return berEncode(ldapTagFilterEquality, berString(berTagOctetString, f.attribute), berString(berTagOctetString, v))
+	}
+	children := make([][]byte, 0)
+	for _, child := range f.children {
+		children = append(children, child.encode(value))
+	}
+	return berEncode(f.tag, children...)
+}
+
+// hasPlaceholder returns true if any equality filter has ldapFilterPlaceholder as value
+func (f *ldapFilter) hasPlaceholder() bool {
+	if f.tag == ldapTagFilterEquality && f.value == ldapFilterPlaceholder {
+		return true
+	}
+	for _, child := range f.children {
+		if child.hasPlaceholder() {
+			return true
+		}
+	}
+	return false
+}
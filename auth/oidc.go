@@ -0,0 +1,284 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// This file implements the parts of OpenID Connect Discovery and JSON Web Tokens (RFC 7519) that are needed to
+// validate ID and access tokens issued by an OpenID Connect provider. Only asymmetric signatures (RS*, ES*) are
+// supported, since symmetric ones would require sharing the client secret with everyone who validates tokens.
+
+const (
+	oidcDiscoveryPath   = "/.well-known/openid-configuration"
+	oidcMaxResponseSize = 1024 * 1024
+)
+
+var (
+	errJWTMalformed        = errors.New("malformed JWT")
+	errJWTAlgorithmInvalid = errors.New("JWT algorithm not supported")
+	errJWTSignatureInvalid = errors.New("invalid JWT signature")
+)
+
+// oidcProviderMetadata is the subset of the provider's discovery document that is used
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcTokenResponse is the response of the token endpoint
+type oidcTokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// jwk is a JSON Web Key (RFC 7517) with an RSA or EC public key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwt is a parsed, but not yet verified, JSON Web Token
+type jwt struct {
+	header       jwtHeader
+	claims       map[string]interface{}
+	signingInput []byte
+	signature    []byte
+}
+
+func fetchOIDCProviderMetadata(client *http.Client, issuer string) (*oidcProviderMetadata, error) {
+	var metadata oidcProviderMetadata
+	if err := fetchJSON(client, strings.TrimSuffix(issuer, "/")+oidcDiscoveryPath, &metadata); err != nil {
+		return nil, err
+	} else if metadata.Issuer != issuer {
+		return nil, fmt.Errorf("OIDC issuer mismatch: expected %s, provider returned %s", issuer, metadata.Issuer)
+	} else if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document of %s is incomplete", issuer)
+	}
+	return &metadata, nil
+}
+
+// fetchJWKS returns the signing keys of the provider, by key ID. Keys that cannot be parsed are skipped.
+func fetchJWKS(client *http.Client, uri string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := fetchJSON(client, uri, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func fetchJSON(client *http.Client, uri string, v interface{}) error {
+	resp, err := client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response from %s: %s", uri, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(v)
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errJWTMalformed
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errJWTAlgorithmInvalid
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		} else if !curve.IsOnCurve(x, y) {
+			return nil, errJWTMalformed
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errJWTAlgorithmInvalid
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errJWTMalformed
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parseJWT decodes a token in the JWS compact serialization, without verifying it
+func parseJWT(token string) (*jwt, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errJWTMalformed
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errJWTMalformed
+	}
+	t := &jwt{signingInput: []byte(parts[0] + "." + parts[1]), signature: signature}
+	if err := json.Unmarshal(header, &t.header); err != nil {
+		return nil, errJWTMalformed
+	} else if err := json.Unmarshal(payload, &t.claims); err != nil {
+		return nil, errJWTMalformed
+	}
+	return t, nil
+}
+
+// verify checks the signature of the token with the given key. The key type must match the algorithm, so that
+// a token cannot be verified with a different algorithm than the key was meant for.
+func (t *jwt) verify(key crypto.PublicKey) error {
+	if !t.supportedAlgorithm() {
+		return errJWTAlgorithmInvalid
+	}
+	var hash crypto.Hash
+	switch t.header.Alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errJWTAlgorithmInvalid
+	}
+	digest := jwtDigest(hash, t.signingInput)
+	switch t.header.Alg[:2] {
+	case "RS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errJWTAlgorithmInvalid
+		} else if err := rsa.VerifyPKCS1v15(rsaKey, hash, digest, t.signature); err != nil {
+			return errJWTSignatureInvalid
+		}
+		return nil
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errJWTAlgorithmInvalid
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errJWTSignatureInvalid
+		}
+		r, s := new(big.Int).SetBytes(t.signature[:size]), new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errJWTSignatureInvalid
+		}
+		return nil
+	}
+	return errJWTAlgorithmInvalid
+}
+
+// supportedAlgorithm returns true if the algorithm is one of RS256/384/512 or ES256/384/512
+func (t *jwt) supportedAlgorithm() bool {
+	alg := t.header.Alg
+	return len(alg) == 5 && (strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "ES")) &&
+		(strings.HasSuffix(alg, "256") || strings.HasSuffix(alg, "384") || strings.HasSuffix(alg, "512"))
+}
+
+// stringClaim returns the claim as string, or an empty string if it does not exist or is not a string
+func (t *jwt) stringClaim(name string) string {
+	s, _ := t.claims[name].(string)
+	return s
+}
+
+// stringsClaim returns the claim as a list of strings; a single string is returned as list with one element
+func (t *jwt) stringsClaim(name string) []string {
+	values := make([]string, 0)
+	switch v := t.claims[name].(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// timeClaim returns a NumericDate claim (seconds since the epoch), and false if it does not exist
+func (t *jwt) timeClaim(name string) (int64, bool) {
+	f, ok := t.claims[name].(float64)
+	return int64(f), ok
+}
+
+func jwtDigest(hash crypto.Hash, b []byte) []byte {
+	switch hash {
+	case crypto.SHA384:
+		d := sha512.Sum384(b)
+		return d[:]
+	case crypto.SHA512:
+		d := sha512.Sum512(b)
+		return d[:]
+	}
+	d := sha256.Sum256(b)
+	return d[:]
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TOTP parameters, see RFC 6238. These are the defaults of all common authenticator apps, so they are
+// not configurable, and not included in the otpauth:// URL.
+const (
+	totpSecretLength = 20 // Bytes, as recommended by RFC 4226
+	totpPeriod       = 30 * time.Second
+	totpDigits       = 6
+	totpSkew         = 1 // Number of periods before and after the current one that are also accepted
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ValidateTOTP checks a time-based one-time password (TOTP) against the base32-encoded secret. To allow for clock
+// drift between the server and the user's device, the codes of the previous and the next period are also accepted.
+func ValidateTOTP(secret, code string, now time.Time) bool {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	counter := now.Unix() / int64(totpPeriod.Seconds())
+	valid := false
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, counter+i)), []byte(code)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// TOTPCode returns the TOTP code for the base32-encoded secret at the given time, as shown by an authenticator app
+func TOTPCode(secret string, now time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, now.Unix()/int64(totpPeriod.Seconds())), nil
+}
+
+// totpCode computes the HOTP value of the counter (RFC 4226, section 5.3)
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// generateTOTPSecret returns a new random base32-encoded TOTP secret
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
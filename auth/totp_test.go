@@ -0,0 +1,35 @@
+package auth_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"testing"
+	"time"
+)
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // base32("12345678901234567890"), the secret of RFC 6238, appendix B
+
+func TestTOTPCode_RFC6238(t *testing.T) {
+	// RFC 6238 lists 8-digit codes; the 6-digit codes are the last six digits
+	for unix, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := auth.TOTPCode(testTOTPSecret, time.Unix(unix, 0))
+		require.Nil(t, err)
+		require.Equal(t, expected, code)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	require.True(t, auth.ValidateTOTP(testTOTPSecret, "005924", now))
+	require.True(t, auth.ValidateTOTP(testTOTPSecret, "005924", now.Add(30*time.Second))) // Clock drift
+	require.True(t, auth.ValidateTOTP(testTOTPSecret, "005924", now.Add(-30*time.Second)))
+	require.False(t, auth.ValidateTOTP(testTOTPSecret, "005924", now.Add(2*time.Minute)))
+	require.False(t, auth.ValidateTOTP(testTOTPSecret, "005925", now))
+	require.False(t, auth.ValidateTOTP(testTOTPSecret, "5924", now))
+	require.False(t, auth.ValidateTOTP("not base32!", "005924", now))
+}
@@ -47,6 +47,7 @@ type Message struct { // TODO combine with server.message
 	Priority   int
 	Tags       []string
 	Click      string
+	Group      string
 	Attachment *Attachment
 
 	// Additional fields
@@ -148,6 +149,66 @@ func (c *Client) Poll(topic string, options ...SubscribeOption) ([]*Message, err
 	return messages, <-errChan
 }
 
+// Search queries the server for cached messages of a topic whose title, message or tags contain all words of
+// the query, and returns them, oldest first. Words are matched by prefix, so that "back" also finds "backup".
+//
+// The topic is expanded like in Subscribe. The filter options (e.g. WithPriorityFilter and WithTagsFilter)
+// and WithBasicAuth can be passed to narrow down the results.
+func (c *Client) Search(topic, query string, options ...SubscribeOption) ([]*Message, error) {
+	ctx := context.Background()
+	messages := make([]*Message, 0)
+	msgChan := make(chan *Message)
+	errChan := make(chan error)
+	topicURL := c.expandTopicURL(topic)
+	options = append(options, WithQueryParam("q", query))
+	go func() {
+		err := performMessagesRequest(ctx, msgChan, fmt.Sprintf("%s/search", topicURL), topicURL, "", options...)
+		close(msgChan)
+		errChan <- err
+	}()
+	for m := range msgChan {
+		messages = append(messages, m)
+	}
+	return messages, <-errChan
+}
+
+// Export writes all cached messages of a topic, including scheduled messages, to w as JSON lines. The output
+// can be imported into another server using Import.
+//
+// If the server has access control enabled, admin credentials have to be passed using WithBasicAuth.
+func (c *Client) Export(topic string, w io.Writer, options ...RequestOption) error {
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/export", c.expandTopicURL(topic)), nil)
+	resp, err := performRequest(req, options...)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import reads messages as JSON lines (as written by Export) from r, and adds them to the message cache of the
+// topic. Messages that already exist on the server are skipped. It returns the number of imported and skipped
+// messages.
+//
+// If the server has access control enabled, admin credentials have to be passed using WithBasicAuth.
+func (c *Client) Import(topic string, r io.Reader, options ...RequestOption) (imported int, skipped int, err error) {
+	req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/import", c.expandTopicURL(topic)), r)
+	resp, err := performRequest(req, options...)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Imported int `json:"imported"`
+		Skipped  int `json:"skipped"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBytes)).Decode(&result); err != nil {
+		return 0, 0, err
+	}
+	return result.Imported, result.Skipped, nil
+}
+
 // Subscribe subscribes to a topic to listen for newly incoming messages. The method starts a connection in the
 // background and returns new messages via the Messages channel.
 //
@@ -237,8 +298,35 @@ func handleSubscribeConnLoop(ctx context.Context, msgChan chan *Message, topicUR
 	}
 }
 
+// performRequest applies the options to the request and sends it. If the response status is not 200 OK,
+// the response body is returned as error.
+func performRequest(req *http.Request, options ...RequestOption) (*http.Response, error) {
+	for _, option := range options {
+		if err := option(req); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New(strings.TrimSpace(string(b)))
+	}
+	return resp, nil
+}
+
 func performSubscribeRequest(ctx context.Context, msgChan chan *Message, topicURL string, subscriptionID string, options ...SubscribeOption) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/json", topicURL), nil)
+	return performMessagesRequest(ctx, msgChan, fmt.Sprintf("%s/json", topicURL), topicURL, subscriptionID, options...)
+}
+
+func performMessagesRequest(ctx context.Context, msgChan chan *Message, url, topicURL, subscriptionID string, options ...SubscribeOption) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
@@ -1,10 +1,12 @@
 package client_test
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/client"
 	"heckel.io/ntfy/test"
+	"strings"
 	"testing"
 	"time"
 )
@@ -94,6 +96,60 @@ func TestClient_Publish_Poll(t *testing.T) {
 	require.Equal(t, "some delayed message", messages[1].Message)
 }
 
+func TestClient_Publish_Search(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	_, err := c.Publish("mytopic", "backup failed", client.WithPriority("high"))
+	require.Nil(t, err)
+	_, err = c.Publish("mytopic", "backup succeeded")
+	require.Nil(t, err)
+
+	messages, err := c.Search("mytopic", "back")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "backup failed", messages[0].Message)
+	require.Equal(t, "backup succeeded", messages[1].Message)
+
+	messages, err = c.Search("mytopic", "backup", client.WithPriorityFilter(4))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "backup failed", messages[0].Message)
+
+	_, err = c.Search("mytopic", "")
+	require.Error(t, err)
+}
+
+func TestClient_Export_Import(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	c := client.New(newTestConfig(port))
+
+	_, err := c.Publish("mytopic", "message 1")
+	require.Nil(t, err)
+	_, err = c.Publish("mytopic", "message 2", client.WithDelay("20 min"))
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	require.Nil(t, c.Export("mytopic", &buf))
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	imported, skipped, err := c.Import("othertopic", strings.NewReader(buf.String()))
+	require.Nil(t, err)
+	require.Equal(t, 2, imported)
+	require.Equal(t, 0, skipped)
+
+	messages, err := c.Poll("othertopic", client.WithScheduled())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+
+	_, _, err = c.Import("othertopic", strings.NewReader("invalid"))
+	require.Error(t, err)
+}
+
 func newTestConfig(port int) *client.Config {
 	c := client.NewConfig()
 	c.DefaultHost = fmt.Sprintf("http://127.0.0.1:%d", port)
@@ -51,6 +51,19 @@ func WithDelay(delay string) PublishOption {
 	return WithHeader("X-Delay", delay)
 }
 
+// WithExpires instructs the server to remove the message from its cache once the given time has passed. Like
+// the delay, it can be a Unix timestamp, a duration string or a natural language string; durations are relative
+// to the delivery date. See https://ntfy.sh/docs/publish/#message-expiry for details.
+func WithExpires(expires string) PublishOption {
+	return WithHeader("X-Expires", expires)
+}
+
+// WithDedupKey sets an idempotency key for the message. If a message with the same key was published to the topic
+// recently, the server returns that message instead of publishing a new one, which makes it safe to retry.
+func WithDedupKey(key string) PublishOption {
+	return WithHeader("X-Dedup-Key", key)
+}
+
 // WithClick makes the notification action open the given URL as opposed to entering the detail view
 func WithClick(url string) PublishOption {
 	return WithHeader("X-Click", url)
@@ -77,11 +90,22 @@ func WithEmail(email string) PublishOption {
 	return WithHeader("X-Email", email)
 }
 
+// WithEmailDigest instructs the server to batch the e-mails (see WithEmail) for the topic into a single e-mail
+// per time window, e.g. 15m
+func WithEmailDigest(window string) PublishOption {
+	return WithHeader("X-Email-Digest", window)
+}
+
 // WithBasicAuth adds the Authorization header for basic auth to the request
 func WithBasicAuth(user, pass string) PublishOption {
 	return WithHeader("Authorization", util.BasicAuth(user, pass))
 }
 
+// WithBearerAuth adds the Authorization header for bearer auth (e.g. with an access token) to the request
+func WithBearerAuth(token string) PublishOption {
+	return WithHeader("Authorization", "Bearer "+token)
+}
+
 // WithNoCache instructs the server not to cache the message server-side
 func WithNoCache() PublishOption {
 	return WithHeader("X-Cache", "no")
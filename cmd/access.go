@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"heckel.io/ntfy/auth"
-	"heckel.io/ntfy/util"
 )
 
 const (
@@ -28,8 +27,8 @@ var cmdAccess = &cli.Command{
 	Description: `Manage the access control list for the ntfy server.
 
 This is a server-only command. It directly manages the user.db as defined in the server config
-file server.yml. The command only works if 'auth-file' is properly defined. Please also refer
-to the related command 'ntfy user'.
+file server.yml. The command only works if 'auth-file' (or 'auth-dsn', if auth-backend
+is postgres) is properly defined. Please also refer to the related command 'ntfy user'.
 
 The command allows you to show the access control list, as well as change it, depending on how
 it is called.
@@ -42,12 +41,21 @@ Usage:
 Arguments:
   USERNAME     an existing user, as created with 'ntfy user add', or "everyone"/"*"
                to define access rules for anonymous/unauthenticated clients
-  TOPIC        name of a topic with optional wildcards, e.g. "mytopic*"
+  TOPIC        name of a topic with optional wildcards, e.g. "mytopic*" or "alerts-*-prod";
+               "*" matches any characters, "?" a single character, and "[...]" a character
+               class, e.g. "team[0-9]"; alternatively, a regular expression enclosed in ^ and $,
+               e.g. "^team[0-9]+$"
   PERMISSION   one of the following:
                - read-write (alias: rw) 
                - read-only (aliases: read, ro)
                - write-only (aliases: write, wo)
                - deny (alias: none)
+               or a comma-separated list of fine-grained permissions:
+               - subscribe: receive new messages (part of read)
+               - poll: retrieve cached messages, e.g. with poll=1 or since=... (part of read)
+               - publish: publish, update and delete messages (part of write)
+               - attach: attach files to messages (part of write)
+               - email: forward messages via e-mail (part of write)
 
 Examples:
   ntfy access                        # Shows access control list (alias: 'ntfy user list')
@@ -55,6 +63,10 @@ Examples:
   ntfy access phil mytopic rw        # Allow read-write access to mytopic for user phil
   ntfy access everyone mytopic rw    # Allow anonymous read-write access to mytopic
   ntfy access everyone "up*" write   # Allow anonymous write-only access to topics "up..." 
+  ntfy access ben "alerts-*-prod" ro # Allow read-only access to topics like "alerts-db-prod"
+  ntfy access ben '^team[0-9]+$' rw  # Allow read-write access to topics "team1", "team42", ...
+  ntfy access sensor temp publish    # Allow user sensor to publish to temp, but not to read or attach files
+  ntfy access ben temp subscribe     # Allow user ben to receive new messages, but not to poll or publish
   ntfy access --reset                # Reset entire access control list
   ntfy access --reset phil           # Reset all access for user phil
   ntfy access --reset phil mytopic   # Reset access for user phil and topic mytopic
@@ -91,28 +103,26 @@ func execUserAccess(c *cli.Context) error {
 }
 
 func changeAccess(c *cli.Context, manager auth.Manager, username string, topic string, perms string) error {
-	if !util.InStringList([]string{"", "read-write", "rw", "read-only", "read", "ro", "write-only", "write", "wo", "none", "deny"}, perms) {
-		return errors.New("permission must be one of: read-write, read-only, write-only, or deny (or the aliases: read, ro, write, wo, none)")
+	if !auth.AllowedTopicPattern(topic) {
+		return fmt.Errorf("invalid topic pattern %s, expected a topic name with optional wildcards (*, ?, [...]) or a regular expression like ^team[0-9]+$", topic)
+	}
+	perm, err := auth.ParsePermissions(perms)
+	if err != nil {
+		return errors.New("permission must be one of: read-write, read-only, write-only, or deny (or the aliases: read, ro, write, wo, none), or a comma-separated list of: subscribe, poll, publish, attach, email")
 	}
-	read := util.InStringList([]string{"read-write", "rw", "read-only", "read", "ro"}, perms)
-	write := util.InStringList([]string{"read-write", "rw", "write-only", "write", "wo"}, perms)
 	user, err := manager.User(username)
 	if err == auth.ErrNotFound {
 		return fmt.Errorf("user %s does not exist", username)
 	} else if user.Role == auth.RoleAdmin {
 		return fmt.Errorf("user %s is an admin user, access control entries have no effect", username)
 	}
-	if err := manager.AllowAccess(username, topic, read, write); err != nil {
+	if err := manager.AllowPermissions(username, topic, perm); err != nil {
 		return err
 	}
-	if read && write {
-		fmt.Fprintf(c.App.ErrWriter, "granted read-write access to topic %s\n\n", topic)
-	} else if read {
-		fmt.Fprintf(c.App.ErrWriter, "granted read-only access to topic %s\n\n", topic)
-	} else if write {
-		fmt.Fprintf(c.App.ErrWriter, "granted write-only access to topic %s\n\n", topic)
-	} else {
+	if perm == 0 {
 		fmt.Fprintf(c.App.ErrWriter, "revoked all access to topic %s\n\n", topic)
+	} else {
+		fmt.Fprintf(c.App.ErrWriter, "granted %s access to topic %s\n\n", perm, topic)
 	}
 	return showUserAccess(c, manager, username)
 }
@@ -177,12 +187,21 @@ func showUserAccess(c *cli.Context, manager auth.Manager, username string) error
 
 func showUsers(c *cli.Context, manager auth.Manager, users []*auth.User) error {
 	for _, user := range users {
-		fmt.Fprintf(c.App.ErrWriter, "user %s (%s)\n", user.Name, user.Role)
+		if user.Tier != nil {
+			fmt.Fprintf(c.App.ErrWriter, "user %s (%s, tier %s)\n", user.Name, user.Role, user.Tier.Code)
+		} else {
+			fmt.Fprintf(c.App.ErrWriter, "user %s (%s)\n", user.Name, user.Role)
+		}
+		if user.TOTP != "" {
+			fmt.Fprintln(c.App.ErrWriter, "- two-factor authentication enabled")
+		}
 		if user.Role == auth.RoleAdmin {
 			fmt.Fprintf(c.App.ErrWriter, "- read-write access to all topics (admin role)\n")
 		} else if len(user.Grants) > 0 {
 			for _, grant := range user.Grants {
-				if grant.AllowRead && grant.AllowWrite {
+				if grant.Deny != 0 {
+					fmt.Fprintf(c.App.ErrWriter, "- %s access to topic %s\n", grant.Permissions(), grant.TopicPattern)
+				} else if grant.AllowRead && grant.AllowWrite {
 					fmt.Fprintf(c.App.ErrWriter, "- read-write access to topic %s\n", grant.TopicPattern)
 				} else if grant.AllowRead {
 					fmt.Fprintf(c.App.ErrWriter, "- read-only access to topic %s\n", grant.TopicPattern)
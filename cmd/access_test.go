@@ -76,6 +76,78 @@ user * (anonymous)
 	}))
 }
 
+func TestCLI_Access_FineGrained(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("sensorpass\nsensorpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "sensor"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "sensor", "readings", "publish"))
+	require.Contains(t, stderr.String(), "granted publish access to topic readings")
+	require.Contains(t, stderr.String(), "user sensor (user)\n- publish access to topic readings\n")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "everyone", "readings", "subscribe,poll"))
+	require.Contains(t, stderr.String(), "granted read-only access to topic readings")
+
+	app, _, _, _ = newTestApp()
+	err := runAccessCommand(app, conf, "sensor", "readings", "publish,maybe")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "permission must be one of")
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "sensor:sensorpass",
+		fmt.Sprintf("http://127.0.0.1:%d/readings", port),
+		"21.5",
+	}))
+	require.Error(t, app.Run([]string{
+		"ntfy",
+		"subscribe",
+		"--poll",
+		"-u", "sensor:sensorpass",
+		fmt.Sprintf("http://127.0.0.1:%d/readings", port),
+	}))
+}
+
+func TestCLI_Access_TopicPatterns(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("benpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "ben", "alerts-*-prod", "ro"))
+	require.Nil(t, runAccessCommand(app, conf, "ben", "^team[0-9]+$", "rw"))
+	require.Contains(t, stderr.String(), "- read-only access to topic alerts-*-prod\n- read-write access to topic ^team[0-9]+$\n")
+
+	app, _, _, _ = newTestApp()
+	err := runAccessCommand(app, conf, "ben", "^team[0-9+$", "rw")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid topic pattern")
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "ben:benpass",
+		fmt.Sprintf("http://127.0.0.1:%d/team42", port),
+	}))
+	require.Error(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"-u", "ben:benpass",
+		fmt.Sprintf("http://127.0.0.1:%d/alerts-db-prod", port),
+	}))
+}
+
 func runAccessCommand(app *cli.App, conf *server.Config, args ...string) error {
 	userArgs := []string{
 		"ntfy",
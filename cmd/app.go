@@ -35,10 +35,15 @@ func New() *cli.App {
 			cmdServe,
 			cmdUser,
 			cmdAccess,
+			cmdToken,
+			cmdTier,
 
 			// Client commands
 			cmdPublish,
 			cmdSubscribe,
+			cmdSearch,
+			cmdExport,
+			cmdImport,
 		},
 	}
 }
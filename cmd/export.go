@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/client"
+	"heckel.io/ntfy/util"
+	"io"
+	"os"
+	"strings"
+)
+
+var cmdExport = &cli.Command{
+	Name:      "export",
+	Usage:     "Export the cached messages of a topic on a ntfy server",
+	UsageText: "ntfy export [OPTIONS..] TOPIC",
+	Action:    execExport,
+	Category:  categoryClient,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "client config file"},
+		&cli.StringFlag{Name: "user", Aliases: []string{"u"}, Usage: "username[:password] of an admin user, if access control is enabled"},
+		&cli.StringFlag{Name: "file", Aliases: []string{"f"}, Usage: "write messages to `FILE` instead of stdout"},
+	},
+	Description: `Export all cached messages of a topic, including scheduled messages, as JSON lines.
+The output can be imported into another server using 'ntfy import', e.g. to migrate topics
+to a new server, or to back them up without stopping the server.
+
+If the server has access control enabled, only admin users can export messages.
+
+Examples:
+  ntfy export mytopic                               # Print messages of ntfy.sh/mytopic
+  ntfy export -f backups.ndjson home.lan/backups    # Write messages to a file
+  ntfy export -u phil:mypass secret > secret.ndjson # Export with username/password
+
+The default config file for all client commands is /etc/ntfy/client.yml (if root user),
+or ~/.config/ntfy/client.yml for all other users.`,
+}
+
+var cmdImport = &cli.Command{
+	Name:      "import",
+	Usage:     "Import messages into the cache of a topic on a ntfy server",
+	UsageText: "ntfy import [OPTIONS..] TOPIC",
+	Action:    execImport,
+	Category:  categoryClient,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "client config file"},
+		&cli.StringFlag{Name: "user", Aliases: []string{"u"}, Usage: "username[:password] of an admin user, if access control is enabled"},
+		&cli.StringFlag{Name: "file", Aliases: []string{"f"}, Usage: "read messages from `FILE` instead of stdin"},
+	},
+	Description: `Import messages that were exported using 'ntfy export' into the message cache of a
+topic. The messages keep their IDs and times, but are not delivered to subscribers. Messages
+that exist already are skipped, so it is safe to import the same file more than once.
+
+If the server has access control enabled, only admin users can import messages.
+
+Examples:
+  ntfy import -f backups.ndjson new.lan/backups     # Import messages from a file
+  ntfy export old.lan/alerts | ntfy import new.lan/alerts
+
+The default config file for all client commands is /etc/ntfy/client.yml (if root user),
+or ~/.config/ntfy/client.yml for all other users.`,
+}
+
+func execExport(c *cli.Context) error {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	if c.NArg() < 1 {
+		return errors.New("must specify topic, type 'ntfy export --help' for help")
+	}
+	topic := c.Args().Get(0)
+	options, err := exportImportOptions(c)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = c.App.Writer
+	if file := c.String("file"); file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return client.New(conf).Export(topic, w, options...)
+}
+
+func execImport(c *cli.Context) error {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	if c.NArg() < 1 {
+		return errors.New("must specify topic, type 'ntfy import --help' for help")
+	}
+	topic := c.Args().Get(0)
+	options, err := exportImportOptions(c)
+	if err != nil {
+		return err
+	}
+	r := c.App.Reader
+	if file := c.String("file"); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	imported, skipped, err := client.New(conf).Import(topic, r, options...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "%d message(s) imported, %d skipped (already existed)\n", imported, skipped)
+	return nil
+}
+
+func exportImportOptions(c *cli.Context) ([]client.RequestOption, error) {
+	user := c.String("user")
+	if user == "" {
+		return nil, nil
+	}
+	var pass string
+	parts := strings.SplitN(user, ":", 2)
+	if len(parts) == 2 {
+		user = parts[0]
+		pass = parts[1]
+	} else {
+		fmt.Fprint(c.App.ErrWriter, "Enter Password: ")
+		p, err := util.ReadPassword(c.App.Reader)
+		if err != nil {
+			return nil, err
+		}
+		pass = string(p)
+		fmt.Fprintf(c.App.ErrWriter, "\r%s\r", strings.Repeat(" ", 20))
+	}
+	return []client.RequestOption{client.WithBasicAuth(user, pass)}, nil
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/test"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCLI_Export_Import(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	topic := fmt.Sprintf("http://127.0.0.1:%d/mytopic", port)
+	otherTopic := fmt.Sprintf("http://127.0.0.1:%d/othertopic", port)
+	filename := filepath.Join(t.TempDir(), "mytopic.ndjson")
+
+	app, _, _, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", topic, "some message"}))
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "export", "--file", filename, topic}))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "import", "-f", filename, otherTopic}))
+	require.Equal(t, "1 message(s) imported, 0 skipped (already existed)\n", stderr.String())
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "export", otherTopic}))
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Equal(t, 1, len(lines))
+	m := toMessage(t, lines[0])
+	require.Equal(t, "othertopic", m.Topic)
+	require.Equal(t, "some message", m.Message)
+}
+
+func TestCLI_Import_Stdin(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	topic := fmt.Sprintf("http://127.0.0.1:%d/mytopic", port)
+
+	app, stdin, _, stderr := newTestApp()
+	stdin.WriteString(`{"id":"nFS3knfcQ1xe","time":1,"event":"message","topic":"old","message":"imported"}` + "\n")
+	require.Nil(t, app.Run([]string{"ntfy", "import", topic}))
+	require.Equal(t, "1 message(s) imported, 0 skipped (already existed)\n", stderr.String())
+
+	app, stdin, _, _ = newTestApp()
+	stdin.WriteString("invalid")
+	require.Error(t, app.Run([]string{"ntfy", "import", topic}))
+}
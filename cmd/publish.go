@@ -25,13 +25,17 @@ var cmdPublish = &cli.Command{
 		&cli.StringFlag{Name: "priority", Aliases: []string{"p"}, EnvVars: []string{"NTFY_PRIORITY"}, Usage: "priority of the message (1=min, 2=low, 3=default, 4=high, 5=max)"},
 		&cli.StringFlag{Name: "tags", Aliases: []string{"tag", "T"}, EnvVars: []string{"NTFY_TAGS"}, Usage: "comma separated list of tags and emojis"},
 		&cli.StringFlag{Name: "delay", Aliases: []string{"at", "in", "D"}, EnvVars: []string{"NTFY_DELAY"}, Usage: "delay/schedule message"},
+		&cli.StringFlag{Name: "expires", Aliases: []string{"expire"}, EnvVars: []string{"NTFY_EXPIRES"}, Usage: "remove message from the server cache after this time (e.g. 2h)"},
+		&cli.StringFlag{Name: "dedup-key", Aliases: []string{"dedup"}, EnvVars: []string{"NTFY_DEDUP_KEY"}, Usage: "do not publish again if a message with this key was published recently (safe retries)"},
 		&cli.StringFlag{Name: "click", Aliases: []string{"U"}, EnvVars: []string{"NTFY_CLICK"}, Usage: "URL to open when notification is clicked"},
 		&cli.StringFlag{Name: "actions", Aliases: []string{"A"}, EnvVars: []string{"NTFY_ACTIONS"}, Usage: "actions JSON array or simple definition"},
 		&cli.StringFlag{Name: "attach", Aliases: []string{"a"}, EnvVars: []string{"NTFY_ATTACH"}, Usage: "URL to send as an external attachment"},
 		&cli.StringFlag{Name: "filename", Aliases: []string{"name", "n"}, EnvVars: []string{"NTFY_FILENAME"}, Usage: "filename for the attachment"},
 		&cli.StringFlag{Name: "file", Aliases: []string{"f"}, EnvVars: []string{"NTFY_FILE"}, Usage: "file to upload as an attachment"},
 		&cli.StringFlag{Name: "email", Aliases: []string{"mail", "e"}, EnvVars: []string{"NTFY_EMAIL"}, Usage: "also send to e-mail address"},
+		&cli.StringFlag{Name: "email-digest", Aliases: []string{"digest"}, EnvVars: []string{"NTFY_EMAIL_DIGEST"}, Usage: "batch e-mails for this topic into one e-mail per time window (e.g. 15m)"},
 		&cli.StringFlag{Name: "user", Aliases: []string{"u"}, EnvVars: []string{"NTFY_USER"}, Usage: "username[:password] used to auth against the server"},
+		&cli.StringFlag{Name: "token", Aliases: []string{"k"}, EnvVars: []string{"NTFY_TOKEN"}, Usage: "access token used to auth against the server"},
 		&cli.BoolFlag{Name: "no-cache", Aliases: []string{"C"}, EnvVars: []string{"NTFY_NO_CACHE"}, Usage: "do not cache message server-side"},
 		&cli.BoolFlag{Name: "no-firebase", Aliases: []string{"F"}, EnvVars: []string{"NTFY_NO_FIREBASE"}, Usage: "do not forward message to Firebase"},
 		&cli.BoolFlag{Name: "env-topic", Aliases: []string{"P"}, EnvVars: []string{"NTFY_ENV_TOPIC"}, Usage: "use topic from NTFY_TOPIC env variable"},
@@ -46,12 +50,16 @@ Examples:
   ntfy pub --tags=warning,skull backups "Backups failed"  # Add tags/emojis to message
   ntfy pub --delay=10s delayed_topic Laterzz              # Delay message by 10s
   ntfy pub --at=8:30am delayed_topic Laterzz              # Send message at 8:30am
+  ntfy pub --expires=1h deploys 'Deploy in progress'      # Forget message after one hour
+  ntfy pub --dedup=backup-2022-05-01 backups 'Done'       # Publish only once, even if the command is retried
   ntfy pub -e phil@example.com alerts 'App is down!'      # Also send email to phil@example.com
+  ntfy pub -e phil@example.com --digest=15m ci 'Failed'   # Send one summary email every 15 minutes at most
   ntfy pub --click="https://reddit.com" redd 'New msg'    # Opens Reddit when notification is clicked
   ntfy pub --attach="http://some.tld/file.zip" files      # Send ZIP archive from URL as attachment
   ntfy pub --file=flower.jpg flowers 'Nice!'              # Send image.jpg as attachment
   ntfy pub -u phil:mypass secret Psst                     # Publish with username/password
   NTFY_USER=phil:mypass ntfy pub secret Psst              # Use env variables to set username/password
+  ntfy pub --token=tk_AgQdq7mVBoFD37zQVN2 secret Psst     # Publish with access token (see 'ntfy token')
   NTFY_TOPIC=mytopic ntfy pub -P "some message""          # Use NTFY_TOPIC variable as topic 
   cat flower.jpg | ntfy pub --file=- flowers 'Nice!'      # Same as above, send image.jpg as attachment
   ntfy trigger mywebhook                                  # Sending without message, useful for webhooks
@@ -72,13 +80,17 @@ func execPublish(c *cli.Context) error {
 	priority := c.String("priority")
 	tags := c.String("tags")
 	delay := c.String("delay")
+	expires := c.String("expires")
+	dedupKey := c.String("dedup-key")
 	click := c.String("click")
 	actions := c.String("actions")
 	attach := c.String("attach")
 	filename := c.String("filename")
 	file := c.String("file")
 	email := c.String("email")
+	emailDigest := c.String("email-digest")
 	user := c.String("user")
+	token := c.String("token")
 	noCache := c.Bool("no-cache")
 	noFirebase := c.Bool("no-firebase")
 	envTopic := c.Bool("env-topic")
@@ -111,6 +123,12 @@ func execPublish(c *cli.Context) error {
 	if delay != "" {
 		options = append(options, client.WithDelay(delay))
 	}
+	if expires != "" {
+		options = append(options, client.WithExpires(expires))
+	}
+	if dedupKey != "" {
+		options = append(options, client.WithDedupKey(dedupKey))
+	}
 	if click != "" {
 		options = append(options, client.WithClick(click))
 	}
@@ -126,6 +144,9 @@ func execPublish(c *cli.Context) error {
 	if email != "" {
 		options = append(options, client.WithEmail(email))
 	}
+	if emailDigest != "" {
+		options = append(options, client.WithEmailDigest(emailDigest))
+	}
 	if noCache {
 		options = append(options, client.WithNoCache())
 	}
@@ -148,6 +169,8 @@ func execPublish(c *cli.Context) error {
 			fmt.Fprintf(c.App.ErrWriter, "\r%s\r", strings.Repeat(" ", 20))
 		}
 		options = append(options, client.WithBasicAuth(user, pass))
+	} else if token != "" {
+		options = append(options, client.WithBearerAuth(token))
 	}
 	var body io.Reader
 	if file == "" {
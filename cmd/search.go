@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/client"
+	"heckel.io/ntfy/util"
+	"strings"
+)
+
+var cmdSearch = &cli.Command{
+	Name:      "search",
+	Usage:     "Search the cached messages of a topic on a ntfy server",
+	UsageText: "ntfy search [OPTIONS..] TOPIC QUERY",
+	Action:    execSearch,
+	Category:  categoryClient,
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "client config file"},
+		&cli.StringFlag{Name: "user", Aliases: []string{"u"}, Usage: "username[:password] used to auth against the server"},
+		&cli.StringFlag{Name: "priority", Aliases: []string{"p"}, Usage: "only return messages with priority `PRIORITY` (comma-separated list)"},
+		&cli.StringFlag{Name: "tags", Aliases: []string{"tag", "T"}, Usage: "only return messages with all tags `TAGS` (comma-separated list)"},
+	},
+	Description: `Search the cached messages of a topic for one or more words, and print the JSON
+representation of every matching message, oldest first. The words are searched for in 
+the title, the message and the tags of each message, and all of them must match. Words
+are matched by prefix, so "back" also finds messages containing "backup".
+
+Only messages that are still in the message cache of the server can be found. 
+
+Examples:
+  ntfy search mytopic disk full                  # Search ntfy.sh/mytopic for "disk" and "full"
+  ntfy search home.lan/backups failed            # Search topic on different server
+  ntfy search -p urgent,high alerts db           # Search high priority messages only
+  ntfy search -u phil:mypass secret password     # Search with username/password
+
+The default config file for all client commands is /etc/ntfy/client.yml (if root user),
+or ~/.config/ntfy/client.yml for all other users.`,
+}
+
+func execSearch(c *cli.Context) error {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	cl := client.New(conf)
+	user := c.String("user")
+	priority := c.String("priority")
+	tags := c.String("tags")
+	if c.NArg() < 2 {
+		return errors.New("must specify topic and query, type 'ntfy search --help' for help")
+	}
+	topic := c.Args().Get(0)
+	query := strings.Join(c.Args().Slice()[1:], " ")
+	var options []client.SubscribeOption
+	if priority != "" {
+		options = append(options, client.WithFilter("priority", priority))
+	}
+	if tags != "" {
+		options = append(options, client.WithFilter("tags", tags))
+	}
+	if user != "" {
+		var pass string
+		parts := strings.SplitN(user, ":", 2)
+		if len(parts) == 2 {
+			user = parts[0]
+			pass = parts[1]
+		} else {
+			fmt.Fprint(c.App.ErrWriter, "Enter Password: ")
+			p, err := util.ReadPassword(c.App.Reader)
+			if err != nil {
+				return err
+			}
+			pass = string(p)
+			fmt.Fprintf(c.App.ErrWriter, "\r%s\r", strings.Repeat(" ", 20))
+		}
+		options = append(options, client.WithBasicAuth(user, pass))
+	}
+	messages, err := cl.Search(topic, query, options...)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		fmt.Fprintln(c.App.Writer, m.Raw)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/test"
+	"strings"
+	"testing"
+)
+
+func TestCLI_Search(t *testing.T) {
+	s, port := test.StartServer(t)
+	defer test.StopServer(t, s, port)
+	topic := fmt.Sprintf("http://127.0.0.1:%d/mytopic", port)
+
+	app, _, _, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--priority", "high", topic, "backup failed: disk full"}))
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", topic, "backup succeeded"}))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "search", topic, "back"}))
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Equal(t, 2, len(lines))
+	require.Equal(t, "backup failed: disk full", toMessage(t, lines[0]).Message)
+	require.Equal(t, "backup succeeded", toMessage(t, lines[1]).Message)
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "search", "--priority", "high", topic, "backup"}))
+	require.Equal(t, "backup failed: disk full", toMessage(t, stdout.String()).Message)
+}
+
+func TestCLI_Search_MissingQuery(t *testing.T) {
+	app, _, _, _ := newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "search", "mytopic"}))
+}
@@ -70,6 +70,120 @@ func TestCLI_Serve_WebSocket(t *testing.T) {
 	require.Equal(t, "mytopic", m.Topic)
 }
 
+func TestParseFirebaseProjects(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "acme-firebase.json")
+	require.Nil(t, os.WriteFile(keyFile, []byte("{}"), 0600))
+	projects, err := parseFirebaseProjects([]string{"acme-=" + keyFile, "widgets=" + keyFile})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"acme-": keyFile, "widgets": keyFile}, projects)
+
+	_, err = parseFirebaseProjects([]string{"acme-"})
+	require.Error(t, err)
+	_, err = parseFirebaseProjects([]string{"acme/=" + keyFile})
+	require.Error(t, err)
+	_, err = parseFirebaseProjects([]string{"acme-=/does/not/exist.json"})
+	require.Error(t, err)
+	_, err = parseFirebaseProjects([]string{"acme-=" + keyFile, "acme-=" + keyFile})
+	require.Error(t, err)
+}
+
+func TestParseMatrixRooms(t *testing.T) {
+	rooms, err := parseMatrixRooms([]string{"!abcdef:example.com=alerts", "!ghijkl:matrix.org:8448=alerts"})
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"!abcdef:example.com": "alerts", "!ghijkl:matrix.org:8448": "alerts"}, rooms)
+
+	_, err = parseMatrixRooms([]string{"!abcdef:example.com"})
+	require.Error(t, err)
+	_, err = parseMatrixRooms([]string{"#alerts:example.com=alerts"})
+	require.Error(t, err)
+	_, err = parseMatrixRooms([]string{"!abcdef:example.com=not/a/topic"})
+	require.Error(t, err)
+	_, err = parseMatrixRooms([]string{"!abcdef:example.com=alerts", "!abcdef:example.com=backups"})
+	require.Error(t, err)
+}
+
+func TestParseTelegramChats(t *testing.T) {
+	chats, err := parseTelegramChats([]string{"alerts=-1001234567890", "alerts=@ops_alerts", "backups=123456"})
+	require.Nil(t, err)
+	require.Equal(t, map[string][]string{"alerts": {"-1001234567890", "@ops_alerts"}, "backups": {"123456"}}, chats)
+
+	_, err = parseTelegramChats([]string{"alerts"})
+	require.Error(t, err)
+	_, err = parseTelegramChats([]string{"alerts=ops_alerts"})
+	require.Error(t, err)
+	_, err = parseTelegramChats([]string{"not/a/topic=123456"})
+	require.Error(t, err)
+}
+
+func TestParseCacheDurationTopics(t *testing.T) {
+	durations, err := parseCacheDurationTopics([]string{"backups=720h", " chatty-logs = 1h "}, time.Minute)
+	require.Nil(t, err)
+	require.Equal(t, map[string]time.Duration{"backups": 720 * time.Hour, "chatty-logs": time.Hour}, durations)
+
+	_, err = parseCacheDurationTopics([]string{"backups"}, time.Minute)
+	require.Error(t, err)
+	_, err = parseCacheDurationTopics([]string{"=1h"}, time.Minute)
+	require.Error(t, err)
+	_, err = parseCacheDurationTopics([]string{"not/a/topic=1h"}, time.Minute)
+	require.Error(t, err)
+	_, err = parseCacheDurationTopics([]string{"backups=30d"}, time.Minute)
+	require.Error(t, err)
+	_, err = parseCacheDurationTopics([]string{"backups=10s"}, time.Minute)
+	require.Error(t, err)
+}
+
+func TestParseSMTPServerTopicRules(t *testing.T) {
+	rules, err := parseSMTPServerTopicRules([]string{`alerts-(.+)@corp\.example\.com=datacenter-$1`, `a=b=c`})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(rules))
+	require.Equal(t, `^(?:alerts-(.+)@corp\.example\.com)$`, rules[0].Pattern.String())
+	require.Equal(t, "datacenter-$1", rules[0].Topic)
+	require.Equal(t, `^(?:a=b)$`, rules[1].Pattern.String())
+	require.Equal(t, "c", rules[1].Topic)
+
+	_, err = parseSMTPServerTopicRules([]string{"no-separator"})
+	require.Error(t, err)
+	_, err = parseSMTPServerTopicRules([]string{"=topic"})
+	require.Error(t, err)
+	_, err = parseSMTPServerTopicRules([]string{"pattern="})
+	require.Error(t, err)
+	_, err = parseSMTPServerTopicRules([]string{"alerts-(.+@corp=topic"})
+	require.Error(t, err)
+}
+
+func TestParseSyslogTopicRules(t *testing.T) {
+	rules, err := parseSyslogTopicRules([]string{`sshd|sudo=auth-logs`, `(.+)-backup=backups-$1`})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(rules))
+	require.Equal(t, `^(?:sshd|sudo)$`, rules[0].Pattern.String())
+	require.Equal(t, "auth-logs", rules[0].Topic)
+	require.Equal(t, "backups-$1", rules[1].Topic)
+
+	_, err = parseSyslogTopicRules([]string{"sshd"})
+	require.EqualError(t, err, "invalid syslog-topic-rule sshd, expected format <regex>=<topic-template>")
+	_, err = parseSyslogTopicRules([]string{"(sshd=auth-logs"})
+	require.Error(t, err)
+}
+
+func TestParseSMTPServerSenders(t *testing.T) {
+	patterns, err := parseSMTPServerSenders("smtp-server-allowed-senders", []string{"*@example.com", "alerts-??@corp.example.com", `/.+@(a|b)\.com/`})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(patterns))
+	require.True(t, patterns[0].MatchString("phil@example.com"))
+	require.True(t, patterns[0].MatchString("Phil@Example.COM"))
+	require.False(t, patterns[0].MatchString("phil@example.com.evil.org"))
+	require.False(t, patterns[0].MatchString("phil@exampleXcom"))
+	require.True(t, patterns[1].MatchString("alerts-01@corp.example.com"))
+	require.False(t, patterns[1].MatchString("alerts-001@corp.example.com"))
+	require.True(t, patterns[2].MatchString("phil@b.com"))
+	require.False(t, patterns[2].MatchString("phil@c.com"))
+
+	_, err = parseSMTPServerSenders("smtp-server-allowed-senders", []string{""})
+	require.Error(t, err)
+	_, err = parseSMTPServerSenders("smtp-server-denied-senders", []string{"/(unclosed/"})
+	require.Error(t, err)
+}
+
 func newEmptyFile(t *testing.T) string {
 	filename := filepath.Join(t.TempDir(), "empty")
 	require.Nil(t, os.WriteFile(filename, []byte{}, 0600))
@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+)
+
+var flagsTier = userCommandFlags()
+var flagsTierLimits = []cli.Flag{
+	&cli.IntFlag{Name: "reservations", Aliases: []string{"r"}, Value: 0, Usage: "number of topics a user in this tier can reserve"},
+	&cli.Int64Flag{Name: "messages", Value: 0, Usage: "number of messages a user in this tier can publish per day"},
+	&cli.Int64Flag{Name: "emails", Value: 0, Usage: "number of e-mails a user in this tier can send per day"},
+	&cli.StringFlag{Name: "attachment-total-size", Usage: "total storage for attachments of a user in this tier (e.g. 1G)"},
+	&cli.DurationFlag{Name: "max-delay", Usage: "how far into the future a user in this tier can schedule messages"},
+	&cli.Int64Flag{Name: "sms", Value: 0, Usage: "number of SMS a user in this tier can send per day"},
+	&cli.Int64Flag{Name: "calls", Value: 0, Usage: "number of phone calls a user in this tier can trigger per day"},
+}
+var cmdTier = &cli.Command{
+	Name:      "tier",
+	Usage:     "Manage/show tiers",
+	UsageText: "ntfy tier [list|add|change|remove] ...",
+	Flags:     flagsTier,
+	Before:    initConfigFileInputSource("config", flagsTier),
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Adds a new tier",
+			UsageText: "ntfy tier add [--reservations=LIMIT] [--messages=LIMIT] [--emails=LIMIT] [--attachment-total-size=SIZE] [--max-delay=DURATION] [--sms=LIMIT] [--calls=LIMIT] CODE",
+			Action:    execTierAdd,
+			Flags:     flagsTierLimits,
+			Description: `Add a new tier to the ntfy user database.
+
+A tier is a named set of limits, which can be assigned to users with 'ntfy user change-tier'.
+Users without a tier are limited by the auth-reservations-limit server option.
+
+The messages, emails, attachment-total-size, max-delay, sms and calls limits replace the visitor limits
+of the server (visitor-message-daily-limit, visitor-email-limit-*, visitor-attachment-total-size-limit,
+the maximum delay of 3 days, visitor-sms-daily-limit and visitor-call-daily-limit) for users in the tier. If they are not set, the visitor limits apply.
+Unlike visitor limits, which are per IP address, they apply to the user across all of their devices.
+
+Examples:
+  ntfy tier add basic                     # Add tier basic, without reserved topics
+  ntfy tier add --reservations=10 pro     # Add tier pro, allowing users to reserve 10 topics
+  ntfy tier add --messages=10000 --emails=100 --attachment-total-size=5G --max-delay=720h power
+                                          # Add tier power, with more quota than visitors
+`,
+		},
+		{
+			Name:      "change",
+			Aliases:   []string{"ch"},
+			Usage:     "Changes the limits of a tier",
+			UsageText: "ntfy tier change [--reservations=LIMIT] [--messages=LIMIT] [--emails=LIMIT] [--attachment-total-size=SIZE] [--max-delay=DURATION] [--sms=LIMIT] [--calls=LIMIT] CODE",
+			Action:    execTierChange,
+			Flags:     flagsTierLimits,
+			Description: `Change the limits of an existing tier.
+
+Only the given limits are changed, all others are kept. Setting a limit to 0 removes it, so
+that the server's visitor limit applies again. Topics that users already reserved stay reserved,
+even if the new limit is lower.
+
+Examples:
+  ntfy tier change --reservations=20 pro
+  ntfy tier change --messages=0 pro        # Users in tier pro are limited like visitors again
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes a tier",
+			UsageText: "ntfy tier remove CODE",
+			Action:    execTierDel,
+			Description: `Remove a tier from the ntfy user database.
+
+Users in this tier are no longer assigned to any tier afterwards.
+
+Example:
+  ntfy tier del pro
+`,
+		},
+		{
+			Name:    "list",
+			Aliases: []string{"l"},
+			Usage:   "Shows a list of tiers",
+			Action:  execTierList,
+		},
+	},
+	Description: `Manage tiers of the ntfy server.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' (or 'auth-dsn', if auth-backend
+is postgres) is properly defined. Please also refer to the related command 'ntfy user change-tier'.
+
+Examples:
+  ntfy tier list                          # Shows list of tiers
+  ntfy tier add --reservations=10 pro     # Add tier pro, allowing users to reserve 10 topics
+  ntfy tier del pro                       # Delete tier pro
+`,
+}
+
+func execTierAdd(c *cli.Context) error {
+	code, err := tierCodeFromArgs(c, "add")
+	if err != nil {
+		return err
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if t, _ := manager.Tier(code); t != nil {
+		return fmt.Errorf("tier %s already exists", code)
+	}
+	tier := &auth.Tier{Code: code}
+	if err := tierLimitsFromFlags(c, tier); err != nil {
+		return err
+	}
+	if err := manager.AddTier(tier); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "tier %s added\n", tier.Code)
+	return nil
+}
+
+func execTierChange(c *cli.Context) error {
+	code, err := tierCodeFromArgs(c, "change")
+	if err != nil {
+		return err
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	tier, err := manager.Tier(code)
+	if err == auth.ErrNotFound {
+		return fmt.Errorf("tier %s does not exist", code)
+	} else if err != nil {
+		return err
+	}
+	if err := tierLimitsFromFlags(c, tier); err != nil {
+		return err
+	}
+	if err := manager.UpdateTier(tier); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "tier %s changed\n", tier.Code)
+	return nil
+}
+
+func execTierDel(c *cli.Context) error {
+	code := c.Args().Get(0)
+	if code == "" {
+		return errors.New("tier code expected, type 'ntfy tier del --help' for help")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.Tier(code); err == auth.ErrNotFound {
+		return fmt.Errorf("tier %s does not exist", code)
+	}
+	if err := manager.RemoveTier(code); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "tier %s removed\n", code)
+	return nil
+}
+
+func execTierList(c *cli.Context) error {
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	tiers, err := manager.Tiers()
+	if err != nil {
+		return err
+	}
+	if len(tiers) == 0 {
+		fmt.Fprintln(c.App.ErrWriter, "no tiers defined")
+		return nil
+	}
+	for _, tier := range tiers {
+		fmt.Fprintf(c.App.ErrWriter, "tier %s\n", tier.Code)
+		fmt.Fprintf(c.App.ErrWriter, "- reserved topics: %d\n", tier.ReservationsLimit)
+		if tier.MessagesLimit > 0 {
+			fmt.Fprintf(c.App.ErrWriter, "- messages per day: %d\n", tier.MessagesLimit)
+		}
+		if tier.EmailsLimit > 0 {
+			fmt.Fprintf(c.App.ErrWriter, "- e-mails per day: %d\n", tier.EmailsLimit)
+		}
+		if tier.AttachmentTotalSizeLimit > 0 {
+			fmt.Fprintf(c.App.ErrWriter, "- attachment storage: %d bytes\n", tier.AttachmentTotalSizeLimit)
+		}
+		if tier.MaxDelay > 0 {
+			fmt.Fprintf(c.App.ErrWriter, "- max delay: %s\n", tier.MaxDelay)
+		}
+		if tier.SMSLimit > 0 {
+			fmt.Fprintf(c.App.ErrWriter, "- SMS per day: %d\n", tier.SMSLimit)
+		}
+		if tier.CallsLimit > 0 {
+			fmt.Fprintf(c.App.ErrWriter, "- phone calls per day: %d\n", tier.CallsLimit)
+		}
+	}
+	return nil
+}
+
+func tierCodeFromArgs(c *cli.Context, command string) (string, error) {
+	code := c.Args().Get(0)
+	if code == "" {
+		return "", fmt.Errorf("tier code expected, type 'ntfy tier %s --help' for help", command)
+	} else if !auth.AllowedTier(code) {
+		return "", errors.New("tier code must only contain lower-case letters, numbers, dashes and underscores")
+	}
+	return code, nil
+}
+
+// tierLimitsFromFlags sets the limits of the tier that were passed as flags, and leaves all others untouched
+func tierLimitsFromFlags(c *cli.Context, tier *auth.Tier) error {
+	if c.IsSet("reservations") {
+		tier.ReservationsLimit = c.Int("reservations")
+	}
+	if c.IsSet("messages") {
+		tier.MessagesLimit = c.Int64("messages")
+	}
+	if c.IsSet("emails") {
+		tier.EmailsLimit = c.Int64("emails")
+	}
+	if c.IsSet("attachment-total-size") {
+		size, err := util.ParseSize(c.String("attachment-total-size"))
+		if err != nil {
+			return fmt.Errorf("invalid attachment total size: %s", err.Error())
+		}
+		tier.AttachmentTotalSizeLimit = size
+	}
+	if c.IsSet("max-delay") {
+		tier.MaxDelay = c.Duration("max-delay")
+	}
+	if c.IsSet("sms") {
+		tier.SMSLimit = c.Int64("sms")
+	}
+	if c.IsSet("calls") {
+		tier.CallsLimit = c.Int64("calls")
+	}
+	if tier.ReservationsLimit < 0 {
+		return errors.New("reservations limit must not be negative")
+	} else if tier.MessagesLimit < 0 || tier.EmailsLimit < 0 || tier.AttachmentTotalSizeLimit < 0 || tier.MaxDelay < 0 || tier.SMSLimit < 0 || tier.CallsLimit < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/server"
+	"heckel.io/ntfy/test"
+	"testing"
+)
+
+func TestCLI_Tier_Add_Change_Remove(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "add", "--reservations=10", "pro"))
+	require.Contains(t, stderr.String(), "tier pro added")
+
+	app, _, _, _ = newTestApp()
+	err := runTierCommand(app, conf, "add", "pro")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tier pro already exists")
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "change", "--reservations=20", "pro"))
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "list"))
+	require.Equal(t, "tier pro\n- reserved topics: 20\n", stderr.String())
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "change-tier", "phil", "pro"))
+	require.Contains(t, stderr.String(), "changed tier for user phil to pro")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "user phil (user, tier pro)")
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "remove", "pro"))
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "user phil (user)")
+}
+
+func TestCLI_Tier_Limits(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "add", "--messages=10000", "--emails=100", "--attachment-total-size=1G", "--max-delay=720h", "--sms=10", "--calls=2", "power"))
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "change", "--reservations=5", "--emails=0", "power"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runTierCommand(app, conf, "list"))
+	require.Equal(t, "tier power\n- reserved topics: 5\n- messages per day: 10000\n- attachment storage: 1073741824 bytes\n- max delay: 720h0m0s\n- SMS per day: 10\n- phone calls per day: 2\n", stderr.String())
+
+	app, _, _, _ = newTestApp()
+	err := runTierCommand(app, conf, "change", "--messages=-1", "power")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "limits must not be negative")
+
+	app, _, _, _ = newTestApp()
+	err = runTierCommand(app, conf, "add", "--attachment-total-size=lots", "huge")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid attachment total size")
+}
+
+func TestCLI_Tier_Invalid(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	err := runTierCommand(app, conf, "add", "Pro Plan")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tier code must only contain")
+
+	app, _, _, _ = newTestApp()
+	err = runTierCommand(app, conf, "change", "doesnotexist")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tier doesnotexist does not exist")
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, _, _ = newTestApp()
+	err = runUserCommand(app, conf, "change-tier", "phil", "doesnotexist")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tier doesnotexist does not exist")
+}
+
+func runTierCommand(app *cli.App, conf *server.Config, args ...string) error {
+	tierArgs := []string{
+		"ntfy",
+		"tier",
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + confToDefaultAccess(conf),
+	}
+	return app.Run(append(tierArgs, args...))
+}
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"strings"
+	"time"
+)
+
+var flagsToken = userCommandFlags()
+var cmdToken = &cli.Command{
+	Name:      "token",
+	Usage:     "Create, list or remove access tokens",
+	UsageText: "ntfy token [list|add|remove] ...",
+	Flags:     flagsToken,
+	Before:    initConfigFileInputSource("config", flagsToken),
+	Category:  categoryServer,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "add",
+			Aliases:   []string{"a"},
+			Usage:     "Creates a new access token for a user",
+			UsageText: "ntfy token add [--label=LABEL] [--expires=EXPIRES] USERNAME TOPICS PERMISSION",
+			Action:    execTokenAdd,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "label", Aliases: []string{"l"}, Usage: "token label, e.g. the name of the script using it"},
+				&cli.StringFlag{Name: "expires", Aliases: []string{"e"}, Usage: "expiry of the token, e.g. 30d or a unix timestamp (default: never)"},
+			},
+			Description: `Create a new access token for an existing user.
+
+The token can be used instead of the user's password, e.g. with the header "Authorization: Bearer <token>".
+It only grants access to the given topics (comma-separated, with optional wildcards), and only with the
+given permission. The token never grants more than the user itself is allowed to do.
+
+The token is printed to stdout, so it can be captured in scripts.
+
+Arguments:
+  USERNAME     an existing user, as created with 'ntfy user add'
+  TOPICS       comma-separated list of topics with optional wildcards, e.g. "backups,alerts*"
+  PERMISSION   one of the following:
+               - read-write (alias: rw)
+               - read-only (aliases: read, ro)
+               - write-only (aliases: write, wo)
+
+Examples:
+  ntfy token add phil backups write-only                      # Publish-only token for topic backups
+  ntfy token add --label=dashboard phil "alerts*" read-only   # Read-only token for all alerts... topics
+  ntfy token add --expires=30d phil mytopic rw                # Token that expires in 30 days
+`,
+		},
+		{
+			Name:      "remove",
+			Aliases:   []string{"del", "rm"},
+			Usage:     "Removes an access token",
+			UsageText: "ntfy token remove USERNAME TOKEN",
+			Action:    execTokenDel,
+			Description: `Remove an access token of a user. The token can no longer be used afterwards.
+
+Example:
+  ntfy token del phil tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2
+`,
+		},
+		{
+			Name:      "list",
+			Aliases:   []string{"l"},
+			Usage:     "Shows the access tokens of a user",
+			UsageText: "ntfy token list USERNAME",
+			Action:    execTokenList,
+			Description: `Shows the access tokens of a user, including expired tokens.
+
+Example:
+  ntfy token list phil
+`,
+		},
+	},
+	Description: `Manage access tokens of the users of the ntfy server.
+
+This is a server-only command. It directly manages the user.db as defined in the server config
+file server.yml. The command only works if 'auth-file' (or 'auth-dsn', if auth-backend
+is postgres) is properly defined. Please also refer to the related commands 'ntfy user' and 'ntfy access'.
+
+Access tokens are long-lived tokens that are limited to specific topics and permissions, so
+that users don't have to put their password in scripts. Users can also manage their own tokens
+via the /user/tokens endpoint.
+
+Examples:
+  ntfy token list phil                     # Shows tokens of user phil
+  ntfy token add phil backups write-only   # Creates a publish-only token for topic backups
+  ntfy token del phil tk_AgQdq7m...        # Removes a token
+`,
+}
+
+func execTokenAdd(c *cli.Context) error {
+	username := c.Args().Get(0)
+	topics := c.Args().Get(1)
+	perms := c.Args().Get(2)
+	if username == "" || topics == "" || perms == "" {
+		return errors.New("username, topics and permission expected, type 'ntfy token add --help' for help")
+	} else if c.NArg() > 3 {
+		return errors.New("too many arguments, type 'ntfy token add --help' for help")
+	}
+	if !util.InStringList([]string{"read-write", "rw", "read-only", "read", "ro", "write-only", "write", "wo"}, perms) {
+		return errors.New("permission must be one of: read-write, read-only or write-only (or the aliases: rw, read, ro, write, wo)")
+	}
+	read := util.InStringList([]string{"read-write", "rw", "read-only", "read", "ro"}, perms)
+	write := util.InStringList([]string{"read-write", "rw", "write-only", "write", "wo"}, perms)
+	grants := make([]auth.Grant, 0)
+	for _, topic := range util.SplitNoEmpty(topics, ",") {
+		topic = strings.TrimSpace(topic)
+		if !auth.AllowedTopicPattern(topic) {
+			return fmt.Errorf("invalid topic %s", topic)
+		}
+		grants = append(grants, auth.Grant{TopicPattern: topic, AllowRead: read, AllowWrite: write})
+	}
+	var expires time.Time
+	if c.String("expires") != "" {
+		var err error
+		expires, err = util.ParseFutureTime(c.String("expires"), time.Now())
+		if err != nil || expires.Before(time.Now()) {
+			return errors.New("invalid expiry, must be a future unix timestamp or a duration, e.g. 30d")
+		}
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	token, err := manager.AddToken(username, c.String("label"), grants, expires)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "token created for user %s\n", username)
+	fmt.Fprintln(c.App.Writer, token.Value)
+	return nil
+}
+
+func execTokenDel(c *cli.Context) error {
+	username := c.Args().Get(0)
+	token := c.Args().Get(1)
+	if username == "" || token == "" {
+		return errors.New("username and token expected, type 'ntfy token remove --help' for help")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	tokens, err := manager.Tokens(username)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.Value == token {
+			if err := manager.RemoveToken(username, token); err != nil {
+				return err
+			}
+			fmt.Fprintf(c.App.ErrWriter, "token %s removed\n", token)
+			return nil
+		}
+	}
+	return fmt.Errorf("token %s does not exist for user %s", token, username)
+}
+
+func execTokenList(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == "" {
+		return errors.New("username expected, type 'ntfy token list --help' for help")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	tokens, err := manager.Tokens(username)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		fmt.Fprintf(c.App.ErrWriter, "user %s has no access tokens\n", username)
+		return nil
+	}
+	for _, token := range tokens {
+		fmt.Fprintf(c.App.ErrWriter, "token %s", token.Value)
+		if token.Label != "" {
+			fmt.Fprintf(c.App.ErrWriter, " (%s)", token.Label)
+		}
+		if token.Expires.IsZero() {
+			fmt.Fprint(c.App.ErrWriter, ", never expires\n")
+		} else if token.Expires.Before(time.Now()) {
+			fmt.Fprintf(c.App.ErrWriter, ", expired %s\n", token.Expires.Format(time.RFC1123))
+		} else {
+			fmt.Fprintf(c.App.ErrWriter, ", expires %s\n", token.Expires.Format(time.RFC1123))
+		}
+		for _, grant := range token.Grants {
+			if grant.AllowRead && grant.AllowWrite {
+				fmt.Fprintf(c.App.ErrWriter, "- read-write access to topic %s\n", grant.TopicPattern)
+			} else if grant.AllowRead {
+				fmt.Fprintf(c.App.ErrWriter, "- read-only access to topic %s\n", grant.TopicPattern)
+			} else if grant.AllowWrite {
+				fmt.Fprintf(c.App.ErrWriter, "- write-only access to topic %s\n", grant.TopicPattern)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/server"
+	"heckel.io/ntfy/test"
+	"strings"
+	"testing"
+)
+
+func TestCLI_Token_Add_List_Remove(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+
+	app, _, stdout, stderr := newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "--label=backup script", "phil", "backups,alerts*", "write-only"))
+	require.Contains(t, stderr.String(), "token created for user phil")
+	token := strings.TrimSpace(stdout.String())
+	require.Regexp(t, `^tk_[A-Za-z0-9]{29}$`, token)
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
+	expected := "token " + token + ` (backup script), never expires
+- write-only access to topic backups
+- write-only access to topic alerts*
+`
+	require.Equal(t, expected, stderr.String())
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "remove", "phil", token))
+	require.Contains(t, stderr.String(), "token "+token+" removed")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
+	require.Equal(t, "user phil has no access tokens\n", stderr.String())
+}
+
+func TestCLI_Token_Add_Invalid(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, _, _, _ := newTestApp()
+	err := runTokenCommand(app, conf, "add", "ben", "mytopic", "rw")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user ben does not exist")
+
+	app, _, _, _ = newTestApp()
+	err = runTokenCommand(app, conf, "add", "ben", "mytopic", "deny")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "permission must be one of")
+
+	app, _, _, _ = newTestApp()
+	err = runTokenCommand(app, conf, "add", "--expires=1000", "ben", "mytopic", "rw")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid expiry")
+}
+
+func TestCLI_Token_Publish(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "--role=admin", "phil"))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, runTokenCommand(app, conf, "add", "phil", "backups", "write-only"))
+	token := strings.TrimSpace(stdout.String())
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"--token", token,
+		fmt.Sprintf("http://127.0.0.1:%d/backups", port),
+		"backup done",
+	}))
+	require.Error(t, app.Run([]string{
+		"ntfy",
+		"publish",
+		"--token", token,
+		fmt.Sprintf("http://127.0.0.1:%d/announcements", port),
+		"not allowed",
+	}))
+}
+
+func runTokenCommand(app *cli.App, conf *server.Config, args ...string) error {
+	tokenArgs := []string{
+		"ntfy",
+		"token",
+		"--auth-file=" + conf.AuthFile,
+		"--auth-default-access=" + confToDefaultAccess(conf),
+	}
+	return app.Run(append(tokenArgs, args...))
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"github.com/urfave/cli/v2/altsrc"
 	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/server"
 	"heckel.io/ntfy/util"
 	"strings"
 )
@@ -15,7 +16,7 @@ var flagsUser = userCommandFlags()
 var cmdUser = &cli.Command{
 	Name:      "user",
 	Usage:     "Manage/show users",
-	UsageText: "ntfy user [list|add|remove|change-pass|change-role] ...",
+	UsageText: "ntfy user [list|add|remove|change-pass|change-role|change-tier|reset-totp] ...",
 	Flags:     flagsUser,
 	Before:    initConfigFileInputSource("config", flagsUser),
 	Category:  categoryServer,
@@ -87,6 +88,36 @@ user are removed, since they are no longer necessary.
 Example:
   ntfy user change-role phil admin   # Make user phil an admin 
   ntfy user change-role phil user    # Remove admin role from user phil 
+`,
+		},
+		{
+			Name:      "change-tier",
+			Aliases:   []string{"cht"},
+			Usage:     "Changes the tier of a user",
+			UsageText: "ntfy user change-tier USERNAME (TIER|none)",
+			Action:    execUserChangeTier,
+			Description: `Change the tier of the given user.
+
+The tier defines the user's limits, e.g. how many topics the user can reserve. Tiers
+can be created with 'ntfy tier add'. Pass "none" to remove the user from its tier.
+
+Example:
+  ntfy user change-tier phil pro    # Move user phil to tier pro
+  ntfy user change-tier phil none   # Remove user phil from its tier
+`,
+		},
+		{
+			Name:      "reset-totp",
+			Usage:     "Disables two-factor authentication for a user",
+			UsageText: "ntfy user reset-totp USERNAME",
+			Action:    execUserResetTOTP,
+			Description: `Disable two-factor authentication (TOTP) for the given user.
+
+This is useful if a user lost access to their authenticator app. The user can log in
+with their password only afterwards, and enroll again via the /user/totp endpoint.
+
+Example:
+  ntfy user reset-totp phil   # Disable two-factor authentication for user phil
 `,
 		},
 		{
@@ -97,7 +128,8 @@ Example:
 			Description: `Shows a list of all configured users, including the everyone ('*') user.
 
 This is a server-only command. It directly reads from the user.db as defined in the server config
-file server.yml. The command only works if 'auth-file' is properly defined. 
+file server.yml. The command only works if 'auth-file' (or 'auth-dsn', if auth-backend
+is postgres) is properly defined. 
 
 This command is an alias to calling 'ntfy access' (display access control list).
 `,
@@ -106,8 +138,8 @@ This command is an alias to calling 'ntfy access' (display access control list).
 	Description: `Manage users of the ntfy server.
 
 This is a server-only command. It directly manages the user.db as defined in the server config
-file server.yml. The command only works if 'auth-file' is properly defined. Please also refer
-to the related command 'ntfy access'.
+file server.yml. The command only works if 'auth-file' (or 'auth-dsn', if auth-backend
+is postgres) is properly defined. Please also refer to the related command 'ntfy access'.
 
 The command allows you to add/remove/change users in the ntfy user database, as well as change 
 passwords or roles.
@@ -119,6 +151,8 @@ Examples:
   ntfy user del phil                 # Delete user phil
   ntfy user change-pass phil         # Change password for user phil
   ntfy user change-role phil admin   # Make user phil an admin 
+  ntfy user change-tier phil pro     # Move user phil to tier pro
+  ntfy user reset-totp phil          # Disable two-factor authentication for user phil
 `,
 }
 
@@ -218,6 +252,58 @@ func execUserChangeRole(c *cli.Context) error {
 	return nil
 }
 
+func execUserChangeTier(c *cli.Context) error {
+	username := c.Args().Get(0)
+	tier := c.Args().Get(1)
+	if username == "" || tier == "" {
+		return errors.New("username and new tier expected, type 'ntfy user change-tier --help' for help")
+	} else if username == userEveryone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if tier == "none" {
+		if err := manager.ChangeTier(username, ""); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.ErrWriter, "removed tier from user %s\n", username)
+		return nil
+	}
+	if err := manager.ChangeTier(username, tier); err == auth.ErrNotFound {
+		return fmt.Errorf("tier %s does not exist", tier)
+	} else if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "changed tier for user %s to %s\n", username, tier)
+	return nil
+}
+
+func execUserResetTOTP(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == "" {
+		return errors.New("username expected, type 'ntfy user reset-totp --help' for help")
+	} else if username == userEveryone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createAuthManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if err := manager.DisableTOTP(username); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "disabled two-factor authentication for user %s\n", username)
+	return nil
+}
+
 func execUserList(c *cli.Context) error {
 	manager, err := createAuthManager(c)
 	if err != nil {
@@ -231,20 +317,42 @@ func execUserList(c *cli.Context) error {
 }
 
 func createAuthManager(c *cli.Context) (auth.Manager, error) {
+	authBackend := c.String("auth-backend")
 	authFile := c.String("auth-file")
+	authDSN := c.String("auth-dsn")
 	authDefaultAccess := c.String("auth-default-access")
-	if authFile == "" {
+	if authBackend == server.AuthBackendLDAP || authBackend == server.AuthBackendOIDC {
+		return nil, fmt.Errorf("users cannot be managed with auth-backend %s; manage them in the directory or identity provider instead", authBackend)
+	} else if authBackend == server.AuthBackendPostgres {
+		if authDSN == "" {
+			return nil, errors.New("option auth-dsn not set; auth is unconfigured for this server")
+		}
+		authDefaultRead, authDefaultWrite, err := parseAuthDefaultAccess(authDefaultAccess)
+		if err != nil {
+			return nil, err
+		}
+		return auth.NewPostgresAuth(authDSN, authDefaultRead, authDefaultWrite)
+	} else if authFile == "" {
 		return nil, errors.New("option auth-file not set; auth is unconfigured for this server")
 	} else if !util.FileExists(authFile) {
 		return nil, errors.New("auth-file does not exist; please start the server at least once to create it")
-	} else if !util.InStringList([]string{"read-write", "read-only", "write-only", "deny-all"}, authDefaultAccess) {
-		return nil, errors.New("if set, auth-default-access must start set to 'read-write', 'read-only' or 'deny-all'")
 	}
-	authDefaultRead := authDefaultAccess == "read-write" || authDefaultAccess == "read-only"
-	authDefaultWrite := authDefaultAccess == "read-write" || authDefaultAccess == "write-only"
+	authDefaultRead, authDefaultWrite, err := parseAuthDefaultAccess(authDefaultAccess)
+	if err != nil {
+		return nil, err
+	}
 	return auth.NewSQLiteAuth(authFile, authDefaultRead, authDefaultWrite)
 }
 
+func parseAuthDefaultAccess(authDefaultAccess string) (read bool, write bool, err error) {
+	if !util.InStringList([]string{"read-write", "read-only", "write-only", "deny-all"}, authDefaultAccess) {
+		return false, false, errors.New("if set, auth-default-access must start set to 'read-write', 'read-only' or 'deny-all'")
+	}
+	read = authDefaultAccess == "read-write" || authDefaultAccess == "read-only"
+	write = authDefaultAccess == "read-write" || authDefaultAccess == "write-only"
+	return read, write, nil
+}
+
 func readPasswordAndConfirm(c *cli.Context) (string, error) {
 	fmt.Fprint(c.App.ErrWriter, "password: ")
 	password, err := util.ReadPassword(c.App.Reader)
@@ -266,7 +374,9 @@ func readPasswordAndConfirm(c *cli.Context) (string, error) {
 func userCommandFlags() []cli.Flag {
 	return []cli.Flag{
 		&cli.StringFlag{Name: "config", Aliases: []string{"c"}, EnvVars: []string{"NTFY_CONFIG_FILE"}, Value: "/etc/ntfy/server.yml", DefaultText: "/etc/ntfy/server.yml", Usage: "config file"},
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-backend", EnvVars: []string{"NTFY_AUTH_BACKEND"}, Value: server.AuthBackendSQLite, Usage: "where users and access control entries are stored: sqlite (auth-file) or postgres (auth-dsn)"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-file", Aliases: []string{"H"}, EnvVars: []string{"NTFY_AUTH_FILE"}, Usage: "auth database file used for access control"}),
+		altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-dsn", EnvVars: []string{"NTFY_AUTH_DSN"}, Usage: "PostgreSQL connection string of the auth database (if auth-backend is postgres)"}),
 		altsrc.NewStringFlag(&cli.StringFlag{Name: "auth-default-access", Aliases: []string{"p"}, EnvVars: []string{"NTFY_AUTH_DEFAULT_ACCESS"}, Value: "read-write", Usage: "default permissions if no matching entries in the auth database are found"}),
 	}
 }
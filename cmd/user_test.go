@@ -3,10 +3,12 @@ package cmd
 import (
 	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli/v2"
+	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/server"
 	"heckel.io/ntfy/test"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestCLI_User_Add(t *testing.T) {
@@ -111,6 +113,35 @@ func TestCLI_User_Delete(t *testing.T) {
 	require.Contains(t, err.Error(), "user phil does not exist")
 }
 
+func TestCLI_User_ResetTOTP(t *testing.T) {
+	conf := server.NewConfig()
+	conf.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	a, err := auth.NewSQLiteAuth(conf.AuthFile, false, false)
+	require.Nil(t, err)
+	require.Nil(t, a.AddUser("phil", "mypass", auth.RoleUser))
+	secret, err := a.EnrollTOTP("phil")
+	require.Nil(t, err)
+	code, err := auth.TOTPCode(secret, time.Now())
+	require.Nil(t, err)
+	require.Nil(t, a.EnableTOTP("phil", code))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "user phil (user)\n- two-factor authentication enabled")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "reset-totp", "phil"))
+	require.Contains(t, stderr.String(), "disabled two-factor authentication for user phil")
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "", phil.TOTP)
+
+	app, _, _, _ = newTestApp()
+	err = runUserCommand(app, conf, "reset-totp", "ben")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user ben does not exist")
+}
+
 func newTestServerWithAuth(t *testing.T) (s *server.Server, conf *server.Config, port int) {
 	conf = server.NewConfig()
 	conf.AuthFile = filepath.Join(t.TempDir(), "user.db")
@@ -120,6 +151,18 @@ func newTestServerWithAuth(t *testing.T) (s *server.Server, conf *server.Config,
 	return
 }
 
+func TestCLI_User_Backend_NotManaged(t *testing.T) {
+	app, _, _, _ := newTestApp()
+	err := app.Run([]string{"ntfy", "user", "--auth-backend=ldap", "list"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "users cannot be managed with auth-backend ldap")
+
+	app, _, _, _ = newTestApp()
+	err = app.Run([]string{"ntfy", "user", "--auth-backend=postgres", "list"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "option auth-dsn not set")
+}
+
 func runUserCommand(app *cli.App, conf *server.Config, args ...string) error {
 	userArgs := []string{
 		"ntfy",
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+var (
+	ackPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/([A-Za-z0-9]{12})/ack$`)
+)
+
+// handleAck records that a subscriber has seen a message, and emits a message_acked event to the subscribers of the
+// topic, so that the publisher can tell that someone reacted to an alert (see X-Ack-Required). Acknowledging a message
+// twice is allowed, but only the first acknowledgment counts.
+func (s *Server) handleAck(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	id := ackPathRegex.FindStringSubmatch(r.URL.Path)[1]
+	if _, err := s.messageCache.Message(t.ID, id); err == errMessageNotFound {
+		return errHTTPNotFoundMessage
+	} else if err != nil {
+		return err
+	}
+	ack := &messageAck{
+		Time:       time.Now().Unix(),
+		subscriber: v.ip,
+	}
+	if user := userFromRequest(r); user != nil {
+		ack.User = user.Name
+		ack.subscriber = user.Name
+	}
+	added, err := s.messageCache.AddMessageAck(t.ID, id, ack)
+	if err != nil {
+		return err
+	}
+	acked := newMessageAckedMessage(t.ID, id, ack)
+	if added {
+		if err := t.Publish(acked); err != nil {
+			return err
+		}
+		s.publishFirehose(acked)
+		log.Printf("[%s] Message %s of topic %s acknowledged", v.ip, id, t.ID)
+	}
+	return writeJSON(w, acked)
+}
+
+// handleAcks returns the acknowledgments of a message, oldest first
+func (s *Server) handleAcks(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	id := ackPathRegex.FindStringSubmatch(r.URL.Path)[1]
+	if _, err := s.messageCache.Message(t.ID, id); err == errMessageNotFound {
+		return errHTTPNotFoundMessage
+	} else if err != nil {
+		return err
+	}
+	acks, err := s.messageCache.MessageAcks(t.ID, id)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &acksResponse{ID: id, Acks: acks})
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_Ack(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/alerts/json", subscribeRR)
+	var topic *topic
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		topic = s.topics["alerts"]
+		return topic != nil && topic.Subscribers() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	delivered := make(chan string, 10) // Published events may overtake each other, see topic.Publish
+	topic.Subscribe(func(m *message) error {
+		delivered <- m.Event
+		return nil
+	})
+
+	msg := toMessage(t, request(t, s, "PUT", "/alerts", "Disk full on nas01", map[string]string{"Ack-Required": "yes"}).Body.String())
+	require.True(t, msg.AckRequired)
+	response := request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	require.True(t, toMessage(t, response.Body.String()).AckRequired)
+	require.Equal(t, messageEvent, <-delivered)
+	topic.Subscribers() // Waits until the message was passed to all subscribers
+	response = request(t, s, "POST", "/alerts/"+msg.ID+"/ack", "", nil)
+	require.Equal(t, 200, response.Code)
+	ack := toMessage(t, response.Body.String())
+	require.Equal(t, messageAckedEvent, ack.Event)
+	require.Equal(t, msg.ID, ack.ID)
+	require.Equal(t, "", ack.AckedBy)
+	require.Equal(t, messageAckedEvent, <-delivered)
+	topic.Subscribers()
+	response = request(t, s, "POST", "/alerts/"+msg.ID+"/ack", "", nil)
+	require.Equal(t, 200, response.Code) // Acknowledging twice is fine, but doesn't emit another event
+	subscribeCancel()
+	require.Empty(t, delivered)
+
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, messageEvent, messages[1].Event)
+	require.Equal(t, messageAckedEvent, messages[2].Event)
+	require.Equal(t, msg.ID, messages[2].ID)
+
+	response = request(t, s, "GET", "/alerts/"+msg.ID+"/ack", "", nil)
+	require.Equal(t, 200, response.Code)
+	acks := toAcksResponse(t, response.Body.String())
+	require.Equal(t, msg.ID, acks.ID)
+	require.Len(t, acks.Acks, 1)
+	require.True(t, acks.Acks[0].Time >= msg.Time)
+
+	response = request(t, s, "POST", "/alerts/abcdefghijkl/ack", "", nil)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/alerts/abcdefghijkl/ack", "", nil)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Ack_PerUser(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "alerts", true, true))
+	require.Nil(t, manager.AllowAccess("ben", "alerts", true, false))
+	phil := map[string]string{"Authorization": basicAuth("phil:phil")}
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	msg := toMessage(t, request(t, s, "PUT", "/alerts", "Front door open", phil).Body.String())
+	response := request(t, s, "POST", "/alerts/"+msg.ID+"/ack", "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/alerts/"+msg.ID+"/ack", "", ben)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ben", toMessage(t, response.Body.String()).AckedBy)
+	response = request(t, s, "POST", "/alerts/"+msg.ID+"/ack", "", phil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/alerts/"+msg.ID+"/ack", "", phil)
+	acks := toAcksResponse(t, response.Body.String())
+	require.Len(t, acks.Acks, 2)
+	require.ElementsMatch(t, []string{"ben", "phil"}, []string{acks.Acks[0].User, acks.Acks[1].User})
+
+	response = request(t, s, "DELETE", "/alerts/"+msg.ID, "", phil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/alerts/"+msg.ID+"/ack", "", phil)
+	require.Equal(t, 404, response.Code)
+}
+
+func toAcksResponse(t *testing.T, s string) *acksResponse {
+	var acks acksResponse
+	require.Nil(t, json.Unmarshal([]byte(s), &acks))
+	return &acks
+}
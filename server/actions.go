@@ -20,10 +20,11 @@ const (
 	actionView      = "view"
 	actionBroadcast = "broadcast"
 	actionHTTP      = "http"
+	actionPublish   = "publish"
 )
 
 var (
-	actionsAll      = []string{actionView, actionBroadcast, actionHTTP}
+	actionsAll      = []string{actionView, actionBroadcast, actionHTTP, actionPublish}
 	actionsWithURL  = []string{actionView, actionHTTP}
 	actionsKeyRegex = regexp.MustCompile(`^([-.\w]+)\s*=\s*`)
 )
@@ -61,13 +62,17 @@ func parseActions(s string) (actions []*action, err error) {
 	}
 	for _, action := range actions {
 		if !util.InStringList(actionsAll, action.Action) {
-			return nil, fmt.Errorf("parameter 'action' cannot be '%s', valid values are 'view', 'broadcast' and 'http'", action.Action)
+			return nil, fmt.Errorf("parameter 'action' cannot be '%s', valid values are 'view', 'broadcast', 'http' and 'publish'", action.Action)
 		} else if action.Label == "" {
 			return nil, fmt.Errorf("parameter 'label' is required")
 		} else if util.InStringList(actionsWithURL, action.Action) && action.URL == "" {
 			return nil, fmt.Errorf("parameter 'url' is required for action '%s'", action.Action)
 		} else if action.Action == actionHTTP && util.InStringList([]string{"GET", "HEAD"}, action.Method) && action.Body != "" {
 			return nil, fmt.Errorf("parameter 'body' cannot be set if method is %s", action.Method)
+		} else if action.Action == actionPublish && !topicRegex.MatchString(action.Topic) {
+			return nil, fmt.Errorf("parameter 'topic' is required for action '%s', and must be a valid topic name", action.Action)
+		} else if action.Action == actionPublish && (action.URL != "" || action.Method != "" || action.Body != "") {
+			return nil, fmt.Errorf("parameters 'url', 'method' and 'body' cannot be set for action '%s', use 'topic' and 'message' instead", action.Action)
 		}
 	}
 
@@ -156,6 +161,8 @@ func populateAction(newAction *action, section int, key, value string) error {
 		key = "label"
 	} else if key == "" && section == 2 && util.InStringList(actionsWithURL, newAction.Action) {
 		key = "url"
+	} else if key == "" && section == 2 && newAction.Action == actionPublish {
+		key = "topic"
 	}
 
 	// Validate
@@ -186,6 +193,10 @@ func populateAction(newAction *action, section int, key, value string) error {
 			newAction.Method = value
 		case "body":
 			newAction.Body = value
+		case "topic":
+			newAction.Topic = value
+		case "message":
+			newAction.Message = value
 		default:
 			return fmt.Errorf("key '%s' unknown", key)
 		}
@@ -138,7 +138,7 @@ func TestParseActions(t *testing.T) {
 	require.EqualError(t, err, "term 'what is this anyway' unknown")
 
 	_, err = parseActions(`fdsfdsf`)
-	require.EqualError(t, err, "parameter 'action' cannot be 'fdsfdsf', valid values are 'view', 'broadcast' and 'http'")
+	require.EqualError(t, err, "parameter 'action' cannot be 'fdsfdsf', valid values are 'view', 'broadcast', 'http' and 'publish'")
 
 	_, err = parseActions(`aaa=a, "bbb, 'ccc, ddd, eee "`)
 	require.EqualError(t, err, "key 'aaa' unknown")
@@ -165,7 +165,7 @@ func TestParseActions(t *testing.T) {
 	require.EqualError(t, err, "JSON error: invalid character 'i' looking for beginning of value")
 
 	_, err = parseActions(`[ { "some": "object" } ]`)
-	require.EqualError(t, err, "parameter 'action' cannot be '', valid values are 'view', 'broadcast' and 'http'")
+	require.EqualError(t, err, "parameter 'action' cannot be '', valid values are 'view', 'broadcast', 'http' and 'publish'")
 
 	_, err = parseActions("\x00\x01\xFFx\xFE")
 	require.EqualError(t, err, "invalid utf-8 string")
@@ -174,3 +174,27 @@ func TestParseActions(t *testing.T) {
 	require.EqualError(t, err, "parameter 'clear' cannot be 'x', only boolean values are allowed (true/yes/1/false/no/0)")
 
 }
+
+func TestParseActions_Publish(t *testing.T) {
+	actions, err := parseActions(`publish, Acknowledge, ops-acks, message="Disk full on nas01 acknowledged", headers.X-Tags=ok, clear=true`)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(actions))
+	require.Equal(t, "publish", actions[0].Action)
+	require.Equal(t, "Acknowledge", actions[0].Label)
+	require.Equal(t, "ops-acks", actions[0].Topic)
+	require.Equal(t, "Disk full on nas01 acknowledged", actions[0].Message)
+	require.Equal(t, "ok", actions[0].Headers["X-Tags"])
+	require.True(t, actions[0].Clear)
+
+	actions, err = parseActions(`[{"action":"publish","label":"Acknowledge","topic":"ops-acks"}]`)
+	require.Nil(t, err)
+	require.Equal(t, "ops-acks", actions[0].Topic)
+	require.Equal(t, "", actions[0].Message)
+
+	_, err = parseActions(`publish, Acknowledge`)
+	require.EqualError(t, err, "parameter 'topic' is required for action 'publish', and must be a valid topic name")
+	_, err = parseActions(`publish, Acknowledge, ops/acks`)
+	require.EqualError(t, err, "parameter 'topic' is required for action 'publish', and must be a valid topic name")
+	_, err = parseActions(`publish, Acknowledge, ops-acks, url=https://example.com`)
+	require.EqualError(t, err, "parameters 'url', 'method' and 'body' cannot be set for action 'publish', use 'topic' and 'message' instead")
+}
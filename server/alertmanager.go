@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// This file implements the "alertmanager" webhook format (see webhookFormats), so that Prometheus Alertmanager can
+// publish to ntfy directly, see https://prometheus.io/docs/alerting/latest/configuration/#webhook_config
+
+const (
+	alertmanagerStatusFiring   = "firing"
+	alertmanagerStatusResolved = "resolved"
+	alertmanagerTagFiring      = "rotating_light"   // Emoji, see toEmojis
+	alertmanagerTagResolved    = "white_check_mark" // Emoji, see toEmojis
+	alertmanagerSeverityLabel  = "severity"
+	alertmanagerNameLabel      = "alertname"
+)
+
+var (
+	// alertmanagerPriorities maps common values of the "severity" label to message priorities
+	alertmanagerPriorities = map[string]int{
+		"critical":  5,
+		"page":      5,
+		"emergency": 5,
+		"error":     4,
+		"high":      4,
+		"major":     4,
+		"warning":   3,
+		"minor":     3,
+		"info":      2,
+		"low":       2,
+		"none":      1,
+	}
+)
+
+// alertmanagerPayload is the body of an Alertmanager webhook, version 4. Fields not used by ntfy are omitted.
+type alertmanagerPayload struct {
+	Version      string              `json:"version"`
+	Status       string              `json:"status"` // "firing" if at least one alert is firing, "resolved" otherwise
+	Receiver     string              `json:"receiver"`
+	GroupLabels  map[string]string   `json:"groupLabels"`
+	CommonLabels map[string]string   `json:"commonLabels"`
+	ExternalURL  string              `json:"externalURL"`
+	Alerts       []alertmanagerAlert `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	GeneratorURL string            `json:"generatorURL"`
+}
+
+// newAlertmanagerWebhookMessage parses the Alertmanager webhook payload, see newAlertmanagerMessage
+func newAlertmanagerWebhookMessage(body io.Reader, messageLimit int) (*publishMessage, error) {
+	var payload alertmanagerPayload
+	if err := json.NewDecoder(body).Decode(&payload); err != nil || len(payload.Alerts) == 0 {
+		return nil, errHTTPBadRequestWebhookInvalid
+	}
+	return newAlertmanagerMessage(&payload, messageLimit), nil
+}
+
+// newAlertmanagerMessage converts the alerts of a group into a single message. The title follows the default
+// Alertmanager notification title (e.g. "[FIRING:2] HighLoad"), the body lists the summary of each alert, and the
+// common labels become tags. The priority is derived from the highest severity of all firing alerts.
+func newAlertmanagerMessage(payload *alertmanagerPayload, messageLimit int) *publishMessage {
+	m := &publishMessage{
+		Title: alertmanagerTitle(payload),
+		Tags:  alertmanagerTags(payload),
+	}
+	texts := make([]string, 0)
+	for _, alert := range payload.Alerts {
+		if alert.Status != alertmanagerStatusResolved {
+			if priority, ok := alertmanagerPriorities[strings.ToLower(alert.Labels[alertmanagerSeverityLabel])]; ok && priority > m.Priority {
+				m.Priority = priority
+			}
+		}
+		if m.Click == "" && alert.GeneratorURL != "" {
+			m.Click = alert.GeneratorURL
+		}
+		texts = append(texts, alertmanagerAlertText(&alert, payload))
+	}
+	m.Message = joinAlertTexts(texts, messageLimit)
+	if payload.ExternalURL != "" {
+		m.Actions = []action{{Action: actionView, Label: "Alertmanager", URL: payload.ExternalURL}}
+	}
+	return m
+}
+
+// alertmanagerTags returns an emoji for the status of the group, and the labels common to all alerts (as name=value)
+func alertmanagerTags(payload *alertmanagerPayload) []string {
+	tags := []string{alertmanagerTagFiring}
+	if payload.Status == alertmanagerStatusResolved {
+		tags[0] = alertmanagerTagResolved
+	}
+	for _, name := range sortedKeys(payload.CommonLabels) {
+		if name != alertmanagerNameLabel {
+			tags = append(tags, fmt.Sprintf("%s=%s", name, strings.ReplaceAll(payload.CommonLabels[name], ",", " ")))
+		}
+	}
+	return tags
+}
+
+// alertmanagerTitle returns the title of the notification, e.g. "[FIRING:2] HighLoad node1" or "[RESOLVED] HighLoad"
+func alertmanagerTitle(payload *alertmanagerPayload) string {
+	status := strings.ToUpper(payload.Status)
+	if payload.Status != alertmanagerStatusResolved {
+		firing := 0
+		for _, alert := range payload.Alerts {
+			if alert.Status != alertmanagerStatusResolved {
+				firing++
+			}
+		}
+		status = fmt.Sprintf("%s:%d", strings.ToUpper(alertmanagerStatusFiring), firing)
+	}
+	values := make([]string, 0)
+	for _, name := range sortedKeys(payload.GroupLabels) {
+		values = append(values, payload.GroupLabels[name])
+	}
+	if len(values) == 0 && payload.CommonLabels[alertmanagerNameLabel] != "" {
+		values = append(values, payload.CommonLabels[alertmanagerNameLabel])
+	}
+	return strings.TrimSpace(fmt.Sprintf("[%s] %s", status, strings.Join(values, " ")))
+}
+
+// alertmanagerAlertText describes a single alert, using its summary (or description) annotation, and the labels
+// that are not already shown as tags, since they are common to all alerts
+func alertmanagerAlertText(alert *alertmanagerAlert, payload *alertmanagerPayload) string {
+	text := alert.Labels[alertmanagerNameLabel]
+	if summary := alert.Annotations["summary"]; summary != "" {
+		text = summary
+	} else if description := alert.Annotations["description"]; description != "" {
+		text = description
+	}
+	if alert.Status == alertmanagerStatusResolved && payload.Status != alertmanagerStatusResolved {
+		text = "[RESOLVED] " + text
+	}
+	labels := make([]string, 0)
+	for _, name := range sortedKeys(alert.Labels) {
+		if _, common := payload.CommonLabels[name]; !common {
+			labels = append(labels, fmt.Sprintf("%s=%s", name, alert.Labels[name]))
+		}
+	}
+	if len(labels) > 0 {
+		text += "\n" + strings.Join(labels, ", ")
+	}
+	return text
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+const testAlertmanagerPayload = `{
+  "version": "4",
+  "groupKey": "{}:{alertname=\"HighLoad\"}",
+  "status": "firing",
+  "receiver": "ntfy",
+  "groupLabels": {"alertname": "HighLoad"},
+  "commonLabels": {"alertname": "HighLoad", "job": "node"},
+  "commonAnnotations": {},
+  "externalURL": "https://alertmanager.example.com",
+  "alerts": [
+    {
+      "status": "firing",
+      "labels": {"alertname": "HighLoad", "job": "node", "instance": "node1", "severity": "warning"},
+      "annotations": {"summary": "Load on node1 is above 10"},
+      "startsAt": "2022-12-01T10:15:00Z",
+      "generatorURL": "https://prometheus.example.com/graph?g0.expr=load1"
+    },
+    {
+      "status": "firing",
+      "labels": {"alertname": "HighLoad", "job": "node", "instance": "node2", "severity": "critical"},
+      "annotations": {"description": "Load on node2 is above 20"},
+      "generatorURL": "https://prometheus.example.com/graph?g0.expr=load2"
+    },
+    {
+      "status": "resolved",
+      "labels": {"alertname": "HighLoad", "job": "node", "instance": "node3", "severity": "critical"},
+      "annotations": {"summary": "Load on node3 is above 10"}
+    }
+  ]
+}`
+
+func TestServer_Alertmanager(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "POST", "/alerts/alertmanager", testAlertmanagerPayload, nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "alerts", m.Topic)
+	require.Equal(t, "[FIRING:2] HighLoad", m.Title)
+	require.Equal(t, "Load on node1 is above 10\ninstance=node1, severity=warning\n\n"+
+		"Load on node2 is above 20\ninstance=node2, severity=critical\n\n"+
+		"[RESOLVED] Load on node3 is above 10\ninstance=node3, severity=critical", m.Message)
+	require.Equal(t, 5, m.Priority) // The resolved alert does not count
+	require.Equal(t, []string{"rotating_light", "job=node"}, m.Tags)
+	require.Equal(t, "https://prometheus.example.com/graph?g0.expr=load1", m.Click)
+	require.Equal(t, 1, len(m.Actions))
+	require.Equal(t, "https://alertmanager.example.com", m.Actions[0].URL)
+
+	response = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	require.Equal(t, "[FIRING:2] HighLoad", toMessage(t, response.Body.String()).Title)
+}
+
+func TestServer_Alertmanager_Resolved(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	payload := `{"status":"resolved","groupLabels":{},"commonLabels":{"alertname":"DiskFull","severity":"critical"},
+		"alerts":[{"status":"resolved","labels":{"alertname":"DiskFull","severity":"critical"},"annotations":{}}]}`
+	response := request(t, s, "POST", "/alerts/alertmanager", payload, nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "[RESOLVED] DiskFull", m.Title)
+	require.Equal(t, "DiskFull", m.Message)
+	require.Equal(t, 0, m.Priority) // Default priority, since no alert is firing
+	require.Equal(t, []string{"white_check_mark", "severity=critical"}, m.Tags)
+}
+
+func TestServer_Alertmanager_TooManyAlerts(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageLimit = 200
+	s := newTestServer(t, c)
+	alerts := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		alerts = append(alerts, fmt.Sprintf(`{"status":"firing","labels":{"alertname":"Down","instance":"node%d"},"annotations":{}}`, i))
+	}
+	payload := `{"status":"firing","groupLabels":{"alertname":"Down"},"commonLabels":{"alertname":"Down"},"alerts":[` + strings.Join(alerts, ",") + `]}`
+	response := request(t, s, "POST", "/alerts/alertmanager", payload, nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Nil(t, m.Attachment)
+	require.LessOrEqual(t, len(m.Message), 200)
+	require.True(t, strings.HasPrefix(m.Message, "Down\ninstance=node0\n\nDown\ninstance=node1"))
+	require.Regexp(t, `\.\.\. and \d+ more alerts$`, m.Message)
+}
+
+func TestServer_Alertmanager_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "POST", "/alerts/alertmanager", `{"status":"firing","alerts":[]}`, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40039, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/alerts/alertmanager", `not json`, nil)
+	require.Equal(t, 400, response.Code)
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// APNs delivers messages to iOS devices directly, without Firebase. Devices register their device token for a topic
+// (see handleAPNSRegister), and every message published to the topic is sent to them as an alert notification. The
+// provider token is a JWT signed with the .p8 key of the Apple developer account,
+// see https://developer.apple.com/documentation/usernotifications/establishing-a-token-based-connection-to-apns
+
+const (
+	apnsProductionURL  = "https://api.push.apple.com"
+	apnsSandboxURL     = "https://api.sandbox.push.apple.com"
+	apnsTokenMaxAge    = 50 * time.Minute // Provider tokens expire after an hour, but must not be renewed more than every 20 minutes
+	apnsRequestTimeout = 10 * time.Second
+	apnsPayloadLimit   = 4096
+)
+
+var (
+	apnsPathRegex        = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/apns$`)
+	apnsDeviceTokenRegex = regexp.MustCompile(`^[0-9a-fA-F]{64,200}$`)
+)
+
+// apnsClient sends notifications to the APNs HTTP/2 API, using token-based authentication
+type apnsClient struct {
+	baseURL  string
+	keyID    string
+	teamID   string
+	topic    string // Bundle ID of the app
+	key      *ecdsa.PrivateKey
+	client   *http.Client
+	token    string // Cached provider token, see authToken
+	issuedAt time.Time
+	mu       sync.Mutex
+}
+
+// apnsError is returned by apnsClient.send if APNs rejected the notification
+type apnsError struct {
+	statusCode int
+	reason     string
+}
+
+func (e *apnsError) Error() string {
+	return fmt.Sprintf("APNs rejected notification with status %d: %s", e.statusCode, e.reason)
+}
+
+// unregistered returns true if the device token will never be valid again, e.g. because the app was uninstalled
+func (e *apnsError) unregistered() bool {
+	return e.statusCode == http.StatusGone || e.reason == "BadDeviceToken" || e.reason == "DeviceTokenNotForTopic"
+}
+
+// apnsNotification is the payload and the request headers of a notification, see toAPNSNotification
+type apnsNotification struct {
+	priority   int // 10 delivers immediately, 5 may be delayed to save power
+	collapseID string
+	expiration int64
+	payload    *apnsPayload
+}
+
+type apnsPayload struct {
+	APS       *apnsAPS `json:"aps"`
+	ID        string   `json:"id"`
+	Time      int64    `json:"time"`
+	Event     string   `json:"event"`
+	Topic     string   `json:"topic"`
+	Priority  int      `json:"priority,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Click     string   `json:"click,omitempty"`
+	Truncated bool     `json:"truncated,omitempty"` // The app may poll for the full message
+}
+
+type apnsAPS struct {
+	Alert             *apnsAlert `json:"alert"`
+	Sound             string     `json:"sound,omitempty"`
+	ThreadID          string     `json:"thread-id,omitempty"`
+	MutableContent    int        `json:"mutable-content,omitempty"` // Lets the notification service extension of the app load attachments
+	InterruptionLevel string     `json:"interruption-level,omitempty"`
+}
+
+type apnsAlert struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body"`
+}
+
+func createAPNSClient(conf *Config) (*apnsClient, error) {
+	b, err := os.ReadFile(conf.APNSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("APNs key file does not contain a PEM-encoded key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse APNs key: %s", err.Error())
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key must be an ECDSA (P-256) key")
+	}
+	baseURL := apnsProductionURL
+	if conf.APNSSandbox {
+		baseURL = apnsSandboxURL
+	}
+	return &apnsClient{
+		baseURL: baseURL,
+		keyID:   conf.APNSKeyID,
+		teamID:  conf.APNSTeamID,
+		topic:   conf.APNSTopic,
+		key:     key,
+		client:  &http.Client{Timeout: apnsRequestTimeout},
+	}, nil
+}
+
+// authToken returns the provider token, an ES256-signed JWT, which is reused until it is close to expiring, since
+// APNs throttles providers that create new tokens too often
+func (c *apnsClient) authToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Since(c.issuedAt) < apnsTokenMaxAge {
+		return c.token, nil
+	}
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": c.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": c.teamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64) // JWS signatures are r and s, each padded to 32 bytes, not ASN.1
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	c.token = unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	c.issuedAt = now
+	return c.token, nil
+}
+
+func (c *apnsClient) send(deviceToken string, n *apnsNotification) error {
+	token, err := c.authToken()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(n.payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/3/device/%s", c.baseURL, deviceToken), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apns-topic", c.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", fmt.Sprintf("%d", n.priority))
+	req.Header.Set("apns-expiration", fmt.Sprintf("%d", n.expiration))
+	if n.collapseID != "" {
+		req.Header.Set("apns-collapse-id", n.collapseID)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var apnsResp struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, apiRequestMaxBytes)).Decode(&apnsResp)
+	return &apnsError{statusCode: resp.StatusCode, reason: apnsResp.Reason}
+}
+
+// handleAPNSRegister registers the device token of an iOS device for the messages of a topic, e.g.
+// {"token":"7aa6...b3"}. The user that registered the device must still be allowed to subscribe to the topic
+// when a message is sent, see sendAPNS.
+func (s *Server) handleAPNSRegister(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if err := s.authorizeTopics(r, auth.PermissionSubscribe, t.ID); err != nil {
+		return err
+	}
+	token, err := readAPNSDeviceToken(r)
+	if err != nil {
+		return err
+	}
+	device := &apnsDevice{Topic: t.ID, Token: token}
+	if u := userFromRequest(r); u != nil {
+		device.User = u.Name
+	}
+	if err := s.messageCache.AddAPNSDevice(device); err != nil {
+		return err
+	}
+	log.Printf("[%s] Registered APNs device for topic %s", v.ip, t.ID)
+	return writeJSON(w, &apnsRegistration{Topic: t.ID, Token: token})
+}
+
+// handleAPNSUnregister removes the device token from a topic. Like registering, this requires permission to
+// subscribe to the topic, so that others cannot remove devices whose token they learned.
+func (s *Server) handleAPNSUnregister(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if err := s.authorizeTopics(r, auth.PermissionSubscribe, t.ID); err != nil {
+		return err
+	}
+	token, err := readAPNSDeviceToken(r)
+	if err != nil {
+		return err
+	}
+	if err := s.messageCache.DeleteAPNSDevice(t.ID, token); err != nil {
+		return err
+	}
+	log.Printf("[%s] Unregistered APNs device from topic %s", v.ip, t.ID)
+	return writeJSON(w, &apnsRegistration{Topic: t.ID, Token: token})
+}
+
+func readAPNSDeviceToken(r *http.Request) (string, error) {
+	var req apnsRegistration
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return "", errHTTPBadRequestJSONInvalid
+	} else if !apnsDeviceTokenRegex.MatchString(req.Token) {
+		return "", errHTTPBadRequestAPNSTokenInvalid
+	}
+	return strings.ToLower(req.Token), nil
+}
+
+// withAPNS returns a subscriber that passes messages to Firebase (if configured) and to sendAPNS, so that APNs is
+// used in all the places Firebase is, including the opt-out via X-Firebase: no
+func (s *Server) withAPNS(firebase subscriber) subscriber {
+	return func(m *message) error {
+		if firebase != nil {
+			if err := firebase(m); err != nil {
+				log.Printf("unable to publish to Firebase: %v", err.Error())
+			}
+		}
+		return s.sendAPNS(m)
+	}
+}
+
+// sendAPNS sends a message to all devices registered for its topic. Devices whose user is no longer allowed to
+// subscribe to the topic, and devices that APNs reports as unregistered, are removed. During the quiet hours of the
+// user, the notification is sent with low priority, see withQuietHours.
+func (s *Server) sendAPNS(m *message) error {
+	if m.Event != messageEvent && m.Event != messageUpdatedEvent {
+		return nil
+	}
+	devices, err := s.messageCache.APNSDevices(m.Topic)
+	if err != nil {
+		return err
+	} else if len(devices) == 0 {
+		return nil
+	}
+	n, quietN := toAPNSNotification(m), toAPNSNotification(newQuietPushMessage(m))
+	for _, d := range devices {
+		if !s.apnsDeviceAuthorized(d) {
+			log.Printf("APNs - Removing device of topic %s, user %s may no longer subscribe", d.Topic, d.User)
+			if err := s.messageCache.DeleteAPNSDevice(d.Topic, d.Token); err != nil {
+				return err
+			}
+			continue
+		}
+		notification := n
+		if d.User != "" {
+			if quiet, err := s.quietPush(d.User, m); err != nil {
+				log.Printf("APNs - Unable to read quiet hours of user %s: %v", d.User, err.Error())
+			} else if quiet {
+				notification = quietN
+			}
+		}
+		err := s.apns.send(d.Token, notification)
+		var apnsErr *apnsError
+		if errors.As(err, &apnsErr) && apnsErr.unregistered() {
+			log.Printf("APNs - Removing unregistered device of topic %s: %s", d.Topic, apnsErr.reason)
+			if err := s.messageCache.DeleteAPNSDevice(d.Topic, d.Token); err != nil {
+				return err
+			}
+		} else if err != nil {
+			log.Printf("APNs - Unable to send message %s to device: %v", m.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+// apnsDeviceAuthorized checks if the user that registered the device may still subscribe to its topic. Users of
+// external identity providers cannot be looked up, so their devices are trusted until they unregister.
+func (s *Server) apnsDeviceAuthorized(d *apnsDevice) bool {
+	if s.auth == nil {
+		return true
+	}
+	var user *auth.User
+	if d.User != "" {
+		manager, ok := s.auth.(auth.Manager)
+		if !ok {
+			return true
+		}
+		u, err := manager.User(d.User)
+		if err != nil {
+			return false
+		}
+		user = u
+	}
+	return s.auth.Authorize(user, d.Topic, auth.PermissionSubscribe) == nil
+}
+
+func toAPNSNotification(m *message) *apnsNotification {
+	body := m.Message
+	if m.Encoding == encodingBase64 {
+		body = "" // Binary messages cannot be shown
+	}
+	if body == "" && m.Attachment != nil {
+		body = fmt.Sprintf(defaultAttachmentMessage, m.Attachment.Name)
+	}
+	aps := &apnsAPS{
+		Alert:          &apnsAlert{Title: m.Title, Body: body},
+		Sound:          "default",
+		ThreadID:       m.Topic,
+		MutableContent: 1,
+	}
+	priority := 10
+	if m.Priority == 1 || m.Priority == 2 {
+		priority = 5
+		aps.Sound = ""
+		aps.InterruptionLevel = "passive"
+	} else if m.Priority == 5 {
+		aps.InterruptionLevel = "time-sensitive"
+	}
+	collapseID := m.CollapseKey
+	if collapseID == "" {
+		collapseID = m.ID // Updates of the message replace its notification
+	}
+	payload := &apnsPayload{
+		APS:      aps,
+		ID:       m.ID,
+		Time:     m.Time,
+		Event:    m.Event,
+		Topic:    m.Topic,
+		Priority: m.Priority,
+		Tags:     m.Tags,
+		Click:    m.Click,
+	}
+	if b, err := json.Marshal(payload); err == nil && len(b) > apnsPayloadLimit {
+		over := len(b) - apnsPayloadLimit + len(`,"truncated":true`)
+		if over < len(body) {
+			cut := len(body) - over
+			for cut > 0 && !utf8.RuneStart(body[cut]) {
+				cut--
+			}
+			aps.Alert.Body = body[:cut]
+			payload.Truncated = true
+		}
+	}
+	return &apnsNotification{
+		priority:   priority,
+		collapseID: collapseID,
+		expiration: m.Expires,
+		payload:    payload,
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testAPNSDeviceToken  = strings.Repeat("ab", 32)
+	testAPNSDeviceToken2 = strings.Repeat("cd", 32)
+)
+
+type testAPNSRequest struct {
+	header  http.Header
+	device  string
+	payload *apnsPayload
+}
+
+func TestServer_APNS_Publish(t *testing.T) {
+	s, key, requests := newTestAPNSServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/alerts/apns", `{"token":"`+strings.ToUpper(testAPNSDeviceToken)+`"}`, nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"topic":"alerts","token":"`+testAPNSDeviceToken+`"}`+"\n", response.Body.String())
+
+	m := toMessage(t, request(t, s, "PUT", "/alerts", "Disk full", map[string]string{"Title": "Server down", "Priority": "5", "Tags": "warning"}).Body.String())
+	req := readTestAPNSRequest(t, requests)
+	require.Equal(t, testAPNSDeviceToken, req.device)
+	require.Equal(t, "io.heckel.ntfy", req.header.Get("apns-topic"))
+	require.Equal(t, "alert", req.header.Get("apns-push-type"))
+	require.Equal(t, "10", req.header.Get("apns-priority"))
+	require.Equal(t, m.ID, req.header.Get("apns-collapse-id"))
+	verifyTestAPNSToken(t, &key.PublicKey, strings.TrimPrefix(req.header.Get("Authorization"), "bearer "))
+	require.Equal(t, "Server down", req.payload.APS.Alert.Title)
+	require.Equal(t, "Disk full", req.payload.APS.Alert.Body)
+	require.Equal(t, "time-sensitive", req.payload.APS.InterruptionLevel)
+	require.Equal(t, m.ID, req.payload.ID)
+	require.Equal(t, "alerts", req.payload.Topic)
+	require.Equal(t, []string{"warning"}, req.payload.Tags)
+
+	request(t, s, "PUT", "/alerts?firebase=no", "Not pushed", nil)
+	request(t, s, "PUT", "/other", "No devices", nil)
+	request(t, s, "PUT", "/alerts", "Low priority", map[string]string{"Priority": "min"})
+	req = readTestAPNSRequest(t, requests)
+	require.Equal(t, "Low priority", req.payload.APS.Alert.Body)
+	require.Equal(t, "5", req.header.Get("apns-priority"))
+	require.Equal(t, "passive", req.payload.APS.InterruptionLevel)
+
+	response = request(t, s, "DELETE", "/alerts/apns", `{"token":"`+testAPNSDeviceToken+`"}`, nil)
+	require.Equal(t, 200, response.Code)
+	devices, err := s.messageCache.APNSDevices("alerts")
+	require.Nil(t, err)
+	require.Empty(t, devices)
+}
+
+func TestServer_APNS_UnregisteredDevice(t *testing.T) {
+	s, _, requests := newTestAPNSServer(t, newTestConfig(t))
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts/apns", `{"token":"`+testAPNSDeviceToken+`"}`, nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts/apns", `{"token":"`+testAPNSDeviceToken2+`"}`, nil).Code) // Rejected by the test server
+
+	request(t, s, "PUT", "/alerts", "Disk full", nil)
+	require.Equal(t, testAPNSDeviceToken, readTestAPNSRequest(t, requests).device)
+	require.Eventually(t, func() bool {
+		devices, err := s.messageCache.APNSDevices("alerts")
+		return err == nil && len(devices) == 1 && devices[0].Token == testAPNSDeviceToken
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_APNS_Auth(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s, _, requests := newTestAPNSServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "alerts", true, true))
+
+	response := request(t, s, "PUT", "/alerts/apns", `{"token":"`+testAPNSDeviceToken+`"}`, nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/alerts/apns", `{"token":"`+testAPNSDeviceToken+`"}`, map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+
+	// Unregistering requires the same permission
+	response = request(t, s, "DELETE", "/alerts/apns", `{"token":"`+testAPNSDeviceToken+`"}`, nil)
+	require.Equal(t, 403, response.Code)
+	devices, err := s.messageCache.APNSDevices("alerts")
+	require.Nil(t, err)
+	require.Len(t, devices, 1)
+
+	request(t, s, "PUT", "/alerts", "Disk full", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, "Disk full", readTestAPNSRequest(t, requests).payload.APS.Alert.Body)
+
+	// Access revoked: the device is removed instead of receiving the message
+	require.Nil(t, manager.AllowAccess("phil", "alerts", false, true))
+	request(t, s, "PUT", "/alerts", "Secret", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Eventually(t, func() bool {
+		devices, err := s.messageCache.APNSDevices("alerts")
+		return err == nil && len(devices) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected APNs request for device %s", req.device)
+	default:
+	}
+}
+
+func TestServer_APNS_QuietHours(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = true
+	c.AuthDefaultWrite = true
+	s, _, requests := newTestAPNSServer(t, c)
+	require.Nil(t, s.auth.(auth.Manager).AddUser("phil", "phil", auth.RoleUser))
+	phil := map[string]string{"Authorization": basicAuth("phil:phil")}
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts/apns", `{"token":"`+testAPNSDeviceToken+`"}`, phil).Code)
+	window := strings.Split(quietHoursAround(time.Now()), "-")
+	response := request(t, s, "PUT", "/user/quiet-hours", `{"start":"`+window[0]+`","end":"`+window[1]+`","timezone":"UTC"}`, phil)
+	require.Equal(t, 200, response.Code)
+
+	// The quiet hours of the user who registered the device apply
+	request(t, s, "PUT", "/alerts", "Backup done", nil)
+	req := readTestAPNSRequest(t, requests)
+	require.Equal(t, "Backup done", req.payload.APS.Alert.Body)
+	require.Equal(t, "5", req.header.Get("apns-priority"))
+	require.Equal(t, "passive", req.payload.APS.InterruptionLevel)
+	request(t, s, "PUT", "/alerts", "Disk full", map[string]string{"Priority": "high"})
+	req = readTestAPNSRequest(t, requests)
+	require.Equal(t, "10", req.header.Get("apns-priority"))
+	require.Equal(t, "", req.payload.APS.InterruptionLevel)
+}
+
+func TestServer_APNS_Invalid(t *testing.T) {
+	s, _, _ := newTestAPNSServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/alerts/apns", `{"token":"not-a-token"}`, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40056, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/alerts/apns", `not json`, nil)
+	require.Equal(t, 400, response.Code)
+
+	s = newTestServer(t, newTestConfig(t)) // APNs disabled
+	response = request(t, s, "PUT", "/alerts/apns", `{"token":"`+testAPNSDeviceToken+`"}`, nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestToAPNSNotification_Truncated(t *testing.T) {
+	m := newDefaultMessage("mytopic", strings.Repeat("this is a long message ", 400))
+	n := toAPNSNotification(m)
+	b, err := json.Marshal(n.payload)
+	require.Nil(t, err)
+	require.LessOrEqual(t, len(b), apnsPayloadLimit)
+	require.True(t, n.payload.Truncated)
+	require.True(t, strings.HasPrefix(m.Message, n.payload.APS.Alert.Body))
+}
+
+// newTestAPNSServer creates a server that sends notifications to a fake APNs server. The fake server rejects
+// testAPNSDeviceToken2 as unregistered, and passes all other requests to the returned channel.
+func newTestAPNSServer(t *testing.T, c *Config) (*Server, *ecdsa.PrivateKey, chan *testAPNSRequest) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	c.APNSKeyFile = filepath.Join(t.TempDir(), "AuthKey_ABC123DEFG.p8")
+	require.Nil(t, os.WriteFile(c.APNSKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	c.APNSKeyID = "ABC123DEFG"
+	c.APNSTeamID = "DEF123GHIJ"
+	c.APNSTopic = "io.heckel.ntfy"
+	requests := make(chan *testAPNSRequest, 10)
+	apnsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		device := strings.TrimPrefix(r.URL.Path, "/3/device/")
+		if device == testAPNSDeviceToken2 {
+			w.WriteHeader(http.StatusGone)
+			io.WriteString(w, `{"reason":"Unregistered"}`)
+			return
+		}
+		var payload apnsPayload
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+		requests <- &testAPNSRequest{header: r.Header, device: device, payload: &payload}
+	}))
+	t.Cleanup(apnsServer.Close)
+	s := newTestServer(t, c)
+	s.apns.baseURL = apnsServer.URL
+	s.apns.client = apnsServer.Client()
+	return s, key, requests
+}
+
+func readTestAPNSRequest(t *testing.T, requests chan *testAPNSRequest) *testAPNSRequest {
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for APNs request")
+		return nil
+	}
+}
+
+func verifyTestAPNSToken(t *testing.T, key *ecdsa.PublicKey, token string) {
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	require.Nil(t, err)
+	require.JSONEq(t, `{"alg":"ES256","kid":"ABC123DEFG"}`, string(header))
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.Nil(t, err)
+	require.Contains(t, string(claims), `"iss":"DEF123GHIJ"`)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.Nil(t, err)
+	require.Len(t, signature, 64)
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	require.True(t, ecdsa.Verify(key, hash[:], r, s))
+}
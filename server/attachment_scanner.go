@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	attachmentScanTimeout   = time.Minute
+	clamdChunkSize          = 64 * 1024 // Size of the chunks sent via the INSTREAM command
+	scanCommandExitInfected = 1         // Exit code of the scan command if the file is infected, same as clamscan
+)
+
+var (
+	errClamdResponseInvalid = errors.New("invalid response from clamd")
+)
+
+// attachmentScanner checks uploaded attachments for viruses and other malware
+type attachmentScanner interface {
+	// Scan reads the file and returns the name of the found signature if it is infected, or an empty string if not
+	Scan(r io.Reader) (signature string, err error)
+}
+
+func newAttachmentScanner(conf *Config) attachmentScanner {
+	if conf.AttachmentScanClamdAddr != "" {
+		return &clamdScanner{addr: conf.AttachmentScanClamdAddr, timeout: attachmentScanTimeout}
+	} else if conf.AttachmentScanCommand != "" {
+		return &commandScanner{command: conf.AttachmentScanCommand, timeout: attachmentScanTimeout}
+	}
+	return nil
+}
+
+// clamdScanner streams files to a ClamAV daemon using the INSTREAM command. The address is either the
+// path of a Unix socket (e.g. /var/run/clamav/clamd.ctl), or host:port of a TCP socket.
+type clamdScanner struct {
+	addr    string
+	timeout time.Duration
+}
+
+func (c *clamdScanner) Scan(r io.Reader) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(c.addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, c.addr, c.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return "", err // clamd closes the connection if the stream is longer than its StreamMaxLength
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	response, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return parseClamdResponse(strings.TrimSuffix(response, "\x00"))
+}
+
+// parseClamdResponse parses a response like "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseClamdResponse(response string) (string, error) {
+	result := strings.TrimPrefix(response, "stream: ")
+	if result == response {
+		return "", errClamdResponseInvalid
+	} else if result == "OK" {
+		return "", nil
+	} else if strings.HasSuffix(result, " FOUND") {
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd error: %s", result)
+}
+
+// commandScanner pipes files into an external command, e.g. "clamdscan --no-summary -". Like clamscan, the
+// command must exit with 0 if the file is clean, and with 1 if it is infected; its output is used as signature.
+type commandScanner struct {
+	command string
+	timeout time.Duration
+}
+
+func (c *commandScanner) Scan(r io.Reader) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.command)
+	cmd.Stdin = r
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err == nil {
+		return "", nil
+	} else if ctx.Err() != nil {
+		return "", ctx.Err()
+	} else if errors.As(err, &exitErr) && exitErr.ExitCode() == scanCommandExitInfected {
+		if signature := strings.TrimSpace(stdout.String()); signature != "" {
+			return signature, nil
+		}
+		return "unknown", nil
+	}
+	return "", fmt.Errorf("scan command failed: %s, %s", err.Error(), strings.TrimSpace(stderr.String()))
+}
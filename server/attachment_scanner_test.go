@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/util"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testEICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func TestClamdScanner_Scan(t *testing.T) {
+	addr := newTestClamd(t, "unix")
+	c := &clamdScanner{addr: addr, timeout: 5 * time.Second}
+
+	signature, err := c.Scan(strings.NewReader("my harmless file"))
+	require.Nil(t, err)
+	require.Equal(t, "", signature)
+
+	signature, err = c.Scan(strings.NewReader(util.RandomString(200000) + testEICAR)) // Multiple chunks
+	require.Nil(t, err)
+	require.Equal(t, "Win.Test.EICAR_HDB-1", signature)
+
+	signature, err = c.Scan(strings.NewReader(""))
+	require.Nil(t, err)
+	require.Equal(t, "", signature)
+}
+
+func TestClamdScanner_TCP_Error(t *testing.T) {
+	c := &clamdScanner{addr: newTestClamd(t, "tcp"), timeout: 5 * time.Second}
+	_, err := c.Scan(strings.NewReader("trigger error"))
+	require.Equal(t, "clamd error: INSTREAM size limit exceeded. ERROR", err.Error())
+
+	c = &clamdScanner{addr: filepath.Join(t.TempDir(), "doesnotexist.ctl"), timeout: time.Second}
+	_, err = c.Scan(strings.NewReader("my harmless file"))
+	require.Error(t, err)
+}
+
+func TestParseClamdResponse(t *testing.T) {
+	signature, err := parseClamdResponse("stream: OK")
+	require.Nil(t, err)
+	require.Equal(t, "", signature)
+
+	signature, err = parseClamdResponse("stream: Eicar-Signature FOUND")
+	require.Nil(t, err)
+	require.Equal(t, "Eicar-Signature", signature)
+
+	_, err = parseClamdResponse("UNKNOWN COMMAND")
+	require.Equal(t, errClamdResponseInvalid, err)
+}
+
+func TestCommandScanner_Scan(t *testing.T) {
+	c := &commandScanner{command: testScanCommand, timeout: 5 * time.Second}
+	signature, err := c.Scan(strings.NewReader("my harmless file"))
+	require.Nil(t, err)
+	require.Equal(t, "", signature)
+
+	signature, err = c.Scan(strings.NewReader(testEICAR))
+	require.Nil(t, err)
+	require.Equal(t, "stdin: Eicar-Test-Signature FOUND", signature)
+
+	c = &commandScanner{command: "cat >/dev/null; exit 1", timeout: 5 * time.Second}
+	signature, err = c.Scan(strings.NewReader(testEICAR))
+	require.Nil(t, err)
+	require.Equal(t, "unknown", signature)
+}
+
+func TestCommandScanner_Error(t *testing.T) {
+	c := &commandScanner{command: "echo database outdated >&2; exit 2", timeout: 5 * time.Second}
+	_, err := c.Scan(strings.NewReader("my harmless file"))
+	require.Equal(t, "scan command failed: exit status 2, database outdated", err.Error())
+
+	c = &commandScanner{command: "exec sleep 10", timeout: 100 * time.Millisecond}
+	_, err = c.Scan(strings.NewReader("my harmless file"))
+	require.Error(t, err)
+}
+
+func TestServer_PublishAttachment_Infected(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentScanCommand = testScanCommand
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic?f=invoice.pdf.exe", testEICAR, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40030, toHTTPError(t, response.Body.String()).Code)
+	entries, err := os.ReadDir(c.AttachmentCacheDir)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(entries))
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, "", response.Body.String())
+
+	content := util.RandomString(5000) // > 4096
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", content, nil).Body.String())
+	require.Equal(t, int64(5000), msg.Attachment.Size)
+	file, err := os.ReadFile(attachmentFile(t, s, msg))
+	require.Nil(t, err)
+	require.Equal(t, content, string(file))
+}
+
+func TestServer_PublishAttachment_ScanFailed(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentScanClamdAddr = filepath.Join(t.TempDir(), "clamd.ctl") // Not running
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", util.RandomString(5000), nil)
+	require.Equal(t, 500, response.Code)
+	entries, err := os.ReadDir(c.AttachmentCacheDir)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(entries))
+}
+
+// testScanCommand behaves like "clamscan --no-summary -", but only detects the EICAR test file
+const testScanCommand = `if grep -q EICAR-STANDARD-ANTIVIRUS-TEST-FILE; then echo "stdin: Eicar-Test-Signature FOUND"; exit 1; fi`
+
+// newTestClamd starts a fake clamd that only understands zINSTREAM: it reports the EICAR test file as infected,
+// and files containing "trigger error" as too large
+func newTestClamd(t *testing.T, network string) string {
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = filepath.Join(t.TempDir(), "clamd.ctl")
+	}
+	listener, err := net.Listen(network, addr)
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleTestClamdConn(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func handleTestClamdConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var content []byte
+	for {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return
+		} else if length == 0 {
+			break
+		}
+		chunk := make([]byte, length)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		content = append(content, chunk...)
+	}
+	if strings.Contains(string(content), "EICAR-STANDARD-ANTIVIRUS-TEST-FILE") {
+		conn.Write([]byte("stream: Win.Test.EICAR_HDB-1 FOUND\x00"))
+	} else if strings.Contains(string(content), "trigger error") {
+		conn.Write([]byte("stream: INSTREAM size limit exceeded. ERROR\x00"))
+	} else {
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit events, see auditEvent
+const (
+	auditEventAuthFailed         = "auth_failed"
+	auditEventAccessDenied       = "access_denied"
+	auditEventTokenCreated       = "token_created"
+	auditEventTokenRevoked       = "token_revoked"
+	auditEventUserAdded          = "user_added"
+	auditEventUserChanged        = "user_changed"
+	auditEventUserRemoved        = "user_removed"
+	auditEventAccessChanged      = "access_changed"
+	auditEventAccessReset        = "access_reset"
+	auditEventTOTPEnabled        = "totp_enabled"
+	auditEventTOTPDisabled       = "totp_disabled"
+	auditEventReservationAdded   = "reservation_added"
+	auditEventReservationRemoved = "reservation_removed"
+	auditEventReadOnlyChanged    = "read_only_changed"
+)
+
+const (
+	auditTokenVisibleLength = 7 // Only the prefix of tokens is logged, e.g. "tk_abcd...", so the log does not leak them
+)
+
+// auditEvent is a single entry in the audit log, which is written as one JSON object per line, e.g.
+// {"time":"2022-12-01T10:15:00Z","event":"access_denied","ip":"1.2.3.4","user":"phil","topic":"alerts","permission":"read"}
+type auditEvent struct {
+	Time       string `json:"time"`
+	Event      string `json:"event"`
+	IP         string `json:"ip,omitempty"`
+	User       string `json:"user,omitempty"`   // The (attempted) user who caused the event
+	Target     string `json:"target,omitempty"` // The user affected by a change, if different from User
+	Topic      string `json:"topic,omitempty"`
+	Permission string `json:"permission,omitempty"`
+	Token      string `json:"token,omitempty"` // Prefix of the access token, see auditTokenVisibleLength
+	Reason     string `json:"reason,omitempty"`
+}
+
+// auditLog appends audit events to a file. Once the file reaches maxSize bytes, it is rotated, i.e. renamed to
+// <filename>.1 (the previous <filename>.1 to <filename>.2, and so on), keeping at most maxBackups rotated files.
+type auditLog struct {
+	filename   string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	mu         sync.Mutex
+}
+
+func newAuditLog(filename string, maxSize int64, maxBackups int) (*auditLog, error) {
+	a := &auditLog{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Write appends the event to the log, rotating the file first if it would grow beyond maxSize
+func (a *auditLog) Write(e *auditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(b)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	return err
+}
+
+// Close closes the log file
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = stat.Size()
+	return nil
+}
+
+// rotate shifts all rotated files by one, dropping the oldest one, and starts a new file. The lock must be held by the caller.
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	if a.maxBackups > 0 {
+		os.Remove(a.backupFilename(a.maxBackups))
+		for i := a.maxBackups - 1; i >= 1; i-- {
+			os.Rename(a.backupFilename(i), a.backupFilename(i+1)) // Fails if there are fewer backups, which is fine
+		}
+		if err := os.Rename(a.filename, a.backupFilename(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.filename); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *auditLog) backupFilename(i int) string {
+	return fmt.Sprintf("%s.%d", a.filename, i)
+}
+
+// audit writes the event to the audit log, if enabled. Time and IP address are filled in from the request.
+func (s *Server) audit(r *http.Request, e *auditEvent) {
+	if s.auditLog == nil {
+		return
+	}
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	e.IP = s.visitorIP(r)
+	if err := s.auditLog.Write(e); err != nil {
+		log.Printf("Unable to write audit log: %s", err.Error())
+	}
+}
+
+// auditAccessDenied records that the user (nil for anonymous users) was denied the permission on the topic
+func (s *Server) auditAccessDenied(r *http.Request, user *auth.User, topic string, perm auth.Permission, reason string) {
+	e := &auditEvent{
+		Event:  auditEventAccessDenied,
+		Topic:  topic,
+		Reason: reason,
+	}
+	if user != nil {
+		e.User = user.Name
+		if user.Token != nil {
+			e.Token = auditToken(user.Token.Value)
+		}
+	}
+	if perm != 0 {
+		e.Permission = perm.String()
+	}
+	s.audit(r, e)
+}
+
+// auditToken returns the prefix of an access token, which is enough to tell tokens apart, but cannot be used to authenticate
+func auditToken(token string) string {
+	if len(token) <= auditTokenVisibleLength {
+		return token
+	}
+	return token[:auditTokenVisibleLength] + "..."
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLog_Rotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditLog(filename, 300, 2)
+	require.Nil(t, err)
+	defer a.Close()
+
+	for i := 0; i < 10; i++ {
+		require.Nil(t, a.Write(&auditEvent{Time: "2022-12-01T10:15:00Z", Event: auditEventAuthFailed, User: "phil", Reason: "invalid password"}))
+	}
+	for _, f := range []string{filename, filename + ".1", filename + ".2"} {
+		stat, err := os.Stat(f)
+		require.Nil(t, err)
+		require.LessOrEqual(t, stat.Size(), int64(300))
+		require.Greater(t, stat.Size(), int64(0))
+	}
+	require.NoFileExists(t, filename+".3")
+}
+
+func TestAuditLog_Reopen(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	a, err := newAuditLog(filename, 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, a.Write(&auditEvent{Event: auditEventUserAdded, User: "phil"}))
+	require.Nil(t, a.Close())
+
+	a, err = newAuditLog(filename, 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, a.Write(&auditEvent{Event: auditEventUserRemoved, User: "phil"}))
+	require.Nil(t, a.Close())
+	events := readAuditLog(t, filename)
+	require.Len(t, events, 2)
+	require.Equal(t, auditEventUserAdded, events[0].Event)
+	require.Equal(t, auditEventUserRemoved, events[1].Event)
+}
+
+func TestServer_AuditLog(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	c.AuditLogFile = filepath.Join(t.TempDir(), "audit.log")
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleAdmin))
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+
+	response := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": basicAuth("ben:wrongpass"),
+	})
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/user/tokens", `{"topics":["mytopic"],"permission":"read-only"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	token := toTokenResponse(t, response.Body.String())
+	response = request(t, s, "DELETE", "/user/tokens/"+token.Token, "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/admin/users/ben", `{"role":"admin"}`, map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	events := readAuditLog(t, c.AuditLogFile)
+	require.Len(t, events, 5)
+	require.Equal(t, auditEventAuthFailed, events[0].Event)
+	require.Equal(t, "ben", events[0].User)
+	require.Equal(t, "9.9.9.9", events[0].IP)
+	require.NotEmpty(t, events[0].Time)
+	require.Equal(t, auditEventAccessDenied, events[1].Event)
+	require.Equal(t, "ben", events[1].User)
+	require.Equal(t, "mytopic", events[1].Topic)
+	require.Equal(t, "publish", events[1].Permission)
+	require.Equal(t, auditEventTokenCreated, events[2].Event)
+	require.Equal(t, token.Token[:auditTokenVisibleLength]+"...", events[2].Token)
+	require.Equal(t, "mytopic", events[2].Topic)
+	require.Equal(t, auditEventTokenRevoked, events[3].Event)
+	require.Equal(t, auditEventUserChanged, events[4].Event)
+	require.Equal(t, "phil", events[4].User)
+	require.Equal(t, "ben", events[4].Target)
+
+	b, err := os.ReadFile(c.AuditLogFile)
+	require.Nil(t, err)
+	require.NotContains(t, string(b), token.Token) // Tokens must not be leaked
+}
+
+func readAuditLog(t *testing.T, filename string) []*auditEvent {
+	f, err := os.Open(filename)
+	require.Nil(t, err)
+	defer f.Close()
+	events := make([]*auditEvent, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEvent
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, &e)
+	}
+	return events
+}
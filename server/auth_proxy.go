@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	authProxySecretHeader = "X-Proxy-Secret"
+)
+
+// authProxy trusts the username in a header (e.g. Remote-User) that is set by an authenticating reverse proxy like
+// Authelia or oauth2-proxy. Since any client can set this header, it is only accepted from the proxy, which is
+// identified by its IP address (trustedNets), by a shared secret in the X-Proxy-Secret header, or both.
+type authProxy struct {
+	header      string
+	secret      string
+	trustedNets []*net.IPNet
+}
+
+// newAuthProxy creates an authProxy. Trusted hosts are IP addresses or CIDR ranges, e.g. 10.0.0.1 or 172.16.0.0/12.
+func newAuthProxy(header, secret string, trustedHosts []string) (*authProxy, error) {
+	if secret == "" && len(trustedHosts) == 0 {
+		return nil, errors.New("auth proxy requires a secret or trusted hosts, otherwise any client could choose its user")
+	}
+	trustedNets := make([]*net.IPNet, 0)
+	for _, host := range trustedHosts {
+		ipNet, err := parseIPNet(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth proxy trusted host %s, expected IP address or CIDR range", host)
+		}
+		trustedNets = append(trustedNets, ipNet)
+	}
+	return &authProxy{
+		header:      header,
+		secret:      secret,
+		trustedNets: trustedNets,
+	}, nil
+}
+
+// authProxyUsername returns the username in the auth proxy header, or false if the auth proxy is not
+// configured or the request does not have the header. It does not check if the header can be trusted.
+func (s *Server) authProxyUsername(r *http.Request) (string, bool) {
+	if s.authProxy == nil {
+		return "", false
+	}
+	username := r.Header.Get(s.authProxy.header)
+	return strings.TrimSpace(username), username != ""
+}
+
+// trusted returns true if the request was sent by the proxy, i.e. if it comes from one of the trusted
+// hosts and carries the shared secret (if they are configured)
+func (p *authProxy) trusted(r *http.Request) bool {
+	if p.secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(authProxySecretHeader)), []byte(p.secret)) != 1 {
+		return false
+	}
+	if len(p.trustedNets) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr // Only in tests
+	}
+	ip := net.ParseIP(host)
+	for _, ipNet := range p.trustedNets {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateProxyUser returns the user that the proxy authenticated. Users that do not exist yet are
+// created with the user role and a random password, so that they can only log in via the proxy.
+func (s *Server) authenticateProxyUser(r *http.Request, username string) (*auth.User, error) {
+	if !s.authProxy.trusted(r) {
+		return nil, fmt.Errorf("header %s not set by a trusted proxy", s.authProxy.header)
+	}
+	manager, ok := s.auth.(auth.Manager)
+	if !ok {
+		return nil, errors.New("auth proxy requires the sqlite or postgres auth backend")
+	} else if !auth.AllowedUsername(username) {
+		return nil, fmt.Errorf("invalid username %s in header %s", username, s.authProxy.header)
+	}
+	user, err := manager.User(username)
+	if err == auth.ErrNotFound {
+		password := make([]byte, 32)
+		if _, err := rand.Read(password); err != nil {
+			return nil, err
+		}
+		if err := manager.AddUser(username, base64.StdEncoding.EncodeToString(password), auth.RoleUser); err != nil {
+			return nil, err
+		}
+		log.Printf("[%s] Created user %s, authenticated by auth proxy", r.RemoteAddr, username)
+		s.audit(r, &auditEvent{Event: auditEventUserAdded, User: username, Reason: "authenticated by auth proxy"})
+		return manager.User(username)
+	}
+	return user, err
+}
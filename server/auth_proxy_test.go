@@ -0,0 +1,101 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthProxy_Trusted(t *testing.T) {
+	p, err := newAuthProxy("Remote-User", "", []string{"10.0.0.1", "172.16.0.0/12", "::1"})
+	require.Nil(t, err)
+	for addr, trusted := range map[string]bool{
+		"10.0.0.1:1234":    true,
+		"10.0.0.2:1234":    false,
+		"172.20.1.2:1234":  true,
+		"[::1]:1234":       true,
+		"9.9.9.9":          false,
+		"not-an-ip:1234":   false,
+		"192.168.1.1:1234": false,
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		require.Equal(t, trusted, p.trusted(r), addr)
+	}
+
+	p, err = newAuthProxy("Remote-User", "proxysecret", nil)
+	require.Nil(t, err)
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "9.9.9.9:1234"
+	require.False(t, p.trusted(r))
+	r.Header.Set("X-Proxy-Secret", "wrongsecret")
+	require.False(t, p.trusted(r))
+	r.Header.Set("X-Proxy-Secret", "proxysecret")
+	require.True(t, p.trusted(r))
+}
+
+func TestNewAuthProxy_Invalid(t *testing.T) {
+	_, err := newAuthProxy("Remote-User", "", nil)
+	require.Error(t, err)
+	_, err = newAuthProxy("Remote-User", "", []string{"proxy.example.com"})
+	require.Error(t, err)
+	_, err = newAuthProxy("Remote-User", "", []string{"10.0.0.0/33"})
+	require.Error(t, err)
+}
+
+func TestServer_AuthProxy_ProvisionAndPublish(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	c.AuthProxyHeader = "Remote-User"
+	c.AuthProxyTrustedHosts = []string{"9.9.9.9"} // See request()
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AllowAccess("phil", "mytopic", true, true))
+
+	response := request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Remote-User": "phil",
+	})
+	require.Equal(t, 200, response.Code)
+	phil, err := manager.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, auth.RoleUser, phil.Role)
+
+	response = request(t, s, "PUT", "/othertopic", "hi", map[string]string{
+		"Remote-User": "phil",
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Remote-User": "not a valid username",
+	})
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_AuthProxy_Untrusted(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	c.AuthProxyHeader = "Remote-User"
+	c.AuthProxySecret = "proxysecret"
+	c.AuthProxyTrustedHosts = []string{"10.0.0.1"}
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleAdmin))
+
+	response := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Remote-User":    "phil",
+		"X-Proxy-Secret": "proxysecret",
+	})
+	require.Equal(t, 401, response.Code) // Not from a trusted host
+
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+	})
+	require.Equal(t, 200, response.Code) // Other credentials still work without the header
+}
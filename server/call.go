@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	callTextMaxLength = 1000 // In characters, to keep calls short; Twilio allows up to 4,096
+)
+
+// parsePublishCall reads the phone number that is to be called to read out a message (X-Call), if any. Like for SMS,
+// only max priority messages that are not delayed can trigger calls, and only to the verified phone numbers of the
+// publishing user, see parsePublishSMS.
+func (s *Server) parsePublishCall(r *http.Request, v *visitor, m *message) (string, error) {
+	number := readParam(r, "x-call", "call")
+	if number == "" {
+		return "", nil
+	} else if s.caller == nil || s.auth == nil {
+		return "", errHTTPBadRequestCallDisabled
+	} else if err := s.checkPublishPhoneNumber(r, m, number, errHTTPBadRequestCallInvalid, "read out in phone calls"); err != nil {
+		return "", err
+	} else if err := s.callAllowed(r, v); err != nil {
+		return "", err
+	}
+	return number, nil
+}
+
+// placeCall calls a phone number to read out a message. Calls that fail or are not answered are not retried.
+// This is meant to be called in a goroutine.
+func (s *Server) placeCall(senderIP, to string, m *message) {
+	if err := s.caller.Call(to, toCallText(m)); err != nil {
+		log.Printf("[%s] CALL - Unable to call %s for message %s: %v", senderIP, to, m.ID, err.Error())
+	}
+}
+
+// toCallText formats a message as the text that is read out: the topic and the title, followed by the message.
+// Binary messages are left out, and the text is cut off after callTextMaxLength characters.
+func toCallText(m *message) string {
+	sentences := []string{fmt.Sprintf("You have an urgent notification on topic %s.", m.Topic)}
+	if m.Title != "" {
+		sentences = append(sentences, strings.TrimSuffix(m.Title, ".")+".")
+	}
+	if m.Encoding == "" && m.Message != "" {
+		sentences = append(sentences, m.Message)
+	}
+	return truncateRunes(strings.Join(sentences, " "), callTextMaxLength)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPhoneCaller passes all calls to its channel, instead of placing them via Twilio
+type testPhoneCaller struct {
+	calls chan *testSMS
+}
+
+func (c *testPhoneCaller) Call(to, text string) error {
+	c.calls <- &testSMS{to: to, text: text}
+	return nil
+}
+
+func (c *testPhoneCaller) read(t *testing.T) *testSMS {
+	select {
+	case call := <-c.calls:
+		return call
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for phone call")
+		return nil
+	}
+}
+
+func TestServer_Call_Publish(t *testing.T) {
+	s, sender, caller := newTestCallServer(t, newTestConfig(t))
+	verifyTestPhoneNumber(t, s, sender, "phil:phil", testPhoneNumber)
+	response := request(t, s, "PUT", "/alerts", "Disk full <90%", map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+		"Title":         "Server down",
+		"Priority":      "urgent",
+		"X-Call":        testPhoneNumber,
+	})
+	require.Equal(t, 200, response.Code)
+	call := caller.read(t)
+	require.Equal(t, testPhoneNumber, call.to)
+	require.Equal(t, "You have an urgent notification on topic alerts. Server down. Disk full <90%", call.text)
+
+	// Calls and SMS can be combined
+	response = request(t, s, "POST", "/", `{"topic":"alerts","message":"Still down","priority":5,"sms":"+12025550123","call":"+12025550123"}`, map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "You have an urgent notification on topic alerts. Still down", caller.read(t).text)
+	require.Equal(t, "[alerts]\nStill down", sender.read(t).text)
+}
+
+func TestServer_Call_Invalid(t *testing.T) {
+	s, sender, _ := newTestCallServer(t, newTestConfig(t))
+	verifyTestPhoneNumber(t, s, sender, "phil:phil", testPhoneNumber)
+	response := request(t, s, "PUT", "/alerts", "Not urgent", map[string]string{"Authorization": basicAuth("phil:phil"), "Priority": "high", "X-Call": testPhoneNumber})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40063, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/alerts", "Not verified", map[string]string{"Authorization": basicAuth("phil:phil"), "Priority": "5", "X-Call": "+12025550124"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40063, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/alerts", "Anonymous", map[string]string{"Priority": "5", "Call": testPhoneNumber})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40063, toHTTPError(t, response.Body.String()).Code)
+
+	s, _ = newTestSMSServer(t, newTestConfig(t)) // SMS enabled, calls disabled
+	response = request(t, s, "PUT", "/alerts", "Urgent", map[string]string{"Authorization": basicAuth("phil:phil"), "Priority": "5", "X-Call": testPhoneNumber})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40062, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/user/phone/verify", `{"number":"+12025550123","channel":"call"}`, map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40060, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Call_VerifyByCall(t *testing.T) {
+	s, _, caller := newTestCallServer(t, newTestConfig(t))
+	headers := map[string]string{"Authorization": basicAuth("phil:phil")}
+	response := request(t, s, "POST", "/user/phone/verify", `{"number":"+12025550123","channel":"call"}`, headers)
+	require.Equal(t, 200, response.Code)
+	call := caller.read(t)
+	require.Equal(t, testPhoneNumber, call.to)
+	matches := regexp.MustCompile(`is ([0-9], [0-9], [0-9], [0-9], [0-9], [0-9])\.`).FindStringSubmatch(call.text)
+	require.NotNil(t, matches)
+	code := strings.ReplaceAll(matches[1], ", ", "")
+	response = request(t, s, "PUT", "/user/phone", `{"number":"+12025550123","code":"`+code+`"}`, headers)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"phone_numbers":["+12025550123"]}`+"\n", response.Body.String())
+}
+
+func TestServer_Call_Limits(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorCallDailyLimit = 1
+	s, sender, caller := newTestCallServer(t, c)
+	verifyTestPhoneNumber(t, s, sender, "phil:phil", testPhoneNumber) // Verified by SMS, does not count towards the call limit
+	headers := map[string]string{"Authorization": basicAuth("phil:phil"), "Priority": "5", "X-Call": testPhoneNumber}
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "First", headers).Code)
+	caller.read(t)
+	response := request(t, s, "PUT", "/alerts", "Second", headers)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42911, toHTTPError(t, response.Body.String()).Code)
+
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddTier(&auth.Tier{Code: "oncall", CallsLimit: 2}))
+	require.Nil(t, manager.ChangeTier("phil", "oncall"))
+	for i := 0; i < 2; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/alerts", "Urgent", headers).Code)
+		caller.read(t)
+	}
+	response = request(t, s, "PUT", "/alerts", "Too many", headers)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42911, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestTwilioClient_Call(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/2010-04-01/Accounts/AC123/Calls.json", r.URL.Path)
+		require.Nil(t, r.ParseForm())
+		require.Equal(t, testPhoneNumber, r.PostForm.Get("To"))
+		require.Equal(t, "+15005550006", r.PostForm.Get("From"))
+		require.Equal(t, `<Response><Say loop="2">Disk &lt;90% &amp; rising</Say></Response>`, r.PostForm.Get("Twiml"))
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"sid":"CA123","status":"queued"}`)
+	}))
+	defer server.Close()
+	caller := newPhoneCaller(&Config{EnableCalls: true, SMSProvider: SMSProviderTwilio, SMSUser: "AC123", SMSPass: "secret", SMSFrom: "+15005550006"}).(*twilioClient)
+	caller.baseURL = server.URL
+	require.Nil(t, caller.Call(testPhoneNumber, "Disk <90% & rising"))
+	require.Nil(t, newPhoneCaller(&Config{EnableCalls: true, SMSProvider: SMSProviderVonage}))
+}
+
+// newTestCallServer is like newTestSMSServer, but with phone calls enabled
+func newTestCallServer(t *testing.T, c *Config) (*Server, *testSMSSender, *testPhoneCaller) {
+	c.EnableCalls = true
+	s, sender := newTestSMSServer(t, c)
+	caller := &testPhoneCaller{calls: make(chan *testSMS, 10)}
+	s.caller = caller
+	return s, sender, caller
+}
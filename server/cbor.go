@@ -0,0 +1,455 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// CBOR (RFC 8949) is offered as an alternative to JSON for constrained devices, see /<topic>/cbor. There is no
+// separate schema: Structs are encoded as maps, with the same keys and the same omitempty rules as their JSON
+// struct tags, so a CBOR message has exactly the fields of the JSON message. Only the types used in the message
+// structs (strings, integers, booleans, slices, string maps, structs and pointers) are supported.
+
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+
+	cborFalse      = 20
+	cborTrue       = 21
+	cborNull       = 22
+	cborUndefined  = 23
+	cborIndefinite = 31
+	cborBreak      = 0xff
+
+	cborMaxDepth = 16 // Messages are at most three levels deep (message, action, headers)
+)
+
+var (
+	errCBORInvalid     = errors.New("invalid CBOR")
+	errCBORUnsupported = errors.New("unsupported CBOR type")
+)
+
+// cborMarshal encodes v as CBOR, using the JSON struct tags as map keys
+func cborMarshal(v interface{}) ([]byte, error) {
+	return cborEncode(nil, reflect.ValueOf(v))
+}
+
+func cborEncode(b []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return append(b, cborSimple<<5|cborNull), nil
+		}
+		return cborEncode(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, cborSimple<<5|cborTrue), nil
+		}
+		return append(b, cborSimple<<5|cborFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); i < 0 {
+			return cborHead(b, cborNegative, uint64(-(i + 1))), nil
+		}
+		return cborHead(b, cborUnsigned, uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cborHead(b, cborUnsigned, v.Uint()), nil
+	case reflect.String:
+		return append(cborHead(b, cborText, uint64(v.Len())), v.String()...), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(b, cborSimple<<5|cborNull), nil
+		} else if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(cborHead(b, cborBytes, uint64(v.Len())), v.Bytes()...), nil
+		}
+		b = cborHead(b, cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if b, err = cborEncode(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, cborSimple<<5|cborNull), nil
+		} else if v.Type().Key().Kind() != reflect.String {
+			return nil, errCBORUnsupported
+		}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys) // Deterministic output, like encoding/json
+		b = cborHead(b, cborMap, uint64(len(keys)))
+		for _, k := range keys {
+			var err error
+			b = append(cborHead(b, cborText, uint64(len(k))), k...)
+			if b, err = cborEncode(b, v.MapIndex(reflect.ValueOf(k).Convert(v.Type().Key()))); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		fields := cborFields(v.Type())
+		values := make([]reflect.Value, 0, len(fields))
+		names := make([]string, 0, len(fields))
+		for _, f := range fields {
+			fv := v.Field(f.index)
+			if f.omitEmpty && cborEmpty(fv) {
+				continue
+			}
+			values = append(values, fv)
+			names = append(names, f.name)
+		}
+		b = cborHead(b, cborMap, uint64(len(values)))
+		for i, fv := range values {
+			var err error
+			b = append(cborHead(b, cborText, uint64(len(names[i]))), names[i]...)
+			if b, err = cborEncode(b, fv); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, errCBORUnsupported
+}
+
+// cborEmpty returns true if the value is omitted by encoding/json if the field has the omitempty option
+func cborEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// cborHead appends the initial byte of an item, and its argument (the value, length or count) in as few bytes as possible
+func cborHead(b []byte, major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return append(b, major<<5|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(b, major<<5|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return append(b, major<<5|25, byte(arg>>8), byte(arg))
+	case arg <= math.MaxUint32:
+		return append(b, major<<5|26, byte(arg>>24), byte(arg>>16), byte(arg>>8), byte(arg))
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], arg)
+	return append(append(b, major<<5|27), buf[:]...)
+}
+
+// cborField is an exported struct field with a JSON name, see cborFields
+type cborField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// cborFields returns the fields of a struct that encoding/json would encode, in the order of the struct
+func cborFields(t reflect.Type) []cborField {
+	fields := make([]cborField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // Unexported
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = f.Name
+		}
+		omitEmpty := false
+		for _, option := range tag[1:] {
+			omitEmpty = omitEmpty || option == "omitempty"
+		}
+		fields = append(fields, cborField{name: name, index: i, omitEmpty: omitEmpty})
+	}
+	return fields
+}
+
+// cborUnmarshal decodes a single CBOR item into v, which must be a pointer. Like encoding/json, unknown map keys are
+// ignored, and null leaves the value untouched. Tags are ignored, and indefinite-length items are supported.
+func cborUnmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errCBORUnsupported
+	}
+	d := &cborDecoder{data: data}
+	if err := d.decode(rv.Elem(), 0); err != nil {
+		return err
+	} else if d.pos != len(d.data) {
+		return fmt.Errorf("%w: %d bytes of trailing data", errCBORInvalid, len(d.data)-d.pos)
+	}
+	return nil
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// head reads the initial byte of an item and its argument. For indefinite-length items, indefinite is true.
+func (d *cborDecoder) head() (major byte, info byte, arg uint64, indefinite bool, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, 0, false, errCBORInvalid
+	}
+	major, info = d.data[d.pos]>>5, d.data[d.pos]&0x1f
+	d.pos++
+	switch {
+	case info < 24:
+		return major, info, uint64(info), false, nil
+	case info <= 27:
+		n := 1 << (info - 24)
+		if d.pos+n > len(d.data) {
+			return 0, 0, 0, false, errCBORInvalid
+		}
+		for _, c := range d.data[d.pos : d.pos+n] {
+			arg = arg<<8 | uint64(c)
+		}
+		d.pos += n
+		return major, info, arg, false, nil
+	case info == cborIndefinite && major >= cborBytes && major <= cborMap:
+		return major, info, 0, true, nil
+	}
+	return 0, 0, 0, false, errCBORInvalid
+}
+
+// breaks returns true and skips the break byte, if the next byte ends an indefinite-length item
+func (d *cborDecoder) breaks() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == cborBreak {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+// count checks that n items may follow, each of them at least one byte long, so that a forged length can't
+// make us allocate huge slices
+func (d *cborDecoder) count(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errCBORInvalid
+	}
+	return int(n), nil
+}
+
+// str reads the rest of a byte or text string, whose head was already read
+func (d *cborDecoder) str(major byte, arg uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		n, err := d.count(arg)
+		if err != nil {
+			return nil, err
+		}
+		d.pos += n
+		return d.data[d.pos-n : d.pos], nil
+	}
+	var s []byte
+	for !d.breaks() {
+		chunkMajor, _, chunkArg, chunkIndefinite, err := d.head()
+		if err != nil {
+			return nil, err
+		} else if chunkMajor != major || chunkIndefinite {
+			return nil, errCBORInvalid
+		}
+		chunk, err := d.str(major, chunkArg, false)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+	return s, nil
+}
+
+func (d *cborDecoder) decode(v reflect.Value, depth int) error {
+	if depth > cborMaxDepth {
+		return errCBORInvalid
+	} else if v.Kind() == reflect.Ptr {
+		if d.pos < len(d.data) && (d.data[d.pos] == cborSimple<<5|cborNull || d.data[d.pos] == cborSimple<<5|cborUndefined) {
+			d.pos++
+			return nil
+		} else if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem(), depth+1)
+	}
+	major, info, arg, indefinite, err := d.head()
+	if err != nil {
+		return err
+	}
+	for major == cborTag { // e.g. "self-described CBOR", we don't care about tags
+		if major, info, arg, indefinite, err = d.head(); err != nil {
+			return err
+		}
+	}
+	if major == cborSimple && (info == cborNull || info == cborUndefined) {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if major != cborSimple || info != cborFalse && info != cborTrue {
+			return errCBORUnsupported
+		}
+		v.SetBool(info == cborTrue)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if major == cborUnsigned && arg <= math.MaxInt64 {
+			i = int64(arg)
+		} else if major == cborNegative && arg <= math.MaxInt64 {
+			i = -1 - int64(arg)
+		} else {
+			return errCBORUnsupported
+		}
+		if v.OverflowInt(i) {
+			return errCBORUnsupported
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if major != cborUnsigned || v.OverflowUint(arg) {
+			return errCBORUnsupported
+		}
+		v.SetUint(arg)
+	case reflect.String:
+		if major != cborText {
+			return errCBORUnsupported
+		}
+		s, err := d.str(major, arg, indefinite)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(s))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && major == cborBytes {
+			s, err := d.str(major, arg, indefinite)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), s...))
+			return nil
+		} else if major != cborArray {
+			return errCBORUnsupported
+		}
+		n, err := d.count(arg)
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), 0, n)
+		for i := 0; indefinite && !d.breaks() || !indefinite && i < n; i++ {
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(e, depth+1); err != nil {
+				return err
+			}
+			s = reflect.Append(s, e)
+		}
+		v.Set(s)
+	case reflect.Map:
+		if major != cborMap || v.Type().Key().Kind() != reflect.String {
+			return errCBORUnsupported
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		return d.entries(arg, indefinite, depth, func(key string) (reflect.Value, bool) {
+			return reflect.New(v.Type().Elem()).Elem(), true
+		}, func(key string, e reflect.Value) {
+			v.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), e)
+		})
+	case reflect.Struct:
+		if major != cborMap {
+			return errCBORUnsupported
+		}
+		fields := cborFields(v.Type())
+		return d.entries(arg, indefinite, depth, func(key string) (reflect.Value, bool) {
+			for _, f := range fields {
+				if f.name == key {
+					return v.Field(f.index), true
+				}
+			}
+			for _, f := range fields {
+				if strings.EqualFold(f.name, key) { // Like encoding/json
+					return v.Field(f.index), true
+				}
+			}
+			return reflect.Value{}, false
+		}, nil)
+	default:
+		return errCBORUnsupported
+	}
+	return nil
+}
+
+// entries decodes the key/value pairs of a map, whose head was already read. Keys must be text strings. For every
+// key, value returns where to decode the value to, or false if the value is to be skipped. If set is not nil, it
+// is called with the decoded value.
+func (d *cborDecoder) entries(arg uint64, indefinite bool, depth int, value func(key string) (reflect.Value, bool), set func(key string, v reflect.Value)) error {
+	n, err := d.count(arg)
+	if err != nil {
+		return err
+	}
+	for i := 0; indefinite && !d.breaks() || !indefinite && i < n; i++ {
+		var key string
+		if err := d.decode(reflect.ValueOf(&key).Elem(), depth+1); err != nil {
+			return err
+		}
+		v, ok := value(key)
+		if !ok {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decode(v, depth+1); err != nil {
+			return err
+		}
+		if set != nil {
+			set(key, v)
+		}
+	}
+	return nil
+}
+
+// skip skips an item of any type, e.g. the value of an unknown map key
+func (d *cborDecoder) skip(depth int) error {
+	if depth > cborMaxDepth {
+		return errCBORInvalid
+	}
+	major, _, arg, indefinite, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborBytes, cborText:
+		_, err := d.str(major, arg, indefinite)
+		return err
+	case cborArray, cborMap:
+		n, err := d.count(arg)
+		if err != nil {
+			return err
+		}
+		if major == cborMap {
+			n *= 2
+		}
+		for i := 0; indefinite && !d.breaks() || !indefinite && i < n; i++ {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		return d.skip(depth + 1)
+	}
+	return nil // Integers and simple values (incl. floats) have no content beyond their head
+}
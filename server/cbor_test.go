@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCBOR_Marshal(t *testing.T) {
+	type test struct {
+		Number  int               `json:"n"`
+		Text    string            `json:"t,omitempty"`
+		List    []string          `json:"l,omitempty"`
+		Map     map[string]string `json:"m,omitempty"`
+		Flag    bool              `json:"f"`
+		Ignored string            `json:"-"`
+	}
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{500, "1901f4"},
+		{int64(1665792000), "1a6349f800"},
+		{int64(1) << 40, "1b0000010000000000"},
+		{-1, "20"},
+		{-500, "3901f3"},
+		{"", "60"},
+		{"ntfy", "646e746679"},
+		{[]byte{1, 2}, "420102"},
+		{[]string{"a", "b"}, "8261616162"},
+		{[]string(nil), "f6"},
+		{map[string]string{"b": "2", "a": "1"}, "a26161613161626132"}, // Sorted keys
+		{&test{Number: 1, Ignored: "x"}, "a2616e016166f4"},
+		{&test{Number: -2, Text: "hi", List: []string{}, Map: map[string]string{"k": "v"}, Flag: true}, "a4616e216174626869616da1616b61766166f5"},
+		{(*test)(nil), "f6"},
+	}
+	for _, tt := range tests {
+		b, err := cborMarshal(tt.value)
+		require.Nil(t, err)
+		require.Equal(t, tt.expected, hex.EncodeToString(b), tt.value)
+	}
+	_, err := cborMarshal(1.5)
+	require.Equal(t, errCBORUnsupported, err)
+}
+
+func TestCBOR_MessageRoundTrip(t *testing.T) {
+	m := newDefaultMessage("mytopic", "Backup failed")
+	m.Priority = 5
+	m.Tags = []string{"warning", "backup"}
+	m.Actions = []*action{{ID: "a1", Action: "http", Label: "Retry", URL: "https://example.com", Headers: map[string]string{"Authorization": "Bearer x"}}}
+	m.Attachment = &attachment{Name: "log.txt", Size: 1234, URL: "https://ntfy.sh/file/abc.txt", Owner: "1.2.3.4"}
+	b, err := cborMarshal(m)
+	require.Nil(t, err)
+
+	var decoded message
+	require.Nil(t, cborUnmarshal(b, &decoded))
+	m.Attachment.Owner = "" // Not encoded, json:"-"
+	require.Equal(t, *m, decoded)
+}
+
+func TestCBOR_Unmarshal(t *testing.T) {
+	var m publishMessage
+	// {_ "topic": "mytopic", "priority": 4, "tags": [_ "a", "b"], "unknown": {"x": [1, 2.5]}, "title": (_ "Hel" "lo"), "click": null, "markdown": true}
+	// The outer map, the tags array, and the title are indefinite-length; the whole item is tagged as self-described CBOR
+	data, err := hex.DecodeString("d9d9f7bf65746f706963676d79746f706963687072696f726974790464746167739f61616162ff67756e6b6e6f776ea1617882" +
+		"01f94100657469746c657f6348656c626c6fff65636c69636bf6686d61726b646f776ef5ff")
+	require.Nil(t, err)
+	require.Nil(t, cborUnmarshal(data, &m))
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, 4, m.Priority)
+	require.Equal(t, []string{"a", "b"}, m.Tags)
+	require.Equal(t, "Hello", m.Title)
+	require.Equal(t, "", m.Click)
+	require.True(t, m.Markdown)
+}
+
+func TestCBOR_UnmarshalInvalid(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected error
+	}{
+		{"", errCBORInvalid},
+		{"a1", errCBORInvalid},                                         // Truncated map
+		{"a165746f706963", errCBORInvalid},                             // Value missing
+		{"a0a0", errCBORInvalid},                                       // Trailing data
+		{"a165746f7069637a7fffffff", errCBORInvalid},                   // String longer than the data
+		{"a164746167739bffffffffffffffff", errCBORInvalid},             // Array longer than the data
+		{"a165746f70696301", errCBORUnsupported},                       // Number instead of string
+		{"a1687072696f72697479f93e00", errCBORUnsupported},             // Float instead of int
+		{"a1687072696f726974791bffffffffffffffff", errCBORUnsupported}, // Integer overflow
+		{"81", errCBORUnsupported},                                     // Array instead of map
+	}
+	for _, tt := range tests {
+		data, err := hex.DecodeString(tt.input)
+		require.Nil(t, err)
+		var m publishMessage
+		require.ErrorIs(t, cborUnmarshal(data, &m), tt.expected, tt.input)
+	}
+
+	var m publishMessage
+	deep := []byte{0xa1, 0x61, 0x78} // {"x": [[[[...
+	for i := 0; i < 100; i++ {
+		deep = append(deep, 0x81)
+	}
+	require.Equal(t, errCBORInvalid, cborUnmarshal(deep, &m)) // Unknown keys are skipped, but only up to cborMaxDepth
+}
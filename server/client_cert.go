@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"net/http"
+	"os"
+)
+
+// Fields of a client certificate that can be mapped to a ntfy username, see clientCertUsername
+const (
+	ClientCertUsernameCN    = "cn"    // Common name of the subject
+	ClientCertUsernameEmail = "email" // First e-mail address in the subject alternative names
+	ClientCertUsernameDNS   = "dns"   // First DNS name in the subject alternative names
+)
+
+// loadClientCAs reads the PEM-encoded CA certificates that client certificates are verified against
+func loadClientCAs(filename string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("invalid client CA file %s: no PEM-encoded certificates found", filename)
+	}
+	return pool, nil
+}
+
+// clientTLSConfig returns the TLS config of the HTTPS listener, which asks clients for a certificate, but also
+// accepts connections without one, so that other clients can still use passwords or tokens
+func clientTLSConfig(clientCAs *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  clientCAs,
+	}
+}
+
+// verifiedClientCert returns the client certificate of the request, if it was verified during the TLS handshake
+func verifiedClientCert(r *http.Request) (*x509.Certificate, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return r.TLS.VerifiedChains[0][0], true
+}
+
+// clientCertUsername returns the username for a client certificate, taken from the given field, or an empty
+// string if the certificate does not have this field
+func clientCertUsername(cert *x509.Certificate, field string) string {
+	switch field {
+	case ClientCertUsernameEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case ClientCertUsernameDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
+
+// authenticateClientCert returns the user that a verified client certificate maps to. Users are looked up in the
+// auth database, so a certificate can be revoked by removing its user, without having to revoke the certificate.
+func (s *Server) authenticateClientCert(cert *x509.Certificate) (*auth.User, error) {
+	manager, ok := s.auth.(auth.Manager)
+	if !ok {
+		return nil, errors.New("client certificates require the sqlite or postgres auth backend")
+	}
+	username := clientCertUsername(cert, s.config.ClientCertUsername)
+	if !auth.AllowedUsername(username) {
+		return nil, fmt.Errorf("client certificate %s does not map to a valid username", cert.Subject.String())
+	}
+	user, err := manager.User(username)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate user %s: %s", username, err.Error())
+	}
+	return user, nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientCertUsername(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "sensor-1"},
+		EmailAddresses: []string{"sensor-2", "sensor-3"},
+		DNSNames:       []string{"sensor-4"},
+	}
+	require.Equal(t, "sensor-1", clientCertUsername(cert, ClientCertUsernameCN))
+	require.Equal(t, "sensor-2", clientCertUsername(cert, ClientCertUsernameEmail))
+	require.Equal(t, "sensor-4", clientCertUsername(cert, ClientCertUsernameDNS))
+	require.Equal(t, "", clientCertUsername(&x509.Certificate{}, ClientCertUsernameDNS))
+}
+
+func TestLoadClientCAs_Invalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(filename, []byte("not a certificate"), 0600))
+	_, err := loadClientCAs(filename)
+	require.Error(t, err)
+	_, err = loadClientCAs(filepath.Join(t.TempDir(), "does-not-exist.pem"))
+	require.Error(t, err)
+}
+
+func TestServer_PublishWithClientCert(t *testing.T) {
+	ca, caKey := newTestClientCA(t)
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	c.ClientCertCAFile = filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(c.ClientCertCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600))
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("sensor-1", "sensor-1-pass", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("sensor-1", "sensors", false, true))
+
+	cert := newTestClientCert(t, ca, caKey, "sensor-1")
+	response := requestWithClientCert(t, s, "PUT", "/sensors", "21.5", cert)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "21.5", toMessage(t, response.Body.String()).Message)
+	response = requestWithClientCert(t, s, "PUT", "/othertopic", "21.5", cert)
+	require.Equal(t, 403, response.Code)
+	response = requestWithClientCert(t, s, "PUT", "/sensors", "21.5", newTestClientCert(t, ca, caKey, "sensor-2"))
+	require.Equal(t, 401, response.Code) // User does not exist
+
+	require.Nil(t, manager.RemoveUser("sensor-1"))
+	response = requestWithClientCert(t, s, "PUT", "/sensors", "21.5", cert)
+	require.Equal(t, 401, response.Code) // Removing the user revokes the certificate
+}
+
+func TestServer_PublishWithClientCert_NotEnabled(t *testing.T) {
+	ca, caKey := newTestClientCA(t)
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("sensor-1", "sensor-1-pass", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("sensor-1", "sensors", false, true))
+
+	response := requestWithClientCert(t, s, "PUT", "/sensors", "21.5", newTestClientCert(t, ca, caKey, "sensor-1"))
+	require.Equal(t, 403, response.Code) // Certificate is ignored, request is anonymous
+}
+
+func requestWithClientCert(t *testing.T, s *Server, method, url, body string, cert *x509.Certificate) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "9.9.9.9" // Used for tests
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	s.handle(rr, req)
+	return rr
+}
+
+func newTestClientCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ntfy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert, key
+}
+
+func newTestClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, commonName string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert
+}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The CoAP endpoint (RFC 7252) lets constrained devices publish with a single UDP datagram, instead of a TCP, TLS and
+// HTTP stack. A POST or PUT to the path /<topic> publishes the payload as the message. Title, priority and tags
+// can be set with the compact custom options below, or with Uri-Query options (e.g. "t=Title" or "p=4"), which are
+// interpreted just like HTTP query parameters. Like gRPC and MQTT, every request is turned into an internal HTTP
+// request, so access control and rate limiting work exactly like they do for HTTP.
+
+const (
+	coapVersion = 1
+
+	coapTypeConfirmable    = 0
+	coapTypeNonConfirmable = 1
+	coapTypeAcknowledgment = 2
+	coapTypeReset          = 3
+
+	coapCodeEmpty = 0x00
+	coapCodePost  = 0x02 // 0.02
+	coapCodePut   = 0x03 // 0.03
+
+	coapOptionURIHost       = 3
+	coapOptionURIPort       = 7
+	coapOptionURIPath       = 11
+	coapOptionContentFormat = 12
+	coapOptionURIQuery      = 15
+	coapOptionSize1         = 60
+
+	// Custom options in the experimental range; all of them are elective (even), so that other servers ignore them
+	coapOptionTitle         = 65000 // UTF-8 string
+	coapOptionPriority      = 65002 // uint, 1-5
+	coapOptionTags          = 65004 // UTF-8 string, repeatable, one tag per option
+	coapOptionAuthorization = 65006 // Same as the HTTP Authorization header, e.g. "Bearer tk_..."
+
+	coapPayloadMarker     = 0xff
+	coapDatagramMaxBytes  = 64 * 1024
+	coapExchangeLifetime  = 247 * time.Second // Duplicate CON requests are answered from the cache for this long
+	coapExchangeCacheSize = 10000
+)
+
+var (
+	errCoAPMessageInvalid = errors.New("invalid CoAP message")
+)
+
+// runCoAPServer starts the CoAP endpoint on coap-listen
+func (s *Server) runCoAPServer() error {
+	conn, err := net.ListenPacket("udp", s.config.CoAPListen)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.coapConn = conn
+	s.mu.Unlock()
+	return s.serveCoAP(conn)
+}
+
+// serveCoAP handles the datagrams one by one. Publishing is fast enough for that, and it keeps the exchange cache
+// free of locking.
+func (s *Server) serveCoAP(conn net.PacketConn) error {
+	exchanges := newCoAPExchangeCache()
+	buf := make([]byte, coapDatagramMaxBytes)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		req, err := parseCoAPMessage(buf[:n])
+		if err != nil {
+			continue // Silently ignored, as required by the spec
+		}
+		key := fmt.Sprintf("%s/%d", addr.String(), req.id)
+		response, ok := exchanges.get(key)
+		if !ok {
+			response = s.handleCoAP(req, addr).bytes()
+			if req.typ == coapTypeConfirmable {
+				exchanges.add(key, response)
+			}
+		}
+		if response != nil {
+			if _, err := conn.WriteTo(response, addr); err != nil {
+				log.Printf("[%s] CoAP: Unable to send response: %s", addr.String(), err.Error())
+			}
+		}
+	}
+}
+
+// handleCoAP handles a single request, and returns the response. Confirmable requests are answered with a
+// piggybacked acknowledgment, non-confirmable requests with a non-confirmable response.
+func (s *Server) handleCoAP(req *coapMessage, addr net.Addr) *coapMessage {
+	if req.typ == coapTypeAcknowledgment || req.typ == coapTypeReset {
+		return nil
+	} else if req.code == coapCodeEmpty {
+		return &coapMessage{typ: coapTypeReset, id: req.id} // CoAP ping
+	}
+	response := &coapMessage{typ: coapTypeAcknowledgment, id: req.id, token: req.token}
+	if req.typ == coapTypeNonConfirmable {
+		response.typ = coapTypeNonConfirmable
+		response.id = req.id + 1 // Any ID will do, responses are matched by token
+	}
+	if req.code != coapCodePost && req.code != coapCodePut {
+		response.code = coapCode(4, 5) // Method Not Allowed
+		return response
+	}
+	r, err := s.newCoAPRequest(req, addr)
+	if err != nil {
+		response.code = coapCode(4, 2) // Bad Option
+		response.payload = []byte(err.Error())
+		return response
+	}
+	w := newInternalResponseWriter(nil)
+	s.handle(w, r)
+	if w.code == http.StatusOK || w.code == http.StatusAccepted {
+		var m message
+		if err := json.Unmarshal(w.buf.Bytes(), &m); err != nil {
+			response.code = coapCode(5, 0)
+			return response
+		}
+		response.code = coapCode(2, 1)  // Created
+		response.payload = []byte(m.ID) // Compact, the ID is all a sensor might need (e.g. to delete the message)
+		return response
+	}
+	response.code = coapCodeFromHTTP(w.code)
+	var httpErr errHTTP
+	if err := json.Unmarshal(w.buf.Bytes(), &httpErr); err == nil {
+		response.payload = []byte(httpErr.Message) // Diagnostic payload
+	}
+	return response
+}
+
+// newCoAPRequest creates the internal HTTP request for a publish request. Unknown critical options are rejected,
+// unknown elective options are ignored, as required by the spec.
+func (s *Server) newCoAPRequest(req *coapMessage, addr net.Addr) (*http.Request, error) {
+	var path []string
+	var tags []string
+	query := url.Values{}
+	headers := http.Header{}
+	for _, option := range req.options {
+		switch option.number {
+		case coapOptionURIPath:
+			path = append(path, url.PathEscape(string(option.value)))
+		case coapOptionURIQuery:
+			parts := strings.SplitN(string(option.value), "=", 2)
+			if len(parts) == 2 {
+				query.Add(parts[0], parts[1])
+			} else {
+				query.Add(parts[0], "")
+			}
+		case coapOptionTitle:
+			headers.Set("Title", string(option.value))
+		case coapOptionPriority:
+			headers.Set("Priority", strconv.FormatUint(coapOptionUint(option.value), 10))
+		case coapOptionTags:
+			tags = append(tags, string(option.value))
+		case coapOptionAuthorization:
+			headers.Set("Authorization", string(option.value))
+		case coapOptionURIHost, coapOptionURIPort, coapOptionContentFormat, coapOptionSize1:
+			// Ignored
+		default:
+			if option.number%2 == 1 {
+				return nil, fmt.Errorf("unsupported critical option %d", option.number)
+			}
+		}
+	}
+	if len(tags) > 0 {
+		headers.Set("Tags", strings.Join(tags, ","))
+	}
+	u := fmt.Sprintf("%s/%s", s.config.BaseURL, strings.Join(path, "/"))
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	r, err := http.NewRequest(http.MethodPut, u, strings.NewReader(string(req.payload)))
+	if err != nil {
+		return nil, err
+	}
+	r.Header = headers
+	r.RemoteAddr = addr.String() // Rate limiting is done based on the (unverified!) address of the datagram
+	return r, nil
+}
+
+type coapMessage struct {
+	typ     byte
+	code    byte
+	id      uint16
+	token   []byte
+	options []*coapOption
+	payload []byte
+}
+
+type coapOption struct {
+	number int
+	value  []byte
+}
+
+func parseCoAPMessage(b []byte) (*coapMessage, error) {
+	if len(b) < 4 || b[0]>>6 != coapVersion {
+		return nil, errCoAPMessageInvalid
+	}
+	tokenLength := int(b[0] & 0x0f)
+	if tokenLength > 8 || len(b) < 4+tokenLength {
+		return nil, errCoAPMessageInvalid
+	}
+	m := &coapMessage{
+		typ:   (b[0] >> 4) & 0x03,
+		code:  b[1],
+		id:    binary.BigEndian.Uint16(b[2:4]),
+		token: append([]byte{}, b[4:4+tokenLength]...),
+	}
+	b = b[4+tokenLength:]
+	number := 0
+	for len(b) > 0 {
+		if b[0] == coapPayloadMarker {
+			if len(b) == 1 {
+				return nil, errCoAPMessageInvalid // Marker must be followed by a payload
+			}
+			m.payload = append([]byte{}, b[1:]...)
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0x0f)
+		b = b[1:]
+		var err error
+		if delta, b, err = readCoAPOptionNibble(delta, b); err != nil {
+			return nil, err
+		} else if length, b, err = readCoAPOptionNibble(length, b); err != nil {
+			return nil, err
+		} else if len(b) < length {
+			return nil, errCoAPMessageInvalid
+		}
+		number += delta
+		m.options = append(m.options, &coapOption{number: number, value: append([]byte{}, b[:length]...)})
+		b = b[length:]
+	}
+	return m, nil
+}
+
+func readCoAPOptionNibble(nibble int, b []byte) (int, []byte, error) {
+	switch nibble {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errCoAPMessageInvalid
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errCoAPMessageInvalid
+		}
+		return int(binary.BigEndian.Uint16(b[:2])) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errCoAPMessageInvalid
+	}
+	return nibble, b, nil
+}
+
+// bytes encodes the message. Options must be sorted by number, and are sorted here if they aren't.
+func (m *coapMessage) bytes() []byte {
+	if m == nil {
+		return nil
+	}
+	b := []byte{coapVersion<<6 | m.typ<<4 | byte(len(m.token)), m.code, byte(m.id >> 8), byte(m.id)}
+	b = append(b, m.token...)
+	sort.SliceStable(m.options, func(i, j int) bool { return m.options[i].number < m.options[j].number })
+	number := 0
+	for _, option := range m.options {
+		delta, length := option.number-number, len(option.value)
+		deltaNibble, deltaExt := encodeCoAPOptionNibble(delta)
+		lengthNibble, lengthExt := encodeCoAPOptionNibble(length)
+		b = append(b, byte(deltaNibble<<4|lengthNibble))
+		b = append(b, deltaExt...)
+		b = append(b, lengthExt...)
+		b = append(b, option.value...)
+		number = option.number
+	}
+	if len(m.payload) > 0 {
+		b = append(b, coapPayloadMarker)
+		b = append(b, m.payload...)
+	}
+	return b
+}
+
+func encodeCoAPOptionNibble(v int) (int, []byte) {
+	if v < 13 {
+		return v, nil
+	} else if v < 269 {
+		return 13, []byte{byte(v - 13)}
+	}
+	return 14, []byte{byte((v - 269) >> 8), byte(v - 269)}
+}
+
+// coapOptionUint decodes a uint option value, which is big-endian with leading zero bytes removed
+func coapOptionUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func coapCode(class, detail byte) byte {
+	return class<<5 | detail
+}
+
+func coapCodeFromHTTP(code int) byte {
+	switch code {
+	case http.StatusBadRequest:
+		return coapCode(4, 0)
+	case http.StatusUnauthorized:
+		return coapCode(4, 1)
+	case http.StatusForbidden:
+		return coapCode(4, 3)
+	case http.StatusNotFound:
+		return coapCode(4, 4)
+	case http.StatusMethodNotAllowed:
+		return coapCode(4, 5)
+	case http.StatusRequestEntityTooLarge:
+		return coapCode(4, 13)
+	case http.StatusTooManyRequests:
+		return coapCode(4, 29) // RFC 8516
+	case http.StatusServiceUnavailable:
+		return coapCode(5, 3)
+	}
+	return coapCode(5, 0)
+}
+
+// coapExchangeCache remembers the responses to confirmable requests, so that retransmitted requests (the response
+// got lost) are not published twice
+type coapExchangeCache struct {
+	responses map[string]*coapExchange
+}
+
+type coapExchange struct {
+	response []byte
+	expires  time.Time
+}
+
+func newCoAPExchangeCache() *coapExchangeCache {
+	return &coapExchangeCache{responses: make(map[string]*coapExchange)}
+}
+
+func (c *coapExchangeCache) get(key string) ([]byte, bool) {
+	exchange, ok := c.responses[key]
+	if !ok || time.Now().After(exchange.expires) {
+		return nil, false
+	}
+	return exchange.response, true
+}
+
+func (c *coapExchangeCache) add(key string, response []byte) {
+	if len(c.responses) >= coapExchangeCacheSize {
+		for k, exchange := range c.responses {
+			if time.Now().After(exchange.expires) {
+				delete(c.responses, k)
+			}
+		}
+	}
+	if len(c.responses) < coapExchangeCacheSize {
+		c.responses[key] = &coapExchange{response: response, expires: time.Now().Add(coapExchangeLifetime)}
+	}
+}
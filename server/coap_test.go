@@ -0,0 +1,143 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_CoAP_Publish(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	conn := newTestCoAPConn(t, s)
+
+	response := coapRoundTrip(t, conn, &coapMessage{
+		typ:   coapTypeConfirmable,
+		code:  coapCodePost,
+		id:    1234,
+		token: []byte{0xab, 0xcd},
+		options: []*coapOption{
+			{number: coapOptionURIPath, value: []byte("sensors")},
+			{number: coapOptionTitle, value: []byte("Basement")},
+			{number: coapOptionPriority, value: []byte{5}},
+			{number: coapOptionTags, value: []byte("droplet")},
+			{number: coapOptionTags, value: []byte("warning")},
+		},
+		payload: []byte("Water detected"),
+	})
+	require.Equal(t, byte(coapTypeAcknowledgment), response.typ)
+	require.Equal(t, coapCode(2, 1), response.code)
+	require.Equal(t, uint16(1234), response.id)
+	require.Equal(t, []byte{0xab, 0xcd}, response.token)
+
+	messages := toMessages(t, request(t, s, "GET", "/sensors/json?poll=1", "", nil).Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, string(response.payload), messages[0].ID)
+	require.Equal(t, "Water detected", messages[0].Message)
+	require.Equal(t, "Basement", messages[0].Title)
+	require.Equal(t, 5, messages[0].Priority)
+	require.Equal(t, []string{"droplet", "warning"}, messages[0].Tags)
+}
+
+func TestServer_CoAP_Publish_QueryAndRetransmission(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	conn := newTestCoAPConn(t, s)
+
+	req := &coapMessage{
+		typ:  coapTypeConfirmable,
+		code: coapCodePut,
+		id:   7,
+		options: []*coapOption{
+			{number: coapOptionURIPath, value: []byte("sensors")},
+			{number: coapOptionURIQuery, value: []byte("t=Battery low")},
+		},
+		payload: []byte("Sensor 3 at 5%"),
+	}
+	first := coapRoundTrip(t, conn, req)
+	require.Equal(t, coapCode(2, 1), first.code)
+	second := coapRoundTrip(t, conn, req) // Same message ID, e.g. because the ACK got lost
+	require.Equal(t, first.payload, second.payload)
+
+	messages := toMessages(t, request(t, s, "GET", "/sensors/json?poll=1", "", nil).Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, "Battery low", messages[0].Title)
+}
+
+func TestServer_CoAP_Errors(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "sensors", true, true))
+	conn := newTestCoAPConn(t, s)
+	path := &coapOption{number: coapOptionURIPath, value: []byte("sensors")}
+
+	response := coapRoundTrip(t, conn, &coapMessage{typ: coapTypeNonConfirmable, code: coapCodePost, id: 1, token: []byte{1}, options: []*coapOption{path}, payload: []byte("anonymous")})
+	require.Equal(t, byte(coapTypeNonConfirmable), response.typ)
+	require.Equal(t, coapCode(4, 3), response.code)
+	require.Equal(t, []byte{1}, response.token)
+
+	authorization := &coapOption{number: coapOptionAuthorization, value: []byte(basicAuth("phil:phil"))}
+	response = coapRoundTrip(t, conn, &coapMessage{typ: coapTypeConfirmable, code: coapCodePost, id: 2, options: []*coapOption{path, authorization}, payload: []byte("authenticated")})
+	require.Equal(t, coapCode(2, 1), response.code)
+
+	response = coapRoundTrip(t, conn, &coapMessage{typ: coapTypeConfirmable, code: 0x01, id: 3, options: []*coapOption{path}}) // GET
+	require.Equal(t, coapCode(4, 5), response.code)
+
+	response = coapRoundTrip(t, conn, &coapMessage{typ: coapTypeConfirmable, code: coapCodePost, id: 4, options: []*coapOption{path, {number: 65001}}})
+	require.Equal(t, coapCode(4, 2), response.code)
+
+	response = coapRoundTrip(t, conn, &coapMessage{typ: coapTypeConfirmable, code: coapCodeEmpty, id: 5}) // Ping
+	require.Equal(t, byte(coapTypeReset), response.typ)
+}
+
+func TestCoAPMessage_Encoding(t *testing.T) {
+	m := &coapMessage{
+		typ:   coapTypeConfirmable,
+		code:  coapCodePost,
+		id:    0xbeef,
+		token: []byte{1, 2, 3},
+		options: []*coapOption{
+			{number: coapOptionTags, value: []byte("a")},
+			{number: coapOptionURIPath, value: []byte("mytopic")},
+			{number: coapOptionTitle, value: []byte("this title is longer than thirteen bytes")},
+		},
+		payload: []byte("hi"),
+	}
+	parsed, err := parseCoAPMessage(m.bytes())
+	require.Nil(t, err)
+	require.Equal(t, m, parsed)
+
+	_, err = parseCoAPMessage([]byte{0x40, 0x02, 0x00})
+	require.Equal(t, errCoAPMessageInvalid, err)
+	_, err = parseCoAPMessage([]byte{0x40, 0x02, 0x00, 0x01, 0xff}) // Payload marker without payload
+	require.Equal(t, errCoAPMessageInvalid, err)
+}
+
+func newTestCoAPConn(t *testing.T, s *Server) net.Conn {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go s.serveCoAP(listener)
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func coapRoundTrip(t *testing.T, conn net.Conn, req *coapMessage) *coapMessage {
+	_, err := conn.Write(req.bytes())
+	require.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, coapDatagramMaxBytes)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	response, err := parseCoAPMessage(buf[:n])
+	require.Nil(t, err)
+	return response
+}
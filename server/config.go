@@ -1,6 +1,8 @@
 package server
 
 import (
+	"heckel.io/ntfy/util"
+	"regexp"
 	"time"
 )
 
@@ -9,11 +11,70 @@ const (
 	DefaultListenHTTP                = ":80"
 	DefaultCacheDuration             = 12 * time.Hour
 	DefaultKeepaliveInterval         = 45 * time.Second // Not too frequently to save battery (Android read timeout used to be 77s!)
+	DefaultStreamCompressionLevel    = 1                // Fastest, notifications are small and compress well anyway
 	DefaultManagerInterval           = time.Minute
 	DefaultAtSenderInterval          = 10 * time.Second
 	DefaultMinDelay                  = 10 * time.Second
 	DefaultMaxDelay                  = 3 * 24 * time.Hour
+	DefaultDedupWindow               = time.Hour
 	DefaultFirebaseKeepaliveInterval = 3 * time.Hour // Not too frequently to save battery
+	DefaultSMTPSenderRetryMaxAge     = 12 * time.Hour
+	DefaultSMTPServerMaxRecipients   = 10
+	DefaultMQTTTopicPrefix           = "ntfy/"
+	DefaultAuditLogMaxSize           = 10 * 1024 * 1024 // 10 MB
+	DefaultAuditLogMaxBackups        = 5
+)
+
+// DefaultSMTPServerPriorityMapping maps the values of the "X-Priority", "Priority" and "Importance" headers
+// of incoming e-mails to message priorities
+const DefaultSMTPServerPriorityMapping = "1=urgent,2=high,3=default,4=low,5=min,high=urgent,normal=default,low=low,urgent=urgent,non-urgent=low"
+
+// DefaultSyslogPriorityMapping maps the severities of incoming syslog messages to message priorities. Debug
+// messages are not in the mapping, so they are dropped.
+const DefaultSyslogPriorityMapping = "emerg=urgent,alert=urgent,crit=urgent,err=high,warning=default,notice=default,info=low"
+
+// Defines where messages are cached, see cache-engine
+const (
+	CacheEngineSQLite   = "sqlite"   // SQLite file (cache-file), or in-memory if no file is set
+	CacheEnginePostgres = "postgres" // PostgreSQL database (cache-dsn)
+	CacheEngineRedis    = "redis"    // Redis server (cache-dsn)
+)
+
+// Defines where users and access control entries are stored, see auth-backend
+const (
+	AuthBackendSQLite   = "sqlite"   // SQLite auth database (auth-file), managed with "ntfy user" and "ntfy access"
+	AuthBackendPostgres = "postgres" // PostgreSQL auth database (auth-dsn), managed like the SQLite database
+	AuthBackendLDAP     = "ldap"     // LDAP directory (auth-ldap-url), with access control entries for groups
+	AuthBackendOIDC     = "oidc"     // Tokens of an OpenID Connect provider (auth-oidc-issuer), with access control entries for groups
+)
+
+// Defines how outgoing e-mails are sent, either via SMTP or via the HTTP API of a mail provider
+const (
+	SMTPSenderProviderSMTP     = "smtp"     // SMTP server (smtp-sender-addr is host:port)
+	SMTPSenderProviderSES      = "ses"      // Amazon SES API (smtp-sender-addr is the AWS region)
+	SMTPSenderProviderMailgun  = "mailgun"  // Mailgun API (smtp-sender-addr is the sending domain)
+	SMTPSenderProviderSendGrid = "sendgrid" // SendGrid API (smtp-sender-addr is not used)
+)
+
+// Defines how SMS are sent, see newSMSSender
+const (
+	SMSProviderTwilio = "twilio" // Twilio Programmable Messaging (sms-user is the account SID, sms-pass the auth token)
+	SMSProviderVonage = "vonage" // Vonage SMS API (sms-user is the API key, sms-pass the API secret)
+)
+
+// Defines what happens to incoming e-mails that fail sender verification (SPF/DKIM)
+const (
+	SMTPServerVerifySenderOff    = "off"    // Sender is not verified
+	SMTPServerVerifySenderIgnore = "ignore" // Failures are only logged
+	SMTPServerVerifySenderTag    = "tag"    // Published without priority, and tagged as unverified
+	SMTPServerVerifySenderReject = "reject" // Rejected with an SMTP error
+)
+
+// Defines whether the first URL in the body of incoming e-mails is used as click action
+const (
+	SMTPServerClickURLOff   = "off"   // Body is published as is
+	SMTPServerClickURLKeep  = "keep"  // URL is used as click action, and kept in the body
+	SMTPServerClickURLStrip = "strip" // URL is used as click action, and removed from the body
 )
 
 // Defines all global and per-visitor limits
@@ -32,6 +93,8 @@ const (
 // - per visitor subscription limit: max number of subscriptions (active HTTP connections) per per-visitor/IP
 // - per visitor request limit: max number of PUT/GET/.. requests (here: 60 requests bucket, replenished at a rate of one per 5 seconds)
 // - per visitor email limit: max number of emails (here: 16 email bucket, replenished at a rate of one per hour)
+// - per visitor SMS limit: max number of SMS per day, including verification codes
+// - per visitor call limit: max number of phone calls per day, including verification calls
 // - per visitor attachment size limit: total per-visitor attachment size in bytes to be stored on the server
 // - per visitor attachment daily bandwidth limit: number of bytes that can be transferred to/from the server
 const (
@@ -40,25 +103,124 @@ const (
 	DefaultVisitorRequestLimitReplenish         = 5 * time.Second
 	DefaultVisitorEmailLimitBurst               = 16
 	DefaultVisitorEmailLimitReplenish           = time.Hour
+	DefaultVisitorSMSDailyLimit                 = 10
+	DefaultVisitorCallDailyLimit                = 2
 	DefaultVisitorAttachmentTotalSizeLimit      = 100 * 1024 * 1024 // 100 MB
 	DefaultVisitorAttachmentDailyBandwidthLimit = 500 * 1024 * 1024 // 500 MB
 )
 
+// Defines the per-topic limits for incoming e-mails (SMTP server)
+// - topic limit: max number of e-mails per topic (here: 60 email bucket, replenished at a rate of one per 10 seconds)
+const (
+	DefaultSMTPServerTopicLimitBurst     = 60
+	DefaultSMTPServerTopicLimitReplenish = 10 * time.Second
+)
+
+// SMTPServerTopicRule maps incoming e-mail addresses that match Pattern to a topic. The topic template may
+// reference capture groups of the pattern, e.g. "datacenter-$1" (see regexp.Regexp.Expand).
+type SMTPServerTopicRule struct {
+	Pattern *regexp.Regexp
+	Topic   string
+}
+
+// SyslogTopicRule maps the tags of incoming syslog messages that match Pattern to a topic, just like
+// SMTPServerTopicRule does for e-mail addresses
+type SyslogTopicRule struct {
+	Pattern *regexp.Regexp
+	Topic   string
+}
+
 // Config is the main config struct for the application. Use New to instantiate a default config struct.
 type Config struct {
 	BaseURL                              string
 	ListenHTTP                           string
 	ListenHTTPS                          string
 	ListenUnix                           string
+	ListenGRPC                           string // ip:port of the gRPC listener, see Server.runGRPCServer
+	MQTTListen                           string // ip:port of the MQTT listener, see Server.runMQTTServer
+	MQTTTopicPrefix                      string // MQTT topics are this prefix followed by the ntfy topic
+	CoAPListen                           string // ip:port of the CoAP endpoint (UDP), see Server.runCoAPServer
+	SyslogListen                         string // ip:port of the syslog receiver (UDP and TCP), see Server.runSyslogServer
+	SyslogListenTLS                      string // ip:port of the syslog receiver with TLS (RFC 5425), using KeyFile and CertFile
+	SyslogTopicRules                     []*SyslogTopicRule
+	SyslogDefaultTopic                   string         // Topic of syslog messages that match no rule; if empty, they are dropped
+	SyslogPriorityMapping                map[string]int // Priorities by severity name; messages with other severities are dropped
+	SyslogToken                          string         // Access token that syslog messages are published with, if the topics are protected
+	SNMPTrapListen                       string         // ip:port of the SNMP trap receiver (UDP), see Server.runSNMPTrapServer
+	SNMPTrapTopic                        string
+	SNMPTrapCommunities                  []string // If set, traps with other community strings are dropped
+	SNMPTrapOIDMapFiles                  []string // Friendly names (and priorities) of OIDs, see loadSNMPOIDMap
+	SNMPTrapToken                        string   // Access token that traps are published with, if the topic is protected
 	KeyFile                              string
 	CertFile                             string
+	ClientCertCAFile                     string // CA certificates for client certificates on the HTTPS listener, see clientTLSConfig
+	ClientCertUsername                   string // Field of the client certificate with the username, see clientCertUsername
 	FirebaseKeyFile                      string
+	FirebaseProjects                     map[string]string // Key files of additional Firebase projects, by topic prefix, see createFirebaseSubscriber
+	APNSKeyFile                          string            // Token signing key (.p8) of the Apple developer account, see createAPNSClient
+	APNSKeyID                            string
+	APNSTeamID                           string
+	APNSTopic                            string // Bundle ID of the iOS app
+	APNSSandbox                          bool   // Use the APNs development environment, for debug builds of the app
+	MatrixHomeserver                     string // Base URL of the homeserver of the Matrix bridge's bot account, see matrixBridge
+	MatrixAccessToken                    string
+	MatrixRooms                          map[string]string // Bridged topic, by Matrix room ID
+	MatrixNtfyToken                      string            // Access token that the bridge publishes with, if the topics are protected
+	TelegramBotToken                     string
+	TelegramChats                        map[string][]string // Telegram chat IDs that messages are forwarded to, by topic, see forwardTelegram
+	SMSProvider                          string              // Empty if SMS notifications are disabled, see newSMSSender
+	SMSUser                              string
+	SMSPass                              string
+	SMSFrom                              string // Phone number (E.164) or alphanumeric sender ID
+	EnableCalls                          bool   // Places phone calls via the SMS provider (only Twilio), see newPhoneCaller
+	CacheEngine                          string
 	CacheFile                            string
+	CacheDSN                             string
+	CacheBatchSize                       int
+	CacheBatchTimeout                    time.Duration
 	CacheDuration                        time.Duration
+	CacheDurationTopics                  map[string]time.Duration // Per-topic retention, overrides CacheDuration
+	CacheEncryptionKeyFile               string                   // File with the base64-encoded AES-256 key for the SQL cache
+	AuthBackend                          string
 	AuthFile                             string
+	AuthDSN                              string // PostgreSQL connection string, if AuthBackend is postgres
 	AuthDefaultRead                      bool
 	AuthDefaultWrite                     bool
+	AuthReservationsLimit                int      // Topics a user without tier can reserve, see handleUserReservationAdd
+	AuthLDAPURL                          string   // ldap:// or ldaps:// URL of the directory, if AuthBackend is ldap
+	AuthLDAPBindDN                       string   // Service account used to look up users
+	AuthLDAPBindPassword                 string   // Password of the service account
+	AuthLDAPUserBaseDN                   string   // Users are searched below this DN
+	AuthLDAPUserFilter                   string   // Filter to find a user, with %s as placeholder for the username
+	AuthLDAPGroupAttribute               string   // Attribute of the user entry that lists the groups
+	AuthLDAPAdminGroup                   string   // Members of this group are admins
+	AuthLDAPGroupAccess                  []string // Access control entries for groups, see auth.LDAPConfig
+	AuthOIDCIssuer                       string   // Issuer URL of the OpenID Connect provider, if AuthBackend is oidc
+	AuthOIDCClientID                     string   // Tokens must be issued to this client
+	AuthOIDCClientSecret                 string   // Client secret for the web app login flow, may be empty
+	AuthOIDCScopes                       []string // Scopes requested in the web app login flow
+	AuthOIDCUsernameClaim                string   // Claim with the username
+	AuthOIDCGroupsClaim                  string   // Claim with the list of groups
+	AuthOIDCAdminGroup                   string   // Members of this group are admins
+	AuthOIDCGroupAccess                  []string // Access control entries for groups, see auth.OIDCConfig
+	AuthProxyHeader                      string   // Header with the username, set by an authenticating reverse proxy, see authProxy
+	AuthProxySecret                      string   // Shared secret the proxy sends in the X-Proxy-Secret header
+	AuthProxyTrustedHosts                []string // IP addresses or CIDR ranges of the proxy
+	SignupInviteCodes                    []string // Invite codes for self-service sign-ups, optionally with a tier ("code:tier"), see handleAccountAdd
+	SignupDefaultTier                    string   // Tier of users who signed up with an invite code without a tier
+	PublishURLSecrets                    []string // Secrets for pre-signed publish URLs, see publishURLSigner
+	WebhookTemplateDir                   string   // Directory with webhook templates (<name>.tmpl), see webhookTemplate
+	WebhookTemplateTopics                []string // Webhook template used for all messages published to a topic, format: <topic>=<template>
+	AuditLogFile                         string   // JSON lines file for authentication and access control events, see auditLog
+	AuditLogMaxSize                      int64    // Size in bytes after which the audit log is rotated
+	AuditLogMaxBackups                   int      // Number of rotated audit logs to keep
 	AttachmentCacheDir                   string
+	AttachmentS3URL                      string   // Store attachments in an S3 bucket instead, see newS3Cache
+	AttachmentScanClamdAddr              string   // Unix socket path or host:port of clamd, see clamdScanner
+	AttachmentScanCommand                string   // Scan with an external command instead, see commandScanner
+	AttachmentURLSigningKeyFile          string   // File with the base64-encoded HMAC key, see fileURLSigner
+	AttachmentURLRequireRead             bool     // Downloads require read access to the topic, if auth is enabled
+	AttachmentAllowedTypes               []string // Mime types (e.g. image/*) of uploads, see attachmentTypeAllowed; all if empty
 	AttachmentTotalSizeLimit             int64
 	AttachmentFileSizeLimit              int64
 	AttachmentExpiryDuration             time.Duration
@@ -67,45 +229,154 @@ type Config struct {
 	WebRootIsApp                         bool
 	AtSenderInterval                     time.Duration
 	FirebaseKeepaliveInterval            time.Duration
+	SMTPSenderProvider                   string
 	SMTPSenderAddr                       string
 	SMTPSenderUser                       string
 	SMTPSenderPass                       string
 	SMTPSenderFrom                       string
+	SMTPSenderTemplateFile               string
+	SMTPSenderDKIMSelector               string
+	SMTPSenderDKIMKeyFile                string
+	SMTPSenderRetryMaxAge                time.Duration
 	SMTPServerListen                     string
+	SMTPServerListenLMTP                 string
 	SMTPServerDomain                     string
 	SMTPServerAddrPrefix                 string
+	SMTPServerPriorityMapping            map[string]int
+	SMTPServerTopicRules                 []*SMTPServerTopicRule
+	SMTPServerAllowedSenders             []*regexp.Regexp
+	SMTPServerDeniedSenders              []*regexp.Regexp
+	SMTPServerCheckAccess                bool
+	SMTPServerVerifySender               string
+	SMTPServerClickURL                   string
+	SMTPServerMaxRecipients              int
+	SMTPServerTLSCertFile                string
+	SMTPServerTLSKeyFile                 string
+	SMTPServerProxyProtocol              bool
+	SMTPServerTopicLimitBurst            int
+	SMTPServerTopicLimitReplenish        time.Duration
 	MessageLimit                         int
 	MinDelay                             time.Duration
 	MaxDelay                             time.Duration
+	DedupWindow                          time.Duration // Window in which a dedup key returns the original message
 	TotalTopicLimit                      int
 	TotalAttachmentSizeLimit             int64
+	TotalAttachmentDownloadRateLimit     int // Bytes per second for all attachment downloads, 0 means unlimited
 	VisitorSubscriptionLimit             int
 	VisitorAttachmentTotalSizeLimit      int64
 	VisitorAttachmentDailyBandwidthLimit int
+	VisitorAttachmentDownloadRateLimit   int // Bytes per second for attachment downloads per visitor, 0 means unlimited
 	VisitorRequestLimitBurst             int
 	VisitorRequestLimitReplenish         time.Duration
 	VisitorRequestExemptIPAddrs          []string
 	VisitorEmailLimitBurst               int
 	VisitorEmailLimitReplenish           time.Duration
+	VisitorMessageDailyLimit             int // Messages per day per visitor, 0 means unlimited; may be raised by a user's tier
+	VisitorSMSDailyLimit                 int // SMS per day per visitor, 0 means none; may be raised by a user's tier
+	VisitorCallDailyLimit                int // Phone calls per day per visitor, 0 means none; may be raised by a user's tier
 	BehindProxy                          bool
+	EnableMetrics                        bool
+	EnableGRPCWeb                        bool // Serves the gRPC API as gRPC-Web on the HTTP listeners, see Server.handleGRPCWeb
+	EnableWebSocketCompression           bool // Negotiates permessage-deflate on /ws, see Server.handleSubscribeWS
+	EnableSSECompression                 bool // Compresses /sse with gzip, if the client accepts it, see gzipStreamWriter
+	StreamCompressionLevel               int  // Of the WebSocket and SSE compression, 1 (fastest) to 9 (smallest)
+	ReadOnly                             bool // Starts the server in read-only mode, see Server.rejectReadOnly
 }
 
 // NewConfig instantiates a default new server config
 func NewConfig() *Config {
+	smtpServerPriorityMapping, _ := util.ParsePriorityMapping(DefaultSMTPServerPriorityMapping)
+	syslogPriorityMapping, _ := util.ParsePriorityMapping(DefaultSyslogPriorityMapping)
 	return &Config{
 		BaseURL:                              "",
 		ListenHTTP:                           DefaultListenHTTP,
 		ListenHTTPS:                          "",
 		ListenUnix:                           "",
+		ListenGRPC:                           "",
+		MQTTListen:                           "",
+		MQTTTopicPrefix:                      DefaultMQTTTopicPrefix,
+		CoAPListen:                           "",
+		SyslogListen:                         "",
+		SyslogListenTLS:                      "",
+		SyslogTopicRules:                     make([]*SyslogTopicRule, 0),
+		SyslogDefaultTopic:                   "",
+		SyslogPriorityMapping:                syslogPriorityMapping,
+		SyslogToken:                          "",
+		SNMPTrapListen:                       "",
+		SNMPTrapTopic:                        "",
+		SNMPTrapCommunities:                  make([]string, 0),
+		SNMPTrapOIDMapFiles:                  make([]string, 0),
+		SNMPTrapToken:                        "",
 		KeyFile:                              "",
 		CertFile:                             "",
+		ClientCertCAFile:                     "",
+		ClientCertUsername:                   ClientCertUsernameCN,
 		FirebaseKeyFile:                      "",
+		FirebaseProjects:                     make(map[string]string),
+		APNSKeyFile:                          "",
+		APNSKeyID:                            "",
+		APNSTeamID:                           "",
+		APNSTopic:                            "",
+		APNSSandbox:                          false,
+		MatrixHomeserver:                     "",
+		MatrixAccessToken:                    "",
+		MatrixRooms:                          make(map[string]string),
+		MatrixNtfyToken:                      "",
+		TelegramBotToken:                     "",
+		TelegramChats:                        make(map[string][]string),
+		SMSProvider:                          "",
+		SMSUser:                              "",
+		SMSPass:                              "",
+		SMSFrom:                              "",
+		EnableCalls:                          false,
+		CacheEngine:                          CacheEngineSQLite,
 		CacheFile:                            "",
+		CacheDSN:                             "",
+		CacheBatchSize:                       0,
+		CacheBatchTimeout:                    0,
 		CacheDuration:                        DefaultCacheDuration,
+		CacheDurationTopics:                  make(map[string]time.Duration),
+		CacheEncryptionKeyFile:               "",
+		AuthBackend:                          AuthBackendSQLite,
 		AuthFile:                             "",
+		AuthDSN:                              "",
 		AuthDefaultRead:                      true,
 		AuthDefaultWrite:                     true,
+		AuthReservationsLimit:                0,
+		AuthLDAPURL:                          "",
+		AuthLDAPBindDN:                       "",
+		AuthLDAPBindPassword:                 "",
+		AuthLDAPUserBaseDN:                   "",
+		AuthLDAPUserFilter:                   "",
+		AuthLDAPGroupAttribute:               "",
+		AuthLDAPAdminGroup:                   "",
+		AuthLDAPGroupAccess:                  make([]string, 0),
+		AuthOIDCIssuer:                       "",
+		AuthOIDCClientID:                     "",
+		AuthOIDCClientSecret:                 "",
+		AuthOIDCScopes:                       make([]string, 0),
+		AuthOIDCUsernameClaim:                "",
+		AuthOIDCGroupsClaim:                  "",
+		AuthOIDCAdminGroup:                   "",
+		AuthOIDCGroupAccess:                  make([]string, 0),
+		AuthProxyHeader:                      "",
+		AuthProxySecret:                      "",
+		AuthProxyTrustedHosts:                make([]string, 0),
+		SignupInviteCodes:                    make([]string, 0),
+		SignupDefaultTier:                    "",
+		PublishURLSecrets:                    make([]string, 0),
+		WebhookTemplateDir:                   "",
+		WebhookTemplateTopics:                make([]string, 0),
+		AuditLogFile:                         "",
+		AuditLogMaxSize:                      DefaultAuditLogMaxSize,
+		AuditLogMaxBackups:                   DefaultAuditLogMaxBackups,
 		AttachmentCacheDir:                   "",
+		AttachmentS3URL:                      "",
+		AttachmentScanClamdAddr:              "",
+		AttachmentScanCommand:                "",
+		AttachmentURLSigningKeyFile:          "",
+		AttachmentURLRequireRead:             false,
+		AttachmentAllowedTypes:               make([]string, 0),
 		AttachmentTotalSizeLimit:             DefaultAttachmentTotalSizeLimit,
 		AttachmentFileSizeLimit:              DefaultAttachmentFileSizeLimit,
 		AttachmentExpiryDuration:             DefaultAttachmentExpiryDuration,
@@ -114,7 +385,16 @@ func NewConfig() *Config {
 		MessageLimit:                         DefaultMessageLengthLimit,
 		MinDelay:                             DefaultMinDelay,
 		MaxDelay:                             DefaultMaxDelay,
+		DedupWindow:                          DefaultDedupWindow,
 		AtSenderInterval:                     DefaultAtSenderInterval,
+		SMTPServerPriorityMapping:            smtpServerPriorityMapping,
+		SMTPServerVerifySender:               SMTPServerVerifySenderOff,
+		SMTPSenderProvider:                   SMTPSenderProviderSMTP,
+		SMTPSenderRetryMaxAge:                DefaultSMTPSenderRetryMaxAge,
+		SMTPServerClickURL:                   SMTPServerClickURLOff,
+		SMTPServerMaxRecipients:              DefaultSMTPServerMaxRecipients,
+		SMTPServerTopicLimitBurst:            DefaultSMTPServerTopicLimitBurst,
+		SMTPServerTopicLimitReplenish:        DefaultSMTPServerTopicLimitReplenish,
 		FirebaseKeepaliveInterval:            DefaultFirebaseKeepaliveInterval,
 		TotalTopicLimit:                      DefaultTotalTopicLimit,
 		VisitorSubscriptionLimit:             DefaultVisitorSubscriptionLimit,
@@ -125,6 +405,15 @@ func NewConfig() *Config {
 		VisitorRequestExemptIPAddrs:          make([]string, 0),
 		VisitorEmailLimitBurst:               DefaultVisitorEmailLimitBurst,
 		VisitorEmailLimitReplenish:           DefaultVisitorEmailLimitReplenish,
+		VisitorMessageDailyLimit:             0,
+		VisitorSMSDailyLimit:                 DefaultVisitorSMSDailyLimit,
+		VisitorCallDailyLimit:                DefaultVisitorCallDailyLimit,
 		BehindProxy:                          false,
+		EnableMetrics:                        false,
+		EnableGRPCWeb:                        false,
+		EnableWebSocketCompression:           false,
+		EnableSSECompression:                 false,
+		StreamCompressionLevel:               DefaultStreamCompressionLevel,
+		ReadOnly:                             false,
 	}
 }
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	zstdMaxWindowSize = 8 << 20 // Enough for all compression levels, unless --long is used; bounds memory per request
+)
+
+// acceptsGzip returns true if the Accept-Encoding header of the request contains gzip (and not with q=0)
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(value, ";")
+		if strings.ToLower(strings.TrimSpace(parts[0])) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") && strings.Trim(q[2:], "0.") == "" {
+				return false // q=0, q=0.0, q=0.000, ...
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipStreamWriter compresses a streaming response, see enable-sse-compression. Every flush also flushes the
+// compressor, so that messages are delivered right away, at the cost of a slightly worse compression ratio. The
+// compressor (and the Content-Encoding header) is only set up on the first write, so that errors that are
+// returned before anything is written are sent uncompressed, like all other errors.
+type gzipStreamWriter struct {
+	w     http.ResponseWriter
+	level int
+	gz    *gzip.Writer
+}
+
+func newGzipStreamWriter(w http.ResponseWriter, level int) *gzipStreamWriter {
+	return &gzipStreamWriter{w: w, level: level}
+}
+
+func (w *gzipStreamWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+func (w *gzipStreamWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		w.start()
+	}
+	w.w.WriteHeader(code)
+}
+
+func (w *gzipStreamWriter) Write(p []byte) (int, error) {
+	w.start()
+	return w.gz.Write(p)
+}
+
+func (w *gzipStreamWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if fl, ok := w.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Close writes the gzip footer, if anything was written
+func (w *gzipStreamWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+func (w *gzipStreamWriter) start() {
+	if w.gz != nil {
+		return
+	}
+	w.w.Header().Set("Content-Encoding", "gzip")
+	w.w.Header().Add("Vary", "Accept-Encoding")
+	w.w.Header().Del("Content-Length")
+	gz, err := gzip.NewWriterLevel(w.w, w.level)
+	if err != nil {
+		gz = gzip.NewWriter(w.w) // Invalid level, cannot happen, since stream-compression-level is validated
+	}
+	w.gz = gz
+}
+
+// decompressBody transparently decompresses publish requests with a Content-Encoding: gzip or zstd header, so
+// that all following handlers see the plain body. The decompressed body is subject to the same limits as an
+// uncompressed one, since handlePublish only peeks up to the message limit, and attachments are limited by size.
+func (s *Server) decompressBody(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		switch encoding {
+		case "", "identity":
+			return next(w, r, v)
+		case "gzip", "x-gzip":
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				return errHTTPBadRequestContentEncodingInvalid
+			}
+			defer reader.Close()
+			r.Body = &decompressedBody{Reader: reader, body: r.Body}
+		case "zstd":
+			reader, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindowSize))
+			if err != nil {
+				return errHTTPBadRequestContentEncodingInvalid
+			}
+			defer reader.Close()
+			r.Body = &decompressedBody{Reader: reader, body: r.Body}
+		default:
+			return errHTTPBadRequestContentEncodingInvalid
+		}
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		return next(w, r, v)
+	}
+}
+
+// decompressedBody reads from the decompressor, and closes the original request body
+type decompressedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (b *decompressedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer_PublishGzip(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", gzipString(t, "Backup done"), map[string]string{"Content-Encoding": "gzip"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "Backup done", toMessage(t, response.Body.String()).Message)
+
+	response = request(t, s, "POST", "/", gzipString(t, `{"topic":"mytopic","message":"Disk full","priority":4}`), map[string]string{"Content-Encoding": "gzip"})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Disk full", m.Message)
+	require.Equal(t, 4, m.Priority)
+}
+
+func TestServer_PublishZstd(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	encoder, err := zstd.NewWriter(nil)
+	require.Nil(t, err)
+	body := string(encoder.EncodeAll([]byte("Backup done"), nil))
+	response := request(t, s, "PUT", "/mytopic", body, map[string]string{"Content-Encoding": "zstd"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "Backup done", toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_PublishContentEncodingInvalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "Backup done", map[string]string{"Content-Encoding": "br"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40051, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/mytopic", "not gzip", map[string]string{"Content-Encoding": "gzip"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40051, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/mytopic", "Backup done", map[string]string{"Content-Encoding": "identity"})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_SubscribeSSECompression(t *testing.T) {
+	c := newTestConfig(t)
+	c.EnableSSECompression = true
+	s := newTestServer(t, c)
+	request(t, s, "PUT", "/mytopic", "Backup done", nil)
+
+	response := request(t, s, "GET", "/mytopic/sse?poll=1", "", map[string]string{"Accept-Encoding": "br, gzip;q=0.8"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "gzip", response.Header().Get("Content-Encoding"))
+	reader, err := gzip.NewReader(response.Body)
+	require.Nil(t, err)
+	body, err := io.ReadAll(reader)
+	require.Nil(t, err)
+	require.Equal(t, "Backup done", toMessage(t, strings.TrimPrefix(strings.TrimSpace(string(body)), "data: ")).Message)
+
+	for _, acceptEncoding := range []string{"", "br", "gzip;q=0"} {
+		response = request(t, s, "GET", "/mytopic/sse?poll=1", "", map[string]string{"Accept-Encoding": acceptEncoding})
+		require.Equal(t, "", response.Header().Get("Content-Encoding"))
+		require.Equal(t, "Backup done", toMessage(t, strings.TrimPrefix(strings.TrimSpace(response.Body.String()), "data: ")).Message)
+	}
+
+	response = request(t, s, "GET", "/mytopic/sse?poll=1&since=invalid", "", map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, "", response.Header().Get("Content-Encoding")) // Errors are never compressed
+	require.Equal(t, 40008, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_SubscribeSSECompressionDisabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	request(t, s, "PUT", "/mytopic", "Backup done", nil)
+	response := request(t, s, "GET", "/mytopic/sse?poll=1", "", map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, "", response.Header().Get("Content-Encoding"))
+	require.Contains(t, response.Body.String(), "Backup done")
+}
+
+func TestServer_SubscribeWebSocketCompression(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		c := newTestConfig(t)
+		c.EnableWebSocketCompression = enabled
+		s := newTestServer(t, c)
+		server := httptest.NewServer(http.HandlerFunc(s.handle))
+		dialer := &websocket.Dialer{EnableCompression: true}
+		conn, response, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/mytopic/ws", nil)
+		require.Nil(t, err)
+		require.Equal(t, enabled, strings.Contains(response.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"))
+
+		_, data, err := conn.ReadMessage()
+		require.Nil(t, err)
+		require.Equal(t, openEvent, toMessage(t, string(data)).Event)
+		message := strings.Repeat("Backup done, ", 100) + "all good"
+		request(t, s, "PUT", "/mytopic", message, nil)
+		_, data, err = conn.ReadMessage()
+		require.Nil(t, err)
+		require.Equal(t, message, toMessage(t, string(data)).Message)
+		conn.Close()
+		server.Close()
+	}
+}
+
+func gzipString(t *testing.T, s string) string {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write([]byte(s))
+	require.Nil(t, err)
+	require.Nil(t, writer.Close())
+	return buf.String()
+}
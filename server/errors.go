@@ -50,15 +50,84 @@ var (
 	errHTTPBadRequestWebSocketsUpgradeHeaderMissing  = &errHTTP{40016, http.StatusBadRequest, "invalid request: client not using the websocket protocol", "https://ntfy.sh/docs/subscribe/api/#websockets"}
 	errHTTPBadRequestJSONInvalid                     = &errHTTP{40017, http.StatusBadRequest, "invalid request: request body must be message JSON", "https://ntfy.sh/docs/publish/#publish-as-json"}
 	errHTTPBadRequestActionsInvalid                  = &errHTTP{40018, http.StatusBadRequest, "invalid request: actions invalid", "https://ntfy.sh/docs/publish/#action-buttons"}
+	errHTTPBadRequestGroupInvalid                    = &errHTTP{40019, http.StatusBadRequest, "invalid request: group too long", "https://ntfy.sh/docs/publish/#message-groups"}
+	errHTTPBadRequestEmailDigestInvalid              = &errHTTP{40020, http.StatusBadRequest, "invalid request: e-mail digest window invalid, or no e-mail address set", "https://ntfy.sh/docs/publish/#e-mail-digests"}
+	errHTTPBadRequestSearchQueryInvalid              = &errHTTP{40021, http.StatusBadRequest, "invalid request: search query is empty", "https://ntfy.sh/docs/subscribe/api/#search-cached-messages"}
+	errHTTPBadRequestImportInvalid                   = &errHTTP{40022, http.StatusBadRequest, "invalid request: body must be cached messages as JSON lines, as exported", "https://ntfy.sh/docs/config/#exporting-and-importing-messages"}
+	errHTTPBadRequestImportCacheDisabled             = &errHTTP{40023, http.StatusBadRequest, "invalid request: cannot import messages if the message cache is disabled", "https://ntfy.sh/docs/config/#message-cache"}
+	errHTTPBadRequestLimitInvalid                    = &errHTTP{40024, http.StatusBadRequest, "invalid request: limit must be a positive number, and can only be used when polling, without since=<id> or scheduled", "https://ntfy.sh/docs/subscribe/api/#paginate-through-cached-messages"}
+	errHTTPBadRequestUpdateInvalid                   = &errHTTP{40025, http.StatusBadRequest, "invalid request: title, message or priority must be passed to update a message", "https://ntfy.sh/docs/publish/#updating-messages"}
+	errHTTPBadRequestExpiresInvalid                  = &errHTTP{40026, http.StatusBadRequest, "invalid expires parameter: unable to parse expiry, or expiry before delivery date", "https://ntfy.sh/docs/publish/#message-expiry"}
+	errHTTPBadRequestDedupKeyInvalid                 = &errHTTP{40027, http.StatusBadRequest, "invalid request: dedup key too long", "https://ntfy.sh/docs/publish/#deduplication"}
+	errHTTPBadRequestDedupKeyNoCache                 = &errHTTP{40028, http.StatusBadRequest, "cannot disable cache for message with dedup key", "https://ntfy.sh/docs/publish/#deduplication"}
+	errHTTPBadRequestSearchEncrypted                 = &errHTTP{40029, http.StatusBadRequest, "invalid request: search is not available, because the message cache is encrypted", "https://ntfy.sh/docs/config/#cache-encryption"}
+	errHTTPBadRequestAttachmentInfected              = &errHTTP{40030, http.StatusBadRequest, "invalid request: attachment rejected by virus scanner", "https://ntfy.sh/docs/config/#virus-scanning"}
+	errHTTPBadRequestOIDCStateInvalid                = &errHTTP{40031, http.StatusBadRequest, "invalid request: login expired or invalid, please try again", "https://ntfy.sh/docs/config/#openid-connect-oidc"}
+	errHTTPBadRequestTokenInvalid                    = &errHTTP{40032, http.StatusBadRequest, "invalid request: token request must include topics, a permission (read-write, read-only or write-only) and an optional future expiry", "https://ntfy.sh/docs/config/#access-tokens"}
+	errHTTPBadRequestUserInvalid                     = &errHTTP{40033, http.StatusBadRequest, "invalid request: username, password or role invalid", "https://ntfy.sh/docs/config/#user-management-api"}
+	errHTTPBadRequestAccessInvalid                   = &errHTTP{40034, http.StatusBadRequest, "invalid request: topic or permission invalid", "https://ntfy.sh/docs/config/#user-management-api"}
+	errHTTPBadRequestReservationInvalid              = &errHTTP{40035, http.StatusBadRequest, "invalid request: topic name or access for everyone (deny, read-only, write-only or read-write) invalid", "https://ntfy.sh/docs/config/#topic-reservations"}
+	errHTTPBadRequestTOTPInvalid                     = &errHTTP{40036, http.StatusBadRequest, "invalid request: two-factor authentication code invalid", "https://ntfy.sh/docs/config/#two-factor-authentication"}
+	errHTTPBadRequestSignupInvalid                   = &errHTTP{40037, http.StatusBadRequest, "invalid request: sign-up requires a valid username, password and e-mail address", "https://ntfy.sh/docs/config/#self-service-sign-up"}
+	errHTTPBadRequestSignupTokenInvalid              = &errHTTP{40038, http.StatusBadRequest, "invalid request: e-mail verification link invalid or expired", "https://ntfy.sh/docs/config/#self-service-sign-up"}
+	errHTTPBadRequestWebhookInvalid                  = &errHTTP{40039, http.StatusBadRequest, "invalid request: request body must be a valid JSON webhook payload, and alerting webhooks must contain at least one alert", "https://ntfy.sh/docs/publish/#webhooks"}
+	errHTTPBadRequestTemplateInvalid                 = &errHTTP{40040, http.StatusBadRequest, "invalid request: unknown webhook template, must be alertmanager, grafana, yes, or a template defined by the server", "https://ntfy.sh/docs/publish/#webhooks"}
+	errHTTPBadRequestTemplateFailed                  = &errHTTP{40041, http.StatusBadRequest, "invalid request: webhook template could not be parsed or executed", "https://ntfy.sh/docs/publish/#webhook-templates"}
+	errHTTPBadRequestBatchInvalid                    = &errHTTP{40042, http.StatusBadRequest, "invalid request: batch must contain 1-100 messages no longer than the message limit, without e-mail or attachment uploads", "https://ntfy.sh/docs/publish/#batch-publishing"}
+	errHTTPBadRequestRecurringInvalid                = &errHTTP{40043, http.StatusBadRequest, "invalid request: recurring message requires a valid cron expression and time zone, and a message no longer than the message limit", "https://ntfy.sh/docs/publish/#recurring-messages"}
+	errHTTPBadRequestTopicInfoInvalid                = &errHTTP{40044, http.StatusBadRequest, "invalid request: display name must be at most 64 characters, description at most 1024 characters, and icon must be an HTTP(S) URL", "https://ntfy.sh/docs/publish/#topic-metadata"}
+	errHTTPBadRequestInReplyToInvalid                = &errHTTP{40045, http.StatusBadRequest, "invalid request: in-reply-to must be a message ID", "https://ntfy.sh/docs/publish/#message-threads"}
+	errHTTPBadRequestTopicDefaultsInvalid            = &errHTTP{40046, http.StatusBadRequest, "invalid request: priority must be between 1 and 5, and at most 10 tags without commas are allowed", "https://ntfy.sh/docs/publish/#topic-defaults"}
+	errHTTPBadRequestEscalationInvalid               = &errHTTP{40047, http.StatusBadRequest, "invalid request: escalation steps invalid", "https://ntfy.sh/docs/publish/#escalations"}
+	errHTTPBadRequestQuietHoursInvalid               = &errHTTP{40048, http.StatusBadRequest, "invalid request: quiet hours must be given as HH:MM-HH:MM, with a valid time zone and priority", "https://ntfy.sh/docs/subscribe/api/#quiet-hours"}
+	errHTTPBadRequestCollapseKeyInvalid              = &errHTTP{40049, http.StatusBadRequest, "invalid request: collapse key too long", "https://ntfy.sh/docs/publish/#collapse-keys"}
+	errHTTPBadRequestTopicWildcardNotAllowed         = &errHTTP{40050, http.StatusBadRequest, "invalid request: wildcard subscriptions require access control to be enabled", "https://ntfy.sh/docs/subscribe/api/#wildcard-subscriptions"}
+	errHTTPBadRequestContentEncodingInvalid          = &errHTTP{40051, http.StatusBadRequest, "invalid request: unsupported or invalid Content-Encoding, only gzip and zstd are supported", "https://ntfy.sh/docs/publish/#compressed-requests"}
+	errHTTPBadRequestTopicWebhooksInvalid            = &errHTTP{40052, http.StatusBadRequest, "invalid request: webhooks invalid", "https://ntfy.sh/docs/publish/#outgoing-webhooks"}
+	errHTTPBadRequestHeartbeatInvalid                = &errHTTP{40053, http.StatusBadRequest, "invalid request: heartbeat invalid", "https://ntfy.sh/docs/publish/#heartbeats"}
+	errHTTPBadRequestModerationAuthRequired          = &errHTTP{40054, http.StatusBadRequest, "invalid request: moderation requires access control to be enabled", "https://ntfy.sh/docs/publish/#moderated-topics"}
+	errHTTPBadRequestGRPCWebInvalid                  = &errHTTP{40055, http.StatusBadRequest, "invalid request: malformed gRPC-Web request", "https://ntfy.sh/docs/subscribe/grpc/#grpc-web"}
+	errHTTPBadRequestAPNSTokenInvalid                = &errHTTP{40056, http.StatusBadRequest, "invalid request: APNs device token must be hex-encoded", "https://ntfy.sh/docs/config/#ios-push-notifications-via-apns"}
+	errHTTPBadRequestTelegramChatInvalid             = &errHTTP{40057, http.StatusBadRequest, "invalid request: Telegram chat ID must be numeric, or a @username of a channel", "https://ntfy.sh/docs/config/#telegram-forwarding"}
+	errHTTPBadRequestSMSDisabled                     = &errHTTP{40058, http.StatusBadRequest, "invalid request: SMS notifications are not enabled on this server", "https://ntfy.sh/docs/config/#sms-notifications"}
+	errHTTPBadRequestSMSInvalid                      = &errHTTP{40059, http.StatusBadRequest, "invalid request: SMS invalid", "https://ntfy.sh/docs/publish/#sms-notifications"}
+	errHTTPBadRequestPhoneNumberInvalid              = &errHTTP{40060, http.StatusBadRequest, "invalid request: phone number must be in E.164 format, e.g. +12025550123", "https://ntfy.sh/docs/publish/#sms-notifications"}
+	errHTTPBadRequestPhoneVerificationInvalid        = &errHTTP{40061, http.StatusBadRequest, "invalid request: verification code invalid or expired", "https://ntfy.sh/docs/publish/#sms-notifications"}
+	errHTTPBadRequestCallDisabled                    = &errHTTP{40062, http.StatusBadRequest, "invalid request: phone calls are not enabled on this server", "https://ntfy.sh/docs/config/#phone-calls"}
+	errHTTPBadRequestCallInvalid                     = &errHTTP{40063, http.StatusBadRequest, "invalid request: phone call invalid", "https://ntfy.sh/docs/publish/#phone-calls"}
+	errHTTPBadRequestProtobufInvalid                 = &errHTTP{40064, http.StatusBadRequest, "invalid request: request body must be a protobuf PublishRequest", "https://ntfy.sh/docs/publish/#publish-as-protobuf-or-cbor"}
+	errHTTPBadRequestCBORInvalid                     = &errHTTP{40065, http.StatusBadRequest, "invalid request: request body must be message CBOR", "https://ntfy.sh/docs/publish/#publish-as-protobuf-or-cbor"}
 	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", ""}
+	errHTTPNotFoundMessage                           = &errHTTP{40402, http.StatusNotFound, "message not found", "https://ntfy.sh/docs/publish/#deleting-messages"}
+	errHTTPNotFoundScheduledMessage                  = &errHTTP{40403, http.StatusNotFound, "scheduled message not found, or already delivered", "https://ntfy.sh/docs/publish/#cancelling-scheduled-messages"}
+	errHTTPNotFoundToken                             = &errHTTP{40404, http.StatusNotFound, "access token not found", "https://ntfy.sh/docs/config/#access-tokens"}
+	errHTTPNotFoundUser                              = &errHTTP{40405, http.StatusNotFound, "user not found", "https://ntfy.sh/docs/config/#user-management-api"}
+	errHTTPNotFoundReservation                       = &errHTTP{40406, http.StatusNotFound, "topic reservation not found", "https://ntfy.sh/docs/config/#topic-reservations"}
+	errHTTPNotFoundTOTPEnrollment                    = &errHTTP{40407, http.StatusNotFound, "two-factor authentication enrollment not found, please enroll first", "https://ntfy.sh/docs/config/#two-factor-authentication"}
+	errHTTPNotFoundRecurringMessage                  = &errHTTP{40408, http.StatusNotFound, "recurring message not found", "https://ntfy.sh/docs/publish/#recurring-messages"}
 	errHTTPUnauthorized                              = &errHTTP{40101, http.StatusUnauthorized, "unauthorized", "https://ntfy.sh/docs/publish/#authentication"}
+	errHTTPUnauthorizedTOTPRequired                  = &errHTTP{40102, http.StatusUnauthorized, "unauthorized: two-factor authentication code missing or invalid", "https://ntfy.sh/docs/config/#two-factor-authentication"}
 	errHTTPForbidden                                 = &errHTTP{40301, http.StatusForbidden, "forbidden", "https://ntfy.sh/docs/publish/#authentication"}
+	errHTTPForbiddenAttachmentURLInvalid             = &errHTTP{40302, http.StatusForbidden, "forbidden: attachment URL signature invalid or expired", "https://ntfy.sh/docs/config/#signed-attachment-urls"}
+	errHTTPForbiddenPublishURLInvalid                = &errHTTP{40303, http.StatusForbidden, "forbidden: publish URL signature invalid or expired", "https://ntfy.sh/docs/config/#pre-signed-publish-urls"}
+	errHTTPForbiddenPublishIP                        = &errHTTP{40304, http.StatusForbidden, "forbidden: publishing to this topic is not allowed from your IP address", "https://ntfy.sh/docs/config/#topic-reservations"}
+	errHTTPForbiddenInviteCodeInvalid                = &errHTTP{40305, http.StatusForbidden, "forbidden: invite code invalid", "https://ntfy.sh/docs/config/#self-service-sign-up"}
+	errHTTPConflictUserExists                        = &errHTTP{40901, http.StatusConflict, "user already exists", "https://ntfy.sh/docs/config/#user-management-api"}
+	errHTTPConflictTopicReserved                     = &errHTTP{40902, http.StatusConflict, "topic is reserved by another user, or its access is managed by an admin", "https://ntfy.sh/docs/config/#topic-reservations"}
 	errHTTPEntityTooLargeAttachmentTooLarge          = &errHTTP{41301, http.StatusRequestEntityTooLarge, "attachment too large, or bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations"}
+	errHTTPUnsupportedMediaTypeAttachment            = &errHTTP{41501, http.StatusUnsupportedMediaType, "attachment type not allowed", "https://ntfy.sh/docs/config/#attachment-types"}
 	errHTTPTooManyRequestsLimitRequests              = &errHTTP{42901, http.StatusTooManyRequests, "limit reached: too many requests, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsLimitEmails                = &errHTTP{42902, http.StatusTooManyRequests, "limit reached: too many emails, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsLimitSubscriptions         = &errHTTP{42903, http.StatusTooManyRequests, "limit reached: too many active subscriptions, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsLimitTotalTopics           = &errHTTP{42904, http.StatusTooManyRequests, "limit reached: the total number of topics on the server has been reached, please contact the admin", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsAttachmentBandwidthLimit   = &errHTTP{42905, http.StatusTooManyRequests, "too many requests: daily bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations"}
+	errHTTPTooManyRequestsLimitReservations          = &errHTTP{42906, http.StatusTooManyRequests, "limit reached: too many reserved topics, please release a topic first", "https://ntfy.sh/docs/config/#topic-reservations"}
+	errHTTPTooManyRequestsLimitMessages              = &errHTTP{42907, http.StatusTooManyRequests, "limit reached: too many messages today, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
+	errHTTPTooManyRequestsLimitRecurringMessages     = &errHTTP{42908, http.StatusTooManyRequests, "limit reached: too many recurring messages for this topic, please delete one first", "https://ntfy.sh/docs/publish/#recurring-messages"}
+	errHTTPTooManyRequestsLimitHeldMessages          = &errHTTP{42909, http.StatusTooManyRequests, "limit reached: too many messages waiting for moderation in this topic", "https://ntfy.sh/docs/publish/#moderated-topics"}
+	errHTTPTooManyRequestsLimitSMS                   = &errHTTP{42910, http.StatusTooManyRequests, "limit reached: too many SMS today, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
+	errHTTPTooManyRequestsLimitCalls                 = &errHTTP{42911, http.StatusTooManyRequests, "limit reached: too many phone calls today, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", ""}
 	errHTTPInternalErrorInvalidFilePath              = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid file path", ""}
+	errHTTPServiceUnavailableReadOnly                = &errHTTP{50301, http.StatusServiceUnavailable, "service unavailable: the server is in read-only mode for maintenance, please try again later", "https://ntfy.sh/docs/config/#read-only-mode"}
 )
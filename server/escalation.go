@@ -0,0 +1,302 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/ntfy/auth"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	escalationStepsMax = 5
+	escalationMinAfter = time.Minute
+	escalationMaxAfter = 24 * time.Hour
+	escalationPriority = 5 // Only messages with max priority are escalated
+)
+
+var (
+	escalationPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/escalation$`)
+)
+
+// handleTopicEscalation returns the escalation chain of a topic, e.g. {"topic":"alerts","steps":[{"after":"10m","topic":"oncall"}]}
+func (s *Server) handleTopicEscalation(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden // The steps may contain e-mail addresses, so only owners may see them
+	}
+	e, err := s.messageCache.TopicEscalation(t.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, e)
+}
+
+// handleTopicEscalationUpdate replaces the escalation chain of a topic. Only owners of the topic may do this (the route
+// only exists if access control is enabled). In addition, they need write access to the topics that messages are
+// republished to, the e-mail permission for e-mail steps, and verified phone numbers for call steps. Passing no steps removes the escalation chain.
+func (s *Server) handleTopicEscalationUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	var e topicEscalation
+	if err := json.NewDecoder(io.LimitReader(r.Body, 2*apiRequestMaxBytes)).Decode(&e); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	e.Topic = t.ID
+	if e.Steps == nil {
+		e.Steps = make([]*escalationStep, 0)
+	}
+	if err := s.validateEscalationSteps(r, t.ID, e.Steps); err != nil {
+		return err
+	}
+	if len(e.Steps) == 0 {
+		err = s.messageCache.DeleteTopicEscalation(t.ID)
+	} else {
+		err = s.messageCache.UpdateTopicEscalation(&e)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Updated escalation chain of topic %s (%d step(s))", v.ip, t.ID, len(e.Steps))
+	return writeJSON(w, &e)
+}
+
+// validateEscalationSteps checks that the steps are in order, and that the user may publish to their targets
+func (s *Server) validateEscalationSteps(r *http.Request, topic string, steps []*escalationStep) error {
+	if len(steps) > escalationStepsMax {
+		return wrapErrHTTP(errHTTPBadRequestEscalationInvalid, "at most %d steps are allowed", escalationStepsMax)
+	}
+	var last time.Duration
+	for _, step := range steps {
+		step.Email = strings.TrimSpace(step.Email)
+		step.Call = strings.TrimSpace(step.Call)
+		step.User = "" // Set by the server only, see below
+		if step.Email != "" || step.Call != "" {
+			if user := userFromRequest(r); user != nil {
+				step.User = user.Name // Their permissions and limits apply when the step is performed
+			}
+		}
+		after, err := time.ParseDuration(step.After)
+		if err != nil || after < escalationMinAfter || after > escalationMaxAfter || after <= last {
+			return wrapErrHTTP(errHTTPBadRequestEscalationInvalid, "after must be between %s and %s, and increase with every step",
+				escalationMinAfter, escalationMaxAfter)
+		}
+		last = after
+		if step.Topic == "" && step.Email == "" && step.Call == "" {
+			return wrapErrHTTP(errHTTPBadRequestEscalationInvalid, "every step needs a topic, an e-mail address or a phone number")
+		} else if step.Topic != "" && (!topicRegex.MatchString(step.Topic) || step.Topic == topic) {
+			return wrapErrHTTP(errHTTPBadRequestEscalationInvalid, "invalid topic %s", step.Topic)
+		}
+		if step.Topic != "" {
+			if err := s.authorizeTopics(r, auth.PermissionWrite, step.Topic); err != nil {
+				return err
+			}
+		}
+		if step.Email != "" {
+			if s.mailer == nil {
+				return errHTTPBadRequestEmailDisabled
+			} else if err := s.authorizeTopics(r, auth.PermissionEmail, topic); err != nil {
+				return err
+			}
+		}
+		if step.Call != "" {
+			if s.caller == nil {
+				return errHTTPBadRequestCallDisabled
+			} else if !phoneNumberRegex.MatchString(step.Call) {
+				return errHTTPBadRequestPhoneNumberInvalid
+			} else if err := s.checkVerifiedPhoneNumber(userFromRequest(r), step.Call, errHTTPBadRequestEscalationInvalid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scheduleEscalation starts the escalation chain of a newly published message, if the message has max priority and
+// its topic has escalation steps. Messages that were republished by an escalation are not escalated again, so that
+// two topics escalating to each other don't cause an endless loop.
+func (s *Server) scheduleEscalation(m *message) error {
+	if m.Priority != escalationPriority {
+		return nil
+	}
+	e, err := s.messageCache.TopicEscalation(m.Topic)
+	if err != nil {
+		return err
+	} else if len(e.Steps) == 0 {
+		return nil
+	}
+	after, err := time.ParseDuration(e.Steps[0].After)
+	if err != nil {
+		return err
+	}
+	return s.messageCache.UpdateEscalation(&escalation{
+		Topic:     m.Topic,
+		MessageID: m.ID,
+		Due:       time.Unix(m.Time, 0).Add(after).Unix(),
+	})
+}
+
+// sendEscalations performs the next step of all escalations that are due, see escalate
+func (s *Server) sendEscalations() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	escalations, err := s.messageCache.EscalationsDue()
+	if err != nil {
+		return err
+	}
+	for _, e := range escalations {
+		if err := s.escalate(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escalate performs the next step of the escalation chain of a message, unless the message (or one of the messages
+// it was republished as) was acknowledged, or deleted in the meantime. Must be called with s.mu held.
+func (s *Server) escalate(e *escalation) error {
+	m, err := s.messageCache.Message(e.Topic, e.MessageID)
+	if err == errMessageNotFound {
+		return s.messageCache.DeleteEscalation(e.Topic, e.MessageID)
+	} else if err != nil {
+		return err
+	}
+	acked, err := s.escalationAcked(e)
+	if err != nil {
+		return err
+	}
+	chain, err := s.messageCache.TopicEscalation(e.Topic)
+	if err != nil {
+		return err
+	} else if acked || e.Step >= len(chain.Steps) { // Steps may have been removed in the meantime
+		return s.messageCache.DeleteEscalation(e.Topic, e.MessageID)
+	}
+	step := chain.Steps[e.Step]
+	if step.Topic != "" {
+		escalated := newEscalatedMessage(m, step.Topic)
+		if t, ok := s.topics[escalated.Topic]; ok {
+			if err := t.Publish(escalated); err != nil {
+				log.Printf("unable to publish escalated message %s to topic %s: %v", m.ID, escalated.Topic, err.Error())
+			}
+		}
+		s.publishFirehose(escalated)
+		go s.forwardWebhooks(escalated)
+		s.forwardMatrix(escalated)
+		go s.forwardTelegram(escalated)
+		if s.firebase != nil { // Not under s.mu, like in publish
+			go func() {
+				if err := s.firebase(escalated); err != nil {
+					log.Printf("unable to publish to Firebase: %v", err.Error())
+				}
+			}()
+		}
+		if err := s.messageCache.AddMessage(escalated); err != nil {
+			return err
+		}
+		s.messages++
+		e.Copies = append(e.Copies, escalated.Topic+"/"+escalated.ID)
+	}
+	if step.Email != "" && s.mailer != nil {
+		if err := s.escalationEmailAllowed(step, m); err != nil {
+			log.Printf("unable to send escalated message %s to %s: %v", m.ID, step.Email, err.Error())
+		} else {
+			go s.sendEmail(m.senderIP, step.Email, m)
+		}
+	}
+	if step.Call != "" && s.caller != nil {
+		if err := s.escalationCallAllowed(step, m); err != nil {
+			log.Printf("unable to call %s for escalated message %s: %v", step.Call, m.ID, err.Error())
+		} else {
+			go s.placeCall(m.senderIP, step.Call, m)
+		}
+	}
+	log.Printf("Escalated message %s of topic %s (step %d of %d)", m.ID, m.Topic, e.Step+1, len(chain.Steps))
+	e.Step++
+	if e.Step >= len(chain.Steps) {
+		return s.messageCache.DeleteEscalation(e.Topic, e.MessageID)
+	}
+	after, err := time.ParseDuration(chain.Steps[e.Step].After)
+	if err != nil {
+		return err
+	}
+	e.Due = time.Unix(m.Time, 0).Add(after).Unix()
+	return s.messageCache.UpdateEscalation(e)
+}
+
+// escalationEmailAllowed checks that the user who added an e-mail step may still forward the messages of the topic
+// via e-mail, and that the e-mail is within their daily limit. If their tier does not set one, the e-mail counts
+// towards the limit of the visitor who published the message, just like the e-mails of publish would.
+// Must be called with s.mu held.
+func (s *Server) escalationEmailAllowed(step *escalationStep, m *message) error {
+	user, err := s.escalationStepUser(step)
+	if err != nil {
+		return err
+	} else if err := s.auth.Authorize(user, m.Topic, auth.PermissionEmail); err != nil {
+		return errHTTPForbidden
+	}
+	return s.userEmailAllowed(user, s.visitorFromIP(m.senderIP))
+}
+
+// escalationCallAllowed checks that the phone number of a call step is still verified by the user who added the
+// step, and that the call is within their daily limit. Like for e-mail steps, the limit of the visitor who published
+// the message applies if their tier does not set one. Must be called with s.mu held.
+func (s *Server) escalationCallAllowed(step *escalationStep, m *message) error {
+	user, err := s.escalationStepUser(step)
+	if err != nil {
+		return err
+	} else if err := s.checkVerifiedPhoneNumber(user, step.Call, errHTTPBadRequestEscalationInvalid); err != nil {
+		return err
+	}
+	return s.userCallAllowed(user, s.visitorFromIP(m.senderIP))
+}
+
+// escalationStepUser returns the user who added an e-mail or call step, see validateEscalationSteps
+func (s *Server) escalationStepUser(step *escalationStep) (*auth.User, error) {
+	manager, ok := s.auth.(auth.Manager)
+	if !ok || step.User == "" {
+		return nil, errHTTPForbidden
+	}
+	return manager.User(step.User)
+}
+
+// escalationAcked returns true if the message or any of the messages it was republished as was acknowledged
+func (s *Server) escalationAcked(e *escalation) (bool, error) {
+	messages := append([]string{e.Topic + "/" + e.MessageID}, e.Copies...)
+	for _, topicAndID := range messages {
+		topic, id := topicAndID[:strings.Index(topicAndID, "/")], topicAndID[strings.Index(topicAndID, "/")+1:]
+		acks, err := s.messageCache.MessageAcks(topic, id)
+		if err != nil {
+			return false, err
+		} else if len(acks) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// newEscalatedMessage creates the copy of the message that is republished to another topic. Attachments are not
+// copied, since they belong to the original message.
+func newEscalatedMessage(m *message, topic string) *message {
+	escalated := newDefaultMessage(topic, m.Message)
+	escalated.Title = m.Title
+	escalated.Priority = m.Priority
+	escalated.Tags = m.Tags
+	escalated.Click = m.Click
+	escalated.Actions = m.Actions
+	escalated.Encoding = m.Encoding
+	escalated.AckRequired = true
+	escalated.senderIP = m.senderIP
+	escalated.senderUser = m.senderUser
+	return escalated
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_Escalation(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts", "oncall", "oncall-backup")
+	response := request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"10m","topic":"oncall"},{"after":"30m","topic":"oncall-backup"}]}`, phil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/alerts/escalation", "", phil)
+	chain := toTopicEscalation(t, response.Body.String())
+	require.Len(t, chain.Steps, 2)
+	require.Equal(t, "oncall-backup", chain.Steps[1].Topic)
+
+	request(t, s, "PUT", "/alerts", "Disk almost full", map[string]string{"Priority": "high", "Authorization": phil["Authorization"]}) // Not escalated
+	msg := toMessage(t, request(t, s, "PUT", "/alerts", "Disk full", map[string]string{"Priority": "urgent", "Title": "nas01", "Authorization": phil["Authorization"]}).Body.String())
+	require.Nil(t, s.sendEscalations())
+	response = request(t, s, "GET", "/oncall/json?poll=1", "", nil)
+	require.Empty(t, response.Body.String()) // Not due yet
+
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	response = request(t, s, "GET", "/oncall/json?poll=1", "", nil)
+	escalated := toMessage(t, response.Body.String())
+	require.Equal(t, "Disk full", escalated.Message)
+	require.Equal(t, "nas01", escalated.Title)
+	require.Equal(t, 5, escalated.Priority)
+	require.True(t, escalated.AckRequired)
+
+	// Acknowledging the republished message ends the escalation
+	response = request(t, s, "POST", "/oncall/"+escalated.ID+"/ack", "", nil)
+	require.Equal(t, 200, response.Code)
+	makeEscalationDue(t, s, msg, 1, "oncall/"+escalated.ID)
+	require.Nil(t, s.sendEscalations())
+	response = request(t, s, "GET", "/oncall-backup/json?poll=1", "", nil)
+	require.Empty(t, response.Body.String())
+	escalations, err := s.messageCache.EscalationsDue()
+	require.Nil(t, err)
+	require.Empty(t, escalations)
+
+	// Without acknowledgment, the next step is performed
+	msg = toMessage(t, request(t, s, "PUT", "/alerts", "Disk full again", map[string]string{"Priority": "urgent", "Authorization": phil["Authorization"]}).Body.String())
+	makeEscalationDue(t, s, msg, 1)
+	require.Nil(t, s.sendEscalations())
+	response = request(t, s, "GET", "/oncall-backup/json?poll=1", "", nil)
+	require.Equal(t, "Disk full again", toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_Escalation_Email(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts")
+	response := request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"5m","email":"oncall@example.com"}]}`, phil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40001, toHTTPError(t, response.Body.String()).Code) // E-mail not enabled
+
+	mailer := &testMailer{}
+	s.mailer = mailer
+	response = request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"5m","email":"oncall@example.com"}]}`, phil)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, request(t, s, "PUT", "/alerts", "Front door open", map[string]string{"Priority": "5", "Authorization": phil["Authorization"]}).Body.String())
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	for i := 0; i < 50 && mailer.Count() == 0; i++ {
+		time.Sleep(20 * time.Millisecond) // E-mails are sent asynchronously
+	}
+	require.Equal(t, 1, mailer.Count())
+
+	// Deleted messages are not escalated
+	msg = toMessage(t, request(t, s, "PUT", "/alerts", "Back door open", map[string]string{"Priority": "5", "Authorization": phil["Authorization"]}).Body.String())
+	request(t, s, "DELETE", "/alerts/"+msg.ID, "", phil)
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	require.Equal(t, 1, mailer.Count())
+}
+
+func TestServer_Escalation_EmailLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorEmailLimitBurst = 1
+	s, phil := newTestServerWithTopicOwner(t, c, "alerts")
+	mailer := &testMailer{}
+	s.mailer = mailer
+	response := request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"5m","email":"oncall@example.com","user":"ben"}]}`, phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "phil", toTopicEscalation(t, response.Body.String()).Steps[0].User)
+	msg := toMessage(t, request(t, s, "PUT", "/alerts", "Front door open", map[string]string{"Priority": "5", "Authorization": phil["Authorization"]}).Body.String())
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	require.Eventually(t, func() bool {
+		return mailer.Count() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The e-mail limit of the publisher applies
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, mailer.Count())
+
+	// So does the e-mail permission of the user who added the step
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddTier(&auth.Tier{Code: "pro", EmailsLimit: 10}))
+	require.Nil(t, manager.ChangeTier("phil", "pro"))
+	require.Nil(t, manager.AllowPermissions("phil", "alerts", auth.PermissionSubscribe|auth.PermissionPoll|auth.PermissionPublish))
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, mailer.Count())
+	require.Nil(t, manager.AllowAccess("phil", "alerts", true, true))
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	require.Eventually(t, func() bool {
+		return mailer.Count() == 2 // Within the limit of the tier
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServer_Escalation_Call(t *testing.T) {
+	c := newTestConfig(t)
+	c.SMSProvider = SMSProviderTwilio
+	c.EnableCalls = true
+	c.VisitorCallDailyLimit = 1
+	s, phil := newTestServerWithTopicOwner(t, c, "alerts")
+	sender := &testSMSSender{sent: make(chan *testSMS, 10)}
+	caller := &testPhoneCaller{calls: make(chan *testSMS, 10)}
+	s.sms, s.caller = sender, caller
+	response := request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"5m","call":"+12025550123"}]}`, phil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40047, toHTTPError(t, response.Body.String()).Code) // Not verified
+
+	verifyTestPhoneNumber(t, s, sender, "phil:phil", testPhoneNumber)
+	response = request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"5m","call":"+12025550123","user":"ben"}]}`, phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "phil", toTopicEscalation(t, response.Body.String()).Steps[0].User)
+	msg := toMessage(t, request(t, s, "PUT", "/alerts", "Front door open", map[string]string{"Priority": "5", "Title": "Home", "Authorization": phil["Authorization"]}).Body.String())
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	call := caller.read(t)
+	require.Equal(t, testPhoneNumber, call.to)
+	require.Equal(t, "You have an urgent notification on topic alerts. Home. Front door open", call.text)
+
+	// The call limit applies to escalations as well
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	select {
+	case <-caller.calls:
+		t.Fatal("unexpected phone call")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	s.caller = nil
+	response = request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"5m","call":"+12025550123"}]}`, phil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40062, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Escalation_Invalid(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts", "oncall")
+	for _, body := range []string{
+		`{"steps":[{"after":"30s","topic":"oncall"}]}`,
+		`{"steps":[{"after":"25h","topic":"oncall"}]}`,
+		`{"steps":[{"after":"10m","topic":"oncall"},{"after":"5m","topic":"manager"}]}`,
+		`{"steps":[{"after":"10m"}]}`,
+		`{"steps":[{"after":"10m","topic":"alerts"}]}`,
+		`{"steps":[{"after":"10m","topic":"on/call"}]}`,
+		`{"steps":[{"after":"1m","topic":"a"},{"after":"2m","topic":"b"},{"after":"3m","topic":"c"},{"after":"4m","topic":"d"},{"after":"5m","topic":"e"},{"after":"6m","topic":"f"}]}`,
+	} {
+		response := request(t, s, "PUT", "/alerts/escalation", body, phil)
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40047, toHTTPError(t, response.Body.String()).Code, body)
+	}
+}
+
+func TestServer_Escalation_TargetNotWritable(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "alerts", true, true))
+	require.Nil(t, manager.AllowAccess("phil", "oncall", true, true))
+	phil := map[string]string{"Authorization": basicAuth("phil:phil")}
+
+	response := request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"10m","topic":"boss"}]}`, phil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"10m","topic":"oncall"}]}`, phil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/alerts/escalation", `{"steps":[]}`, phil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/alerts/escalation", "", phil)
+	require.Empty(t, toTopicEscalation(t, response.Body.String()).Steps)
+}
+
+func TestServer_Escalation_OwnerOnly(t *testing.T) {
+	s, _ := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts", "oncall")
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "alerts", true, false))
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"10m","topic":"oncall"}]}`, ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"10m","topic":"oncall"}]}`, nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/alerts/escalation", "", ben)
+	require.Equal(t, 403, response.Code)
+
+	// Without access control, nobody owns a topic
+	s = newTestServer(t, newTestConfig(t))
+	response = request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"10m","topic":"oncall"}]}`, nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "GET", "/alerts/escalation", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_Escalation_FirebaseAsync(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts", "oncall")
+	release := make(chan bool)
+	defer close(release)
+	pushed := make(chan *message, 1)
+	s.firebase = func(m *message) error {
+		if m.Topic == "oncall" {
+			pushed <- m
+			<-release // A slow push must not block the escalations while holding the lock
+		}
+		return nil
+	}
+	response := request(t, s, "PUT", "/alerts/escalation", `{"steps":[{"after":"10m","topic":"oncall"}]}`, phil)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, request(t, s, "PUT", "/alerts", "Disk full", map[string]string{"Priority": "urgent", "Authorization": phil["Authorization"]}).Body.String())
+	makeEscalationDue(t, s, msg, 0)
+	require.Nil(t, s.sendEscalations())
+	require.Equal(t, "Disk full", (<-pushed).Message)
+	response = request(t, s, "PUT", "/alerts", "Disk still full", phil)
+	require.Equal(t, 200, response.Code)
+}
+
+func makeEscalationDue(t *testing.T, s *Server, m *message, step int, copies ...string) {
+	require.Nil(t, s.messageCache.UpdateEscalation(&escalation{
+		Topic:     m.Topic,
+		MessageID: m.ID,
+		Step:      step,
+		Due:       time.Now().Add(-time.Second).Unix(),
+		Copies:    copies,
+	}))
+}
+
+func toTopicEscalation(t *testing.T, s string) *topicEscalation {
+	var e topicEscalation
+	require.Nil(t, json.Unmarshal([]byte(s), &e))
+	return &e
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	feedMaxEntries     = 100 // Most recent messages included in a feed
+	feedTitleMaxLength = 80  // Entries without a title use the beginning of the message instead
+	atomNamespace      = "http://www.w3.org/2005/Atom"
+	jsonFeedVersion    = "https://jsonfeed.org/version/1.1"
+)
+
+var (
+	feedPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/feed(\.json)?$`)
+)
+
+// atomFeed is the Atom (RFC 4287) document returned by handleTopicFeed for /<topic>/feed
+type atomFeed struct {
+	XMLName  xml.Name     `xml:"feed"`
+	XMLNS    string       `xml:"xmlns,attr"`
+	ID       string       `xml:"id"`
+	Title    string       `xml:"title"`
+	Subtitle string       `xml:"subtitle,omitempty"`
+	Icon     string       `xml:"icon,omitempty"`
+	Updated  string       `xml:"updated"`
+	Links    []*atomLink  `xml:"link"`
+	Entries  []*atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID         string          `xml:"id"`
+	Title      string          `xml:"title"`
+	Updated    string          `xml:"updated"`
+	Published  string          `xml:"published"`
+	Content    *atomContent    `xml:"content,omitempty"`
+	Links      []*atomLink     `xml:"link"`
+	Categories []*atomCategory `xml:"category"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+// jsonFeed is the JSON Feed (https://jsonfeed.org/version/1.1) returned by handleTopicFeed for /<topic>/feed.json
+type jsonFeed struct {
+	Version     string          `json:"version"`
+	Title       string          `json:"title"`
+	Description string          `json:"description,omitempty"`
+	HomePageURL string          `json:"home_page_url"`
+	FeedURL     string          `json:"feed_url"`
+	Icon        string          `json:"icon,omitempty"`
+	Items       []*jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string                `json:"id"`
+	URL           string                `json:"url,omitempty"`
+	Title         string                `json:"title,omitempty"`
+	ContentText   string                `json:"content_text,omitempty"`
+	ContentHTML   string                `json:"content_html,omitempty"`
+	DatePublished string                `json:"date_published"`
+	Tags          []string              `json:"tags,omitempty"`
+	Attachments   []*jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedAttachment struct {
+	URL         string `json:"url"`
+	MimeType    string `json:"mime_type"`
+	Title       string `json:"title,omitempty"`
+	SizeInBytes int64  `json:"size_in_bytes,omitempty"`
+}
+
+// handleTopicFeed renders the most recent cached messages of a topic as an Atom feed (/<topic>/feed), or as a
+// JSON Feed (/<topic>/feed.json), so that topics can be followed in a feed reader. Like polling, this requires
+// the poll permission. Feed readers that cannot send an Authorization header may pass ?auth=... instead.
+func (s *Server) handleTopicFeed(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if err := s.authorizeTopics(r, auth.PermissionPoll, t.ID); err != nil {
+		return err
+	}
+	filters, err := parseQueryFilters(r)
+	if err != nil {
+		return err
+	}
+	cached, err := s.messageCache.Messages(t.ID, sinceAllMessages, false)
+	if err != nil {
+		return err
+	}
+	messages := make([]*message, 0)
+	for i := len(cached) - 1; i >= 0 && len(messages) < feedMaxEntries; i-- { // Newest first
+		m := cached[i]
+		if m.Event == messageEvent && filters.Pass(m) && !s.cacheExpired(m) {
+			messages = append(messages, m)
+		}
+	}
+	info, err := s.messageCache.TopicInfo(t.ID)
+	if err != nil {
+		return err
+	}
+	baseURL := s.feedBaseURL(r)
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	if strings.HasSuffix(r.URL.Path, ".json") {
+		w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+		return json.NewEncoder(w).Encode(newJSONFeed(baseURL, info, messages))
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(newAtomFeed(baseURL, info, messages))
+}
+
+// feedBaseURL returns the configured base-url, or the URL the feed was requested with, since feed readers need
+// absolute links
+func (s *Server) feedBaseURL(r *http.Request) string {
+	if s.config.BaseURL != "" {
+		return s.config.BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+func newAtomFeed(baseURL string, info *topicInfo, messages []*message) *atomFeed {
+	topicURL := fmt.Sprintf("%s/%s", baseURL, info.Topic)
+	updated := time.Now()
+	if len(messages) > 0 {
+		updated = time.Unix(messages[0].Time, 0)
+	}
+	feed := &atomFeed{
+		XMLNS:    atomNamespace,
+		ID:       topicURL,
+		Title:    feedTitle(info),
+		Subtitle: info.Description,
+		Icon:     info.Icon,
+		Updated:  updated.UTC().Format(time.RFC3339),
+		Links: []*atomLink{
+			{Rel: "self", Href: topicURL + "/feed", Type: "application/atom+xml"},
+			{Rel: "alternate", Href: topicURL, Type: "text/html"},
+		},
+		Entries: make([]*atomEntry, 0),
+	}
+	for _, m := range messages {
+		date := time.Unix(m.Time, 0).UTC().Format(time.RFC3339)
+		entry := &atomEntry{
+			ID:        fmt.Sprintf("%s/%s", topicURL, m.ID),
+			Title:     feedEntryTitle(m),
+			Updated:   date,
+			Published: date,
+			Links:     make([]*atomLink, 0),
+		}
+		if m.HTML != "" {
+			entry.Content = &atomContent{Type: "html", Body: m.HTML}
+		} else if text := feedEntryText(m); text != "" {
+			entry.Content = &atomContent{Type: "text", Body: text}
+		}
+		if m.Click != "" {
+			entry.Links = append(entry.Links, &atomLink{Rel: "alternate", Href: m.Click})
+		}
+		if m.Attachment != nil {
+			entry.Links = append(entry.Links, &atomLink{Rel: "enclosure", Href: m.Attachment.URL, Type: m.Attachment.Type, Length: m.Attachment.Size})
+		}
+		for _, tag := range m.Tags {
+			entry.Categories = append(entry.Categories, &atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	return feed
+}
+
+func newJSONFeed(baseURL string, info *topicInfo, messages []*message) *jsonFeed {
+	topicURL := fmt.Sprintf("%s/%s", baseURL, info.Topic)
+	feed := &jsonFeed{
+		Version:     jsonFeedVersion,
+		Title:       feedTitle(info),
+		Description: info.Description,
+		HomePageURL: topicURL,
+		FeedURL:     topicURL + "/feed.json",
+		Icon:        info.Icon,
+		Items:       make([]*jsonFeedItem, 0),
+	}
+	for _, m := range messages {
+		item := &jsonFeedItem{
+			ID:            m.ID,
+			URL:           m.Click,
+			Title:         m.Title,
+			ContentText:   feedEntryText(m),
+			ContentHTML:   m.HTML,
+			DatePublished: time.Unix(m.Time, 0).UTC().Format(time.RFC3339),
+			Tags:          m.Tags,
+		}
+		if item.ContentText == "" && item.ContentHTML == "" {
+			item.ContentText = feedEntryTitle(m) // One of the two is required by the spec
+		}
+		if m.Attachment != nil {
+			mimeType := m.Attachment.Type
+			if mimeType == "" {
+				mimeType = "application/octet-stream"
+			}
+			item.Attachments = []*jsonFeedAttachment{{URL: m.Attachment.URL, MimeType: mimeType, Title: m.Attachment.Name, SizeInBytes: m.Attachment.Size}}
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	return feed
+}
+
+func feedTitle(info *topicInfo) string {
+	if info.DisplayName != "" {
+		return info.DisplayName
+	}
+	return info.Topic
+}
+
+// feedEntryText returns the message body, unless it is binary (base64-encoded), which cannot be shown in a feed
+func feedEntryText(m *message) string {
+	if m.Encoding != "" {
+		return ""
+	}
+	return m.Message
+}
+
+// feedEntryTitle returns the title of a message, or the beginning of its first line, since Atom requires a title
+func feedEntryTitle(m *message) string {
+	if m.Title != "" {
+		return m.Title
+	}
+	text := feedEntryText(m)
+	if text == "" && m.Attachment != nil {
+		text = m.Attachment.Name
+	}
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	if utf8.RuneCountInString(text) > feedTitleMaxLength {
+		text = string([]rune(text)[:feedTitleMaxLength-1]) + "…"
+	}
+	if text == "" {
+		return m.ID
+	}
+	return text
+}
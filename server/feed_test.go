@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"testing"
+)
+
+func TestServer_TopicFeed_Atom(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	request(t, s, "PUT", "/backups/info", `{"display_name":"Nightly backups","description":"Results of the backup jobs"}`, nil)
+	first := toMessage(t, request(t, s, "PUT", "/backups", "Backup of /home succeeded\nTook 3 minutes", map[string]string{"Tags": "white_check_mark"}).Body.String())
+	second := toMessage(t, request(t, s, "PUT", "/backups", "Disk almost full", map[string]string{"Title": "Backup failed", "Priority": "4", "Click": "https://example.com/logs"}).Body.String())
+
+	response := request(t, s, "GET", "/backups/feed", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/atom+xml; charset=utf-8", response.Header().Get("Content-Type"))
+	var feed atomFeed
+	require.Nil(t, xml.Unmarshal(response.Body.Bytes(), &feed))
+	require.Equal(t, "http://127.0.0.1:12345/backups", feed.ID)
+	require.Equal(t, "Nightly backups", feed.Title)
+	require.Equal(t, "Results of the backup jobs", feed.Subtitle)
+	require.Len(t, feed.Entries, 2)
+	require.Equal(t, "http://127.0.0.1:12345/backups/"+second.ID, feed.Entries[0].ID) // Newest first
+	require.Equal(t, "Backup failed", feed.Entries[0].Title)
+	require.Equal(t, "Disk almost full", feed.Entries[0].Content.Body)
+	require.Equal(t, "https://example.com/logs", feed.Entries[0].Links[0].Href)
+	require.Equal(t, "http://127.0.0.1:12345/backups/"+first.ID, feed.Entries[1].ID)
+	require.Equal(t, "Backup of /home succeeded", feed.Entries[1].Title) // First line of the message
+	require.Equal(t, "white_check_mark", feed.Entries[1].Categories[0].Term)
+
+	response = request(t, s, "GET", "/backups/feed?priority=high", "", nil)
+	var filtered atomFeed
+	require.Nil(t, xml.Unmarshal(response.Body.Bytes(), &filtered))
+	require.Len(t, filtered.Entries, 1)
+	require.Equal(t, "Backup failed", filtered.Entries[0].Title)
+}
+
+func TestServer_TopicFeed_JSON(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	m := toMessage(t, request(t, s, "PUT", "/backups", "Backup of /home succeeded", map[string]string{"Tags": "backup", "Attach": "https://example.com/report.pdf"}).Body.String())
+
+	response := request(t, s, "GET", "/backups/feed.json", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/feed+json; charset=utf-8", response.Header().Get("Content-Type"))
+	var feed jsonFeed
+	require.Nil(t, json.Unmarshal(response.Body.Bytes(), &feed))
+	require.Equal(t, jsonFeedVersion, feed.Version)
+	require.Equal(t, "backups", feed.Title)
+	require.Equal(t, "http://127.0.0.1:12345/backups/feed.json", feed.FeedURL)
+	require.Len(t, feed.Items, 1)
+	require.Equal(t, m.ID, feed.Items[0].ID)
+	require.Equal(t, "Backup of /home succeeded", feed.Items[0].ContentText)
+	require.Equal(t, []string{"backup"}, feed.Items[0].Tags)
+	require.Equal(t, "https://example.com/report.pdf", feed.Items[0].Attachments[0].URL)
+}
+
+func TestServer_TopicFeed_Auth(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "backups", true, true))
+	request(t, s, "PUT", "/backups", "Backup succeeded", map[string]string{"Authorization": basicAuth("phil:phil")})
+
+	response := request(t, s, "GET", "/backups/feed", "", nil)
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", "/backups/feed", "", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	var feed atomFeed
+	require.Nil(t, xml.Unmarshal(response.Body.Bytes(), &feed))
+	require.Len(t, feed.Entries, 1)
+}
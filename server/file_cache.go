@@ -1,6 +1,8 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"heckel.io/ntfy/util"
 	"io"
@@ -14,8 +16,27 @@ var (
 	fileIDRegex      = regexp.MustCompile(`^[-_A-Za-z0-9]+$`)
 	errInvalidFileID = errors.New("invalid file ID")
 	errFileExists    = errors.New("file exists")
+	errFileNotFound  = errors.New("file not found")
 )
 
+// attachmentStore is where uploaded attachments are kept, either a local directory (fileCache), or an
+// S3-compatible bucket (s3Cache)
+type attachmentStore interface {
+	Write(id string, in io.Reader, limiters ...util.Limiter) (int64, error)
+	WriteContent(in io.Reader, limiters ...util.Limiter) (id string, size int64, err error)
+	Read(id string) (io.ReadCloser, int64, error)
+	Stat(id string) (int64, error)
+	Remove(ids ...string) error
+	Size() int64
+	Remaining() int64
+}
+
+// signedURLStore is implemented by attachment stores that serve files themselves, in which case the
+// file endpoint redirects to the URL instead of streaming the file
+type signedURLStore interface {
+	SignedURL(id string) string
+}
+
 type fileCache struct {
 	dir              string
 	totalSizeCurrent int64
@@ -70,6 +91,74 @@ func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (in
 	return size, nil
 }
 
+// WriteContent stores the file under the hex-encoded SHA-256 of its content, and returns that as its ID. If a
+// file with the same content already exists, it is kept and the upload is discarded, so that it does not count
+// towards the total size limit twice. The upload must fit into the limits nonetheless.
+func (c *fileCache) WriteContent(in io.Reader, limiters ...util.Limiter) (string, int64, error) {
+	f, err := os.CreateTemp(c.dir, ".upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	limiters = append(limiters, util.NewFixedLimiter(c.Remaining()), util.NewFixedLimiter(c.fileSizeLimit))
+	limitWriter := util.NewLimitWriter(io.MultiWriter(f, hash), limiters...)
+	size, err := io.Copy(limitWriter, in)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	id := hex.EncodeToString(hash.Sum(nil))
+	file := filepath.Join(c.dir, id)
+	if _, err := os.Stat(file); err == nil {
+		os.Remove(f.Name())
+		return id, size, nil
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+	c.mu.Lock()
+	c.totalSizeCurrent += size
+	c.mu.Unlock()
+	return id, size, nil
+}
+
+func (c *fileCache) Read(id string) (io.ReadCloser, int64, error) {
+	if !fileIDRegex.MatchString(id) {
+		return nil, 0, errInvalidFileID
+	}
+	f, err := os.Open(filepath.Join(c.dir, id))
+	if os.IsNotExist(err) {
+		return nil, 0, errFileNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+func (c *fileCache) Stat(id string) (int64, error) {
+	if !fileIDRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	}
+	stat, err := os.Stat(filepath.Join(c.dir, id))
+	if os.IsNotExist(err) {
+		return 0, errFileNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
 func (c *fileCache) Remove(ids ...string) error {
 	for _, id := range ids {
 		if !fileIDRegex.MatchString(id) {
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/util"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3DefaultRegion      = "us-east-1"
+	s3PresignExpiry      = 15 * time.Minute // Validity of the download URLs that /file/... redirects to
+	s3UnsignedPayload    = "UNSIGNED-PAYLOAD"
+	s3SigningAlgorithm   = "AWS4-HMAC-SHA256"
+	s3AmzDateFormat      = "20060102T150405Z"
+	s3ListMaxPageRequest = 100 // Safety net against servers that always claim to be truncated
+)
+
+// s3Cache stores uploaded attachments in an S3-compatible bucket (e.g. AWS S3 or MinIO) instead of a local
+// directory. Requests are signed with AWS Signature Version 4, and downloads are redirected to presigned URLs,
+// so the files do not pass through ntfy.
+type s3Cache struct {
+	endpoint         *url.URL // Scheme and host only
+	bucket           string
+	prefix           string // Prepended to the file ID to build the object key, e.g. "attachments/"
+	region           string
+	accessKey        string
+	secretKey        string
+	client           *http.Client
+	totalSizeCurrent int64
+	totalSizeLimit   int64
+	fileSizeLimit    int64
+	mu               sync.Mutex
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// newS3Cache creates an attachment cache backed by a bucket, using a URL like
+// s3://ACCESS_KEY:SECRET_KEY@s3.us-east-1.amazonaws.com/my-bucket/optional/prefix?region=us-east-1. Objects are
+// addressed path-style, which works with AWS as well as MinIO. Use s3+http:// for endpoints without TLS.
+func newS3Cache(rawURL string, totalSizeLimit int64, fileSizeLimit int64) (*s3Cache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var scheme string
+	if u.Scheme == "s3" {
+		scheme = "https"
+	} else if u.Scheme == "s3+http" {
+		scheme = "http"
+	} else {
+		return nil, fmt.Errorf("invalid S3 URL: scheme must be s3:// or s3+http://, not %s://", u.Scheme)
+	}
+	if u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return nil, errors.New("invalid S3 URL: access key and host must be set, e.g. s3://KEY:SECRET@host/bucket")
+	}
+	secretKey, _ := u.User.Password()
+	path := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if path[0] == "" {
+		return nil, errors.New("invalid S3 URL: bucket must be set, e.g. s3://KEY:SECRET@host/bucket")
+	}
+	var prefix string
+	if len(path) == 2 && path[1] != "" {
+		prefix = strings.TrimSuffix(path[1], "/") + "/"
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	c := &s3Cache{
+		endpoint:       &url.URL{Scheme: scheme, Host: u.Host},
+		bucket:         path[0],
+		prefix:         prefix,
+		region:         region,
+		accessKey:      u.User.Username(),
+		secretKey:      secretKey,
+		client:         &http.Client{Timeout: time.Minute},
+		totalSizeLimit: totalSizeLimit,
+		fileSizeLimit:  fileSizeLimit,
+	}
+	size, err := c.bucketSize()
+	if err != nil {
+		return nil, err
+	}
+	c.totalSizeCurrent = size
+	return c, nil
+}
+
+func (c *s3Cache) Write(id string, in io.Reader, limiters ...util.Limiter) (int64, error) {
+	if !fileIDRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	}
+	if _, err := c.Stat(id); err == nil {
+		return 0, errFileExists
+	} else if err != errFileNotFound {
+		return 0, err
+	}
+	b, err := c.read(in, limiters...)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.put(id, b); err != nil {
+		return 0, err
+	}
+	return int64(len(b)), nil
+}
+
+// WriteContent stores the file under the hex-encoded SHA-256 of its content, and skips the upload if an
+// object with the same content already exists, see fileCache.WriteContent
+func (c *s3Cache) WriteContent(in io.Reader, limiters ...util.Limiter) (string, int64, error) {
+	b, err := c.read(in, limiters...)
+	if err != nil {
+		return "", 0, err
+	}
+	id := s3Hash(b)
+	if _, err := c.Stat(id); err == nil {
+		return id, int64(len(b)), nil
+	} else if err != errFileNotFound {
+		return "", 0, err
+	}
+	if err := c.put(id, b); err != nil {
+		return "", 0, err
+	}
+	return id, int64(len(b)), nil
+}
+
+func (c *s3Cache) Read(id string) (io.ReadCloser, int64, error) {
+	if !fileIDRegex.MatchString(id) {
+		return nil, 0, errInvalidFileID
+	}
+	resp, err := c.request(http.MethodGet, c.prefix+id, nil, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (c *s3Cache) Stat(id string) (int64, error) {
+	if !fileIDRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	}
+	resp, err := c.request(http.MethodHead, c.prefix+id, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (c *s3Cache) Remove(ids ...string) error {
+	for _, id := range ids {
+		if !fileIDRegex.MatchString(id) {
+			return errInvalidFileID
+		}
+		if resp, err := c.request(http.MethodDelete, c.prefix+id, nil, nil, nil); err == nil { // Best effort delete
+			resp.Body.Close()
+		}
+	}
+	size, err := c.bucketSize() // Also accounts for files written by other ntfy instances sharing the bucket
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.totalSizeCurrent = size
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *s3Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.totalSizeCurrent
+}
+
+func (c *s3Cache) Remaining() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	remaining := c.totalSizeLimit - c.totalSizeCurrent
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// read buffers the upload in memory, since the payload hash is part of the signature
+func (c *s3Cache) read(in io.Reader, limiters ...util.Limiter) ([]byte, error) {
+	var buf bytes.Buffer
+	limiters = append(limiters, util.NewFixedLimiter(c.Remaining()), util.NewFixedLimiter(c.fileSizeLimit))
+	if _, err := io.Copy(util.NewLimitWriter(&buf, limiters...), in); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *s3Cache) put(id string, b []byte) error {
+	contentType, _ := util.DetectContentType(b, id)
+	resp, err := c.request(http.MethodPut, c.prefix+id, nil, b, map[string]string{"Content-Type": contentType})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	c.mu.Lock()
+	c.totalSizeCurrent += int64(len(b))
+	c.mu.Unlock()
+	return nil
+}
+
+// SignedURL returns a presigned download URL for the file, valid for s3PresignExpiry
+func (c *s3Cache) SignedURL(id string) string {
+	return c.presign(c.prefix+id, s3PresignExpiry, time.Now())
+}
+
+// bucketSize returns the total size of all objects under the prefix
+func (c *s3Cache) bucketSize() (int64, error) {
+	var size int64
+	token := ""
+	for i := 0; i < s3ListMaxPageRequest; i++ {
+		query := url.Values{"list-type": {"2"}}
+		if c.prefix != "" {
+			query.Set("prefix", c.prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.request(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return 0, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+		for _, object := range result.Contents {
+			size += object.Size
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return size, nil
+		}
+		token = result.NextContinuationToken
+	}
+	return 0, errors.New("unable to list S3 bucket: too many pages")
+}
+
+// request sends a signed request for the object with the given key (or the bucket, if key is empty), and returns
+// errFileNotFound for 404 responses, and an error for all other unsuccessful responses
+func (c *s3Cache) request(method, key string, query url.Values, body []byte, headers map[string]string) (*http.Response, error) {
+	u := c.objectURL(key)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	c.sign(req, s3Hash(body), time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errFileNotFound
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 request %s %s failed: %s %s", method, u.Path, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+func (c *s3Cache) objectURL(key string) *url.URL {
+	path := "/" + key
+	if c.bucket != "" {
+		path = "/" + c.bucket + path
+	}
+	return &url.URL{Scheme: c.endpoint.Scheme, Host: c.endpoint.Host, Path: path}
+}
+
+// sign adds the Authorization header to the request, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (c *s3Cache) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3AmzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{req.Method, s3CanonicalPath(req.URL.Path), req.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := c.scope(amzDate)
+	signature := c.signature(amzDate, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3SigningAlgorithm, c.accessKey, scope, signedHeaders, signature))
+}
+
+// presign returns a URL that allows downloading the object without credentials, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func (c *s3Cache) presign(key string, expires time.Duration, now time.Time) string {
+	amzDate := now.UTC().Format(s3AmzDateFormat)
+	u := c.objectURL(key)
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3SigningAlgorithm},
+		"X-Amz-Credential":    {c.accessKey + "/" + c.scope(amzDate)},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.FormatInt(int64(expires.Seconds()), 10)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalRequest := strings.Join([]string{http.MethodGet, s3CanonicalPath(u.Path), canonicalQuery, "host:" + u.Host + "\n", "host", s3UnsignedPayload}, "\n")
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + c.signature(amzDate, canonicalRequest)
+	return u.String()
+}
+
+func (c *s3Cache) scope(amzDate string) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", amzDate[:8], c.region)
+}
+
+func (c *s3Cache) signature(amzDate, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{s3SigningAlgorithm, amzDate, c.scope(amzDate), s3Hash([]byte(canonicalRequest))}, "\n")
+	key := s3HMAC([]byte("AWS4"+c.secretKey), amzDate[:8])
+	key = s3HMAC(key, c.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+// s3CanonicalQuery encodes the query parameters sorted by key, with spaces as %20 (not +), as required for signing
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+func s3CanonicalPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func s3Hash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
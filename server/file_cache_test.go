@@ -43,6 +43,38 @@ func TestFileCache_Write_Remove_Success(t *testing.T) {
 	require.Equal(t, int64(2248), c.Remaining())
 }
 
+func TestFileCache_WriteContent_Deduplicated(t *testing.T) {
+	dir, c := newTestFileCache(t)
+	id, size, err := c.WriteContent(strings.NewReader("camera snapshot"))
+	require.Nil(t, err)
+	require.Equal(t, "d227ec6883e8d7b2b415659260e1e811a8892ef8a1ea8ac2c09f7fc4be23f70c", id)
+	require.Equal(t, int64(15), size)
+	require.Equal(t, "camera snapshot", readFile(t, dir+"/"+id))
+
+	again, size, err := c.WriteContent(strings.NewReader("camera snapshot"))
+	require.Nil(t, err)
+	require.Equal(t, id, again)
+	require.Equal(t, int64(15), size)
+	require.Equal(t, int64(15), c.Size())
+
+	other, _, err := c.WriteContent(strings.NewReader("another snapshot"))
+	require.Nil(t, err)
+	require.NotEqual(t, id, other)
+	require.Equal(t, int64(31), c.Size())
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries)) // No leftover temporary files
+}
+
+func TestFileCache_WriteContent_FailedFileSizeLimit(t *testing.T) {
+	dir, c := newTestFileCache(t)
+	_, _, err := c.WriteContent(bytes.NewReader(make([]byte, 1025)))
+	require.Equal(t, util.ErrLimitReached, err)
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	require.Empty(t, entries)
+}
+
 func TestFileCache_Write_FailedTotalSizeLimit(t *testing.T) {
 	dir, c := newTestFileCache(t)
 	for i := 0; i < 10; i++ {
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fileURLSigningKeyLength = 32
+)
+
+var (
+	errFileURLSignatureInvalid = errors.New("attachment URL signature missing or invalid")
+	errFileURLExpired          = errors.New("attachment URL expired")
+)
+
+// fileURLSigner signs attachment URLs with an HMAC-SHA256 of the file ID, the topic and the expiry time, so that
+// they cannot be guessed, and stop working once the attachment expires. The topic is part of the signature, so that
+// downloads can be bound to the read permission of the topic the attachment was published to.
+type fileURLSigner struct {
+	key []byte
+}
+
+func loadFileURLSigner(filename string) (*fileURLSigner, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid attachment URL signing key file %s: %s", filename, err.Error())
+	} else if len(key) < fileURLSigningKeyLength {
+		return nil, fmt.Errorf("invalid attachment URL signing key file %s: key must be at least %d bytes, not %d", filename, fileURLSigningKeyLength, len(key))
+	}
+	return &fileURLSigner{key: key}, nil
+}
+
+// sign returns the query string (including the leading "?") that has to be appended to the URL of the file
+func (s *fileURLSigner) sign(id, topic string, expires int64) string {
+	query := url.Values{}
+	query.Set("topic", topic)
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", s.signature(id, topic, expires))
+	return "?" + query.Encode()
+}
+
+// verify checks the signature and expiry time in the query of a file URL, and returns the topic it was signed for
+func (s *fileURLSigner) verify(id string, query url.Values) (string, error) {
+	topic, signature := query.Get("topic"), query.Get("signature")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || topic == "" || signature == "" {
+		return "", errFileURLSignatureInvalid
+	} else if !hmac.Equal([]byte(signature), []byte(s.signature(id, topic, expires))) {
+		return "", errFileURLSignatureInvalid
+	} else if time.Now().Unix() > expires {
+		return "", errFileURLExpired
+	}
+	return topic, nil
+}
+
+func (s *fileURLSigner) signature(id, topic string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(fmt.Sprintf("%s\n%s\n%d", id, topic, expires)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
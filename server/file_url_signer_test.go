@@ -0,0 +1,154 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileURLSigner_SignVerify(t *testing.T) {
+	s := newTestFileURLSigner(t)
+	expires := time.Now().Add(time.Hour).Unix()
+	query := parseTestFileURLQuery(t, s.sign("abc", "mytopic", expires))
+	topic, err := s.verify("abc", query)
+	require.Nil(t, err)
+	require.Equal(t, "mytopic", topic)
+
+	_, err = s.verify("abc-thumb", query) // Different file
+	require.Equal(t, errFileURLSignatureInvalid, err)
+	_, err = newTestFileURLSigner(t).verify("abc", query) // Different key
+	require.Equal(t, errFileURLSignatureInvalid, err)
+	_, err = s.verify("abc", url.Values{})
+	require.Equal(t, errFileURLSignatureInvalid, err)
+
+	tampered := parseTestFileURLQuery(t, s.sign("abc", "mytopic", expires))
+	tampered.Set("topic", "othertopic")
+	_, err = s.verify("abc", tampered)
+	require.Equal(t, errFileURLSignatureInvalid, err)
+	tampered = parseTestFileURLQuery(t, s.sign("abc", "mytopic", expires))
+	tampered.Set("expires", "9999999999")
+	_, err = s.verify("abc", tampered)
+	require.Equal(t, errFileURLSignatureInvalid, err)
+
+	expired := parseTestFileURLQuery(t, s.sign("abc", "mytopic", time.Now().Add(-time.Second).Unix()))
+	_, err = s.verify("abc", expired)
+	require.Equal(t, errFileURLExpired, err)
+}
+
+func TestLoadFileURLSigner_Invalid(t *testing.T) {
+	_, err := loadFileURLSigner(filepath.Join(t.TempDir(), "missing.key"))
+	require.Error(t, err)
+
+	_, err = loadFileURLSigner(writeTestFileURLSigningKey(t, "not base64!"))
+	require.Error(t, err)
+
+	_, err = loadFileURLSigner(writeTestFileURLSigningKey(t, base64.StdEncoding.EncodeToString([]byte("too short"))))
+	require.Error(t, err)
+}
+
+func TestServer_PublishAttachment_SignedURL(t *testing.T) {
+	content := util.RandomString(5000) // > 4096
+	c := newTestConfig(t)
+	c.AttachmentURLSigningKeyFile = newTestFileURLSigningKeyFile(t)
+	s := newTestServer(t, c)
+
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", content, nil).Body.String())
+	u, err := url.Parse(msg.Attachment.URL)
+	require.Nil(t, err)
+	require.Equal(t, "mytopic", u.Query().Get("topic"))
+	require.Equal(t, fmt.Sprintf("%d", msg.Attachment.Expires), u.Query().Get("expires"))
+
+	response := request(t, s, "GET", u.RequestURI(), "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+
+	response = request(t, s, "GET", u.Path, "", nil) // Unsigned
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40302, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", strings.Replace(u.RequestURI(), "topic=mytopic", "topic=othertopic", 1), "", nil)
+	require.Equal(t, 403, response.Code)
+
+	// Same file in another topic has a different signature
+	other := toMessage(t, request(t, s, "PUT", "/othertopic", content, nil).Body.String())
+	require.Equal(t, attachmentFile(t, s, msg), attachmentFile(t, s, other))
+	require.NotEqual(t, msg.Attachment.URL, other.Attachment.URL)
+}
+
+func TestServer_PublishAttachment_SignedURLRequireRead(t *testing.T) {
+	content := util.RandomString(5000) // > 4096
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AttachmentURLSigningKeyFile = newTestFileURLSigningKeyFile(t)
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	c.AttachmentURLRequireRead = true
+	s := newTestServer(t, c)
+
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AddUser("marian", "marian", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "protected", true, true))
+
+	response := request(t, s, "PUT", "/protected", content, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	u, err := url.Parse(toMessage(t, response.Body.String()).Attachment.URL)
+	require.Nil(t, err)
+
+	response = request(t, s, "GET", u.RequestURI(), "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+
+	response = request(t, s, "GET", u.RequestURI(), "", nil)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40301, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", u.RequestURI(), "", map[string]string{
+		"Authorization": basicAuth("marian:marian"),
+	})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", u.RequestURI(), "", map[string]string{
+		"Authorization": basicAuth("ben:wrong"),
+	})
+	require.Equal(t, 401, response.Code)
+}
+
+func newTestFileURLSigner(t *testing.T) *fileURLSigner {
+	s, err := loadFileURLSigner(newTestFileURLSigningKeyFile(t))
+	require.Nil(t, err)
+	return s
+}
+
+func newTestFileURLSigningKeyFile(t *testing.T) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.Nil(t, err)
+	return writeTestFileURLSigningKey(t, base64.StdEncoding.EncodeToString(key)+"\n")
+}
+
+func writeTestFileURLSigningKey(t *testing.T, contents string) string {
+	filename := filepath.Join(t.TempDir(), "attachment-url.key")
+	require.Nil(t, os.WriteFile(filename, []byte(contents), 0600))
+	return filename
+}
+
+func parseTestFileURLQuery(t *testing.T, query string) url.Values {
+	require.True(t, strings.HasPrefix(query, "?"))
+	values, err := url.ParseQuery(strings.TrimPrefix(query, "?"))
+	require.Nil(t, err)
+	return values
+}
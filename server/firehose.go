@@ -0,0 +1,33 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	firehosePath  = "/v1/firehose"
+	firehoseTopic = "~firehose" // Not a valid topic name, so it cannot clash with a real topic
+)
+
+// subscribeTopics returns the topics of a subscription. For the firehose (see publishFirehose), this is the
+// firehose topic itself, otherwise the topics are taken from the path (e.g. /mytopic1,mytopic2/json).
+func (s *Server) subscribeTopics(r *http.Request) ([]*topic, string, error) {
+	if strings.HasPrefix(r.URL.Path, firehosePath) {
+		return []*topic{s.firehose}, firehoseTopic, nil
+	}
+	return s.topicsFromPath(r.URL.Path)
+}
+
+// publishFirehose sends a message of any topic to the subscribers of the firehose, i.e. admins subscribed to
+// /v1/firehose/json, /v1/firehose/sse or /v1/firehose/ws, and wildcard subscriptions (see topicPatterns). Unlike
+// for regular topics, messages are not cached for the firehose, so polling and since=... return nothing.
+func (s *Server) publishFirehose(m *message) {
+	if s.firehose.Subscribers() == 0 {
+		return
+	}
+	if err := s.firehose.Publish(m); err != nil {
+		log.Printf("unable to publish message %s of topic %s to firehose: %v", m.ID, m.Topic, err.Error())
+	}
+}
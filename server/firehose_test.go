@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServer_Firehose(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 0)
+	require.Nil(t, s.auth.(auth.Manager).AddUser("phil", "phil", auth.RoleAdmin))
+	phil := map[string]string{"Authorization": basicAuth("phil:phil")}
+
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/v1/firehose/json?auth="+base64.RawURLEncoding.EncodeToString([]byte(basicAuth("phil:phil"))), rr)
+	request(t, s, "PUT", "/backups", "Backup done", phil)
+	response := request(t, s, "PUT", "/alerts", "Disk full", phil)
+	m := toMessage(t, response.Body.String())
+	request(t, s, "DELETE", "/alerts/"+m.ID, "", phil)
+	cancel()
+	messages := toMessages(t, rr.Body.String())
+	require.Len(t, messages, 4)
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, firehoseTopic, messages[0].Topic)
+	require.Equal(t, "backups", messages[1].Topic)
+	require.Equal(t, "Backup done", messages[1].Message)
+	require.Equal(t, "alerts", messages[2].Topic)
+	require.Equal(t, messageDeletedEvent, messages[3].Event)
+	require.Equal(t, m.ID, messages[3].ID)
+
+	// Filters apply, and nothing is cached
+	rr = httptest.NewRecorder()
+	cancel = subscribe(t, s, "/v1/firehose/json?priority=high&auth="+base64.RawURLEncoding.EncodeToString([]byte(basicAuth("phil:phil"))), rr)
+	request(t, s, "PUT", "/alerts", "Backup done", phil)
+	request(t, s, "PUT", "/alerts", "Disk full", map[string]string{"Authorization": basicAuth("phil:phil"), "Priority": "high"})
+	cancel()
+	messages = toMessages(t, rr.Body.String())
+	require.Len(t, messages, 2)
+	require.Equal(t, "Disk full", messages[1].Message)
+	response = request(t, s, "GET", "/v1/firehose/json?poll=1", "", phil)
+	require.Equal(t, 200, response.Code)
+	require.Empty(t, response.Body.String())
+}
+
+func TestServer_Firehose_Unauthorized(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 0)
+	response := request(t, s, "GET", "/v1/firehose/json?poll=1", "", nil)
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "GET", "/v1/firehose/sse?poll=1", "", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 403, response.Code)
+
+	s = newTestServer(t, newTestConfig(t)) // Without access control, there is no firehose
+	response = request(t, s, "GET", "/v1/firehose/json?poll=1", "", nil)
+	require.Equal(t, 404, response.Code)
+}
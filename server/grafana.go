@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// This file implements the "grafana" webhook format (see webhookFormats) for Grafana unified alerting, see
+// https://grafana.com/docs/grafana/latest/alerting/manage-notifications/webhook-notifier/. The payload is
+// a superset of the Alertmanager payload, so most of it is handled just like an Alertmanager webhook.
+
+var (
+	// grafanaPriorities maps the state of the alert rule to message priorities
+	grafanaPriorities = map[string]int{
+		"alerting": 4,
+		"no_data":  3,
+		"pending":  3,
+		"ok":       2,
+		"paused":   2,
+	}
+)
+
+// grafanaPayload is the body of a Grafana webhook. Fields not used by ntfy are omitted.
+type grafanaPayload struct {
+	alertmanagerPayload
+	Alerts  []grafanaAlert `json:"alerts"`
+	Title   string         `json:"title"`
+	State   string         `json:"state"` // "alerting" or "ok", older versions also send "no_data", "pending", "paused"
+	Message string         `json:"message"`
+}
+
+type grafanaAlert struct {
+	alertmanagerAlert
+	Values       map[string]interface{} `json:"values"` // Values of the queries and expressions, e.g. {"B":22.5,"C":1}
+	PanelURL     string                 `json:"panelURL"`
+	DashboardURL string                 `json:"dashboardURL"`
+	SilenceURL   string                 `json:"silenceURL"`
+}
+
+// newGrafanaWebhookMessage parses the Grafana webhook payload, see newGrafanaMessage
+func newGrafanaWebhookMessage(body io.Reader, messageLimit int) (*publishMessage, error) {
+	var payload grafanaPayload
+	if err := json.NewDecoder(body).Decode(&payload); err != nil || len(payload.Alerts) == 0 {
+		return nil, errHTTPBadRequestWebhookInvalid
+	}
+	return newGrafanaMessage(&payload, messageLimit), nil
+}
+
+// newGrafanaMessage converts the alerts into a single message. The alert name becomes the title, the state
+// of the alert rule the priority, and the panel (or dashboard) of the first alert is opened when the notification
+// is clicked. Like with Alertmanager, the body lists all alerts, and the common labels become tags.
+func newGrafanaMessage(payload *grafanaPayload, messageLimit int) *publishMessage {
+	m := &publishMessage{
+		Title:    grafanaTitle(payload),
+		Tags:     alertmanagerTags(&payload.alertmanagerPayload),
+		Priority: grafanaPriorities[grafanaState(payload)],
+	}
+	texts := make([]string, 0)
+	for _, alert := range payload.Alerts {
+		for _, link := range []string{alert.PanelURL, alert.DashboardURL, alert.GeneratorURL} {
+			if m.Click == "" && link != "" {
+				m.Click = link
+			}
+		}
+		if len(m.Actions) == 0 && alert.SilenceURL != "" && alert.Status != alertmanagerStatusResolved {
+			m.Actions = []action{{Action: actionView, Label: "Silence", URL: alert.SilenceURL}}
+		}
+		text := alertmanagerAlertText(&alert.alertmanagerAlert, &payload.alertmanagerPayload)
+		if values := grafanaValues(alert.Values); values != "" {
+			text += "\n" + values
+		}
+		texts = append(texts, text)
+	}
+	m.Message = joinAlertTexts(texts, messageLimit)
+	return m
+}
+
+// grafanaTitle returns the name of the alert rule. If the alerts belong to different rules, the title generated
+// by Grafana is used instead, e.g. "[FIRING:2] (HighLoad DiskFull)".
+func grafanaTitle(payload *grafanaPayload) string {
+	if name := payload.CommonLabels[alertmanagerNameLabel]; name != "" {
+		return name
+	} else if len(payload.Alerts) == 1 && payload.Alerts[0].Labels[alertmanagerNameLabel] != "" {
+		return payload.Alerts[0].Labels[alertmanagerNameLabel]
+	}
+	return payload.Title
+}
+
+// grafanaState returns the state of the alert rule, falling back to the status of the group if there is none
+func grafanaState(payload *grafanaPayload) string {
+	if payload.State != "" {
+		return strings.ToLower(payload.State)
+	} else if payload.Status == alertmanagerStatusResolved {
+		return "ok"
+	}
+	return "alerting"
+}
+
+// grafanaValues formats the query values of an alert, e.g. "B=22.5, C=1"
+func grafanaValues(values map[string]interface{}) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		formatted = append(formatted, fmt.Sprintf("%s=%v", name, values[name]))
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const testGrafanaPayload = `{
+  "receiver": "ntfy",
+  "status": "firing",
+  "orgId": 1,
+  "alerts": [
+    {
+      "status": "firing",
+      "labels": {"alertname": "HighCPU", "grafana_folder": "Servers", "instance": "web1"},
+      "annotations": {"summary": "CPU usage on web1 is above 90%"},
+      "startsAt": "2022-12-01T10:15:00Z",
+      "generatorURL": "https://grafana.example.com/alerting/grafana/abc/view",
+      "fingerprint": "c6eadffa33fcdf37",
+      "silenceURL": "https://grafana.example.com/alerting/silence/new?alertmanager=grafana",
+      "dashboardURL": "https://grafana.example.com/d/servers",
+      "panelURL": "https://grafana.example.com/d/servers?viewPanel=2",
+      "values": {"B": 94.5, "C": 1}
+    }
+  ],
+  "groupLabels": {"alertname": "HighCPU"},
+  "commonLabels": {"alertname": "HighCPU", "grafana_folder": "Servers", "instance": "web1"},
+  "commonAnnotations": {"summary": "CPU usage on web1 is above 90%"},
+  "externalURL": "https://grafana.example.com/",
+  "version": "1",
+  "title": "[FIRING:1] HighCPU Servers (web1)",
+  "state": "alerting",
+  "message": "**Firing**\n\nValue: B=94.5, C=1"
+}`
+
+func TestServer_Grafana(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "POST", "/alerts/grafana", testGrafanaPayload, nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "alerts", m.Topic)
+	require.Equal(t, "HighCPU", m.Title)
+	require.Equal(t, "CPU usage on web1 is above 90%\nB=94.5, C=1", m.Message)
+	require.Equal(t, 4, m.Priority)
+	require.Equal(t, []string{"rotating_light", "grafana_folder=Servers", "instance=web1"}, m.Tags)
+	require.Equal(t, "https://grafana.example.com/d/servers?viewPanel=2", m.Click)
+	require.Equal(t, 1, len(m.Actions))
+	require.Equal(t, "Silence", m.Actions[0].Label)
+	require.Equal(t, "https://grafana.example.com/alerting/silence/new?alertmanager=grafana", m.Actions[0].URL)
+}
+
+func TestServer_Grafana_TemplateHeader(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	payload := `{"status":"resolved","state":"ok","title":"[RESOLVED] (DiskFull HighCPU)","commonLabels":{},"alerts":[
+		{"status":"resolved","labels":{"alertname":"DiskFull"},"annotations":{},"dashboardURL":"https://grafana.example.com/d/disks"},
+		{"status":"resolved","labels":{"alertname":"HighCPU"},"annotations":{}}]}`
+	response := request(t, s, "PUT", "/alerts", payload, map[string]string{"X-Template": "grafana"})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "alerts", m.Topic)
+	require.Equal(t, "[RESOLVED] (DiskFull HighCPU)", m.Title) // Different alerts, so Grafana's title is used
+	require.Equal(t, "DiskFull\nalertname=DiskFull\n\nHighCPU\nalertname=HighCPU", m.Message)
+	require.Equal(t, 2, m.Priority)
+	require.Equal(t, []string{"white_check_mark"}, m.Tags)
+	require.Equal(t, "https://grafana.example.com/d/disks", m.Click)
+	require.Empty(t, m.Actions) // Resolved alerts cannot be silenced
+
+	response = request(t, s, "POST", "/alerts?template=alertmanager", testAlertmanagerPayload, nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "[FIRING:2] HighLoad", toMessage(t, response.Body.String()).Title)
+}
+
+func TestServer_Grafana_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "POST", "/alerts/grafana", `{"status":"firing","alerts":[]}`, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40039, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/alerts", testGrafanaPayload, map[string]string{"X-Template": "zabbix"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40040, toHTTPError(t, response.Body.String()).Code)
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"heckel.io/ntfy/server/ntfypb"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// grpcService implements the gRPC API (see ntfypb/ntfy.proto) on top of the HTTP handlers, the same way the SMTP
+// backend does: every call is turned into an internal HTTP request, so that authentication, rate limiting and
+// all other publishing and subscribing features behave exactly like they do for the HTTP API.
+type grpcService struct {
+	ntfypb.UnimplementedNtfyServer
+	s *Server
+}
+
+// Publish publishes a message by sending a PUT request to the topic
+func (g *grpcService) Publish(ctx context.Context, req *ntfypb.PublishRequest) (*ntfypb.Message, error) {
+	if !topicRegex.MatchString(req.Topic) {
+		return nil, status.Error(codes.InvalidArgument, "invalid topic")
+	}
+	r, err := g.newRequest(ctx, http.MethodPut, "/"+req.Topic, strings.NewReader(req.Message))
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{
+		"Title":    req.Title,
+		"Tags":     strings.Join(req.Tags, ","),
+		"Click":    req.Click,
+		"Attach":   req.Attach,
+		"Filename": req.Filename,
+		"Delay":    req.Delay,
+		"Email":    req.Email,
+	}
+	if req.Priority != 0 {
+		headers["Priority"] = strconv.Itoa(int(req.Priority))
+	}
+	if req.Markdown {
+		headers["Markdown"] = "yes"
+	}
+	for k, v := range headers {
+		if v != "" {
+			r.Header.Set(k, v)
+		}
+	}
+	w := newInternalResponseWriter(nil)
+	g.s.handle(w, r)
+	if w.code != http.StatusOK && w.code != http.StatusAccepted { // 202 if held for moderation
+		return nil, grpcError(w.code, w.buf.Bytes())
+	}
+	var m message
+	if err := json.Unmarshal(w.buf.Bytes(), &m); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return toGRPCMessage(&m), nil
+}
+
+// Subscribe subscribes to the topics with a GET request to the JSON stream endpoint, and sends every JSON line
+// as a message to the stream. Like the HTTP request, the call ends when the client goes away (or right away, if
+// poll is set).
+func (g *grpcService) Subscribe(req *ntfypb.SubscribeRequest, stream ntfypb.Ntfy_SubscribeServer) error {
+	if len(req.Topics) == 0 {
+		return status.Error(codes.InvalidArgument, "no topics")
+	}
+	params := url.Values{}
+	if req.Since != "" {
+		params.Set("since", req.Since)
+	}
+	if req.Poll {
+		params.Set("poll", "1")
+	}
+	if req.Scheduled {
+		params.Set("scheduled", "1")
+	}
+	path := fmt.Sprintf("/%s/json", strings.Join(req.Topics, ","))
+	if len(params) > 0 {
+		path += "?" + params.Encode()
+	}
+	r, err := g.newRequest(stream.Context(), http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	w := newInternalResponseWriter(func(m *message) error {
+		return stream.Send(toGRPCMessage(m))
+	})
+	g.s.handle(w, r)
+	if w.err != nil {
+		return w.err
+	} else if w.code != 0 && w.code != http.StatusOK { // Nothing is written when polling without new messages
+		return grpcError(w.code, w.buf.Bytes())
+	}
+	return nil
+}
+
+// newRequest creates the internal HTTP request for a gRPC call, passing on the visitor's address and the authorization
+// metadata. Other metadata, in particular x-forwarded-for, is not passed on, since the client could use it to pose as
+// another visitor if behind-proxy is set.
+func (g *grpcService) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, method, g.s.config.BaseURL+path, body)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			r.Header.Set("Authorization", values[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String() // Rate limiting is done based on the IP of the gRPC client
+	}
+	return r, nil
+}
+
+// runGRPCServer starts the gRPC server on listen-grpc. If a certificate is configured (cert-file and key-file),
+// it uses TLS, the same as the HTTPS server.
+func (s *Server) runGRPCServer() error {
+	var options []grpc.ServerOption
+	if s.config.CertFile != "" && s.config.KeyFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(s.config.CertFile, s.config.KeyFile)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(creds))
+	}
+	listener, err := net.Listen("tcp", s.config.ListenGRPC)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer(options...)
+	ntfypb.RegisterNtfyServer(server, &grpcService{s: s})
+	s.mu.Lock()
+	s.grpcServer = server
+	s.mu.Unlock()
+	return server.Serve(listener)
+}
+
+// grpcError turns the JSON error (see errHTTP) of an internal HTTP request into a gRPC status error
+func grpcError(httpCode int, body []byte) error {
+	message := strings.TrimSpace(string(body))
+	var httpErr errHTTP
+	if err := json.Unmarshal(body, &httpErr); err == nil && httpErr.Message != "" {
+		message = httpErr.Message
+	}
+	var code codes.Code
+	switch httpCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, message)
+}
+
+func toGRPCMessage(m *message) *ntfypb.Message {
+	pm := &ntfypb.Message{
+		Id:          m.ID,
+		Time:        m.Time,
+		Expires:     m.Expires,
+		Event:       m.Event,
+		Topic:       m.Topic,
+		Priority:    int32(m.Priority),
+		Tags:        m.Tags,
+		Click:       m.Click,
+		Title:       m.Title,
+		Message:     m.Message,
+		Encoding:    m.Encoding,
+		Group:       m.Group,
+		InReplyTo:   m.InReplyTo,
+		AckRequired: m.AckRequired,
+		AckedBy:     m.AckedBy,
+		CollapseKey: m.CollapseKey,
+		Markdown:    m.Markdown,
+		Html:        m.HTML,
+	}
+	for _, a := range m.Actions {
+		pm.Actions = append(pm.Actions, &ntfypb.Action{
+			Id:      a.ID,
+			Action:  a.Action,
+			Label:   a.Label,
+			Clear:   a.Clear,
+			Url:     a.URL,
+			Method:  a.Method,
+			Headers: a.Headers,
+			Body:    a.Body,
+			Intent:  a.Intent,
+			Extras:  a.Extras,
+			Topic:   a.Topic,
+			Message: a.Message,
+		})
+	}
+	if m.Attachment != nil {
+		pm.Attachment = &ntfypb.Attachment{
+			Name:      m.Attachment.Name,
+			Type:      m.Attachment.Type,
+			Size:      m.Attachment.Size,
+			Expires:   m.Attachment.Expires,
+			Url:       m.Attachment.URL,
+			Thumbnail: m.Attachment.Thumbnail,
+		}
+	}
+	return pm
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/server/ntfypb"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServer_GRPC_PublishAndPoll(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	client := newTestGRPCClient(t, s)
+
+	m, err := client.Publish(context.Background(), &ntfypb.PublishRequest{
+		Topic:    "mytopic",
+		Message:  "Backup done",
+		Title:    "Backups",
+		Priority: 4,
+		Tags:     []string{"floppy_disk", "ok"},
+	})
+	require.Nil(t, err)
+	require.Equal(t, "message", m.Event)
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, int32(4), m.Priority)
+
+	stream, err := client.Subscribe(context.Background(), &ntfypb.SubscribeRequest{Topics: []string{"mytopic"}, Since: "all", Poll: true})
+	require.Nil(t, err)
+	polled, err := stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, m.Id, polled.Id)
+	require.Equal(t, "Backups", polled.Title)
+	require.Equal(t, "Backup done", polled.Message)
+	require.Equal(t, []string{"floppy_disk", "ok"}, polled.Tags)
+	_, err = stream.Recv()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestServer_GRPC_Subscribe(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	client := newTestGRPCClient(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Subscribe(ctx, &ntfypb.SubscribeRequest{Topics: []string{"mytopic", "othertopic"}})
+	require.Nil(t, err)
+	open, err := stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, "open", open.Event)
+
+	request(t, s, "PUT", "/othertopic", "from HTTP", nil)
+	m, err := stream.Recv()
+	require.Nil(t, err)
+	require.Equal(t, "othertopic", m.Topic)
+	require.Equal(t, "from HTTP", m.Message)
+}
+
+func TestServer_GRPC_Auth(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "mytopic", true, true))
+	client := newTestGRPCClient(t, s)
+
+	_, err := client.Publish(context.Background(), &ntfypb.PublishRequest{Topic: "mytopic", Message: "anonymous"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.Publish(context.Background(), &ntfypb.PublishRequest{Topic: "not a topic"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", basicAuth("phil:phil"))
+	m, err := client.Publish(ctx, &ntfypb.PublishRequest{Topic: "mytopic", Message: "authenticated"})
+	require.Nil(t, err)
+	require.Equal(t, "authenticated", m.Message)
+}
+
+func TestServer_GRPC_ForwardedForIgnored(t *testing.T) {
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	client := newTestGRPCClient(t, s)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-forwarded-for", "1.2.3.4")
+	_, err := client.Publish(ctx, &ntfypb.PublishRequest{Topic: "mytopic", Message: "spoofed"})
+	require.Nil(t, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.NotContains(t, s.visitors, "1.2.3.4")
+	require.Contains(t, s.visitors, "bufconn") // The address of the gRPC client
+}
+
+func TestServer_GRPCWeb_BehindProxy(t *testing.T) {
+	c := newTestConfig(t)
+	c.EnableGRPCWeb = true
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	payload, err := proto.Marshal(&ntfypb.PublishRequest{Topic: "mytopic", Message: "from the browser"})
+	require.Nil(t, err)
+	response := request(t, s, "POST", "/ntfy.v1.Ntfy/Publish", string(grpcWebFrame(grpcWebFrameData, payload)), map[string]string{
+		"Content-Type":    "application/grpc-web+proto",
+		"X-Forwarded-For": "1.2.3.4", // Set by the proxy in front of the HTTP server
+	})
+	require.Equal(t, 200, response.Code)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Contains(t, s.visitors, "1.2.3.4")
+}
+
+func TestServer_GRPCWeb_Publish(t *testing.T) {
+	c := newTestConfig(t)
+	c.EnableGRPCWeb = true
+	s := newTestServer(t, c)
+
+	payload, err := proto.Marshal(&ntfypb.PublishRequest{Topic: "mytopic", Message: "from the browser"})
+	require.Nil(t, err)
+	response := request(t, s, "POST", "/ntfy.v1.Ntfy/Publish", string(grpcWebFrame(grpcWebFrameData, payload)), map[string]string{
+		"Content-Type": "application/grpc-web+proto",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/grpc-web+proto", response.Header().Get("Content-Type"))
+
+	body := response.Body.Bytes()
+	require.Equal(t, byte(grpcWebFrameData), body[0])
+	length := binary.BigEndian.Uint32(body[1:5])
+	var m ntfypb.Message
+	require.Nil(t, proto.Unmarshal(body[5:5+length], &m))
+	require.Equal(t, "from the browser", m.Message)
+	trailer := body[5+length:]
+	require.Equal(t, byte(grpcWebFrameTrailer), trailer[0])
+	require.True(t, strings.HasPrefix(string(trailer[5:]), "grpc-status: 0\r\n"))
+
+	messages := toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", nil).Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, m.Id, messages[0].ID)
+}
+
+func TestServer_GRPCWeb_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "POST", "/ntfy.v1.Ntfy/Publish", string(grpcWebFrame(grpcWebFrameData, nil)), map[string]string{
+		"Content-Type": "application/grpc-web+proto",
+	})
+	require.Equal(t, 404, response.Code)
+}
+
+func newTestGRPCClient(t *testing.T, s *Server) ntfypb.NtfyClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	ntfypb.RegisterNtfyServer(server, &grpcService{s: s})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return listener.DialContext(ctx)
+	}
+	conn, err := grpc.DialContext(context.Background(), "bufnet", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return ntfypb.NewNtfyClient(conn)
+}
+
+func grpcWebFrame(flag byte, payload []byte) []byte {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"heckel.io/ntfy/server/ntfypb"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// gRPC-Web lets browsers (and HTTP/1.1 clients) call the gRPC API through the regular HTTP listeners. Requests and
+// responses are length-prefixed protobuf frames, and the status is sent as a final trailer frame in the body, since
+// browsers cannot read HTTP trailers. See https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+
+const (
+	grpcWebRequestMaxBytes = 64 * 1024 // Plenty for a PublishRequest; attachments can only be passed by URL
+	grpcWebFrameData       = 0x00
+	grpcWebFrameTrailer    = 0x80
+)
+
+var (
+	grpcWebPathRegex = regexp.MustCompile(`^/ntfy\.v1\.Ntfy/(Publish|Subscribe)$`)
+)
+
+// handleGRPCWeb handles a gRPC-Web call (application/grpc-web+proto, or application/grpc-web-text+proto for the
+// base64 variant) by decoding the request frame and calling the gRPC service directly. Rate limiting and access
+// control are applied by the service's internal HTTP request, so the call itself is not wrapped.
+func (s *Server) handleGRPCWeb(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	contentType := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/grpc-web") {
+		return errHTTPBadRequestGRPCWebInvalid
+	}
+	text := strings.HasPrefix(contentType, "application/grpc-web-text")
+	var body io.Reader = io.LimitReader(r.Body, grpcWebRequestMaxBytes)
+	if text {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	payload, err := readGRPCWebFrame(body)
+	if err != nil {
+		return errHTTPBadRequestGRPCWebInvalid
+	}
+	md := metadata.MD{}
+	for k, v := range r.Header {
+		md.Append(k, v...)
+	}
+	ctx := metadata.NewIncomingContext(r.Context(), md)
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: grpcWebAddr(s.visitorIP(r))}) // Unlike for gRPC, the proxy is trusted here
+	stream := &grpcWebStream{ctx: ctx, w: w, text: text}
+	service := &grpcService{s: s}
+	if grpcWebPathRegex.FindStringSubmatch(r.URL.Path)[1] == "Publish" {
+		var req ntfypb.PublishRequest
+		if err := proto.Unmarshal(payload, &req); err != nil {
+			return errHTTPBadRequestGRPCWebInvalid
+		}
+		stream.writeHeader()
+		m, err := service.Publish(ctx, &req)
+		if err == nil {
+			err = stream.Send(m)
+		}
+		return stream.writeTrailer(err)
+	}
+	var req ntfypb.SubscribeRequest
+	if err := proto.Unmarshal(payload, &req); err != nil {
+		return errHTTPBadRequestGRPCWebInvalid
+	}
+	stream.writeHeader()
+	return stream.writeTrailer(service.Subscribe(&req, stream))
+}
+
+func readGRPCWebFrame(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	} else if prefix[0] != grpcWebFrameData {
+		return nil, fmt.Errorf("unexpected frame type %d", prefix[0])
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > grpcWebRequestMaxBytes {
+		return nil, fmt.Errorf("frame too large")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// grpcWebStream writes the response frames of a gRPC-Web call. It implements ntfypb.Ntfy_SubscribeServer, so that
+// it can be passed to grpcService.Subscribe like a native gRPC stream.
+type grpcWebStream struct {
+	ctx  context.Context
+	w    http.ResponseWriter
+	text bool // Frames are base64-encoded, for application/grpc-web-text
+}
+
+var _ ntfypb.Ntfy_SubscribeServer = (*grpcWebStream)(nil)
+
+func (s *grpcWebStream) writeHeader() {
+	contentType := "application/grpc-web+proto"
+	if s.text {
+		contentType = "application/grpc-web-text+proto"
+	}
+	s.w.Header().Set("Content-Type", contentType)
+	s.w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	s.w.Header().Set("Access-Control-Expose-Headers", "grpc-status, grpc-message")
+	s.w.WriteHeader(http.StatusOK)
+}
+
+func (s *grpcWebStream) writeFrame(flag byte, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	if s.text {
+		frame = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+	if _, err := s.w.Write(frame); err != nil {
+		return err
+	}
+	if fl, ok := s.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return nil
+}
+
+// writeTrailer ends the call with the gRPC status of err. Errors cannot be returned to the HTTP handler anymore
+// at this point, since the response has been started already.
+func (s *grpcWebStream) writeTrailer(err error) error {
+	st := status.Convert(err)
+	trailer := fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %s\r\n", st.Code(), url.PathEscape(st.Message()))
+	if err := s.writeFrame(grpcWebFrameTrailer, []byte(trailer)); err != nil && s.ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func (s *grpcWebStream) Send(m *ntfypb.Message) error {
+	return s.SendMsg(m)
+}
+
+func (s *grpcWebStream) SendMsg(m interface{}) error {
+	pm, ok := m.(proto.Message)
+	if !ok {
+		return status.Errorf(codes.Internal, "unexpected message type %T", m)
+	}
+	payload, err := proto.Marshal(pm)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return s.writeFrame(grpcWebFrameData, payload)
+}
+
+func (s *grpcWebStream) RecvMsg(_ interface{}) error {
+	return io.EOF // The only request message has been read already, see handleGRPCWeb
+}
+
+func (s *grpcWebStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *grpcWebStream) SetHeader(_ metadata.MD) error {
+	return nil
+}
+
+func (s *grpcWebStream) SendHeader(_ metadata.MD) error {
+	return nil
+}
+
+func (s *grpcWebStream) SetTrailer(_ metadata.MD) {}
+
+// grpcWebAddr is the net.Addr of the peer of a gRPC-Web call, i.e. the IP address of the visitor of the HTTP request
+type grpcWebAddr string
+
+func (a grpcWebAddr) Network() string {
+	return "tcp"
+}
+
+func (a grpcWebAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	heartbeatMinInterval      = time.Minute
+	heartbeatMaxInterval      = 31 * 24 * time.Hour // Enough for monthly jobs
+	heartbeatMessageMaxLength = 1024
+	heartbeatAlertPriority    = 4
+	heartbeatSenderIP         = "server"     // Shown in alert e-mails in place of the IP address of a publisher
+	heartbeatVisitorPrefix    = "heartbeat:" // Visitor of a user's alert e-mails, if the user's tier sets no e-mail limit
+)
+
+var (
+	heartbeatPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/heartbeat$`)
+)
+
+// handleTopicHeartbeat returns the heartbeat of a topic, e.g.
+// {"topic":"backups","interval":"25h","target":"alerts","due":1700000000,"alerted":false}
+func (s *Server) handleTopicHeartbeat(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden // The heartbeat may contain an e-mail address, so only owners may see it
+	}
+	h, err := s.messageCache.Heartbeat(t.ID)
+	if err != nil {
+		return err
+	} else if h == nil {
+		h = &heartbeat{Topic: t.ID}
+	}
+	return writeJSON(w, h)
+}
+
+// handleTopicHeartbeatUpdate sets the heartbeat of a topic, which starts counting right away. Only owners of the topic
+// may do this (the route only exists if access control is enabled), and they need write access to the target topic
+// and the e-mail permission for e-mail alerts. Passing no interval removes it.
+func (s *Server) handleTopicHeartbeatUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	var h heartbeat
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&h); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	if h.Interval == "" {
+		if err := s.messageCache.DeleteHeartbeat(t.ID); err != nil {
+			return err
+		}
+		log.Printf("[%s] Removed heartbeat of topic %s", v.ip, t.ID)
+		return writeJSON(w, &heartbeat{Topic: t.ID})
+	}
+	h.Topic, h.User = t.ID, userFromRequest(r).Name
+	interval, err := s.validateHeartbeat(r, &h)
+	if err != nil {
+		return err
+	}
+	h.Due = time.Now().Add(interval).Unix()
+	h.Alerted = false
+	if err := s.messageCache.UpdateHeartbeat(&h); err != nil {
+		return err
+	}
+	log.Printf("[%s] Updated heartbeat of topic %s (interval %s)", v.ip, t.ID, h.Interval)
+	return writeJSON(w, &h)
+}
+
+// validateHeartbeat checks the interval and the alert targets of the heartbeat, and returns the parsed interval
+func (s *Server) validateHeartbeat(r *http.Request, h *heartbeat) (time.Duration, error) {
+	h.Target = strings.TrimSpace(h.Target)
+	h.Email = strings.TrimSpace(h.Email)
+	interval, err := time.ParseDuration(h.Interval)
+	if err != nil || interval < heartbeatMinInterval || interval > heartbeatMaxInterval {
+		return 0, wrapErrHTTP(errHTTPBadRequestHeartbeatInvalid, "interval must be between %s and %s", heartbeatMinInterval, heartbeatMaxInterval)
+	} else if h.Target == "" && h.Email == "" {
+		return 0, wrapErrHTTP(errHTTPBadRequestHeartbeatInvalid, "a target topic or an e-mail address is required")
+	} else if h.Target != "" && (!topicRegex.MatchString(h.Target) || h.Target == h.Topic) {
+		return 0, wrapErrHTTP(errHTTPBadRequestHeartbeatInvalid, "invalid target topic %s", h.Target)
+	} else if len(h.Message) > heartbeatMessageMaxLength {
+		return 0, wrapErrHTTP(errHTTPBadRequestHeartbeatInvalid, "message must not be longer than %d characters", heartbeatMessageMaxLength)
+	}
+	if h.Target != "" {
+		if err := s.authorizeTopics(r, auth.PermissionWrite, h.Target); err != nil {
+			return 0, err
+		}
+	}
+	if h.Email != "" {
+		if s.mailer == nil {
+			return 0, errHTTPBadRequestEmailDisabled
+		} else if err := s.authorizeTopics(r, auth.PermissionEmail, h.Topic); err != nil {
+			return 0, err
+		}
+	}
+	return interval, nil
+}
+
+// heartbeatReceived resets the heartbeat of the message's topic, if it has one. If the alert was already sent,
+// a recovery notice is published to the target topic. Since this is called for every message, it must not be
+// called with s.mu held, so that publishing to other topics isn't blocked by the cache.
+func (s *Server) heartbeatReceived(m *message) error {
+	s.heartbeatMu.Lock()
+	defer s.heartbeatMu.Unlock()
+	h, err := s.messageCache.Heartbeat(m.Topic)
+	if err != nil || h == nil {
+		return err
+	}
+	interval, err := time.ParseDuration(h.Interval)
+	if err != nil {
+		return err
+	}
+	alerted := h.Alerted
+	h.Due = time.Now().Add(interval).Unix()
+	h.Alerted = false
+	if err := s.messageCache.UpdateHeartbeat(h); err != nil {
+		return err
+	}
+	if alerted && h.Target != "" {
+		log.Printf("Heartbeat of topic %s recovered", h.Topic)
+		recovered := newDefaultMessage(h.Target, fmt.Sprintf("Topic %s is receiving messages again", h.Topic))
+		recovered.Title = "Heartbeat recovered: " + h.Topic
+		recovered.Tags = []string{"white_check_mark"}
+		return s.publishHeartbeatMessage(recovered)
+	}
+	return nil
+}
+
+// sendHeartbeatAlerts sends the alerts of all heartbeats whose topic has not seen a message in time. Each heartbeat
+// alerts only once, until the next message is published to the topic, see heartbeatReceived.
+func (s *Server) sendHeartbeatAlerts() error {
+	s.heartbeatMu.Lock()
+	defer s.heartbeatMu.Unlock()
+	heartbeats, err := s.messageCache.HeartbeatsDue()
+	if err != nil {
+		return err
+	}
+	for _, h := range heartbeats {
+		m := newHeartbeatAlertMessage(h)
+		if h.Target != "" {
+			if err := s.publishHeartbeatMessage(m); err != nil {
+				return err
+			}
+		}
+		if h.Email != "" && s.mailer != nil {
+			if err := s.heartbeatEmailAllowed(h); err != nil {
+				log.Printf("Heartbeat of topic %s missed, not sending alert e-mail: %s", h.Topic, err.Error())
+			} else {
+				go s.sendEmail(heartbeatSenderIP, h.Email, m)
+			}
+		}
+		log.Printf("Heartbeat of topic %s missed, no message in the last %s", h.Topic, h.Interval)
+		h.Alerted = true
+		if err := s.messageCache.UpdateHeartbeat(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// heartbeatEmailAllowed checks that the user who set up the heartbeat still has the e-mail permission on the topic,
+// and that the alert e-mail is within their e-mail limit. If their tier does not set one, the visitor limit applies
+// to the alert e-mails of all of their heartbeats. Must not be called with s.mu held.
+func (s *Server) heartbeatEmailAllowed(h *heartbeat) error {
+	manager, ok := s.auth.(auth.Manager)
+	if !ok || h.User == "" {
+		return errHTTPForbidden
+	}
+	user, err := manager.User(h.User)
+	if err != nil {
+		return err
+	} else if err := s.auth.Authorize(user, h.Topic, auth.PermissionEmail); err != nil {
+		return errHTTPForbidden
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.userEmailAllowed(user, s.visitorFromIP(heartbeatVisitorPrefix+user.Name))
+}
+
+// publishHeartbeatMessage publishes an alert or recovery notice to the target topic. Must not be called with s.mu held.
+func (s *Server) publishHeartbeatMessage(m *message) error {
+	s.mu.Lock()
+	t, ok := s.topics[m.Topic]
+	s.mu.Unlock()
+	if ok {
+		if err := t.Publish(m); err != nil {
+			log.Printf("unable to publish heartbeat message to topic %s: %v", m.Topic, err.Error())
+		}
+	}
+	s.publishFirehose(m)
+	go s.forwardWebhooks(m)
+	s.forwardMatrix(m)
+	go s.forwardTelegram(m)
+	if s.firebase != nil {
+		go func() {
+			if err := s.firebase(m); err != nil {
+				log.Printf("unable to publish to Firebase: %v", err.Error())
+			}
+		}()
+	}
+	if err := s.messageCache.AddMessage(m); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.messages++
+	s.mu.Unlock()
+	return nil
+}
+
+// newHeartbeatAlertMessage creates the alert of a missed heartbeat. It is published to the target topic, or to the
+// watched topic if it is only sent as e-mail, so that the e-mail links to the right topic.
+func newHeartbeatAlertMessage(h *heartbeat) *message {
+	text := h.Message
+	if text == "" {
+		text = fmt.Sprintf("No message was published to topic %s in the last %s", h.Topic, h.Interval)
+	}
+	topic := h.Target
+	if topic == "" {
+		topic = h.Topic
+	}
+	m := newDefaultMessage(topic, text)
+	m.Title = "Heartbeat missed: " + h.Topic
+	m.Priority = heartbeatAlertPriority
+	m.Tags = []string{"rotating_light"}
+	return m
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"testing"
+	"time"
+)
+
+func TestServer_Heartbeat(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "backups", "alerts")
+	response := request(t, s, "GET", "/backups/heartbeat", "", phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "", toHeartbeat(t, response.Body.String()).Interval)
+
+	response = request(t, s, "PUT", "/backups/heartbeat", `{"interval":"25h","target":"alerts"}`, phil)
+	require.Equal(t, 200, response.Code)
+	h := toHeartbeat(t, response.Body.String())
+	require.Equal(t, "backups", h.Topic)
+	require.Equal(t, "alerts", h.Target)
+	require.InDelta(t, time.Now().Add(25*time.Hour).Unix(), h.Due, 2)
+
+	// Not due yet
+	require.Nil(t, s.sendHeartbeatAlerts())
+	require.Empty(t, request(t, s, "GET", "/alerts/json?poll=1", "", nil).Body.String())
+
+	// Missed heartbeats alert only once
+	makeHeartbeatDue(t, s, "backups")
+	require.Nil(t, s.sendHeartbeatAlerts())
+	require.Nil(t, s.sendHeartbeatAlerts())
+	messages := toMessages(t, request(t, s, "GET", "/alerts/json?poll=1", "", nil).Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, "Heartbeat missed: backups", messages[0].Title)
+	require.Equal(t, "No message was published to topic backups in the last 25h", messages[0].Message)
+	require.Equal(t, 4, messages[0].Priority)
+	response = request(t, s, "GET", "/backups/heartbeat", "", phil)
+	require.True(t, toHeartbeat(t, response.Body.String()).Alerted)
+
+	// The next message resets the heartbeat, and publishes a recovery notice
+	request(t, s, "PUT", "/backups", "Backup done", phil)
+	messages = toMessages(t, request(t, s, "GET", "/alerts/json?poll=1", "", nil).Body.String())
+	require.Len(t, messages, 2)
+	require.Equal(t, "Topic backups is receiving messages again", messages[1].Message)
+	h = toHeartbeat(t, request(t, s, "GET", "/backups/heartbeat", "", phil).Body.String())
+	require.False(t, h.Alerted)
+	require.True(t, h.Due > time.Now().Add(24*time.Hour).Unix())
+
+	// No interval removes the heartbeat
+	response = request(t, s, "PUT", "/backups/heartbeat", `{}`, phil)
+	require.Equal(t, 200, response.Code)
+	heartbeat, err := s.messageCache.Heartbeat("backups")
+	require.Nil(t, err)
+	require.Nil(t, heartbeat)
+}
+
+func TestServer_Heartbeat_EmailAndMessage(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "cron")
+	response := request(t, s, "PUT", "/cron/heartbeat", `{"interval":"10m","email":"ops@example.com"}`, phil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40001, toHTTPError(t, response.Body.String()).Code) // E-mail not enabled
+
+	mailer := &testMailer{}
+	s.mailer = mailer
+	response = request(t, s, "PUT", "/cron/heartbeat", `{"interval":"10m","email":"ops@example.com","message":"Nightly job did not run"}`, phil)
+	require.Equal(t, 200, response.Code)
+	makeHeartbeatDue(t, s, "cron")
+	require.Nil(t, s.sendHeartbeatAlerts())
+	require.Eventually(t, func() bool {
+		return mailer.Count() == 1
+	}, time.Second, 10*time.Millisecond)
+	mailer.mu.Lock()
+	require.Equal(t, "cron", mailer.last.Topic)
+	require.Equal(t, "Nightly job did not run", mailer.last.Message)
+	mailer.mu.Unlock()
+}
+
+func TestServer_Heartbeat_EmailLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorEmailLimitBurst = 1
+	s, phil := newTestServerWithTopicOwner(t, c, "cron")
+	mailer := &testMailer{}
+	s.mailer = mailer
+	response := request(t, s, "PUT", "/cron/heartbeat", `{"interval":"10m","email":"ops@example.com","user":"ben"}`, phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "phil", toHeartbeat(t, response.Body.String()).User)
+	makeHeartbeatDue(t, s, "cron")
+	require.Nil(t, s.sendHeartbeatAlerts())
+	require.Eventually(t, func() bool {
+		return mailer.Count() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The e-mail limit of the user who set up the heartbeat applies, the alert is skipped once it is exhausted
+	request(t, s, "PUT", "/cron", "Job done", phil)
+	makeHeartbeatDue(t, s, "cron")
+	require.Nil(t, s.sendHeartbeatAlerts())
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, mailer.Count())
+	require.True(t, toHeartbeat(t, request(t, s, "GET", "/cron/heartbeat", "", phil).Body.String()).Alerted)
+
+	// Within the limit of the user's tier
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddTier(&auth.Tier{Code: "pro", EmailsLimit: 10}))
+	require.Nil(t, manager.ChangeTier("phil", "pro"))
+	request(t, s, "PUT", "/cron", "Job done", phil)
+	makeHeartbeatDue(t, s, "cron")
+	require.Nil(t, s.sendHeartbeatAlerts())
+	require.Eventually(t, func() bool {
+		return mailer.Count() == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServer_Heartbeat_Invalid(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "backups", "alerts")
+	for _, body := range []string{
+		`{"interval":"30s","target":"alerts"}`,
+		`{"interval":"800h","target":"alerts"}`,
+		`{"interval":"daily","target":"alerts"}`,
+		`{"interval":"1h"}`,
+		`{"interval":"1h","target":"backups"}`,
+		`{"interval":"1h","target":"al/erts"}`,
+	} {
+		response := request(t, s, "PUT", "/backups/heartbeat", body, phil)
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40053, toHTTPError(t, response.Body.String()).Code, body)
+	}
+}
+
+func TestServer_Heartbeat_Auth(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "backups")
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "backups", true, false))
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	// Phil needs write access to the target topic
+	response := request(t, s, "PUT", "/backups/heartbeat", `{"interval":"25h","target":"alerts"}`, phil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/backups/heartbeat", `{"interval":"25h","target":"alerts"}`, ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/backups/heartbeat", "", ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/backups/heartbeat", "", nil)
+	require.Equal(t, 403, response.Code)
+
+	// Without access control, nobody owns a topic
+	s = newTestServer(t, newTestConfig(t))
+	response = request(t, s, "PUT", "/backups/heartbeat", `{"interval":"25h","target":"alerts"}`, nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "GET", "/backups/heartbeat", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_Heartbeat_FirebaseAsync(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "backups", "alerts")
+	release := make(chan bool)
+	defer close(release)
+	pushed := make(chan *message, 2)
+	s.firebase = func(m *message) error {
+		pushed <- m
+		<-release // A slow push must neither block the alerts, nor other publishers
+		return nil
+	}
+	response := request(t, s, "PUT", "/backups/heartbeat", `{"interval":"25h","target":"alerts"}`, phil)
+	require.Equal(t, 200, response.Code)
+	makeHeartbeatDue(t, s, "backups")
+	require.Nil(t, s.sendHeartbeatAlerts())
+	require.Equal(t, "Heartbeat missed: backups", (<-pushed).Title)
+	response = request(t, s, "PUT", "/backups", "Backup done", map[string]string{"Authorization": phil["Authorization"], "Firebase": "no"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "Heartbeat recovered: backups", (<-pushed).Title)
+}
+
+func makeHeartbeatDue(t *testing.T, s *Server, topic string) {
+	h, err := s.messageCache.Heartbeat(topic)
+	require.Nil(t, err)
+	h.Due = time.Now().Add(-time.Second).Unix()
+	require.Nil(t, s.messageCache.UpdateHeartbeat(h))
+}
+
+func toHeartbeat(t *testing.T, s string) *heartbeat {
+	var h heartbeat
+	require.Nil(t, json.Unmarshal([]byte(s), &h))
+	return &h
+}
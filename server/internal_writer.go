@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// internalResponseWriter is the http.ResponseWriter of internal HTTP requests, i.e. requests that the server sends
+// to its own handlers on behalf of the gRPC or MQTT listeners. If send is set, the body of a successful response is
+// expected to be JSON lines (as written by handleSubscribeJSON), which are passed to send one by one as they are
+// written. Otherwise, and for error responses, the body is buffered.
+type internalResponseWriter struct {
+	header http.Header
+	code   int
+	buf    bytes.Buffer
+	send   func(m *message) error
+	err    error // First error returned by send, the client most likely went away
+}
+
+var _ http.Flusher = (*internalResponseWriter)(nil)
+
+func newInternalResponseWriter(send func(m *message) error) *internalResponseWriter {
+	return &internalResponseWriter{
+		header: make(http.Header),
+		send:   send,
+	}
+}
+
+func (w *internalResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *internalResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *internalResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buf.Write(p)
+	if w.send == nil || w.code != http.StatusOK {
+		return len(p), nil
+	}
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := w.buf.Next(i + 1)
+		var m message
+		if err := json.Unmarshal(line, &m); err != nil {
+			w.err = err
+			return 0, err
+		}
+		if err := w.send(&m); err != nil {
+			w.err = err
+			return 0, err
+		}
+	}
+}
+
+// Flush does nothing, since messages are sent as soon as they are written
+func (w *internalResponseWriter) Flush() {}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/russross/blackfriday/v2"
+	"regexp"
+	"strings"
+)
+
+const (
+	// markdownHTMLFlags sanitize the rendered HTML: raw HTML is dropped, links to untrusted protocols (e.g. javascript:)
+	// are not rendered as links, and images are skipped, since they would be loaded from arbitrary servers
+	markdownHTMLFlags = blackfriday.SkipHTML | blackfriday.SkipImages | blackfriday.Safelink |
+		blackfriday.NofollowLinks | blackfriday.NoreferrerLinks | blackfriday.NoopenerLinks | blackfriday.HrefTargetBlank
+)
+
+var (
+	markdownNewlinesRegex = regexp.MustCompile(`\n{3,}`)
+)
+
+// renderMessageMarkdown treats the message body as Markdown (X-Markdown: yes). The raw source is kept in the
+// markdown field, the sanitized HTML (for the web app) in the html field, and the message itself is replaced by
+// a plain text version, so that clients that don't render Markdown (Android, CLI, e-mail) don't show the syntax.
+func renderMessageMarkdown(m *message) {
+	html, text := renderMarkdown(m.Message)
+	m.Markdown = m.Message
+	m.HTML = html
+	m.Message = text
+	if m.Message == "" {
+		m.Message = emptyMessageBody
+	}
+}
+
+// renderMarkdown returns the sanitized HTML and the plain text version of the given Markdown source
+func renderMarkdown(source string) (html string, text string) {
+	parser := blackfriday.New(blackfriday.WithExtensions(blackfriday.CommonExtensions))
+	document := parser.Parse([]byte(source))
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{Flags: markdownHTMLFlags})
+	var buf bytes.Buffer
+	document.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		return renderer.RenderNode(&buf, node, entering)
+	})
+	return strings.TrimSpace(buf.String()), markdownText(document)
+}
+
+// markdownText strips the Markdown syntax, keeping the text, the targets of links, list bullets and line breaks
+func markdownText(document *blackfriday.Node) string {
+	var buf strings.Builder
+	links := make([]int, 0) // Start of the link texts, to compare them to the link targets
+	document.Walk(func(node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+		switch node.Type {
+		case blackfriday.Text, blackfriday.Code, blackfriday.CodeBlock:
+			buf.Write(node.Literal)
+		case blackfriday.HTMLBlock, blackfriday.HTMLSpan:
+			return blackfriday.SkipChildren
+		case blackfriday.Softbreak, blackfriday.Hardbreak, blackfriday.HorizontalRule:
+			buf.WriteString("\n")
+		case blackfriday.Link:
+			if entering {
+				links = append(links, buf.Len())
+			} else {
+				start := links[len(links)-1]
+				links = links[:len(links)-1]
+				if destination := string(node.LinkData.Destination); buf.String()[start:] != destination {
+					buf.WriteString(" (" + destination + ")")
+				}
+			}
+		case blackfriday.List:
+			if !entering && node.Parent != nil && node.Parent.Type != blackfriday.Item {
+				buf.WriteString("\n")
+			}
+		case blackfriday.Item:
+			if entering && node.ListFlags&blackfriday.ListTypeOrdered != 0 {
+				buf.WriteString(fmt.Sprintf("%d. ", markdownItemNumber(node)))
+			} else if entering {
+				buf.WriteString("- ")
+			}
+		case blackfriday.Paragraph, blackfriday.Heading, blackfriday.TableRow:
+			if !entering && node.Parent != nil && node.Parent.Type == blackfriday.Item {
+				buf.WriteString("\n")
+			} else if !entering {
+				buf.WriteString("\n\n")
+			}
+		case blackfriday.TableCell:
+			if !entering && node.Next != nil {
+				buf.WriteString(" | ")
+			}
+		}
+		return blackfriday.GoToNext
+	})
+	return strings.TrimSpace(markdownNewlinesRegex.ReplaceAllString(buf.String(), "\n\n"))
+}
+
+func markdownItemNumber(item *blackfriday.Node) int {
+	number := 1
+	for n := item.Prev; n != nil; n = n.Prev {
+		number++
+	}
+	return number
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	html, text := renderMarkdown("# Backup report\n\nThe backup of **nas01** failed, see [logs](https://example.com/logs) or https://example.com.\n\n- Disk full\n- Retried `3` times\n\n1. Free space\n2. Retry")
+	require.Equal(t, `<h1>Backup report</h1>
+
+<p>The backup of <strong>nas01</strong> failed, see <a href="https://example.com/logs" target="_blank" rel="nofollow noreferrer noopener">logs</a> or <a href="https://example.com" target="_blank" rel="nofollow noreferrer noopener">https://example.com</a>.</p>
+
+<ul>
+<li>Disk full</li>
+<li>Retried <code>3</code> times</li>
+</ul>
+
+<ol>
+<li>Free space</li>
+<li>Retry</li>
+</ol>`, html)
+	require.Equal(t, "Backup report\n\nThe backup of nas01 failed, see logs (https://example.com/logs) or https://example.com.\n\n- Disk full\n- Retried 3 times\n\n1. Free space\n2. Retry", text)
+}
+
+func TestRenderMarkdown_Sanitize(t *testing.T) {
+	html, text := renderMarkdown("<script>alert(1)</script>\n\nClick [here](javascript:alert(1)) <b onclick=\"alert(1)\">now</b> ![tracker](https://example.com/pixel.png)")
+	require.NotContains(t, html, "<script")
+	require.NotContains(t, html, "onclick")
+	require.NotContains(t, html, "javascript:")
+	require.NotContains(t, html, "<img")
+	require.Equal(t, "Click here (javascript:alert(1)) now tracker", text)
+}
+
+func TestServer_PublishMarkdown(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/backups", "**Backup** of nas01 failed", map[string]string{"X-Markdown": "yes"})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Backup of nas01 failed", m.Message)
+	require.Equal(t, "**Backup** of nas01 failed", m.Markdown)
+	require.Equal(t, "<p><strong>Backup</strong> of nas01 failed</p>", m.HTML)
+
+	response = request(t, s, "POST", "/", `{"topic":"backups","message":"_Retrying_","markdown":true}`, nil)
+	require.Equal(t, "<p><em>Retrying</em></p>", toMessage(t, response.Body.String()).HTML)
+
+	response = request(t, s, "PUT", "/backups", "**Not** markdown", nil)
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, "**Not** markdown", m.Message)
+	require.Equal(t, "", m.HTML)
+
+	response = request(t, s, "GET", "/backups/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Len(t, messages, 3)
+	require.Equal(t, "**Backup** of nas01 failed", messages[0].Markdown)
+}
@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/util"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The Matrix bridge relays messages between Matrix rooms and ntfy topics, as configured with matrix-room. It acts
+// as a regular Matrix user (a bot account, see matrix-access-token) via the client-server API, so that it works
+// with any homeserver, and does not have to be registered as an appservice:
+//
+//   - Messages in a bridged room are read with long-polling /sync requests, and published to the topic with
+//     internal HTTP requests (like the MQTT listener), so that access control and rate limiting work like for HTTP.
+//   - Messages published to a bridged topic are sent to the room as the bot, see forwardMatrix.
+//
+// Messages are never relayed back to where they came from: the bot's own messages are ignored when syncing, and
+// messages published by the bridge are marked with matrixContextKey, so that they are not forwarded to Matrix.
+
+const (
+	matrixSyncTimeout    = 30 * time.Second // Long-polling timeout of /sync requests
+	matrixRequestTimeout = matrixSyncTimeout + 15*time.Second
+	matrixRetryDelay     = 10 * time.Second // Delay after a failed sync, e.g. if the homeserver is unavailable
+	matrixErrorMaxBytes  = 4096
+	matrixEventMessage   = "m.room.message"
+	matrixRelReplace     = "m.replace" // Edits, which are not relayed
+	matrixFormatHTML     = "org.matrix.custom.html"
+)
+
+var (
+	matrixTextMsgTypes = []string{"m.text", "m.notice", "m.emote"} // Other types (images, files, ...) are ignored
+)
+
+// matrixContextKey marks internal publish requests of the Matrix bridge, see matrixBridged
+type matrixContextKey struct{}
+
+// matrixBridge is the Matrix client of the bridge
+type matrixBridge struct {
+	homeserver string            // Base URL of the homeserver, without trailing slash
+	token      string            // Access token of the bot account
+	rooms      map[string]string // Topic, by room ID
+	remoteAddr string            // Of the internal requests; the host of the homeserver
+	client     *http.Client
+	userID     string // Matrix ID of the bot account, set by connect
+}
+
+type matrixSyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join   map[string]*matrixJoinedRoom `json:"join"`
+		Invite map[string]json.RawMessage   `json:"invite"`
+	} `json:"rooms"`
+}
+
+type matrixJoinedRoom struct {
+	Timeline struct {
+		Events []*matrixEvent `json:"events"`
+	} `json:"timeline"`
+}
+
+type matrixEvent struct {
+	Type    string                `json:"type"`
+	EventID string                `json:"event_id"`
+	Sender  string                `json:"sender"`
+	Content *matrixMessageContent `json:"content"`
+}
+
+// matrixMessageContent is the content of m.room.message events, see https://spec.matrix.org/latest/client-server-api/#mroommessage
+type matrixMessageContent struct {
+	MsgType       string               `json:"msgtype"`
+	Body          string               `json:"body"`
+	Format        string               `json:"format,omitempty"`
+	FormattedBody string               `json:"formatted_body,omitempty"`
+	RelatesTo     *matrixEventRelation `json:"m.relates_to,omitempty"`
+}
+
+type matrixEventRelation struct {
+	RelType string `json:"rel_type"`
+}
+
+type matrixError struct {
+	Status  int    `json:"-"`
+	ErrCode string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *matrixError) Error() string {
+	if e.ErrCode == "" {
+		return fmt.Sprintf("unexpected status %d", e.Status)
+	}
+	return fmt.Sprintf("unexpected status %d: %s (%s)", e.Status, e.Message, e.ErrCode)
+}
+
+func newMatrixBridge(conf *Config) *matrixBridge {
+	homeserver := strings.TrimSuffix(conf.MatrixHomeserver, "/")
+	remoteAddr := homeserver
+	if u, err := url.Parse(homeserver); err == nil && u.Host != "" {
+		remoteAddr = u.Host
+	}
+	return &matrixBridge{
+		homeserver: homeserver,
+		token:      conf.MatrixAccessToken,
+		rooms:      conf.MatrixRooms,
+		remoteAddr: remoteAddr,
+		client:     &http.Client{Timeout: matrixRequestTimeout},
+	}
+}
+
+// runMatrixBridge relays the messages of the bridged rooms to their topics until the server is stopped. Errors
+// are logged and retried, since they are most likely temporary (homeserver restarts, network issues, ...).
+func (s *Server) runMatrixBridge() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.closeChan
+		cancel()
+	}()
+	since := ""
+	for ctx.Err() == nil {
+		var err error
+		if s.matrix.userID == "" {
+			err = s.matrix.connect(ctx)
+		} else {
+			since, err = s.syncMatrix(ctx, since)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("MATRIX - %s, retrying in %s", err.Error(), matrixRetryDelay)
+			select {
+			case <-ctx.Done():
+			case <-time.After(matrixRetryDelay):
+			}
+		}
+	}
+}
+
+// syncMatrix waits for new events in the bridged rooms, publishes their messages, and returns the token of the
+// next sync. The history of the rooms is not relayed, so the events of the initial sync are skipped.
+func (s *Server) syncMatrix(ctx context.Context, since string) (string, error) {
+	resp, err := s.matrix.sync(ctx, since)
+	if err != nil {
+		return since, err
+	}
+	for roomID := range resp.Rooms.Invite {
+		if _, ok := s.matrix.rooms[roomID]; ok {
+			if err := s.matrix.join(ctx, roomID); err != nil {
+				log.Printf("MATRIX - Unable to join room %s: %s", roomID, err.Error())
+			}
+		}
+	}
+	if since == "" {
+		return resp.NextBatch, nil
+	}
+	for roomID, room := range resp.Rooms.Join {
+		topic, ok := s.matrix.rooms[roomID]
+		if !ok {
+			continue
+		}
+		for _, event := range room.Timeline.Events {
+			if err := s.publishMatrixEvent(ctx, topic, event); err != nil {
+				log.Printf("MATRIX - Unable to publish event %s of room %s to topic %s: %s", event.EventID, roomID, topic, err.Error())
+			}
+		}
+	}
+	return resp.NextBatch, nil
+}
+
+// publishMatrixEvent publishes a text message of a bridged room to its topic, with the sender as the title
+func (s *Server) publishMatrixEvent(ctx context.Context, topic string, event *matrixEvent) error {
+	if event.Type != matrixEventMessage || event.Sender == s.matrix.userID || event.Content == nil || event.Content.Body == "" {
+		return nil
+	} else if !util.InStringList(matrixTextMsgTypes, event.Content.MsgType) {
+		return nil
+	} else if event.Content.RelatesTo != nil && event.Content.RelatesTo.RelType == matrixRelReplace {
+		return nil
+	}
+	ctx = context.WithValue(ctx, matrixContextKey{}, true)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/%s", s.config.BaseURL, topic), strings.NewReader(event.Content.Body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Title", event.Sender)
+	if s.config.MatrixNtfyToken != "" {
+		r.Header.Set("Authorization", bearerAuthPrefix+s.config.MatrixNtfyToken)
+	}
+	r.RemoteAddr = s.matrix.remoteAddr // Rate limiting is done based on the homeserver, i.e. the bridge is one visitor
+	w := newInternalResponseWriter(nil)
+	s.handle(w, r)
+	if w.code != http.StatusOK && w.code != http.StatusAccepted { // 202 if held for moderation
+		return errors.New(strings.TrimSpace(w.buf.String()))
+	}
+	return nil
+}
+
+// matrixBridged returns true if the request was sent by the Matrix bridge, see publishMatrixEvent
+func matrixBridged(r *http.Request) bool {
+	bridged, _ := r.Context().Value(matrixContextKey{}).(bool)
+	return bridged
+}
+
+// forwardMatrix sends a message to the Matrix rooms that are bridged to its topic, if any
+func (s *Server) forwardMatrix(m *message) {
+	if s.matrix == nil || m.Event != messageEvent {
+		return
+	}
+	for roomID, topic := range s.matrix.rooms {
+		if topic != m.Topic {
+			continue
+		}
+		go func(roomID string) {
+			if err := s.matrix.send(context.Background(), roomID, m); err != nil {
+				log.Printf("MATRIX - Unable to forward message %s of topic %s to room %s: %s", m.ID, m.Topic, roomID, err.Error())
+			}
+		}(roomID)
+	}
+}
+
+// connect looks up the Matrix ID of the bot account, and joins the bridged rooms. Rooms that cannot be joined
+// yet (e.g. because the bot has not been invited) are joined once the invite shows up in the sync.
+func (b *matrixBridge) connect(ctx context.Context) error {
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := b.do(ctx, http.MethodGet, "/_matrix/client/v3/account/whoami", nil, &whoami); err != nil {
+		return fmt.Errorf("unable to log in to %s: %s", b.homeserver, err.Error())
+	}
+	for roomID := range b.rooms {
+		if err := b.join(ctx, roomID); err != nil {
+			log.Printf("MATRIX - Unable to join room %s: %s", roomID, err.Error())
+		}
+	}
+	b.userID = whoami.UserID
+	log.Printf("MATRIX - Bridging %d room(s) as %s", len(b.rooms), b.userID)
+	return nil
+}
+
+func (b *matrixBridge) join(ctx context.Context, roomID string) error {
+	return b.do(ctx, http.MethodPost, "/_matrix/client/v3/join/"+url.PathEscape(roomID), struct{}{}, nil)
+}
+
+func (b *matrixBridge) sync(ctx context.Context, since string) (*matrixSyncResponse, error) {
+	filter, err := b.syncFilter()
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("filter", filter)
+	if since != "" {
+		query.Set("since", since)
+		query.Set("timeout", fmt.Sprintf("%d", matrixSyncTimeout.Milliseconds()))
+	}
+	var resp matrixSyncResponse
+	if err := b.do(ctx, http.MethodGet, "/_matrix/client/v3/sync?"+query.Encode(), nil, &resp); err != nil {
+		return nil, fmt.Errorf("unable to sync: %s", err.Error())
+	}
+	return &resp, nil
+}
+
+// syncFilter returns the inline filter of the /sync requests, which only asks for the messages of the bridged
+// rooms, see https://spec.matrix.org/latest/client-server-api/#filtering
+func (b *matrixBridge) syncFilter() (string, error) {
+	rooms := make([]string, 0, len(b.rooms))
+	for roomID := range b.rooms {
+		rooms = append(rooms, roomID)
+	}
+	none := map[string]interface{}{"not_types": []string{"*"}}
+	filter := map[string]interface{}{
+		"room": map[string]interface{}{
+			"rooms":        rooms,
+			"timeline":     map[string]interface{}{"types": []string{matrixEventMessage}},
+			"state":        none,
+			"ephemeral":    none,
+			"account_data": none,
+		},
+		"presence":     none,
+		"account_data": none,
+	}
+	filterJSON, err := json.Marshal(filter)
+	if err != nil {
+		return "", err
+	}
+	return string(filterJSON), nil
+}
+
+// send sends a message to a room. The transaction ID is derived from the message ID, so that the homeserver
+// ignores duplicates.
+func (b *matrixBridge) send(ctx context.Context, roomID string, m *message) error {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/%s/%s", url.PathEscape(roomID), matrixEventMessage, url.PathEscape("ntfy-"+m.ID))
+	return b.do(ctx, http.MethodPut, path, toMatrixMessage(m), nil)
+}
+
+func (b *matrixBridge) do(ctx context.Context, method, path string, body interface{}, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, b.homeserver+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", bearerAuthPrefix+b.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		e := &matrixError{Status: resp.StatusCode}
+		json.NewDecoder(io.LimitReader(resp.Body, matrixErrorMaxBytes)).Decode(e) // Best effort
+		return e
+	} else if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// toMatrixMessage converts a message to a text message, with the title in bold, followed by the message, the
+// attachment and the click URL. Binary messages (base64-encoded) are left out.
+func toMatrixMessage(m *message) *matrixMessageContent {
+	text, formatted := make([]string, 0), make([]string, 0)
+	if m.Title != "" {
+		text = append(text, m.Title)
+		formatted = append(formatted, "<strong>"+html.EscapeString(m.Title)+"</strong>")
+	}
+	if m.HTML != "" {
+		text = append(text, m.Message)
+		formatted = append(formatted, m.HTML)
+	} else if m.Encoding == "" && m.Message != "" {
+		text = append(text, m.Message)
+		formatted = append(formatted, strings.ReplaceAll(html.EscapeString(m.Message), "\n", "<br>"))
+	}
+	if m.Attachment != nil {
+		text = append(text, m.Attachment.URL)
+		formatted = append(formatted, matrixLink(m.Attachment.URL, m.Attachment.Name))
+	}
+	if m.Click != "" {
+		text = append(text, m.Click)
+		formatted = append(formatted, matrixLink(m.Click, m.Click))
+	}
+	return &matrixMessageContent{
+		MsgType:       "m.text",
+		Body:          strings.Join(text, "\n"),
+		Format:        matrixFormatHTML,
+		FormattedBody: strings.Join(formatted, "<br>"),
+	}
+}
+
+func matrixLink(href, name string) string {
+	if name == "" {
+		name = href
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(href), html.EscapeString(name))
+}
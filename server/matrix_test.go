@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testMatrixRoomID = "!abcdef:example.com"
+	testMatrixBotID  = "@ntfy:example.com"
+	testMatrixToken  = "syt_bot_token"
+)
+
+type testMatrixRequest struct {
+	path    string
+	content *matrixMessageContent
+}
+
+func TestServer_Matrix_RoomToTopic(t *testing.T) {
+	s, homeserver := newTestMatrixServer(t, newTestConfig(t))
+	homeserver.events <- []*matrixEvent{
+		{Type: matrixEventMessage, EventID: "$1", Sender: "@phil:example.com", Content: &matrixMessageContent{MsgType: "m.text", Body: "Deploy started"}},
+		{Type: matrixEventMessage, EventID: "$2", Sender: testMatrixBotID, Content: &matrixMessageContent{MsgType: "m.text", Body: "Sent by the bridge"}},
+		{Type: matrixEventMessage, EventID: "$3", Sender: "@phil:example.com", Content: &matrixMessageContent{MsgType: "m.text", Body: "* Deploy started!", RelatesTo: &matrixEventRelation{RelType: matrixRelReplace}}},
+		{Type: matrixEventMessage, EventID: "$4", Sender: "@phil:example.com", Content: &matrixMessageContent{MsgType: "m.image", Body: "screenshot.png"}},
+		{Type: matrixEventMessage, EventID: "$5", Sender: "@phil:example.com", Content: &matrixMessageContent{MsgType: "m.notice", Body: "Deploy done"}},
+	}
+	go s.runMatrixBridge()
+
+	var messages []*message
+	require.Eventually(t, func() bool {
+		messages = toMessages(t, request(t, s, "GET", "/alerts/json?poll=1", "", nil).Body.String())
+		return len(messages) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "Deploy started", messages[0].Message)
+	require.Equal(t, "@phil:example.com", messages[0].Title)
+	require.Equal(t, "Deploy done", messages[1].Message)
+	require.Equal(t, testMatrixRoomID, homeserver.readRequest(t).path[len("/_matrix/client/v3/join/"):])
+
+	// Messages from Matrix are not sent back to the room
+	select {
+	case req := <-homeserver.requests:
+		t.Fatalf("unexpected request %s", req.path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_Matrix_TopicToRoom(t *testing.T) {
+	s, homeserver := newTestMatrixServer(t, newTestConfig(t))
+	m := toMessage(t, request(t, s, "PUT", "/alerts", "Disk full\n<90%", map[string]string{"Title": "Server down"}).Body.String())
+	req := homeserver.readRequest(t)
+	require.Equal(t, "/_matrix/client/v3/rooms/"+testMatrixRoomID+"/send/m.room.message/ntfy-"+m.ID, req.path)
+	require.Equal(t, "m.text", req.content.MsgType)
+	require.Equal(t, "Server down\nDisk full\n<90%", req.content.Body)
+	require.Equal(t, matrixFormatHTML, req.content.Format)
+	require.Equal(t, "<strong>Server down</strong><br>Disk full<br>&lt;90%", req.content.FormattedBody)
+
+	request(t, s, "PUT", "/other", "Not bridged", nil)
+	select {
+	case req := <-homeserver.requests:
+		t.Fatalf("unexpected request %s", req.path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_Matrix_NtfyToken(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s, homeserver := newTestMatrixServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("bridge", "bridge", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("bridge", "alerts", true, true))
+	token, err := manager.AddToken("bridge", "Matrix bridge", []auth.Grant{{TopicPattern: "alerts", AllowRead: true, AllowWrite: true}}, time.Time{})
+	require.Nil(t, err)
+	s.config.MatrixNtfyToken = token.Value
+	homeserver.events <- []*matrixEvent{
+		{Type: matrixEventMessage, EventID: "$1", Sender: "@phil:example.com", Content: &matrixMessageContent{MsgType: "m.text", Body: "Deploy started"}},
+	}
+	go s.runMatrixBridge()
+
+	require.Eventually(t, func() bool {
+		response := request(t, s, "GET", "/alerts/json?poll=1", "", map[string]string{"Authorization": basicAuth("bridge:bridge")})
+		return len(toMessages(t, response.Body.String())) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestToMatrixMessage_Attachment(t *testing.T) {
+	m := newDefaultMessage("alerts", "")
+	m.Attachment = &attachment{Name: "report.pdf", URL: "https://example.com/file/report.pdf"}
+	m.Click = "https://example.com/logs?a=1&b=2"
+	content := toMatrixMessage(m)
+	require.Equal(t, "https://example.com/file/report.pdf\nhttps://example.com/logs?a=1&b=2", content.Body)
+	require.Equal(t, `<a href="https://example.com/file/report.pdf">report.pdf</a><br><a href="https://example.com/logs?a=1&amp;b=2">https://example.com/logs?a=1&amp;b=2</a>`, content.FormattedBody)
+}
+
+type testMatrixHomeserver struct {
+	events   chan []*matrixEvent     // Returned by the next sync
+	requests chan *testMatrixRequest // Joins and sent messages
+}
+
+func (h *testMatrixHomeserver) readRequest(t *testing.T) *testMatrixRequest {
+	select {
+	case req := <-h.requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Matrix request")
+		return nil
+	}
+}
+
+// newTestMatrixServer creates a server that bridges testMatrixRoomID and the topic "alerts" via a fake homeserver.
+// The bridge is not started, so that tests can queue the events of the first sync before calling runMatrixBridge.
+func newTestMatrixServer(t *testing.T, c *Config) (*Server, *testMatrixHomeserver) {
+	homeserver := &testMatrixHomeserver{
+		events:   make(chan []*matrixEvent, 10),
+		requests: make(chan *testMatrixRequest, 10),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer "+testMatrixToken, r.Header.Get("Authorization"))
+		switch {
+		case r.URL.Path == "/_matrix/client/v3/account/whoami":
+			io.WriteString(w, `{"user_id":"`+testMatrixBotID+`"}`)
+		case r.URL.Path == "/_matrix/client/v3/sync":
+			var resp matrixSyncResponse
+			resp.NextBatch = "s1"
+			if since := r.URL.Query().Get("since"); since != "" {
+				resp.NextBatch = since + "1"
+				select {
+				case events := <-homeserver.events:
+					resp.Rooms.Join = map[string]*matrixJoinedRoom{testMatrixRoomID: {}}
+					resp.Rooms.Join[testMatrixRoomID].Timeline.Events = events
+				case <-r.Context().Done():
+				case <-time.After(50 * time.Millisecond):
+				}
+			}
+			json.NewEncoder(w).Encode(&resp)
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/join/"):
+			homeserver.requests <- &testMatrixRequest{path: r.URL.Path}
+			io.WriteString(w, `{"room_id":"`+testMatrixRoomID+`"}`)
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/rooms/"):
+			var content matrixMessageContent
+			require.Nil(t, json.NewDecoder(r.Body).Decode(&content))
+			homeserver.requests <- &testMatrixRequest{path: r.URL.Path, content: &content}
+			io.WriteString(w, `{"event_id":"$sent"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	c.MatrixHomeserver = server.URL
+	c.MatrixAccessToken = testMatrixToken
+	c.MatrixRooms = map[string]string{testMatrixRoomID: "alerts"}
+	s := newTestServer(t, c)
+	s.closeChan = make(chan bool)
+	t.Cleanup(func() { close(s.closeChan) })
+	return s, homeserver
+}
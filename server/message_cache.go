@@ -8,12 +8,16 @@ import (
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
 	"heckel.io/ntfy/util"
 	"log"
+	"math"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
 	errUnexpectedMessageType = errors.New("unexpected message type")
+	errMessageNotFound       = errors.New("message not found")
+	errCacheClosed           = errors.New("cache closed")
 )
 
 // Messages cache
@@ -36,46 +40,94 @@ const (
 			attachment_size INT NOT NULL,
 			attachment_expires INT NOT NULL,
 			attachment_url TEXT NOT NULL,
+			attachment_thumbnail TEXT NOT NULL,
 			attachment_owner TEXT NOT NULL,
+			attachment_hash TEXT NOT NULL,
 			encoding TEXT NOT NULL,
-			published INT NOT NULL
+			group_key TEXT NOT NULL,
+			expires INT NOT NULL,
+			published INT NOT NULL,
+			sender_ip TEXT NOT NULL,
+			sender_user TEXT NOT NULL,
+			dedup_key TEXT NOT NULL,
+			in_reply_to TEXT NOT NULL,
+			thread TEXT NOT NULL,
+			ack_required INT NOT NULL,
+			collapse_key TEXT NOT NULL,
+			markdown TEXT NOT NULL,
+			html TEXT NOT NULL
 		);
 		CREATE INDEX IF NOT EXISTS idx_mid ON messages (mid);
 		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
+		CREATE INDEX IF NOT EXISTS idx_expires ON messages (expires);
+		CREATE INDEX IF NOT EXISTS idx_dedup_key ON messages (dedup_key);
+		CREATE INDEX IF NOT EXISTS idx_attachment_hash ON messages (attachment_hash);
+		CREATE INDEX IF NOT EXISTS idx_thread ON messages (thread);
+		CREATE INDEX IF NOT EXISTS idx_collapse_key ON messages (collapse_key);
 		COMMIT;
 	`
 	insertMessageQuery = `
-		INSERT INTO messages (mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, published) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, published, sender_ip, sender_user, dedup_key, in_reply_to, thread, ack_required, collapse_key, markdown, html) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	pruneMessagesQuery        = `DELETE FROM messages WHERE time < ? AND published = 1`
+	pruneTopicMessagesQuery   = `DELETE FROM messages WHERE topic = ? AND time < ? AND published = 1`
+	pruneExpiredMessagesQuery = `DELETE FROM messages WHERE expires > 0 AND expires <= ?`
+	updateMessageQuery        = `UPDATE messages SET title = ?, message = ?, priority = ?, encoding = ?, markdown = ?, html = ? WHERE topic = ? AND mid = ?`
+	deleteMessageQuery        = `DELETE FROM messages WHERE topic = ? AND mid = ?`
+	deleteMessagesQuery       = `DELETE FROM messages WHERE topic = ?`
+	selectRowIDFromMessageID  = `SELECT id FROM messages WHERE topic = ? AND mid = ?`
+	selectMessageQuery        = `
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html, sender_ip, sender_user
+		FROM messages
+		WHERE topic = ? AND mid = ?
+	`
+	selectMessageByDedupKeyQuery = `
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html
+		FROM messages
+		WHERE topic = ? AND dedup_key = ? AND time >= ?
+		ORDER BY time DESC, id DESC
+		LIMIT 1
+	`
+	selectMessagesByCollapseKeyQuery = `
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html, sender_ip, sender_user
+		FROM messages
+		WHERE topic = ? AND collapse_key = ? AND published = 1
+		ORDER BY time, id
 	`
-	pruneMessagesQuery           = `DELETE FROM messages WHERE time < ? AND published = 1`
-	selectRowIDFromMessageID     = `SELECT id FROM messages WHERE topic = ? AND mid = ?`
 	selectMessagesSinceTimeQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html
 		FROM messages 
 		WHERE topic = ? AND time >= ? AND published = 1
 		ORDER BY time, id
 	`
 	selectMessagesSinceTimeIncludeScheduledQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html
 		FROM messages 
 		WHERE topic = ? AND time >= ?
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html
 		FROM messages 
 		WHERE topic = ? AND id > ? AND published = 1 
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDIncludeScheduledQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html
 		FROM messages 
 		WHERE topic = ? AND (id > ? OR published = 0)
 		ORDER BY time, id
 	`
+	selectMessagesAfterCursorQuery = `
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html, id
+		FROM messages
+		WHERE topic = ? AND published = 1 AND (time > ? OR (time = ? AND id > ?))
+		ORDER BY time, id
+		LIMIT ?
+	`
 	selectMessagesDueQuery = `
-		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html
 		FROM messages 
 		WHERE time <= ? AND published = 0
 		ORDER BY time, id
@@ -84,13 +136,413 @@ const (
 	selectMessagesCountQuery        = `SELECT COUNT(*) FROM messages`
 	selectMessageCountForTopicQuery = `SELECT COUNT(*) FROM messages WHERE topic = ?`
 	selectTopicsQuery               = `SELECT topic FROM messages GROUP BY topic`
-	selectAttachmentsSizeQuery      = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE attachment_owner = ? AND attachment_expires >= ?`
-	selectAttachmentsExpiredQuery   = `SELECT mid FROM messages WHERE attachment_expires > 0 AND attachment_expires < ?`
+)
+
+// Uploaded attachments are stored under the hash of their content (see attachmentFileID), so the same file is only
+// stored and counted once, no matter how many messages reference it. Attachments uploaded before that are stored
+// under the message ID, and have no hash.
+const (
+	selectAttachmentsSizeQuery = `
+		SELECT COALESCE(SUM(size), 0)
+		FROM (
+			SELECT MAX(attachment_size) AS size
+			FROM messages
+			WHERE attachment_owner = ? AND attachment_expires >= ?
+			GROUP BY CASE WHEN attachment_hash = '' THEN mid ELSE attachment_hash END
+		) AS files
+	`
+	selectAttachmentsExpiredQuery = `
+		SELECT mid FROM messages WHERE attachment_expires > 0 AND attachment_expires < ? AND attachment_hash = ''
+		UNION
+		SELECT attachment_hash FROM messages WHERE attachment_hash != '' GROUP BY attachment_hash HAVING MAX(attachment_expires) < ?
+	`
+	selectAttachmentReferencesQuery = `SELECT COUNT(*) FROM messages WHERE attachment_hash = ?`
+)
+
+// E-mail retry queue, see Server.sendEmail
+const (
+	createEmailsTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS emails (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			sender_ip TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			message TEXT NOT NULL,
+			attachment_owner TEXT NOT NULL,
+			attachment_hash TEXT NOT NULL,
+			attempts INT NOT NULL,
+			queued INT NOT NULL,
+			next_attempt INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_next_attempt ON emails (next_attempt);
+		COMMIT;
+	`
+	insertEmailQuery = `
+		INSERT INTO emails (sender_ip, recipient, message, attachment_owner, attachment_hash, attempts, queued, next_attempt)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`
+	selectEmailsDueQuery = `
+		SELECT id, sender_ip, recipient, message, attachment_owner, attachment_hash, attempts, queued, next_attempt
+		FROM emails
+		WHERE next_attempt <= ?
+		ORDER BY next_attempt, id
+	`
+	selectEmailsCountQuery = `SELECT COUNT(*) FROM emails`
+	updateEmailQuery       = `UPDATE emails SET attempts = ?, next_attempt = ? WHERE id = ?`
+	deleteEmailQuery       = `DELETE FROM emails WHERE id = ?`
+)
+
+// E-mail digests, see Server.sendEmailDigests. All messages of a digest (same topic and recipient) have the same
+// due time, which is set when the first message is added.
+const (
+	createEmailDigestsTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS email_digests (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			topic TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			sender_ip TEXT NOT NULL,
+			message TEXT NOT NULL,
+			due INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_due ON email_digests (due);
+		COMMIT;
+	`
+	insertEmailDigestMessageQuery = `INSERT INTO email_digests (topic, recipient, sender_ip, message, due) VALUES (?, ?, ?, ?, ?)`
+	selectEmailDigestDueQuery     = `SELECT COALESCE(MIN(due), 0) FROM email_digests WHERE topic = ? AND recipient = ?`
+	selectEmailDigestsDueQuery    = `
+		SELECT id, topic, recipient, sender_ip, message
+		FROM email_digests
+		WHERE due <= ?
+		ORDER BY topic, recipient, id
+	`
+	deleteEmailDigestMessagesQuery = `DELETE FROM email_digests WHERE topic = ? AND recipient = ? AND id <= ?`
+)
+
+// Recurring messages, see Server.sendRecurringMessages. The message column holds the JSON-encoded recurringMessage;
+// the next column is the authoritative time of the next message, since it is updated after every run.
+const (
+	createRecurringMessagesTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS recurring_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			rid TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			message TEXT NOT NULL,
+			next INT NOT NULL,
+			sender_ip TEXT NOT NULL,
+			sender_user TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_recurring_topic ON recurring_messages (topic);
+		CREATE INDEX IF NOT EXISTS idx_recurring_next ON recurring_messages (next);
+		COMMIT;
+	`
+	insertRecurringMessageQuery     = `INSERT INTO recurring_messages (rid, topic, message, next, sender_ip, sender_user) VALUES (?, ?, ?, ?, ?, ?)`
+	selectRecurringMessagesQuery    = `SELECT rid, topic, message, next, sender_ip, sender_user FROM recurring_messages WHERE topic = ? ORDER BY id`
+	selectRecurringMessagesDueQuery = `SELECT rid, topic, message, next, sender_ip, sender_user FROM recurring_messages WHERE next <= ? ORDER BY next, id`
+	updateRecurringMessageNextQuery = `UPDATE recurring_messages SET next = ? WHERE topic = ? AND rid = ?`
+	deleteRecurringMessageQuery     = `DELETE FROM recurring_messages WHERE topic = ? AND rid = ?`
+)
+
+// Topic metadata, see Server.handleTopicInfoUpdate (also used for PostgreSQL)
+const (
+	createTopicInfoTableQuery = `
+		CREATE TABLE IF NOT EXISTS topic_info (
+			topic TEXT PRIMARY KEY,
+			display_name TEXT NOT NULL,
+			icon TEXT NOT NULL,
+			description TEXT NOT NULL
+		);
+	`
+	selectTopicInfoQuery = `SELECT display_name, icon, description FROM topic_info WHERE topic = ?`
+	upsertTopicInfoQuery = `
+		INSERT INTO topic_info (topic, display_name, icon, description) VALUES (?, ?, ?, ?)
+		ON CONFLICT (topic) DO UPDATE SET display_name = excluded.display_name, icon = excluded.icon, description = excluded.description
+	`
+	deleteTopicInfoQuery = `DELETE FROM topic_info WHERE topic = ?`
+)
+
+// Default message fields of a topic, see Server.handleTopicDefaultsUpdate (also used for PostgreSQL)
+const (
+	createTopicDefaultsTableQuery = `
+		CREATE TABLE IF NOT EXISTS topic_defaults (
+			topic TEXT PRIMARY KEY,
+			title TEXT NOT NULL,
+			priority INT NOT NULL,
+			tags TEXT NOT NULL,
+			click TEXT NOT NULL
+		);
+	`
+	selectTopicDefaultsQuery = `SELECT title, priority, tags, click FROM topic_defaults WHERE topic = ?`
+	upsertTopicDefaultsQuery = `
+		INSERT INTO topic_defaults (topic, title, priority, tags, click) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (topic) DO UPDATE SET title = excluded.title, priority = excluded.priority, tags = excluded.tags, click = excluded.click
+	`
+	deleteTopicDefaultsQuery = `DELETE FROM topic_defaults WHERE topic = ?`
+)
+
+// Escalation chains of topics and the progress of the escalations of messages, see Server.sendEscalations.
+// The steps column holds the JSON-encoded escalation steps, and copies the republished messages as topic/id.
+const (
+	createEscalationsTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS topic_escalations (
+			topic TEXT PRIMARY KEY,
+			steps TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS escalations (
+			topic TEXT NOT NULL,
+			mid TEXT NOT NULL,
+			step INT NOT NULL,
+			due INT NOT NULL,
+			copies TEXT NOT NULL,
+			PRIMARY KEY (topic, mid)
+		);
+		CREATE INDEX IF NOT EXISTS idx_escalations_due ON escalations (due);
+		COMMIT;
+	`
+	selectTopicEscalationQuery = `SELECT steps FROM topic_escalations WHERE topic = ?`
+	upsertTopicEscalationQuery = `
+		INSERT INTO topic_escalations (topic, steps) VALUES (?, ?)
+		ON CONFLICT (topic) DO UPDATE SET steps = excluded.steps
+	`
+	deleteTopicEscalationQuery = `DELETE FROM topic_escalations WHERE topic = ?`
+	upsertEscalationQuery      = `
+		INSERT INTO escalations (topic, mid, step, due, copies) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (topic, mid) DO UPDATE SET step = excluded.step, due = excluded.due, copies = excluded.copies
+	`
+	selectEscalationsDueQuery = `SELECT topic, mid, step, due, copies FROM escalations WHERE due <= ? ORDER BY due`
+	deleteEscalationQuery     = `DELETE FROM escalations WHERE topic = ? AND mid = ?`
+)
+
+// Quiet hours of users, see Server.handleUserQuietHoursUpdate (also used for PostgreSQL)
+const (
+	createQuietHoursTableQuery = `
+		CREATE TABLE IF NOT EXISTS quiet_hours (
+			user_name TEXT PRIMARY KEY,
+			start_time TEXT NOT NULL,
+			end_time TEXT NOT NULL,
+			timezone TEXT NOT NULL,
+			priority INT NOT NULL
+		);
+	`
+	selectQuietHoursQuery = `SELECT start_time, end_time, timezone, priority FROM quiet_hours WHERE user_name = ?`
+	upsertQuietHoursQuery = `
+		INSERT INTO quiet_hours (user_name, start_time, end_time, timezone, priority) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_name) DO UPDATE SET start_time = excluded.start_time, end_time = excluded.end_time, timezone = excluded.timezone, priority = excluded.priority
+	`
+	deleteQuietHoursQuery = `DELETE FROM quiet_hours WHERE user_name = ?`
+)
+
+// Outgoing webhooks of topics and the retry queue of failed deliveries, see Server.forwardWebhooks. The webhooks
+// column holds the JSON-encoded webhooks of a topic, and the secret column the signing key of the topic; like the
+// queued messages, both are encrypted.
+const (
+	createWebhooksTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS topic_webhooks (
+			topic TEXT PRIMARY KEY,
+			webhooks TEXT NOT NULL,
+			secret TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS webhook_queue (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			format TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			message TEXT NOT NULL,
+			attempts INT NOT NULL,
+			queued INT NOT NULL,
+			next_attempt INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_webhook_queue_next_attempt ON webhook_queue (next_attempt);
+		COMMIT;
+	`
+	selectTopicWebhooksQuery = `SELECT webhooks, secret FROM topic_webhooks WHERE topic = ?`
+	upsertTopicWebhooksQuery = `
+		INSERT INTO topic_webhooks (topic, webhooks, secret) VALUES (?, ?, ?)
+		ON CONFLICT (topic) DO UPDATE SET webhooks = excluded.webhooks, secret = excluded.secret
+	`
+	deleteTopicWebhooksQuery = `DELETE FROM topic_webhooks WHERE topic = ?`
+	insertQueuedWebhookQuery = `
+		INSERT INTO webhook_queue (url, format, secret, message, attempts, queued, next_attempt)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING id
+	`
+	selectQueuedWebhooksDueQuery = `
+		SELECT id, url, format, secret, message, attempts, queued, next_attempt
+		FROM webhook_queue
+		WHERE next_attempt <= ?
+		ORDER BY next_attempt, id
+	`
+	updateQueuedWebhookQuery = `UPDATE webhook_queue SET attempts = ?, next_attempt = ? WHERE id = ?`
+	deleteQueuedWebhookQuery = `DELETE FROM webhook_queue WHERE id = ?`
+)
+
+// Heartbeats of topics, see Server.sendHeartbeatAlerts (also used for PostgreSQL, except for creating the table)
+const (
+	createHeartbeatsTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS heartbeats (
+			topic TEXT PRIMARY KEY,
+			period TEXT NOT NULL,
+			target TEXT NOT NULL,
+			email TEXT NOT NULL,
+			message TEXT NOT NULL,
+			due INT NOT NULL,
+			alerted INT NOT NULL,
+			user_name TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_heartbeats_due ON heartbeats (due);
+		COMMIT;
+	`
+	selectHeartbeatQuery = `SELECT topic, period, target, email, message, due, alerted, user_name FROM heartbeats WHERE topic = ?`
+	upsertHeartbeatQuery = `
+		INSERT INTO heartbeats (topic, period, target, email, message, due, alerted, user_name) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (topic) DO UPDATE SET period = excluded.period, target = excluded.target, email = excluded.email, message = excluded.message, due = excluded.due, alerted = excluded.alerted, user_name = excluded.user_name
+	`
+	deleteHeartbeatQuery     = `DELETE FROM heartbeats WHERE topic = ?`
+	selectHeartbeatsDueQuery = `
+		SELECT topic, period, target, email, message, due, alerted, user_name
+		FROM heartbeats
+		WHERE due <= ? AND alerted = 0
+		ORDER BY due
+	`
+)
+
+// Moderated topics and their moderation queues, see Server.holdMessage. The message column holds the JSON-encoded
+// heldMessage, which is encrypted like the messages in the retry queues.
+const (
+	createModerationTablesQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS moderated_topics (
+			topic TEXT PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS held_messages (
+			topic TEXT NOT NULL,
+			mid TEXT NOT NULL,
+			time INT NOT NULL,
+			message TEXT NOT NULL,
+			PRIMARY KEY (topic, mid)
+		);
+		COMMIT;
+	`
+	selectTopicModeratedQuery = `SELECT COUNT(*) FROM moderated_topics WHERE topic = ?`
+	insertTopicModeratedQuery = `INSERT INTO moderated_topics (topic) VALUES (?) ON CONFLICT (topic) DO NOTHING`
+	deleteTopicModeratedQuery = `DELETE FROM moderated_topics WHERE topic = ?`
+	insertHeldMessageQuery    = `INSERT INTO held_messages (topic, mid, time, message) VALUES (?, ?, ?, ?)`
+	selectHeldMessagesQuery   = `SELECT message FROM held_messages WHERE topic = ? ORDER BY time, mid`
+	selectHeldMessageQuery    = `SELECT message FROM held_messages WHERE topic = ? AND mid = ?`
+	deleteHeldMessageQuery    = `DELETE FROM held_messages WHERE topic = ? AND mid = ?`
+)
+
+// iOS devices that receive the messages of topics via APNs, see Server.handleAPNSRegister (also used for
+// PostgreSQL, except for creating the table)
+const (
+	createAPNSDevicesTableQuery = `
+		CREATE TABLE IF NOT EXISTS apns_devices (
+			topic TEXT NOT NULL,
+			token TEXT NOT NULL,
+			username TEXT NOT NULL,
+			PRIMARY KEY (topic, token)
+		);
+	`
+	upsertAPNSDeviceQuery = `
+		INSERT INTO apns_devices (topic, token, username) VALUES (?, ?, ?)
+		ON CONFLICT (topic, token) DO UPDATE SET username = excluded.username
+	`
+	selectAPNSDevicesQuery = `SELECT topic, token, username FROM apns_devices WHERE topic = ? ORDER BY token`
+	deleteAPNSDeviceQuery  = `DELETE FROM apns_devices WHERE topic = ? AND token = ?`
+)
+
+// Telegram chats that the messages of topics are forwarded to, see Server.forwardTelegram (also used for PostgreSQL,
+// except for creating the table)
+const (
+	createTelegramChatsTableQuery = `
+		CREATE TABLE IF NOT EXISTS telegram_chats (
+			topic TEXT NOT NULL,
+			chat_id TEXT NOT NULL,
+			PRIMARY KEY (topic, chat_id)
+		);
+	`
+	insertTelegramChatQuery  = `INSERT INTO telegram_chats (topic, chat_id) VALUES (?, ?) ON CONFLICT (topic, chat_id) DO NOTHING`
+	selectTelegramChatsQuery = `SELECT chat_id FROM telegram_chats WHERE topic = ? ORDER BY chat_id`
+	deleteTelegramChatQuery  = `DELETE FROM telegram_chats WHERE topic = ? AND chat_id = ?`
+)
+
+// Verified phone numbers of users, that messages can be sent to as SMS, see Server.handleUserPhoneNumberAdd (also
+// used for PostgreSQL, except for creating the table)
+const (
+	createPhoneNumbersTableQuery = `
+		CREATE TABLE IF NOT EXISTS phone_numbers (
+			user_name TEXT NOT NULL,
+			phone_number TEXT NOT NULL,
+			PRIMARY KEY (user_name, phone_number)
+		);
+	`
+	insertPhoneNumberQuery  = `INSERT INTO phone_numbers (user_name, phone_number) VALUES (?, ?) ON CONFLICT (user_name, phone_number) DO NOTHING`
+	selectPhoneNumbersQuery = `SELECT phone_number FROM phone_numbers WHERE user_name = ? ORDER BY phone_number`
+	deletePhoneNumberQuery  = `DELETE FROM phone_numbers WHERE user_name = ? AND phone_number = ?`
+)
+
+// Acknowledgments of messages, see Server.handleAck (also used for PostgreSQL, except for creating the table).
+// Acknowledgments of messages that are no longer cached are removed when the cache is pruned.
+const (
+	createMessageAcksTableQuery = `
+		CREATE TABLE IF NOT EXISTS message_acks (
+			topic TEXT NOT NULL,
+			mid TEXT NOT NULL,
+			subscriber TEXT NOT NULL,
+			user_name TEXT NOT NULL,
+			time INT NOT NULL,
+			PRIMARY KEY (topic, mid, subscriber)
+		);
+	`
+	insertMessageAckQuery  = `INSERT INTO message_acks (topic, mid, subscriber, user_name, time) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`
+	selectMessageAcksQuery = `SELECT user_name, time FROM message_acks WHERE topic = ? AND mid = ? ORDER BY time`
+	deleteMessageAcksQuery = `DELETE FROM message_acks WHERE topic = ? AND mid = ?`
+	deleteTopicAcksQuery   = `DELETE FROM message_acks WHERE topic = ?`
+	pruneMessageAcksQuery  = `
+		DELETE FROM message_acks
+		WHERE NOT EXISTS (SELECT 1 FROM messages WHERE messages.topic = message_acks.topic AND messages.mid = message_acks.mid)
+	`
+)
+
+// Full-text search index over title, message and tags, see Server.handleSearch. This uses FTS4 rather than
+// FTS5, because FTS5 is only compiled into go-sqlite3 with the "sqlite_fts5" build tag. The index is an
+// external content table, so it only stores the tokens; the triggers keep it in sync with the messages table.
+const (
+	createMessagesSearchIndexQuery = `
+		BEGIN;
+		CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts4(content="messages", title, message, tags, tokenize=unicode61);
+		CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (docid, title, message, tags) VALUES (new.id, new.title, new.message, new.tags);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_delete BEFORE DELETE ON messages BEGIN
+			DELETE FROM messages_fts WHERE docid = old.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_update_before BEFORE UPDATE OF title, message, tags ON messages BEGIN
+			DELETE FROM messages_fts WHERE docid = old.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_update_after AFTER UPDATE OF title, message, tags ON messages BEGIN
+			INSERT INTO messages_fts (docid, title, message, tags) VALUES (new.id, new.title, new.message, new.tags);
+		END;
+		COMMIT;
+	`
+	rebuildMessagesSearchIndexQuery = `INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')`
+	searchMessagesQuery             = `
+		SELECT mid, time, topic, message, title, priority, tags, click, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_thumbnail, attachment_owner, attachment_hash, encoding, group_key, expires, in_reply_to, thread, ack_required, collapse_key, markdown, html
+		FROM messages
+		WHERE topic = ? AND published = 1 AND id IN (SELECT docid FROM messages_fts WHERE messages_fts MATCH ?)
+		ORDER BY time DESC, id DESC
+		LIMIT ?
+	`
 )
 
 // Schema management queries
 const (
-	currentSchemaVersion          = 6
+	currentSchemaVersion          = 34
 	createSchemaVersionTableQuery = `
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
@@ -173,15 +625,270 @@ const (
 	migrate5To6AlterMessagesTableQuery = `
 		ALTER TABLE messages ADD COLUMN actions TEXT NOT NULL DEFAULT('');
 	`
+
+	// 6 -> 7
+	migrate6To7AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN group_key TEXT NOT NULL DEFAULT('');
+	`
+
+	// 7 -> 8: Creates the emails table as it was in schema version 8, see createEmailsTableQuery
+	migrate7To8CreateEmailsTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS emails (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			sender_ip TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			message TEXT NOT NULL,
+			attachment_owner TEXT NOT NULL,
+			attempts INT NOT NULL,
+			queued INT NOT NULL,
+			next_attempt INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_next_attempt ON emails (next_attempt);
+		COMMIT;
+	`
+
+	// 8 -> 9: The email_digests table is created using createEmailDigestsTableQuery
+
+	// 9 -> 10: The messages_fts table is created using createMessagesSearchIndexQuery, and then filled
+	// using rebuildMessagesSearchIndexQuery
+
+	// 10 -> 11 (also used for PostgreSQL)
+	migrate10To11AlterMessagesTableQuery = `
+		BEGIN;
+		ALTER TABLE messages ADD COLUMN sender_ip TEXT NOT NULL DEFAULT('');
+		ALTER TABLE messages ADD COLUMN sender_user TEXT NOT NULL DEFAULT('');
+		COMMIT;
+	`
+
+	// 11 -> 12: The update triggers of messages_fts are created using createMessagesSearchIndexQuery
+
+	// 12 -> 13 (also used for PostgreSQL)
+	migrate12To13AlterMessagesTableQuery = `
+		BEGIN;
+		ALTER TABLE messages ADD COLUMN expires INT NOT NULL DEFAULT(0);
+		CREATE INDEX IF NOT EXISTS idx_expires ON messages (expires);
+		COMMIT;
+	`
+
+	// 13 -> 14 (also used for PostgreSQL)
+	migrate13To14AlterMessagesTableQuery = `
+		BEGIN;
+		ALTER TABLE messages ADD COLUMN dedup_key TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_dedup_key ON messages (dedup_key);
+		COMMIT;
+	`
+
+	// 14 -> 15 (also used for PostgreSQL)
+	migrate14To15AlterMessagesTableQuery = `
+		BEGIN;
+		ALTER TABLE messages ADD COLUMN attachment_hash TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_attachment_hash ON messages (attachment_hash);
+		ALTER TABLE emails ADD COLUMN attachment_hash TEXT NOT NULL DEFAULT('');
+		COMMIT;
+	`
+
+	// 15 -> 16 (also used for PostgreSQL)
+	migrate15To16AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN attachment_thumbnail TEXT NOT NULL DEFAULT('');
+	`
+
+	// 16 -> 17: The recurring_messages table is created using createRecurringMessagesTableQuery
+
+	// 17 -> 18: The topic_info table is created using createTopicInfoTableQuery
+
+	// 18 -> 19 (also used for PostgreSQL)
+	migrate18To19AlterMessagesTableQuery = `
+		BEGIN;
+		ALTER TABLE messages ADD COLUMN in_reply_to TEXT NOT NULL DEFAULT('');
+		ALTER TABLE messages ADD COLUMN thread TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_thread ON messages (thread);
+		COMMIT;
+	`
+
+	// 19 -> 20: The topic_defaults table is created using createTopicDefaultsTableQuery
+
+	// 20 -> 21 (also used for PostgreSQL), and the message_acks table is created using createMessageAcksTableQuery
+	migrate20To21AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN ack_required INT NOT NULL DEFAULT(0);
+	`
+
+	// 21 -> 22: The topic_escalations and escalations tables are created using createEscalationsTableQuery
+
+	// 22 -> 23: The quiet_hours table is created using createQuietHoursTableQuery
+
+	// 23 -> 24 (also used for PostgreSQL)
+	migrate23To24AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN collapse_key TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_collapse_key ON messages (collapse_key);
+	`
+
+	// 24 -> 25 (also used for PostgreSQL)
+	migrate24To25AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN markdown TEXT NOT NULL DEFAULT('');
+		ALTER TABLE messages ADD COLUMN html TEXT NOT NULL DEFAULT('');
+	`
+
+	// 25 -> 26: The topic_webhooks table did not have the secret column yet, see 26 -> 27
+	migrate25To26CreateWebhooksTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS topic_webhooks (
+			topic TEXT PRIMARY KEY,
+			webhooks TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS webhook_queue (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			message TEXT NOT NULL,
+			attempts INT NOT NULL,
+			queued INT NOT NULL,
+			next_attempt INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_webhook_queue_next_attempt ON webhook_queue (next_attempt);
+		COMMIT;
+	`
+
+	// 26 -> 27 (also used for PostgreSQL)
+	migrate26To27AlterTopicWebhooksTableQuery = `
+		ALTER TABLE topic_webhooks ADD COLUMN secret TEXT NOT NULL DEFAULT('');
+	`
+
+	// 27 -> 28: The heartbeats table did not have the user_name column yet, see 33 -> 34
+	migrate27To28CreateHeartbeatsTableQuery = `
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS heartbeats (
+			topic TEXT PRIMARY KEY,
+			period TEXT NOT NULL,
+			target TEXT NOT NULL,
+			email TEXT NOT NULL,
+			message TEXT NOT NULL,
+			due INT NOT NULL,
+			alerted INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_heartbeats_due ON heartbeats (due);
+		COMMIT;
+	`
+
+	// 28 -> 29: The moderated_topics and held_messages tables are created using createModerationTablesQuery
+
+	// 29 -> 30: The apns_devices table is created using createAPNSDevicesTableQuery
+
+	// 30 -> 31: The telegram_chats table is created using createTelegramChatsTableQuery
+
+	// 31 -> 32 (also used for PostgreSQL)
+	migrate31To32AlterWebhookQueueTableQuery = `
+		ALTER TABLE webhook_queue ADD COLUMN format TEXT NOT NULL DEFAULT('');
+	`
+
+	// 32 -> 33: The phone_numbers table is created using createPhoneNumbersTableQuery
+
+	// 33 -> 34 (also used for PostgreSQL)
+	migrate33To34AlterHeartbeatsTableQuery = `
+		ALTER TABLE heartbeats ADD COLUMN user_name TEXT NOT NULL DEFAULT('');
+	`
 )
 
-type messageCache struct {
-	db  *sql.DB
-	nop bool
+// messageCache stores messages for the since= and poll= parameters, as well as the e-mail retry queue, pending
+// e-mail digests, recurring messages, topic metadata, topic defaults, acknowledgments, escalations, the quiet hours
+// of users, the outgoing webhooks of topics with their retry queue, heartbeats, moderation queues, and the APNs devices of topics. It is implemented by sqlCache (SQLite and
+// PostgreSQL) and redisCache.
+type messageCache interface {
+	AddMessage(m *message) error
+	Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error)
+	MessagesAfter(topic string, cursor sinceMarker, limit int) ([]*message, error)
+	Message(topic, id string) (*message, error)
+	MessageByDedupKey(topic, key string, since time.Time) (*message, error)
+	MessagesByCollapseKey(topic, key string) ([]*message, error)
+	UpdateMessage(m *message) error
+	DeleteMessage(topic, id string) error
+	DeleteMessages(topic string) error
+	MessagesDue() ([]*message, error)
+	MarkPublished(m *message) error
+	MessageCount(topic string) (int, error)
+	Topics() (map[string]*topic, error)
+	Prune(olderThan time.Time, topicOlderThan map[string]time.Time) error
+	AttachmentBytesUsed(owner string) (int64, error)
+	AttachmentsExpired() ([]string, error)
+	AttachmentReferences(hash string) (int, error)
+	QueueEmail(e *queuedEmail) error
+	EmailsDue() ([]*queuedEmail, error)
+	EmailsQueued() (int, error)
+	DeleteEmail(id int64) error
+	AddEmailDigestMessage(senderIP, to string, m *message, window time.Duration) error
+	EmailDigestPending(topic, to string) (bool, error)
+	EmailDigestsDue() ([]*emailDigest, error)
+	DeleteEmailDigest(d *emailDigest) error
+	AddRecurringMessage(r *recurringMessage) error
+	RecurringMessages(topic string) ([]*recurringMessage, error)
+	RecurringMessagesDue() ([]*recurringMessage, error)
+	UpdateRecurringMessage(r *recurringMessage) error
+	DeleteRecurringMessage(topic, id string) error
+	TopicInfo(topic string) (*topicInfo, error)
+	UpdateTopicInfo(info *topicInfo) error
+	DeleteTopicInfo(topic string) error
+	TopicDefaults(topic string) (*topicDefaults, error)
+	UpdateTopicDefaults(defaults *topicDefaults) error
+	DeleteTopicDefaults(topic string) error
+	AddMessageAck(topic, id string, ack *messageAck) (bool, error)
+	MessageAcks(topic, id string) ([]*messageAck, error)
+	TopicEscalation(topic string) (*topicEscalation, error)
+	UpdateTopicEscalation(e *topicEscalation) error
+	DeleteTopicEscalation(topic string) error
+	UpdateEscalation(e *escalation) error
+	EscalationsDue() ([]*escalation, error)
+	DeleteEscalation(topic, id string) error
+	QuietHours(user string) (*quietHours, error)
+	UpdateQuietHours(user string, q *quietHours) error
+	DeleteQuietHours(user string) error
+	TopicWebhooks(topic string) (*topicWebhooks, error)
+	UpdateTopicWebhooks(w *topicWebhooks) error
+	DeleteTopicWebhooks(topic string) error
+	QueueWebhook(w *queuedWebhook) error
+	WebhooksDue() ([]*queuedWebhook, error)
+	DeleteQueuedWebhook(id int64) error
+	Heartbeat(topic string) (*heartbeat, error)
+	UpdateHeartbeat(h *heartbeat) error
+	DeleteHeartbeat(topic string) error
+	HeartbeatsDue() ([]*heartbeat, error)
+	TopicModerated(topic string) (bool, error)
+	UpdateTopicModerated(topic string, moderated bool) error
+	HoldMessage(m *message) error
+	HeldMessages(topic string) ([]*message, error)
+	HeldMessage(topic, id string) (*message, error)
+	DeleteHeldMessage(topic, id string) error
+	AddAPNSDevice(d *apnsDevice) error
+	APNSDevices(topic string) ([]*apnsDevice, error)
+	DeleteAPNSDevice(topic, token string) error
+	AddTelegramChat(topic, chatID string) error
+	TelegramChats(topic string) ([]string, error)
+	DeleteTelegramChat(topic, chatID string) error
+	AddPhoneNumber(user, phoneNumber string) error
+	PhoneNumbers(user string) ([]string, error)
+	DeletePhoneNumber(user, phoneNumber string) error
+	SearchMessages(topic string, terms []string, limit int) ([]*message, error)
+	Close() error
+}
+
+// sqlCache is the message cache backed by a SQL database, either SQLite (file or in-memory) or PostgreSQL
+type sqlCache struct {
+	db        *cacheDB
+	queue     chan *message // Write-behind queue, if batching is enabled, see processMessageBatches
+	batchDone chan bool     // Closed when processMessageBatches has written the last queued message, see Close
+	flushes   chan bool     // Asks processMessageBatches to write the current batch right away, see waitForQueue
+	closed    bool          // Set by Close; messages can no longer be queued afterwards
+	cipher    *cacheCipher  // Encrypts the message contents, if a cache encryption key is set
+	nop       bool
+	mu        sync.RWMutex // Protects closed, so that AddMessage doesn't send to the closed queue
+	queued    int64        // Messages added to the queue so far
+	written   int64        // Queued messages that processMessageBatches has written (or failed to write) so far
+	writtenMu sync.Mutex   // Protects queued and written
+	writtenC  *sync.Cond   // Signalled when written changes
 }
 
-// newSqliteCache creates a SQLite file-backed cache
-func newSqliteCache(filename string, nop bool) (*messageCache, error) {
+// newSqliteCache creates a SQLite file-backed cache. If batchSize is set, messages are written
+// asynchronously in batches, see processMessageBatches.
+func newSqliteCache(filename string, batchSize int, batchTimeout time.Duration, nop bool) (*sqlCache, error) {
 	db, err := sql.Open("sqlite3", filename)
 	if err != nil {
 		return nil, err
@@ -189,21 +896,33 @@ func newSqliteCache(filename string, nop bool) (*messageCache, error) {
 	if err := setupCacheDB(db); err != nil {
 		return nil, err
 	}
-	return &messageCache{
-		db:  db,
-		nop: nop,
-	}, nil
+	return newSQLCache(&cacheDB{DB: db}, batchSize, batchTimeout, nop), nil
 }
 
 // newMemCache creates an in-memory cache
-func newMemCache() (*messageCache, error) {
-	return newSqliteCache(createMemoryFilename(), false)
+func newMemCache() (*sqlCache, error) {
+	return newSqliteCache(createMemoryFilename(), 0, 0, false)
 }
 
 // newNopCache creates an in-memory cache that discards all messages;
 // it is always empty and can be used if caching is entirely disabled
-func newNopCache() (*messageCache, error) {
-	return newSqliteCache(createMemoryFilename(), true)
+func newNopCache() (*sqlCache, error) {
+	return newSqliteCache(createMemoryFilename(), 0, 0, true)
+}
+
+func newSQLCache(db *cacheDB, batchSize int, batchTimeout time.Duration, nop bool) *sqlCache {
+	c := &sqlCache{
+		db:  db,
+		nop: nop,
+	}
+	if batchSize > 0 && !nop {
+		c.queue = make(chan *message, batchSize)
+		c.batchDone = make(chan bool)
+		c.flushes = make(chan bool, 1)
+		c.writtenC = sync.NewCond(&c.writtenMu)
+		go c.processMessageBatches(batchSize, batchTimeout)
+	}
+	return c
 }
 
 // createMemoryFilename creates a unique memory filename to use for the SQLite backend.
@@ -216,91 +935,252 @@ func createMemoryFilename() string {
 	return fmt.Sprintf("file:%s?mode=memory&cache=shared", util.RandomString(10))
 }
 
-func (c *messageCache) AddMessage(m *message) error {
+func (c *sqlCache) AddMessage(m *message) error {
 	if m.Event != messageEvent {
 		return errUnexpectedMessageType
 	}
 	if c.nop {
 		return nil
 	}
-	published := m.Time <= time.Now().Unix()
-	tags := strings.Join(m.Tags, ",")
-	var attachmentName, attachmentType, attachmentURL, attachmentOwner string
-	var attachmentSize, attachmentExpires int64
-	if m.Attachment != nil {
-		attachmentName = m.Attachment.Name
-		attachmentType = m.Attachment.Type
-		attachmentSize = m.Attachment.Size
-		attachmentExpires = m.Attachment.Expires
-		attachmentURL = m.Attachment.URL
-		attachmentOwner = m.Attachment.Owner
-	}
-	var actionsStr string
-	if len(m.Actions) > 0 {
-		actionsBytes, err := json.Marshal(m.Actions)
-		if err != nil {
-			return err
+	if c.queue != nil {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		if c.closed {
+			return errCacheClosed
 		}
-		actionsStr = string(actionsBytes)
-	}
-	_, err := c.db.Exec(
-		insertMessageQuery,
-		m.ID,
-		m.Time,
-		m.Topic,
-		m.Message,
-		m.Title,
-		m.Priority,
-		tags,
-		m.Click,
-		actionsStr,
-		attachmentName,
-		attachmentType,
-		attachmentSize,
-		attachmentExpires,
-		attachmentURL,
-		attachmentOwner,
-		m.Encoding,
-		published,
-	)
-	return err
-}
-
-func (c *messageCache) Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
-	if since.IsNone() {
-		return make([]*message, 0), nil
-	} else if since.IsID() {
-		return c.messagesSinceID(topic, since, scheduled)
+		c.writtenMu.Lock()
+		c.queued++
+		c.writtenMu.Unlock()
+		c.queue <- m
+		return nil
 	}
-	return c.messagesSinceTime(topic, since, scheduled)
+	return c.addMessages([]*message{m})
 }
 
-func (c *messageCache) messagesSinceTime(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
-	var rows *sql.Rows
-	var err error
-	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceTimeIncludeScheduledQuery, topic, since.Time().Unix())
-	} else {
-		rows, err = c.db.Query(selectMessagesSinceTimeQuery, topic, since.Time().Unix())
+// waitForQueue waits until all messages that were queued so far are written, so that reads see the messages
+// that were added right before them, e.g. the original message of a dedup key, collapse key or acknowledgment.
+// If the batch of the messages is still being collected, it is written right away. Without batching, messages
+// are written synchronously, so there is nothing to wait for.
+func (c *sqlCache) waitForQueue() {
+	if c.queue == nil {
+		return
 	}
-	if err != nil {
-		return nil, err
+	c.writtenMu.Lock()
+	defer c.writtenMu.Unlock()
+	target := c.queued
+	if c.written >= target {
+		return
+	}
+	select {
+	case c.flushes <- true:
+	default: // Already asked
+	}
+	for c.written < target {
+		c.writtenC.Wait()
 	}
-	return readMessages(rows)
 }
 
-func (c *messageCache) messagesSinceID(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
-	idrows, err := c.db.Query(selectRowIDFromMessageID, topic, since.ID())
-	if err != nil {
-		return nil, err
+// Close writes the messages that are still queued, waits for processMessageBatches to finish, and closes the database
+func (c *sqlCache) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
 	}
-	defer idrows.Close()
-	if !idrows.Next() {
-		return c.messagesSinceTime(topic, sinceAllMessages, scheduled)
+	c.closed = true
+	if c.queue != nil {
+		close(c.queue)
 	}
-	var rowID int64
-	if err := idrows.Scan(&rowID); err != nil {
-		return nil, err
+	c.mu.Unlock()
+	if c.batchDone != nil {
+		<-c.batchDone
+	}
+	return c.db.Close()
+}
+
+// processMessageBatches writes the queued messages in batches of up to batchSize messages, each in a single
+// transaction. After the first message of a batch, it waits up to batchTimeout for more messages; if batchTimeout
+// is 0, the batch is written as soon as there are no more messages in the queue. Since there is only one writer,
+// messages are written in the order in which they were added. If a batch can't be written, its messages are written
+// one by one, so that a single bad message doesn't take the others with it.
+func (c *sqlCache) processMessageBatches(batchSize int, batchTimeout time.Duration) {
+	defer close(c.batchDone)
+	for m := range c.queue {
+		batch := []*message{m}
+		var timeout <-chan time.Time
+		if batchTimeout > 0 {
+			timeout = time.After(batchTimeout)
+		}
+	collect:
+		for len(batch) < batchSize {
+			if timeout == nil {
+				select {
+				case m, ok := <-c.queue:
+					if !ok {
+						break collect
+					}
+					batch = append(batch, m)
+				default:
+					break collect
+				}
+			} else {
+				select {
+				case m, ok := <-c.queue:
+					if !ok {
+						break collect // Closed, write what we have right away
+					}
+					batch = append(batch, m)
+				case <-timeout:
+					break collect
+				case <-c.flushes:
+					break collect // Somebody is waiting for the batch, see waitForQueue
+				}
+			}
+		}
+		c.writeMessageBatch(batch)
+		c.writtenMu.Lock()
+		c.written += int64(len(batch))
+		c.writtenC.Broadcast()
+		c.writtenMu.Unlock()
+	}
+}
+
+func (c *sqlCache) writeMessageBatch(batch []*message) {
+	err := c.addMessages(batch)
+	if err == nil {
+		return
+	} else if len(batch) == 1 {
+		log.Printf("Unable to write message %s to cache: %s", batch[0].ID, err.Error())
+		return
+	}
+	log.Printf("Unable to write %d message(s) to cache, writing them one by one: %s", len(batch), err.Error())
+	for _, m := range batch {
+		if err := c.addMessages([]*message{m}); err != nil {
+			log.Printf("Unable to write message %s to cache: %s", m.ID, err.Error())
+		}
+	}
+}
+
+func (c *sqlCache) addMessages(ms []*message) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(c.db.rebind(insertMessageQuery))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range ms {
+		published := 0 // Not a bool, PostgreSQL does not convert booleans to integers
+		if m.Time <= time.Now().Unix() {
+			published = 1
+		}
+		ackRequired := 0
+		if m.AckRequired {
+			ackRequired = 1
+		}
+		tags := strings.Join(m.Tags, ",")
+		var attachmentName, attachmentType, attachmentURL, attachmentThumbnail, attachmentOwner, attachmentHash string
+		var attachmentSize, attachmentExpires int64
+		if m.Attachment != nil {
+			attachmentName = m.Attachment.Name
+			attachmentType = m.Attachment.Type
+			attachmentSize = m.Attachment.Size
+			attachmentExpires = m.Attachment.Expires
+			attachmentURL = m.Attachment.URL
+			attachmentThumbnail = m.Attachment.Thumbnail
+			attachmentOwner = m.Attachment.Owner
+			attachmentHash = m.Attachment.Hash
+		}
+		var actionsStr string
+		if len(m.Actions) > 0 {
+			actionsBytes, err := json.Marshal(m.Actions)
+			if err != nil {
+				return err
+			}
+			actionsStr = string(actionsBytes)
+		}
+		msg, title, click, markdown, html := m.Message, m.Title, m.Click, m.Markdown, m.HTML
+		if err := c.cipher.encryptAll(&msg, &title, &tags, &click, &actionsStr, &attachmentName, &attachmentType, &attachmentURL, &attachmentThumbnail, &markdown, &html); err != nil {
+			return err
+		}
+		_, err := stmt.Exec(
+			m.ID,
+			m.Time,
+			m.Topic,
+			msg,
+			title,
+			m.Priority,
+			tags,
+			click,
+			actionsStr,
+			attachmentName,
+			attachmentType,
+			attachmentSize,
+			attachmentExpires,
+			attachmentURL,
+			attachmentThumbnail,
+			attachmentOwner,
+			attachmentHash,
+			m.Encoding,
+			m.Group,
+			m.Expires,
+			published,
+			m.senderIP,
+			m.senderUser,
+			m.dedupKey,
+			m.InReplyTo,
+			m.thread,
+			ackRequired,
+			m.CollapseKey,
+			markdown,
+			html,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (c *sqlCache) Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+	c.waitForQueue()
+	if since.IsNone() {
+		return make([]*message, 0), nil
+	} else if since.IsID() {
+		return c.messagesSinceID(topic, since, scheduled)
+	}
+	return c.messagesSinceTime(topic, since, scheduled)
+}
+
+func (c *sqlCache) messagesSinceTime(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+	var rows *sql.Rows
+	var err error
+	if scheduled {
+		rows, err = c.db.Query(selectMessagesSinceTimeIncludeScheduledQuery, topic, since.Time().Unix())
+	} else {
+		rows, err = c.db.Query(selectMessagesSinceTimeQuery, topic, since.Time().Unix())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(rows)
+}
+
+func (c *sqlCache) messagesSinceID(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+	idrows, err := c.db.Query(selectRowIDFromMessageID, topic, since.ID())
+	if err != nil {
+		return nil, err
+	}
+	defer idrows.Close()
+	if !idrows.Next() {
+		return c.messagesSinceTime(topic, sinceAllMessages, scheduled)
+	}
+	var rowID int64
+	if err := idrows.Scan(&rowID); err != nil {
+		return nil, err
 	}
 	idrows.Close()
 	var rows *sql.Rows
@@ -312,23 +1192,145 @@ func (c *messageCache) messagesSinceID(topic string, since sinceMarker, schedule
 	if err != nil {
 		return nil, err
 	}
-	return readMessages(rows)
+	return c.readMessages(rows)
+}
+
+// MessagesAfter returns up to limit published messages after the cursor, ordered by time and insertion order.
+// The cursor of each message is set, so that the caller can continue right after it. A limit of 0 means no limit.
+func (c *sqlCache) MessagesAfter(topic string, cursor sinceMarker, limit int) ([]*message, error) {
+	c.waitForQueue()
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+	timestamp := cursor.Time().Unix()
+	rows, err := c.db.Query(selectMessagesAfterCursorQuery, topic, timestamp, timestamp, cursor.Seq(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make([]*message, 0)
+	for rows.Next() {
+		var rowID int64
+		m, err := c.scanMessage(rows, &rowID)
+		if err != nil {
+			return nil, err
+		}
+		m.cursor = newSinceCursor(m.Time, rowID)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// Message returns the message with the given ID, including who published it, or errMessageNotFound
+func (c *sqlCache) Message(topic, id string) (*message, error) {
+	c.waitForQueue()
+	rows, err := c.db.Query(selectMessageQuery, topic, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, errMessageNotFound
+	}
+	var senderIP, senderUser string
+	m, err := c.scanMessage(rows, &senderIP, &senderUser)
+	if err != nil {
+		return nil, err
+	}
+	m.senderIP, m.senderUser = senderIP, senderUser
+	return m, nil
+}
+
+// MessageByDedupKey returns the latest message of the topic that was published with the given dedup key at or
+// after the given time, or errMessageNotFound
+func (c *sqlCache) MessageByDedupKey(topic, key string, since time.Time) (*message, error) {
+	c.waitForQueue()
+	rows, err := c.db.Query(selectMessageByDedupKeyQuery, topic, key, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, errMessageNotFound
+	}
+	return c.scanMessage(rows)
+}
+
+// MessagesByCollapseKey returns the published messages of the topic with the given collapse key, including who
+// published them. Usually there is at most one, since each message replaces the previous one, see Server.collapseMessages.
+func (c *sqlCache) MessagesByCollapseKey(topic, key string) ([]*message, error) {
+	c.waitForQueue()
+	rows, err := c.db.Query(selectMessagesByCollapseKeyQuery, topic, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make([]*message, 0)
+	for rows.Next() {
+		var senderIP, senderUser string
+		m, err := c.scanMessage(rows, &senderIP, &senderUser)
+		if err != nil {
+			return nil, err
+		}
+		m.senderIP, m.senderUser = senderIP, senderUser
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// UpdateMessage replaces the title, message (including its Markdown source), priority and encoding of an existing message
+func (c *sqlCache) UpdateMessage(m *message) error {
+	c.waitForQueue()
+	title, msg, markdown, html := m.Title, m.Message, m.Markdown, m.HTML
+	if err := c.cipher.encryptAll(&title, &msg, &markdown, &html); err != nil {
+		return err
+	}
+	_, err := c.db.Exec(updateMessageQuery, title, msg, m.Priority, m.Encoding, markdown, html, m.Topic, m.ID)
+	return err
+}
+
+func (c *sqlCache) DeleteMessage(topic, id string) error {
+	c.waitForQueue()
+	if _, err := c.db.Exec(deleteMessageAcksQuery, topic, id); err != nil {
+		return err
+	}
+	_, err := c.db.Exec(deleteMessageQuery, topic, id)
+	return err
+}
+
+// DeleteMessages removes all messages of a topic, including scheduled ones
+func (c *sqlCache) DeleteMessages(topic string) error {
+	c.waitForQueue()
+	if _, err := c.db.Exec(deleteTopicAcksQuery, topic); err != nil {
+		return err
+	}
+	_, err := c.db.Exec(deleteMessagesQuery, topic)
+	return err
 }
 
-func (c *messageCache) MessagesDue() ([]*message, error) {
+func (c *sqlCache) MessagesDue() ([]*message, error) {
+	c.waitForQueue()
 	rows, err := c.db.Query(selectMessagesDueQuery, time.Now().Unix())
 	if err != nil {
 		return nil, err
 	}
-	return readMessages(rows)
+	return c.readMessages(rows)
 }
 
-func (c *messageCache) MarkPublished(m *message) error {
+func (c *sqlCache) MarkPublished(m *message) error {
+	c.waitForQueue()
 	_, err := c.db.Exec(updateMessagePublishedQuery, m.ID)
 	return err
 }
 
-func (c *messageCache) MessageCount(topic string) (int, error) {
+func (c *sqlCache) MessageCount(topic string) (int, error) {
+	c.waitForQueue()
 	rows, err := c.db.Query(selectMessageCountForTopicQuery, topic)
 	if err != nil {
 		return 0, err
@@ -346,7 +1348,8 @@ func (c *messageCache) MessageCount(topic string) (int, error) {
 	return count, nil
 }
 
-func (c *messageCache) Topics() (map[string]*topic, error) {
+func (c *sqlCache) Topics() (map[string]*topic, error) {
+	c.waitForQueue()
 	rows, err := c.db.Query(selectTopicsQuery)
 	if err != nil {
 		return nil, err
@@ -366,12 +1369,39 @@ func (c *messageCache) Topics() (map[string]*topic, error) {
 	return topics, nil
 }
 
-func (c *messageCache) Prune(olderThan time.Time) error {
-	_, err := c.db.Exec(pruneMessagesQuery, olderThan.Unix())
-	return err
+// Prune removes all published messages older than olderThan, except for the topics in topicOlderThan, which
+// are pruned using their own retention (see Config.CacheDurationTopics)
+func (c *sqlCache) Prune(olderThan time.Time, topicOlderThan map[string]time.Time) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := pruneMessagesQuery
+	args := []interface{}{olderThan.Unix()}
+	if len(topicOlderThan) > 0 {
+		query += " AND topic NOT IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(topicOlderThan)), ", ") + ")"
+	}
+	for topic, until := range topicOlderThan {
+		if _, err := tx.Exec(c.db.rebind(pruneTopicMessagesQuery), topic, until.Unix()); err != nil {
+			return err
+		}
+		args = append(args, topic)
+	}
+	if _, err := tx.Exec(c.db.rebind(query), args...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(c.db.rebind(pruneExpiredMessagesQuery), time.Now().Unix()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(pruneMessageAcksQuery); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (c *messageCache) AttachmentBytesUsed(owner string) (int64, error) {
+func (c *sqlCache) AttachmentBytesUsed(owner string) (int64, error) {
+	c.waitForQueue()
 	rows, err := c.db.Query(selectAttachmentsSizeQuery, owner, time.Now().Unix())
 	if err != nil {
 		return 0, err
@@ -386,92 +1416,834 @@ func (c *messageCache) AttachmentBytesUsed(owner string) (int64, error) {
 	} else if err := rows.Err(); err != nil {
 		return 0, err
 	}
-	return size, nil
+	return size, nil
+}
+
+func (c *sqlCache) AttachmentsExpired() ([]string, error) {
+	now := time.Now().Unix()
+	rows, err := c.db.Query(selectAttachmentsExpiredQuery, now, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// AttachmentReferences returns the number of messages that reference the uploaded file with the given hash,
+// including messages whose attachment has expired
+func (c *sqlCache) AttachmentReferences(hash string) (int, error) {
+	c.waitForQueue()
+	var count int
+	if err := c.db.QueryRow(selectAttachmentReferencesQuery, hash).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// QueueEmail adds an e-mail to the retry queue, or updates it if it is already queued
+func (c *sqlCache) QueueEmail(e *queuedEmail) error {
+	if e.ID != 0 {
+		_, err := c.db.Exec(updateEmailQuery, e.Attempts, e.NextAttempt, e.ID)
+		return err
+	}
+	b, err := json.Marshal(e.Message)
+	if err != nil {
+		return err
+	}
+	m, err := c.cipher.encrypt(string(b))
+	if err != nil {
+		return err
+	}
+	var attachmentOwner, attachmentHash string
+	if e.Message.Attachment != nil {
+		attachmentOwner = e.Message.Attachment.Owner // Not part of the JSON representation
+		attachmentHash = e.Message.Attachment.Hash
+	}
+	return c.db.QueryRow(insertEmailQuery, e.SenderIP, e.To, m, attachmentOwner, attachmentHash, e.Attempts, e.Queued, e.NextAttempt).Scan(&e.ID) // LastInsertId is not supported by PostgreSQL
+}
+
+// EmailsDue returns all queued e-mails that are due for another attempt
+func (c *sqlCache) EmailsDue() ([]*queuedEmail, error) {
+	rows, err := c.db.Query(selectEmailsDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emails := make([]*queuedEmail, 0)
+	for rows.Next() {
+		var m, attachmentOwner, attachmentHash string
+		e := &queuedEmail{}
+		if err := rows.Scan(&e.ID, &e.SenderIP, &e.To, &m, &attachmentOwner, &attachmentHash, &e.Attempts, &e.Queued, &e.NextAttempt); err != nil {
+			return nil, err
+		}
+		if err := c.cipher.decryptAll(&m); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(m), &e.Message); err != nil {
+			return nil, err
+		}
+		if e.Message.Attachment != nil {
+			e.Message.Attachment.Owner = attachmentOwner
+			e.Message.Attachment.Hash = attachmentHash
+		}
+		emails = append(emails, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// EmailsQueued returns the number of e-mails in the retry queue
+func (c *sqlCache) EmailsQueued() (int, error) {
+	rows, err := c.db.Query(selectEmailsCountQuery)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var count int
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// DeleteEmail removes an e-mail from the retry queue, after it was sent or given up on
+func (c *sqlCache) DeleteEmail(id int64) error {
+	_, err := c.db.Exec(deleteEmailQuery, id)
+	return err
+}
+
+// AddEmailDigestMessage adds a message to the pending digest for the topic and recipient. If there is no pending
+// digest, a new one is started, which is due after the given window.
+func (c *sqlCache) AddEmailDigestMessage(senderIP, to string, m *message, window time.Duration) error {
+	due, err := c.emailDigestDue(m.Topic, to)
+	if err != nil {
+		return err
+	} else if due == 0 {
+		due = time.Now().Add(window).Unix()
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	messageJSON, err := c.cipher.encrypt(string(b))
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(insertEmailDigestMessageQuery, m.Topic, to, senderIP, messageJSON, due)
+	return err
+}
+
+// EmailDigestPending returns true if there is a pending digest for the topic and recipient
+func (c *sqlCache) EmailDigestPending(topic, to string) (bool, error) {
+	due, err := c.emailDigestDue(topic, to)
+	if err != nil {
+		return false, err
+	}
+	return due > 0, nil
+}
+
+func (c *sqlCache) emailDigestDue(topic, to string) (int64, error) {
+	rows, err := c.db.Query(selectEmailDigestDueQuery, topic, to)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var due int64
+	if !rows.Next() {
+		return 0, errors.New("no rows found")
+	}
+	if err := rows.Scan(&due); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return due, nil
+}
+
+// EmailDigestsDue returns all digests whose window has passed, including all of their messages
+func (c *sqlCache) EmailDigestsDue() ([]*emailDigest, error) {
+	rows, err := c.db.Query(selectEmailDigestsDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	digests := make([]*emailDigest, 0)
+	var digest *emailDigest
+	for rows.Next() {
+		var id int64
+		var topic, to, senderIP, messageJSON string
+		if err := rows.Scan(&id, &topic, &to, &senderIP, &messageJSON); err != nil {
+			return nil, err
+		}
+		if err := c.cipher.decryptAll(&messageJSON); err != nil {
+			return nil, err
+		}
+		var m *message
+		if err := json.Unmarshal([]byte(messageJSON), &m); err != nil {
+			return nil, err
+		}
+		if digest == nil || digest.Topic != topic || digest.To != to {
+			digest = &emailDigest{Topic: topic, To: to, SenderIP: senderIP}
+			digests = append(digests, digest)
+		}
+		digest.Messages = append(digest.Messages, m)
+		digest.LastID = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// DeleteEmailDigest removes the messages of a digest after it was sent. Messages that were added in the meantime
+// are not removed.
+func (c *sqlCache) DeleteEmailDigest(d *emailDigest) error {
+	_, err := c.db.Exec(deleteEmailDigestMessagesQuery, d.Topic, d.To, d.LastID)
+	return err
+}
+
+// AddRecurringMessage stores a new recurring message; its ID and next run must be set already
+func (c *sqlCache) AddRecurringMessage(r *recurringMessage) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	messageJSON, err := c.cipher.encrypt(string(b))
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(insertRecurringMessageQuery, r.ID, r.Topic, messageJSON, r.Next, r.senderIP, r.senderUser)
+	return err
+}
+
+// RecurringMessages returns the recurring messages of a topic, in the order they were added
+func (c *sqlCache) RecurringMessages(topic string) ([]*recurringMessage, error) {
+	rows, err := c.db.Query(selectRecurringMessagesQuery, topic)
+	if err != nil {
+		return nil, err
+	}
+	return c.readRecurringMessages(rows)
+}
+
+// RecurringMessagesDue returns all recurring messages whose next run has come
+func (c *sqlCache) RecurringMessagesDue() ([]*recurringMessage, error) {
+	rows, err := c.db.Query(selectRecurringMessagesDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readRecurringMessages(rows)
+}
+
+// UpdateRecurringMessage stores the next run of a recurring message; the other fields cannot be changed
+func (c *sqlCache) UpdateRecurringMessage(r *recurringMessage) error {
+	_, err := c.db.Exec(updateRecurringMessageNextQuery, r.Next, r.Topic, r.ID)
+	return err
+}
+
+// DeleteRecurringMessage removes a recurring message; messages that were already published are not affected
+func (c *sqlCache) DeleteRecurringMessage(topic, id string) error {
+	_, err := c.db.Exec(deleteRecurringMessageQuery, topic, id)
+	return err
+}
+
+// TopicInfo returns the metadata of a topic; if none was set, all fields but the topic are empty
+func (c *sqlCache) TopicInfo(topic string) (*topicInfo, error) {
+	info := &topicInfo{Topic: topic}
+	err := c.db.QueryRow(selectTopicInfoQuery, topic).Scan(&info.DisplayName, &info.Icon, &info.Description)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return info, nil
+}
+
+// UpdateTopicInfo sets the metadata of a topic, replacing the existing metadata
+func (c *sqlCache) UpdateTopicInfo(info *topicInfo) error {
+	_, err := c.db.Exec(upsertTopicInfoQuery, info.Topic, info.DisplayName, info.Icon, info.Description)
+	return err
+}
+
+// DeleteTopicInfo removes the metadata of a topic
+func (c *sqlCache) DeleteTopicInfo(topic string) error {
+	_, err := c.db.Exec(deleteTopicInfoQuery, topic)
+	return err
+}
+
+// TopicDefaults returns the default message fields of a topic; if none were set, all fields but the topic are empty
+func (c *sqlCache) TopicDefaults(topic string) (*topicDefaults, error) {
+	defaults := &topicDefaults{Topic: topic}
+	var tags string
+	err := c.db.QueryRow(selectTopicDefaultsQuery, topic).Scan(&defaults.Title, &defaults.Priority, &tags, &defaults.Click)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if tags != "" {
+		defaults.Tags = strings.Split(tags, ",")
+	}
+	return defaults, nil
+}
+
+// UpdateTopicDefaults sets the default message fields of a topic, replacing the existing defaults
+func (c *sqlCache) UpdateTopicDefaults(defaults *topicDefaults) error {
+	_, err := c.db.Exec(upsertTopicDefaultsQuery, defaults.Topic, defaults.Title, defaults.Priority, strings.Join(defaults.Tags, ","), defaults.Click)
+	return err
+}
+
+// DeleteTopicDefaults removes the default message fields of a topic
+func (c *sqlCache) DeleteTopicDefaults(topic string) error {
+	_, err := c.db.Exec(deleteTopicDefaultsQuery, topic)
+	return err
+}
+
+// AddMessageAck records that a subscriber acknowledged a message. It returns false if the subscriber had
+// already acknowledged it, in which case the original acknowledgment is kept.
+func (c *sqlCache) AddMessageAck(topic, id string, ack *messageAck) (bool, error) {
+	res, err := c.db.Exec(insertMessageAckQuery, topic, id, ack.subscriber, ack.User, ack.Time)
+	if err != nil {
+		return false, err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// MessageAcks returns the acknowledgments of a message, oldest first
+func (c *sqlCache) MessageAcks(topic, id string) ([]*messageAck, error) {
+	rows, err := c.db.Query(selectMessageAcksQuery, topic, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	acks := make([]*messageAck, 0)
+	for rows.Next() {
+		var ack messageAck
+		if err := rows.Scan(&ack.User, &ack.Time); err != nil {
+			return nil, err
+		}
+		acks = append(acks, &ack)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return acks, nil
+}
+
+// TopicEscalation returns the escalation chain of a topic; if none was set, it has no steps
+func (c *sqlCache) TopicEscalation(topic string) (*topicEscalation, error) {
+	e := &topicEscalation{Topic: topic, Steps: make([]*escalationStep, 0)}
+	var steps string
+	err := c.db.QueryRow(selectTopicEscalationQuery, topic).Scan(&steps)
+	if err == sql.ErrNoRows {
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(steps), &e.Steps); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// UpdateTopicEscalation sets the escalation chain of a topic, replacing the existing one
+func (c *sqlCache) UpdateTopicEscalation(e *topicEscalation) error {
+	steps, err := json.Marshal(e.Steps)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(upsertTopicEscalationQuery, e.Topic, string(steps))
+	return err
+}
+
+// DeleteTopicEscalation removes the escalation chain of a topic; escalations already in progress are stopped
+// when they are due, see Server.escalate
+func (c *sqlCache) DeleteTopicEscalation(topic string) error {
+	_, err := c.db.Exec(deleteTopicEscalationQuery, topic)
+	return err
+}
+
+// UpdateEscalation adds the escalation of a message, or replaces it if the message is already being escalated
+func (c *sqlCache) UpdateEscalation(e *escalation) error {
+	_, err := c.db.Exec(upsertEscalationQuery, e.Topic, e.MessageID, e.Step, e.Due, strings.Join(e.Copies, ","))
+	return err
+}
+
+// EscalationsDue returns all escalations whose next step is due
+func (c *sqlCache) EscalationsDue() ([]*escalation, error) {
+	rows, err := c.db.Query(selectEscalationsDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	escalations := make([]*escalation, 0)
+	for rows.Next() {
+		var e escalation
+		var copies string
+		if err := rows.Scan(&e.Topic, &e.MessageID, &e.Step, &e.Due, &copies); err != nil {
+			return nil, err
+		}
+		if copies != "" {
+			e.Copies = strings.Split(copies, ",")
+		}
+		escalations = append(escalations, &e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return escalations, nil
+}
+
+// DeleteEscalation ends the escalation of a message
+func (c *sqlCache) DeleteEscalation(topic, id string) error {
+	_, err := c.db.Exec(deleteEscalationQuery, topic, id)
+	return err
+}
+
+// QuietHours returns the quiet hours of a user, or nil if the user has not set any
+func (c *sqlCache) QuietHours(user string) (*quietHours, error) {
+	var q quietHours
+	err := c.db.QueryRow(selectQuietHoursQuery, user).Scan(&q.Start, &q.End, &q.Timezone, &q.Priority)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// UpdateQuietHours sets the quiet hours of a user, replacing the existing ones
+func (c *sqlCache) UpdateQuietHours(user string, q *quietHours) error {
+	_, err := c.db.Exec(upsertQuietHoursQuery, user, q.Start, q.End, q.Timezone, q.Priority)
+	return err
+}
+
+// DeleteQuietHours removes the quiet hours of a user
+func (c *sqlCache) DeleteQuietHours(user string) error {
+	_, err := c.db.Exec(deleteQuietHoursQuery, user)
+	return err
+}
+
+// TopicWebhooks returns the outgoing webhooks of a topic; if none were set, the list is empty
+func (c *sqlCache) TopicWebhooks(topic string) (*topicWebhooks, error) {
+	w := &topicWebhooks{Topic: topic, Webhooks: make([]*topicWebhook, 0)}
+	var webhooks string
+	err := c.db.QueryRow(selectTopicWebhooksQuery, topic).Scan(&webhooks, &w.Secret)
+	if err == sql.ErrNoRows {
+		return w, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := c.cipher.decryptAll(&webhooks, &w.Secret); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(webhooks), &w.Webhooks); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// UpdateTopicWebhooks sets the outgoing webhooks of a topic, replacing the existing ones
+func (c *sqlCache) UpdateTopicWebhooks(w *topicWebhooks) error {
+	b, err := json.Marshal(w.Webhooks)
+	if err != nil {
+		return err
+	}
+	webhooks, secret := string(b), w.Secret
+	if err := c.cipher.encryptAll(&webhooks, &secret); err != nil {
+		return err
+	}
+	_, err = c.db.Exec(upsertTopicWebhooksQuery, w.Topic, webhooks, secret)
+	return err
+}
+
+// DeleteTopicWebhooks removes the outgoing webhooks of a topic; deliveries that are already queued are still retried
+func (c *sqlCache) DeleteTopicWebhooks(topic string) error {
+	_, err := c.db.Exec(deleteTopicWebhooksQuery, topic)
+	return err
+}
+
+// QueueWebhook adds a failed webhook delivery to the retry queue, or updates it if it is already queued
+func (c *sqlCache) QueueWebhook(w *queuedWebhook) error {
+	if w.ID != 0 {
+		_, err := c.db.Exec(updateQueuedWebhookQuery, w.Attempts, w.NextAttempt, w.ID)
+		return err
+	}
+	b, err := json.Marshal(w.Message)
+	if err != nil {
+		return err
+	}
+	m, err := c.cipher.encrypt(string(b))
+	if err != nil {
+		return err
+	}
+	secret, err := c.cipher.encrypt(w.Secret)
+	if err != nil {
+		return err
+	}
+	return c.db.QueryRow(insertQueuedWebhookQuery, w.URL, w.Format, secret, m, w.Attempts, w.Queued, w.NextAttempt).Scan(&w.ID)
+}
+
+// WebhooksDue returns all queued webhook deliveries that are due for another attempt
+func (c *sqlCache) WebhooksDue() ([]*queuedWebhook, error) {
+	rows, err := c.db.Query(selectQueuedWebhooksDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	webhooks := make([]*queuedWebhook, 0)
+	for rows.Next() {
+		var m string
+		w := &queuedWebhook{}
+		if err := rows.Scan(&w.ID, &w.URL, &w.Format, &w.Secret, &m, &w.Attempts, &w.Queued, &w.NextAttempt); err != nil {
+			return nil, err
+		}
+		if err := c.cipher.decryptAll(&w.Secret, &m); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(m), &w.Message); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// DeleteQueuedWebhook removes a webhook delivery from the retry queue, after it succeeded or was given up on
+func (c *sqlCache) DeleteQueuedWebhook(id int64) error {
+	_, err := c.db.Exec(deleteQueuedWebhookQuery, id)
+	return err
+}
+
+// Heartbeat returns the heartbeat of a topic, or nil if the topic has none
+func (c *sqlCache) Heartbeat(topic string) (*heartbeat, error) {
+	rows, err := c.db.Query(selectHeartbeatQuery, topic)
+	if err != nil {
+		return nil, err
+	}
+	heartbeats, err := readHeartbeats(rows)
+	if err != nil {
+		return nil, err
+	} else if len(heartbeats) == 0 {
+		return nil, nil
+	}
+	return heartbeats[0], nil
+}
+
+// UpdateHeartbeat sets the heartbeat of a topic, replacing the existing one
+func (c *sqlCache) UpdateHeartbeat(h *heartbeat) error {
+	alerted := 0
+	if h.Alerted {
+		alerted = 1
+	}
+	_, err := c.db.Exec(upsertHeartbeatQuery, h.Topic, h.Interval, h.Target, h.Email, h.Message, h.Due, alerted, h.User)
+	return err
+}
+
+// DeleteHeartbeat removes the heartbeat of a topic
+func (c *sqlCache) DeleteHeartbeat(topic string) error {
+	_, err := c.db.Exec(deleteHeartbeatQuery, topic)
+	return err
+}
+
+// HeartbeatsDue returns all heartbeats that have not seen a message in time, and whose alert was not sent yet
+func (c *sqlCache) HeartbeatsDue() ([]*heartbeat, error) {
+	rows, err := c.db.Query(selectHeartbeatsDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return readHeartbeats(rows)
+}
+
+// TopicModerated returns true if anonymous messages to the topic are held for moderation
+func (c *sqlCache) TopicModerated(topic string) (bool, error) {
+	var count int
+	if err := c.db.QueryRow(selectTopicModeratedQuery, topic).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// UpdateTopicModerated turns moderation of a topic on or off; messages that are already held stay in the queue
+func (c *sqlCache) UpdateTopicModerated(topic string, moderated bool) error {
+	var err error
+	if moderated {
+		_, err = c.db.Exec(insertTopicModeratedQuery, topic)
+	} else {
+		_, err = c.db.Exec(deleteTopicModeratedQuery, topic)
+	}
+	return err
+}
+
+// HoldMessage adds a message to the moderation queue of its topic
+func (c *sqlCache) HoldMessage(m *message) error {
+	b, err := json.Marshal(newHeldMessage(m))
+	if err != nil {
+		return err
+	}
+	held, err := c.cipher.encrypt(string(b))
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(insertHeldMessageQuery, m.Topic, m.ID, m.Time, held)
+	return err
+}
+
+// HeldMessages returns the moderation queue of a topic, oldest first
+func (c *sqlCache) HeldMessages(topic string) ([]*message, error) {
+	rows, err := c.db.Query(selectHeldMessagesQuery, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := make([]*message, 0)
+	for rows.Next() {
+		var held string
+		if err := rows.Scan(&held); err != nil {
+			return nil, err
+		}
+		m, err := c.readHeldMessage(held)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// HeldMessage returns a message from the moderation queue of a topic, or errMessageNotFound
+func (c *sqlCache) HeldMessage(topic, id string) (*message, error) {
+	var held string
+	err := c.db.QueryRow(selectHeldMessageQuery, topic, id).Scan(&held)
+	if err == sql.ErrNoRows {
+		return nil, errMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return c.readHeldMessage(held)
+}
+
+// DeleteHeldMessage removes a message from the moderation queue, after it was approved or rejected
+func (c *sqlCache) DeleteHeldMessage(topic, id string) error {
+	_, err := c.db.Exec(deleteHeldMessageQuery, topic, id)
+	return err
+}
+
+// AddAPNSDevice registers a device for the messages of a topic, or updates the user it was registered by
+func (c *sqlCache) AddAPNSDevice(d *apnsDevice) error {
+	_, err := c.db.Exec(upsertAPNSDeviceQuery, d.Topic, d.Token, d.User)
+	return err
+}
+
+// APNSDevices returns the devices that registered for the messages of a topic
+func (c *sqlCache) APNSDevices(topic string) ([]*apnsDevice, error) {
+	rows, err := c.db.Query(selectAPNSDevicesQuery, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := make([]*apnsDevice, 0)
+	for rows.Next() {
+		d := &apnsDevice{}
+		if err := rows.Scan(&d.Topic, &d.Token, &d.User); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// DeleteAPNSDevice unregisters a device from a topic
+func (c *sqlCache) DeleteAPNSDevice(topic, token string) error {
+	_, err := c.db.Exec(deleteAPNSDeviceQuery, topic, token)
+	return err
+}
+
+// AddTelegramChat forwards the messages of a topic to a Telegram chat; adding a chat twice does nothing
+func (c *sqlCache) AddTelegramChat(topic, chatID string) error {
+	_, err := c.db.Exec(insertTelegramChatQuery, topic, chatID)
+	return err
+}
+
+// TelegramChats returns the IDs of the Telegram chats that the messages of a topic are forwarded to
+func (c *sqlCache) TelegramChats(topic string) ([]string, error) {
+	rows, err := c.db.Query(selectTelegramChatsQuery, topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chats := make([]string, 0)
+	for rows.Next() {
+		var chatID string
+		if err := rows.Scan(&chatID); err != nil {
+			return nil, err
+		}
+		chats = append(chats, chatID)
+	}
+	return chats, rows.Err()
+}
+
+// DeleteTelegramChat stops forwarding the messages of a topic to a Telegram chat
+func (c *sqlCache) DeleteTelegramChat(topic, chatID string) error {
+	_, err := c.db.Exec(deleteTelegramChatQuery, topic, chatID)
+	return err
+}
+
+// AddPhoneNumber adds a verified phone number to a user; adding a number twice does nothing
+func (c *sqlCache) AddPhoneNumber(user, phoneNumber string) error {
+	_, err := c.db.Exec(insertPhoneNumberQuery, user, phoneNumber)
+	return err
+}
+
+// PhoneNumbers returns the verified phone numbers of a user
+func (c *sqlCache) PhoneNumbers(user string) ([]string, error) {
+	rows, err := c.db.Query(selectPhoneNumbersQuery, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	phoneNumbers := make([]string, 0)
+	for rows.Next() {
+		var phoneNumber string
+		if err := rows.Scan(&phoneNumber); err != nil {
+			return nil, err
+		}
+		phoneNumbers = append(phoneNumbers, phoneNumber)
+	}
+	return phoneNumbers, rows.Err()
+}
+
+// DeletePhoneNumber removes a phone number from a user
+func (c *sqlCache) DeletePhoneNumber(user, phoneNumber string) error {
+	_, err := c.db.Exec(deletePhoneNumberQuery, user, phoneNumber)
+	return err
+}
+
+func (c *sqlCache) readHeldMessage(held string) (*message, error) {
+	if err := c.cipher.decryptAll(&held); err != nil {
+		return nil, err
+	}
+	var h heldMessage
+	if err := json.Unmarshal([]byte(held), &h); err != nil {
+		return nil, err
+	}
+	return h.toMessage(), nil
+}
+
+func readHeartbeats(rows *sql.Rows) ([]*heartbeat, error) {
+	defer rows.Close()
+	heartbeats := make([]*heartbeat, 0)
+	for rows.Next() {
+		var h heartbeat
+		var alerted int
+		if err := rows.Scan(&h.Topic, &h.Interval, &h.Target, &h.Email, &h.Message, &h.Due, &alerted, &h.User); err != nil {
+			return nil, err
+		}
+		h.Alerted = alerted == 1
+		heartbeats = append(heartbeats, &h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return heartbeats, nil
 }
 
-func (c *messageCache) AttachmentsExpired() ([]string, error) {
-	rows, err := c.db.Query(selectAttachmentsExpiredQuery, time.Now().Unix())
-	if err != nil {
-		return nil, err
-	}
+func (c *sqlCache) readRecurringMessages(rows *sql.Rows) ([]*recurringMessage, error) {
 	defer rows.Close()
-	ids := make([]string, 0)
+	recurring := make([]*recurringMessage, 0)
 	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
+		var id, topic, messageJSON, senderIP, senderUser string
+		var next int64
+		if err := rows.Scan(&id, &topic, &messageJSON, &next, &senderIP, &senderUser); err != nil {
 			return nil, err
 		}
-		ids = append(ids, id)
+		if err := c.cipher.decryptAll(&messageJSON); err != nil {
+			return nil, err
+		}
+		var r *recurringMessage
+		if err := json.Unmarshal([]byte(messageJSON), &r); err != nil {
+			return nil, err
+		}
+		r.ID, r.Topic, r.Next, r.senderIP, r.senderUser = id, topic, next, senderIP, senderUser
+		recurring = append(recurring, r)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	return ids, nil
+	return recurring, nil
+}
+
+// SearchMessages returns the most recent published messages in the topic whose title, message or tags contain a
+// word starting with each of the given terms (see parseSearchTerms), up to limit messages, oldest first
+func (c *sqlCache) SearchMessages(topic string, terms []string, limit int) ([]*message, error) {
+	c.waitForQueue()
+	if len(terms) == 0 {
+		return make([]*message, 0), nil
+	} else if c.cipher != nil {
+		return nil, errCacheCipherSearch // The search index only contains the encrypted values
+	}
+	var rows *sql.Rows
+	var err error
+	if c.db.postgres {
+		rows, err = c.db.Query(postgresSearchMessagesQuery, topic, postgresSearchQuery(terms), limit)
+	} else {
+		rows, err = c.db.Query(searchMessagesQuery, topic, sqliteSearchQuery(terms), limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// sqliteSearchQuery turns the terms into an FTS4 prefix query, e.g. disk* full*. The terms are lower-case, so
+// they can never be mistaken for the AND, OR and NOT operators.
+func sqliteSearchQuery(terms []string) string {
+	query := make([]string, len(terms))
+	for i, term := range terms {
+		query[i] = term + "*"
+	}
+	return strings.Join(query, " ")
 }
 
-func readMessages(rows *sql.Rows) ([]*message, error) {
+func (c *sqlCache) readMessages(rows *sql.Rows) ([]*message, error) {
 	defer rows.Close()
 	messages := make([]*message, 0)
 	for rows.Next() {
-		var timestamp, attachmentSize, attachmentExpires int64
-		var priority int
-		var id, topic, msg, title, tagsStr, click, actionsStr, attachmentName, attachmentType, attachmentURL, attachmentOwner, encoding string
-		err := rows.Scan(
-			&id,
-			&timestamp,
-			&topic,
-			&msg,
-			&title,
-			&priority,
-			&tagsStr,
-			&click,
-			&actionsStr,
-			&attachmentName,
-			&attachmentType,
-			&attachmentSize,
-			&attachmentExpires,
-			&attachmentURL,
-			&attachmentOwner,
-			&encoding,
-		)
+		m, err := c.scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-		var tags []string
-		if tagsStr != "" {
-			tags = strings.Split(tagsStr, ",")
-		}
-		var actions []*action
-		if actionsStr != "" {
-			if err := json.Unmarshal([]byte(actionsStr), &actions); err != nil {
-				return nil, err
-			}
-		}
-		var att *attachment
-		if attachmentName != "" && attachmentURL != "" {
-			att = &attachment{
-				Name:    attachmentName,
-				Type:    attachmentType,
-				Size:    attachmentSize,
-				Expires: attachmentExpires,
-				URL:     attachmentURL,
-				Owner:   attachmentOwner,
-			}
-		}
-		messages = append(messages, &message{
-			ID:         id,
-			Time:       timestamp,
-			Event:      messageEvent,
-			Topic:      topic,
-			Message:    msg,
-			Title:      title,
-			Priority:   priority,
-			Tags:       tags,
-			Click:      click,
-			Actions:    actions,
-			Attachment: att,
-			Encoding:   encoding,
-		})
+		messages = append(messages, m)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -479,6 +2251,92 @@ func readMessages(rows *sql.Rows) ([]*message, error) {
 	return messages, nil
 }
 
+// scanMessage reads the message columns of the current row, followed by the given extra columns, if any
+func (c *sqlCache) scanMessage(rows *sql.Rows, extra ...interface{}) (*message, error) {
+	var timestamp, expires, attachmentSize, attachmentExpires int64
+	var priority, ackRequired int
+	var id, topic, msg, title, tagsStr, click, actionsStr, attachmentName, attachmentType, attachmentURL, attachmentThumbnail, attachmentOwner, attachmentHash, encoding, group, inReplyTo, thread, collapseKey, markdown, html string
+	dest := []interface{}{
+		&id,
+		&timestamp,
+		&topic,
+		&msg,
+		&title,
+		&priority,
+		&tagsStr,
+		&click,
+		&actionsStr,
+		&attachmentName,
+		&attachmentType,
+		&attachmentSize,
+		&attachmentExpires,
+		&attachmentURL,
+		&attachmentThumbnail,
+		&attachmentOwner,
+		&attachmentHash,
+		&encoding,
+		&group,
+		&expires,
+		&inReplyTo,
+		&thread,
+		&ackRequired,
+		&collapseKey,
+		&markdown,
+		&html,
+	}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if err := c.cipher.decryptAll(&msg, &title, &tagsStr, &click, &actionsStr, &attachmentName, &attachmentType, &attachmentURL, &attachmentThumbnail, &markdown, &html); err != nil {
+		return nil, err
+	}
+	var tags []string
+	if tagsStr != "" {
+		tags = strings.Split(tagsStr, ",")
+	}
+	var actions []*action
+	if actionsStr != "" {
+		if err := json.Unmarshal([]byte(actionsStr), &actions); err != nil {
+			return nil, err
+		}
+	}
+	var att *attachment
+	if attachmentName != "" && attachmentURL != "" {
+		att = &attachment{
+			Name:      attachmentName,
+			Type:      attachmentType,
+			Size:      attachmentSize,
+			Expires:   attachmentExpires,
+			URL:       attachmentURL,
+			Thumbnail: attachmentThumbnail,
+			Owner:     attachmentOwner,
+			Hash:      attachmentHash,
+		}
+	}
+	return &message{
+		ID:          id,
+		Time:        timestamp,
+		Expires:     expires,
+		Event:       messageEvent,
+		Topic:       topic,
+		Message:     msg,
+		Title:       title,
+		Priority:    priority,
+		Tags:        tags,
+		Click:       click,
+		Group:       group,
+		Actions:     actions,
+		Attachment:  att,
+		Encoding:    encoding,
+		InReplyTo:   inReplyTo,
+		AckRequired: ackRequired == 1,
+		CollapseKey: collapseKey,
+		Markdown:    markdown,
+		HTML:        html,
+		thread:      thread,
+	}, nil
+}
+
 func setupCacheDB(db *sql.DB) error {
 	// If 'messages' table does not exist, this must be a new database
 	rowsMC, err := db.Query(selectMessagesCountQuery)
@@ -516,6 +2374,62 @@ func setupCacheDB(db *sql.DB) error {
 		return migrateFrom4(db)
 	} else if schemaVersion == 5 {
 		return migrateFrom5(db)
+	} else if schemaVersion == 6 {
+		return migrateFrom6(db)
+	} else if schemaVersion == 7 {
+		return migrateFrom7(db)
+	} else if schemaVersion == 8 {
+		return migrateFrom8(db)
+	} else if schemaVersion == 9 {
+		return migrateFrom9(db)
+	} else if schemaVersion == 10 {
+		return migrateFrom10(db)
+	} else if schemaVersion == 11 {
+		return migrateFrom11(db)
+	} else if schemaVersion == 12 {
+		return migrateFrom12(db)
+	} else if schemaVersion == 13 {
+		return migrateFrom13(db)
+	} else if schemaVersion == 14 {
+		return migrateFrom14(db)
+	} else if schemaVersion == 15 {
+		return migrateFrom15(db)
+	} else if schemaVersion == 16 {
+		return migrateFrom16(db)
+	} else if schemaVersion == 17 {
+		return migrateFrom17(db)
+	} else if schemaVersion == 18 {
+		return migrateFrom18(db)
+	} else if schemaVersion == 19 {
+		return migrateFrom19(db)
+	} else if schemaVersion == 20 {
+		return migrateFrom20(db)
+	} else if schemaVersion == 21 {
+		return migrateFrom21(db)
+	} else if schemaVersion == 22 {
+		return migrateFrom22(db)
+	} else if schemaVersion == 23 {
+		return migrateFrom23(db)
+	} else if schemaVersion == 24 {
+		return migrateFrom24(db)
+	} else if schemaVersion == 25 {
+		return migrateFrom25(db)
+	} else if schemaVersion == 26 {
+		return migrateFrom26(db)
+	} else if schemaVersion == 27 {
+		return migrateFrom27(db)
+	} else if schemaVersion == 28 {
+		return migrateFrom28(db)
+	} else if schemaVersion == 29 {
+		return migrateFrom29(db)
+	} else if schemaVersion == 30 {
+		return migrateFrom30(db)
+	} else if schemaVersion == 31 {
+		return migrateFrom31(db)
+	} else if schemaVersion == 32 {
+		return migrateFrom32(db)
+	} else if schemaVersion == 33 {
+		return migrateFrom33(db)
 	}
 	return fmt.Errorf("unexpected schema version found: %d", schemaVersion)
 }
@@ -524,6 +2438,51 @@ func setupNewCacheDB(db *sql.DB) error {
 	if _, err := db.Exec(createMessagesTableQuery); err != nil {
 		return err
 	}
+	if _, err := db.Exec(createEmailsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createEmailDigestsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createRecurringMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createTopicInfoTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createTopicDefaultsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createMessageAcksTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createEscalationsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createQuietHoursTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createWebhooksTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createHeartbeatsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createModerationTablesQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createAPNSDevicesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createTelegramChatsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createPhoneNumbersTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createMessagesSearchIndexQuery); err != nil {
+		return err
+	}
 	if _, err := db.Exec(createSchemaVersionTableQuery); err != nil {
 		return err
 	}
@@ -599,5 +2558,319 @@ func migrateFrom5(db *sql.DB) error {
 	if _, err := db.Exec(updateSchemaVersion, 6); err != nil {
 		return err
 	}
+	return migrateFrom6(db)
+}
+
+func migrateFrom6(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 6 to 7")
+	if _, err := db.Exec(migrate6To7AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 7); err != nil {
+		return err
+	}
+	return migrateFrom7(db)
+}
+
+func migrateFrom7(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 7 to 8")
+	if _, err := db.Exec(migrate7To8CreateEmailsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 8); err != nil {
+		return err
+	}
+	return migrateFrom8(db)
+}
+
+func migrateFrom8(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 8 to 9")
+	if _, err := db.Exec(createEmailDigestsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 9); err != nil {
+		return err
+	}
+	return migrateFrom9(db)
+}
+
+func migrateFrom9(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 9 to 10")
+	if _, err := db.Exec(createMessagesSearchIndexQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(rebuildMessagesSearchIndexQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 10); err != nil {
+		return err
+	}
+	return migrateFrom10(db)
+}
+
+func migrateFrom10(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 10 to 11")
+	if _, err := db.Exec(migrate10To11AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 11); err != nil {
+		return err
+	}
+	return migrateFrom11(db)
+}
+
+func migrateFrom11(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 11 to 12")
+	if _, err := db.Exec(createMessagesSearchIndexQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 12); err != nil {
+		return err
+	}
+	return migrateFrom12(db)
+}
+
+func migrateFrom12(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 12 to 13")
+	if _, err := db.Exec(migrate12To13AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 13); err != nil {
+		return err
+	}
+	return migrateFrom13(db)
+}
+
+func migrateFrom13(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 13 to 14")
+	if _, err := db.Exec(migrate13To14AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 14); err != nil {
+		return err
+	}
+	return migrateFrom14(db)
+}
+
+func migrateFrom14(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 14 to 15")
+	if _, err := db.Exec(migrate14To15AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 15); err != nil {
+		return err
+	}
+	return migrateFrom15(db)
+}
+
+func migrateFrom15(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 15 to 16")
+	if _, err := db.Exec(migrate15To16AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 16); err != nil {
+		return err
+	}
+	return migrateFrom16(db)
+}
+
+func migrateFrom16(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 16 to 17")
+	if _, err := db.Exec(createRecurringMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 17); err != nil {
+		return err
+	}
+	return migrateFrom17(db)
+}
+
+func migrateFrom17(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 17 to 18")
+	if _, err := db.Exec(createTopicInfoTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 18); err != nil {
+		return err
+	}
+	return migrateFrom18(db)
+}
+
+func migrateFrom18(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 18 to 19")
+	if _, err := db.Exec(migrate18To19AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 19); err != nil {
+		return err
+	}
+	return migrateFrom19(db)
+}
+
+func migrateFrom19(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 19 to 20")
+	if _, err := db.Exec(createTopicDefaultsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 20); err != nil {
+		return err
+	}
+	return migrateFrom20(db)
+}
+
+func migrateFrom20(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 20 to 21")
+	if _, err := db.Exec(migrate20To21AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(createMessageAcksTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 21); err != nil {
+		return err
+	}
+	return migrateFrom21(db)
+}
+
+func migrateFrom21(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 21 to 22")
+	if _, err := db.Exec(createEscalationsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 22); err != nil {
+		return err
+	}
+	return migrateFrom22(db)
+}
+
+func migrateFrom22(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 22 to 23")
+	if _, err := db.Exec(createQuietHoursTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 23); err != nil {
+		return err
+	}
+	return migrateFrom23(db)
+}
+
+func migrateFrom23(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 23 to 24")
+	if _, err := db.Exec(migrate23To24AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 24); err != nil {
+		return err
+	}
+	return migrateFrom24(db)
+}
+
+func migrateFrom24(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 24 to 25")
+	if _, err := db.Exec(migrate24To25AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 25); err != nil {
+		return err
+	}
+	return migrateFrom25(db)
+}
+
+func migrateFrom25(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 25 to 26")
+	if _, err := db.Exec(migrate25To26CreateWebhooksTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 26); err != nil {
+		return err
+	}
+	return migrateFrom26(db)
+}
+
+func migrateFrom26(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 26 to 27")
+	if _, err := db.Exec(migrate26To27AlterTopicWebhooksTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 27); err != nil {
+		return err
+	}
+	return migrateFrom27(db)
+}
+
+func migrateFrom27(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 27 to 28")
+	if _, err := db.Exec(migrate27To28CreateHeartbeatsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 28); err != nil {
+		return err
+	}
+	return migrateFrom28(db)
+}
+
+func migrateFrom28(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 28 to 29")
+	if _, err := db.Exec(createModerationTablesQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 29); err != nil {
+		return err
+	}
+	return migrateFrom29(db)
+}
+
+func migrateFrom29(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 29 to 30")
+	if _, err := db.Exec(createAPNSDevicesTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 30); err != nil {
+		return err
+	}
+	return migrateFrom30(db)
+}
+
+func migrateFrom30(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 30 to 31")
+	if _, err := db.Exec(createTelegramChatsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 31); err != nil {
+		return err
+	}
+	return migrateFrom31(db)
+}
+
+func migrateFrom31(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 31 to 32")
+	if _, err := db.Exec(migrate31To32AlterWebhookQueueTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 32); err != nil {
+		return err
+	}
+	return migrateFrom32(db)
+}
+
+func migrateFrom32(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 32 to 33")
+	if _, err := db.Exec(createPhoneNumbersTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 33); err != nil {
+		return err
+	}
+	return migrateFrom33(db)
+}
+
+func migrateFrom33(db *sql.DB) error {
+	log.Print("Migrating cache database schema: from 33 to 34")
+	if _, err := db.Exec(migrate33To34AlterHeartbeatsTableQuery); err != nil {
+		return err
+	}
+	if _, err := db.Exec(updateSchemaVersion, 34); err != nil {
+		return err
+	}
 	return nil // Update this when a new version is added
 }
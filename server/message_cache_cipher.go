@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// cacheCipherPrefix marks encrypted values in the message cache. Values without it were written before encryption
+// was enabled, and are returned as they are.
+const cacheCipherPrefix = "enc:v1:"
+
+var (
+	errCacheCipherKeyMissing = errors.New("message cache contains encrypted values, but no cache encryption key is set")
+	errCacheCipherInvalid    = errors.New("unable to decrypt value in message cache, wrong cache encryption key?")
+	errCacheCipherSearch     = errors.New("search is not supported if the message cache is encrypted")
+)
+
+// cacheCipher encrypts the message contents stored in the SQL cache with AES-256-GCM. A nil cacheCipher
+// stores all values in plain text.
+type cacheCipher struct {
+	aead cipher.AEAD
+}
+
+// loadCacheCipher reads the base64-encoded 32-byte key from the given file, e.g. as created
+// with "openssl rand -base64 32"
+func loadCacheCipher(filename string) (*cacheCipher, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache encryption key file %s: %s", filename, err.Error())
+	} else if len(key) != 32 {
+		return nil, fmt.Errorf("invalid cache encryption key file %s: key must be 32 bytes, not %d", filename, len(key))
+	}
+	return newCacheCipher(key)
+}
+
+func newCacheCipher(key []byte) (*cacheCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheCipher{aead: aead}, nil
+}
+
+// encrypt returns the encrypted value, prefixed with cacheCipherPrefix. Empty values stay empty, so that checks
+// like "has an attachment" keep working.
+func (c *cacheCipher) encrypt(s string) (string, error) {
+	if c == nil || s == "" {
+		return s, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(s), nil)
+	return cacheCipherPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt reverses encrypt. Plain text values are returned unchanged.
+func (c *cacheCipher) decrypt(s string) (string, error) {
+	if !strings.HasPrefix(s, cacheCipherPrefix) {
+		return s, nil
+	} else if c == nil {
+		return "", errCacheCipherKeyMissing
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, cacheCipherPrefix))
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", errCacheCipherInvalid
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errCacheCipherInvalid
+	}
+	return string(plaintext), nil
+}
+
+// encryptAll encrypts all given values in place, and stops at the first error
+func (c *cacheCipher) encryptAll(values ...*string) error {
+	for _, v := range values {
+		encrypted, err := c.encrypt(*v)
+		if err != nil {
+			return err
+		}
+		*v = encrypted
+	}
+	return nil
+}
+
+// decryptAll decrypts all given values in place, and stops at the first error
+func (c *cacheCipher) decryptAll(values ...*string) error {
+	for _, v := range values {
+		decrypted, err := c.decrypt(*v)
+		if err != nil {
+			return err
+		}
+		*v = decrypted
+	}
+	return nil
+}
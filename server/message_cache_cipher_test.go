@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheCipher_EncryptDecrypt(t *testing.T) {
+	c := newTestCacheCipher(t)
+	encrypted, err := c.encrypt("disk full")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(encrypted, cacheCipherPrefix))
+	require.NotContains(t, encrypted, "disk full")
+
+	again, err := c.encrypt("disk full")
+	require.Nil(t, err)
+	require.NotEqual(t, encrypted, again) // Random nonce
+
+	decrypted, err := c.decrypt(encrypted)
+	require.Nil(t, err)
+	require.Equal(t, "disk full", decrypted)
+
+	empty, err := c.encrypt("")
+	require.Nil(t, err)
+	require.Equal(t, "", empty)
+
+	plain, err := c.decrypt("written before encryption was enabled")
+	require.Nil(t, err)
+	require.Equal(t, "written before encryption was enabled", plain)
+}
+
+func TestCacheCipher_WrongOrMissingKey(t *testing.T) {
+	encrypted, err := newTestCacheCipher(t).encrypt("disk full")
+	require.Nil(t, err)
+
+	_, err = newTestCacheCipher(t).decrypt(encrypted)
+	require.Equal(t, errCacheCipherInvalid, err)
+
+	var nop *cacheCipher
+	_, err = nop.decrypt(encrypted)
+	require.Equal(t, errCacheCipherKeyMissing, err)
+	s, err := nop.encrypt("disk full")
+	require.Nil(t, err)
+	require.Equal(t, "disk full", s)
+}
+
+func TestLoadCacheCipher_Invalid(t *testing.T) {
+	_, err := loadCacheCipher(filepath.Join(t.TempDir(), "missing.key"))
+	require.Error(t, err)
+
+	_, err = loadCacheCipher(writeTestCacheKeyFile(t, "not base64!"))
+	require.Error(t, err)
+
+	_, err = loadCacheCipher(writeTestCacheKeyFile(t, base64.StdEncoding.EncodeToString([]byte("too short"))))
+	require.Error(t, err)
+}
+
+func TestSqliteCache_Encrypted_Messages(t *testing.T) {
+	testCacheMessages(t, newEncryptedSqliteTestCache(t))
+}
+
+func TestSqliteCache_Encrypted_Attachments(t *testing.T) {
+	testCacheAttachments(t, newEncryptedSqliteTestCache(t))
+}
+
+func TestSqliteCache_Encrypted_Emails(t *testing.T) {
+	testCacheEmails(t, newEncryptedSqliteTestCache(t))
+}
+
+func TestSqliteCache_Encrypted_EmailDigests(t *testing.T) {
+	testCacheEmailDigests(t, newEncryptedSqliteTestCache(t))
+}
+
+func TestSqliteCache_Encrypted_TopicWebhooks(t *testing.T) {
+	c := newEncryptedSqliteTestCache(t)
+	testCacheTopicWebhooks(t, c)
+	require.Nil(t, c.UpdateTopicWebhooks(&topicWebhooks{Topic: "alerts", Secret: "topic secret", Webhooks: []*topicWebhook{{URL: "https://example.com/hook", Secret: "secret"}}}))
+	var webhooks, secret string
+	require.Nil(t, c.db.QueryRow("SELECT webhooks, secret FROM topic_webhooks WHERE topic = ?", "alerts").Scan(&webhooks, &secret))
+	for _, value := range []string{webhooks, secret} {
+		require.True(t, strings.HasPrefix(value, cacheCipherPrefix))
+		require.NotContains(t, value, "secret")
+	}
+}
+
+func TestSqliteCache_Encrypted_NoPlainText(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "written in plain text")))
+	c.cipher = newTestCacheCipher(t)
+	m := newDefaultMessage("mytopic", "top secret message")
+	m.Title = "top secret title"
+	m.Attachment = &attachment{Name: "secret.pdf", Type: "application/pdf", Size: 10, URL: "https://ntfy.sh/file/secret.pdf", Owner: "1.2.3.4"}
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.QueueEmail(&queuedEmail{SenderIP: "1.2.3.4", To: "phil@example.com", Message: m}))
+
+	var msg, title, attachmentName, email string
+	require.Nil(t, c.db.QueryRow("SELECT message, title, attachment_name FROM messages WHERE mid = ?", m.ID).Scan(&msg, &title, &attachmentName))
+	require.Nil(t, c.db.QueryRow("SELECT message FROM emails").Scan(&email))
+	for _, value := range []string{msg, title, attachmentName, email} {
+		require.True(t, strings.HasPrefix(value, cacheCipherPrefix))
+		require.NotContains(t, value, "secret")
+	}
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "written in plain text", messages[0].Message)
+	require.Equal(t, "top secret message", messages[1].Message)
+	require.Equal(t, "secret.pdf", messages[1].Attachment.Name)
+
+	m.Title = "updated secret title"
+	require.Nil(t, c.UpdateMessage(m))
+	require.Nil(t, c.db.QueryRow("SELECT title FROM messages WHERE mid = ?", m.ID).Scan(&title))
+	require.NotContains(t, title, "secret")
+	updated, err := c.Message("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "updated secret title", updated.Title)
+
+	_, err = c.SearchMessages("mytopic", []string{"secret"}, 10)
+	require.Equal(t, errCacheCipherSearch, err)
+
+	c.cipher = nil
+	_, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Equal(t, errCacheCipherKeyMissing, err)
+}
+
+func newEncryptedSqliteTestCache(t *testing.T) *sqlCache {
+	c := newSqliteTestCache(t)
+	c.cipher = newTestCacheCipher(t)
+	return c
+}
+
+func newTestCacheCipher(t *testing.T) *cacheCipher {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.Nil(t, err)
+	c, err := loadCacheCipher(writeTestCacheKeyFile(t, base64.StdEncoding.EncodeToString(key)+"\n"))
+	require.Nil(t, err)
+	return c
+}
+
+func writeTestCacheKeyFile(t *testing.T, contents string) string {
+	filename := filepath.Join(t.TempDir(), "cache.key")
+	require.Nil(t, os.WriteFile(filename, []byte(contents), 0600))
+	return filename
+}
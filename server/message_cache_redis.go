@@ -0,0 +1,1477 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redis keys; sorted sets are scored by time, and their members are zero-padded sequence numbers, so that
+// entries with the same time are sorted by insertion order (like the row IDs in the SQL cache)
+const (
+	redisKeyPrefix           = "ntfy:"
+	redisMessageSeqKey       = redisKeyPrefix + "message-seq"
+	redisMessageKey          = redisKeyPrefix + "message:"         // + seq -> JSON-encoded redisMessage
+	redisTopicKey            = redisKeyPrefix + "topic:"           // + topic -> sorted set of seqs, scored by message time
+	redisTopicIDsKey         = redisKeyPrefix + "topic-ids:"       // + topic -> hash of message ID to seq
+	redisTopicDedupKey       = redisKeyPrefix + "topic-dedup:"     // + topic -> hash of dedup key to seq
+	redisTopicsKey           = redisKeyPrefix + "topics"           // Set of topics with messages
+	redisScheduledKey        = redisKeyPrefix + "scheduled"        // Sorted set of seqs of unpublished messages, scored by message time
+	redisExpiresKey          = redisKeyPrefix + "expires"          // Sorted set of seqs of messages with an expiry, scored by expiry
+	redisAttachmentsKey      = redisKeyPrefix + "attachments"      // Sorted set of seqs, scored by attachment expiry
+	redisOwnerAttachmentsKey = redisKeyPrefix + "attachments:"     // + owner -> sorted set of seqs, scored by attachment expiry
+	redisAttachmentHashKey   = redisKeyPrefix + "attachment-hash:" // + hash -> sorted set of seqs referencing the file, scored by attachment expiry
+	redisEmailSeqKey         = redisKeyPrefix + "email-seq"
+	redisEmailKey            = redisKeyPrefix + "email:" // + id -> JSON-encoded redisEmail
+	redisEmailsKey           = redisKeyPrefix + "emails" // Sorted set of e-mail IDs, scored by next attempt
+	redisDigestSeqKey        = redisKeyPrefix + "digest-seq"
+	redisDigestKey           = redisKeyPrefix + "digest:" // + topic:recipient -> list of JSON-encoded redisDigestEntry
+	redisDigestsKey          = redisKeyPrefix + "digests" // Sorted set of topic:recipient, scored by due time
+	redisRecurringSeqKey     = redisKeyPrefix + "recurring-seq"
+	redisRecurringKey        = redisKeyPrefix + "recurring:"        // + topic -> hash of ID to JSON-encoded redisRecurringMessage
+	redisRecurringDueKey     = redisKeyPrefix + "recurring-due"     // Sorted set of topic:ID, scored by next run
+	redisTopicInfoKey        = redisKeyPrefix + "topic-info:"       // + topic -> JSON-encoded topicInfo
+	redisTopicDefaultsKey    = redisKeyPrefix + "topic-defaults:"   // + topic -> JSON-encoded topicDefaults
+	redisAcksKey             = redisKeyPrefix + "acks:"             // + topic:ID -> hash of subscriber to JSON-encoded redisAck
+	redisTopicEscalationKey  = redisKeyPrefix + "topic-escalation:" // + topic -> JSON-encoded escalation steps
+	redisEscalationsKey      = redisKeyPrefix + "escalations"       // Hash of topic:ID to JSON-encoded escalation
+	redisEscalationsDueKey   = redisKeyPrefix + "escalations-due"   // Sorted set of topic:ID, scored by due time of the next step
+	redisQuietHoursKey       = redisKeyPrefix + "quiet-hours:"      // + user -> JSON-encoded quietHours
+	redisTopicWebhooksKey    = redisKeyPrefix + "topic-webhooks:"   // + topic -> JSON-encoded webhooks
+	redisTopicSecretKey      = redisKeyPrefix + "topic-secret:"     // + topic -> signing key of the webhooks
+	redisWebhookSeqKey       = redisKeyPrefix + "webhook-seq"
+	redisWebhookKey          = redisKeyPrefix + "webhook:"         // + id -> JSON-encoded queuedWebhook
+	redisWebhooksKey         = redisKeyPrefix + "webhooks"         // Sorted set of queued webhook IDs, scored by next attempt
+	redisHeartbeatsKey       = redisKeyPrefix + "heartbeats"       // Hash of topic to JSON-encoded heartbeat
+	redisHeartbeatsDueKey    = redisKeyPrefix + "heartbeats-due"   // Sorted set of topics that were not alerted yet, scored by due time
+	redisModeratedTopicsKey  = redisKeyPrefix + "moderated-topics" // Set of moderated topics
+	redisHeldMessagesKey     = redisKeyPrefix + "held:"            // + topic -> hash of ID to JSON-encoded heldMessage
+	redisAPNSDevicesKey      = redisKeyPrefix + "apns:"            // + topic -> hash of device token to user
+	redisTelegramChatsKey    = redisKeyPrefix + "telegram:"        // + topic -> set of chat IDs
+	redisPhoneNumbersKey     = redisKeyPrefix + "phone-numbers:"   // + user -> set of verified phone numbers
+)
+
+// Removes the sent messages of a digest, and the digest itself if no other messages were added in the meantime
+var redisDeleteDigestScript = redis.NewScript(`
+	redis.call('LTRIM', KEYS[1], ARGV[1], -1)
+	if redis.call('LLEN', KEYS[1]) == 0 then
+		redis.call('ZREM', KEYS[2], ARGV[2])
+	end
+	return 0
+`)
+
+// Removes a dedup key, unless it has been taken over by a newer message in the meantime
+var redisDeleteDedupKeyScript = redis.NewScript(`
+	if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+		redis.call('HDEL', KEYS[1], ARGV[1])
+	end
+	return 0
+`)
+
+type redisMessage struct {
+	Message    *message `json:"message"`
+	Owner      string   `json:"owner,omitempty"` // Attachment owner, not part of the message JSON
+	Hash       string   `json:"hash,omitempty"`  // Attachment content hash, not part of the message JSON
+	Published  bool     `json:"published"`
+	SenderIP   string   `json:"sender_ip,omitempty"`
+	SenderUser string   `json:"sender_user,omitempty"`
+	DedupKey   string   `json:"dedup_key,omitempty"`
+	Thread     string   `json:"thread,omitempty"`
+}
+
+type redisAck struct {
+	User string `json:"user,omitempty"`
+	Time int64  `json:"time"`
+}
+
+type redisEmail struct {
+	Email *queuedEmail `json:"email"`
+	Owner string       `json:"owner,omitempty"`
+	Hash  string       `json:"hash,omitempty"`
+}
+
+type redisDigestEntry struct {
+	ID       int64    `json:"id"`
+	SenderIP string   `json:"sender_ip"`
+	Message  *message `json:"message"`
+}
+
+type redisRecurringMessage struct {
+	Seq        int64             `json:"seq"` // Keeps the order in which they were added, see RecurringMessages
+	Message    *recurringMessage `json:"message"`
+	SenderIP   string            `json:"sender_ip,omitempty"`
+	SenderUser string            `json:"sender_user,omitempty"`
+}
+
+// redisCache is a message cache backed by Redis. It is meant for deployments in which latency matters more than
+// durability; how much data survives a restart of Redis depends on its persistence settings.
+type redisCache struct {
+	client *redis.Client
+}
+
+// newRedisCache creates a cache backed by Redis, using a connection URL like redis://:password@host:6379/0
+func newRedisCache(dsn string) (*redisCache, error) {
+	options, err := redis.ParseURL(dsn)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+	return &redisCache{
+		client: client,
+	}, nil
+}
+
+func (c *redisCache) Close() error {
+	return c.client.Close()
+}
+
+func (c *redisCache) AddMessage(m *message) error {
+	if m.Event != messageEvent {
+		return errUnexpectedMessageType
+	}
+	ctx := context.Background()
+	id, err := c.client.Incr(ctx, redisMessageSeqKey).Result()
+	if err != nil {
+		return err
+	}
+	rm := &redisMessage{Message: m, Published: m.Time <= time.Now().Unix(), SenderIP: m.senderIP, SenderUser: m.senderUser, DedupKey: m.dedupKey, Thread: m.thread}
+	if m.Attachment != nil {
+		rm.Owner = m.Attachment.Owner
+		rm.Hash = m.Attachment.Hash
+	}
+	b, err := json.Marshal(rm)
+	if err != nil {
+		return err
+	}
+	seq := redisSeq(id)
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisMessageKey+seq, b, 0)
+		pipe.ZAdd(ctx, redisTopicKey+m.Topic, &redis.Z{Score: float64(m.Time), Member: seq})
+		pipe.HSet(ctx, redisTopicIDsKey+m.Topic, m.ID, seq)
+		pipe.SAdd(ctx, redisTopicsKey, m.Topic)
+		if m.dedupKey != "" {
+			pipe.HSet(ctx, redisTopicDedupKey+m.Topic, m.dedupKey, seq)
+		}
+		if !rm.Published {
+			pipe.ZAdd(ctx, redisScheduledKey, &redis.Z{Score: float64(m.Time), Member: seq})
+		}
+		if m.Expires > 0 {
+			pipe.ZAdd(ctx, redisExpiresKey, &redis.Z{Score: float64(m.Expires), Member: seq})
+		}
+		if m.Attachment != nil && m.Attachment.Expires > 0 {
+			pipe.ZAdd(ctx, redisAttachmentsKey, &redis.Z{Score: float64(m.Attachment.Expires), Member: seq})
+			pipe.ZAdd(ctx, redisOwnerAttachmentsKey+m.Attachment.Owner, &redis.Z{Score: float64(m.Attachment.Expires), Member: seq})
+			if m.Attachment.Hash != "" {
+				pipe.ZAdd(ctx, redisAttachmentHashKey+m.Attachment.Hash, &redis.Z{Score: float64(m.Attachment.Expires), Member: seq})
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *redisCache) Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
+	if since.IsNone() {
+		return make([]*message, 0), nil
+	}
+	ctx := context.Background()
+	min := "-inf"
+	after := "" // Only messages with a greater seq, if since is an ID
+	if since.IsID() {
+		seq, err := c.client.HGet(ctx, redisTopicIDsKey+topic, since.ID()).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		after = seq // If the ID does not exist, all messages are returned
+	} else {
+		min = strconv.FormatInt(since.Time().Unix(), 10)
+	}
+	seqs, err := c.client.ZRangeByScore(ctx, redisTopicKey+topic, &redis.ZRangeBy{Min: min, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	rms, err := c.readMessages(seqs)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*message, 0)
+	for i, rm := range rms {
+		if rm == nil {
+			continue
+		} else if (rm.Published && seqs[i] > after) || (scheduled && !rm.Published) {
+			messages = append(messages, readRedisMessage(rm))
+		}
+	}
+	return messages, nil
+}
+
+func (c *redisCache) MessagesAfter(topic string, cursor sinceMarker, limit int) ([]*message, error) {
+	ctx := context.Background()
+	min := strconv.FormatInt(cursor.Time().Unix(), 10)
+	seqs, err := c.client.ZRangeByScore(ctx, redisTopicKey+topic, &redis.ZRangeBy{Min: min, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	rms, err := c.readMessages(seqs)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*message, 0)
+	for i, rm := range rms {
+		if rm == nil || !rm.Published {
+			continue
+		}
+		seq, err := strconv.ParseInt(seqs[i], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		m := readRedisMessage(rm)
+		m.cursor = newSinceCursor(m.Time, seq)
+		if !cursor.Before(m.cursor) {
+			continue // Same second, but not after the cursor
+		}
+		messages = append(messages, m)
+		if limit > 0 && len(messages) >= limit {
+			break
+		}
+	}
+	return messages, nil
+}
+
+func (c *redisCache) Message(topic, id string) (*message, error) {
+	seq, err := c.client.HGet(context.Background(), redisTopicIDsKey+topic, id).Result()
+	if err == redis.Nil {
+		return nil, errMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	rms, err := c.readMessages([]string{seq})
+	if err != nil {
+		return nil, err
+	} else if rms[0] == nil {
+		return nil, errMessageNotFound
+	}
+	m := readRedisMessage(rms[0])
+	m.senderIP, m.senderUser = rms[0].SenderIP, rms[0].SenderUser
+	return m, nil
+}
+
+func (c *redisCache) MessageByDedupKey(topic, key string, since time.Time) (*message, error) {
+	seq, err := c.client.HGet(context.Background(), redisTopicDedupKey+topic, key).Result()
+	if err == redis.Nil {
+		return nil, errMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	rms, err := c.readMessages([]string{seq})
+	if err != nil {
+		return nil, err
+	} else if rms[0] == nil || rms[0].Message.Time < since.Unix() {
+		return nil, errMessageNotFound
+	}
+	return readRedisMessage(rms[0]), nil
+}
+
+// MessagesByCollapseKey returns the published messages of the topic with the given collapse key, including who
+// published them. Unlike dedup keys, collapse keys are not indexed, since messages are only looked up by the key
+// when a new message with the same key is published.
+func (c *redisCache) MessagesByCollapseKey(topic, key string) ([]*message, error) {
+	seqs, err := c.client.ZRange(context.Background(), redisTopicKey+topic, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	rms, err := c.readMessages(seqs)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*message, 0)
+	for _, rm := range rms {
+		if rm != nil && rm.Published && rm.Message.CollapseKey == key {
+			m := readRedisMessage(rm)
+			m.senderIP, m.senderUser = rm.SenderIP, rm.SenderUser
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+func (c *redisCache) UpdateMessage(m *message) error {
+	ctx := context.Background()
+	seq, err := c.client.HGet(ctx, redisTopicIDsKey+m.Topic, m.ID).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rms, err := c.readMessages([]string{seq})
+	if err != nil {
+		return err
+	} else if rms[0] == nil {
+		return nil
+	}
+	rm := rms[0]
+	rm.Message.Title, rm.Message.Message, rm.Message.Priority, rm.Message.Encoding = m.Title, m.Message, m.Priority, m.Encoding
+	rm.Message.Markdown, rm.Message.HTML = m.Markdown, m.HTML
+	b, err := json.Marshal(rm)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(ctx, redisMessageKey+seq, b, 0).Err()
+}
+
+func (c *redisCache) DeleteMessage(topic, id string) error {
+	ctx := context.Background()
+	seq, err := c.client.HGet(ctx, redisTopicIDsKey+topic, id).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rms, err := c.readMessages([]string{seq})
+	if err != nil {
+		return err
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		redisDeleteMessage(ctx, pipe, topic, id, seq, rms[0])
+		return nil
+	})
+	return err
+}
+
+func (c *redisCache) DeleteMessages(topic string) error {
+	ctx := context.Background()
+	seqs, err := c.client.ZRange(ctx, redisTopicKey+topic, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	rms, err := c.readMessages(seqs)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, rm := range rms {
+			redisDeleteMessage(ctx, pipe, topic, "", seqs[i], rm)
+		}
+		pipe.Del(ctx, redisTopicKey+topic, redisTopicIDsKey+topic, redisTopicDedupKey+topic)
+		pipe.SRem(ctx, redisTopicsKey, topic)
+		return nil
+	})
+	return err
+}
+
+func (c *redisCache) MessagesDue() ([]*message, error) {
+	ctx := context.Background()
+	seqs, err := c.client.ZRangeByScore(ctx, redisScheduledKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	rms, err := c.readMessages(seqs)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*message, 0)
+	for _, rm := range rms {
+		if rm != nil {
+			messages = append(messages, readRedisMessage(rm))
+		}
+	}
+	return messages, nil
+}
+
+func (c *redisCache) MarkPublished(m *message) error {
+	ctx := context.Background()
+	seq, err := c.client.HGet(ctx, redisTopicIDsKey+m.Topic, m.ID).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rms, err := c.readMessages([]string{seq})
+	if err != nil {
+		return err
+	} else if rms[0] == nil {
+		return nil
+	}
+	rms[0].Published = true
+	b, err := json.Marshal(rms[0])
+	if err != nil {
+		return err
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisMessageKey+seq, b, 0)
+		pipe.ZRem(ctx, redisScheduledKey, seq)
+		return nil
+	})
+	return err
+}
+
+func (c *redisCache) MessageCount(topic string) (int, error) {
+	count, err := c.client.ZCard(context.Background(), redisTopicKey+topic).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (c *redisCache) Topics() (map[string]*topic, error) {
+	ids, err := c.client.SMembers(context.Background(), redisTopicsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	topics := make(map[string]*topic)
+	for _, id := range ids {
+		topics[id] = newTopic(id)
+	}
+	return topics, nil
+}
+
+// Prune removes all published messages older than olderThan, except for the topics in topicOlderThan, which
+// are pruned using their own retention
+func (c *redisCache) Prune(olderThan time.Time, topicOlderThan map[string]time.Time) error {
+	ctx := context.Background()
+	if err := c.pruneExpired(ctx); err != nil {
+		return err
+	}
+	topics, err := c.client.SMembers(ctx, redisTopicsKey).Result()
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		until := olderThan
+		if t, ok := topicOlderThan[topic]; ok {
+			until = t
+		}
+		seqs, err := c.client.ZRangeByScore(ctx, redisTopicKey+topic, &redis.ZRangeBy{Min: "-inf", Max: fmt.Sprintf("(%d", until.Unix())}).Result()
+		if err != nil {
+			return err
+		}
+		rms, err := c.readMessages(seqs)
+		if err != nil {
+			return err
+		}
+		_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, rm := range rms {
+				if rm == nil || !rm.Published {
+					continue
+				}
+				redisDeleteMessage(ctx, pipe, topic, rm.Message.ID, seqs[i], rm)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		count, err := c.client.ZCard(ctx, redisTopicKey+topic).Result()
+		if err != nil {
+			return err
+		} else if count == 0 {
+			if err := c.client.SRem(ctx, redisTopicsKey, topic).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneExpired removes the messages whose own expiry (see message.Expires) has passed
+func (c *redisCache) pruneExpired(ctx context.Context) error {
+	seqs, err := c.client.ZRangeByScore(ctx, redisExpiresKey, &redis.ZRangeBy{Min: "-inf", Max: fmt.Sprintf("%d", time.Now().Unix())}).Result()
+	if err != nil {
+		return err
+	}
+	rms, err := c.readMessages(seqs)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, rm := range rms {
+			if rm == nil {
+				pipe.ZRem(ctx, redisExpiresKey, seqs[i])
+				continue
+			}
+			redisDeleteMessage(ctx, pipe, rm.Message.Topic, rm.Message.ID, seqs[i], rm)
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *redisCache) AttachmentBytesUsed(owner string) (int64, error) {
+	ctx := context.Background()
+	seqs, err := c.client.ZRangeByScore(ctx, redisOwnerAttachmentsKey+owner, &redis.ZRangeBy{Min: strconv.FormatInt(time.Now().Unix(), 10), Max: "+inf"}).Result()
+	if err != nil {
+		return 0, err
+	}
+	rms, err := c.readMessages(seqs)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	counted := make(map[string]bool)
+	for _, rm := range rms {
+		if rm == nil || rm.Message.Attachment == nil {
+			continue
+		} else if rm.Hash != "" && counted[rm.Hash] {
+			continue // Same file as another message, only counted once
+		}
+		counted[rm.Hash] = true
+		size += rm.Message.Attachment.Size
+	}
+	return size, nil
+}
+
+func (c *redisCache) AttachmentsExpired() ([]string, error) {
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	seqs, err := c.client.ZRangeByScore(ctx, redisAttachmentsKey, &redis.ZRangeBy{Min: "(0", Max: now}).Result()
+	if err != nil {
+		return nil, err
+	}
+	rms, err := c.readMessages(seqs)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, rm := range rms {
+		if rm == nil {
+			continue
+		} else if rm.Hash == "" {
+			ids = append(ids, rm.Message.ID)
+			continue
+		} else if seen[rm.Hash] {
+			continue
+		}
+		seen[rm.Hash] = true
+		references, err := c.client.ZCount(ctx, redisAttachmentHashKey+rm.Hash, "("+now, "+inf").Result()
+		if err != nil {
+			return nil, err
+		} else if references == 0 { // The file is only deleted once all messages referencing it have expired
+			ids = append(ids, rm.Hash)
+		}
+	}
+	return ids, nil
+}
+
+// AttachmentReferences returns the number of messages that reference the uploaded file with the given hash,
+// including messages whose attachment has expired
+func (c *redisCache) AttachmentReferences(hash string) (int, error) {
+	count, err := c.client.ZCard(context.Background(), redisAttachmentHashKey+hash).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// QueueEmail adds an e-mail to the retry queue, or updates it if it is already queued
+func (c *redisCache) QueueEmail(e *queuedEmail) error {
+	ctx := context.Background()
+	if e.ID == 0 {
+		id, err := c.client.Incr(ctx, redisEmailSeqKey).Result()
+		if err != nil {
+			return err
+		}
+		e.ID = id
+	}
+	re := &redisEmail{Email: e}
+	if e.Message.Attachment != nil {
+		re.Owner = e.Message.Attachment.Owner
+		re.Hash = e.Message.Attachment.Hash
+	}
+	b, err := json.Marshal(re)
+	if err != nil {
+		return err
+	}
+	seq := redisSeq(e.ID)
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisEmailKey+seq, b, 0)
+		pipe.ZAdd(ctx, redisEmailsKey, &redis.Z{Score: float64(e.NextAttempt), Member: seq})
+		return nil
+	})
+	return err
+}
+
+// EmailsDue returns all queued e-mails that are due for another attempt
+func (c *redisCache) EmailsDue() ([]*queuedEmail, error) {
+	ctx := context.Background()
+	seqs, err := c.client.ZRangeByScore(ctx, redisEmailsKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	emails := make([]*queuedEmail, 0)
+	if len(seqs) == 0 {
+		return emails, nil
+	}
+	keys := make([]string, len(seqs))
+	for i, seq := range seqs {
+		keys[i] = redisEmailKey + seq
+	}
+	values, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue // Deleted in the meantime
+		}
+		var re redisEmail
+		if err := json.Unmarshal([]byte(s), &re); err != nil {
+			return nil, err
+		}
+		if re.Email.Message.Attachment != nil {
+			re.Email.Message.Attachment.Owner = re.Owner
+			re.Email.Message.Attachment.Hash = re.Hash
+		}
+		emails = append(emails, re.Email)
+	}
+	return emails, nil
+}
+
+// EmailsQueued returns the number of e-mails in the retry queue
+func (c *redisCache) EmailsQueued() (int, error) {
+	count, err := c.client.ZCard(context.Background(), redisEmailsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// DeleteEmail removes an e-mail from the retry queue, after it was sent or given up on
+func (c *redisCache) DeleteEmail(id int64) error {
+	ctx := context.Background()
+	seq := redisSeq(id)
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisEmailKey+seq)
+		pipe.ZRem(ctx, redisEmailsKey, seq)
+		return nil
+	})
+	return err
+}
+
+// AddEmailDigestMessage adds a message to the pending digest for the topic and recipient. If there is no pending
+// digest, a new one is started, which is due after the given window.
+func (c *redisCache) AddEmailDigestMessage(senderIP, to string, m *message, window time.Duration) error {
+	ctx := context.Background()
+	id, err := c.client.Incr(ctx, redisDigestSeqKey).Result()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&redisDigestEntry{ID: id, SenderIP: senderIP, Message: m})
+	if err != nil {
+		return err
+	}
+	digest := m.Topic + ":" + to
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, redisDigestKey+digest, b)
+		pipe.ZAddNX(ctx, redisDigestsKey, &redis.Z{Score: float64(time.Now().Add(window).Unix()), Member: digest}) // Keeps existing due time
+		return nil
+	})
+	return err
+}
+
+// EmailDigestPending returns true if there is a pending digest for the topic and recipient
+func (c *redisCache) EmailDigestPending(topic, to string) (bool, error) {
+	err := c.client.ZScore(context.Background(), redisDigestsKey, topic+":"+to).Err()
+	if err == redis.Nil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// EmailDigestsDue returns all digests whose window has passed, including all of their messages
+func (c *redisCache) EmailDigestsDue() ([]*emailDigest, error) {
+	ctx := context.Background()
+	keys, err := c.client.ZRangeByScore(ctx, redisDigestsKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys) // Same order as the SQL cache: by topic and recipient
+	digests := make([]*emailDigest, 0)
+	for _, key := range keys {
+		entries, err := c.client.LRange(ctx, redisDigestKey+key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		} else if len(entries) == 0 {
+			continue
+		}
+		topic, to := key[:strings.Index(key, ":")], key[strings.Index(key, ":")+1:] // Topics cannot contain ":"
+		digest := &emailDigest{Topic: topic, To: to}
+		for _, entry := range entries {
+			var e redisDigestEntry
+			if err := json.Unmarshal([]byte(entry), &e); err != nil {
+				return nil, err
+			}
+			if digest.SenderIP == "" {
+				digest.SenderIP = e.SenderIP
+			}
+			digest.Messages = append(digest.Messages, e.Message)
+			digest.LastID = e.ID
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// DeleteEmailDigest removes the messages of a digest after it was sent. Messages that were added in the meantime
+// are not removed.
+func (c *redisCache) DeleteEmailDigest(d *emailDigest) error {
+	ctx := context.Background()
+	digest := d.Topic + ":" + d.To
+	entries, err := c.client.LRange(ctx, redisDigestKey+digest, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for _, entry := range entries {
+		var e redisDigestEntry
+		if err := json.Unmarshal([]byte(entry), &e); err != nil {
+			return err
+		} else if e.ID > d.LastID {
+			break
+		}
+		sent++
+	}
+	return redisDeleteDigestScript.Run(ctx, c.client, []string{redisDigestKey + digest, redisDigestsKey}, sent, digest).Err()
+}
+
+// AddRecurringMessage stores a new recurring message; its ID and next run must be set already
+func (c *redisCache) AddRecurringMessage(r *recurringMessage) error {
+	ctx := context.Background()
+	seq, err := c.client.Incr(ctx, redisRecurringSeqKey).Result()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&redisRecurringMessage{Seq: seq, Message: r, SenderIP: r.senderIP, SenderUser: r.senderUser})
+	if err != nil {
+		return err
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisRecurringKey+r.Topic, r.ID, b)
+		pipe.ZAdd(ctx, redisRecurringDueKey, &redis.Z{Score: float64(r.Next), Member: r.Topic + ":" + r.ID})
+		return nil
+	})
+	return err
+}
+
+// RecurringMessages returns the recurring messages of a topic, in the order they were added
+func (c *redisCache) RecurringMessages(topic string) ([]*recurringMessage, error) {
+	values, err := c.client.HGetAll(context.Background(), redisRecurringKey+topic).Result()
+	if err != nil {
+		return nil, err
+	}
+	rrs := make([]*redisRecurringMessage, 0)
+	for _, value := range values {
+		rr, err := readRedisRecurringMessage(value)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	sort.Slice(rrs, func(i, j int) bool {
+		return rrs[i].Seq < rrs[j].Seq
+	})
+	recurring := make([]*recurringMessage, len(rrs))
+	for i, rr := range rrs {
+		recurring[i] = rr.Message
+	}
+	return recurring, nil
+}
+
+// RecurringMessagesDue returns all recurring messages whose next run has come
+func (c *redisCache) RecurringMessagesDue() ([]*recurringMessage, error) {
+	ctx := context.Background()
+	keys, err := c.client.ZRangeByScore(ctx, redisRecurringDueKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	recurring := make([]*recurringMessage, 0)
+	for _, key := range keys {
+		topic, id := key[:strings.Index(key, ":")], key[strings.Index(key, ":")+1:] // Topics cannot contain ":"
+		value, err := c.client.HGet(ctx, redisRecurringKey+topic, id).Result()
+		if err == redis.Nil {
+			continue // Deleted in the meantime
+		} else if err != nil {
+			return nil, err
+		}
+		rr, err := readRedisRecurringMessage(value)
+		if err != nil {
+			return nil, err
+		}
+		recurring = append(recurring, rr.Message)
+	}
+	return recurring, nil
+}
+
+// UpdateRecurringMessage stores the next run of a recurring message; the other fields cannot be changed
+func (c *redisCache) UpdateRecurringMessage(r *recurringMessage) error {
+	ctx := context.Background()
+	value, err := c.client.HGet(ctx, redisRecurringKey+r.Topic, r.ID).Result()
+	if err == redis.Nil {
+		return nil // Deleted in the meantime, must not be re-added
+	} else if err != nil {
+		return err
+	}
+	rr, err := readRedisRecurringMessage(value)
+	if err != nil {
+		return err
+	}
+	rr.Message.Next = r.Next
+	b, err := json.Marshal(rr)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisRecurringKey+r.Topic, r.ID, b)
+		pipe.ZAdd(ctx, redisRecurringDueKey, &redis.Z{Score: float64(r.Next), Member: r.Topic + ":" + r.ID})
+		return nil
+	})
+	return err
+}
+
+// DeleteRecurringMessage removes a recurring message; messages that were already published are not affected
+func (c *redisCache) DeleteRecurringMessage(topic, id string) error {
+	ctx := context.Background()
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, redisRecurringKey+topic, id)
+		pipe.ZRem(ctx, redisRecurringDueKey, topic+":"+id)
+		return nil
+	})
+	return err
+}
+
+// TopicInfo returns the metadata of a topic; if none was set, all fields but the topic are empty
+func (c *redisCache) TopicInfo(topic string) (*topicInfo, error) {
+	value, err := c.client.Get(context.Background(), redisTopicInfoKey+topic).Result()
+	if err == redis.Nil {
+		return &topicInfo{Topic: topic}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var info topicInfo
+	if err := json.Unmarshal([]byte(value), &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// UpdateTopicInfo sets the metadata of a topic, replacing the existing metadata
+func (c *redisCache) UpdateTopicInfo(info *topicInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(context.Background(), redisTopicInfoKey+info.Topic, b, 0).Err()
+}
+
+// DeleteTopicInfo removes the metadata of a topic
+func (c *redisCache) DeleteTopicInfo(topic string) error {
+	return c.client.Del(context.Background(), redisTopicInfoKey+topic).Err()
+}
+
+// TopicDefaults returns the default message fields of a topic; if none were set, all fields but the topic are empty
+func (c *redisCache) TopicDefaults(topic string) (*topicDefaults, error) {
+	value, err := c.client.Get(context.Background(), redisTopicDefaultsKey+topic).Result()
+	if err == redis.Nil {
+		return &topicDefaults{Topic: topic}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var defaults topicDefaults
+	if err := json.Unmarshal([]byte(value), &defaults); err != nil {
+		return nil, err
+	}
+	return &defaults, nil
+}
+
+// UpdateTopicDefaults sets the default message fields of a topic, replacing the existing defaults
+func (c *redisCache) UpdateTopicDefaults(defaults *topicDefaults) error {
+	b, err := json.Marshal(defaults)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(context.Background(), redisTopicDefaultsKey+defaults.Topic, b, 0).Err()
+}
+
+// DeleteTopicDefaults removes the default message fields of a topic
+func (c *redisCache) DeleteTopicDefaults(topic string) error {
+	return c.client.Del(context.Background(), redisTopicDefaultsKey+topic).Err()
+}
+
+// AddMessageAck records that a subscriber acknowledged a message. It returns false if the subscriber had
+// already acknowledged it, in which case the original acknowledgment is kept.
+func (c *redisCache) AddMessageAck(topic, id string, ack *messageAck) (bool, error) {
+	b, err := json.Marshal(&redisAck{User: ack.User, Time: ack.Time})
+	if err != nil {
+		return false, err
+	}
+	return c.client.HSetNX(context.Background(), redisAcksKey+topic+":"+id, ack.subscriber, b).Result()
+}
+
+// MessageAcks returns the acknowledgments of a message, oldest first
+func (c *redisCache) MessageAcks(topic, id string) ([]*messageAck, error) {
+	values, err := c.client.HVals(context.Background(), redisAcksKey+topic+":"+id).Result()
+	if err != nil {
+		return nil, err
+	}
+	acks := make([]*messageAck, 0)
+	for _, value := range values {
+		var ra redisAck
+		if err := json.Unmarshal([]byte(value), &ra); err != nil {
+			return nil, err
+		}
+		acks = append(acks, &messageAck{User: ra.User, Time: ra.Time})
+	}
+	sort.SliceStable(acks, func(i, j int) bool {
+		return acks[i].Time < acks[j].Time
+	})
+	return acks, nil
+}
+
+// TopicEscalation returns the escalation chain of a topic; if none was set, it has no steps
+func (c *redisCache) TopicEscalation(topic string) (*topicEscalation, error) {
+	e := &topicEscalation{Topic: topic, Steps: make([]*escalationStep, 0)}
+	value, err := c.client.Get(context.Background(), redisTopicEscalationKey+topic).Result()
+	if err == redis.Nil {
+		return e, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(value), &e.Steps); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// UpdateTopicEscalation sets the escalation chain of a topic, replacing the existing one
+func (c *redisCache) UpdateTopicEscalation(e *topicEscalation) error {
+	b, err := json.Marshal(e.Steps)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(context.Background(), redisTopicEscalationKey+e.Topic, b, 0).Err()
+}
+
+// DeleteTopicEscalation removes the escalation chain of a topic; escalations already in progress are stopped
+// when they are due, see Server.escalate
+func (c *redisCache) DeleteTopicEscalation(topic string) error {
+	return c.client.Del(context.Background(), redisTopicEscalationKey+topic).Err()
+}
+
+// UpdateEscalation adds the escalation of a message, or replaces it if the message is already being escalated
+func (c *redisCache) UpdateEscalation(e *escalation) error {
+	ctx := context.Background()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisEscalationsKey, e.Topic+":"+e.MessageID, b)
+		pipe.ZAdd(ctx, redisEscalationsDueKey, &redis.Z{Score: float64(e.Due), Member: e.Topic + ":" + e.MessageID})
+		return nil
+	})
+	return err
+}
+
+// EscalationsDue returns all escalations whose next step is due
+func (c *redisCache) EscalationsDue() ([]*escalation, error) {
+	ctx := context.Background()
+	keys, err := c.client.ZRangeByScore(ctx, redisEscalationsDueKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	escalations := make([]*escalation, 0)
+	for _, key := range keys {
+		value, err := c.client.HGet(ctx, redisEscalationsKey, key).Result()
+		if err == redis.Nil {
+			continue // Deleted in the meantime
+		} else if err != nil {
+			return nil, err
+		}
+		var e escalation
+		if err := json.Unmarshal([]byte(value), &e); err != nil {
+			return nil, err
+		}
+		escalations = append(escalations, &e)
+	}
+	return escalations, nil
+}
+
+// DeleteEscalation ends the escalation of a message
+func (c *redisCache) DeleteEscalation(topic, id string) error {
+	ctx := context.Background()
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, redisEscalationsKey, topic+":"+id)
+		pipe.ZRem(ctx, redisEscalationsDueKey, topic+":"+id)
+		return nil
+	})
+	return err
+}
+
+// QuietHours returns the quiet hours of a user, or nil if the user has not set any
+func (c *redisCache) QuietHours(user string) (*quietHours, error) {
+	value, err := c.client.Get(context.Background(), redisQuietHoursKey+user).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var q quietHours
+	if err := json.Unmarshal([]byte(value), &q); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// UpdateQuietHours sets the quiet hours of a user, replacing the existing ones
+func (c *redisCache) UpdateQuietHours(user string, q *quietHours) error {
+	b, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	return c.client.Set(context.Background(), redisQuietHoursKey+user, b, 0).Err()
+}
+
+// DeleteQuietHours removes the quiet hours of a user
+func (c *redisCache) DeleteQuietHours(user string) error {
+	return c.client.Del(context.Background(), redisQuietHoursKey+user).Err()
+}
+
+// TopicWebhooks returns the outgoing webhooks of a topic; if none were set, the list is empty
+func (c *redisCache) TopicWebhooks(topic string) (*topicWebhooks, error) {
+	ctx := context.Background()
+	w := &topicWebhooks{Topic: topic, Webhooks: make([]*topicWebhook, 0)}
+	values, err := c.client.MGet(ctx, redisTopicWebhooksKey+topic, redisTopicSecretKey+topic).Result()
+	if err != nil {
+		return nil, err
+	}
+	value, ok := values[0].(string)
+	if !ok {
+		return w, nil
+	}
+	if err := json.Unmarshal([]byte(value), &w.Webhooks); err != nil {
+		return nil, err
+	}
+	if secret, ok := values[1].(string); ok {
+		w.Secret = secret
+	}
+	return w, nil
+}
+
+// UpdateTopicWebhooks sets the outgoing webhooks of a topic, replacing the existing ones
+func (c *redisCache) UpdateTopicWebhooks(w *topicWebhooks) error {
+	b, err := json.Marshal(w.Webhooks)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisTopicWebhooksKey+w.Topic, b, 0)
+		if w.Secret != "" {
+			pipe.Set(ctx, redisTopicSecretKey+w.Topic, w.Secret, 0)
+		} else {
+			pipe.Del(ctx, redisTopicSecretKey+w.Topic)
+		}
+		return nil
+	})
+	return err
+}
+
+// DeleteTopicWebhooks removes the outgoing webhooks of a topic; deliveries that are already queued are still retried
+func (c *redisCache) DeleteTopicWebhooks(topic string) error {
+	return c.client.Del(context.Background(), redisTopicWebhooksKey+topic, redisTopicSecretKey+topic).Err()
+}
+
+// QueueWebhook adds a failed webhook delivery to the retry queue, or updates it if it is already queued
+func (c *redisCache) QueueWebhook(w *queuedWebhook) error {
+	ctx := context.Background()
+	if w.ID == 0 {
+		id, err := c.client.Incr(ctx, redisWebhookSeqKey).Result()
+		if err != nil {
+			return err
+		}
+		w.ID = id
+	}
+	b, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	seq := redisSeq(w.ID)
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisWebhookKey+seq, b, 0)
+		pipe.ZAdd(ctx, redisWebhooksKey, &redis.Z{Score: float64(w.NextAttempt), Member: seq})
+		return nil
+	})
+	return err
+}
+
+// WebhooksDue returns all queued webhook deliveries that are due for another attempt
+func (c *redisCache) WebhooksDue() ([]*queuedWebhook, error) {
+	ctx := context.Background()
+	seqs, err := c.client.ZRangeByScore(ctx, redisWebhooksKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	webhooks := make([]*queuedWebhook, 0)
+	if len(seqs) == 0 {
+		return webhooks, nil
+	}
+	keys := make([]string, len(seqs))
+	for i, seq := range seqs {
+		keys[i] = redisWebhookKey + seq
+	}
+	values, err := c.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue // Deleted in the meantime
+		}
+		var w queuedWebhook
+		if err := json.Unmarshal([]byte(s), &w); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &w)
+	}
+	return webhooks, nil
+}
+
+// DeleteQueuedWebhook removes a webhook delivery from the retry queue, after it succeeded or was given up on
+func (c *redisCache) DeleteQueuedWebhook(id int64) error {
+	ctx := context.Background()
+	seq := redisSeq(id)
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisWebhookKey+seq)
+		pipe.ZRem(ctx, redisWebhooksKey, seq)
+		return nil
+	})
+	return err
+}
+
+// Heartbeat returns the heartbeat of a topic, or nil if the topic has none
+func (c *redisCache) Heartbeat(topic string) (*heartbeat, error) {
+	value, err := c.client.HGet(context.Background(), redisHeartbeatsKey, topic).Result()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var h heartbeat
+	if err := json.Unmarshal([]byte(value), &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// UpdateHeartbeat sets the heartbeat of a topic, replacing the existing one
+func (c *redisCache) UpdateHeartbeat(h *heartbeat) error {
+	ctx := context.Background()
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisHeartbeatsKey, h.Topic, b)
+		if h.Alerted {
+			pipe.ZRem(ctx, redisHeartbeatsDueKey, h.Topic)
+		} else {
+			pipe.ZAdd(ctx, redisHeartbeatsDueKey, &redis.Z{Score: float64(h.Due), Member: h.Topic})
+		}
+		return nil
+	})
+	return err
+}
+
+// DeleteHeartbeat removes the heartbeat of a topic
+func (c *redisCache) DeleteHeartbeat(topic string) error {
+	ctx := context.Background()
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, redisHeartbeatsKey, topic)
+		pipe.ZRem(ctx, redisHeartbeatsDueKey, topic)
+		return nil
+	})
+	return err
+}
+
+// HeartbeatsDue returns all heartbeats that have not seen a message in time, and whose alert was not sent yet
+func (c *redisCache) HeartbeatsDue() ([]*heartbeat, error) {
+	ctx := context.Background()
+	topics, err := c.client.ZRangeByScore(ctx, redisHeartbeatsDueKey, &redis.ZRangeBy{Min: "-inf", Max: strconv.FormatInt(time.Now().Unix(), 10)}).Result()
+	if err != nil {
+		return nil, err
+	}
+	heartbeats := make([]*heartbeat, 0)
+	for _, topic := range topics {
+		h, err := c.Heartbeat(topic)
+		if err != nil {
+			return nil, err
+		} else if h == nil || h.Alerted {
+			continue // Deleted or alerted in the meantime
+		}
+		heartbeats = append(heartbeats, h)
+	}
+	return heartbeats, nil
+}
+
+// TopicModerated returns true if anonymous messages to the topic are held for moderation
+func (c *redisCache) TopicModerated(topic string) (bool, error) {
+	return c.client.SIsMember(context.Background(), redisModeratedTopicsKey, topic).Result()
+}
+
+// UpdateTopicModerated turns moderation of a topic on or off; messages that are already held stay in the queue
+func (c *redisCache) UpdateTopicModerated(topic string, moderated bool) error {
+	if moderated {
+		return c.client.SAdd(context.Background(), redisModeratedTopicsKey, topic).Err()
+	}
+	return c.client.SRem(context.Background(), redisModeratedTopicsKey, topic).Err()
+}
+
+// HoldMessage adds a message to the moderation queue of its topic
+func (c *redisCache) HoldMessage(m *message) error {
+	b, err := json.Marshal(newHeldMessage(m))
+	if err != nil {
+		return err
+	}
+	return c.client.HSet(context.Background(), redisHeldMessagesKey+m.Topic, m.ID, b).Err()
+}
+
+// HeldMessages returns the moderation queue of a topic, oldest first
+func (c *redisCache) HeldMessages(topic string) ([]*message, error) {
+	values, err := c.client.HVals(context.Background(), redisHeldMessagesKey+topic).Result()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*message, 0, len(values))
+	for _, value := range values {
+		var h heldMessage
+		if err := json.Unmarshal([]byte(value), &h); err != nil {
+			return nil, err
+		}
+		messages = append(messages, h.toMessage())
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Time == messages[j].Time {
+			return messages[i].ID < messages[j].ID
+		}
+		return messages[i].Time < messages[j].Time
+	})
+	return messages, nil
+}
+
+// HeldMessage returns a message from the moderation queue of a topic, or errMessageNotFound
+func (c *redisCache) HeldMessage(topic, id string) (*message, error) {
+	value, err := c.client.HGet(context.Background(), redisHeldMessagesKey+topic, id).Result()
+	if err == redis.Nil {
+		return nil, errMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var h heldMessage
+	if err := json.Unmarshal([]byte(value), &h); err != nil {
+		return nil, err
+	}
+	return h.toMessage(), nil
+}
+
+// DeleteHeldMessage removes a message from the moderation queue, after it was approved or rejected
+func (c *redisCache) DeleteHeldMessage(topic, id string) error {
+	return c.client.HDel(context.Background(), redisHeldMessagesKey+topic, id).Err()
+}
+
+// AddAPNSDevice registers a device for the messages of a topic, or updates the user it was registered by
+func (c *redisCache) AddAPNSDevice(d *apnsDevice) error {
+	return c.client.HSet(context.Background(), redisAPNSDevicesKey+d.Topic, d.Token, d.User).Err()
+}
+
+// APNSDevices returns the devices that registered for the messages of a topic
+func (c *redisCache) APNSDevices(topic string) ([]*apnsDevice, error) {
+	values, err := c.client.HGetAll(context.Background(), redisAPNSDevicesKey+topic).Result()
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]*apnsDevice, 0, len(values))
+	for token, user := range values {
+		devices = append(devices, &apnsDevice{Topic: topic, Token: token, User: user})
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Token < devices[j].Token
+	})
+	return devices, nil
+}
+
+// DeleteAPNSDevice unregisters a device from a topic
+func (c *redisCache) DeleteAPNSDevice(topic, token string) error {
+	return c.client.HDel(context.Background(), redisAPNSDevicesKey+topic, token).Err()
+}
+
+// AddTelegramChat forwards the messages of a topic to a Telegram chat; adding a chat twice does nothing
+func (c *redisCache) AddTelegramChat(topic, chatID string) error {
+	return c.client.SAdd(context.Background(), redisTelegramChatsKey+topic, chatID).Err()
+}
+
+// TelegramChats returns the IDs of the Telegram chats that the messages of a topic are forwarded to
+func (c *redisCache) TelegramChats(topic string) ([]string, error) {
+	chats, err := c.client.SMembers(context.Background(), redisTelegramChatsKey+topic).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(chats)
+	return chats, nil
+}
+
+// DeleteTelegramChat stops forwarding the messages of a topic to a Telegram chat
+func (c *redisCache) DeleteTelegramChat(topic, chatID string) error {
+	return c.client.SRem(context.Background(), redisTelegramChatsKey+topic, chatID).Err()
+}
+
+// AddPhoneNumber adds a verified phone number to a user; adding a number twice does nothing
+func (c *redisCache) AddPhoneNumber(user, phoneNumber string) error {
+	return c.client.SAdd(context.Background(), redisPhoneNumbersKey+user, phoneNumber).Err()
+}
+
+// PhoneNumbers returns the verified phone numbers of a user
+func (c *redisCache) PhoneNumbers(user string) ([]string, error) {
+	phoneNumbers, err := c.client.SMembers(context.Background(), redisPhoneNumbersKey+user).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(phoneNumbers)
+	return phoneNumbers, nil
+}
+
+// DeletePhoneNumber removes a phone number from a user
+func (c *redisCache) DeletePhoneNumber(user, phoneNumber string) error {
+	return c.client.SRem(context.Background(), redisPhoneNumbersKey+user, phoneNumber).Err()
+}
+
+func readRedisRecurringMessage(value string) (*redisRecurringMessage, error) {
+	var rr redisRecurringMessage
+	if err := json.Unmarshal([]byte(value), &rr); err != nil {
+		return nil, err
+	}
+	rr.Message.senderIP, rr.Message.senderUser = rr.SenderIP, rr.SenderUser
+	return &rr, nil
+}
+
+// SearchMessages scans the messages of the topic, newest first, since Redis has no full-text index. Like the
+// SQL cache, it prefix-matches each term against the words of the title, message and tags.
+func (c *redisCache) SearchMessages(topic string, terms []string, limit int) ([]*message, error) {
+	messages := make([]*message, 0)
+	if len(terms) == 0 {
+		return messages, nil
+	}
+	seqs, err := c.client.ZRevRange(context.Background(), redisTopicKey+topic, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	rms, err := c.readMessages(seqs)
+	if err != nil {
+		return nil, err
+	}
+	for _, rm := range rms {
+		if len(messages) == limit {
+			break
+		} else if rm != nil && rm.Published && messageMatchesSearch(rm.Message, terms) {
+			messages = append(messages, readRedisMessage(rm))
+		}
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// readMessages returns the messages for the given seqs. Messages that were pruned in the meantime are nil.
+func (c *redisCache) readMessages(seqs []string) ([]*redisMessage, error) {
+	rms := make([]*redisMessage, 0)
+	if len(seqs) == 0 {
+		return rms, nil
+	}
+	keys := make([]string, len(seqs))
+	for i, seq := range seqs {
+		keys[i] = redisMessageKey + seq
+	}
+	values, err := c.client.MGet(context.Background(), keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			rms = append(rms, nil)
+			continue
+		}
+		var rm redisMessage
+		if err := json.Unmarshal([]byte(s), &rm); err != nil {
+			return nil, err
+		}
+		rms = append(rms, &rm)
+	}
+	return rms, nil
+}
+
+func readRedisMessage(rm *redisMessage) *message {
+	if rm.Message.Attachment != nil {
+		rm.Message.Attachment.Owner = rm.Owner
+		rm.Message.Attachment.Hash = rm.Hash
+	}
+	rm.Message.thread = rm.Thread
+	return rm.Message
+}
+
+func messageMatchesSearch(m *message, terms []string) bool {
+	words := searchWords(m.Title + " " + m.Message + " " + strings.Join(m.Tags, " "))
+	for _, term := range terms {
+		found := false
+		for _, word := range words {
+			if strings.HasPrefix(word, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// redisDeleteMessage queues the removal of a message and all references to it. The message rm may be nil
+// if it was removed in the meantime.
+func redisDeleteMessage(ctx context.Context, pipe redis.Pipeliner, topic, id, seq string, rm *redisMessage) {
+	pipe.Del(ctx, redisMessageKey+seq)
+	pipe.ZRem(ctx, redisTopicKey+topic, seq)
+	pipe.HDel(ctx, redisTopicIDsKey+topic, id)
+	pipe.ZRem(ctx, redisScheduledKey, seq)
+	pipe.ZRem(ctx, redisExpiresKey, seq)
+	if rm != nil {
+		pipe.Del(ctx, redisAcksKey+topic+":"+rm.Message.ID)
+	}
+	if rm != nil && rm.DedupKey != "" {
+		redisDeleteDedupKeyScript.Eval(ctx, pipe, []string{redisTopicDedupKey + topic}, rm.DedupKey, seq)
+	}
+	if rm != nil && rm.Message.Attachment != nil {
+		pipe.ZRem(ctx, redisAttachmentsKey, seq)
+		pipe.ZRem(ctx, redisOwnerAttachmentsKey+rm.Owner, seq)
+		if rm.Hash != "" {
+			pipe.ZRem(ctx, redisAttachmentHashKey+rm.Hash, seq)
+		}
+	}
+}
+
+// redisSeq zero-pads sequence numbers, so that they sort correctly as strings
+func redisSeq(id int64) string {
+	return fmt.Sprintf("%019d", id)
+}
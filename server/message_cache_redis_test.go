@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRedisCache_Messages(t *testing.T) {
+	testCacheMessages(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_MessagesScheduled(t *testing.T) {
+	testCacheMessagesScheduled(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_Topics(t *testing.T) {
+	testCacheTopics(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_MessagesTagsPrioAndTitle(t *testing.T) {
+	testCacheMessagesTagsPrioAndTitle(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_MessagesSinceID(t *testing.T) {
+	testCacheMessagesSinceID(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_MessagesAfter(t *testing.T) {
+	testCacheMessagesAfter(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_MessageByDedupKey(t *testing.T) {
+	testCacheMessageByDedupKey(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_DeleteMessage(t *testing.T) {
+	testCacheDeleteMessage(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_DeleteMessages(t *testing.T) {
+	testCacheDeleteMessages(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_Prune(t *testing.T) {
+	testCachePrune(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_PruneTopics(t *testing.T) {
+	testCachePruneTopics(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_PruneExpired(t *testing.T) {
+	testCachePruneExpired(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_Attachments(t *testing.T) {
+	testCacheAttachments(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_AttachmentsDeduplicated(t *testing.T) {
+	testCacheAttachmentsDeduplicated(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_Emails(t *testing.T) {
+	testCacheEmails(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_EmailDigests(t *testing.T) {
+	testCacheEmailDigests(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_RecurringMessages(t *testing.T) {
+	testCacheRecurringMessages(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_Thread(t *testing.T) {
+	testCacheThread(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_TopicDefaults(t *testing.T) {
+	testCacheTopicDefaults(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_MessageAcks(t *testing.T) {
+	testCacheMessageAcks(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_Escalations(t *testing.T) {
+	testCacheEscalations(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_CollapseKey(t *testing.T) {
+	testCacheCollapseKey(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_Markdown(t *testing.T) {
+	testCacheMarkdown(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_TopicWebhooks(t *testing.T) {
+	testCacheTopicWebhooks(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_Heartbeats(t *testing.T) {
+	testCacheHeartbeats(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_HeldMessages(t *testing.T) {
+	testCacheHeldMessages(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_APNSDevices(t *testing.T) {
+	testCacheAPNSDevices(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_TelegramChats(t *testing.T) {
+	testCacheTelegramChats(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_PhoneNumbers(t *testing.T) {
+	testCachePhoneNumbers(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_QuietHours(t *testing.T) {
+	testCacheQuietHours(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_TopicInfo(t *testing.T) {
+	testCacheTopicInfo(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_Search(t *testing.T) {
+	testCacheSearch(t, newRedisTestCache(t))
+}
+
+func TestRedisCache_MarkPublished(t *testing.T) {
+	c := newRedisTestCache(t)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "now")))
+	m := newDefaultMessage("mytopic", "later")
+	m.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+
+	require.Nil(t, c.MarkPublished(m))
+	messages, err = c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "later", messages[1].Message)
+	count, err := c.client.ZCard(context.Background(), redisScheduledKey).Result()
+	require.Nil(t, err)
+	require.Equal(t, int64(0), count)
+}
+
+func TestRedisCache_PruneRemovesTopic(t *testing.T) {
+	c := newRedisTestCache(t)
+	m := newDefaultMessage("mytopic", "old message")
+	m.Time = 1
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.Prune(time.Unix(2, 0), nil))
+
+	topics, err := c.Topics()
+	require.Nil(t, err)
+	require.Empty(t, topics)
+	messages, err := c.Messages("mytopic", newSinceID(m.ID), false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func newRedisTestCache(t *testing.T) *redisCache {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	c, err := newRedisCache("redis://" + server.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
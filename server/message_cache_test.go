@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,7 +19,7 @@ func TestMemCache_Messages(t *testing.T) {
 	testCacheMessages(t, newMemTestCache(t))
 }
 
-func testCacheMessages(t *testing.T, c *messageCache) {
+func testCacheMessages(t *testing.T, c messageCache) {
 	m1 := newDefaultMessage("mytopic", "my message")
 	m1.Time = 1
 
@@ -92,7 +93,7 @@ func TestMemCache_MessagesScheduled(t *testing.T) {
 	testCacheMessagesScheduled(t, newMemTestCache(t))
 }
 
-func testCacheMessagesScheduled(t *testing.T, c *messageCache) {
+func testCacheMessagesScheduled(t *testing.T, c messageCache) {
 	m1 := newDefaultMessage("mytopic", "message 1")
 	m2 := newDefaultMessage("mytopic", "message 2")
 	m2.Time = time.Now().Add(time.Hour).Unix()
@@ -126,7 +127,7 @@ func TestMemCache_Topics(t *testing.T) {
 	testCacheTopics(t, newMemTestCache(t))
 }
 
-func testCacheTopics(t *testing.T, c *messageCache) {
+func testCacheTopics(t *testing.T, c messageCache) {
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic1", "my example message")))
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 1")))
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 2")))
@@ -149,17 +150,19 @@ func TestMemCache_MessagesTagsPrioAndTitle(t *testing.T) {
 	testCacheMessagesTagsPrioAndTitle(t, newMemTestCache(t))
 }
 
-func testCacheMessagesTagsPrioAndTitle(t *testing.T, c *messageCache) {
+func testCacheMessagesTagsPrioAndTitle(t *testing.T, c messageCache) {
 	m := newDefaultMessage("mytopic", "some message")
 	m.Tags = []string{"tag1", "tag2"}
 	m.Priority = 5
 	m.Title = "some title"
+	m.Group = "some group"
 	require.Nil(t, c.AddMessage(m))
 
 	messages, _ := c.Messages("mytopic", sinceAllMessages, false)
 	require.Equal(t, []string{"tag1", "tag2"}, messages[0].Tags)
 	require.Equal(t, 5, messages[0].Priority)
 	require.Equal(t, "some title", messages[0].Title)
+	require.Equal(t, "some group", messages[0].Group)
 }
 
 func TestSqliteCache_MessagesSinceID(t *testing.T) {
@@ -170,7 +173,7 @@ func TestMemCache_MessagesSinceID(t *testing.T) {
 	testCacheMessagesSinceID(t, newMemTestCache(t))
 }
 
-func testCacheMessagesSinceID(t *testing.T, c *messageCache) {
+func testCacheMessagesSinceID(t *testing.T, c messageCache) {
 	m1 := newDefaultMessage("mytopic", "message 1")
 	m1.Time = 100
 	m2 := newDefaultMessage("mytopic", "message 2")
@@ -232,6 +235,197 @@ func testCacheMessagesSinceID(t *testing.T, c *messageCache) {
 	require.Equal(t, "message 3", messages[1].Message)
 }
 
+func TestSqliteCache_MessagesAfter(t *testing.T) {
+	testCacheMessagesAfter(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesAfter(t *testing.T) {
+	testCacheMessagesAfter(t, newMemTestCache(t))
+}
+
+func testCacheMessagesAfter(t *testing.T, c messageCache) {
+	for i := 1; i <= 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = 100 // All in the same second
+		require.Nil(t, c.AddMessage(m))
+	}
+	m6 := newDefaultMessage("mytopic", "message 6")
+	m6.Time = 200
+	require.Nil(t, c.AddMessage(m6))
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other")))
+
+	// Page through messages, two at a time
+	messages, err := c.MessagesAfter("mytopic", newSinceCursor(0, 0), 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+	require.True(t, messages[0].cursor.Before(messages[1].cursor))
+
+	messages, err = c.MessagesAfter("mytopic", messages[1].cursor, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "message 4", messages[1].Message)
+
+	messages, err = c.MessagesAfter("mytopic", messages[1].cursor, 0) // No limit, not scheduled
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 5", messages[0].Message)
+	require.Equal(t, "message 6", messages[1].Message)
+
+	messages, err = c.MessagesAfter("mytopic", messages[1].cursor, 2)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Cursor at the start of a second includes all messages of that second
+	messages, err = c.MessagesAfter("mytopic", newSinceCursor(200, 0), 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 6", messages[0].Message)
+}
+
+func TestSqliteCache_MessageByDedupKey(t *testing.T) {
+	testCacheMessageByDedupKey(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessageByDedupKey(t *testing.T) {
+	testCacheMessageByDedupKey(t, newMemTestCache(t))
+}
+
+func testCacheMessageByDedupKey(t *testing.T, c messageCache) {
+	m1 := newDefaultMessage("mytopic", "old")
+	m1.Time = 1000
+	m1.dedupKey = "backup"
+	m2 := newDefaultMessage("mytopic", "new")
+	m2.Time = 2000
+	m2.dedupKey = "backup"
+	m3 := newDefaultMessage("othertopic", "other topic")
+	m3.Time = 2000
+	m3.dedupKey = "other"
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+
+	m, err := c.MessageByDedupKey("mytopic", "backup", time.Unix(1500, 0))
+	require.Nil(t, err)
+	require.Equal(t, m2.ID, m.ID)
+	require.Equal(t, "new", m.Message)
+
+	_, err = c.MessageByDedupKey("mytopic", "backup", time.Unix(2500, 0))
+	require.Equal(t, errMessageNotFound, err)
+	_, err = c.MessageByDedupKey("mytopic", "other", time.Unix(0, 0))
+	require.Equal(t, errMessageNotFound, err)
+
+	require.Nil(t, c.DeleteMessage("mytopic", m2.ID))
+	_, err = c.MessageByDedupKey("mytopic", "backup", time.Unix(1500, 0))
+	require.Equal(t, errMessageNotFound, err)
+}
+
+func TestSqliteCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newMemTestCache(t))
+}
+
+func testCacheUpdateMessage(t *testing.T, c messageCache) {
+	m := newDefaultMessage("mytopic", "Downloading: 10%")
+	m.Title = "Download"
+	m.Tags = []string{"download"}
+	require.Nil(t, c.AddMessage(m))
+
+	m.Message = "Downloading: 50%"
+	m.Title = "Download (halfway)"
+	m.Priority = 4
+	require.Nil(t, c.UpdateMessage(m))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m.ID, messages[0].ID)
+	require.Equal(t, "Downloading: 50%", messages[0].Message)
+	require.Equal(t, "Download (halfway)", messages[0].Title)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, []string{"download"}, messages[0].Tags)
+
+	// Search index is updated as well
+	messages, err = c.SearchMessages("mytopic", []string{"halfway"}, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	messages, err = c.SearchMessages("mytopic", []string{"10"}, 10)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_DeleteMessage(t *testing.T) {
+	testCacheDeleteMessage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DeleteMessage(t *testing.T) {
+	testCacheDeleteMessage(t, newMemTestCache(t))
+}
+
+func testCacheDeleteMessage(t *testing.T, c messageCache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m1.senderIP = "1.2.3.4"
+	m1.senderUser = "phil"
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m2.senderIP = "5.6.7.8"
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+
+	m, err := c.Message("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "message 1", m.Message)
+	require.Equal(t, "1.2.3.4", m.senderIP)
+	require.Equal(t, "phil", m.senderUser)
+
+	_, err = c.Message("othertopic", m1.ID)
+	require.Equal(t, errMessageNotFound, err)
+
+	require.Nil(t, c.DeleteMessage("mytopic", m1.ID))
+	_, err = c.Message("mytopic", m1.ID)
+	require.Equal(t, errMessageNotFound, err)
+	require.Nil(t, c.DeleteMessage("mytopic", m1.ID)) // Deleting twice is fine
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+}
+
+func TestSqliteCache_DeleteMessages(t *testing.T) {
+	testCacheDeleteMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_DeleteMessages(t *testing.T) {
+	testCacheDeleteMessages(t, newMemTestCache(t))
+}
+
+func testCacheDeleteMessages(t *testing.T, c messageCache) {
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my secret")))
+	require.Nil(t, c.AddMessage(scheduled))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other")))
+
+	require.Nil(t, c.DeleteMessages("mytopic"))
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	due, err := c.MessagesDue()
+	require.Nil(t, err)
+	require.Empty(t, due)
+	count, err = c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
 func TestSqliteCache_Prune(t *testing.T) {
 	testCachePrune(t, newSqliteTestCache(t))
 }
@@ -240,7 +434,7 @@ func TestMemCache_Prune(t *testing.T) {
 	testCachePrune(t, newMemTestCache(t))
 }
 
-func testCachePrune(t *testing.T, c *messageCache) {
+func testCachePrune(t *testing.T, c messageCache) {
 	m1 := newDefaultMessage("mytopic", "my message")
 	m1.Time = 1
 
@@ -253,7 +447,7 @@ func testCachePrune(t *testing.T, c *messageCache) {
 	require.Nil(t, c.AddMessage(m1))
 	require.Nil(t, c.AddMessage(m2))
 	require.Nil(t, c.AddMessage(m3))
-	require.Nil(t, c.Prune(time.Unix(2, 0)))
+	require.Nil(t, c.Prune(time.Unix(2, 0), nil))
 
 	count, err := c.MessageCount("mytopic")
 	require.Nil(t, err)
@@ -269,6 +463,72 @@ func testCachePrune(t *testing.T, c *messageCache) {
 	require.Equal(t, "my other message", messages[0].Message)
 }
 
+func TestSqliteCache_PruneExpired(t *testing.T) {
+	testCachePruneExpired(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_PruneExpired(t *testing.T) {
+	testCachePruneExpired(t, newMemTestCache(t))
+}
+
+func testCachePruneExpired(t *testing.T, c messageCache) {
+	m1 := newDefaultMessage("mytopic", "expired")
+	m1.Expires = time.Now().Add(-time.Minute).Unix()
+	m2 := newDefaultMessage("mytopic", "not expired yet")
+	m2.Expires = time.Now().Add(time.Hour).Unix()
+	m3 := newDefaultMessage("mytopic", "no expiry")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.Prune(time.Unix(1, 0), nil))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "not expired yet", messages[0].Message)
+	require.Equal(t, m2.Expires, messages[0].Expires)
+	require.Equal(t, "no expiry", messages[1].Message)
+	require.Equal(t, int64(0), messages[1].Expires)
+
+	_, err = c.Message("mytopic", m1.ID)
+	require.Equal(t, errMessageNotFound, err)
+}
+
+func TestSqliteCache_PruneTopics(t *testing.T) {
+	testCachePruneTopics(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_PruneTopics(t *testing.T) {
+	testCachePruneTopics(t, newMemTestCache(t))
+}
+
+func testCachePruneTopics(t *testing.T, c messageCache) {
+	for _, topic := range []string{"mytopic", "backups", "chatty-logs"} {
+		for i := int64(1); i <= 3; i++ {
+			m := newDefaultMessage(topic, fmt.Sprintf("message %d", i))
+			m.Time = i * 10
+			require.Nil(t, c.AddMessage(m))
+		}
+	}
+	require.Nil(t, c.Prune(time.Unix(20, 0), map[string]time.Time{
+		"backups":     time.Unix(0, 0),  // Keep everything
+		"chatty-logs": time.Unix(30, 0), // Keep less than the other topics
+	}))
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	count, err = c.MessageCount("backups")
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+
+	messages, err := c.Messages("chatty-logs", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+}
+
 func TestSqliteCache_Attachments(t *testing.T) {
 	testCacheAttachments(t, newSqliteTestCache(t))
 }
@@ -277,7 +537,7 @@ func TestMemCache_Attachments(t *testing.T) {
 	testCacheAttachments(t, newMemTestCache(t))
 }
 
-func testCacheAttachments(t *testing.T, c *messageCache) {
+func testCacheAttachments(t *testing.T, c messageCache) {
 	expires1 := time.Now().Add(-4 * time.Hour).Unix()
 	m := newDefaultMessage("mytopic", "flower for you")
 	m.ID = "m1"
@@ -350,6 +610,858 @@ func testCacheAttachments(t *testing.T, c *messageCache) {
 	require.Equal(t, []string{"m1"}, ids)
 }
 
+func TestSqliteCache_AttachmentsDeduplicated(t *testing.T) {
+	testCacheAttachmentsDeduplicated(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_AttachmentsDeduplicated(t *testing.T) {
+	testCacheAttachmentsDeduplicated(t, newMemTestCache(t))
+}
+
+func testCacheAttachmentsDeduplicated(t *testing.T, c messageCache) {
+	snapshot, logo := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	addAttachment := func(id, owner, hash string, size int64, expires time.Duration) {
+		m := newDefaultMessage("mytopic", "motion detected")
+		m.ID = id
+		m.Attachment = &attachment{
+			Name:    "snapshot.jpg",
+			Type:    "image/jpeg",
+			Size:    size,
+			Expires: time.Now().Add(expires).Unix(),
+			URL:     "https://ntfy.sh/file/" + hash + ".jpg",
+			Owner:   owner,
+			Hash:    hash,
+		}
+		require.Nil(t, c.AddMessage(m))
+	}
+	addAttachment("m1", "1.2.3.4", snapshot, 5000, time.Hour)
+	addAttachment("m2", "1.2.3.4", snapshot, 5000, 2*time.Hour) // Same file, uploaded again
+	addAttachment("m3", "1.2.3.4", logo, 300, -time.Hour)
+	addAttachment("m4", "5.6.7.8", snapshot, 5000, time.Hour)
+	addAttachment("m5", "1.2.3.4", "", 700, -time.Hour) // Uploaded before deduplication, stored under the message ID
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(messages))
+	require.Equal(t, snapshot, messages[0].Attachment.Hash)
+	require.Equal(t, "", messages[4].Attachment.Hash)
+	require.Equal(t, snapshot, attachmentFileID(messages[0]))
+	require.Equal(t, "m5", attachmentFileID(messages[4]))
+
+	size, err := c.AttachmentBytesUsed("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(5000), size) // Counted only once
+	size, err = c.AttachmentBytesUsed("5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, int64(5000), size)
+
+	ids, err := c.AttachmentsExpired()
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{logo, "m5"}, ids) // Snapshot is still referenced by unexpired attachments
+
+	references, err := c.AttachmentReferences(snapshot)
+	require.Nil(t, err)
+	require.Equal(t, 3, references)
+	references, err = c.AttachmentReferences(logo)
+	require.Nil(t, err)
+	require.Equal(t, 1, references)
+	references, err = c.AttachmentReferences(strings.Repeat("c", 64))
+	require.Nil(t, err)
+	require.Equal(t, 0, references)
+
+	require.Nil(t, c.QueueEmail(&queuedEmail{SenderIP: "1.2.3.4", To: "phil@example.com", Message: messages[0], NextAttempt: time.Now().Unix()}))
+	emails, err := c.EmailsDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(emails))
+	require.Equal(t, snapshot, emails[0].Message.Attachment.Hash)
+
+	require.Nil(t, c.DeleteMessage("mytopic", "m1"))
+	require.Nil(t, c.DeleteMessage("mytopic", "m3"))
+	references, err = c.AttachmentReferences(snapshot)
+	require.Nil(t, err)
+	require.Equal(t, 2, references)
+	references, err = c.AttachmentReferences(logo)
+	require.Nil(t, err)
+	require.Equal(t, 0, references)
+}
+
+func TestSqliteCache_Emails(t *testing.T) {
+	testCacheEmails(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Emails(t *testing.T) {
+	testCacheEmails(t, newMemTestCache(t))
+}
+
+func testCacheEmails(t *testing.T, c messageCache) {
+	now := time.Now().Unix()
+	m := newDefaultMessage("mytopic", "disk full")
+	m.Attachment = &attachment{Name: "df.txt", Size: 10, URL: "https://ntfy.sh/file/abc.txt", Owner: "1.2.3.4"}
+	e1 := &queuedEmail{SenderIP: "1.2.3.4", To: "phil@example.com", Message: m, Attempts: 1, Queued: now, NextAttempt: now - 1}
+	e2 := &queuedEmail{SenderIP: "5.6.7.8", To: "lisa@example.com", Message: newDefaultMessage("alerts", "later"), Attempts: 1, Queued: now, NextAttempt: now + 60}
+	require.Nil(t, c.QueueEmail(e1))
+	require.Nil(t, c.QueueEmail(e2))
+	require.NotEqual(t, int64(0), e1.ID)
+
+	count, err := c.EmailsQueued()
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	emails, err := c.EmailsDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(emails))
+	require.Equal(t, e1.ID, emails[0].ID)
+	require.Equal(t, "phil@example.com", emails[0].To)
+	require.Equal(t, "1.2.3.4", emails[0].SenderIP)
+	require.Equal(t, 1, emails[0].Attempts)
+	require.Equal(t, "disk full", emails[0].Message.Message)
+	require.Equal(t, "df.txt", emails[0].Message.Attachment.Name)
+	require.Equal(t, "1.2.3.4", emails[0].Message.Attachment.Owner)
+
+	// Reschedule the first, and make the second one due
+	emails[0].Attempts = 2
+	emails[0].NextAttempt = now + 120
+	require.Nil(t, c.QueueEmail(emails[0]))
+	e2.NextAttempt = now - 1
+	require.Nil(t, c.QueueEmail(e2))
+	emails, err = c.EmailsDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(emails))
+	require.Equal(t, "lisa@example.com", emails[0].To)
+
+	require.Nil(t, c.DeleteEmail(e1.ID))
+	require.Nil(t, c.DeleteEmail(e2.ID))
+	count, err = c.EmailsQueued()
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestSqliteCache_EmailDigests(t *testing.T) {
+	testCacheEmailDigests(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_EmailDigests(t *testing.T) {
+	testCacheEmailDigests(t, newMemTestCache(t))
+}
+
+func testCacheEmailDigests(t *testing.T, c messageCache) {
+	require.Nil(t, c.AddEmailDigestMessage("1.2.3.4", "phil@example.com", newDefaultMessage("ci", "build 1 failed"), -time.Second))
+	require.Nil(t, c.AddEmailDigestMessage("5.6.7.8", "phil@example.com", newDefaultMessage("ci", "build 2 failed"), time.Hour)) // Window of the digest is kept
+	require.Nil(t, c.AddEmailDigestMessage("1.2.3.4", "lisa@example.com", newDefaultMessage("ci", "build 1 failed"), time.Hour))
+
+	pending, err := c.EmailDigestPending("ci", "phil@example.com")
+	require.Nil(t, err)
+	require.True(t, pending)
+	pending, err = c.EmailDigestPending("other", "phil@example.com")
+	require.Nil(t, err)
+	require.False(t, pending)
+
+	digests, err := c.EmailDigestsDue()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(digests))
+	require.Equal(t, "ci", digests[0].Topic)
+	require.Equal(t, "phil@example.com", digests[0].To)
+	require.Equal(t, "1.2.3.4", digests[0].SenderIP)
+	require.Equal(t, 2, len(digests[0].Messages))
+	require.Equal(t, "build 1 failed", digests[0].Messages[0].Message)
+	require.Equal(t, "build 2 failed", digests[0].Messages[1].Message)
+
+	require.Nil(t, c.DeleteEmailDigest(digests[0]))
+	digests, err = c.EmailDigestsDue()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(digests))
+	pending, err = c.EmailDigestPending("ci", "lisa@example.com")
+	require.Nil(t, err)
+	require.True(t, pending)
+}
+
+func TestSqliteCache_RecurringMessages(t *testing.T) {
+	testCacheRecurringMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_RecurringMessages(t *testing.T) {
+	testCacheRecurringMessages(t, newMemTestCache(t))
+}
+
+func testCacheRecurringMessages(t *testing.T, c messageCache) {
+	backup := &recurringMessage{ID: "backup123456", Topic: "mytopic", Cron: "0 9 * * *", Next: time.Now().Add(-time.Minute).Unix(), Message: "Run the backup", Tags: []string{"floppy_disk"}, senderIP: "1.2.3.4"}
+	weekly := &recurringMessage{ID: "weekly123456", Topic: "mytopic", Cron: "@weekly", Timezone: "Europe/Berlin", Next: time.Now().Add(time.Hour).Unix(), Message: "Weekly report", senderUser: "phil"}
+	other := &recurringMessage{ID: "other1234567", Topic: "other", Cron: "@hourly", Next: time.Now().Add(-time.Hour).Unix(), Message: "Other topic"}
+	require.Nil(t, c.AddRecurringMessage(backup))
+	require.Nil(t, c.AddRecurringMessage(weekly))
+	require.Nil(t, c.AddRecurringMessage(other))
+
+	recurring, err := c.RecurringMessages("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(recurring))
+	require.Equal(t, "backup123456", recurring[0].ID)
+	require.Equal(t, "0 9 * * *", recurring[0].Cron)
+	require.Equal(t, []string{"floppy_disk"}, recurring[0].Tags)
+	require.Equal(t, "1.2.3.4", recurring[0].senderIP)
+	require.Equal(t, "Europe/Berlin", recurring[1].Timezone)
+	require.Equal(t, "phil", recurring[1].senderUser)
+
+	due, err := c.RecurringMessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(due))
+	require.Equal(t, "other1234567", due[0].ID) // Oldest first
+	require.Equal(t, "backup123456", due[1].ID)
+
+	backup.Next = time.Now().Add(24 * time.Hour).Unix()
+	require.Nil(t, c.UpdateRecurringMessage(backup))
+	require.Nil(t, c.DeleteRecurringMessage("other", "other1234567"))
+	due, err = c.RecurringMessagesDue()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(due))
+	recurring, err = c.RecurringMessages("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, backup.Next, recurring[0].Next)
+	recurring, err = c.RecurringMessages("other")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(recurring))
+}
+
+func TestSqliteCache_Thread(t *testing.T) {
+	testCacheThread(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Thread(t *testing.T) {
+	testCacheThread(t, newMemTestCache(t))
+}
+
+func testCacheThread(t *testing.T, c messageCache) {
+	m := newDefaultMessage("mytopic", "fixed")
+	m.InReplyTo = "update123456"
+	m.thread = "alert1234567"
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "update123456", messages[0].InReplyTo)
+	require.Equal(t, "alert1234567", messages[0].thread)
+	m, err = c.Message("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "alert1234567", m.thread)
+}
+
+func TestSqliteCache_TopicInfo(t *testing.T) {
+	testCacheTopicInfo(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicInfo(t *testing.T) {
+	testCacheTopicInfo(t, newMemTestCache(t))
+}
+
+func testCacheTopicInfo(t *testing.T, c messageCache) {
+	info, err := c.TopicInfo("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, &topicInfo{Topic: "mytopic"}, info)
+
+	require.Nil(t, c.UpdateTopicInfo(&topicInfo{Topic: "mytopic", DisplayName: "My topic", Icon: "https://example.com/icon.png"}))
+	require.Nil(t, c.UpdateTopicInfo(&topicInfo{Topic: "mytopic", DisplayName: "My topic", Description: "Replaced"}))
+	require.Nil(t, c.UpdateTopicInfo(&topicInfo{Topic: "other", DisplayName: "Other topic"}))
+	info, err = c.TopicInfo("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, &topicInfo{Topic: "mytopic", DisplayName: "My topic", Description: "Replaced"}, info)
+
+	require.Nil(t, c.DeleteTopicInfo("mytopic"))
+	info, err = c.TopicInfo("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, &topicInfo{Topic: "mytopic"}, info)
+	info, err = c.TopicInfo("other")
+	require.Nil(t, err)
+	require.Equal(t, "Other topic", info.DisplayName)
+}
+
+func TestSqliteCache_TopicDefaults(t *testing.T) {
+	testCacheTopicDefaults(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicDefaults(t *testing.T) {
+	testCacheTopicDefaults(t, newMemTestCache(t))
+}
+
+func testCacheTopicDefaults(t *testing.T, c messageCache) {
+	defaults, err := c.TopicDefaults("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, &topicDefaults{Topic: "mytopic"}, defaults)
+
+	require.Nil(t, c.UpdateTopicDefaults(&topicDefaults{Topic: "mytopic", Title: "Backup", Click: "https://example.com"}))
+	require.Nil(t, c.UpdateTopicDefaults(&topicDefaults{Topic: "mytopic", Priority: 2, Tags: []string{"backup", "nas"}}))
+	require.Nil(t, c.UpdateTopicDefaults(&topicDefaults{Topic: "other", Priority: 5}))
+	defaults, err = c.TopicDefaults("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, &topicDefaults{Topic: "mytopic", Priority: 2, Tags: []string{"backup", "nas"}}, defaults)
+
+	require.Nil(t, c.DeleteTopicDefaults("mytopic"))
+	defaults, err = c.TopicDefaults("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, &topicDefaults{Topic: "mytopic"}, defaults)
+	defaults, err = c.TopicDefaults("other")
+	require.Nil(t, err)
+	require.Equal(t, 5, defaults.Priority)
+}
+
+func TestSqliteCache_MessageAcks(t *testing.T) {
+	testCacheMessageAcks(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessageAcks(t *testing.T) {
+	testCacheMessageAcks(t, newMemTestCache(t))
+}
+
+func testCacheMessageAcks(t *testing.T, c messageCache) {
+	m1 := newDefaultMessage("mytopic", "disk full")
+	m1.AckRequired = true
+	m2 := newDefaultMessage("mytopic", "disk still full")
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	m, err := c.Message("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.True(t, m.AckRequired)
+
+	added, err := c.AddMessageAck("mytopic", m1.ID, &messageAck{User: "phil", Time: 200, subscriber: "phil"})
+	require.Nil(t, err)
+	require.True(t, added)
+	added, err = c.AddMessageAck("mytopic", m1.ID, &messageAck{Time: 100, subscriber: "1.2.3.4"})
+	require.Nil(t, err)
+	require.True(t, added)
+	added, err = c.AddMessageAck("mytopic", m1.ID, &messageAck{User: "phil", Time: 300, subscriber: "phil"})
+	require.Nil(t, err)
+	require.False(t, added)
+	added, err = c.AddMessageAck("mytopic", m2.ID, &messageAck{User: "phil", Time: 300, subscriber: "phil"})
+	require.Nil(t, err)
+	require.True(t, added)
+
+	acks, err := c.MessageAcks("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, []*messageAck{{Time: 100}, {User: "phil", Time: 200}}, acks)
+
+	require.Nil(t, c.DeleteMessage("mytopic", m1.ID))
+	acks, err = c.MessageAcks("mytopic", m1.ID)
+	require.Nil(t, err)
+	require.Empty(t, acks)
+	acks, err = c.MessageAcks("mytopic", m2.ID)
+	require.Nil(t, err)
+	require.Len(t, acks, 1)
+
+	require.Nil(t, c.Prune(time.Now().Add(time.Hour), nil))
+	acks, err = c.MessageAcks("mytopic", m2.ID)
+	require.Nil(t, err)
+	require.Empty(t, acks)
+}
+
+func TestSqliteCache_Escalations(t *testing.T) {
+	testCacheEscalations(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Escalations(t *testing.T) {
+	testCacheEscalations(t, newMemTestCache(t))
+}
+
+func testCacheEscalations(t *testing.T, c messageCache) {
+	chain, err := c.TopicEscalation("alerts")
+	require.Nil(t, err)
+	require.Equal(t, &topicEscalation{Topic: "alerts", Steps: []*escalationStep{}}, chain)
+	steps := []*escalationStep{{After: "10m", Topic: "oncall"}, {After: "1h", Email: "boss@example.com"}}
+	require.Nil(t, c.UpdateTopicEscalation(&topicEscalation{Topic: "alerts", Steps: steps}))
+	chain, err = c.TopicEscalation("alerts")
+	require.Nil(t, err)
+	require.Equal(t, steps, chain.Steps)
+
+	now := time.Now().Unix()
+	require.Nil(t, c.UpdateEscalation(&escalation{Topic: "alerts", MessageID: "msg1", Due: now - 10}))
+	require.Nil(t, c.UpdateEscalation(&escalation{Topic: "alerts", MessageID: "msg2", Due: now + 600}))
+	require.Nil(t, c.UpdateEscalation(&escalation{Topic: "alerts", MessageID: "msg1", Step: 1, Due: now - 5, Copies: []string{"oncall/msg3"}}))
+	escalations, err := c.EscalationsDue()
+	require.Nil(t, err)
+	require.Equal(t, []*escalation{{Topic: "alerts", MessageID: "msg1", Step: 1, Due: now - 5, Copies: []string{"oncall/msg3"}}}, escalations)
+
+	require.Nil(t, c.DeleteEscalation("alerts", "msg1"))
+	escalations, err = c.EscalationsDue()
+	require.Nil(t, err)
+	require.Empty(t, escalations)
+	require.Nil(t, c.DeleteTopicEscalation("alerts"))
+	chain, err = c.TopicEscalation("alerts")
+	require.Nil(t, err)
+	require.Empty(t, chain.Steps)
+}
+
+func TestSqliteCache_CollapseKey(t *testing.T) {
+	testCacheCollapseKey(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_CollapseKey(t *testing.T) {
+	testCacheCollapseKey(t, newMemTestCache(t))
+}
+
+func testCacheCollapseKey(t *testing.T, c messageCache) {
+	m1 := newDefaultMessage("sensors", "21C")
+	m1.CollapseKey = "living-room"
+	m1.senderIP = "1.2.3.4"
+	m2 := newDefaultMessage("sensors", "19C")
+	m2.CollapseKey = "kitchen"
+	m3 := newDefaultMessage("sensors", "22C (scheduled)")
+	m3.CollapseKey = "living-room"
+	m3.Time = time.Now().Add(time.Hour).Unix()
+	m4 := newDefaultMessage("other", "20C")
+	m4.CollapseKey = "living-room"
+	for _, m := range []*message{m1, m2, m3, m4} {
+		require.Nil(t, c.AddMessage(m))
+	}
+	messages, err := c.MessagesByCollapseKey("sensors", "living-room")
+	require.Nil(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, m1.ID, messages[0].ID)
+	require.Equal(t, "living-room", messages[0].CollapseKey)
+	require.Equal(t, "1.2.3.4", messages[0].senderIP)
+
+	messages, err = c.MessagesByCollapseKey("sensors", "bedroom")
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_Markdown(t *testing.T) {
+	testCacheMarkdown(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Markdown(t *testing.T) {
+	testCacheMarkdown(t, newMemTestCache(t))
+}
+
+func testCacheMarkdown(t *testing.T, c messageCache) {
+	m := newDefaultMessage("backups", "**Backup** failed")
+	renderMessageMarkdown(m)
+	require.Nil(t, c.AddMessage(m))
+	messages, err := c.Messages("backups", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, "Backup failed", messages[0].Message)
+	require.Equal(t, "**Backup** failed", messages[0].Markdown)
+	require.Equal(t, "<p><strong>Backup</strong> failed</p>", messages[0].HTML)
+
+	m.Message = "_Backup_ succeeded"
+	renderMessageMarkdown(m)
+	require.Nil(t, c.UpdateMessage(m))
+	m, err = c.Message("backups", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "Backup succeeded", m.Message)
+	require.Equal(t, "<p><em>Backup</em> succeeded</p>", m.HTML)
+}
+
+func TestSqliteCache_TopicWebhooks(t *testing.T) {
+	testCacheTopicWebhooks(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TopicWebhooks(t *testing.T) {
+	testCacheTopicWebhooks(t, newMemTestCache(t))
+}
+
+func testCacheTopicWebhooks(t *testing.T, c messageCache) {
+	webhooks, err := c.TopicWebhooks("alerts")
+	require.Nil(t, err)
+	require.Equal(t, "alerts", webhooks.Topic)
+	require.Empty(t, webhooks.Webhooks)
+
+	require.Nil(t, c.UpdateTopicWebhooks(&topicWebhooks{Topic: "alerts", Webhooks: []*topicWebhook{{URL: "https://example.com/old"}}}))
+	require.Nil(t, c.UpdateTopicWebhooks(&topicWebhooks{Topic: "alerts", Secret: "topic-secret", Webhooks: []*topicWebhook{
+		{URL: "https://example.com/hook", Secret: "s3cr3t"},
+		{URL: "http://10.0.0.1:8080/ntfy"},
+	}}))
+	webhooks, err = c.TopicWebhooks("alerts")
+	require.Nil(t, err)
+	require.Len(t, webhooks.Webhooks, 2)
+	require.Equal(t, "topic-secret", webhooks.Secret)
+	require.Equal(t, "https://example.com/hook", webhooks.Webhooks[0].URL)
+	require.Equal(t, "s3cr3t", webhooks.Webhooks[0].Secret)
+	require.Equal(t, "", webhooks.Webhooks[1].Secret)
+
+	require.Nil(t, c.UpdateTopicWebhooks(&topicWebhooks{Topic: "alerts", Webhooks: webhooks.Webhooks}))
+	webhooks, err = c.TopicWebhooks("alerts")
+	require.Nil(t, err)
+	require.Equal(t, "", webhooks.Secret)
+	require.Len(t, webhooks.Webhooks, 2)
+
+	require.Nil(t, c.DeleteTopicWebhooks("alerts"))
+	webhooks, err = c.TopicWebhooks("alerts")
+	require.Nil(t, err)
+	require.Empty(t, webhooks.Webhooks)
+
+	// Retry queue
+	m := newDefaultMessage("alerts", "Disk full")
+	require.Nil(t, c.QueueWebhook(&queuedWebhook{URL: "https://example.com/hook", Secret: "s3cr3t", Message: m, Attempts: 1, Queued: time.Now().Unix(), NextAttempt: time.Now().Add(time.Hour).Unix()}))
+	queued := &queuedWebhook{URL: "https://example.com/other", Format: webhookFormatSlack, Message: m, Attempts: 1, Queued: time.Now().Unix(), NextAttempt: time.Now().Unix()}
+	require.Nil(t, c.QueueWebhook(queued))
+	require.NotEqual(t, int64(0), queued.ID)
+	due, err := c.WebhooksDue()
+	require.Nil(t, err)
+	require.Len(t, due, 1)
+	require.Equal(t, "https://example.com/other", due[0].URL)
+	require.Equal(t, webhookFormatSlack, due[0].Format)
+	require.Equal(t, m.ID, due[0].Message.ID)
+	require.Equal(t, "Disk full", due[0].Message.Message)
+
+	queued.Attempts = 2
+	queued.NextAttempt = time.Now().Add(time.Minute).Unix()
+	require.Nil(t, c.QueueWebhook(queued))
+	due, err = c.WebhooksDue()
+	require.Nil(t, err)
+	require.Empty(t, due)
+
+	queued.NextAttempt = time.Now().Unix()
+	require.Nil(t, c.QueueWebhook(queued))
+	due, err = c.WebhooksDue()
+	require.Nil(t, err)
+	require.Len(t, due, 1)
+	require.Equal(t, 2, due[0].Attempts)
+	require.Nil(t, c.DeleteQueuedWebhook(queued.ID))
+	due, err = c.WebhooksDue()
+	require.Nil(t, err)
+	require.Empty(t, due)
+}
+
+func TestSqliteCache_Heartbeats(t *testing.T) {
+	testCacheHeartbeats(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Heartbeats(t *testing.T) {
+	testCacheHeartbeats(t, newMemTestCache(t))
+}
+
+func testCacheHeartbeats(t *testing.T, c messageCache) {
+	h, err := c.Heartbeat("backups")
+	require.Nil(t, err)
+	require.Nil(t, h)
+
+	now := time.Now().Unix()
+	backups := &heartbeat{Topic: "backups", Interval: "25h", Target: "alerts", Email: "ops@example.com", Message: "No backup", Due: now - 10}
+	require.Nil(t, c.UpdateHeartbeat(backups))
+	require.Nil(t, c.UpdateHeartbeat(&heartbeat{Topic: "cron", Interval: "1h", Target: "alerts", Due: now + 600}))
+	require.Nil(t, c.UpdateHeartbeat(&heartbeat{Topic: "sync", Interval: "1h", Target: "alerts", Due: now - 5, Alerted: true}))
+	h, err = c.Heartbeat("backups")
+	require.Nil(t, err)
+	require.Equal(t, backups, h)
+	heartbeats, err := c.HeartbeatsDue()
+	require.Nil(t, err)
+	require.Equal(t, []*heartbeat{backups}, heartbeats)
+
+	backups.Alerted = true
+	require.Nil(t, c.UpdateHeartbeat(backups))
+	heartbeats, err = c.HeartbeatsDue()
+	require.Nil(t, err)
+	require.Empty(t, heartbeats)
+	h, err = c.Heartbeat("sync")
+	require.Nil(t, err)
+	require.True(t, h.Alerted)
+
+	require.Nil(t, c.DeleteHeartbeat("backups"))
+	h, err = c.Heartbeat("backups")
+	require.Nil(t, err)
+	require.Nil(t, h)
+}
+
+func TestSqliteCache_HeldMessages(t *testing.T) {
+	testCacheHeldMessages(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_HeldMessages(t *testing.T) {
+	testCacheHeldMessages(t, newMemTestCache(t))
+}
+
+func testCacheHeldMessages(t *testing.T, c messageCache) {
+	moderated, err := c.TopicModerated("community")
+	require.Nil(t, err)
+	require.False(t, moderated)
+	require.Nil(t, c.UpdateTopicModerated("community", true))
+	require.Nil(t, c.UpdateTopicModerated("community", true))
+	moderated, err = c.TopicModerated("community")
+	require.Nil(t, err)
+	require.True(t, moderated)
+
+	m1 := newDefaultMessage("community", "first")
+	m1.Time = 1000
+	m1.senderIP = "1.2.3.4"
+	m1.Attachment = &attachment{Name: "flower.jpg", URL: "https://ntfy.sh/file/abc.jpg", Owner: "1.2.3.4", Hash: "abc"}
+	m2 := newDefaultMessage("community", "second")
+	m2.Time = 2000
+	require.Nil(t, c.HoldMessage(m2))
+	require.Nil(t, c.HoldMessage(m1))
+	messages, err := c.HeldMessages("community")
+	require.Nil(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, "first", messages[0].Message)
+	require.Equal(t, "second", messages[1].Message)
+	m, err := c.HeldMessage("community", m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, "1.2.3.4", m.senderIP)
+	require.Equal(t, "abc", m.Attachment.Hash)
+	require.Equal(t, "1.2.3.4", m.Attachment.Owner)
+
+	require.Nil(t, c.DeleteHeldMessage("community", m1.ID))
+	_, err = c.HeldMessage("community", m1.ID)
+	require.Equal(t, errMessageNotFound, err)
+	messages, err = c.Messages("community", sinceAllMessages, true)
+	require.Nil(t, err)
+	require.Empty(t, messages) // Held messages are not in the cache
+	require.Nil(t, c.UpdateTopicModerated("community", false))
+	moderated, err = c.TopicModerated("community")
+	require.Nil(t, err)
+	require.False(t, moderated)
+}
+
+func TestSqliteCache_APNSDevices(t *testing.T) {
+	testCacheAPNSDevices(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_APNSDevices(t *testing.T) {
+	testCacheAPNSDevices(t, newMemTestCache(t))
+}
+
+func testCacheAPNSDevices(t *testing.T, c messageCache) {
+	require.Nil(t, c.AddAPNSDevice(&apnsDevice{Topic: "alerts", Token: "bbbb", User: ""}))
+	require.Nil(t, c.AddAPNSDevice(&apnsDevice{Topic: "alerts", Token: "aaaa", User: "phil"}))
+	require.Nil(t, c.AddAPNSDevice(&apnsDevice{Topic: "backups", Token: "aaaa", User: "phil"}))
+	require.Nil(t, c.AddAPNSDevice(&apnsDevice{Topic: "alerts", Token: "bbbb", User: "ben"})) // Registered again by another user
+	devices, err := c.APNSDevices("alerts")
+	require.Nil(t, err)
+	require.Equal(t, []*apnsDevice{
+		{Topic: "alerts", Token: "aaaa", User: "phil"},
+		{Topic: "alerts", Token: "bbbb", User: "ben"},
+	}, devices)
+
+	require.Nil(t, c.DeleteAPNSDevice("alerts", "aaaa"))
+	devices, err = c.APNSDevices("alerts")
+	require.Nil(t, err)
+	require.Equal(t, []*apnsDevice{{Topic: "alerts", Token: "bbbb", User: "ben"}}, devices)
+	devices, err = c.APNSDevices("backups")
+	require.Nil(t, err)
+	require.Len(t, devices, 1)
+	devices, err = c.APNSDevices("other")
+	require.Nil(t, err)
+	require.Empty(t, devices)
+}
+
+func TestSqliteCache_TelegramChats(t *testing.T) {
+	testCacheTelegramChats(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_TelegramChats(t *testing.T) {
+	testCacheTelegramChats(t, newMemTestCache(t))
+}
+
+func testCacheTelegramChats(t *testing.T, c messageCache) {
+	require.Nil(t, c.AddTelegramChat("alerts", "-1001234567890"))
+	require.Nil(t, c.AddTelegramChat("alerts", "@ops_alerts"))
+	require.Nil(t, c.AddTelegramChat("alerts", "-1001234567890")) // Added twice
+	require.Nil(t, c.AddTelegramChat("backups", "123456"))
+	chats, err := c.TelegramChats("alerts")
+	require.Nil(t, err)
+	require.Equal(t, []string{"-1001234567890", "@ops_alerts"}, chats)
+
+	require.Nil(t, c.DeleteTelegramChat("alerts", "-1001234567890"))
+	chats, err = c.TelegramChats("alerts")
+	require.Nil(t, err)
+	require.Equal(t, []string{"@ops_alerts"}, chats)
+	chats, err = c.TelegramChats("other")
+	require.Nil(t, err)
+	require.Empty(t, chats)
+}
+
+func TestSqliteCache_PhoneNumbers(t *testing.T) {
+	testCachePhoneNumbers(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_PhoneNumbers(t *testing.T) {
+	testCachePhoneNumbers(t, newMemTestCache(t))
+}
+
+func testCachePhoneNumbers(t *testing.T, c messageCache) {
+	require.Nil(t, c.AddPhoneNumber("phil", "+491701234567"))
+	require.Nil(t, c.AddPhoneNumber("phil", "+12025550123"))
+	require.Nil(t, c.AddPhoneNumber("phil", "+491701234567")) // Added twice
+	require.Nil(t, c.AddPhoneNumber("ben", "+441632960961"))
+	phoneNumbers, err := c.PhoneNumbers("phil")
+	require.Nil(t, err)
+	require.Equal(t, []string{"+12025550123", "+491701234567"}, phoneNumbers)
+
+	require.Nil(t, c.DeletePhoneNumber("phil", "+12025550123"))
+	phoneNumbers, err = c.PhoneNumbers("phil")
+	require.Nil(t, err)
+	require.Equal(t, []string{"+491701234567"}, phoneNumbers)
+	phoneNumbers, err = c.PhoneNumbers("other")
+	require.Nil(t, err)
+	require.Empty(t, phoneNumbers)
+}
+
+func TestSqliteCache_QuietHours(t *testing.T) {
+	testCacheQuietHours(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_QuietHours(t *testing.T) {
+	testCacheQuietHours(t, newMemTestCache(t))
+}
+
+func testCacheQuietHours(t *testing.T, c messageCache) {
+	q, err := c.QuietHours("phil")
+	require.Nil(t, err)
+	require.Nil(t, q)
+	require.Nil(t, c.UpdateQuietHours("phil", &quietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Berlin"}))
+	require.Nil(t, c.UpdateQuietHours("phil", &quietHours{Start: "23:00", End: "06:30", Priority: 5}))
+	require.Nil(t, c.UpdateQuietHours("ben", &quietHours{Start: "01:00", End: "02:00"}))
+	q, err = c.QuietHours("phil")
+	require.Nil(t, err)
+	require.Equal(t, &quietHours{Start: "23:00", End: "06:30", Priority: 5}, q)
+
+	require.Nil(t, c.DeleteQuietHours("phil"))
+	q, err = c.QuietHours("phil")
+	require.Nil(t, err)
+	require.Nil(t, q)
+	q, err = c.QuietHours("ben")
+	require.Nil(t, err)
+	require.Equal(t, "01:00", q.Start)
+}
+
+func TestSqliteCache_Search(t *testing.T) {
+	testCacheSearch(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Search(t *testing.T) {
+	testCacheSearch(t, newMemTestCache(t))
+}
+
+func testCacheSearch(t *testing.T, c messageCache) {
+	m1 := newDefaultMessage("mytopic", "Disk full on the backup server")
+	m1.Time = 1
+	m1.Title = "Backup failed"
+	m1.Tags = []string{"warning", "nas"}
+	m2 := newDefaultMessage("mytopic", "Backup succeeded")
+	m2.Time = 2
+	m3 := newDefaultMessage("othertopic", "Disk full")
+	m4 := newDefaultMessage("mytopic", "Disk full, but later")
+	m4.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(m4))
+
+	messages, err := c.SearchMessages("mytopic", []string{"disk"}, 100)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m1.ID, messages[0].ID)
+
+	messages, err = c.SearchMessages("mytopic", []string{"back"}, 100) // Prefix, title and message
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, m1.ID, messages[0].ID)
+	require.Equal(t, m2.ID, messages[1].ID)
+
+	messages, err = c.SearchMessages("mytopic", []string{"backup"}, 1) // Most recent only
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m2.ID, messages[0].ID)
+
+	messages, err = c.SearchMessages("mytopic", []string{"nas", "full"}, 100) // Tags
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, []string{"warning", "nas"}, messages[0].Tags)
+
+	messages, err = c.SearchMessages("mytopic", []string{"disk", "succeeded"}, 100)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	require.Nil(t, c.Prune(time.Unix(2, 0), nil))
+	messages, err = c.SearchMessages("mytopic", []string{"disk"}, 100)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_MessagesBatched(t *testing.T) {
+	testCacheMessagesBatched(t, 10, 100*time.Millisecond)
+}
+
+func TestSqliteCache_MessagesBatchedNoTimeout(t *testing.T) {
+	testCacheMessagesBatched(t, 10, 0)
+}
+
+func testCacheMessagesBatched(t *testing.T, batchSize int, batchTimeout time.Duration) {
+	c, err := newSqliteCache(newSqliteTestCacheFile(t), batchSize, batchTimeout, false)
+	require.Nil(t, err)
+	for i := 0; i < 25; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = 1 // Same time for all, so that only the insertion order counts
+		require.Nil(t, c.AddMessage(m))
+	}
+	require.Eventually(t, func() bool {
+		count, err := c.MessageCount("mytopic")
+		return err == nil && count == 25
+	}, 2*time.Second, 10*time.Millisecond)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	for i, m := range messages {
+		require.Equal(t, fmt.Sprintf("message %d", i), m.Message)
+	}
+}
+
+func TestSqliteCache_MessagesBatchedRead(t *testing.T) {
+	c, err := newSqliteCache(newSqliteTestCacheFile(t), 10, time.Minute, false)
+	require.Nil(t, err)
+	m := newDefaultMessage("mytopic", "backup done")
+	m.dedupKey = "backup-1"
+	require.Nil(t, c.AddMessage(m))
+
+	// Reads don't wait for the batch timeout, but write the queued messages first
+	start := time.Now()
+	found, err := c.Message("mytopic", m.ID)
+	require.Nil(t, err)
+	require.Equal(t, "backup done", found.Message)
+	found, err = c.MessageByDedupKey("mytopic", "backup-1", time.Unix(0, 0))
+	require.Nil(t, err)
+	require.Equal(t, m.ID, found.ID)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Nil(t, c.Close())
+}
+
+func TestSqliteCache_MessagesBatchedClose(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c, err := newSqliteCache(filename, 10, time.Minute, false)
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))))
+	}
+	require.Nil(t, c.Close()) // Doesn't wait for the batch timeout
+	require.Nil(t, c.Close())
+	require.Equal(t, errCacheClosed, c.AddMessage(newDefaultMessage("mytopic", "too late")))
+
+	c, err = newSqliteCache(filename, 0, 0, false)
+	require.Nil(t, err)
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 5, count)
+}
+
+func TestSqliteCache_MessagesBatchedFailure(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c, err := newSqliteCache(filename, 10, time.Minute, false)
+	require.Nil(t, err)
+	_, err = c.db.Exec(`CREATE TRIGGER reject_poison BEFORE INSERT ON messages WHEN NEW.message = 'poison' BEGIN SELECT RAISE(ABORT, 'poison'); END`)
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "first")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "poison")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "second")))
+	require.Nil(t, c.Close())
+
+	// Only the bad message is lost, not the whole batch
+	c, err = newSqliteCache(filename, 0, 0, false)
+	require.Nil(t, err)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, "first", messages[0].Message)
+	require.Equal(t, "second", messages[1].Message)
+}
+
 func TestSqliteCache_Migration_From0(t *testing.T) {
 	filename := newSqliteTestCacheFile(t)
 	db, err := sql.Open("sqlite3", filename)
@@ -379,7 +1491,7 @@ func TestSqliteCache_Migration_From0(t *testing.T) {
 
 	// Create cache to trigger migration
 	c := newSqliteTestCacheFromFile(t, filename)
-	checkSchemaVersion(t, c.db)
+	checkSchemaVersion(t, c.db.DB)
 
 	messages, err := c.Messages("mytopic", sinceAllMessages, false)
 	require.Nil(t, err)
@@ -388,6 +1500,11 @@ func TestSqliteCache_Migration_From0(t *testing.T) {
 	require.Equal(t, "", messages[5].Title)
 	require.Nil(t, messages[5].Tags)
 	require.Equal(t, 0, messages[5].Priority)
+
+	messages, err = c.SearchMessages("mytopic", []string{"some", "5"}, 100) // Index was rebuilt
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "some message 5", messages[0].Message)
 }
 
 func TestSqliteCache_Migration_From1(t *testing.T) {
@@ -425,7 +1542,7 @@ func TestSqliteCache_Migration_From1(t *testing.T) {
 
 	// Create cache to trigger migration
 	c := newSqliteTestCacheFromFile(t, filename)
-	checkSchemaVersion(t, c.db)
+	checkSchemaVersion(t, c.db.DB)
 
 	// Add delayed message
 	delayedMessage := newDefaultMessage("mytopic", "some delayed message")
@@ -467,8 +1584,8 @@ func TestMemCache_NopCache(t *testing.T) {
 	assert.Empty(t, topics)
 }
 
-func newSqliteTestCache(t *testing.T) *messageCache {
-	c, err := newSqliteCache(newSqliteTestCacheFile(t), false)
+func newSqliteTestCache(t *testing.T) *sqlCache {
+	c, err := newSqliteCache(newSqliteTestCacheFile(t), 0, 0, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -479,15 +1596,15 @@ func newSqliteTestCacheFile(t *testing.T) string {
 	return filepath.Join(t.TempDir(), "cache.db")
 }
 
-func newSqliteTestCacheFromFile(t *testing.T, filename string) *messageCache {
-	c, err := newSqliteCache(filename, false)
+func newSqliteTestCacheFromFile(t *testing.T, filename string) *sqlCache {
+	c, err := newSqliteCache(filename, 0, 0, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 	return c
 }
 
-func newMemTestCache(t *testing.T) *messageCache {
+func newMemTestCache(t *testing.T) *sqlCache {
 	c, err := newMemCache()
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// handleMetrics exposes the server metrics in the Prometheus text exposition format. As of today, only the
+// metrics of the SMTP server (incoming e-mails) and of outgoing e-mails are exposed.
+func (s *Server) handleMetrics(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	var b strings.Builder
+	if s.mailer != nil {
+		queued, err := s.messageCache.EmailsQueued()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		m := s.emailMetrics
+		s.mu.Unlock()
+		writeMetric(&b, "ntfy_emails_sent_total", "counter", "Number of outgoing e-mails sent, including retried e-mails", m.Sent)
+		writeMetric(&b, "ntfy_emails_retried_total", "counter", "Number of failed attempts to send an e-mail that were queued for retry", m.Retried)
+		writeMetric(&b, "ntfy_emails_failed_total", "counter", "Number of outgoing e-mails that were given up on", m.Failed)
+		writeMetric(&b, "ntfy_emails_queued", "gauge", "Number of outgoing e-mails waiting in the retry queue", int64(queued))
+	}
+	if s.smtpBackend != nil {
+		m := s.smtpBackend.Metrics()
+		writeMetric(&b, "ntfy_smtp_emails_published_total", "counter", "Number of messages published via incoming e-mails", m.Success)
+		writeMetric(&b, "ntfy_smtp_emails_failed_total", "counter", "Number of failed SMTP commands, e.g. rejected recipients or e-mails", m.Failure)
+		writeMetricHeader(&b, "ntfy_smtp_errors_total", "counter", "Number of failed SMTP commands by reason")
+		reasons := make([]string, 0, len(m.Errors))
+		for reason := range m.Errors {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(&b, "ntfy_smtp_errors_total{reason=%q} %d\n", reason, m.Errors[reason])
+		}
+		writeMetric(&b, "ntfy_smtp_received_bytes_total", "counter", "Number of bytes received in incoming e-mails", m.BytesReceived)
+		writeMetric(&b, "ntfy_smtp_sessions_active", "gauge", "Number of currently open SMTP sessions", m.ActiveSessions)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeMetric(b *strings.Builder, name, metricType, help string, value int64) {
+	writeMetricHeader(b, name, metricType, help)
+	fmt.Fprintf(b, "%s %d\n", name, value)
+}
+
+func writeMetricHeader(b *strings.Builder, name, metricType, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
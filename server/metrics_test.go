@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestServer_Metrics(t *testing.T) {
+	c := newTestConfig(t)
+	c.EnableMetrics = true
+	s := newTestServer(t, c)
+	s.smtpBackend = newMailBackend(c, nil, nil, func(_ string, m *message, _ *mailAttachment) error {
+		return nil
+	})
+	c.SMTPServerDomain = "ntfy.sh"
+	session, _ := s.smtpBackend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("phil@example.com", smtp.MailOptions{}))
+	require.Equal(t, errInvalidDomain, session.Rcpt("mytopic@example.com"))
+	require.Equal(t, errInvalidTopic, session.Rcpt("my/topic@ntfy.sh"))
+	require.Nil(t, session.Rcpt("mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader("Subject: Hi\r\nContent-Type: text/plain\r\n\r\nhello\r\n")))
+
+	response := request(t, s, "GET", "/metrics", "", nil)
+	require.Equal(t, 200, response.Code)
+	body := response.Body.String()
+	require.Contains(t, body, "# TYPE ntfy_smtp_emails_published_total counter\nntfy_smtp_emails_published_total 1\n")
+	require.Contains(t, body, "ntfy_smtp_emails_failed_total 2\n")
+	require.Contains(t, body, "ntfy_smtp_errors_total{reason=\"invalid_address\"} 2\n")
+	require.Contains(t, body, "ntfy_smtp_received_bytes_total 48\n")
+	require.Contains(t, body, "ntfy_smtp_sessions_active 1\n")
+
+	require.Nil(t, session.Logout())
+	response = request(t, s, "GET", "/metrics", "", nil)
+	require.Contains(t, response.Body.String(), "ntfy_smtp_sessions_active 0\n")
+}
+
+func TestServer_Metrics_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/metrics", "", nil)
+	require.NotContains(t, response.Body.String(), "ntfy_smtp")
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/ntfy/auth"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const (
+	moderationQueueMax = 100 // Per topic, so that spam cannot pile up indefinitely
+)
+
+var (
+	moderationPathRegex        = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/moderation$`)
+	moderationMessagePathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/moderation/([A-Za-z0-9]{12})/(approve|reject)$`)
+)
+
+// handleTopicModeration returns whether the topic is moderated, and the messages waiting for approval. Since the
+// messages are not public yet, only moderators of the topic (see topicModerator) may see them.
+func (s *Server) handleTopicModeration(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if s.auth != nil && !s.topicModerator(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	return s.writeModerationResponse(w, t.ID)
+}
+
+// handleTopicModerationUpdate turns the moderation of a topic on or off. Moderation only holds back anonymous
+// messages, so it requires access control. Turning it off does not publish the messages that are already held.
+func (s *Server) handleTopicModerationUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if s.auth == nil {
+		return errHTTPBadRequestModerationAuthRequired
+	} else if !s.topicModerator(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	var req moderationRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	if err := s.messageCache.UpdateTopicModerated(t.ID, req.Moderated); err != nil {
+		return err
+	}
+	log.Printf("[%s] Turned moderation of topic %s %s", v.ip, t.ID, onOff(req.Moderated))
+	return s.writeModerationResponse(w, t.ID)
+}
+
+// handleModerationMessage approves or rejects a message in the moderation queue of a topic. Approved messages are
+// published as if they were just sent; rejected messages are dropped along with their attachment.
+func (s *Server) handleModerationMessage(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if s.auth != nil && !s.topicModerator(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	matches := moderationMessagePathRegex.FindStringSubmatch(r.URL.Path)
+	id, action := matches[1], matches[2]
+	m, err := s.messageCache.HeldMessage(t.ID, id)
+	if err == errMessageNotFound {
+		return errHTTPNotFoundMessage
+	} else if err != nil {
+		return err
+	}
+	if action == "approve" {
+		s.mu.Lock()
+		err = s.publishApproved(m)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	} else if err := s.removeAttachments(m); err != nil {
+		log.Printf("[%s] Unable to remove attachment of rejected message %s: %s", v.ip, m.ID, err.Error())
+	}
+	if err := s.messageCache.DeleteHeldMessage(t.ID, id); err != nil {
+		return err
+	}
+	log.Printf("[%s] Moderation: %s message %s of topic %s", v.ip, action, id, t.ID)
+	return writeJSON(w, m)
+}
+
+// holdMessage adds an anonymous message to the moderation queue of its topic instead of publishing it, if the topic
+// is moderated. Authenticated publishers are trusted, since access control decides whether they may publish at all.
+func (s *Server) holdMessage(r *http.Request, m *message) (bool, error) {
+	if s.auth == nil || userFromRequest(r) != nil {
+		return false, nil
+	}
+	moderated, err := s.messageCache.TopicModerated(m.Topic)
+	if err != nil || !moderated {
+		return false, err
+	}
+	held, err := s.messageCache.HeldMessages(m.Topic)
+	if err != nil {
+		return false, err
+	} else if len(held) >= moderationQueueMax {
+		return false, errHTTPTooManyRequestsLimitHeldMessages
+	}
+	if err := s.messageCache.HoldMessage(m); err != nil {
+		return false, err
+	}
+	m.held = true
+	log.Printf("[%s] Message %s of topic %s held for moderation", m.senderIP, m.ID, m.Topic)
+	return true, nil
+}
+
+// publishApproved publishes a message from the moderation queue. Scheduled messages that are not due yet are only
+// added to the cache, and published by sendDelayedMessages. Must be called with s.mu held.
+func (s *Server) publishApproved(m *message) error {
+	delayed := m.Time > time.Now().Unix()
+	if !delayed {
+		m.Time = time.Now().Unix() // Subscribers polling with since=<time> would miss it otherwise
+		t := s.topics[m.Topic]     // May be nil if there are no subscribers
+		if err := s.collapseMessages(t, m); err != nil {
+			return err
+		}
+		if t != nil {
+			if err := t.Publish(m); err != nil {
+				log.Printf("unable to publish approved message %s to topic %s: %v", m.ID, m.Topic, err.Error())
+			}
+		}
+		s.publishFirehose(m)
+		go s.forwardWebhooks(m)
+		s.forwardMatrix(m)
+		go s.forwardTelegram(m)
+		if s.firebase != nil {
+			if err := s.firebase(m); err != nil {
+				log.Printf("unable to publish to Firebase: %v", err.Error())
+			}
+		}
+	}
+	if err := s.messageCache.AddMessage(m); err != nil {
+		return err
+	} else if err := s.scheduleEscalation(m); err != nil {
+		return err
+	}
+	s.messages++
+	if !delayed {
+		return s.heartbeatReceived(m)
+	}
+	return nil
+}
+
+// topicModerator returns true if the user may moderate the topic, i.e. if they own it (see topicOwner), or if they
+// reserved it. Unlike topicOwner, the latter applies even if everyone may publish to the topic, which is the usual
+// setup of a moderated topic.
+func (s *Server) topicModerator(user *auth.User, topic string) bool {
+	if s.topicOwner(user, topic) {
+		return true
+	} else if user == nil {
+		return false
+	}
+	manager, ok := s.auth.(auth.Manager)
+	if !ok {
+		return false
+	}
+	reservations, err := manager.Reservations(user.Name)
+	if err != nil {
+		log.Printf("unable to read reservations of user %s: %v", user.Name, err.Error())
+		return false
+	}
+	for _, reservation := range reservations {
+		if reservation.Topic == topic {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) writeModerationResponse(w http.ResponseWriter, topic string) error {
+	moderated, err := s.messageCache.TopicModerated(topic)
+	if err != nil {
+		return err
+	}
+	messages, err := s.messageCache.HeldMessages(topic)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &moderationResponse{Topic: topic, Moderated: moderated, Messages: messages})
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"testing"
+)
+
+func TestServer_Moderation(t *testing.T) {
+	s := newTestServerWithModeratedTopic(t)
+	phil := map[string]string{"Authorization": basicAuth("phil:phil")}
+
+	response := request(t, s, "PUT", "/community", "Hello everyone", nil)
+	require.Equal(t, 202, response.Code)
+	held := toMessage(t, response.Body.String())
+	require.Empty(t, request(t, s, "GET", "/community/json?poll=1", "", nil).Body.String())
+
+	// Only moderators see the queue
+	response = request(t, s, "GET", "/community/moderation", "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/community/moderation", "", phil)
+	require.Equal(t, 200, response.Code)
+	moderation := toModerationResponse(t, response.Body.String())
+	require.True(t, moderation.Moderated)
+	require.Len(t, moderation.Messages, 1)
+	require.Equal(t, held.ID, moderation.Messages[0].ID)
+
+	// Approved messages are published
+	response = request(t, s, "POST", "/community/moderation/"+held.ID+"/approve", "", phil)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, request(t, s, "GET", "/community/json?poll=1", "", nil).Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, "Hello everyone", messages[0].Message)
+	response = request(t, s, "POST", "/community/moderation/"+held.ID+"/approve", "", phil)
+	require.Equal(t, 404, response.Code)
+
+	// Rejected messages are dropped
+	spam := toMessage(t, request(t, s, "PUT", "/community", "Buy now", nil).Body.String())
+	response = request(t, s, "POST", "/community/moderation/"+spam.ID+"/reject", "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/community/moderation/"+spam.ID+"/reject", "", phil)
+	require.Equal(t, 200, response.Code)
+	require.Empty(t, toModerationResponse(t, request(t, s, "GET", "/community/moderation", "", phil).Body.String()).Messages)
+	require.Len(t, toMessages(t, request(t, s, "GET", "/community/json?poll=1", "", nil).Body.String()), 1)
+
+	// Authenticated publishers are not moderated
+	response = request(t, s, "PUT", "/community", "Announcement", phil)
+	require.Equal(t, 200, response.Code)
+	require.Len(t, toMessages(t, request(t, s, "GET", "/community/json?poll=1", "", nil).Body.String()), 2)
+
+	// Turning moderation off publishes anonymous messages right away
+	response = request(t, s, "PUT", "/community/moderation", `{"moderated":false}`, phil)
+	require.Equal(t, 200, response.Code)
+	require.False(t, toModerationResponse(t, response.Body.String()).Moderated)
+	response = request(t, s, "PUT", "/community", "Hi again", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_Moderation_AuthRequired(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/community/moderation", `{"moderated":true}`, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40054, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Moderation_NotModerator(t *testing.T) {
+	s := newTestServerWithModeratedTopic(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "community", true, true))
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "PUT", "/community/moderation", `{"moderated":false}`, ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/community/moderation", "", ben)
+	require.Equal(t, 403, response.Code)
+}
+
+func newTestServerWithModeratedTopic(t *testing.T) *Server {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AddReservation("phil", "community", true, true))
+	response := request(t, s, "PUT", "/community/moderation", `{"moderated":true}`, map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	return s
+}
+
+func toModerationResponse(t *testing.T, s string) *moderationResponse {
+	var response moderationResponse
+	require.Nil(t, json.Unmarshal([]byte(s), &response))
+	return &response
+}
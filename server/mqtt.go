@@ -0,0 +1,477 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The MQTT listener is a minimal MQTT 3.1.1 (and 3.1) broker for the ntfy topics: MQTT topics with the prefix
+// mqtt-topic-prefix (e.g. "ntfy/alerts") map to ntfy topics ("alerts"). Publishing to such an MQTT topic publishes
+// a message, and subscribing to it streams the topic's messages as JSON. Like the gRPC API (see grpcService), it
+// is built on internal HTTP requests, so that access control and rate limiting work exactly like for HTTP.
+//
+// Only what is needed for notifications is supported: QoS 0 subscriptions, no retained messages, no wills, no
+// persistent sessions and no wildcard subscriptions.
+
+const (
+	mqttPacketConnect     = 1
+	mqttPacketConnack     = 2
+	mqttPacketPublish     = 3
+	mqttPacketPuback      = 4
+	mqttPacketPubrec      = 5
+	mqttPacketPubrel      = 6
+	mqttPacketPubcomp     = 7
+	mqttPacketSubscribe   = 8
+	mqttPacketSuback      = 9
+	mqttPacketUnsubscribe = 10
+	mqttPacketUnsuback    = 11
+	mqttPacketPingreq     = 12
+	mqttPacketPingresp    = 13
+	mqttPacketDisconnect  = 14
+
+	mqttConnackAccepted            = 0x00
+	mqttConnackBadProtocolVersion  = 0x01
+	mqttConnackBadUsernamePassword = 0x04
+	mqttSubackFailure              = 0x80
+
+	mqttConnectTimeout = 10 * time.Second
+	mqttPacketMaxBytes = 256 * 1024 // Larger messages are turned into attachments anyway, see handlePublishBody
+)
+
+var (
+	errMQTTProtocolViolation = errors.New("protocol violation")
+	errMQTTPacketTooLarge    = errors.New("packet too large")
+)
+
+// runMQTTServer starts the MQTT listener on mqtt-listen
+func (s *Server) runMQTTServer() error {
+	listener, err := net.Listen("tcp", s.config.MQTTListen)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.mqttListener = listener
+	s.mu.Unlock()
+	return s.serveMQTT(listener)
+}
+
+func (s *Server) serveMQTT(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go s.handleMQTTConn(conn)
+	}
+}
+
+func (s *Server) handleMQTTConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background()) // Ends all subscriptions of the session
+	defer cancel()
+	defer conn.Close()
+	session := &mqttSession{
+		s:             s,
+		conn:          conn,
+		ctx:           ctx,
+		subscriptions: make(map[string]context.CancelFunc),
+	}
+	if err := session.serve(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		log.Printf("[%s] MQTT: Closing connection: %s", conn.RemoteAddr().String(), err.Error())
+	}
+}
+
+// mqttSession is a single MQTT client connection. Packets are read and handled in serve; the subscriptions
+// write to the connection from their own goroutines, which is why writes are synchronized.
+type mqttSession struct {
+	s             *Server
+	conn          net.Conn
+	ctx           context.Context
+	clientID      string
+	authorization string                        // Authorization header of the internal requests, empty if anonymous
+	subscriptions map[string]context.CancelFunc // By ntfy topic, only accessed by serve
+	mu            sync.Mutex                    // Protects writes to conn
+}
+
+func (c *mqttSession) serve() error {
+	reader := bufio.NewReader(c.conn)
+	c.conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	p, err := readMQTTPacket(reader)
+	if err != nil {
+		return err
+	} else if p.kind != mqttPacketConnect {
+		return errMQTTProtocolViolation
+	}
+	keepalive, code, err := c.connect(p)
+	if err != nil {
+		return err
+	}
+	if err := c.write(mqttPacketConnack<<4, []byte{0, code}); err != nil {
+		return err
+	} else if code != mqttConnackAccepted {
+		return nil
+	}
+	for {
+		if keepalive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(keepalive * 3 / 2)) // Grace period as in the spec
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		p, err := readMQTTPacket(reader)
+		if err != nil {
+			return err
+		}
+		switch p.kind {
+		case mqttPacketPublish:
+			err = c.handlePublish(p)
+		case mqttPacketPubrel:
+			err = c.write(mqttPacketPubcomp<<4, p.body) // Packet ID, the message was published on PUBLISH already
+		case mqttPacketSubscribe:
+			err = c.handleSubscribe(p)
+		case mqttPacketUnsubscribe:
+			err = c.handleUnsubscribe(p)
+		case mqttPacketPingreq:
+			err = c.write(mqttPacketPingresp<<4, nil)
+		case mqttPacketDisconnect:
+			return nil
+		default:
+			err = errMQTTProtocolViolation
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connect reads the CONNECT packet, and checks the credentials if there are any. Since users may also publish and
+// subscribe anonymously, missing credentials are not an error; access control is applied per topic.
+func (c *mqttSession) connect(p *mqttPacket) (keepalive time.Duration, code byte, err error) {
+	r := &mqttReader{b: p.body}
+	protocol, level, flags := r.string(), r.byte(), r.byte()
+	keepalive = time.Duration(r.uint16()) * time.Second
+	c.clientID = r.string()
+	if flags&0x04 != 0 {
+		r.string() // Will topic and message, wills are not supported
+		r.bytes()
+	}
+	var username, password string
+	if flags&0x80 != 0 {
+		username = r.string()
+	}
+	if flags&0x40 != 0 {
+		password = string(r.bytes())
+	}
+	if r.err != nil {
+		return 0, 0, r.err
+	} else if (protocol != "MQTT" || level != 4) && (protocol != "MQIsdp" || level != 3) {
+		return 0, mqttConnackBadProtocolVersion, nil
+	}
+	if username == "" && password == "" || c.s.auth == nil {
+		return keepalive, mqttConnackAccepted, nil
+	}
+	if tokenAuther, ok := c.s.auth.(auth.TokenAuther); ok && username == "" {
+		if _, err := tokenAuther.AuthenticateToken(password); err != nil {
+			log.Printf("[%s] MQTT: Invalid token for client %s", c.ip(), c.clientID)
+			return 0, mqttConnackBadUsernamePassword, nil
+		}
+		c.authorization = "Bearer " + password
+	} else {
+		if _, err := c.s.auth.Authenticate(username, password); err != nil {
+			log.Printf("[%s] MQTT: Invalid credentials for user %s", c.ip(), username)
+			return 0, mqttConnackBadUsernamePassword, nil
+		}
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+	return keepalive, mqttConnackAccepted, nil
+}
+
+// handlePublish publishes the payload of a PUBLISH packet. If the payload is a JSON object, it is interpreted like
+// a JSON publish request (see transformBodyJSON), so that devices can set the title, priority, tags, etc.; otherwise
+// the payload is the message. Errors are only logged, since MQTT 3.1.1 has no way to reject a PUBLISH.
+func (c *mqttSession) handlePublish(p *mqttPacket) error {
+	qos := (p.flags >> 1) & 0x03
+	r := &mqttReader{b: p.body}
+	mqttTopic := r.string()
+	var id []byte
+	if qos > 0 {
+		id = r.next(2)
+	}
+	payload := r.rest()
+	if r.err != nil || qos > 2 {
+		return errMQTTProtocolViolation
+	}
+	if err := c.publish(mqttTopic, payload); err != nil {
+		log.Printf("[%s] MQTT: Unable to publish to %s: %s", c.ip(), mqttTopic, err.Error())
+	}
+	if qos == 1 {
+		return c.write(mqttPacketPuback<<4, id)
+	} else if qos == 2 {
+		return c.write(mqttPacketPubrec<<4, id)
+	}
+	return nil
+}
+
+func (c *mqttSession) publish(mqttTopic string, payload []byte) error {
+	topic, ok := c.ntfyTopic(mqttTopic)
+	if !ok {
+		return errors.New("not a ntfy topic")
+	}
+	r, err := c.newRequest(http.MethodPut, "/"+topic, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	var m publishMessage
+	if bytes.HasPrefix(payload, []byte("{")) && json.Unmarshal(payload, &m) == nil {
+		m.Topic = topic
+		if err := rewritePublishRequest(r, &m); err != nil {
+			return err
+		}
+	}
+	w := newInternalResponseWriter(nil)
+	c.s.handle(w, r)
+	if w.code != http.StatusOK && w.code != http.StatusAccepted { // 202 if held for moderation
+		return errors.New(strings.TrimSpace(w.buf.String()))
+	}
+	return nil
+}
+
+func (c *mqttSession) handleSubscribe(p *mqttPacket) error {
+	if p.flags != 0x02 {
+		return errMQTTProtocolViolation
+	}
+	r := &mqttReader{b: p.body}
+	suback := append([]byte{}, r.next(2)...) // Packet ID, followed by the return codes
+	for len(r.b) > 0 && r.err == nil {
+		filter := r.string()
+		r.byte() // Requested QoS, only QoS 0 is granted
+		suback = append(suback, c.subscribe(filter))
+	}
+	if r.err != nil || len(suback) == 2 {
+		return errMQTTProtocolViolation
+	}
+	return c.write(mqttPacketSuback<<4, suback)
+}
+
+// subscribe subscribes to a ntfy topic with an internal request to its JSON stream, and returns the SUBACK return
+// code. The subscription is only granted once the stream is open, so that unauthorized subscriptions fail.
+func (c *mqttSession) subscribe(filter string) byte {
+	topic, ok := c.ntfyTopic(filter)
+	if !ok {
+		return mqttSubackFailure
+	} else if _, ok := c.subscriptions[topic]; ok {
+		return 0x00
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	r, err := c.newRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("/%s/json", topic), nil)
+	if err != nil {
+		cancel()
+		return mqttSubackFailure
+	}
+	open := make(chan bool, 2)
+	w := newInternalResponseWriter(func(m *message) error {
+		if m.Event == openEvent {
+			open <- true
+			return nil
+		} else if m.Event != messageEvent {
+			return nil
+		}
+		return c.forward(m)
+	})
+	go func() {
+		c.s.handle(w, r)
+		open <- false
+	}()
+	if !<-open {
+		cancel()
+		log.Printf("[%s] MQTT: Unable to subscribe to %s: %s", c.ip(), filter, strings.TrimSpace(w.buf.String()))
+		return mqttSubackFailure
+	}
+	c.subscriptions[topic] = cancel
+	return 0x00
+}
+
+func (c *mqttSession) handleUnsubscribe(p *mqttPacket) error {
+	if p.flags != 0x02 {
+		return errMQTTProtocolViolation
+	}
+	r := &mqttReader{b: p.body}
+	id := r.next(2)
+	for len(r.b) > 0 && r.err == nil {
+		if topic, ok := c.ntfyTopic(r.string()); ok {
+			if cancel, ok := c.subscriptions[topic]; ok {
+				cancel()
+				delete(c.subscriptions, topic)
+			}
+		}
+	}
+	if r.err != nil {
+		return errMQTTProtocolViolation
+	}
+	return c.write(mqttPacketUnsuback<<4, id)
+}
+
+// forward sends a message of a subscribed topic to the client, as JSON (the same as a line of the JSON stream)
+func (c *mqttSession) forward(m *message) error {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	body := appendMQTTString(nil, c.s.config.MQTTTopicPrefix+m.Topic)
+	return c.write(mqttPacketPublish<<4, append(body, payload...))
+}
+
+func (c *mqttSession) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	return c.newRequestWithContext(c.ctx, method, path, body)
+}
+
+func (c *mqttSession) newRequestWithContext(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, method, c.s.config.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.authorization != "" {
+		r.Header.Set("Authorization", c.authorization)
+	}
+	r.RemoteAddr = c.conn.RemoteAddr().String() // Rate limiting is done based on the IP of the MQTT client
+	return r, nil
+}
+
+// ntfyTopic returns the ntfy topic of an MQTT topic, i.e. the topic without mqtt-topic-prefix
+func (c *mqttSession) ntfyTopic(mqttTopic string) (string, bool) {
+	if !strings.HasPrefix(mqttTopic, c.s.config.MQTTTopicPrefix) {
+		return "", false
+	}
+	topic := strings.TrimPrefix(mqttTopic, c.s.config.MQTTTopicPrefix)
+	return topic, topicRegex.MatchString(topic)
+}
+
+func (c *mqttSession) write(header byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return writeMQTTPacket(c.conn, header, body)
+}
+
+func (c *mqttSession) ip() string {
+	ip, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return c.conn.RemoteAddr().String()
+	}
+	return ip
+}
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMQTTProtocolViolation
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if length > mqttPacketMaxBytes {
+		return nil, errMQTTPacketTooLarge
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &mqttPacket{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// mqttReader reads the fields of a packet body. After the first error (i.e. if the body is too short), all reads
+// return zero values, so that the error only needs to be checked once.
+type mqttReader struct {
+	b   []byte
+	err error
+}
+
+func (r *mqttReader) next(n int) []byte {
+	if r.err != nil || len(r.b) < n {
+		r.err = errMQTTProtocolViolation
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *mqttReader) byte() byte {
+	if v := r.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if v := r.next(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *mqttReader) bytes() []byte {
+	return r.next(int(r.uint16()))
+}
+
+func (r *mqttReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *mqttReader) rest() []byte {
+	return r.next(len(r.b))
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_MQTT_Publish(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	client := newTestMQTTClient(t, s)
+	require.Equal(t, byte(mqttConnackAccepted), client.connect("", ""))
+
+	// QoS 1, plain payload
+	client.publish("ntfy/mytopic", 1, []byte("Motion detected"))
+	puback := client.read()
+	require.Equal(t, byte(mqttPacketPuback), puback.kind)
+	require.Equal(t, []byte{0, 1}, puback.body)
+
+	// QoS 0, JSON payload
+	client.publish("ntfy/mytopic", 0, []byte(`{"title":"Garage","message":"Door open","priority":4,"tags":["door"]}`))
+	client.publish("not-ntfy/mytopic", 0, []byte("Ignored"))
+	client.ping()
+
+	messages := toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", nil).Body.String())
+	require.Len(t, messages, 2)
+	require.Equal(t, "Motion detected", messages[0].Message)
+	require.Equal(t, "Door open", messages[1].Message)
+	require.Equal(t, "Garage", messages[1].Title)
+	require.Equal(t, 4, messages[1].Priority)
+	require.Equal(t, []string{"door"}, messages[1].Tags)
+}
+
+func TestServer_MQTT_Subscribe(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	client := newTestMQTTClient(t, s)
+	require.Equal(t, byte(mqttConnackAccepted), client.connect("", ""))
+	require.Equal(t, []byte{0, 7, 0x00, mqttSubackFailure}, client.subscribe(7, "ntfy/mytopic", "ntfy/#"))
+
+	request(t, s, "PUT", "/mytopic", "Washing machine done", map[string]string{"Title": "Laundry"})
+	p := client.read()
+	require.Equal(t, byte(mqttPacketPublish), p.kind)
+	r := &mqttReader{b: p.body}
+	require.Equal(t, "ntfy/mytopic", r.string())
+	var m message
+	require.Nil(t, json.Unmarshal(r.rest(), &m))
+	require.Equal(t, "Washing machine done", m.Message)
+	require.Equal(t, "Laundry", m.Title)
+}
+
+func TestServer_MQTT_Auth(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "mytopic", true, true))
+
+	require.Equal(t, byte(mqttConnackBadUsernamePassword), newTestMQTTClient(t, s).connect("phil", "wrong"))
+
+	anonymous := newTestMQTTClient(t, s)
+	require.Equal(t, byte(mqttConnackAccepted), anonymous.connect("", ""))
+	require.Equal(t, []byte{0, 1, mqttSubackFailure}, anonymous.subscribe(1, "ntfy/mytopic"))
+
+	phil := newTestMQTTClient(t, s)
+	require.Equal(t, byte(mqttConnackAccepted), phil.connect("phil", "phil"))
+	require.Equal(t, []byte{0, 1, 0x00}, phil.subscribe(1, "ntfy/mytopic"))
+	phil.publish("ntfy/mytopic", 0, []byte("Authenticated"))
+	p := phil.read()
+	require.Equal(t, byte(mqttPacketPublish), p.kind)
+}
+
+type testMQTTClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestMQTTClient(t *testing.T, s *Server) *testMQTTClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go s.serveMQTT(listener)
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testMQTTClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testMQTTClient) connect(username, password string) byte {
+	body := appendMQTTString(nil, "MQTT")
+	flags := byte(0x02) // Clean session
+	if username != "" {
+		flags |= 0x80 | 0x40
+	}
+	body = append(body, 4, flags, 0, 60)
+	body = appendMQTTString(body, "test-client")
+	if username != "" {
+		body = appendMQTTString(body, username)
+		body = appendMQTTString(body, password)
+	}
+	c.write(mqttPacketConnect<<4, body)
+	connack := c.read()
+	require.Equal(c.t, byte(mqttPacketConnack), connack.kind)
+	return connack.body[1]
+}
+
+func (c *testMQTTClient) publish(topic string, qos byte, payload []byte) {
+	body := appendMQTTString(nil, topic)
+	if qos > 0 {
+		body = append(body, 0, 1)
+	}
+	c.write(mqttPacketPublish<<4|qos<<1, append(body, payload...))
+}
+
+func (c *testMQTTClient) subscribe(id byte, filters ...string) []byte {
+	body := []byte{0, id}
+	for _, filter := range filters {
+		body = append(appendMQTTString(body, filter), 0)
+	}
+	c.write(mqttPacketSubscribe<<4|0x02, body)
+	suback := c.read()
+	require.Equal(c.t, byte(mqttPacketSuback), suback.kind)
+	return suback.body
+}
+
+// ping waits for a PINGRESP, i.e. until all packets sent before have been handled
+func (c *testMQTTClient) ping() {
+	c.write(mqttPacketPingreq<<4, nil)
+	require.Equal(c.t, byte(mqttPacketPingresp), c.read().kind)
+}
+
+func (c *testMQTTClient) write(header byte, body []byte) {
+	require.Nil(c.t, writeMQTTPacket(c.conn, header, body))
+}
+
+func (c *testMQTTClient) read() *mqttPacket {
+	p, err := readMQTTPacket(c.reader)
+	require.Nil(c.t, err)
+	return p
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"io"
+	"net/http"
+)
+
+const (
+	publishBatchPath        = "/v1/publish/batch"
+	publishBatchMaxMessages = 100
+)
+
+// handlePublishBatch publishes an array of messages (in the format of the JSON publish API, see publishMessage),
+// possibly to different topics, in a single request. The batch is validated and rate limited as a unit: Either
+// all messages are published, or none are. Each message counts as one request towards the visitor's request limit,
+// and as one message towards the daily message limit.
+//
+// Messages cannot be e-mailed, and files cannot be uploaded (attachments via URL are fine), since both would have
+// to be checked and counted separately.
+func (s *Server) handlePublishBatch(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	defer r.Body.Close()
+	var batch []*publishMessage
+	limit := int64(publishBatchMaxMessages) * int64(s.config.MessageLimit+apiRequestMaxBytes)
+	if err := json.NewDecoder(io.LimitReader(r.Body, limit)).Decode(&batch); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	} else if len(batch) == 0 || len(batch) > publishBatchMaxMessages {
+		return errHTTPBadRequestBatchInvalid
+	}
+	for _, m := range batch {
+		if !topicRegex.MatchString(m.Topic) {
+			return errHTTPBadRequestTopicInvalid
+		} else if m.Email != "" || m.EmailDigest != "" || (m.Filename != "" && m.Attach == "") || len(m.Message) > s.config.MessageLimit {
+			return errHTTPBadRequestBatchInvalid
+		} else if !s.publishIPAllowed(m.Topic, v.ip) {
+			return errHTTPForbiddenPublishIP
+		}
+	}
+	if s.auth != nil {
+		user, err := s.authenticate(r)
+		if err != nil {
+			return err
+		}
+		r = withUser(r, user)
+		for _, m := range batch {
+			if err := s.authorizeTopics(r, auth.PermissionPublish, m.Topic); err != nil {
+				return err
+			}
+		}
+	}
+	requests := make([]*http.Request, 0, len(batch))
+	for _, m := range batch {
+		req, err := newBatchPublishRequest(r, m)
+		if err != nil {
+			return err
+		}
+		if _, _, _, _, _, err := s.parsePublishParams(req, v, newDefaultMessage(m.Topic, "")); err != nil {
+			return err // Validate all messages before publishing the first one
+		}
+		requests = append(requests, req)
+	}
+	if !util.InStringList(s.config.VisitorRequestExemptIPAddrs, v.ip) && len(batch) > 1 {
+		if err := v.RequestsAllowed(len(batch) - 1); err != nil { // The batch request itself was counted by limitRequests
+			return errHTTPTooManyRequestsLimitRequests
+		}
+	}
+	if err := s.messagesAllowed(r, v, len(batch)); err != nil {
+		return err
+	}
+	published := make([]*message, 0, len(requests))
+	for _, req := range requests {
+		m, err := s.publish(req, v, false)
+		if err != nil {
+			return err
+		}
+		published = append(published, m)
+	}
+	return writeJSON(w, published)
+}
+
+// newBatchPublishRequest returns a publish request for a single message of a batch. It carries the authenticated
+// user of the batch (if any), but none of its headers and query parameters, so they do not apply to all messages.
+func newBatchPublishRequest(r *http.Request, m *publishMessage) (*http.Request, error) {
+	req := r.Clone(r.Context())
+	req.Header = make(http.Header)
+	req.URL.RawQuery = ""
+	req.ContentLength = int64(len(m.Message))
+	if err := rewritePublishRequest(req, m); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServer_PublishBatch(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "POST", "/v1/publish/batch", `[
+		{"topic":"logs","message":"disk full","priority":4,"tags":["warning"]},
+		{"topic":"other-logs","title":"Backup","message":"backup done","actions":[{"action":"view","label":"Open","url":"https://example.com"}]}
+	]`, map[string]string{"X-Title": "not applied to the messages"})
+	require.Equal(t, 200, response.Code)
+	messages := toBatchMessages(t, response.Body.String())
+	require.Len(t, messages, 2)
+	require.Equal(t, "logs", messages[0].Topic)
+	require.Equal(t, "disk full", messages[0].Message)
+	require.Equal(t, "", messages[0].Title)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, []string{"warning"}, messages[0].Tags)
+	require.Equal(t, "Backup", messages[1].Title)
+	require.Len(t, messages[1].Actions, 1)
+
+	response = request(t, s, "GET", "/logs,other-logs/json?poll=1", "", nil)
+	polled := toMessages(t, response.Body.String())
+	require.Len(t, polled, 2)
+	require.Equal(t, messages[0].ID, polled[0].ID)
+	require.Equal(t, messages[1].ID, polled[1].ID)
+}
+
+func TestServer_PublishBatch_ValidatedAsUnit(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, batch := range []string{
+		`[]`,
+		`[{"topic":"logs","message":"ok"},{"topic":"invalid topic","message":"not ok"}]`,
+		`[{"topic":"logs","message":"ok"},{"topic":"logs","message":"not ok","priority":7}]`,
+		`[{"topic":"logs","message":"ok"},{"topic":"logs","message":"not ok","delay":"invalid"}]`,
+		`[{"topic":"logs","message":"ok"},{"topic":"logs","message":"not ok","email":"phil@example.com"}]`,
+		`[{"topic":"logs","message":"ok"},{"topic":"logs","message":"` + strings.Repeat("x", 5000) + `"}]`,
+		`{"topic":"logs","message":"not an array"}`,
+	} {
+		response := request(t, s, "POST", "/v1/publish/batch", batch, nil)
+		require.Equal(t, 400, response.Code, batch)
+	}
+	response := request(t, s, "GET", "/logs/json?poll=1", "", nil)
+	require.Empty(t, response.Body.String()) // Nothing was published
+}
+
+func TestServer_PublishBatch_RateLimitedAsUnit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRequestLimitBurst = 10
+	s := newTestServer(t, c)
+	batch := make([]string, 0)
+	for i := 0; i < 6; i++ {
+		batch = append(batch, fmt.Sprintf(`{"topic":"logs","message":"line %d"}`, i))
+	}
+	response := request(t, s, "POST", "/v1/publish/batch", "["+strings.Join(batch, ",")+"]", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/publish/batch", "["+strings.Join(batch, ",")+"]", nil)
+	require.Equal(t, 429, response.Code) // 4 requests left, but the batch needs 6
+	response = request(t, s, "GET", "/logs/json?poll=1", "", nil)
+	require.Len(t, toMessages(t, response.Body.String()), 6)
+}
+
+func TestServer_PublishBatch_Auth(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "logs", true, true))
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "POST", "/v1/publish/batch", `[{"topic":"logs","message":"ok"},{"topic":"secret","message":"not allowed"}]`, ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/v1/publish/batch", `[{"topic":"logs","message":"ok"}]`, nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/v1/publish/batch", `[{"topic":"logs","message":"ok"}]`, ben)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ok", toBatchMessages(t, response.Body.String())[0].Message)
+}
+
+func toBatchMessages(t *testing.T, s string) []*message {
+	var messages []*message
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&messages))
+	return messages
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	publishURLSecretMinLength = 16
+)
+
+var (
+	errPublishURLSignatureInvalid = errors.New("publish URL signature missing or invalid")
+	errPublishURLExpired          = errors.New("publish URL expired")
+)
+
+// publishURLSigner verifies pre-signed publish URLs like /mytopic?exp=1700000000&sig=..., which allow a device to
+// publish to a topic until the expiry time without holding credentials. The signature is an HMAC-SHA256 of the topic,
+// the user and the expiry time, keyed with the secret of the topic, or (if the URL has a user param) of the user.
+// A URL signed with a topic secret may publish to the topic regardless of the access control list; a URL signed
+// with a user secret publishes as that user, with its permissions.
+type publishURLSigner struct {
+	topicSecrets map[string][]byte
+	userSecrets  map[string][]byte
+}
+
+// newPublishURLSigner parses the secrets, in the format topic:<topic>:<secret> or user:<username>:<secret>
+func newPublishURLSigner(entries []string) (*publishURLSigner, error) {
+	s := &publishURLSigner{
+		topicSecrets: make(map[string][]byte),
+		userSecrets:  make(map[string][]byte),
+	}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid publish URL secret %s, expected format topic:<topic>:<secret> or user:<username>:<secret>", entry)
+		}
+		kind, name, secret := parts[0], parts[1], parts[2]
+		if len(secret) < publishURLSecretMinLength {
+			return nil, fmt.Errorf("invalid publish URL secret for %s %s: secret must be at least %d characters", kind, name, publishURLSecretMinLength)
+		}
+		switch kind {
+		case "topic":
+			if !auth.AllowedTopic(name) {
+				return nil, fmt.Errorf("invalid publish URL secret %s: invalid topic %s", entry, name)
+			}
+			s.topicSecrets[name] = []byte(secret)
+		case "user":
+			if !auth.AllowedUsername(name) {
+				return nil, fmt.Errorf("invalid publish URL secret %s: invalid username %s", entry, name)
+			}
+			s.userSecrets[name] = []byte(secret)
+		default:
+			return nil, fmt.Errorf("invalid publish URL secret %s, expected format topic:<topic>:<secret> or user:<username>:<secret>", entry)
+		}
+	}
+	return s, nil
+}
+
+// verify checks the signature and expiry time in the query of a publish URL, and returns the user it was
+// signed for, or an empty string if it was signed with the secret of the topic
+func (s *publishURLSigner) verify(topic string, query url.Values) (string, error) {
+	username, signature := query.Get("user"), query.Get("sig")
+	expires, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	if err != nil || signature == "" {
+		return "", errPublishURLSignatureInvalid
+	}
+	secret, ok := s.topicSecrets[topic]
+	if username != "" {
+		secret, ok = s.userSecrets[username]
+	}
+	if !ok || !hmac.Equal([]byte(signature), []byte(s.signature(secret, topic, username, expires))) {
+		return "", errPublishURLSignatureInvalid
+	} else if time.Now().Unix() > expires {
+		return "", errPublishURLExpired
+	}
+	return username, nil
+}
+
+func (s *publishURLSigner) signature(secret []byte, topic, username string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(fmt.Sprintf("%s\n%s\n%d", topic, username, expires)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPublishURLSigner_Verify(t *testing.T) {
+	s, err := newPublishURLSigner([]string{"topic:sensors:topicsecret123456", "user:phil:philsecret123456"})
+	require.Nil(t, err)
+	expires := time.Now().Add(time.Hour).Unix()
+
+	username, err := s.verify("sensors", signTestPublishURL("topicsecret123456", "sensors", "", expires))
+	require.Nil(t, err)
+	require.Equal(t, "", username)
+	username, err = s.verify("anytopic", signTestPublishURL("philsecret123456", "anytopic", "phil", expires))
+	require.Nil(t, err)
+	require.Equal(t, "phil", username)
+
+	_, err = s.verify("othertopic", signTestPublishURL("topicsecret123456", "sensors", "", expires)) // Different topic
+	require.Equal(t, errPublishURLSignatureInvalid, err)
+	_, err = s.verify("sensors", signTestPublishURL("wrongsecret123456", "sensors", "", expires))
+	require.Equal(t, errPublishURLSignatureInvalid, err)
+	_, err = s.verify("sensors", url.Values{})
+	require.Equal(t, errPublishURLSignatureInvalid, err)
+
+	tampered := signTestPublishURL("topicsecret123456", "sensors", "", expires)
+	tampered.Set("exp", "9999999999")
+	_, err = s.verify("sensors", tampered)
+	require.Equal(t, errPublishURLSignatureInvalid, err)
+	tampered = signTestPublishURL("philsecret123456", "sensors", "phil", expires)
+	tampered.Del("user") // Signature is not valid for the topic secret
+	_, err = s.verify("sensors", tampered)
+	require.Equal(t, errPublishURLSignatureInvalid, err)
+
+	_, err = s.verify("sensors", signTestPublishURL("topicsecret123456", "sensors", "", time.Now().Add(-time.Minute).Unix()))
+	require.Equal(t, errPublishURLExpired, err)
+}
+
+func TestNewPublishURLSigner_Invalid(t *testing.T) {
+	for _, entry := range []string{
+		"sensors:topicsecret123456",
+		"group:devs:topicsecret123456",
+		"topic:sensors:short",
+		"topic:my/topic:topicsecret123456",
+		"user:*:philsecret123456",
+	} {
+		_, err := newPublishURLSigner([]string{entry})
+		require.Error(t, err, entry)
+	}
+}
+
+func TestServer_PublishURL_Signed(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	c.PublishURLSecrets = []string{"topic:sensors:topicsecret123456", "user:ben:bensecret1234567", "user:phil:philsecret123456"}
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "bentopic", false, true))
+	expires := time.Now().Add(time.Hour).Unix()
+
+	response := request(t, s, "PUT", "/sensors", "21.5", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/sensors?"+signTestPublishURL("topicsecret123456", "sensors", "", expires).Encode(), "21.5", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/sensors/publish?message=21.5&"+signTestPublishURL("topicsecret123456", "sensors", "", expires).Encode(), "", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/bentopic?"+signTestPublishURL("bensecret1234567", "bentopic", "ben", expires).Encode(), "hi", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/sensors?"+signTestPublishURL("bensecret1234567", "sensors", "ben", expires).Encode(), "hi", nil)
+	require.Equal(t, 403, response.Code) // Ben cannot publish to sensors
+	require.Equal(t, 40301, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/bentopic?"+signTestPublishURL("philsecret123456", "bentopic", "phil", expires).Encode(), "hi", nil)
+	require.Equal(t, 403, response.Code) // User phil does not exist
+	require.Equal(t, 40303, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/sensors?"+signTestPublishURL("topicsecret123456", "sensors", "", time.Now().Add(-time.Minute).Unix()).Encode(), "21.5", nil)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40303, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "DELETE", "/sensors?"+signTestPublishURL("topicsecret123456", "sensors", "", expires).Encode(), "", nil)
+	require.Equal(t, 403, response.Code) // Signed URLs can only be used to publish
+}
+
+func signTestPublishURL(secret, topic, username string, expires int64) url.Values {
+	s := &publishURLSigner{}
+	query := url.Values{}
+	if username != "" {
+		query.Set("user", username)
+	}
+	query.Set("exp", fmt.Sprintf("%d", expires))
+	query.Set("sig", s.signature([]byte(secret), topic, username, expires))
+	return query
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/util"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	userQuietHoursPath        = "/user/quiet-hours"
+	quietHoursDefaultPriority = 4        // Only high and urgent messages are delivered during quiet hours by default
+	quietHoursHeldMax         = 100      // Per subscription, older messages are dropped from the digest (they are still cached)
+	quietHoursPushPriority    = 2        // Pushes below the threshold are sent with low priority, i.e. without sound or vibration
+	quietHoursTopicPrefix     = "topic:" // Quiet hours of a topic are stored like those of a user (usernames can't contain ':')
+)
+
+var (
+	quietHoursTimeRegex      = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):([0-5][0-9])$`)
+	topicQuietHoursPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/quiet-hours$`)
+)
+
+// handleUserQuietHours returns the quiet hours of the user, e.g. {"start":"22:00","end":"07:00","timezone":"Europe/Berlin"}.
+// If the user has not set any, start and end are empty.
+func (s *Server) handleUserQuietHours(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	_, user := s.userManager(r)
+	q, err := s.messageCache.QuietHours(user.Name)
+	if err != nil {
+		return err
+	} else if q == nil {
+		q = &quietHours{}
+	}
+	return writeJSON(w, q)
+}
+
+// handleUserQuietHoursUpdate sets the quiet hours of the user, which apply to all subscriptions of the user that
+// don't pass their own quiet hours, see subscribeQuietHours
+func (s *Server) handleUserQuietHoursUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	_, user := s.userManager(r)
+	var q quietHours
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&q); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	if _, err := newQuietHoursWindow(&q); err != nil {
+		return wrapErrHTTP(errHTTPBadRequestQuietHoursInvalid, err.Error())
+	}
+	if err := s.messageCache.UpdateQuietHours(user.Name, &q); err != nil {
+		return err
+	}
+	log.Printf("[%s] User %s set quiet hours %s-%s", v.ip, user.Name, q.Start, q.End)
+	return writeJSON(w, &q)
+}
+
+// handleUserQuietHoursDelete removes the quiet hours of the user
+func (s *Server) handleUserQuietHoursDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	_, user := s.userManager(r)
+	if err := s.messageCache.DeleteQuietHours(user.Name); err != nil {
+		return err
+	}
+	return writeJSON(w, map[string]bool{"success": true})
+}
+
+// handleTopicQuietHours returns the quiet hours of a topic, which apply to its push notifications, see withQuietHours.
+// If none were set, start and end are empty.
+func (s *Server) handleTopicQuietHours(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	q, err := s.messageCache.QuietHours(quietHoursTopicPrefix + t.ID)
+	if err != nil {
+		return err
+	} else if q == nil {
+		q = &quietHours{}
+	}
+	return writeJSON(w, q)
+}
+
+// handleTopicQuietHoursUpdate sets the quiet hours of a topic. Only owners of the topic may do this (the route only
+// exists if access control is enabled). Passing no start and end removes the quiet hours.
+func (s *Server) handleTopicQuietHoursUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	var q quietHours
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&q); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	if q.Start == "" && q.End == "" {
+		if err := s.messageCache.DeleteQuietHours(quietHoursTopicPrefix + t.ID); err != nil {
+			return err
+		}
+		return writeJSON(w, &quietHours{})
+	} else if _, err := newQuietHoursWindow(&q); err != nil {
+		return wrapErrHTTP(errHTTPBadRequestQuietHoursInvalid, err.Error())
+	}
+	if err := s.messageCache.UpdateQuietHours(quietHoursTopicPrefix+t.ID, &q); err != nil {
+		return err
+	}
+	log.Printf("[%s] Set quiet hours %s-%s of topic %s", v.ip, q.Start, q.End, t.ID)
+	return writeJSON(w, &q)
+}
+
+// withQuietHours returns a subscriber that lowers the priority of push notifications (Firebase and APNs) below the
+// threshold of the topic's quiet hours while they are active, so that they don't wake up phones. Unlike for
+// subscriptions, nothing is held back: the notification is still delivered, just silently. See also sendAPNS, which
+// applies the quiet hours of the user that registered a device.
+func (s *Server) withQuietHours(push subscriber) subscriber {
+	return func(m *message) error {
+		quiet, err := s.quietPush(quietHoursTopicPrefix+m.Topic, m)
+		if err != nil {
+			log.Printf("unable to read quiet hours of topic %s: %v", m.Topic, err.Error())
+		} else if quiet {
+			m = newQuietPushMessage(m)
+		}
+		return push(m)
+	}
+}
+
+// quietPush returns true if the quiet hours stored under the key (a user, or a topic with quietHoursTopicPrefix) are
+// active, and the message is a notification below their threshold
+func (s *Server) quietPush(key string, m *message) (bool, error) {
+	if m.Event != messageEvent && m.Event != messageUpdatedEvent {
+		return false, nil
+	}
+	q, err := s.messageCache.QuietHours(key)
+	if err != nil || q == nil {
+		return false, err
+	}
+	window, err := newQuietHoursWindow(q)
+	if err != nil {
+		return false, err
+	}
+	return window.holds(m, time.Now()), nil
+}
+
+// newQuietPushMessage returns a copy of the message with quietHoursPushPriority, unless its priority is lower already
+func newQuietPushMessage(m *message) *message {
+	quiet := *m
+	if quiet.Priority == 0 || quiet.Priority > quietHoursPushPriority {
+		quiet.Priority = quietHoursPushPriority
+	}
+	return &quiet
+}
+
+// subscribeQuietHours returns the quiet hours of a subscription, or nil if there are none. They can be passed
+// when subscribing (e.g. quiet-hours=22:00-07:00, to set them per device), and otherwise default to the quiet hours
+// of the user, see handleUserQuietHoursUpdate. Passing quiet-hours=off ignores the quiet hours of the user.
+// Polling requests return right away, so nothing is ever held for them. Push notifications are handled by
+// withQuietHours and sendAPNS.
+func (s *Server) subscribeQuietHours(r *http.Request, poll bool) (*quietHoursBuffer, error) {
+	if poll {
+		return nil, nil
+	}
+	var q *quietHours
+	var err error
+	if param := readParam(r, "x-quiet-hours", "quiet-hours", "quiet"); param == "off" {
+		return nil, nil
+	} else if param != "" {
+		window := strings.Split(param, "-")
+		if len(window) != 2 {
+			return nil, errHTTPBadRequestQuietHoursInvalid
+		}
+		q = &quietHours{Start: window[0], End: window[1], Timezone: readParam(r, "x-quiet-timezone", "quiet-timezone", "quiet-tz")}
+		if q.Priority, err = util.ParsePriority(readParam(r, "x-quiet-priority", "quiet-priority")); err != nil {
+			return nil, errHTTPBadRequestQuietHoursInvalid
+		}
+	} else if user := userFromRequest(r); user != nil {
+		if q, err = s.messageCache.QuietHours(user.Name); err != nil || q == nil {
+			return nil, err
+		}
+	} else {
+		return nil, nil
+	}
+	window, err := newQuietHoursWindow(q)
+	if err != nil {
+		return nil, wrapErrHTTP(errHTTPBadRequestQuietHoursInvalid, err.Error())
+	}
+	return &quietHoursBuffer{window: window}, nil
+}
+
+// quietHoursWindow is the parsed form of quietHours
+type quietHoursWindow struct {
+	start    int // Minutes after midnight
+	end      int
+	location *time.Location
+	priority int
+}
+
+func newQuietHoursWindow(q *quietHours) (*quietHoursWindow, error) {
+	start, err := parseQuietHoursTime(q.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseQuietHoursTime(q.End)
+	if err != nil {
+		return nil, err
+	} else if start == end {
+		return nil, errors.New("start and end must differ")
+	}
+	location, err := recurringLocation(q.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %s", q.Timezone)
+	}
+	priority := q.Priority
+	if priority == 0 {
+		priority = quietHoursDefaultPriority
+	} else if priority < 1 || priority > 5 {
+		return nil, errors.New("priority must be between 1 and 5")
+	}
+	return &quietHoursWindow{start: start, end: end, location: location, priority: priority}, nil
+}
+
+// holds returns true if the message is below the priority of the window, and the window is active at the given time
+func (w *quietHoursWindow) holds(m *message, now time.Time) bool {
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3
+	}
+	return priority < w.priority && w.active(now)
+}
+
+// active returns true if the given time is within the window. Windows that end before they start (e.g. 22:00-07:00)
+// span midnight.
+func (w *quietHoursWindow) active(now time.Time) bool {
+	local := now.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+func parseQuietHoursTime(s string) (int, error) {
+	matches := quietHoursTimeRegex.FindStringSubmatch(s)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid time %s, expected HH:MM", s)
+	}
+	hour, _ := strconv.Atoi(matches[1])
+	minute, _ := strconv.Atoi(matches[2])
+	return hour*60 + minute, nil
+}
+
+// quietHoursBuffer holds back the messages of a subscription during quiet hours. All methods may be called on a
+// nil buffer, in which case nothing is held.
+type quietHoursBuffer struct {
+	window *quietHoursWindow
+	held   []*message
+	mu     sync.Mutex
+}
+
+// Hold returns true if the message is held back, i.e. if it is below the priority of the quiet hours, and the
+// quiet hours are active. Other events (open, keepalive, ...) are never held.
+func (b *quietHoursBuffer) Hold(m *message) bool {
+	if b == nil || m.Event != messageEvent || !b.window.holds(m, time.Now()) {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.held = append(b.held, m)
+	if len(b.held) > quietHoursHeldMax {
+		b.held = b.held[1:]
+	}
+	return true
+}
+
+// Flush sends the held messages once the quiet hours are over, as one digest per topic, see newQuietHoursDigestMessage.
+// It is called with every keepalive, so the digest arrives at most one keepalive interval after the quiet hours end.
+func (b *quietHoursBuffer) Flush(now time.Time, send subscriber) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	if len(b.held) == 0 || b.window.active(now) {
+		b.mu.Unlock()
+		return nil
+	}
+	held := b.held
+	b.held = nil
+	b.mu.Unlock()
+	topics := make([]string, 0)
+	messages := make(map[string][]*message)
+	for _, m := range held {
+		if _, ok := messages[m.Topic]; !ok {
+			topics = append(topics, m.Topic)
+		}
+		messages[m.Topic] = append(messages[m.Topic], m)
+	}
+	for _, topic := range topics {
+		if err := send(newQuietHoursDigestMessage(topic, messages[topic])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newQuietHoursDigestMessage combines the held messages of a topic like an e-mail digest. The digest takes the ID
+// and time of the last held message, so that clients reconnecting with since=<id> don't receive the messages again.
+func newQuietHoursDigestMessage(topic string, messages []*message) *message {
+	m := newEmailDigestMessage(&emailDigest{Topic: topic, Messages: messages})
+	if len(messages) > 1 {
+		last := messages[len(messages)-1]
+		m.ID = last.ID
+		m.Time = last.Time
+		m.Title = fmt.Sprintf("%d messages in %s during quiet hours", len(messages), topic)
+	}
+	return m
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_QuietHours_Subscribe(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/alerts/json?quiet-hours="+quietHoursAround(time.Now())+"&quiet-tz=UTC", rr)
+	request(t, s, "PUT", "/alerts", "Backup done", nil)
+	request(t, s, "PUT", "/alerts", "Disk full", map[string]string{"Priority": "high"})
+	request(t, s, "PUT", "/alerts", "Low battery", map[string]string{"Priority": "low"})
+	cancel()
+	messages := toMessages(t, rr.Body.String())
+	require.Len(t, messages, 2)
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "Disk full", messages[1].Message)
+
+	// Polling is not affected
+	response := request(t, s, "GET", "/alerts/json?poll=1&quiet-hours="+quietHoursAround(time.Now())+"&quiet-tz=UTC", "", nil)
+	require.Len(t, toMessages(t, response.Body.String()), 3)
+}
+
+func TestServer_QuietHours_Flush(t *testing.T) {
+	now := time.Now()
+	window, err := newQuietHoursWindow(&quietHours{Start: now.Add(-time.Hour).UTC().Format("15:04"), End: now.Add(time.Hour).UTC().Format("15:04"), Timezone: "UTC"})
+	require.Nil(t, err)
+	b := &quietHoursBuffer{window: window}
+	m1, m2, m3 := newDefaultMessage("alerts", "Backup done"), newDefaultMessage("alerts", "Backup done again"), newDefaultMessage("news", "Weather")
+	urgent := newDefaultMessage("alerts", "Disk full")
+	urgent.Priority = 5
+	require.True(t, b.Hold(m1))
+	require.True(t, b.Hold(m2))
+	require.True(t, b.Hold(m3))
+	require.False(t, b.Hold(urgent))
+	require.False(t, b.Hold(newKeepaliveMessage("alerts")))
+
+	sent := make([]*message, 0)
+	send := func(m *message) error {
+		sent = append(sent, m)
+		return nil
+	}
+	require.Nil(t, b.Flush(now, send)) // Still quiet
+	require.Empty(t, sent)
+	require.Nil(t, b.Flush(now.Add(2*time.Hour), send))
+	require.Len(t, sent, 2)
+	require.Equal(t, m2.ID, sent[0].ID)
+	require.Equal(t, "2 messages in alerts during quiet hours", sent[0].Title)
+	require.Contains(t, sent[0].Message, "Backup done again")
+	require.Equal(t, m3, sent[1]) // Single message is sent as is
+	require.Nil(t, b.Flush(now.Add(2*time.Hour), send))
+	require.Len(t, sent, 2)
+
+	var nilBuffer *quietHoursBuffer
+	require.False(t, nilBuffer.Hold(m1))
+	require.Nil(t, nilBuffer.Flush(now, send))
+}
+
+func TestServer_QuietHours_Window(t *testing.T) {
+	window, err := newQuietHoursWindow(&quietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Berlin"})
+	require.Nil(t, err)
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	require.True(t, window.active(time.Date(2022, 3, 1, 23, 30, 0, 0, berlin)))
+	require.True(t, window.active(time.Date(2022, 3, 1, 6, 59, 0, 0, berlin)))
+	require.False(t, window.active(time.Date(2022, 3, 1, 7, 0, 0, 0, berlin)))
+	require.True(t, window.active(time.Date(2022, 3, 1, 21, 0, 0, 0, time.UTC))) // 22:00 in Berlin
+	require.False(t, window.active(time.Date(2022, 3, 1, 20, 59, 0, 0, time.UTC)))
+	require.Equal(t, quietHoursDefaultPriority, window.priority)
+
+	window, err = newQuietHoursWindow(&quietHours{Start: "9:00", End: "17:30", Priority: 3})
+	require.Nil(t, err)
+	require.True(t, window.active(time.Date(2022, 3, 1, 12, 0, 0, 0, time.Local)))
+	require.False(t, window.active(time.Date(2022, 3, 1, 18, 0, 0, 0, time.Local)))
+}
+
+func TestServer_QuietHours_User(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 0)
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+	response := request(t, s, "GET", "/user/quiet-hours", "", ben)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "", toQuietHours(t, response.Body.String()).Start)
+
+	response = request(t, s, "PUT", "/user/quiet-hours", fmt.Sprintf(`{"start":"%s","end":"%s","timezone":"UTC"}`, time.Now().Add(-time.Hour).UTC().Format("15:04"), time.Now().Add(time.Hour).UTC().Format("15:04")), ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/user/quiet-hours", "", ben)
+	require.Equal(t, "UTC", toQuietHours(t, response.Body.String()).Timezone)
+
+	auth := base64.RawURLEncoding.EncodeToString([]byte(basicAuth("ben:ben")))
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/alerts/json?auth="+auth, rr)
+	rrOff := httptest.NewRecorder()
+	cancelOff := subscribe(t, s, "/alerts/json?quiet-hours=off&auth="+auth, rrOff)
+	var topic *topic
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		topic = s.topics["alerts"]
+		return topic != nil && topic.Subscribers() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	delivered := make(chan bool, 1)
+	topic.Subscribe(func(m *message) error {
+		delivered <- true
+		return nil
+	})
+	pushed := make(chan *message, 1)
+	s.firebase = func(m *message) error {
+		pushed <- m
+		return nil
+	}
+	request(t, s, "PUT", "/alerts", "Backup done", nil)
+	<-delivered
+	topic.Subscribers()                                 // Waits until the message was passed to all subscribers, see topic.Publish
+	require.Equal(t, "Backup done", (<-pushed).Message) // Push notifications are not held
+	cancel()
+	cancelOff()
+	require.Len(t, toMessages(t, rr.Body.String()), 1) // Only the open message
+	require.Len(t, toMessages(t, rrOff.Body.String()), 2)
+
+	response = request(t, s, "DELETE", "/user/quiet-hours", "", ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/user/quiet-hours", "", ben)
+	require.Equal(t, "", toQuietHours(t, response.Body.String()).Start)
+	response = request(t, s, "GET", "/user/quiet-hours", "", nil)
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_QuietHours_TopicPush(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts")
+	response := request(t, s, "GET", "/alerts/quiet-hours", "", phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "", toQuietHours(t, response.Body.String()).Start)
+	window := strings.Split(quietHoursAround(time.Now()), "-")
+	body := fmt.Sprintf(`{"start":"%s","end":"%s","timezone":"UTC"}`, window[0], window[1])
+	response = request(t, s, "PUT", "/alerts/quiet-hours", body, nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/alerts/quiet-hours", body, phil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/alerts/quiet-hours", `{"start":"22:00"}`, phil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40048, toHTTPError(t, response.Body.String()).Code)
+
+	pushed := make(chan *message, 10)
+	s.firebase = s.withQuietHours(func(m *message) error {
+		pushed <- m
+		return nil
+	})
+	request(t, s, "PUT", "/alerts", "Backup done", phil)
+	require.Equal(t, quietHoursPushPriority, (<-pushed).Priority) // Pushed silently
+	request(t, s, "PUT", "/alerts", "Disk full", map[string]string{"Priority": "high", "Authorization": phil["Authorization"]})
+	require.Equal(t, 4, (<-pushed).Priority)
+	request(t, s, "PUT", "/alerts", "Low battery", map[string]string{"Priority": "min", "Authorization": phil["Authorization"]})
+	require.Equal(t, 1, (<-pushed).Priority)
+
+	response = request(t, s, "PUT", "/alerts/quiet-hours", `{}`, phil)
+	require.Equal(t, 200, response.Code)
+	request(t, s, "PUT", "/alerts", "Backup done again", phil)
+	require.Equal(t, 0, (<-pushed).Priority)
+
+	s = newTestServer(t, newTestConfig(t)) // Quiet hours of topics require access control
+	require.Equal(t, 404, request(t, s, "GET", "/alerts/quiet-hours", "", nil).Code)
+}
+
+func TestServer_QuietHours_Invalid(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 0)
+	for _, body := range []string{
+		`{"start":"22:00"}`,
+		`{"start":"24:00","end":"07:00"}`,
+		`{"start":"22:00","end":"22:00"}`,
+		`{"start":"22:00","end":"07:00","timezone":"Mars/Olympus_Mons"}`,
+		`{"start":"22:00","end":"07:00","priority":6}`,
+	} {
+		response := request(t, s, "PUT", "/user/quiet-hours", body, map[string]string{"Authorization": basicAuth("ben:ben")})
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40048, toHTTPError(t, response.Body.String()).Code, body)
+	}
+	for _, query := range []string{"quiet-hours=22:00", "quiet-hours=22:00-07:00&quiet-priority=extreme"} {
+		response := request(t, s, "GET", "/alerts/json?"+query, "", nil)
+		require.Equal(t, 400, response.Code, query)
+		require.Equal(t, 40048, toHTTPError(t, response.Body.String()).Code, query)
+	}
+}
+
+// quietHoursAround returns quiet hours from an hour before until an hour after the given time, in UTC
+func quietHoursAround(now time.Time) string {
+	return now.Add(-time.Hour).UTC().Format("15:04") + "-" + now.Add(time.Hour).UTC().Format("15:04")
+}
+
+func toQuietHours(t *testing.T, s string) *quietHours {
+	var q quietHours
+	require.Nil(t, json.Unmarshal([]byte(s), &q))
+	return &q
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/ntfy/util"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const (
+	recurringMessagesMaxPerTopic = 10
+)
+
+var (
+	recurringPathRegex    = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/recurring$`)
+	recurringMsgPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/recurring/([A-Za-z0-9]{12})$`)
+)
+
+// handleRecurringAdd creates a recurring message, e.g. {"cron":"0 9 * * 1-5","timezone":"Europe/Berlin","message":"Backup reminder"},
+// which is published whenever the cron expression matches, see sendRecurringMessages. Unlike X-Delay, which publishes
+// a message once, the recurring message is kept in the message cache until it is deleted.
+func (s *Server) handleRecurringAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	} else if !s.publishIPAllowed(t.ID, v.ip) {
+		return errHTTPForbiddenPublishIP
+	}
+	var req recurringMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, int64(s.config.MessageLimit+apiRequestMaxBytes))).Decode(&req); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	schedule, err := util.ParseCron(req.Cron)
+	if err != nil {
+		return wrapErrHTTP(errHTTPBadRequestRecurringInvalid, err.Error())
+	}
+	location, err := recurringLocation(req.Timezone)
+	if err != nil {
+		return wrapErrHTTP(errHTTPBadRequestRecurringInvalid, "unknown time zone %s", req.Timezone)
+	} else if req.Message == "" || len(req.Message) > s.config.MessageLimit || req.Priority < 0 || req.Priority > 5 {
+		return errHTTPBadRequestRecurringInvalid
+	}
+	if len(req.Actions) > 0 {
+		actionsStr, err := json.Marshal(req.Actions)
+		if err != nil {
+			return err
+		}
+		if req.Actions, err = parseActions(string(actionsStr)); err != nil {
+			return wrapErrHTTP(errHTTPBadRequestActionsInvalid, err.Error())
+		}
+	}
+	next := schedule.Next(time.Now().In(location))
+	if next.IsZero() {
+		return wrapErrHTTP(errHTTPBadRequestRecurringInvalid, "cron expression %s never matches", req.Cron)
+	}
+	existing, err := s.messageCache.RecurringMessages(t.ID)
+	if err != nil {
+		return err
+	} else if len(existing) >= recurringMessagesMaxPerTopic {
+		return errHTTPTooManyRequestsLimitRecurringMessages
+	}
+	m := &req
+	m.ID = util.RandomString(messageIDLength)
+	m.Topic = t.ID
+	m.Next = next.Unix()
+	m.senderIP = v.ip
+	if user := userFromRequest(r); user != nil {
+		m.senderUser = user.Name
+	}
+	if err := s.messageCache.AddRecurringMessage(m); err != nil {
+		return err
+	}
+	log.Printf("[%s] Added recurring message %s to topic %s (%s), next message at %s", v.ip, m.ID, m.Topic, m.Cron, next.Format(time.RFC3339))
+	return writeJSON(w, m)
+}
+
+// handleRecurringList returns the recurring messages of a topic as JSON array
+func (s *Server) handleRecurringList(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	recurring, err := s.messageCache.RecurringMessages(t.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, recurring)
+}
+
+// handleRecurringDelete removes a recurring message. The same rules as for handleDelete apply: only its creator
+// and the owners of the topic may do this. Messages that were already published are not deleted.
+func (s *Server) handleRecurringDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	id := recurringMsgPathRegex.FindStringSubmatch(r.URL.Path)[1]
+	recurring, err := s.messageCache.RecurringMessages(t.ID)
+	if err != nil {
+		return err
+	}
+	for _, m := range recurring {
+		if m.ID != id {
+			continue
+		} else if !s.modifyAllowed(r, v, &message{Topic: m.Topic, senderIP: m.senderIP, senderUser: m.senderUser}) {
+			return errHTTPForbidden
+		}
+		if err := s.messageCache.DeleteRecurringMessage(t.ID, id); err != nil {
+			return err
+		}
+		log.Printf("[%s] Deleted recurring message %s from topic %s", v.ip, id, t.ID)
+		return writeJSON(w, m)
+	}
+	return errHTTPNotFoundRecurringMessage
+}
+
+// deleteRecurringMessages removes all recurring messages of a topic, e.g. when the account that reserved it is deleted
+func (s *Server) deleteRecurringMessages(topic string) error {
+	recurring, err := s.messageCache.RecurringMessages(topic)
+	if err != nil {
+		return err
+	}
+	for _, m := range recurring {
+		if err := s.messageCache.DeleteRecurringMessage(topic, m.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendRecurringMessages publishes all recurring messages that are due, just like sendDelayedMessages does for
+// scheduled messages. The next run is calculated from the current time, so runs that were missed while the server
+// was down are skipped, rather than published all at once.
+func (s *Server) sendRecurringMessages() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	recurring, err := s.messageCache.RecurringMessagesDue()
+	if err != nil {
+		return err
+	}
+	for _, r := range recurring {
+		m := newRecurringMessage(r)
+		if t, ok := s.topics[m.Topic]; ok {
+			if err := t.Publish(m); err != nil {
+				log.Printf("unable to publish recurring message %s to topic %s: %v", r.ID, r.Topic, err.Error())
+			}
+		}
+		s.publishFirehose(m)
+		go s.forwardWebhooks(m)
+		s.forwardMatrix(m)
+		go s.forwardTelegram(m)
+		if s.firebase != nil {
+			if err := s.firebase(m); err != nil {
+				log.Printf("unable to publish to Firebase: %v", err.Error())
+			}
+		}
+		if err := s.messageCache.AddMessage(m); err != nil {
+			return err
+		}
+		s.messages++
+		next, err := recurringMessageNext(r, time.Now())
+		if err != nil {
+			log.Printf("unable to schedule recurring message %s of topic %s, deleting it: %v", r.ID, r.Topic, err.Error())
+			if err := s.messageCache.DeleteRecurringMessage(r.Topic, r.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		r.Next = next.Unix()
+		if err := s.messageCache.UpdateRecurringMessage(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newRecurringMessage creates the message that is published for a run of the recurring message
+func newRecurringMessage(r *recurringMessage) *message {
+	m := newDefaultMessage(r.Topic, r.Message)
+	m.Title = r.Title
+	m.Priority = r.Priority
+	m.Tags = r.Tags
+	m.Click = r.Click
+	m.Actions = r.Actions
+	m.senderIP = r.senderIP
+	m.senderUser = r.senderUser
+	return m
+}
+
+// recurringMessageNext returns the time of the first run after the given time, in the time zone of the recurring message
+func recurringMessageNext(r *recurringMessage, after time.Time) (time.Time, error) {
+	schedule, err := util.ParseCron(r.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	location, err := recurringLocation(r.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := schedule.Next(after.In(location))
+	if next.IsZero() {
+		return time.Time{}, errHTTPBadRequestRecurringInvalid
+	}
+	return next, nil
+}
+
+// recurringLocation returns the time zone with the given IANA name, or the server time zone if the name is empty
+func recurringLocation(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(timezone)
+}
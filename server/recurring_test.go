@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_Recurring_AddListDelete(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "POST", "/backups/recurring", `{"cron":"0 9 * * *","timezone":"Europe/Berlin","title":"Backup","message":"Time to run the backup","tags":["floppy_disk"],"priority":4}`, nil)
+	require.Equal(t, 200, response.Code)
+	r := toRecurringMessage(t, response.Body.String())
+	require.Len(t, r.ID, 12)
+	require.Equal(t, "backups", r.Topic)
+	require.Equal(t, "Time to run the backup", r.Message)
+	next := time.Unix(r.Next, 0).In(mustLoadLocation(t, "Europe/Berlin"))
+	require.True(t, next.After(time.Now()))
+	require.Equal(t, 9, next.Hour())
+	require.Equal(t, 0, next.Minute())
+
+	response = request(t, s, "GET", "/backups/recurring", "", nil)
+	require.Equal(t, 200, response.Code)
+	var recurring []*recurringMessage
+	require.Nil(t, json.Unmarshal(response.Body.Bytes(), &recurring))
+	require.Len(t, recurring, 1)
+	require.Equal(t, r.ID, recurring[0].ID)
+	require.Equal(t, []string{"floppy_disk"}, recurring[0].Tags)
+
+	response = request(t, s, "DELETE", "/backups/recurring/"+r.ID, "", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/backups/recurring/"+r.ID, "", nil)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40408, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/backups/recurring", "", nil)
+	require.Equal(t, "[]", response.Body.String()[:2])
+}
+
+func TestServer_Recurring_Send(t *testing.T) {
+	c := newTestConfig(t)
+	s := newTestServer(t, c)
+	response := request(t, s, "POST", "/backups/recurring", `{"cron":"@daily","message":"Time to run the backup","actions":[{"action":"view","label":"Open","url":"https://backup.example.com"}]}`, nil)
+	require.Equal(t, 200, response.Code)
+	r := toRecurringMessage(t, response.Body.String())
+	r.Next = time.Now().Add(-time.Minute).Unix() // Pretend the run is due
+	require.Nil(t, s.messageCache.UpdateRecurringMessage(r))
+
+	require.Nil(t, s.sendRecurringMessages())
+	require.Nil(t, s.sendRecurringMessages()) // Not due anymore
+	response = request(t, s, "GET", "/backups/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, "Time to run the backup", messages[0].Message)
+	require.Equal(t, "https://backup.example.com", messages[0].Actions[0].URL)
+
+	// Survives a restart, with the next run tomorrow
+	s = newTestServer(t, c)
+	recurring, err := s.messageCache.RecurringMessages("backups")
+	require.Nil(t, err)
+	require.Len(t, recurring, 1)
+	require.True(t, recurring[0].Next > time.Now().Unix())
+	require.True(t, recurring[0].Next <= time.Now().Add(24*time.Hour).Unix())
+}
+
+func TestServer_Recurring_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, body := range []string{
+		`{"cron":"0 25 * * *","message":"invalid hour"}`,
+		`{"cron":"0 9 * *","message":"too few fields"}`,
+		`{"cron":"0 9 * * *","timezone":"Mars/Olympus_Mons","message":"unknown time zone"}`,
+		`{"cron":"0 9 * * *","message":""}`,
+		`{"cron":"0 9 * * *","message":"invalid priority","priority":6}`,
+		`{"cron":"0 0 30 2 *","message":"never matches"}`,
+	} {
+		response := request(t, s, "POST", "/mytopic/recurring", body, nil)
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40043, toHTTPError(t, response.Body.String()).Code, body)
+	}
+	response := request(t, s, "POST", "/mytopic/recurring", `{"cron":"0 9 * * *","message":"invalid action","actions":[{"action":"explode"}]}`, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40018, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Recurring_TooMany(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for i := 0; i < recurringMessagesMaxPerTopic; i++ {
+		response := request(t, s, "POST", "/mytopic/recurring", `{"cron":"@hourly","message":"hi"}`, nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "POST", "/mytopic/recurring", `{"cron":"@hourly","message":"hi"}`, nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42908, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/othertopic/recurring", `{"cron":"@hourly","message":"hi"}`, nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_Recurring_DeleteNotCreator(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "backups", true, true))
+	require.Nil(t, manager.AllowAccess("ben", "backups", true, true))
+	require.Nil(t, manager.AllowAccess(auth.Everyone, "backups", true, true)) // Nobody owns the topic, see topicOwner
+
+	response := request(t, s, "POST", "/backups/recurring", `{"cron":"@daily","message":"backup"}`, map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	r := toRecurringMessage(t, response.Body.String())
+	response = request(t, s, "DELETE", "/backups/recurring/"+r.ID, "", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/backups/recurring/"+r.ID, "", nil)
+	require.Equal(t, 403, response.Code) // Same IP address, but the creator was authenticated
+	response = request(t, s, "DELETE", "/backups/recurring/"+r.ID, "", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+}
+
+func toRecurringMessage(t *testing.T, s string) *recurringMessage {
+	var r recurringMessage
+	require.Nil(t, json.Unmarshal([]byte(s), &r))
+	return &r
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	require.Nil(t, err)
+	return location
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
@@ -11,6 +13,8 @@ import (
 	"github.com/emersion/go-smtp"
 	"github.com/gorilla/websocket"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/util"
 	"io"
@@ -21,8 +25,8 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -37,17 +41,48 @@ type Server struct {
 	httpsServer  *http.Server
 	unixListener net.Listener
 	smtpServer   *smtp.Server
+	lmtpServer   *smtp.Server
+	grpcServer   *grpc.Server   // May be nil if listen-grpc is not set
+	mqttListener net.Listener   // May be nil if mqtt-listen is not set
+	coapConn     net.PacketConn // May be nil if coap-listen is not set
+	syslogConns  []io.Closer    // UDP conn and TCP/TLS listeners, may be nil if syslog-listen(-tls) is not set
+	snmpConn     net.PacketConn // May be nil if snmp-trap-listen is not set
 	smtpBackend  *smtpBackend
 	topics       map[string]*topic
+	firehose     *topic // Messages of all topics, for admins, see publishFirehose
 	visitors     map[string]*visitor
-	firebase     subscriber
+	tierLimiters map[string]*tierLimiter // By username, see tierLimiter
+	topicIPRules map[string]*topicIPRule // By topic, see limitPublishIPs
+	firebase     subscriber              // Also sends to APNs, if enabled, see withAPNS
+	apns         *apnsClient             // May be nil if apns-key-file is not set
+	matrix       *matrixBridge           // May be nil if matrix-homeserver is not set
+	telegram     *telegramBot            // May be nil if telegram-bot-token is not set
 	mailer       mailer
+	sms          smsSender                     // May be nil if sms-provider is not set
+	caller       phoneCaller                   // May be nil if enable-calls is not set
+	phoneCodes   map[string]*phoneVerification // Pending phone number verifications, by username, see handleUserPhoneNumberVerify
 	messages     int64
+	emailMetrics emailMetrics
 	auth         auth.Auther
-	messageCache *messageCache
-	fileCache    *fileCache
+	oidc         *auth.OIDCAuth        // Same as auth, if auth-backend is oidc
+	oidcLogins   map[string]*oidcLogin // Login flows started in the web app, by state, see handleOIDCLogin
+	signups      map[string]*signup    // Sign-ups waiting for e-mail verification, by token, see handleAccountAdd
+	invites      []*signupInvite       // Empty if sign-ups are disabled
+	templates    *webhookTemplates
+	messageCache messageCache
+	fileCache    attachmentStore
+	scanner      attachmentScanner
+	downloads    *rate.Limiter // Global attachment download rate, may be nil
+	urlSigner    *fileURLSigner
+	pubSigner    *publishURLSigner // May be nil if no publish URL secrets are configured
+	snmpNames    *snmpOIDMap       // May be nil if snmp-trap-listen is not set
+	clientCAs    *x509.CertPool    // May be nil if client certificates are not enabled
+	authProxy    *authProxy        // May be nil if the auth proxy header is not configured
+	auditLog     *auditLog         // May be nil if audit-log-file is not set
+	readOnly     bool              // Rejects writes to the message cache, see rejectReadOnly
 	closeChan    chan bool
 	mu           sync.Mutex
+	heartbeatMu  sync.Mutex // Serializes heartbeat updates, see heartbeatReceived; never held together with mu
 }
 
 // handleFunc extends the normal http.HandlerFunc to be able to easily return errors
@@ -58,18 +93,28 @@ var (
 	topicRegex             = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)               // No /!
 	topicPathRegex         = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}$`)              // Regex must match JS & Android app!
 	externalTopicPathRegex = regexp.MustCompile(`^/[^/]+\.[^/]+/[-_A-Za-z0-9]{1,64}$`) // Extended topic path, for web-app, e.g. /example.com/mytopic
-	jsonPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/json$`)
-	ssePathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/sse$`)
-	rawPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/raw$`)
-	wsPathRegex            = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/ws$`)
+	jsonPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/json$`)
+	ssePathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/sse$`)
+	rawPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/raw$`)
+	protoPathRegex         = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/proto$`)
+	cborPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/cbor$`)
+	wsPathRegex            = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/ws$`)
 	authPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/auth$`)
+	searchPathRegex        = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/search$`)
+	exportPathRegex        = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/export$`)
+	importPathRegex        = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/import$`)
 	publishPathRegex       = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/(publish|send|trigger)$`)
+	messagePathRegex       = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/([A-Za-z0-9]{12})$`)
+	messageIDRegex         = regexp.MustCompile(`^[A-Za-z0-9]{12}$`)
+	scheduledPathRegex     = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/scheduled$`)
+	scheduledMsgPathRegex  = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/scheduled/([A-Za-z0-9]{12})$`)
 
 	webConfigPath    = "/config.js"
 	userStatsPath    = "/user/stats"
+	metricsPath      = "/metrics"
 	staticRegex      = regexp.MustCompile(`^/static/.+`)
 	docsRegex        = regexp.MustCompile(`^/docs(|/.*)$`)
-	fileRegex        = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
+	fileRegex        = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64}(?:` + thumbnailFileIDSuffix + `)?)(?:\.[A-Za-z0-9]{1,16})?$`)
 	disallowedTopics = []string{"docs", "static", "file", "app", "settings"} // If updated, also update in Android app
 	attachURLRegex   = regexp.MustCompile(`^https?://`)
 
@@ -93,6 +138,12 @@ const (
 	emptyMessageBody         = "triggered"               // Used if message body is empty
 	defaultAttachmentMessage = "You received a file: %s" // Used if message body is empty, and there is an attachment
 	encodingBase64           = "base64"
+	bearerAuthPrefix         = "Bearer "
+	groupMaxLength           = 256 // Max length of the message group (X-Group)
+	dedupKeyMaxLength        = 256 // Max length of the idempotency key (X-Dedup-Key)
+	collapseKeyMaxLength     = 64  // Max length of the collapse key (X-Collapse-Key), same as for apns-collapse-id
+	searchMaxTerms           = 10  // Max number of words in a search query, see handleSearch
+	searchMaxResults         = 100 // Max number of messages returned per topic by a search
 )
 
 // WebSocket constants
@@ -106,9 +157,9 @@ const (
 // New instantiates a new Server. It creates the cache and adds a Firebase
 // subscriber (if configured).
 func New(conf *Config) (*Server, error) {
-	var mailer mailer
-	if conf.SMTPSenderAddr != "" {
-		mailer = &smtpSender{config: conf}
+	mailer, err := newMailer(conf)
+	if err != nil {
+		return nil, err
 	}
 	messageCache, err := createMessageCache(conf)
 	if err != nil {
@@ -118,47 +169,208 @@ func New(conf *Config) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	var fileCache *fileCache
-	if conf.AttachmentCacheDir != "" {
+	var fileCache attachmentStore
+	if conf.AttachmentS3URL != "" {
+		fileCache, err = newS3Cache(conf.AttachmentS3URL, conf.AttachmentTotalSizeLimit, conf.AttachmentFileSizeLimit)
+		if err != nil {
+			return nil, err
+		}
+	} else if conf.AttachmentCacheDir != "" {
 		fileCache, err = newFileCache(conf.AttachmentCacheDir, conf.AttachmentTotalSizeLimit, conf.AttachmentFileSizeLimit)
 		if err != nil {
 			return nil, err
 		}
 	}
+	var urlSigner *fileURLSigner
+	if conf.AttachmentURLSigningKeyFile != "" {
+		urlSigner, err = loadFileURLSigner(conf.AttachmentURLSigningKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var clientCAs *x509.CertPool
+	if conf.ClientCertCAFile != "" {
+		clientCAs, err = loadClientCAs(conf.ClientCertCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var snmpNames *snmpOIDMap
+	if conf.SNMPTrapListen != "" {
+		snmpNames, err = loadSNMPOIDMap(conf.SNMPTrapOIDMapFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var authProxy *authProxy
+	if conf.AuthProxyHeader != "" {
+		authProxy, err = newAuthProxy(conf.AuthProxyHeader, conf.AuthProxySecret, conf.AuthProxyTrustedHosts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var auditLog *auditLog
+	if conf.AuditLogFile != "" {
+		auditLog, err = newAuditLog(conf.AuditLogFile, conf.AuditLogMaxSize, conf.AuditLogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var pubSigner *publishURLSigner
+	if len(conf.PublishURLSecrets) > 0 {
+		pubSigner, err = newPublishURLSigner(conf.PublishURLSecrets)
+		if err != nil {
+			return nil, err
+		}
+	}
+	invites, err := newSignupInvites(conf.SignupInviteCodes, conf.SignupDefaultTier)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := newWebhookTemplates(conf.WebhookTemplateDir, conf.WebhookTemplateTopics)
+	if err != nil {
+		return nil, err
+	}
 	var auther auth.Auther
-	if conf.AuthFile != "" {
+	var oidc *auth.OIDCAuth
+	if conf.AuthBackend == AuthBackendOIDC {
+		oidc, err = auth.NewOIDCAuth(&auth.OIDCConfig{
+			Issuer:        conf.AuthOIDCIssuer,
+			ClientID:      conf.AuthOIDCClientID,
+			ClientSecret:  conf.AuthOIDCClientSecret,
+			Scopes:        conf.AuthOIDCScopes,
+			UsernameClaim: conf.AuthOIDCUsernameClaim,
+			GroupsClaim:   conf.AuthOIDCGroupsClaim,
+			AdminGroup:    conf.AuthOIDCAdminGroup,
+			GroupAccess:   conf.AuthOIDCGroupAccess,
+			DefaultRead:   conf.AuthDefaultRead,
+			DefaultWrite:  conf.AuthDefaultWrite,
+		})
+		if err != nil {
+			return nil, err
+		}
+		auther = oidc
+	} else if conf.AuthBackend == AuthBackendLDAP {
+		auther, err = auth.NewLDAPAuth(&auth.LDAPConfig{
+			URL:            conf.AuthLDAPURL,
+			BindDN:         conf.AuthLDAPBindDN,
+			BindPassword:   conf.AuthLDAPBindPassword,
+			UserBaseDN:     conf.AuthLDAPUserBaseDN,
+			UserFilter:     conf.AuthLDAPUserFilter,
+			GroupAttribute: conf.AuthLDAPGroupAttribute,
+			AdminGroup:     conf.AuthLDAPAdminGroup,
+			GroupAccess:    conf.AuthLDAPGroupAccess,
+			DefaultRead:    conf.AuthDefaultRead,
+			DefaultWrite:   conf.AuthDefaultWrite,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if conf.AuthBackend == AuthBackendPostgres {
+		auther, err = auth.NewPostgresAuth(conf.AuthDSN, conf.AuthDefaultRead, conf.AuthDefaultWrite)
+		if err != nil {
+			return nil, err
+		}
+	} else if conf.AuthFile != "" {
 		auther, err = auth.NewSQLiteAuth(conf.AuthFile, conf.AuthDefaultRead, conf.AuthDefaultWrite)
 		if err != nil {
 			return nil, err
 		}
 	}
 	var firebaseSubscriber subscriber
-	if conf.FirebaseKeyFile != "" {
+	if conf.FirebaseKeyFile != "" || len(conf.FirebaseProjects) > 0 {
 		var err error
-		firebaseSubscriber, err = createFirebaseSubscriber(conf.FirebaseKeyFile, auther)
+		firebaseSubscriber, err = createFirebaseSubscriber(conf, auther)
 		if err != nil {
 			return nil, err
 		}
 	}
-	return &Server{
+	var apns *apnsClient
+	if conf.APNSKeyFile != "" {
+		apns, err = createAPNSClient(conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var matrix *matrixBridge
+	if conf.MatrixHomeserver != "" {
+		matrix = newMatrixBridge(conf)
+	}
+	var telegram *telegramBot
+	if conf.TelegramBotToken != "" {
+		telegram = newTelegramBot(conf)
+	}
+	s := &Server{
 		config:       conf,
 		messageCache: messageCache,
 		fileCache:    fileCache,
+		scanner:      newAttachmentScanner(conf),
+		downloads:    newDownloadRateLimiter(conf.TotalAttachmentDownloadRateLimit),
+		urlSigner:    urlSigner,
+		pubSigner:    pubSigner,
+		snmpNames:    snmpNames,
+		clientCAs:    clientCAs,
+		authProxy:    authProxy,
+		auditLog:     auditLog,
 		firebase:     firebaseSubscriber,
+		apns:         apns,
+		matrix:       matrix,
+		telegram:     telegram,
 		mailer:       mailer,
+		sms:          newSMSSender(conf),
+		caller:       newPhoneCaller(conf),
 		topics:       topics,
+		firehose:     newTopic(firehoseTopic),
+		readOnly:     conf.ReadOnly,
 		auth:         auther,
+		oidc:         oidc,
+		oidcLogins:   make(map[string]*oidcLogin),
+		signups:      make(map[string]*signup),
+		invites:      invites,
+		templates:    templates,
 		visitors:     make(map[string]*visitor),
-	}, nil
+		tierLimiters: make(map[string]*tierLimiter),
+		topicIPRules: make(map[string]*topicIPRule),
+		phoneCodes:   make(map[string]*phoneVerification),
+	}
+	if s.apns != nil {
+		s.firebase = s.withAPNS(firebaseSubscriber)
+	}
+	if s.firebase != nil && s.auth != nil {
+		s.firebase = s.withQuietHours(s.firebase) // Quiet hours of topics can only be set with access control
+	}
+	if err := s.updateTopicIPRules(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func createMessageCache(conf *Config) (*messageCache, error) {
+func createMessageCache(conf *Config) (messageCache, error) {
 	if conf.CacheDuration == 0 {
 		return newNopCache()
+	} else if conf.CacheEngine == CacheEngineRedis {
+		return newRedisCache(conf.CacheDSN)
+	}
+	var cipher *cacheCipher
+	var err error
+	if conf.CacheEncryptionKeyFile != "" {
+		if cipher, err = loadCacheCipher(conf.CacheEncryptionKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	var cache *sqlCache
+	if conf.CacheEngine == CacheEnginePostgres {
+		cache, err = newPostgresCache(conf.CacheDSN, conf.CacheBatchSize, conf.CacheBatchTimeout)
 	} else if conf.CacheFile != "" {
-		return newSqliteCache(conf.CacheFile, false)
+		cache, err = newSqliteCache(conf.CacheFile, conf.CacheBatchSize, conf.CacheBatchTimeout, false)
+	} else {
+		cache, err = newMemCache()
+	}
+	if err != nil {
+		return nil, err
 	}
-	return newMemCache()
+	cache.cipher = cipher // Set before the first message is added, so the batch writer sees it as well
+	return cache, nil
 }
 
 // Run executes the main server. It listens on HTTP (+ HTTPS, if configured), and starts
@@ -177,6 +389,27 @@ func (s *Server) Run() error {
 	if s.config.SMTPServerListen != "" {
 		listenStr += fmt.Sprintf(" %s[smtp]", s.config.SMTPServerListen)
 	}
+	if s.config.SMTPServerListenLMTP != "" {
+		listenStr += fmt.Sprintf(" %s[lmtp]", s.config.SMTPServerListenLMTP)
+	}
+	if s.config.ListenGRPC != "" {
+		listenStr += fmt.Sprintf(" %s[grpc]", s.config.ListenGRPC)
+	}
+	if s.config.MQTTListen != "" {
+		listenStr += fmt.Sprintf(" %s[mqtt]", s.config.MQTTListen)
+	}
+	if s.config.CoAPListen != "" {
+		listenStr += fmt.Sprintf(" %s[coap]", s.config.CoAPListen)
+	}
+	if s.config.SyslogListen != "" {
+		listenStr += fmt.Sprintf(" %s[syslog]", s.config.SyslogListen)
+	}
+	if s.config.SyslogListenTLS != "" {
+		listenStr += fmt.Sprintf(" %s[syslog-tls]", s.config.SyslogListenTLS)
+	}
+	if s.config.SNMPTrapListen != "" {
+		listenStr += fmt.Sprintf(" %s[snmp]", s.config.SNMPTrapListen)
+	}
 	log.Printf("Listening on%s", listenStr)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handle)
@@ -191,6 +424,9 @@ func (s *Server) Run() error {
 	}
 	if s.config.ListenHTTPS != "" {
 		s.httpsServer = &http.Server{Addr: s.config.ListenHTTPS, Handler: mux}
+		if s.clientCAs != nil {
+			s.httpsServer.TLSConfig = clientTLSConfig(s.clientCAs)
+		}
 		go func() {
 			errChan <- s.httpsServer.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile)
 		}()
@@ -210,15 +446,51 @@ func (s *Server) Run() error {
 			errChan <- httpServer.Serve(s.unixListener)
 		}()
 	}
+	if s.config.SMTPServerListen != "" || s.config.SMTPServerListenLMTP != "" {
+		s.smtpBackend = s.newSMTPBackend()
+	}
 	if s.config.SMTPServerListen != "" {
 		go func() {
 			errChan <- s.runSMTPServer()
 		}()
 	}
+	if s.config.SMTPServerListenLMTP != "" {
+		go func() {
+			errChan <- s.runLMTPServer()
+		}()
+	}
+	if s.config.ListenGRPC != "" {
+		go func() {
+			errChan <- s.runGRPCServer()
+		}()
+	}
+	if s.config.MQTTListen != "" {
+		go func() {
+			errChan <- s.runMQTTServer()
+		}()
+	}
+	if s.config.CoAPListen != "" {
+		go func() {
+			errChan <- s.runCoAPServer()
+		}()
+	}
+	if s.config.SyslogListen != "" || s.config.SyslogListenTLS != "" {
+		go func() {
+			errChan <- s.runSyslogServer()
+		}()
+	}
+	if s.config.SNMPTrapListen != "" {
+		go func() {
+			errChan <- s.runSNMPTrapServer()
+		}()
+	}
 	s.mu.Unlock()
 	go s.runManager()
 	go s.runAtSender()
 	go s.runFirebaseKeepaliver()
+	if s.matrix != nil {
+		go s.runMatrixBridge()
+	}
 
 	return <-errChan
 }
@@ -239,7 +511,28 @@ func (s *Server) Stop() {
 	if s.smtpServer != nil {
 		s.smtpServer.Close()
 	}
+	if s.lmtpServer != nil {
+		s.lmtpServer.Close()
+	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if s.mqttListener != nil {
+		s.mqttListener.Close()
+	}
+	if s.coapConn != nil {
+		s.coapConn.Close()
+	}
+	for _, conn := range s.syslogConns {
+		conn.Close()
+	}
+	if s.snmpConn != nil {
+		s.snmpConn.Close()
+	}
 	close(s.closeChan)
+	if err := s.messageCache.Close(); err != nil { // Writes the messages that are still queued, see processMessageBatches
+		log.Printf("error closing message cache: %s", err.Error())
+	}
 }
 
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
@@ -272,30 +565,178 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.handleWebConfig(w, r)
 	} else if r.Method == http.MethodGet && r.URL.Path == userStatsPath {
 		return s.handleUserStats(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == userTokensPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserTokens))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == userTokensPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserTokenAdd))(w, r, v)
+	} else if r.Method == http.MethodDelete && userTokenPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserTokenDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == userTOTPPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserTOTPEnroll))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == userTOTPConfirmPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserTOTPConfirm))(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == userTOTPPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserTOTPDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == userReservationsPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserReservations))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == userReservationsPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserReservationAdd))(w, r, v)
+	} else if r.Method == http.MethodDelete && userReservationPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserReservationDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == userQuietHoursPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserQuietHours))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == userQuietHoursPath && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authUserPassword(s.handleUserQuietHoursUpdate)))(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == userQuietHoursPath && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authUserPassword(s.handleUserQuietHoursDelete)))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == userPhonePath && s.sms != nil && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleUserPhoneNumbers))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == userPhoneVerifyPath && s.sms != nil && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authUserPassword(s.handleUserPhoneNumberVerify)))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == userPhonePath && s.sms != nil && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authUserPassword(s.handleUserPhoneNumberAdd)))(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == userPhonePath && s.sms != nil && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authUserPassword(s.handleUserPhoneNumberRemove)))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == adminUsersPath && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleAdminUsers))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == adminUsersPath && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleAdminUserAdd))(w, r, v)
+	} else if r.Method == http.MethodPut && adminUserPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleAdminUserChange))(w, r, v)
+	} else if r.Method == http.MethodDelete && adminUserPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleAdminUserDelete))(w, r, v)
+	} else if r.Method == http.MethodPut && adminUserAccessPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleAdminAccessAllow))(w, r, v)
+	} else if r.Method == http.MethodDelete && adminUserAccessPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleAdminAccessReset))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == adminMaintenancePath && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleAdminMaintenance))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == adminMaintenancePath && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleAdminMaintenanceUpdate))(w, r, v)
+	} else if r.Method == http.MethodGet && (r.URL.Path == firehosePath || r.URL.Path == firehosePath+"/json") && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleSubscribeJSON))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == firehosePath+"/sse" && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleSubscribeSSE))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == firehosePath+"/ws" && s.auth != nil {
+		return s.limitRequests(s.authAdmin(s.handleSubscribeWS))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == accountPath && len(s.invites) > 0 && s.mailer != nil {
+		return s.limitRequests(s.handleAccountAdd)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == accountVerifyPath && len(s.invites) > 0 {
+		return s.limitRequests(s.handleAccountVerify)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == accountExportPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleAccountExport))(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == accountPath && s.auth != nil {
+		return s.limitRequests(s.authUserPassword(s.handleAccountDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == oidcLoginPath && s.oidc != nil {
+		return s.limitRequests(s.handleOIDCLogin)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == oidcCallbackPath && s.oidc != nil {
+		return s.limitRequests(s.handleOIDCCallback)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == metricsPath && s.config.EnableMetrics {
+		return s.handleMetrics(w, r, v)
 	} else if r.Method == http.MethodGet && staticRegex.MatchString(r.URL.Path) {
 		return s.handleStatic(w, r)
 	} else if r.Method == http.MethodGet && docsRegex.MatchString(r.URL.Path) {
 		return s.handleDocs(w, r)
-	} else if r.Method == http.MethodGet && fileRegex.MatchString(r.URL.Path) && s.config.AttachmentCacheDir != "" {
+	} else if r.Method == http.MethodGet && fileRegex.MatchString(r.URL.Path) && s.fileCache != nil {
 		return s.limitRequests(s.handleFile)(w, r, v)
+	} else if r.Method == http.MethodPost && grpcWebPathRegex.MatchString(r.URL.Path) && s.config.EnableGRPCWeb {
+		return s.handleGRPCWeb(w, r, v)
 	} else if r.Method == http.MethodOptions {
 		return s.handleOptions(w, r)
+	} else if r.Method == http.MethodPost && r.URL.Path == publishBatchPath {
+		return s.limitRequests(s.rejectReadOnly(s.decompressBody(s.handlePublishBatch)))(w, r, v)
 	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == "/" {
-		return s.limitRequests(s.transformBodyJSON(s.authWrite(s.handlePublish)))(w, r, v)
+		return s.limitRequests(s.rejectReadOnly(s.decompressBody(s.transformBodyJSON(s.limitPublishIPs(s.authPublish(s.handlePublish))))))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicPathRegex.MatchString(r.URL.Path) && s.webhookName(r) != "" {
+		return s.limitPublishIPs(s.limitRequests(s.rejectReadOnly(s.decompressBody(s.transformBodyWebhook(s.authPublish(s.handlePublish))))))(w, r, v)
 	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicPathRegex.MatchString(r.URL.Path) {
-		return s.limitRequests(s.authWrite(s.handlePublish))(w, r, v)
+		return s.limitPublishIPs(s.limitRequests(s.rejectReadOnly(s.decompressBody(s.authPublish(s.handlePublish)))))(w, r, v)
 	} else if r.Method == http.MethodGet && publishPathRegex.MatchString(r.URL.Path) {
-		return s.limitRequests(s.authWrite(s.handlePublish))(w, r, v)
+		return s.limitPublishIPs(s.limitRequests(s.rejectReadOnly(s.authPublish(s.handlePublish))))(w, r, v)
+	} else if r.Method == http.MethodPost && webhookPathRegex.MatchString(r.URL.Path) {
+		return s.limitPublishIPs(s.limitRequests(s.rejectReadOnly(s.decompressBody(s.transformBodyWebhook(s.authPublish(s.handlePublish))))))(w, r, v)
 	} else if r.Method == http.MethodGet && jsonPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authRead(s.handleSubscribeJSON))(w, r, v)
 	} else if r.Method == http.MethodGet && ssePathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authRead(s.handleSubscribeSSE))(w, r, v)
 	} else if r.Method == http.MethodGet && rawPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authRead(s.handleSubscribeRaw))(w, r, v)
+	} else if r.Method == http.MethodGet && protoPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleSubscribeProto))(w, r, v)
+	} else if r.Method == http.MethodGet && cborPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleSubscribeCBOR))(w, r, v)
 	} else if r.Method == http.MethodGet && wsPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authRead(s.handleSubscribeWS))(w, r, v)
 	} else if r.Method == http.MethodGet && authPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authRead(s.handleTopicAuth))(w, r, v)
+	} else if r.Method == http.MethodGet && searchPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleSearch))(w, r, v)
+	} else if r.Method == http.MethodGet && feedPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleTopicFeed))(w, r, v)
+	} else if s.apns != nil && (r.Method == http.MethodPut || r.Method == http.MethodPost) && apnsPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authRead(s.handleAPNSRegister)))(w, r, v)
+	} else if s.apns != nil && r.Method == http.MethodDelete && apnsPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authRead(s.handleAPNSUnregister)))(w, r, v)
+	} else if r.Method == http.MethodDelete && topicPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handlePurge)))(w, r, v)
+	} else if r.Method == http.MethodPut && messagePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleUpdate)))(w, r, v)
+	} else if r.Method == http.MethodDelete && messagePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleDelete)))(w, r, v)
+	} else if r.Method == http.MethodGet && scheduledPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleScheduled))(w, r, v)
+	} else if r.Method == http.MethodDelete && scheduledMsgPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleScheduledCancel)))(w, r, v)
+	} else if r.Method == http.MethodGet && topicInfoPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleTopicInfo))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicInfoPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleTopicInfoUpdate)))(w, r, v)
+	} else if r.Method == http.MethodGet && topicDefaultsPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleTopicDefaults))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicDefaultsPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleTopicDefaultsUpdate)))(w, r, v)
+	} else if s.telegram != nil && r.Method == http.MethodGet && telegramPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authRead(s.handleTelegramChats))(w, r, v)
+	} else if s.telegram != nil && (r.Method == http.MethodPut || r.Method == http.MethodPost) && telegramPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleTelegramChatAdd)))(w, r, v)
+	} else if s.telegram != nil && r.Method == http.MethodDelete && telegramPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleTelegramChatRemove)))(w, r, v)
+	} else if r.Method == http.MethodGet && topicWebhooksPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authRead(s.handleTopicWebhooks))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicWebhooksPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleTopicWebhooksUpdate)))(w, r, v)
+	} else if r.Method == http.MethodGet && moderationPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleTopicModeration))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && moderationPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleTopicModerationUpdate)))(w, r, v)
+	} else if r.Method == http.MethodPost && moderationMessagePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleModerationMessage)))(w, r, v)
+	} else if r.Method == http.MethodGet && heartbeatPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authRead(s.handleTopicHeartbeat))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && heartbeatPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleTopicHeartbeatUpdate)))(w, r, v)
+	} else if r.Method == http.MethodGet && topicQuietHoursPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authRead(s.handleTopicQuietHours))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicQuietHoursPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleTopicQuietHoursUpdate)))(w, r, v)
+	} else if r.Method == http.MethodGet && escalationPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.authRead(s.handleTopicEscalation))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && escalationPathRegex.MatchString(r.URL.Path) && s.auth != nil {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleTopicEscalationUpdate)))(w, r, v)
+	} else if r.Method == http.MethodGet && ackPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleAcks))(w, r, v)
+	} else if r.Method == http.MethodPost && ackPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authRead(s.handleAck)))(w, r, v)
+	} else if r.Method == http.MethodGet && recurringPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authRead(s.handleRecurringList))(w, r, v)
+	} else if r.Method == http.MethodPost && recurringPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleRecurringAdd)))(w, r, v)
+	} else if r.Method == http.MethodDelete && recurringMsgPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authWrite(s.handleRecurringDelete)))(w, r, v)
+	} else if r.Method == http.MethodGet && exportPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authAdmin(s.handleExport))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && importPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.rejectReadOnly(s.authAdmin(s.handleImport)))(w, r, v)
 	} else if r.Method == http.MethodGet && (topicPathRegex.MatchString(r.URL.Path) || externalTopicPathRegex.MatchString(r.URL.Path)) {
 		return s.handleTopic(w, r)
 	}
@@ -327,7 +768,12 @@ func (s *Server) handleEmpty(_ http.ResponseWriter, _ *http.Request, _ *visitor)
 	return nil
 }
 
-func (s *Server) handleTopicAuth(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+// handleTopicAuth is used by the web app to check the credentials of a user when logging in, which is why
+// it also requires the TOTP code of users with two-factor authentication
+func (s *Server) handleTopicAuth(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	if err := s.verifyTOTP(r, userFromRequest(r)); err != nil {
+		return err
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
 	_, err := io.WriteString(w, `{"success":true}`+"\n")
@@ -340,22 +786,32 @@ func (s *Server) handleExample(w http.ResponseWriter, _ *http.Request) error {
 }
 
 func (s *Server) handleWebConfig(w http.ResponseWriter, r *http.Request) error {
-	appRoot := "/"
-	if !s.config.WebRootIsApp {
-		appRoot = "/app"
-	}
 	disallowedTopicsStr := `"` + strings.Join(disallowedTopics, `", "`) + `"`
 	w.Header().Set("Content-Type", "text/javascript")
 	_, err := io.WriteString(w, fmt.Sprintf(`// Generated server configuration
 var config = {
   appRoot: "%s",
-  disallowedTopics: [%s]
-};`, appRoot, disallowedTopicsStr))
+  disallowedTopics: [%s],
+  oidcLogin: %t
+};`, s.appRoot(), disallowedTopicsStr, s.oidc != nil))
 	return err
 }
 
+// appRoot returns the path of the web app, see web-root
+func (s *Server) appRoot() string {
+	if !s.config.WebRootIsApp {
+		return "/app"
+	}
+	return "/"
+}
+
 func (s *Server) handleUserStats(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	stats, err := v.Stats()
+	if s.auth != nil {
+		if user, err := s.authenticate(r); err == nil && user != nil {
+			r = withUser(r, user) // The user's tier may come with a different attachment quota
+		}
+	}
+	stats, err := s.visitorStats(r, v)
 	if err != nil {
 		return err
 	}
@@ -379,7 +835,7 @@ func (s *Server) handleDocs(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	if s.config.AttachmentCacheDir == "" {
+	if s.fileCache == nil {
 		return errHTTPInternalError
 	}
 	matches := fileRegex.FindStringSubmatch(r.URL.Path)
@@ -387,50 +843,144 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 		return errHTTPInternalErrorInvalidFilePath
 	}
 	messageID := matches[1]
-	file := filepath.Join(s.config.AttachmentCacheDir, messageID)
-	stat, err := os.Stat(file)
-	if err != nil {
+	if s.urlSigner != nil {
+		topic, err := s.urlSigner.verify(messageID, r.URL.Query())
+		if err != nil {
+			return errHTTPForbiddenAttachmentURLInvalid
+		} else if s.auth != nil && s.config.AttachmentURLRequireRead {
+			user, err := s.authenticate(r)
+			if err != nil {
+				return err
+			} else if err := s.auth.Authorize(user, topic, auth.PermissionRead); err != nil {
+				log.Printf("unauthorized: %s", err.Error())
+				s.auditAccessDenied(r, user, topic, auth.PermissionRead, err.Error())
+				return errHTTPForbidden
+			}
+		}
+	}
+	size, err := s.fileCache.Stat(messageID)
+	if err == errFileNotFound || err == errInvalidFileID {
 		return errHTTPNotFound
+	} else if err != nil {
+		return err
 	}
-	if err := v.BandwidthLimiter().Allow(stat.Size()); err != nil {
+	if err := v.BandwidthLimiter().Allow(size); err != nil {
 		return errHTTPTooManyRequestsAttachmentBandwidthLimit
 	}
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
 	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
-	f, err := os.Open(file)
-	if err != nil {
+	if store, ok := s.fileCache.(signedURLStore); ok {
+		http.Redirect(w, r, store.SignedURL(messageID), http.StatusFound) // Download directly from the bucket
+		return nil
+	}
+	f, size, err := s.fileCache.Read(messageID)
+	if err == errFileNotFound {
+		return errHTTPNotFound
+	} else if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = io.Copy(util.NewContentTypeWriter(w, r.URL.Path), f)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	limiters := make([]*rate.Limiter, 0)
+	for _, limiter := range []*rate.Limiter{v.DownloadRateLimiter(), s.downloads} {
+		if limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	_, err = io.Copy(util.NewThrottleWriter(r.Context(), util.NewContentTypeWriter(w, r.URL.Path), limiters...), f)
 	return err
 }
 
 func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	t, err := s.topicFromPath(r.URL.Path)
+	m, err := s.publish(r, v, true)
 	if err != nil {
 		return err
 	}
+	return encodePublishResponse(w, r, m)
+}
+
+// publish publishes the message described by the request to the topic in the path, and returns it. If the message
+// is a duplicate (see dedupKey), the original message is returned instead. The daily message limit is only checked
+// if limit is true, since batches are checked as a whole, see handlePublishBatch.
+func (s *Server) publish(r *http.Request, v *visitor, limit bool) (*message, error) {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return nil, err
+	}
 	body, err := util.Peek(r.Body, s.config.MessageLimit)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	m := newDefaultMessage(t.ID, "")
-	cache, firebase, email, unifiedpush, err := s.parsePublishParams(r, v, m)
+	m.senderIP = v.ip
+	if user := userFromRequest(r); user != nil {
+		m.senderUser = user.Name
+	}
+	cache, firebase, email, emailDigest, unifiedpush, err := s.parsePublishParams(r, v, m)
 	if err != nil {
-		return err
+		return nil, err
+	} else if err := s.applyTopicDefaults(m); err != nil {
+		return nil, err
+	}
+	if m.Attachment != nil {
+		if err := s.authorizeTopics(r, auth.PermissionAttach, t.ID); err != nil {
+			return nil, err
+		}
+	}
+	if email != "" {
+		if err := s.authorizeTopics(r, auth.PermissionEmail, t.ID); err != nil {
+			return nil, err
+		}
+	}
+	sms, err := s.parsePublishSMS(r, v, m)
+	if err != nil {
+		return nil, err
+	}
+	call, err := s.parsePublishCall(r, v, m)
+	if err != nil {
+		return nil, err
+	}
+	if m.dedupKey != "" && s.config.DedupWindow > 0 {
+		original, err := s.messageCache.MessageByDedupKey(t.ID, m.dedupKey, time.Now().Add(-s.config.DedupWindow))
+		if err == nil {
+			return original, nil
+		} else if err != errMessageNotFound {
+			return nil, err
+		}
+	}
+	if limit {
+		if err := s.messageAllowed(r, v); err != nil {
+			return nil, err
+		}
 	}
 	if err := s.handlePublishBody(r, v, m, body, unifiedpush); err != nil {
-		return err
+		return nil, err
 	}
 	if m.Message == "" {
 		m.Message = emptyMessageBody
 	}
+	if readBoolParam(r, false, "x-markdown", "markdown", "md") && m.Encoding == "" {
+		renderMessageMarkdown(m)
+	}
+	if held, err := s.holdMessage(r, m); err != nil {
+		return nil, err
+	} else if held {
+		return m, nil
+	}
 	delayed := m.Time > time.Now().Unix()
 	if !delayed {
-		if err := t.Publish(m); err != nil {
-			return err
+		if err := s.collapseMessages(t, m); err != nil {
+			return nil, err
+		} else if err := t.Publish(m); err != nil {
+			return nil, err
+		}
+		s.publishFirehose(m)
+		if r.Header.Get(webhookForwardedHeader) == "" {
+			go s.forwardWebhooks(m)
+		}
+		if !matrixBridged(r) {
+			s.forwardMatrix(m)
 		}
+		go s.forwardTelegram(m)
 	}
 	if s.firebase != nil && firebase && !delayed {
 		go func() {
@@ -440,33 +990,378 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 		}()
 	}
 	if s.mailer != nil && email != "" && !delayed {
-		go func() {
-			if err := s.mailer.Send(v.ip, email, m); err != nil {
-				log.Printf("[%s] MAIL - Unable to send email: %v", v.ip, err.Error())
+		if emailDigest > 0 {
+			if err := s.messageCache.AddEmailDigestMessage(v.ip, email, m, emailDigest); err != nil {
+				return nil, err
 			}
-		}()
+		} else {
+			go s.sendEmail(v.ip, email, m)
+		}
+	}
+	if sms != "" {
+		go s.sendSMS(v.ip, sms, m)
+	}
+	if call != "" {
+		go s.placeCall(v.ip, call, m)
 	}
 	if cache {
 		if err := s.messageCache.AddMessage(m); err != nil {
+			return nil, err
+		} else if err := s.scheduleEscalation(m); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	s.messages++
+	s.mu.Unlock()
+	if !delayed {
+		if err := s.heartbeatReceived(m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// messageThread returns the ID of the first message of the thread that the message with the given ID belongs to.
+// Replies to replies belong to the same thread as their parent. If the parent is not (or no longer) cached, it is
+// assumed to be the first message of the thread.
+func (s *Server) messageThread(topic, id string) (string, error) {
+	parent, err := s.messageCache.Message(topic, id)
+	if err == errMessageNotFound {
+		return id, nil
+	} else if err != nil {
+		return "", err
+	} else if parent.thread != "" {
+		return parent.thread, nil
+	}
+	return parent.ID, nil
+}
+
+// collapseMessages removes the cached messages that the given message replaces, i.e. the messages of the topic with
+// the same collapse key, and emits message_deleted events for them, so that subscribers which don't know about collapse
+// keys withdraw the old notifications as well. Only messages of the same publisher are replaced. The topic may be nil
+// if it has no subscribers.
+func (s *Server) collapseMessages(t *topic, m *message) error {
+	if m.CollapseKey == "" {
+		return nil
+	}
+	previous, err := s.messageCache.MessagesByCollapseKey(m.Topic, m.CollapseKey)
+	if err != nil {
+		return err
+	}
+	for _, p := range previous {
+		if p.ID == m.ID || !sameSender(p, m) {
+			continue
+		}
+		if err := s.messageCache.DeleteMessage(p.Topic, p.ID); err != nil {
 			return err
 		}
+		if err := s.removeAttachments(p); err != nil {
+			log.Printf("[%s] Unable to remove attachment of replaced message %s: %s", m.senderIP, p.ID, err.Error())
+		}
+		deleted := newMessageDeletedMessage(p.Topic, p.ID)
+		if t != nil {
+			if err := t.Publish(deleted); err != nil {
+				return err
+			}
+		}
+		s.publishFirehose(deleted)
+	}
+	return nil
+}
+
+// sameSender returns true if both messages were published by the same user, or anonymously from the same IP address
+func sameSender(a, b *message) bool {
+	if a.senderUser != "" || b.senderUser != "" {
+		return a.senderUser == b.senderUser
+	}
+	return a.senderIP == b.senderIP
+}
+
+// handleDelete removes a message from the cache and emits a message_deleted event, so that subscribers can
+// withdraw the notification. Only the publisher of the message and the owners of the topic may delete it.
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	id := messagePathRegex.FindStringSubmatch(r.URL.Path)[1]
+	m, err := s.messageCache.Message(t.ID, id)
+	if err == errMessageNotFound {
+		return errHTTPNotFoundMessage
+	} else if err != nil {
+		return err
+	}
+	if !s.modifyAllowed(r, v, m) {
+		return errHTTPForbidden
+	}
+	if err := s.messageCache.DeleteMessage(t.ID, id); err != nil {
+		return err
+	}
+	if err := s.removeAttachments(m); err != nil {
+		log.Printf("[%s] Unable to remove attachment of deleted message %s: %s", v.ip, id, err.Error())
+	}
+	deleted := newMessageDeletedMessage(t.ID, id)
+	if err := t.Publish(deleted); err != nil {
+		return err
+	}
+	s.publishFirehose(deleted)
+	if s.firebase != nil {
+		go func() {
+			if err := s.firebase(deleted); err != nil {
+				log.Printf("[%s] FB - Unable to publish to Firebase: %v", v.ip, err.Error())
+			}
+		}()
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
-	if err := json.NewEncoder(w).Encode(m); err != nil {
+	return json.NewEncoder(w).Encode(deleted)
+}
+
+// handleScheduled returns the delayed messages of a topic that have not been delivered yet, as JSON lines,
+// ordered by delivery date
+func (s *Server) handleScheduled(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	} else if err := s.authorizeTopics(r, auth.PermissionPoll, t.ID); err != nil {
 		return err
 	}
-	s.mu.Lock()
-	s.messages++
-	s.mu.Unlock()
+	messages, err := s.messageCache.Messages(t.ID, sinceAllMessages, true)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time < messages[j].Time
+	})
+	now := time.Now().Unix()
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	for _, m := range messages {
+		if m.Time <= now {
+			continue
+		}
+		if err := encoder.Encode(m); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (cache bool, firebase bool, email string, unifiedpush bool, err error) {
+// handleScheduledCancel removes a delayed message from the cache before it is delivered. Since subscribers have
+// not seen the message yet, no message_deleted event is emitted. The same rules as for handleDelete apply.
+func (s *Server) handleScheduledCancel(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	id := scheduledMsgPathRegex.FindStringSubmatch(r.URL.Path)[1]
+	m, err := s.messageCache.Message(t.ID, id)
+	if err == errMessageNotFound || (err == nil && m.Time <= time.Now().Unix()) {
+		return errHTTPNotFoundScheduledMessage
+	} else if err != nil {
+		return err
+	}
+	if !s.modifyAllowed(r, v, m) {
+		return errHTTPForbidden
+	}
+	if err := s.messageCache.DeleteMessage(t.ID, id); err != nil {
+		return err
+	}
+	if err := s.removeAttachments(m); err != nil {
+		log.Printf("[%s] Unable to remove attachment of cancelled message %s: %s", v.ip, id, err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	return json.NewEncoder(w).Encode(m)
+}
+
+// handleUpdate replaces the title, message and/or priority of a cached message, and emits a message_updated event
+// with the new version of the message, so that subscribers can update the notification in place (e.g. to show
+// the progress of a download). Just like for handleDelete, only the publisher and the topic owners may do this.
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	id := messagePathRegex.FindStringSubmatch(r.URL.Path)[1]
+	m, err := s.messageCache.Message(t.ID, id)
+	if err == errMessageNotFound {
+		return errHTTPNotFoundMessage
+	} else if err != nil {
+		return err
+	}
+	if !s.modifyAllowed(r, v, m) {
+		return errHTTPForbidden
+	}
+	if err := s.parseUpdateParams(r, m); err != nil {
+		return err
+	}
+	if err := s.messageCache.UpdateMessage(m); err != nil {
+		return err
+	}
+	m.Event = messageUpdatedEvent
+	if m.Time <= time.Now().Unix() { // Subscribers have not seen scheduled messages yet
+		if err := t.Publish(m); err != nil {
+			return err
+		}
+		s.publishFirehose(m)
+		if s.firebase != nil {
+			go func() {
+				if err := s.firebase(m); err != nil {
+					log.Printf("[%s] FB - Unable to publish to Firebase: %v", v.ip, err.Error())
+				}
+			}()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	return json.NewEncoder(w).Encode(m)
+}
+
+// parseUpdateParams applies the title (X-Title), priority (X-Priority) and body of the request to the message.
+// Fields that are not passed are left as they are, but at least one of them has to be passed.
+func (s *Server) parseUpdateParams(r *http.Request, m *message) error {
+	body, err := util.Peek(r.Body, s.config.MessageLimit)
+	if err != nil {
+		return err
+	}
+	title := readParam(r, "x-title", "title", "t")
+	priority, err := util.ParsePriority(readParam(r, "x-priority", "priority", "prio", "p"))
+	if err != nil {
+		return errHTTPBadRequestPriorityInvalid
+	} else if title == "" && priority == 0 && len(body.PeekedBytes) == 0 {
+		return errHTTPBadRequestUpdateInvalid
+	}
+	if title != "" {
+		m.Title = title
+	}
+	if priority != 0 {
+		m.Priority = priority
+	}
+	if len(body.PeekedBytes) > 0 {
+		if err := s.handleBodyAsTextMessage(m, body); err != nil {
+			return err
+		}
+		m.Encoding = ""
+		if m.Markdown != "" || readBoolParam(r, false, "x-markdown", "markdown", "md") { // Updates keep the format
+			renderMessageMarkdown(m)
+		}
+	}
+	return nil
+}
+
+// modifyAllowed returns true if the message was published by the same user (or for anonymous messages, from
+// the same IP address), or if access control is enabled and the user owns the topic (see topicOwner).
+func (s *Server) modifyAllowed(r *http.Request, v *visitor, m *message) bool {
+	user := userFromRequest(r)
+	if m.senderUser != "" {
+		if user != nil && user.Name == m.senderUser {
+			return true
+		}
+	} else if m.senderIP != "" && m.senderIP == v.ip {
+		return true
+	}
+	return s.auth != nil && s.topicOwner(user, m.Topic)
+}
+
+// topicOwner returns true if the user is an admin, or has full read-write access to the topic (see
+// topicOwnerPermissions), and write access isn't granted to everyone. Users with only some fine-grained write
+// permissions, e.g. publish-only users, are not owners.
+func (s *Server) topicOwner(user *auth.User, topic string) bool {
+	if user == nil {
+		return false
+	} else if user.Role == auth.RoleAdmin {
+		return true
+	}
+	for _, perm := range topicOwnerPermissions {
+		if s.auth.Authorize(user, topic, perm) != nil {
+			return false
+		}
+	}
+	return s.auth.Authorize(nil, topic, auth.PermissionWrite) != nil
+}
+
+var (
+	// topicOwnerPermissions are the fine-grained permissions that make up read-write access, see topicOwner
+	topicOwnerPermissions = []auth.Permission{auth.PermissionSubscribe, auth.PermissionPoll, auth.PermissionPublish, auth.PermissionAttach, auth.PermissionEmail}
+)
+
+// handlePurge removes all cached messages of a topic and their attachments, e.g. after accidentally publishing
+// secrets. Subscribers receive a message_deleted event for each message, so that they can withdraw them. Only admins
+// and the owners of the topic (see topicOwner) may do this, so the route only exists if access control is enabled.
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	deleted, err := s.purgeTopic(t)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Purged %d message(s) from topic %s", v.ip, deleted, t.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	return json.NewEncoder(w).Encode(&purgeResponse{Deleted: deleted})
+}
+
+// purgeTopic removes all cached messages of a topic and their attachments, and returns the number of removed messages
+func (s *Server) purgeTopic(t *topic) (int, error) {
+	messages, err := s.messageCache.Messages(t.ID, sinceAllMessages, true)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.messageCache.DeleteMessages(t.ID); err != nil {
+		return 0, err
+	}
+	for _, m := range messages {
+		if m.Time <= time.Now().Unix() {
+			deleted := newMessageDeletedMessage(t.ID, m.ID)
+			if err := t.Publish(deleted); err != nil {
+				return 0, err
+			}
+			s.publishFirehose(deleted)
+		}
+	}
+	if err := s.removeAttachments(messages...); err != nil {
+		log.Printf("Unable to remove attachments of purged topic %s: %s", t.ID, err.Error())
+	}
+	return len(messages), nil
+}
+
+func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (cache bool, firebase bool, email string, emailDigest time.Duration, unifiedpush bool, err error) {
 	cache = readBoolParam(r, true, "x-cache", "cache")
 	firebase = readBoolParam(r, true, "x-firebase", "firebase")
 	m.Title = readParam(r, "x-title", "title", "t")
 	m.Click = readParam(r, "x-click", "click")
+	m.Group = readParam(r, "x-group", "group")
+	if len(m.Group) > groupMaxLength {
+		return false, false, "", 0, false, errHTTPBadRequestGroupInvalid
+	}
+	m.dedupKey = readParam(r, "x-dedup-key", "dedup-key", "dedup")
+	if len(m.dedupKey) > dedupKeyMaxLength {
+		return false, false, "", 0, false, errHTTPBadRequestDedupKeyInvalid
+	} else if m.dedupKey != "" && !cache {
+		return false, false, "", 0, false, errHTTPBadRequestDedupKeyNoCache // the key is looked up in the cache
+	}
+	m.AckRequired = readBoolParam(r, false, "x-ack-required", "ack-required", "ack")
+	m.CollapseKey = readParam(r, "x-collapse-key", "collapse-key", "collapse")
+	if len(m.CollapseKey) > collapseKeyMaxLength {
+		return false, false, "", 0, false, errHTTPBadRequestCollapseKeyInvalid
+	}
+	m.InReplyTo = readParam(r, "x-in-reply-to", "in-reply-to", "reply-to")
+	if m.InReplyTo != "" {
+		if !messageIDRegex.MatchString(m.InReplyTo) {
+			return false, false, "", 0, false, errHTTPBadRequestInReplyToInvalid
+		}
+		if m.thread, err = s.messageThread(m.Topic, m.InReplyTo); err != nil {
+			return false, false, "", 0, false, err
+		}
+	}
 	filename := readParam(r, "x-filename", "filename", "file", "f")
 	attach := readParam(r, "x-attach", "attach", "a")
 	if attach != "" || filename != "" {
@@ -477,7 +1372,7 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	}
 	if attach != "" {
 		if !attachURLRegex.MatchString(attach) {
-			return false, false, "", false, errHTTPBadRequestAttachmentURLInvalid
+			return false, false, "", 0, false, errHTTPBadRequestAttachmentURLInvalid
 		}
 		m.Attachment.URL = attach
 		if m.Attachment.Name == "" {
@@ -494,13 +1389,30 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 		}
 	}
 	email = readParam(r, "x-email", "x-e-mail", "email", "e-mail", "mail", "e")
+	emailDigestStr := readParam(r, "x-email-digest", "email-digest", "digest")
+	if emailDigestStr != "" {
+		emailDigest, err = time.ParseDuration(emailDigestStr)
+		if err != nil || email == "" || emailDigest < emailDigestMinWindow || emailDigest > emailDigestMaxWindow {
+			return false, false, "", 0, false, errHTTPBadRequestEmailDigestInvalid
+		}
+	}
 	if email != "" {
-		if err := v.EmailAllowed(); err != nil {
-			return false, false, "", false, errHTTPTooManyRequestsLimitEmails
+		// Messages that are added to a pending digest do not count towards the e-mail limit, only the digest does
+		pending := false
+		if emailDigest > 0 {
+			pending, err = s.messageCache.EmailDigestPending(m.Topic, email)
+			if err != nil {
+				return false, false, "", 0, false, err
+			}
+		}
+		if !pending {
+			if err := s.emailAllowed(r, v); err != nil {
+				return false, false, "", 0, false, err
+			}
 		}
 	}
 	if s.mailer == nil && email != "" {
-		return false, false, "", false, errHTTPBadRequestEmailDisabled
+		return false, false, "", 0, false, errHTTPBadRequestEmailDisabled
 	}
 	messageStr := strings.ReplaceAll(readParam(r, "x-message", "message", "m"), "\\n", "\n")
 	if messageStr != "" {
@@ -508,7 +1420,7 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	}
 	m.Priority, err = util.ParsePriority(readParam(r, "x-priority", "priority", "prio", "p"))
 	if err != nil {
-		return false, false, "", false, errHTTPBadRequestPriorityInvalid
+		return false, false, "", 0, false, errHTTPBadRequestPriorityInvalid
 	}
 	tagsStr := readParam(r, "x-tags", "tags", "tag", "ta")
 	if tagsStr != "" {
@@ -520,26 +1432,34 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	delayStr := readParam(r, "x-delay", "delay", "x-at", "at", "x-in", "in")
 	if delayStr != "" {
 		if !cache {
-			return false, false, "", false, errHTTPBadRequestDelayNoCache
+			return false, false, "", 0, false, errHTTPBadRequestDelayNoCache
 		}
 		if email != "" {
-			return false, false, "", false, errHTTPBadRequestDelayNoEmail // we cannot store the email address (yet)
+			return false, false, "", 0, false, errHTTPBadRequestDelayNoEmail // we cannot store the email address (yet)
 		}
 		delay, err := util.ParseFutureTime(delayStr, time.Now())
 		if err != nil {
-			return false, false, "", false, errHTTPBadRequestDelayCannotParse
+			return false, false, "", 0, false, errHTTPBadRequestDelayCannotParse
 		} else if delay.Unix() < time.Now().Add(s.config.MinDelay).Unix() {
-			return false, false, "", false, errHTTPBadRequestDelayTooSmall
-		} else if delay.Unix() > time.Now().Add(s.config.MaxDelay).Unix() {
-			return false, false, "", false, errHTTPBadRequestDelayTooLarge
+			return false, false, "", 0, false, errHTTPBadRequestDelayTooSmall
+		} else if delay.Unix() > time.Now().Add(s.maxDelay(r)).Unix() {
+			return false, false, "", 0, false, errHTTPBadRequestDelayTooLarge
 		}
 		m.Time = delay.Unix()
 	}
+	expiresStr := readParam(r, "x-expires", "expires")
+	if expiresStr != "" {
+		expires, err := util.ParseFutureTime(expiresStr, time.Unix(m.Time, 0)) // Relative to the (delayed) delivery
+		if err != nil || expires.Unix() <= m.Time {
+			return false, false, "", 0, false, errHTTPBadRequestExpiresInvalid
+		}
+		m.Expires = expires.Unix()
+	}
 	actionsStr := readParam(r, "x-actions", "actions", "action")
 	if actionsStr != "" {
 		m.Actions, err = parseActions(actionsStr)
 		if err != nil {
-			return false, false, "", false, wrapErrHTTP(errHTTPBadRequestActionsInvalid, err.Error())
+			return false, false, "", 0, false, wrapErrHTTP(errHTTPBadRequestActionsInvalid, err.Error())
 		}
 	}
 	unifiedpush = readBoolParam(r, false, "x-unifiedpush", "unifiedpush", "up") // see GET too!
@@ -547,7 +1467,7 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 		firebase = false
 		unifiedpush = true
 	}
-	return cache, firebase, email, unifiedpush, nil
+	return cache, firebase, email, emailDigest, unifiedpush, nil
 }
 
 // handlePublishBody consumes the PUT/POST body and decides whether the body is an attachment or the message.
@@ -599,12 +1519,15 @@ func (s *Server) handleBodyAsTextMessage(m *message, body *util.PeekedReadCloser
 }
 
 func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser) error {
-	if s.fileCache == nil || s.config.BaseURL == "" || s.config.AttachmentCacheDir == "" {
+	if s.fileCache == nil || s.config.BaseURL == "" {
 		return errHTTPBadRequestAttachmentsDisallowed
 	} else if m.Time > time.Now().Add(s.config.AttachmentExpiryDuration).Unix() {
 		return errHTTPBadRequestAttachmentsExpiryBeforeDelivery
+	} else if err := s.authorizeTopics(r, auth.PermissionAttach, m.Topic); err != nil {
+		return err
 	}
-	visitorStats, err := v.Stats()
+	owner, _ := s.attachmentQuota(r, v)
+	visitorStats, err := s.visitorStats(r, v)
 	if err != nil {
 		return err
 	}
@@ -619,25 +1542,141 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 		m.Attachment = &attachment{}
 	}
 	var ext string
-	m.Attachment.Owner = v.ip // Important for attachment rate limiting
+	m.Attachment.Owner = owner // Important for attachment rate limiting
 	m.Attachment.Expires = time.Now().Add(s.config.AttachmentExpiryDuration).Unix()
+	if m.Expires > 0 && m.Attachment.Expires > m.Expires {
+		m.Attachment.Expires = m.Expires // Attachment is useless once the message is gone
+	}
 	m.Attachment.Type, ext = util.DetectContentType(body.PeekedBytes, m.Attachment.Name)
-	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", s.config.BaseURL, m.ID, ext)
+	if len(s.config.AttachmentAllowedTypes) > 0 {
+		sniffedType, _ := util.DetectContentType(body.PeekedBytes, "") // Ignore the filename, it may be anything
+		if !attachmentTypeAllowed(s.config.AttachmentAllowedTypes, m.Attachment.Type) || !attachmentTypeAllowed(s.config.AttachmentAllowedTypes, sniffedType) {
+			return errHTTPUnsupportedMediaTypeAttachment
+		}
+	}
 	if m.Attachment.Name == "" {
 		m.Attachment.Name = fmt.Sprintf("attachment%s", ext)
 	}
 	if m.Message == "" {
 		m.Message = fmt.Sprintf(defaultAttachmentMessage, m.Attachment.Name)
 	}
-	m.Attachment.Size, err = s.fileCache.Write(m.ID, body, v.BandwidthLimiter(), util.NewFixedLimiter(visitorStats.VisitorAttachmentBytesRemaining))
+	m.Attachment.Hash, m.Attachment.Size, err = s.fileCache.WriteContent(body, v.BandwidthLimiter(), util.NewFixedLimiter(visitorStats.VisitorAttachmentBytesRemaining))
 	if err == util.ErrLimitReached {
 		return errHTTPEntityTooLargeAttachmentTooLarge
 	} else if err != nil {
 		return err
 	}
+	if s.scanner != nil {
+		if err := s.scanAttachment(v, m); err != nil {
+			return err
+		}
+	}
+	m.Attachment.URL = s.fileURL(m, m.Attachment.Hash, ext)
+	if thumbnailSupported(m.Attachment.Type) {
+		if err := s.createAttachmentThumbnail(m); err != nil {
+			log.Printf("[%s] Unable to create thumbnail for attachment of message %s: %s", v.ip, m.ID, err.Error())
+		}
+	}
+	return nil
+}
+
+// scanAttachment checks the message's uploaded file with the virus scanner. If the file is infected, or it cannot
+// be scanned, it is removed again, unless other messages reference the same file.
+func (s *Server) scanAttachment(v *visitor, m *message) error {
+	f, _, err := s.fileCache.Read(m.Attachment.Hash)
+	if err != nil {
+		return err
+	}
+	signature, err := s.scanner.Scan(f)
+	f.Close()
+	if err == nil && signature == "" {
+		return nil
+	}
+	if references, err := s.messageCache.AttachmentReferences(m.Attachment.Hash); err == nil && references == 0 {
+		if err := s.fileCache.Remove(m.Attachment.Hash); err != nil {
+			log.Printf("[%s] Unable to remove rejected attachment %s: %s", v.ip, m.Attachment.Hash, err.Error())
+		}
+	}
+	if err != nil {
+		log.Printf("[%s] Unable to scan attachment of message %s: %s", v.ip, m.ID, err.Error())
+		return err
+	}
+	log.Printf("[%s] Rejecting attachment %s of message %s: virus scanner found %s", v.ip, m.Attachment.Name, m.ID, signature)
+	return errHTTPBadRequestAttachmentInfected
+}
+
+// createAttachmentThumbnail stores a thumbnail of the message's uploaded image next to it in the attachment cache,
+// and sets the thumbnail URL. Thumbnails are only created for images larger than thumbnailMaxSize.
+func (s *Server) createAttachmentThumbnail(m *message) error {
+	id := thumbnailFileID(m.Attachment.Hash)
+	if _, err := s.fileCache.Stat(id); err == nil {
+		m.Attachment.Thumbnail = s.fileURL(m, id, ".jpg") // Same image was uploaded before
+		return nil
+	}
+	f, _, err := s.fileCache.Read(m.Attachment.Hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	thumbnail, err := createThumbnail(b)
+	if err != nil {
+		return err
+	} else if thumbnail == nil {
+		return nil // Small enough, clients can use the original
+	}
+	if _, err := s.fileCache.Write(id, bytes.NewReader(thumbnail)); err != nil && err != errFileExists {
+		return err
+	}
+	m.Attachment.Thumbnail = s.fileURL(m, id, ".jpg")
 	return nil
 }
 
+// fileURL returns the download URL of the uploaded file with the given ID. If a signing key is configured, the URL
+// is signed for the message's topic, and is only valid until the attachment expires.
+func (s *Server) fileURL(m *message, id, ext string) string {
+	u := fmt.Sprintf("%s/file/%s%s", s.config.BaseURL, id, ext)
+	if s.urlSigner != nil {
+		u += s.urlSigner.sign(id, m.Topic, m.Attachment.Expires)
+	}
+	return u
+}
+
+// removeAttachments deletes the uploaded files of the given messages, which must have been removed from the
+// message cache already. Files that are still referenced by other messages with the same attachment are kept;
+// they are removed once these messages' attachments expire.
+func (s *Server) removeAttachments(messages ...*message) error {
+	if s.fileCache == nil {
+		return nil
+	}
+	ids := make([]string, 0)
+	for _, m := range messages {
+		if m.Attachment == nil || m.Attachment.Owner == "" { // Only uploaded files have an owner
+			continue
+		}
+		id := attachmentFileID(m)
+		if util.InStringList(ids, id) {
+			continue
+		}
+		if m.Attachment.Hash != "" {
+			references, err := s.messageCache.AttachmentReferences(m.Attachment.Hash)
+			if err != nil {
+				return err
+			} else if references > 0 {
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.fileCache.Remove(withThumbnailFileIDs(ids)...)
+}
+
 func (s *Server) handleSubscribeJSON(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	encoder := func(msg *message) (string, error) {
 		var buf bytes.Buffer
@@ -660,6 +1699,11 @@ func (s *Server) handleSubscribeSSE(w http.ResponseWriter, r *http.Request, v *v
 		}
 		return fmt.Sprintf("data: %s\n", buf.String()), nil
 	}
+	if s.config.EnableSSECompression && acceptsGzip(r) {
+		gw := newGzipStreamWriter(w, s.config.StreamCompressionLevel)
+		defer gw.Close()
+		w = gw
+	}
 	return s.handleSubscribeHTTP(w, r, v, "text/event-stream", encoder)
 }
 
@@ -678,7 +1722,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 		return errHTTPTooManyRequestsLimitSubscriptions
 	}
 	defer v.RemoveSubscription()
-	topics, topicsStr, err := s.topicsFromPath(r.URL.Path)
+	topics, topicsStr, err := s.subscribeTopics(r)
 	if err != nil {
 		return err
 	}
@@ -686,11 +1730,24 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err != nil {
 		return err
 	}
+	matched, patterns, err := s.subscribeTopicPatterns(r, topics, poll, since)
+	if err != nil {
+		return err
+	}
+	topics = append(topics, matched...)
+	if err := s.authorizeSubscribe(r, topics, poll, since); err != nil {
+		return err
+	}
+	limit, err := parseLimit(r, poll, since, scheduled)
+	if err != nil {
+		return err
+	}
+	quiet, err := s.subscribeQuietHours(r, poll)
+	if err != nil {
+		return err
+	}
 	var wlock sync.Mutex
-	sub := func(msg *message) error {
-		if !filters.Pass(msg) {
-			return nil
-		}
+	send := func(msg *message) error {
 		m, err := encoder(msg)
 		if err != nil {
 			return err
@@ -705,9 +1762,20 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 		}
 		return nil
 	}
-	w.Header().Set("Access-Control-Allow-Origin", "*")            // CORS, allow cross-origin requests
-	w.Header().Set("Content-Type", contentType+"; charset=utf-8") // Android/Volley client needs charset!
-	if poll {
+	sub := func(msg *message) error {
+		if !filters.Pass(msg) || quiet.Hold(msg) {
+			return nil
+		}
+		return send(msg)
+	}
+	if contentType != contentTypeProtobuf && contentType != contentTypeCBORSeq {
+		contentType += "; charset=utf-8" // Android/Volley client needs charset!
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	w.Header().Set("Content-Type", contentType)
+	if poll && !since.IsID() && !since.IsNone() && !scheduled {
+		return s.sendMessagePage(w, topics, since, limit, sub)
+	} else if poll {
 		return s.sendOldMessages(topics, since, scheduled, sub)
 	}
 	subscriberIDs := make([]int, 0)
@@ -719,6 +1787,10 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 			topics[i].Unsubscribe(subscriberID) // Order!
 		}
 	}()
+	if patterns != nil {
+		firehoseSubscriberID := s.firehose.Subscribe(patterns.Subscriber(sub))
+		defer s.firehose.Unsubscribe(firehoseSubscriberID)
+	}
 	if err := sub(newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
@@ -731,13 +1803,133 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 			return nil
 		case <-time.After(s.config.KeepaliveInterval):
 			v.Keepalive()
-			if err := sub(newKeepaliveMessage(topicsStr)); err != nil { // Send keepalive message
+			if err := quiet.Flush(time.Now(), send); err != nil { // Send digest of held messages, if quiet hours are over
+				return err
+			} else if err := sub(newKeepaliveMessage(topicsStr)); err != nil { // Send keepalive message
 				return err
 			}
 		}
 	}
 }
 
+// handleSearch returns the cached messages of the given topics that match the search query (q=...), as JSON
+// lines, just like polling. The most recent searchMaxResults matches per topic are returned, oldest first.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	topics, _, err := s.topicsFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	for _, t := range topics {
+		if err := s.authorizeTopics(r, auth.PermissionPoll, t.ID); err != nil {
+			return err
+		}
+	}
+	terms := parseSearchTerms(readParam(r, "x-query", "query", "q"))
+	if len(terms) == 0 {
+		return errHTTPBadRequestSearchQueryInvalid
+	}
+	filters, err := parseQueryFilters(r)
+	if err != nil {
+		return err
+	}
+	messages := make([]*message, 0)
+	for _, t := range topics {
+		topicMessages, err := s.messageCache.SearchMessages(t.ID, terms, searchMaxResults)
+		if err == errCacheCipherSearch {
+			return errHTTPBadRequestSearchEncrypted
+		} else if err != nil {
+			return err
+		}
+		for _, m := range topicMessages {
+			if filters.Pass(m) && !s.cacheExpired(m) {
+				messages = append(messages, m)
+			}
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Time < messages[j].Time
+	})
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	encoder := json.NewEncoder(w)
+	for _, m := range messages {
+		if err := encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleExport writes all cached messages of a topic as JSON lines, including scheduled messages, so that
+// they can be imported into another server using handleImport
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	topics, topicsStr, err := s.topicsFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	messages, err := s.messageCache.Messages(topics[0].ID, sinceAllMessages, true)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.ndjson", topicsStr))
+	encoder := json.NewEncoder(w)
+	for _, m := range messages {
+		if err := encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleImport adds the messages in the request body (JSON lines, as written by handleExport) to the message
+// cache of the topic. Messages are not delivered to subscribers, and messages that exist already are skipped,
+// so that an import can be safely repeated. The body is parsed entirely before anything is imported.
+func (s *Server) handleImport(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	if s.config.CacheDuration == 0 {
+		return errHTTPBadRequestImportCacheDisabled
+	}
+	topics, _, err := s.topicsFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	t := topics[0]
+	messages := make([]*message, 0)
+	decoder := json.NewDecoder(r.Body)
+	for {
+		var m message
+		if err := decoder.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil || m.Event != messageEvent || !validMessageID(m.ID) || m.Time <= 0 {
+			return errHTTPBadRequestImportInvalid
+		}
+		m.Topic = t.ID
+		messages = append(messages, &m)
+	}
+	existing, err := s.messageCache.Messages(t.ID, sinceAllMessages, true)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool)
+	for _, m := range existing {
+		ids[m.ID] = true
+	}
+	response := &importResponse{}
+	for _, m := range messages {
+		if ids[m.ID] {
+			response.Skipped++
+			continue
+		}
+		if err := s.messageCache.AddMessage(m); err != nil {
+			return err
+		}
+		ids[m.ID] = true
+		response.Imported++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(response)
+}
+
 func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	if strings.ToLower(r.Header.Get("Upgrade")) != "websocket" {
 		return errHTTPBadRequestWebSocketsUpgradeHeaderMissing
@@ -746,7 +1938,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 		return errHTTPTooManyRequestsLimitSubscriptions
 	}
 	defer v.RemoveSubscription()
-	topics, topicsStr, err := s.topicsFromPath(r.URL.Path)
+	topics, topicsStr, err := s.subscribeTopics(r)
 	if err != nil {
 		return err
 	}
@@ -754,9 +1946,22 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err != nil {
 		return err
 	}
+	matched, patterns, err := s.subscribeTopicPatterns(r, topics, poll, since)
+	if err != nil {
+		return err
+	}
+	topics = append(topics, matched...)
+	if err := s.authorizeSubscribe(r, topics, poll, since); err != nil {
+		return err
+	}
+	quiet, err := s.subscribeQuietHours(r, poll)
+	if err != nil {
+		return err
+	}
 	upgrader := &websocket.Upgrader{
-		ReadBufferSize:  wsBufferSize,
-		WriteBufferSize: wsBufferSize,
+		ReadBufferSize:    wsBufferSize,
+		WriteBufferSize:   wsBufferSize,
+		EnableCompression: s.config.EnableWebSocketCompression, // Only used if the client offers permessage-deflate
 		CheckOrigin: func(r *http.Request) bool {
 			return true // We're open for business!
 		},
@@ -766,6 +1971,11 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 		return err
 	}
 	defer conn.Close()
+	if s.config.EnableWebSocketCompression {
+		if err := conn.SetCompressionLevel(s.config.StreamCompressionLevel); err != nil {
+			return err
+		}
+	}
 	var wlock sync.Mutex
 	g, ctx := errgroup.WithContext(context.Background())
 	g.Go(func() error {
@@ -784,6 +1994,14 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			}
 		}
 	})
+	send := func(msg *message) error {
+		wlock.Lock()
+		defer wlock.Unlock()
+		if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+			return err
+		}
+		return conn.WriteJSON(msg)
+	}
 	g.Go(func() error {
 		ping := func() error {
 			wlock.Lock()
@@ -801,20 +2019,17 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 				v.Keepalive()
 				if err := ping(); err != nil {
 					return err
+				} else if err := quiet.Flush(time.Now(), send); err != nil {
+					return err
 				}
 			}
 		}
 	})
 	sub := func(msg *message) error {
-		if !filters.Pass(msg) {
+		if !filters.Pass(msg) || quiet.Hold(msg) {
 			return nil
 		}
-		wlock.Lock()
-		defer wlock.Unlock()
-		if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
-			return err
-		}
-		return conn.WriteJSON(msg)
+		return send(msg)
 	}
 	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
 	if poll {
@@ -829,6 +2044,10 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			topics[i].Unsubscribe(subscriberID) // Order!
 		}
 	}()
+	if patterns != nil {
+		firehoseSubscriberID := s.firehose.Subscribe(patterns.Subscriber(sub))
+		defer s.firehose.Unsubscribe(firehoseSubscriberID)
+	}
 	if err := sub(newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
@@ -861,12 +2080,20 @@ func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled b
 		return nil
 	}
 	for _, t := range topics {
-		messages, err := s.messageCache.Messages(t.ID, since, scheduled)
+		var messages []*message
+		var err error
+		if since.IsCursor() {
+			messages, err = s.messageCache.MessagesAfter(t.ID, since, 0)
+		} else {
+			messages, err = s.messageCache.Messages(t.ID, since, scheduled)
+		}
 		if err != nil {
 			return err
 		}
 		for _, m := range messages {
-			if err := sub(m); err != nil {
+			if s.cacheExpired(m) {
+				continue
+			} else if err := sub(m); err != nil {
 				return err
 			}
 		}
@@ -874,10 +2101,63 @@ func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled b
 	return nil
 }
 
+// sendMessagePage sends up to limit cached messages (0 means all) after the given cursor or timestamp. If the limit
+// is exceeded, the messages of all topics are merged by time before cutting off the page. The cursor of the last message is returned in the X-Cursor header, so that clients can
+// fetch the next page with since=<cursor>, without missing or repeating messages published in the same second.
+func (s *Server) sendMessagePage(w http.ResponseWriter, topics []*topic, since sinceMarker, limit int, sub subscriber) error {
+	cursor := since
+	if !since.IsCursor() {
+		cursor = newSinceCursor(since.Time().Unix(), 0)
+	}
+	messages := make([]*message, 0)
+	for _, t := range topics {
+		topicMessages, err := s.messageCache.MessagesAfter(t.ID, cursor, limit)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, topicMessages...)
+	}
+	if limit > 0 && len(messages) > limit {
+		sort.Slice(messages, func(i, j int) bool {
+			return messages[i].cursor.Before(messages[j].cursor)
+		})
+		messages = messages[:limit]
+	}
+	for _, m := range messages {
+		if cursor.Before(m.cursor) {
+			cursor = m.cursor
+		}
+	}
+	w.Header().Set("X-Cursor", cursor.String())
+	w.Header().Set("Access-Control-Expose-Headers", "X-Cursor")
+	for _, m := range messages {
+		if s.cacheExpired(m) {
+			continue
+		} else if err := sub(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLimit returns the maximum number of messages to return when polling (limit=...), or 0 for no limit.
+// Limits are only supported for pages of published messages, so not with since=<id> or scheduled=1.
+func parseLimit(r *http.Request, poll bool, since sinceMarker, scheduled bool) (int, error) {
+	value := readParam(r, "x-limit", "limit")
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 || !poll || since.IsID() || scheduled {
+		return 0, errHTTPBadRequestLimitInvalid
+	}
+	return limit, nil
+}
+
 // parseSince returns a timestamp identifying the time span from which cached messages should be received.
 //
-// Values in the "since=..." parameter can be either a unix timestamp or a duration (e.g. 12h), or
-// "all" for all messages.
+// Values in the "since=..." parameter can be either a unix timestamp or a duration (e.g. 12h), a message ID,
+// a cursor (as returned in the X-Cursor header of a poll response), or "all" for all messages.
 func parseSince(r *http.Request, poll bool) (sinceMarker, error) {
 	since := readParam(r, "x-since", "since", "si")
 
@@ -893,9 +2173,15 @@ func parseSince(r *http.Request, poll bool) (sinceMarker, error) {
 		return sinceNoMessages, nil
 	}
 
-	// ID, timestamp, duration
+	// ID, cursor, timestamp, duration
 	if validMessageID(since) {
 		return newSinceID(since), nil
+	} else if strings.HasPrefix(since, sinceCursorPrefix) {
+		cursor, err := parseSinceCursor(since)
+		if err != nil {
+			return sinceNoMessages, errHTTPBadRequestSinceInvalid
+		}
+		return cursor, nil
 	} else if s, err := strconv.ParseInt(since, 10, 64); err == nil {
 		return newSinceTime(s), nil
 	} else if d, err := time.ParseDuration(since); err == nil {
@@ -905,7 +2191,7 @@ func parseSince(r *http.Request, poll bool) (sinceMarker, error) {
 }
 
 func (s *Server) handleOptions(w http.ResponseWriter, _ *http.Request) error {
-	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE")
 	w.Header().Set("Access-Control-Allow-Origin", "*")  // CORS, allow cross-origin requests
 	w.Header().Set("Access-Control-Allow-Headers", "*") // CORS, allow auth via JS // FIXME is this terrible?
 	return nil
@@ -923,12 +2209,30 @@ func (s *Server) topicFromPath(path string) (*topic, error) {
 	return topics[0], nil
 }
 
+// cacheExpired returns true if the message is older than the cache duration of its topic, or if its own
+// expiry has passed. Such messages are not handed out anymore, even if they have not been pruned yet.
+func (s *Server) cacheExpired(m *message) bool {
+	if m.Expires > 0 && m.Expires <= time.Now().Unix() {
+		return true
+	}
+	duration, ok := s.config.CacheDurationTopics[m.Topic]
+	if !ok {
+		duration = s.config.CacheDuration
+	}
+	return m.Time < time.Now().Add(-1*duration).Unix()
+}
+
 func (s *Server) topicsFromPath(path string) ([]*topic, string, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
 		return nil, "", errHTTPBadRequestTopicInvalid
 	}
-	topicIDs := util.SplitNoEmpty(parts[1], ",")
+	topicIDs := make([]string, 0)
+	for _, id := range util.SplitNoEmpty(parts[1], ",") {
+		if !strings.Contains(id, topicWildcard) { // Patterns are matched in subscribeTopicPatterns
+			topicIDs = append(topicIDs, id)
+		}
+	}
 	topics, err := s.topicsFromIDs(topicIDs...)
 	if err != nil {
 		return nil, "", errHTTPBadRequestTopicInvalid
@@ -966,11 +2270,32 @@ func (s *Server) updateStatsAndPrune() {
 		}
 	}
 
+	// Expire abandoned OIDC login flows
+	for state, login := range s.oidcLogins {
+		if time.Now().After(login.expires) {
+			delete(s.oidcLogins, state)
+		}
+	}
+
+	// Expire sign-ups whose e-mail address was never verified
+	for token, pending := range s.signups {
+		if time.Now().After(pending.expires) {
+			delete(s.signups, token)
+		}
+	}
+
+	// Expire phone number verifications that were never completed
+	for username, pending := range s.phoneCodes {
+		if time.Now().After(pending.expires) {
+			delete(s.phoneCodes, username)
+		}
+	}
+
 	// Delete expired attachments
 	if s.fileCache != nil {
 		ids, err := s.messageCache.AttachmentsExpired()
 		if err == nil {
-			if err := s.fileCache.Remove(ids...); err != nil {
+			if err := s.fileCache.Remove(withThumbnailFileIDs(ids)...); err != nil {
 				log.Printf("error while deleting attachments: %s", err.Error())
 			}
 		} else {
@@ -978,10 +2303,17 @@ func (s *Server) updateStatsAndPrune() {
 		}
 	}
 
-	// Prune message cache
-	olderThan := time.Now().Add(-1 * s.config.CacheDuration)
-	if err := s.messageCache.Prune(olderThan); err != nil {
-		log.Printf("error pruning cache: %s", err.Error())
+	// Prune message cache, unless the server is in read-only mode
+	if !s.readOnly {
+		now := time.Now()
+		olderThan := now.Add(-1 * s.config.CacheDuration)
+		topicOlderThan := make(map[string]time.Time)
+		for topic, duration := range s.config.CacheDurationTopics {
+			topicOlderThan[topic] = now.Add(-1 * duration)
+		}
+		if err := s.messageCache.Prune(olderThan, topicOlderThan); err != nil {
+			log.Printf("error pruning cache: %s", err.Error())
+		}
 	}
 
 	// Prune old topics, remove subscriptions without subscribers
@@ -1001,9 +2333,10 @@ func (s *Server) updateStatsAndPrune() {
 		messages += msgs
 	}
 
-	// Mail stats
+	// Mail stats, and prune e-mail topic limiters
 	var mailSuccess, mailFailure int64
 	if s.smtpBackend != nil {
+		s.smtpBackend.Prune()
 		mailSuccess, mailFailure = s.smtpBackend.Counts()
 	}
 
@@ -1012,40 +2345,111 @@ func (s *Server) updateStatsAndPrune() {
 		s.messages, messages, mailSuccess, mailFailure, len(s.topics), subscribers, len(s.visitors))
 }
 
-func (s *Server) runSMTPServer() error {
-	sub := func(m *message) error {
-		url := fmt.Sprintf("%s/%s", s.config.BaseURL, m.Topic)
-		req, err := http.NewRequest("PUT", url, strings.NewReader(m.Message))
+// newSMTPBackend creates the backend that is shared by the SMTP and the LMTP server
+func (s *Server) newSMTPBackend() *smtpBackend {
+	visitorFn := func(ip string) *visitor {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.visitorFromIP(ip)
+	}
+	sub := func(senderIP string, m *message, a *mailAttachment) error {
+		topicURL := fmt.Sprintf("%s/%s", s.config.BaseURL, m.Topic)
+		var body io.Reader = strings.NewReader(m.Message)
+		if a != nil && s.fileCache != nil {
+			// Attachments are uploaded as the request body, so the message has to be passed as a query param;
+			// newlines are escaped, since they are unescaped in parsePublishParams
+			topicURL += "?message=" + url.QueryEscape(strings.ReplaceAll(m.Message, "\n", "\\n"))
+			body = bytes.NewReader(a.Body)
+		}
+		req, err := http.NewRequest("PUT", topicURL, body)
 		if err != nil {
 			return err
 		}
 		if m.Title != "" {
 			req.Header.Set("Title", m.Title)
 		}
+		if m.Priority != 0 {
+			req.Header.Set("Priority", strconv.Itoa(m.Priority))
+		}
+		if len(m.Tags) > 0 {
+			req.Header.Set("Tags", strings.Join(m.Tags, ","))
+		}
+		if m.Click != "" {
+			req.Header.Set("Click", m.Click)
+		}
+		if m.Group != "" {
+			req.Header.Set("Group", m.Group)
+		}
+		if a != nil && s.fileCache != nil {
+			req.Header.Set("Filename", a.Name)
+		}
+		req.RemoteAddr = senderIP // Rate limiting is done based on the IP of the SMTP client
 		rr := httptest.NewRecorder()
 		s.handle(rr, req)
-		if rr.Code != http.StatusOK {
+		if rr.Code == http.StatusTooManyRequests {
+			return errRateLimitReached
+		} else if rr.Code == http.StatusForbidden {
+			return errUnauthorizedTopic
+		} else if rr.Code != http.StatusOK {
 			return errors.New("error: " + rr.Body.String())
 		}
 		return nil
 	}
-	s.smtpBackend = newMailBackend(s.config, sub)
-	s.smtpServer = smtp.NewServer(s.smtpBackend)
-	s.smtpServer.Addr = s.config.SMTPServerListen
-	s.smtpServer.Domain = s.config.SMTPServerDomain
-	s.smtpServer.ReadTimeout = 10 * time.Second
-	s.smtpServer.WriteTimeout = 10 * time.Second
-	s.smtpServer.MaxMessageBytes = 1024 * 1024 // Must be much larger than message size (headers, multipart, etc.)
-	s.smtpServer.MaxRecipients = 1
-	s.smtpServer.AllowInsecureAuth = true
+	var authorizeFn func(topic string) error
+	if s.config.SMTPServerCheckAccess && s.auth != nil {
+		authorizeFn = func(topic string) error {
+			return s.auth.Authorize(nil, topic, auth.PermissionPublish) // E-mails are always published anonymously
+		}
+	}
+	return newMailBackend(s.config, visitorFn, authorizeFn, sub)
+}
+
+func (s *Server) newSMTPServer(addr string) *smtp.Server {
+	server := smtp.NewServer(s.smtpBackend)
+	server.Addr = addr
+	server.Domain = s.config.SMTPServerDomain
+	server.ReadTimeout = 10 * time.Second
+	server.WriteTimeout = 10 * time.Second
+	server.MaxMessageBytes = int(smtpMaxMessageBytes(s.config)) // Must be much larger than message size (headers, multipart, etc.)
+	server.MaxRecipients = s.config.SMTPServerMaxRecipients
+	server.AllowInsecureAuth = true
+	return server
+}
+
+func (s *Server) runSMTPServer() error {
+	s.smtpServer = s.newSMTPServer(s.config.SMTPServerListen)
+	if s.config.SMTPServerTLSCertFile != "" && s.config.SMTPServerTLSKeyFile != "" {
+		certReloader, err := util.NewCertReloader(s.config.SMTPServerTLSCertFile, s.config.SMTPServerTLSKeyFile)
+		if err != nil {
+			return err
+		}
+		s.smtpServer.TLSConfig = &tls.Config{GetCertificate: certReloader.GetCertificate} // Enables STARTTLS
+	}
+	if s.config.SMTPServerProxyProtocol {
+		listener, err := net.Listen("tcp", s.config.SMTPServerListen)
+		if err != nil {
+			return err
+		}
+		return s.smtpServer.Serve(util.NewProxyProtocolListener(listener, s.smtpServer.ReadTimeout))
+	}
 	return s.smtpServer.ListenAndServe()
 }
 
+func (s *Server) runLMTPServer() error {
+	s.lmtpServer = s.newSMTPServer(s.config.SMTPServerListenLMTP)
+	s.lmtpServer.LMTP = true // Listens on a Unix socket
+	os.Remove(s.config.SMTPServerListenLMTP)
+	return s.lmtpServer.ListenAndServe()
+}
+
 func (s *Server) runManager() {
 	for {
 		select {
 		case <-time.After(s.config.ManagerInterval):
 			s.updateStatsAndPrune()
+			if err := s.updateTopicIPRules(); err != nil {
+				log.Printf("Unable to update IP address restrictions of reserved topics: %s", err.Error())
+			}
 		case <-s.closeChan:
 			return
 		}
@@ -1056,9 +2460,32 @@ func (s *Server) runAtSender() {
 	for {
 		select {
 		case <-time.After(s.config.AtSenderInterval):
+			if s.readOnlyMode() {
+				continue // Scheduled messages and retries write to the cache, so they wait until the mode is turned off
+			}
 			if err := s.sendDelayedMessages(); err != nil {
 				log.Printf("error sending scheduled messages: %s", err.Error())
 			}
+			if err := s.sendRecurringMessages(); err != nil {
+				log.Printf("error sending recurring messages: %s", err.Error())
+			}
+			if err := s.sendEscalations(); err != nil {
+				log.Printf("error sending escalations: %s", err.Error())
+			}
+			if err := s.sendHeartbeatAlerts(); err != nil {
+				log.Printf("error sending heartbeat alerts: %s", err.Error())
+			}
+			if err := s.sendQueuedWebhooks(); err != nil {
+				log.Printf("error sending queued webhooks: %s", err.Error())
+			}
+			if s.mailer != nil {
+				if err := s.sendEmailDigests(); err != nil {
+					log.Printf("error sending email digests: %s", err.Error())
+				}
+				if err := s.sendQueuedEmails(); err != nil {
+					log.Printf("error sending queued emails: %s", err.Error())
+				}
+			}
 		case <-s.closeChan:
 			return
 		}
@@ -1082,31 +2509,128 @@ func (s *Server) runFirebaseKeepaliver() {
 }
 
 func (s *Server) sendDelayedMessages() error {
+	published, err := s.publishDelayedMessages()
+	for _, m := range published { // Outside of the lock, see heartbeatReceived
+		if err := s.heartbeatReceived(m); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// publishDelayedMessages publishes all scheduled messages that are due, and returns the ones that were published
+func (s *Server) publishDelayedMessages() ([]*message, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	messages, err := s.messageCache.MessagesDue()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	published := make([]*message, 0, len(messages))
 	for _, m := range messages {
 		t, ok := s.topics[m.Topic] // If no subscribers, just mark message as published
+		if err := s.collapseMessages(t, m); err != nil {
+			return published, err
+		}
 		if ok {
 			if err := t.Publish(m); err != nil {
 				log.Printf("unable to publish message %s to topic %s: %v", m.ID, m.Topic, err.Error())
 			}
 		}
+		s.publishFirehose(m)
+		go s.forwardWebhooks(m)
+		s.forwardMatrix(m)
+		go s.forwardTelegram(m)
 		if s.firebase != nil { // Firebase subscribers may not show up in topics map
 			if err := s.firebase(m); err != nil {
 				log.Printf("unable to publish to Firebase: %v", err.Error())
 			}
 		}
 		if err := s.messageCache.MarkPublished(m); err != nil {
+			return published, err
+		}
+		published = append(published, m)
+	}
+	return published, nil
+}
+
+// sendEmail sends the message as e-mail. If sending fails with a transient error (e.g. greylisting, or the SMTP
+// server is unreachable), the e-mail is added to the retry queue, see sendQueuedEmails.
+func (s *Server) sendEmail(senderIP, to string, m *message) {
+	if err := s.mailer.Send(senderIP, to, m); err != nil {
+		log.Printf("[%s] MAIL - Unable to send email: %v", senderIP, err.Error())
+		s.retryEmail(&queuedEmail{SenderIP: senderIP, To: to, Message: m, Attempts: 1, Queued: time.Now().Unix()}, err)
+		return
+	}
+	s.mu.Lock()
+	s.emailMetrics.Sent++
+	s.mu.Unlock()
+}
+
+// sendQueuedEmails retries sending all queued e-mails that are due. Unlike sendDelayedMessages, it does not hold
+// the lock while sending, since talking to the SMTP server or mail provider may take a while.
+func (s *Server) sendQueuedEmails() error {
+	emails, err := s.messageCache.EmailsDue()
+	if err != nil {
+		return err
+	}
+	for _, e := range emails {
+		if err := s.mailer.Send(e.SenderIP, e.To, e.Message); err != nil {
+			e.Attempts++
+			log.Printf("[%s] MAIL - Unable to send queued email (attempt %d): %v", e.SenderIP, e.Attempts, err.Error())
+			s.retryEmail(e, err)
+			continue
+		}
+		if err := s.messageCache.DeleteEmail(e.ID); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.emailMetrics.Sent++
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// sendEmailDigests sends all e-mail digests whose window has passed, see X-Email-Digest
+func (s *Server) sendEmailDigests() error {
+	digests, err := s.messageCache.EmailDigestsDue()
+	if err != nil {
+		return err
+	}
+	for _, d := range digests {
+		s.sendEmail(d.SenderIP, d.To, newEmailDigestMessage(d)) // Failed e-mails end up in the retry queue
+		if err := s.messageCache.DeleteEmailDigest(d); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// retryEmail schedules the next attempt with exponential backoff, or gives up if the error is permanent or the
+// next attempt would exceed the max age (smtp-sender-retry-max-age)
+func (s *Server) retryEmail(e *queuedEmail, err error) {
+	next := time.Now().Add(mailRetryBackoff(e.Attempts))
+	if mailErrorPermanent(err) || next.After(time.Unix(e.Queued, 0).Add(s.config.SMTPSenderRetryMaxAge)) {
+		if e.ID != 0 {
+			if err := s.messageCache.DeleteEmail(e.ID); err != nil {
+				log.Printf("[%s] MAIL - Unable to remove email from queue: %v", e.SenderIP, err.Error())
+			}
+		}
+		s.mu.Lock()
+		s.emailMetrics.Failed++
+		s.mu.Unlock()
+		return
+	}
+	e.NextAttempt = next.Unix()
+	if err := s.messageCache.QueueEmail(e); err != nil {
+		log.Printf("[%s] MAIL - Unable to queue email for retry: %v", e.SenderIP, err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.emailMetrics.Retried++
+	s.mu.Unlock()
+}
+
 func (s *Server) limitRequests(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		if util.InStringList(s.config.VisitorRequestExemptIPAddrs, v.ip) {
@@ -1118,8 +2642,8 @@ func (s *Server) limitRequests(next handleFunc) handleFunc {
 	}
 }
 
-// transformBodyJSON peeks the request body, reads the JSON, and converts it to headers
-// before passing it on to the next handler. This is meant to be used in combination with handlePublish.
+// transformBodyJSON peeks the request body, reads the JSON (or protobuf or CBOR, see decodePublishMessage), and
+// converts it to headers before passing it on to the next handler. This is meant to be used in combination with handlePublish.
 func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
 		body, err := util.Peek(r.Body, s.config.MessageLimit)
@@ -1128,58 +2652,191 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		}
 		defer r.Body.Close()
 		var m publishMessage
-		if err := json.NewDecoder(body).Decode(&m); err != nil {
-			return errHTTPBadRequestJSONInvalid
+		if err := decodePublishMessage(r, body, &m); err != nil {
+			return err
 		}
 		if !topicRegex.MatchString(m.Topic) {
 			return errHTTPBadRequestTopicInvalid
 		}
-		if m.Message == "" {
-			m.Message = emptyMessageBody
+		if err := rewritePublishRequest(r, &m); err != nil {
+			return err
 		}
-		r.URL.Path = "/" + m.Topic
-		r.Body = io.NopCloser(strings.NewReader(m.Message))
-		if m.Title != "" {
-			r.Header.Set("X-Title", m.Title)
+		return next(w, r, v)
+	}
+}
+
+// rewritePublishRequest turns the request into a regular publish request (PUT /<topic>) for the message, so it can be
+// handled by handlePublish: the body becomes the message, and all other fields are passed as headers
+func rewritePublishRequest(r *http.Request, m *publishMessage) error {
+	if m.Message == "" {
+		m.Message = emptyMessageBody
+	}
+	r.URL.Path = "/" + m.Topic
+	r.Body = io.NopCloser(strings.NewReader(m.Message))
+	if m.Title != "" {
+		r.Header.Set("X-Title", m.Title)
+	}
+	if m.Priority != 0 {
+		r.Header.Set("X-Priority", fmt.Sprintf("%d", m.Priority))
+	}
+	if m.Tags != nil && len(m.Tags) > 0 {
+		r.Header.Set("X-Tags", strings.Join(m.Tags, ","))
+	}
+	if m.Attach != "" {
+		r.Header.Set("X-Attach", m.Attach)
+	}
+	if m.Filename != "" {
+		r.Header.Set("X-Filename", m.Filename)
+	}
+	if m.Click != "" {
+		r.Header.Set("X-Click", m.Click)
+	}
+	if m.Group != "" {
+		r.Header.Set("X-Group", m.Group)
+	}
+	if len(m.Actions) > 0 {
+		actionsStr, err := json.Marshal(m.Actions)
+		if err != nil {
+			return errHTTPBadRequestJSONInvalid
 		}
-		if m.Priority != 0 {
-			r.Header.Set("X-Priority", fmt.Sprintf("%d", m.Priority))
+		r.Header.Set("X-Actions", string(actionsStr))
+	}
+	if m.Email != "" {
+		r.Header.Set("X-Email", m.Email)
+	}
+	if m.EmailDigest != "" {
+		r.Header.Set("X-Email-Digest", m.EmailDigest)
+	}
+	if m.SMS != "" {
+		r.Header.Set("X-SMS", m.SMS)
+	}
+	if m.Call != "" {
+		r.Header.Set("X-Call", m.Call)
+	}
+	if m.Delay != "" {
+		r.Header.Set("X-Delay", m.Delay)
+	}
+	if m.InReplyTo != "" {
+		r.Header.Set("X-In-Reply-To", m.InReplyTo)
+	}
+	if m.AckRequired {
+		r.Header.Set("X-Ack-Required", "1")
+	}
+	if m.CollapseKey != "" {
+		r.Header.Set("X-Collapse-Key", m.CollapseKey)
+	}
+	if m.Markdown {
+		r.Header.Set("X-Markdown", "1")
+	}
+	return nil
+}
+
+// authWrite checks the publish permission. Attaching files and forwarding e-mails require additional
+// permissions, which are checked when the message is parsed (see authorizeTopics).
+func (s *Server) authWrite(next handleFunc) handleFunc {
+	return s.withAuth(next, auth.PermissionPublish)
+}
+
+// authPublish is like authWrite, but also accepts pre-signed publish URLs (see publishURLSigner) instead of
+// credentials. URLs signed with the secret of a user are authorized with the permissions of that user.
+func (s *Server) authPublish(next handleFunc) handleFunc {
+	authWrite := s.authWrite(next)
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if s.auth == nil || s.pubSigner == nil || r.URL.Query().Get("sig") == "" {
+			return authWrite(w, r, v)
 		}
-		if m.Tags != nil && len(m.Tags) > 0 {
-			r.Header.Set("X-Tags", strings.Join(m.Tags, ","))
+		t, err := s.topicFromPath(r.URL.Path)
+		if err != nil {
+			return err
 		}
-		if m.Attach != "" {
-			r.Header.Set("X-Attach", m.Attach)
+		username, err := s.pubSigner.verify(t.ID, r.URL.Query())
+		if err != nil {
+			log.Printf("[%s] unauthorized: %s", v.ip, err.Error())
+			return errHTTPForbiddenPublishURLInvalid
+		} else if username == "" {
+			return next(w, r, v)
 		}
-		if m.Filename != "" {
-			r.Header.Set("X-Filename", m.Filename)
+		manager, ok := s.auth.(auth.Manager)
+		if !ok {
+			return errHTTPForbiddenPublishURLInvalid // Users of external identity providers cannot be looked up
 		}
-		if m.Click != "" {
-			r.Header.Set("X-Click", m.Click)
+		user, err := manager.User(username)
+		if err != nil {
+			log.Printf("[%s] unauthorized: publish URL signed for unknown user %s", v.ip, username)
+			return errHTTPForbiddenPublishURLInvalid
+		} else if err := s.auth.Authorize(user, t.ID, auth.PermissionPublish); err != nil {
+			log.Printf("unauthorized: %s", err.Error())
+			return errHTTPForbidden
 		}
-		if len(m.Actions) > 0 {
-			actionsStr, err := json.Marshal(m.Actions)
-			if err != nil {
-				return errHTTPBadRequestJSONInvalid
+		return next(w, withUser(r, user), v)
+	}
+}
+
+// authRead checks the read permission, i.e. that the user may subscribe or poll. The subscribe
+// endpoints check which of the two is needed, see authorizeSubscribe.
+func (s *Server) authRead(next handleFunc) handleFunc {
+	return s.withAuth(next, auth.PermissionRead)
+}
+
+// authorizeSubscribe checks the fine-grained permissions of a subscription: receiving new messages requires
+// the subscribe permission, and retrieving cached messages (poll=1, or since=...) the poll permission
+func (s *Server) authorizeSubscribe(r *http.Request, topics []*topic, poll bool, since sinceMarker) error {
+	for _, t := range topics {
+		if !poll {
+			if err := s.authorizeTopics(r, auth.PermissionSubscribe, t.ID); err != nil {
+				return err
 			}
-			r.Header.Set("X-Actions", string(actionsStr))
 		}
-		if m.Email != "" {
-			r.Header.Set("X-Email", m.Email)
-		}
-		if m.Delay != "" {
-			r.Header.Set("X-Delay", m.Delay)
+		if poll || !since.IsNone() {
+			if err := s.authorizeTopics(r, auth.PermissionPoll, t.ID); err != nil {
+				return err
+			}
 		}
-		return next(w, r, v)
 	}
+	return nil
 }
 
-func (s *Server) authWrite(next handleFunc) handleFunc {
-	return s.withAuth(next, auth.PermissionWrite)
+// authorizeTopics checks a permission for the user authenticated by withAuth (or the anonymous user), in
+// addition to the permission checked by withAuth itself. It does nothing if access control is not enabled.
+func (s *Server) authorizeTopics(r *http.Request, perm auth.Permission, topics ...string) error {
+	if s.auth == nil {
+		return nil
+	}
+	for _, topic := range topics {
+		if err := s.auth.Authorize(userFromRequest(r), topic, perm); err != nil {
+			log.Printf("unauthorized: %s", err.Error())
+			s.auditAccessDenied(r, userFromRequest(r), topic, perm, err.Error())
+			return errHTTPForbidden
+		}
+	}
+	return nil
 }
 
-func (s *Server) authRead(next handleFunc) handleFunc {
-	return s.withAuth(next, auth.PermissionRead)
+// authAdmin only lets admin users through. If access control is not enabled, everyone is let through, just
+// like for all other endpoints.
+func (s *Server) authAdmin(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if s.auth == nil {
+			return next(w, r, v)
+		}
+		user, err := s.authenticate(r)
+		if err != nil {
+			return err
+		} else if user == nil {
+			return errHTTPUnauthorized
+		} else if user.Role != auth.RoleAdmin {
+			log.Printf("unauthorized: user %s is not an admin", user.Name)
+			s.auditAccessDenied(r, user, "", 0, "user is not an admin")
+			return errHTTPForbidden
+		} else if user.Token != nil {
+			log.Printf("unauthorized: access tokens of user %s cannot be used for admin endpoints", user.Name)
+			s.auditAccessDenied(r, user, "", 0, "access tokens cannot be used for admin endpoints")
+			return errHTTPForbidden
+		} else if err := s.verifyTOTP(r, user); err != nil {
+			return err
+		}
+		return next(w, withUser(r, user), v)
+	}
 }
 
 func (s *Server) withAuth(next handleFunc, perm auth.Permission) handleFunc {
@@ -1191,24 +2848,74 @@ func (s *Server) withAuth(next handleFunc, perm auth.Permission) handleFunc {
 		if err != nil {
 			return err
 		}
-		var user *auth.User // may stay nil if no auth header!
-		username, password, ok := extractUserPass(r)
-		if ok {
-			if user, err = s.auth.Authenticate(username, password); err != nil {
-				log.Printf("authentication failed: %s", err.Error())
-				return errHTTPUnauthorized
-			}
+		user, err := s.authenticate(r) // may be nil if no auth header!
+		if err != nil {
+			return err
 		}
 		for _, t := range topics {
 			if err := s.auth.Authorize(user, t.ID, perm); err != nil {
 				log.Printf("unauthorized: %s", err.Error())
+				s.auditAccessDenied(r, user, t.ID, perm, err.Error())
 				return errHTTPForbidden
 			}
 		}
+		if user != nil {
+			r = withUser(r, user)
+		}
 		return next(w, r, v)
 	}
 }
 
+// authenticate returns the user for the credentials in the request, or nil if the request has no credentials.
+// Bearer tokens are only accepted if the auth backend supports them, see auth.TokenAuther. A verified client
+// certificate is only used if the request has no other credentials, see authenticateClientCert. The auth proxy
+// header takes precedence over all other credentials, since the proxy already authenticated the user.
+func (s *Server) authenticate(r *http.Request) (*auth.User, error) {
+	var user *auth.User
+	var err error
+	event := &auditEvent{Event: auditEventAuthFailed}
+	if username, ok := s.authProxyUsername(r); ok {
+		event.User = username
+		user, err = s.authenticateProxyUser(r, username)
+	} else if token, ok := extractBearerToken(r); ok {
+		tokenAuther, ok := s.auth.(auth.TokenAuther)
+		if !ok {
+			return nil, errHTTPUnauthorized
+		}
+		event.Token = auditToken(token)
+		user, err = tokenAuther.AuthenticateToken(token)
+	} else if username, password, ok := extractUserPass(r); ok {
+		event.User = username
+		user, err = s.auth.Authenticate(username, password)
+	} else if cert, ok := verifiedClientCert(r); ok && s.clientCAs != nil {
+		event.User = cert.Subject.CommonName
+		user, err = s.authenticateClientCert(cert)
+	} else {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("authentication failed: %s", err.Error())
+		event.Reason = err.Error()
+		s.audit(r, event)
+		return nil, errHTTPUnauthorized
+	}
+	return user, nil
+}
+
+// userContextKey is the key of the authenticated user in the request context, see withUser
+type userContextKey struct{}
+
+// withUser attaches the authenticated user to the request, so that handlers do not have to authenticate again
+func withUser(r *http.Request, user *auth.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+}
+
+// userFromRequest returns the user authenticated by withAuth or authAdmin, or nil for anonymous requests
+func userFromRequest(r *http.Request) *auth.User {
+	user, _ := r.Context().Value(userContextKey{}).(*auth.User)
+	return user
+}
+
 // extractUserPass reads the username/password from the basic auth header (Authorization: Basic ...),
 // or from the ?auth=... query param. The latter is required only to support the WebSocket JavaScript
 // class, which does not support passing headers during the initial request. The auth query param
@@ -1230,11 +2937,32 @@ func extractUserPass(r *http.Request) (username string, password string, ok bool
 	return
 }
 
+// extractBearerToken reads the token from the bearer auth header (Authorization: Bearer ...), or from the
+// ?auth=... query param, in the same format as described in extractUserPass, i.e. base64(Bearer <token>).
+func extractBearerToken(r *http.Request) (token string, ok bool) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		if a, err := base64.RawURLEncoding.DecodeString(readQueryParam(r, "authorization", "auth")); err == nil {
+			header = string(a)
+		}
+	}
+	if len(header) <= len(bearerAuthPrefix) || !strings.EqualFold(header[:len(bearerAuthPrefix)], bearerAuthPrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(bearerAuthPrefix):]), true
+}
+
 // visitor creates or retrieves a rate.Limiter for the given visitor.
 // This function was taken from https://www.alexedwards.net/blog/how-to-rate-limit-http-requests (MIT).
 func (s *Server) visitor(r *http.Request) *visitor {
+	ip := s.visitorIP(r)
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	return s.visitorFromIP(ip)
+}
+
+// visitorIP returns the IP address of the client, or of the X-Forwarded-For header if behind-proxy is set
+func (s *Server) visitorIP(r *http.Request) string {
 	remoteAddr := r.RemoteAddr
 	ip, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
@@ -1243,6 +2971,11 @@ func (s *Server) visitor(r *http.Request) *visitor {
 	if s.config.BehindProxy && r.Header.Get("X-Forwarded-For") != "" {
 		ip = r.Header.Get("X-Forwarded-For")
 	}
+	return ip
+}
+
+// visitorFromIP creates or retrieves a visitor for the given IP address. The lock must be held by the caller.
+func (s *Server) visitorFromIP(ip string) *visitor {
 	v, exists := s.visitors[ip]
 	if !exists {
 		s.visitors[ip] = newVisitor(s.config, s.messageCache, ip)
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	accountPath               = "/v1/account"
+	accountVerifyPath         = "/v1/account/verify"
+	accountExportPath         = "/v1/account/export"
+	signupVerifyTimeout       = 24 * time.Hour // Time the user has to click the link in the verification e-mail
+	signupMaxPending          = 1000           // Max number of sign-ups waiting for e-mail verification
+	signupInviteCodeMinLength = 8
+)
+
+// signupInvite is an invite code from signup-invite-codes. Users who sign up with it are assigned to the tier, if any.
+type signupInvite struct {
+	code string
+	tier string
+}
+
+// signupRequest is the body of a sign-up request, e.g. {"username":"phil","password":"mypass","email":"phil@example.com","invite_code":"..."}
+type signupRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Email      string `json:"email"`
+	InviteCode string `json:"invite_code"`
+}
+
+// accountExport is all the data stored about a user, see handleAccountExport. Messages are the cached messages
+// of the topics reserved by the user, including scheduled messages.
+type accountExport struct {
+	Username     string                 `json:"username"`
+	Role         auth.Role              `json:"role"`
+	Tier         string                 `json:"tier,omitempty"`
+	TOTP         bool                   `json:"totp"`
+	Access       []accessGrant          `json:"access"`
+	Tokens       []*tokenResponse       `json:"tokens"`
+	Reservations []*reservationResponse `json:"reservations"`
+	Messages     []*message             `json:"messages"`
+}
+
+// signup is a sign-up that was started in handleAccountAdd, and that is completed once the user opens the
+// verification link (see handleAccountVerify). The user is only created then, so the password is kept as hash.
+type signup struct {
+	username string
+	hash     string
+	email    string
+	tier     string
+	expires  time.Time
+}
+
+// newSignupInvites parses the invite codes, format <code> or <code>:<tier>. Codes without tier use the default tier.
+func newSignupInvites(entries []string, defaultTier string) ([]*signupInvite, error) {
+	invites := make([]*signupInvite, 0)
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		invite := &signupInvite{code: parts[0], tier: defaultTier}
+		if len(parts) == 2 {
+			invite.tier = parts[1]
+		}
+		if len(invite.code) < signupInviteCodeMinLength {
+			return nil, fmt.Errorf("invalid invite code %s: code must be at least %d characters", entry, signupInviteCodeMinLength)
+		} else if invite.tier != "" && !auth.AllowedTier(invite.tier) {
+			return nil, fmt.Errorf("invalid invite code %s: invalid tier %s", entry, invite.tier)
+		}
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+// handleAccountAdd starts a sign-up: if the invite code is valid, a verification link is sent to the e-mail address.
+// The user is created once the link is opened, see handleAccountVerify.
+func (s *Server) handleAccountAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	manager, err := s.authManager()
+	if err != nil {
+		return err
+	}
+	var req signupRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return errHTTPBadRequestSignupInvalid
+	}
+	invite := s.signupInvite(req.InviteCode)
+	if invite == nil {
+		log.Printf("[%s] Sign-up of user %s failed: invalid invite code", v.ip, req.Username)
+		s.audit(r, &auditEvent{Event: auditEventAuthFailed, User: req.Username, Reason: "invalid invite code"})
+		return errHTTPForbiddenInviteCodeInvalid
+	}
+	email, err := mail.ParseAddress(req.Email)
+	if err != nil || !auth.AllowedUsername(req.Username) || req.Username == userEveryone || req.Password == "" {
+		return errHTTPBadRequestSignupInvalid
+	}
+	if user, _ := manager.User(req.Username); user != nil || s.signupPending(req.Username) {
+		return errHTTPConflictUserExists
+	}
+	if invite.tier != "" {
+		if _, err := manager.Tier(invite.tier); err != nil {
+			return wrapErrHTTP(errHTTPInternalError, "tier %s of invite code does not exist", invite.tier)
+		}
+	}
+	if err := v.EmailAllowed(); err != nil {
+		return errHTTPTooManyRequestsLimitEmails
+	}
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	token, err := oidcRandomString()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if len(s.signups) >= signupMaxPending {
+		s.mu.Unlock()
+		return errHTTPTooManyRequestsLimitRequests
+	}
+	s.signups[token] = &signup{
+		username: req.Username,
+		hash:     hash,
+		email:    email.Address,
+		tier:     invite.tier,
+		expires:  time.Now().Add(signupVerifyTimeout),
+	}
+	s.mu.Unlock()
+	log.Printf("[%s] Sign-up of user %s started, sending verification e-mail to %s", v.ip, req.Username, email.Address)
+	go s.sendEmail(v.ip, email.Address, s.signupVerifyMessage(req.Username, token))
+	return writeJSON(w, map[string]bool{"success": true})
+}
+
+// handleAccountVerify completes a sign-up by creating the user, once the link from the verification e-mail is opened
+func (s *Server) handleAccountVerify(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	manager, err := s.authManager()
+	if err != nil {
+		return err
+	}
+	token := r.URL.Query().Get("token")
+	s.mu.Lock()
+	pending, ok := s.signups[token]
+	delete(s.signups, token)
+	s.mu.Unlock()
+	if !ok || time.Now().After(pending.expires) {
+		return errHTTPBadRequestSignupTokenInvalid
+	}
+	if user, _ := manager.User(pending.username); user != nil {
+		return errHTTPConflictUserExists // Created by an admin in the meantime
+	}
+	if err := manager.AddUserHash(pending.username, pending.hash, auth.RoleUser); err != nil {
+		return err
+	}
+	if pending.tier != "" {
+		if err := manager.ChangeTier(pending.username, pending.tier); err != nil {
+			log.Printf("[%s] Unable to assign user %s to tier %s: %s", v.ip, pending.username, pending.tier, err.Error())
+		}
+	}
+	log.Printf("[%s] User %s signed up with e-mail address %s", v.ip, pending.username, pending.email)
+	s.audit(r, &auditEvent{Event: auditEventUserAdded, User: pending.username, Reason: "signed up with e-mail address " + pending.email})
+	return writeJSON(w, map[string]string{"username": pending.username})
+}
+
+// handleAccountExport returns all data of the user as JSON file, including the cached messages of the reserved topics
+func (s *Server) handleAccountExport(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	user, err := manager.User(user.Name)
+	if err != nil {
+		return err
+	}
+	tokens, err := manager.Tokens(user.Name)
+	if err != nil {
+		return err
+	}
+	reservations, err := manager.Reservations(user.Name)
+	if err != nil {
+		return err
+	}
+	export := &accountExport{
+		Username:     user.Name,
+		Role:         user.Role,
+		TOTP:         user.TOTP != "",
+		Access:       newAccessGrants(user.Grants),
+		Tokens:       make([]*tokenResponse, 0),
+		Reservations: make([]*reservationResponse, 0),
+		Messages:     make([]*message, 0),
+	}
+	if user.Tier != nil {
+		export.Tier = user.Tier.Code
+	}
+	for _, token := range tokens {
+		export.Tokens = append(export.Tokens, newTokenResponse(token))
+	}
+	for _, reservation := range reservations {
+		export.Reservations = append(export.Reservations, newReservationResponse(reservation))
+		messages, err := s.messageCache.Messages(reservation.Topic, sinceAllMessages, true)
+		if err != nil {
+			return err
+		}
+		export.Messages = append(export.Messages, messages...)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=ntfy-%s.json", user.Name))
+	return writeJSON(w, export)
+}
+
+// handleAccountDelete deletes the user, including its access control entries, tokens, reservations and quiet hours. The cached
+// messages of the reserved topics are purged, along with their attachments, recurring messages, metadata, defaults and escalation chains.
+func (s *Server) handleAccountDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	manager, user := s.userManager(r)
+	reservations, err := manager.Reservations(user.Name)
+	if err != nil {
+		return err
+	}
+	topicIDs := make([]string, 0)
+	for _, reservation := range reservations {
+		topicIDs = append(topicIDs, reservation.Topic)
+	}
+	topics, err := s.topicsFromIDs(topicIDs...)
+	if err != nil {
+		return err
+	}
+	for _, t := range topics {
+		if _, err := s.purgeTopic(t); err != nil {
+			return err
+		} else if err := s.deleteRecurringMessages(t.ID); err != nil {
+			return err
+		} else if err := s.messageCache.DeleteTopicInfo(t.ID); err != nil {
+			return err
+		} else if err := s.messageCache.DeleteTopicDefaults(t.ID); err != nil {
+			return err
+		} else if err := s.messageCache.DeleteTopicEscalation(t.ID); err != nil {
+			return err
+		}
+	}
+	if err := manager.RemoveUser(user.Name); err != nil {
+		return err
+	} else if err := s.messageCache.DeleteQuietHours(user.Name); err != nil {
+		return err
+	} else if err := s.updateTopicIPRules(); err != nil {
+		return err
+	}
+	phoneNumbers, err := s.messageCache.PhoneNumbers(user.Name)
+	if err != nil {
+		return err
+	}
+	for _, phoneNumber := range phoneNumbers {
+		if err := s.messageCache.DeletePhoneNumber(user.Name, phoneNumber); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	delete(s.tierLimiters, user.Name)
+	delete(s.phoneCodes, user.Name)
+	s.mu.Unlock()
+	log.Printf("[%s] User %s deleted their account, and purged %d reserved topic(s)", v.ip, user.Name, len(topics))
+	s.audit(r, &auditEvent{Event: auditEventUserRemoved, User: user.Name, Reason: "account deleted by user"})
+	return writeJSON(w, map[string]bool{"success": true})
+}
+
+// signupInvite returns the invite with the given code, or nil if there is none. Codes are compared in constant time.
+func (s *Server) signupInvite(code string) *signupInvite {
+	var match *signupInvite
+	for _, invite := range s.invites {
+		if subtle.ConstantTimeCompare([]byte(invite.code), []byte(code)) == 1 {
+			match = invite
+		}
+	}
+	return match
+}
+
+// signupPending returns true if the username was already used by a sign-up that is waiting for e-mail verification
+func (s *Server) signupPending(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pending := range s.signups {
+		if pending.username == username && time.Now().Before(pending.expires) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) signupVerifyMessage(username, token string) *message {
+	link := fmt.Sprintf("%s%s?token=%s", s.config.BaseURL, accountVerifyPath, token)
+	m := newDefaultMessage("", fmt.Sprintf("Hi %s,\n\nplease open the following link within %d hours to verify your e-mail address "+
+		"and complete your sign-up at %s:\n\n%s\n\nIf you did not sign up, you can ignore this e-mail.",
+		username, int(signupVerifyTimeout.Hours()), s.config.BaseURL, link))
+	m.Title = "Verify your e-mail address"
+	m.Click = link
+	return m
+}
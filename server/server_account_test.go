@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Account_SignupAndVerify(t *testing.T) {
+	s, mailer := newTestServerWithSignup(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddTier(&auth.Tier{Code: "pro", ReservationsLimit: 5}))
+
+	response := request(t, s, "POST", "/v1/account", `{"username":"phil","password":"mypass","email":"phil@example.com","invite_code":"friends-of-phil"}`, nil)
+	require.Equal(t, 200, response.Code)
+	token := waitForSignupToken(t, mailer)
+	_, err := manager.User("phil")
+	require.Equal(t, auth.ErrNotFound, err) // Not created before the e-mail address is verified
+
+	response = request(t, s, "POST", "/v1/account", `{"username":"phil","password":"other","email":"other@example.com","invite_code":"friends-of-phil"}`, nil)
+	require.Equal(t, 409, response.Code) // Pending sign-up
+
+	response = request(t, s, "GET", "/v1/account/verify?token="+token, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Contains(t, response.Body.String(), `"username":"phil"`)
+	user, err := s.auth.Authenticate("phil", "mypass")
+	require.Nil(t, err)
+	require.Equal(t, auth.RoleUser, user.Role)
+	require.Equal(t, "pro", user.Tier.Code)
+
+	response = request(t, s, "GET", "/v1/account/verify?token="+token, "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40038, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Account_SignupDefaultTier(t *testing.T) {
+	s, mailer := newTestServerWithSignup(t)
+	response := request(t, s, "POST", "/v1/account", `{"username":"ben","password":"ben","email":"ben@example.com","invite_code":"open-house"}`, nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/v1/account/verify?token="+waitForSignupToken(t, mailer), "", nil)
+	require.Equal(t, 200, response.Code)
+	user, err := s.auth.(auth.Manager).User("ben")
+	require.Nil(t, err)
+	require.Nil(t, user.Tier) // No tier, and no default tier
+}
+
+func TestServer_Account_SignupInvalid(t *testing.T) {
+	s, mailer := newTestServerWithSignup(t)
+	require.Nil(t, s.auth.(auth.Manager).AddUser("phil", "phil", auth.RoleAdmin))
+
+	response := request(t, s, "POST", "/v1/account", `{"username":"ben","password":"ben","email":"ben@example.com","invite_code":"wrong-code"}`, nil)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40305, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/account", `{"username":"ben","password":"ben","email":"not-an-email","invite_code":"open-house"}`, nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40037, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/account", `{"username":"ben","password":"","email":"ben@example.com","invite_code":"open-house"}`, nil)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "POST", "/v1/account", `{"username":"phil","password":"ben","email":"ben@example.com","invite_code":"open-house"}`, nil)
+	require.Equal(t, 409, response.Code)
+	response = request(t, s, "GET", "/v1/account/verify?token=invalid", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 0, mailer.Count())
+}
+
+func TestServer_Account_SignupDisabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	s := newTestServer(t, c)
+	s.mailer = &testMailer{}
+	response := request(t, s, "POST", "/v1/account", `{"username":"ben","password":"ben","email":"ben@example.com","invite_code":"open-house"}`, nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_Account_ExportAndDelete(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 2)
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+	response := request(t, s, "POST", "/user/reservations", `{"topic":"ben-alerts","everyone":"write-only"}`, ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/user/tokens", `{"topics":["ben-alerts"],"permission":"read-only","label":"phone"}`, ben)
+	require.Equal(t, 200, response.Code)
+	token := toTokenResponse(t, response.Body.String())
+	response = request(t, s, "PUT", "/ben-alerts", "front door open", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "not ben's topic", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/ben-alerts/recurring", `{"cron":"@daily","message":"daily check"}`, ben)
+	require.Equal(t, 200, response.Code)
+	require.Nil(t, s.messageCache.UpdateTopicDefaults(&topicDefaults{Topic: "ben-alerts", Priority: 5})) // Everyone may write, so ben isn't the owner
+
+	response = request(t, s, "GET", "/v1/account/export", "", ben)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "attachment; filename=ntfy-ben.json", response.Header().Get("Content-Disposition"))
+	var export accountExport
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&export))
+	require.Equal(t, "ben", export.Username)
+	require.Equal(t, auth.RoleUser, export.Role)
+	require.Len(t, export.Tokens, 1)
+	require.Equal(t, "phone", export.Tokens[0].Label)
+	require.Len(t, export.Reservations, 1)
+	require.Equal(t, "ben-alerts", export.Reservations[0].Topic)
+	require.Len(t, export.Messages, 1)
+	require.Equal(t, "front door open", export.Messages[0].Message)
+
+	response = request(t, s, "GET", "/v1/account/export", "", map[string]string{"Authorization": "Bearer " + token.Token})
+	require.Equal(t, 403, response.Code) // Password required
+
+	response = request(t, s, "DELETE", "/v1/account", "", ben)
+	require.Equal(t, 200, response.Code)
+	_, err := s.auth.(auth.Manager).User("ben")
+	require.Equal(t, auth.ErrNotFound, err)
+	response = request(t, s, "GET", "/ben-alerts/json?poll=1", "", map[string]string{"Authorization": "Bearer " + token.Token})
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "GET", "/ben-alerts/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code) // Topic was released
+	require.Empty(t, response.Body.String())
+	recurring, err := s.messageCache.RecurringMessages("ben-alerts")
+	require.Nil(t, err)
+	require.Empty(t, recurring)
+	defaults, err := s.messageCache.TopicDefaults("ben-alerts")
+	require.Nil(t, err)
+	require.Equal(t, 0, defaults.Priority)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, "not ben's topic", toMessage(t, response.Body.String()).Message)
+}
+
+func TestSignupInvites_Invalid(t *testing.T) {
+	_, err := newSignupInvites([]string{"short"}, "")
+	require.Error(t, err)
+	_, err = newSignupInvites([]string{"long-enough:invalid tier"}, "")
+	require.Error(t, err)
+	invites, err := newSignupInvites([]string{"long-enough:pro", "long-enough-too"}, "free")
+	require.Nil(t, err)
+	require.Equal(t, "pro", invites[0].tier)
+	require.Equal(t, "free", invites[1].tier)
+}
+
+func newTestServerWithSignup(t *testing.T) (*Server, *testMailer) {
+	c := newTestConfig(t)
+	c.BaseURL = "https://ntfy.example.com"
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.SignupInviteCodes = []string{"friends-of-phil:pro", "open-house"}
+	s := newTestServer(t, c)
+	mailer := &testMailer{}
+	s.mailer = mailer
+	return s, mailer
+}
+
+// waitForSignupToken waits for the verification e-mail, and returns the token from the link in it
+func waitForSignupToken(t *testing.T, mailer *testMailer) string {
+	for i := 0; i < 50 && mailer.Count() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.Equal(t, 1, mailer.Count())
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	require.True(t, strings.HasPrefix(mailer.last.Click, "https://ntfy.example.com/v1/account/verify?token="))
+	require.Contains(t, mailer.last.Message, mailer.last.Click)
+	return strings.TrimPrefix(mailer.last.Click, "https://ntfy.example.com/v1/account/verify?token=")
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"google.golang.org/api/option"
 	"heckel.io/ntfy/auth"
+	"sort"
 	"strings"
 )
 
@@ -34,39 +35,88 @@ func maybeTruncateFCMMessage(m *messaging.Message) *messaging.Message {
 	return m
 }
 
-func createFirebaseSubscriber(credentialsFile string, auther auth.Auther) (subscriber, error) {
-	fb, err := firebase.NewApp(context.Background(), nil, option.WithCredentialsFile(credentialsFile))
-	if err != nil {
-		return nil, err
+// firebaseSender is implemented by messaging.Client, which sends messages via the FCM HTTP v1 API
+type firebaseSender interface {
+	Send(ctx context.Context, message *messaging.Message) (string, error)
+}
+
+// firebaseProject is a Firebase project that the messages of all topics starting with the prefix are sent to.
+// The project of the firebase-key-file has an empty prefix, so it receives the messages of all other topics.
+type firebaseProject struct {
+	prefix string
+	sender firebaseSender
+}
+
+func createFirebaseSubscriber(conf *Config, auther auth.Auther) (subscriber, error) {
+	projects := make([]*firebaseProject, 0)
+	if conf.FirebaseKeyFile != "" {
+		sender, err := createFirebaseSender(conf.FirebaseKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, &firebaseProject{sender: sender})
+	}
+	for prefix, keyFile := range conf.FirebaseProjects {
+		sender, err := createFirebaseSender(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create Firebase client for topic prefix %s: %s", prefix, err.Error())
+		}
+		projects = append(projects, &firebaseProject{prefix: prefix, sender: sender})
 	}
-	msg, err := fb.Messaging(context.Background())
+	return newFirebaseSubscriber(projects, auther), nil
+}
+
+func createFirebaseSender(keyFile string) (firebaseSender, error) {
+	fb, err := firebase.NewApp(context.Background(), nil, option.WithCredentialsFile(keyFile))
 	if err != nil {
 		return nil, err
 	}
+	return fb.Messaging(context.Background())
+}
+
+// newFirebaseSubscriber returns a subscriber that sends each message to the project with the longest matching
+// topic prefix. Keepalive messages of the control topic are sent to all projects, since every app needs them.
+func newFirebaseSubscriber(projects []*firebaseProject, auther auth.Auther) subscriber {
+	sort.Slice(projects, func(i, j int) bool {
+		return len(projects[i].prefix) > len(projects[j].prefix)
+	})
 	return func(m *message) error {
 		fbm, err := toFirebaseMessage(m, auther)
 		if err != nil {
 			return err
 		}
-		_, err = msg.Send(context.Background(), fbm)
-		return err
-	}, nil
+		if m.Topic == firebaseControlTopic {
+			for _, p := range projects {
+				if _, err := p.sender.Send(context.Background(), fbm); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for _, p := range projects {
+			if strings.HasPrefix(m.Topic, p.prefix) {
+				_, err := p.sender.Send(context.Background(), fbm)
+				return err
+			}
+		}
+		return nil // No project for this topic
+	}
 }
 
 func toFirebaseMessage(m *message, auther auth.Auther) (*messaging.Message, error) {
 	var data map[string]string // Mostly matches https://ntfy.sh/docs/subscribe/api/#json-message-format
 	switch m.Event {
-	case keepaliveEvent, openEvent:
+	case keepaliveEvent, openEvent, messageDeletedEvent:
 		data = map[string]string{
 			"id":    m.ID,
 			"time":  fmt.Sprintf("%d", m.Time),
 			"event": m.Event,
 			"topic": m.Topic,
 		}
-	case messageEvent:
+	case messageEvent, messageUpdatedEvent:
 		allowForward := true
 		if auther != nil {
-			allowForward = auther.Authorize(nil, m.Topic, auth.PermissionRead) == nil
+			allowForward = auther.Authorize(nil, m.Topic, auth.PermissionSubscribe) == nil
 		}
 		if allowForward {
 			data = map[string]string{
@@ -77,6 +127,7 @@ func toFirebaseMessage(m *message, auther auth.Auther) (*messaging.Message, erro
 				"priority": fmt.Sprintf("%d", m.Priority),
 				"tags":     strings.Join(m.Tags, ","),
 				"click":    m.Click,
+				"group":    m.Group,
 				"title":    m.Title,
 				"message":  m.Message,
 				"encoding": m.Encoding,
@@ -88,6 +139,15 @@ func toFirebaseMessage(m *message, auther auth.Auther) (*messaging.Message, erro
 				}
 				data["actions"] = string(actions)
 			}
+			if m.InReplyTo != "" {
+				data["in_reply_to"] = m.InReplyTo
+			}
+			if m.AckRequired {
+				data["ack_required"] = "1"
+			}
+			if m.CollapseKey != "" {
+				data["collapse_key"] = m.CollapseKey
+			}
 			if m.Attachment != nil {
 				data["attachment_name"] = m.Attachment.Name
 				data["attachment_type"] = m.Attachment.Type
@@ -107,14 +167,24 @@ func toFirebaseMessage(m *message, auther auth.Auther) (*messaging.Message, erro
 		}
 	}
 	var androidConfig *messaging.AndroidConfig
-	if m.Priority >= 4 {
+	if m.Priority >= 4 || m.CollapseKey != "" {
 		androidConfig = &messaging.AndroidConfig{
-			Priority: "high",
+			CollapseKey: m.CollapseKey, // Only the last message with the key is delivered to devices that are offline
+		}
+		if m.Priority >= 4 {
+			androidConfig.Priority = "high"
+		}
+	}
+	var apnsConfig *messaging.APNSConfig
+	if m.CollapseKey != "" {
+		apnsConfig = &messaging.APNSConfig{
+			Headers: map[string]string{"apns-collapse-id": m.CollapseKey}, // Replaces the notification on iOS
 		}
 	}
 	return maybeTruncateFCMMessage(&messaging.Message{
 		Topic:   m.Topic,
 		Data:    data,
 		Android: androidConfig,
+		APNS:    apnsConfig,
 	}), nil
 }
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"firebase.google.com/go/messaging"
@@ -40,6 +41,44 @@ func TestToFirebaseMessage_Keepalive(t *testing.T) {
 	}, fbm.Data)
 }
 
+func TestToFirebaseMessage_MessageUpdated(t *testing.T) {
+	m := newDefaultMessage("mytopic", "Downloading: 50%")
+	m.Event = messageUpdatedEvent
+	fbm, err := toFirebaseMessage(m, nil)
+	require.Nil(t, err)
+	require.Equal(t, messageUpdatedEvent, fbm.Data["event"])
+	require.Equal(t, m.ID, fbm.Data["id"])
+	require.Equal(t, "Downloading: 50%", fbm.Data["message"])
+}
+
+func TestToFirebaseMessage_MessageDeleted(t *testing.T) {
+	m := newMessageDeletedMessage("mytopic", "abcdefghijkl")
+	fbm, err := toFirebaseMessage(m, nil)
+	require.Nil(t, err)
+	require.Equal(t, "mytopic", fbm.Topic)
+	require.Equal(t, map[string]string{
+		"id":    "abcdefghijkl",
+		"time":  fmt.Sprintf("%d", m.Time),
+		"event": messageDeletedEvent,
+		"topic": m.Topic,
+	}, fbm.Data)
+}
+
+func TestToFirebaseMessage_CollapseKey(t *testing.T) {
+	m := newDefaultMessage("mytopic", "Downloading: 50%")
+	m.CollapseKey = "download-1"
+	fbm, err := toFirebaseMessage(m, nil)
+	require.Nil(t, err)
+	require.Equal(t, "download-1", fbm.Data["collapse_key"])
+	require.Equal(t, &messaging.AndroidConfig{CollapseKey: "download-1"}, fbm.Android)
+	require.Equal(t, "download-1", fbm.APNS.Headers["apns-collapse-id"])
+
+	m.Priority = 4
+	fbm, err = toFirebaseMessage(m, nil)
+	require.Nil(t, err)
+	require.Equal(t, &messaging.AndroidConfig{CollapseKey: "download-1", Priority: "high"}, fbm.Android)
+}
+
 func TestToFirebaseMessage_Open(t *testing.T) {
 	m := newOpenMessage("mytopic")
 	fbm, err := toFirebaseMessage(m, nil)
@@ -59,6 +98,7 @@ func TestToFirebaseMessage_Message_Normal_Allowed(t *testing.T) {
 	m.Priority = 4
 	m.Tags = []string{"tag 1", "tag2"}
 	m.Click = "https://google.com"
+	m.Group = "some group"
 	m.Title = "some title"
 	m.Attachment = &attachment{
 		Name:    "some file.jpg",
@@ -82,6 +122,7 @@ func TestToFirebaseMessage_Message_Normal_Allowed(t *testing.T) {
 		"priority":           "4",
 		"tags":               strings.Join(m.Tags, ","),
 		"click":              "https://google.com",
+		"group":              "some group",
 		"title":              "some title",
 		"message":            "this is a message",
 		"encoding":           "",
@@ -168,3 +209,40 @@ func TestMaybeTruncateFCMMessage_NotTooLong(t *testing.T) {
 	require.Equal(t, len(serializedOrigFCMMessage), len(serializedNotTruncatedFCMMessage))
 	require.Equal(t, "", notTruncatedFCMMessage.Data["truncated"])
 }
+
+type testFirebaseSender struct {
+	messages []*messaging.Message
+}
+
+func (s *testFirebaseSender) Send(_ context.Context, m *messaging.Message) (string, error) {
+	s.messages = append(s.messages, m)
+	return "projects/test/messages/1", nil
+}
+
+func TestFirebaseSubscriber_Projects(t *testing.T) {
+	fallback, acme, acmeProd := &testFirebaseSender{}, &testFirebaseSender{}, &testFirebaseSender{}
+	sub := newFirebaseSubscriber([]*firebaseProject{
+		{prefix: "", sender: fallback},
+		{prefix: "acme-", sender: acme},
+		{prefix: "acme-prod-", sender: acmeProd},
+	}, nil)
+	require.Nil(t, sub(newDefaultMessage("mytopic", "hi")))
+	require.Nil(t, sub(newDefaultMessage("acme-alerts", "hi")))
+	require.Nil(t, sub(newDefaultMessage("acme-prod-alerts", "hi"))) // Longest prefix wins
+	require.Nil(t, sub(newKeepaliveMessage(firebaseControlTopic)))
+
+	require.Len(t, fallback.messages, 2)
+	require.Equal(t, "mytopic", fallback.messages[0].Topic)
+	require.Len(t, acme.messages, 2)
+	require.Equal(t, "acme-alerts", acme.messages[0].Topic)
+	require.Len(t, acmeProd.messages, 2)
+	require.Equal(t, "acme-prod-alerts", acmeProd.messages[0].Topic)
+	require.Equal(t, firebaseControlTopic, acmeProd.messages[1].Topic) // Keepalives go to all projects
+}
+
+func TestFirebaseSubscriber_NoMatchingProject(t *testing.T) {
+	acme := &testFirebaseSender{}
+	sub := newFirebaseSubscriber([]*firebaseProject{{prefix: "acme-", sender: acme}}, nil)
+	require.Nil(t, sub(newDefaultMessage("mytopic", "hi")))
+	require.Empty(t, acme.messages)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	adminMaintenancePath = "/admin/maintenance"
+	readOnlyRetryAfter   = time.Minute // Sent as Retry-After header to publishers in read-only mode
+)
+
+// maintenanceRequest is the body of a request to change the maintenance mode, e.g. {"read_only":true}. It is also
+// returned by Server.handleAdminMaintenance.
+type maintenanceRequest struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+func (s *Server) handleAdminMaintenance(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	return writeJSON(w, &maintenanceRequest{ReadOnly: s.readOnlyMode()})
+}
+
+// handleAdminMaintenanceUpdate turns the read-only mode on or off at runtime, e.g. before and after migrating the
+// cache database. The read-only config option only sets the mode the server starts in.
+func (s *Server) handleAdminMaintenanceUpdate(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	var req maintenanceRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	s.mu.Lock()
+	s.readOnly = req.ReadOnly
+	s.mu.Unlock()
+	admin := "anonymous" // If access control is disabled, see authAdmin
+	if user := userFromRequest(r); user != nil {
+		admin = user.Name
+	}
+	log.Printf("[%s] Admin %s turned read-only mode %s", r.RemoteAddr, admin, onOff(req.ReadOnly))
+	s.audit(r, &auditEvent{Event: auditEventReadOnlyChanged, User: admin, Reason: "read-only mode turned " + onOff(req.ReadOnly)})
+	return writeJSON(w, &req)
+}
+
+// rejectReadOnly rejects requests that write to the message cache (publishing, updating and deleting messages,
+// changing topic settings, ...) with 503 Service Unavailable while the server is in read-only mode. Subscribing
+// and polling keep working.
+func (s *Server) rejectReadOnly(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if s.readOnlyMode() {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(readOnlyRetryAfter.Seconds())))
+			return errHTTPServiceUnavailableReadOnly
+		}
+		return next(w, r, v)
+	}
+}
+
+func (s *Server) readOnlyMode() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readOnly
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
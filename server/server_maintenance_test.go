@@ -0,0 +1,78 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"testing"
+)
+
+func TestServer_ReadOnly(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/alerts", "Before maintenance", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	s.readOnly = true
+	response = request(t, s, "PUT", "/alerts", "During maintenance", nil)
+	require.Equal(t, 503, response.Code)
+	require.Equal(t, "60", response.Header().Get("Retry-After"))
+	require.Equal(t, 50301, toHTTPError(t, response.Body.String()).Code)
+	for _, req := range [][]string{
+		{"GET", "/alerts/publish?message=hi"},
+		{"POST", "/v1/publish/batch"},
+		{"PUT", "/alerts/" + m.ID},
+		{"DELETE", "/alerts/" + m.ID},
+		{"PUT", "/alerts/defaults"},
+	} {
+		response = request(t, s, req[0], req[1], "", nil)
+		require.Equal(t, 503, response.Code, req)
+	}
+
+	// Polling still works
+	response = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, "Before maintenance", messages[0].Message)
+
+	s.readOnly = false
+	response = request(t, s, "PUT", "/alerts", "After maintenance", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_ReadOnly_Config(t *testing.T) {
+	c := newTestConfig(t)
+	c.ReadOnly = true
+	s := newTestServer(t, c)
+	response := request(t, s, "POST", "/alerts", "Disk full", nil)
+	require.Equal(t, 503, response.Code)
+}
+
+func TestServer_AdminMaintenance(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 0)
+	require.Nil(t, s.auth.(auth.Manager).AddUser("phil", "phil", auth.RoleAdmin))
+	phil := map[string]string{"Authorization": basicAuth("phil:phil")}
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "PUT", "/admin/maintenance", `{"read_only":true}`, ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/admin/maintenance", "", nil)
+	require.Equal(t, 401, response.Code)
+
+	response = request(t, s, "PUT", "/admin/maintenance", `{"read_only":true}`, phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"read_only":true}`+"\n", response.Body.String())
+	response = request(t, s, "GET", "/admin/maintenance", "", phil)
+	require.Equal(t, `{"read_only":true}`+"\n", response.Body.String())
+	response = request(t, s, "PUT", "/alerts", "Disk full", ben)
+	require.Equal(t, 503, response.Code)
+
+	// Admin endpoints keep working, so that the mode can be turned off again
+	response = request(t, s, "PUT", "/admin/maintenance", `{"read_only":false}`, phil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/alerts", "Disk full", ben)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/admin/maintenance", `not json`, phil)
+	require.Equal(t, 400, response.Code)
+}
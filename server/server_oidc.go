@@ -0,0 +1,98 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	oidcLoginPath        = "/auth/oidc/login"
+	oidcCallbackPath     = "/auth/oidc/callback"
+	oidcLoginTimeout     = 10 * time.Minute // Time the user has to log in at the provider
+	oidcMaxLogins        = 10000            // Max number of login flows in progress
+	oidcRandomLength     = 32               // Bytes of randomness for state, nonce and PKCE code verifier
+	oidcFragmentToken    = "oidc_token"     // See App.js if changed
+	oidcFragmentUsername = "oidc_username"  // See App.js if changed
+)
+
+// oidcLogin is a login flow of the web app that was started in handleOIDCLogin, and that is completed
+// when the provider redirects back to handleOIDCCallback
+type oidcLogin struct {
+	nonce        string
+	codeVerifier string
+	expires      time.Time
+}
+
+// handleOIDCLogin starts the authorization code flow, by redirecting the user to the provider's login page
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	state, err := oidcRandomString()
+	if err != nil {
+		return err
+	}
+	nonce, err := oidcRandomString()
+	if err != nil {
+		return err
+	}
+	codeVerifier, err := oidcRandomString()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if len(s.oidcLogins) >= oidcMaxLogins {
+		s.mu.Unlock()
+		return errHTTPTooManyRequestsLimitRequests
+	}
+	s.oidcLogins[state] = &oidcLogin{
+		nonce:        nonce,
+		codeVerifier: codeVerifier,
+		expires:      time.Now().Add(oidcLoginTimeout),
+	}
+	s.mu.Unlock()
+	http.Redirect(w, r, s.oidc.AuthCodeURL(s.oidcRedirectURL(), state, nonce, codeVerifier), http.StatusFound)
+	return nil
+}
+
+// handleOIDCCallback completes the login flow. It redirects to the web app with the ID token in the URL fragment,
+// so that it is not sent to the server in the request, or logged by proxies. The web app then uses it as bearer token.
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	query := r.URL.Query()
+	state := query.Get("state")
+	s.mu.Lock()
+	login, ok := s.oidcLogins[state]
+	delete(s.oidcLogins, state)
+	s.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return errHTTPBadRequestOIDCStateInvalid
+	} else if errorCode := query.Get("error"); errorCode != "" {
+		log.Printf("[%s] OIDC login failed: %s %s", v.ip, errorCode, query.Get("error_description"))
+		s.audit(r, &auditEvent{Event: auditEventAuthFailed, Reason: "OIDC login failed: " + errorCode})
+		return errHTTPUnauthorized
+	}
+	token, user, err := s.oidc.Exchange(query.Get("code"), s.oidcRedirectURL(), login.nonce, login.codeVerifier)
+	if err != nil {
+		log.Printf("[%s] OIDC login failed: %s", v.ip, err.Error())
+		s.audit(r, &auditEvent{Event: auditEventAuthFailed, Reason: "OIDC login failed: " + err.Error()})
+		return errHTTPUnauthorized
+	}
+	fragment := url.Values{}
+	fragment.Set(oidcFragmentUsername, user.Name)
+	fragment.Set(oidcFragmentToken, token)
+	http.Redirect(w, r, s.appRoot()+"#"+fragment.Encode(), http.StatusFound)
+	return nil
+}
+
+func (s *Server) oidcRedirectURL() string {
+	return s.config.BaseURL + oidcCallbackPath
+}
+
+func oidcRandomString() (string, error) {
+	b := make([]byte, oidcRandomLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_OIDC_BearerToken(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	s := newTestServer(t, newTestOIDCConfig(t, p))
+
+	response := request(t, s, "PUT", "/alerts-db", "disk full", nil)
+	require.Equal(t, 403, response.Code)
+
+	token := p.token(t, "ben", "")
+	response = request(t, s, "PUT", "/alerts-db", "disk full", map[string]string{
+		"Authorization": "Bearer " + token,
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/alerts-db/json?poll=1&auth="+base64.RawURLEncoding.EncodeToString([]byte("Bearer "+token)), "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "disk full", toMessage(t, response.Body.String()).Message)
+
+	response = request(t, s, "PUT", "/alerts-db", "disk full", map[string]string{
+		"Authorization": basicAuth("ben:" + token), // Token as password
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/other", "hi", map[string]string{
+		"Authorization": "Bearer " + token,
+	})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "PUT", "/alerts-db", "disk full", map[string]string{
+		"Authorization": "Bearer " + token + "x",
+	})
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_OIDC_BearerTokenNotSupported(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = t.TempDir() + "/user.db"
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": "Bearer sometoken",
+	})
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_OIDC_LoginFlow(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	s := newTestServer(t, newTestOIDCConfig(t, p))
+
+	response := request(t, s, "GET", "/config.js", "", nil)
+	require.Contains(t, response.Body.String(), "oidcLogin: true")
+
+	response = request(t, s, "GET", "/auth/oidc/login", "", nil)
+	require.Equal(t, 302, response.Code)
+	login, err := url.Parse(response.Header().Get("Location"))
+	require.Nil(t, err)
+	require.Equal(t, p.server.URL+"/authorize", login.Scheme+"://"+login.Host+login.Path)
+	require.Equal(t, "http://127.0.0.1:12345/auth/oidc/callback", login.Query().Get("redirect_uri"))
+	p.challenge = login.Query().Get("code_challenge")
+	p.nonce = login.Query().Get("nonce")
+
+	response = request(t, s, "GET", "/auth/oidc/callback?code=mycode&state="+login.Query().Get("state"), "", nil)
+	require.Equal(t, 302, response.Code)
+	redirect, err := url.Parse(response.Header().Get("Location"))
+	require.Nil(t, err)
+	require.Equal(t, "/app", redirect.Path)
+	fragment, err := url.ParseQuery(redirect.Fragment)
+	require.Nil(t, err)
+	require.Equal(t, "ben", fragment.Get("oidc_username"))
+
+	response = request(t, s, "PUT", "/alerts-db", "disk full", map[string]string{
+		"Authorization": "Bearer " + fragment.Get("oidc_token"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	// State can only be used once
+	response = request(t, s, "GET", "/auth/oidc/callback?code=mycode&state="+login.Query().Get("state"), "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40031, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_OIDC_LoginFlow_Denied(t *testing.T) {
+	p := newTestOIDCProvider(t)
+	s := newTestServer(t, newTestOIDCConfig(t, p))
+
+	response := request(t, s, "GET", "/auth/oidc/login", "", nil)
+	login, err := url.Parse(response.Header().Get("Location"))
+	require.Nil(t, err)
+	response = request(t, s, "GET", "/auth/oidc/callback?error=access_denied&state="+login.Query().Get("state"), "", nil)
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_OIDC_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/auth/oidc/login", "", nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "GET", "/config.js", "", nil)
+	require.Contains(t, response.Body.String(), "oidcLogin: false")
+}
+
+func newTestOIDCConfig(t *testing.T, p *testOIDCProvider) *Config {
+	c := newTestConfig(t)
+	c.AuthBackend = AuthBackendOIDC
+	c.AuthOIDCIssuer = p.server.URL
+	c.AuthOIDCClientID = "ntfy"
+	c.AuthOIDCGroupAccess = []string{"ntfy-devs:alerts*:rw"}
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	return c
+}
+
+// testOIDCProvider is a minimal OpenID Connect provider that issues ID tokens for user "ben" (group "ntfy-devs").
+// The token endpoint only accepts the code "mycode", with the code challenge and nonce set by the test.
+type testOIDCProvider struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	p := &testOIDCProvider{key: key}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 p.server.URL,
+				"authorization_endpoint": p.server.URL + "/authorize",
+				"token_endpoint":         p.server.URL + "/token",
+				"jwks_uri":               p.server.URL + "/jwks",
+			})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key1",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		case "/token":
+			challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+			if r.PostFormValue("code") != "mycode" || p.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"id_token": p.token(t, "ben", p.nonce)})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *testOIDCProvider) token(t *testing.T, username, nonce string) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key1"})
+	payload, _ := json.Marshal(map[string]interface{}{
+		"iss":                p.server.URL,
+		"aud":                "ntfy",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              nonce,
+		"preferred_username": username,
+		"groups":             []string{"ntfy-devs"},
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	require.Nil(t, err)
+	return strings.Join([]string{signingInput, base64.RawURLEncoding.EncodeToString(signature)}, ".")
+}
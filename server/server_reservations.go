@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	userReservationsPath = "/user/reservations"
+	reservationIPsMax    = 20 // Max number of IP addresses/ranges in each of publish_allow and publish_deny
+)
+
+var (
+	userReservationPathRegex = regexp.MustCompile(`^/user/reservations/([-_A-Za-z0-9]{1,64})$`)
+)
+
+// reservationRequest is the body of a request to reserve a topic, e.g. {"topic":"mytopic","everyone":"read-only"}.
+// If everyone is empty, other users are denied access to the topic. Publishing can be restricted to certain IP
+// addresses or CIDR ranges with publish_allow, and blocked for others with publish_deny, e.g. {..."publish_allow":["1.2.3.4"]}.
+type reservationRequest struct {
+	Topic        string   `json:"topic"`
+	Everyone     string   `json:"everyone"`
+	PublishAllow []string `json:"publish_allow"`
+	PublishDeny  []string `json:"publish_deny"`
+}
+
+type reservationResponse struct {
+	Topic        string   `json:"topic"`
+	Everyone     string   `json:"everyone"` // One of: deny, read-only, write-only, read-write
+	PublishAllow []string `json:"publish_allow,omitempty"`
+	PublishDeny  []string `json:"publish_deny,omitempty"`
+}
+
+func (s *Server) handleUserReservations(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	reservations, err := manager.Reservations(user.Name)
+	if err != nil {
+		return err
+	}
+	response := make([]*reservationResponse, 0)
+	for _, reservation := range reservations {
+		response = append(response, newReservationResponse(reservation))
+	}
+	return writeJSON(w, response)
+}
+
+func (s *Server) handleUserReservationAdd(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	var req reservationRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return errHTTPBadRequestReservationInvalid
+	}
+	if req.Everyone == "" {
+		req.Everyone = "deny"
+	}
+	read, write, ok := parseAccessPermission(req.Everyone)
+	if !ok || !auth.AllowedTopic(req.Topic) || util.InStringList(disallowedTopics, req.Topic) {
+		return errHTTPBadRequestReservationInvalid
+	}
+	publishAllow, err := parseReservationIPs(req.PublishAllow)
+	if err != nil {
+		return err
+	}
+	publishDeny, err := parseReservationIPs(req.PublishDeny)
+	if err != nil {
+		return err
+	}
+	if user.Role != auth.RoleAdmin {
+		reservations, err := manager.Reservations(user.Name)
+		if err != nil {
+			return err
+		}
+		exists := false
+		for _, reservation := range reservations {
+			if reservation.Topic == req.Topic {
+				exists = true
+			}
+		}
+		if !exists && len(reservations) >= s.reservationsLimit(user) {
+			return errHTTPTooManyRequestsLimitReservations
+		}
+	}
+	if err := manager.AddReservation(user.Name, req.Topic, read, write); err == auth.ErrTopicReserved {
+		return errHTTPConflictTopicReserved
+	} else if err != nil {
+		return err
+	}
+	if err := manager.ChangeReservationIPs(user.Name, req.Topic, publishAllow, publishDeny); err != nil {
+		return err
+	} else if err := s.updateTopicIPRules(); err != nil {
+		return err
+	}
+	log.Printf("[%s] User %s reserved topic %s (everyone: %s)", r.RemoteAddr, user.Name, req.Topic, req.Everyone)
+	s.audit(r, &auditEvent{Event: auditEventReservationAdded, User: user.Name, Topic: req.Topic, Permission: req.Everyone})
+	return writeJSON(w, newReservationResponse(auth.Reservation{
+		Topic:         req.Topic,
+		EveryoneRead:  read,
+		EveryoneWrite: write,
+		PublishAllow:  publishAllow,
+		PublishDeny:   publishDeny,
+	}))
+}
+
+func (s *Server) handleUserReservationDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	matches := userReservationPathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPNotFound
+	}
+	reservations, err := manager.Reservations(user.Name)
+	if err != nil {
+		return err
+	}
+	for _, reservation := range reservations {
+		if reservation.Topic == matches[1] {
+			if err := manager.RemoveReservation(user.Name, reservation.Topic); err != nil {
+				return err
+			} else if err := s.updateTopicIPRules(); err != nil {
+				return err
+			}
+			log.Printf("[%s] User %s released topic %s", r.RemoteAddr, user.Name, reservation.Topic)
+			s.audit(r, &auditEvent{Event: auditEventReservationRemoved, User: user.Name, Topic: reservation.Topic})
+			return writeJSON(w, map[string]bool{"success": true})
+		}
+	}
+	return errHTTPNotFoundReservation
+}
+
+// reservationsLimit returns the number of topics a user can reserve, which is defined by the user's tier,
+// or by the auth-reservations-limit option for users without a tier
+func (s *Server) reservationsLimit(user *auth.User) int {
+	if user.Tier != nil {
+		return user.Tier.ReservationsLimit
+	}
+	return s.config.AuthReservationsLimit
+}
+
+func newReservationResponse(reservation auth.Reservation) *reservationResponse {
+	return &reservationResponse{
+		Topic:        reservation.Topic,
+		Everyone:     permissionString(reservation.EveryoneRead, reservation.EveryoneWrite),
+		PublishAllow: reservation.PublishAllow,
+		PublishDeny:  reservation.PublishDeny,
+	}
+}
+
+// parseReservationIPs parses the IP addresses and CIDR ranges of a reservation request, and returns them as
+// CIDR ranges, e.g. 1.2.3.4 as 1.2.3.4/32
+func parseReservationIPs(ips []string) ([]string, error) {
+	if len(ips) > reservationIPsMax {
+		return nil, wrapErrHTTP(errHTTPBadRequestReservationInvalid, "too many IP addresses, at most %d are allowed", reservationIPsMax)
+	}
+	cidrs := make([]string, 0)
+	for _, ip := range ips {
+		ipNet, err := parseIPNet(strings.TrimSpace(ip))
+		if err != nil {
+			return nil, wrapErrHTTP(errHTTPBadRequestReservationInvalid, "invalid IP address or CIDR range %s", ip)
+		}
+		cidrs = append(cidrs, ipNet.String())
+	}
+	return cidrs, nil
+}
+
+func permissionString(read, write bool) string {
+	if read && write {
+		return "read-write"
+	} else if read {
+		return "read-only"
+	} else if write {
+		return "write-only"
+	}
+	return "deny"
+}
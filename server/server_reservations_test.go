@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Reservations_AddUseRemove(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 2)
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 200, response.Code) // Default access is read-write
+
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"mytopic","everyone":"read-only"}`, ben)
+	require.Equal(t, 200, response.Code)
+	reservation := toReservationResponse(t, response.Body.String())
+	require.Equal(t, "mytopic", reservation.Topic)
+	require.Equal(t, "read-only", reservation.Everyone)
+
+	response = request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", ben)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"mytopic"}`, ben)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "deny", toReservationResponse(t, response.Body.String()).Everyone)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", "/user/reservations", "", ben)
+	require.Equal(t, 200, response.Code)
+	var reservations []*reservationResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&reservations))
+	require.Equal(t, []*reservationResponse{{Topic: "mytopic", Everyone: "deny"}}, reservations)
+
+	response = request(t, s, "DELETE", "/user/reservations/mytopic", "", ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "DELETE", "/user/reservations/mytopic", "", ben)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40406, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Reservations_Conflict(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 2)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess(auth.Everyone, "announcements", true, false))
+
+	response := request(t, s, "POST", "/user/reservations", `{"topic":"mytopic"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"mytopic"}`, map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+	})
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40902, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"announcements"}`, map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+	})
+	require.Equal(t, 409, response.Code)
+}
+
+func TestServer_Reservations_Limit(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 1)
+	manager := s.auth.(auth.Manager)
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "POST", "/user/reservations", `{"topic":"topic1"}`, ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"topic1","everyone":"rw"}`, ben)
+	require.Equal(t, 200, response.Code) // Updating an existing reservation is fine
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"topic2"}`, ben)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42906, toHTTPError(t, response.Body.String()).Code)
+
+	require.Nil(t, manager.AddTier(&auth.Tier{Code: "pro", ReservationsLimit: 2}))
+	require.Nil(t, manager.ChangeTier("ben", "pro"))
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"topic2"}`, ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"topic3"}`, ben)
+	require.Equal(t, 429, response.Code)
+
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleAdmin))
+	for _, topic := range []string{"admin1", "admin2", "admin3"} {
+		response = request(t, s, "POST", "/user/reservations", `{"topic":"`+topic+`"}`, map[string]string{
+			"Authorization": basicAuth("phil:phil"),
+		})
+		require.Equal(t, 200, response.Code) // Admins are not limited
+	}
+}
+
+func TestServer_Reservations_Invalid(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 2)
+	for _, body := range []string{
+		`not json`,
+		`{"topic":""}`,
+		`{"topic":"my*"}`,
+		`{"topic":"docs"}`,
+		`{"topic":"mytopic","everyone":"maybe"}`,
+	} {
+		response := request(t, s, "POST", "/user/reservations", body, map[string]string{
+			"Authorization": basicAuth("ben:ben"),
+		})
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40035, toHTTPError(t, response.Body.String()).Code, body)
+	}
+	response := request(t, s, "POST", "/user/reservations", `{"topic":"mytopic"}`, nil)
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_Reservations_CannotReserveWithToken(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 2)
+	token, err := s.auth.(auth.Manager).AddToken("ben", "", []auth.Grant{{TopicPattern: "*", AllowRead: true, AllowWrite: true}}, time.Time{})
+	require.Nil(t, err)
+	response := request(t, s, "POST", "/user/reservations", `{"topic":"mytopic"}`, map[string]string{
+		"Authorization": "Bearer " + token.Value,
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func newTestServerWithReservationUser(t *testing.T, reservationsLimit int) *Server {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthReservationsLimit = reservationsLimit
+	s := newTestServer(t, c)
+	require.Nil(t, s.auth.(auth.Manager).AddUser("ben", "ben", auth.RoleUser))
+	return s
+}
+
+func toReservationResponse(t *testing.T, s string) *reservationResponse {
+	var reservation reservationResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&reservation))
+	return &reservation
+}
@@ -5,13 +5,18 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/auth"
 	"heckel.io/ntfy/util"
+	"image"
+	"image/color"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -250,6 +255,225 @@ func TestServer_PublishAt(t *testing.T) {
 	require.Equal(t, "a message", messages[0].Message)
 }
 
+func TestServer_PublishWithExpires(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "short-lived", map[string]string{
+		"Expires": "1s",
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, msg.Time+1, msg.Expires)
+
+	response = request(t, s, "PUT", "/mytopic?expires=1h", "long-lived", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+
+	time.Sleep(1100 * time.Millisecond)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "long-lived", messages[0].Message)
+
+	require.Nil(t, s.messageCache.Prune(time.Unix(1, 0), nil))
+	_, err := s.messageCache.Message("mytopic", msg.ID)
+	require.Equal(t, errMessageNotFound, err)
+}
+
+func TestServer_PublishWithExpires_Delayed(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+		"In":      "30 min",
+		"Expires": "1h",
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, msg.Time+3600, msg.Expires)
+}
+
+func TestServer_PublishWithExpires_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic?expires=INVALID", "a message", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40026, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+		"In":      "1h",
+		"Expires": fmt.Sprintf("%d", time.Now().Add(30*time.Minute).Unix()),
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40026, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishWithDedupKey(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+		"Dedup-Key": "backup-1",
+	})
+	require.Equal(t, 200, response.Code)
+	msg1 := toMessage(t, response.Body.String())
+
+	response = request(t, s, "PUT", "/mytopic?dedup=backup-1", "backup done (retry)", nil)
+	require.Equal(t, 200, response.Code)
+	msg2 := toMessage(t, response.Body.String())
+	require.Equal(t, msg1.ID, msg2.ID)
+	require.Equal(t, "backup done", msg2.Message)
+
+	response = request(t, s, "PUT", "/mytopic", "another backup", map[string]string{
+		"X-Dedup-Key": "backup-2",
+	})
+	require.Equal(t, 200, response.Code)
+	require.NotEqual(t, msg1.ID, toMessage(t, response.Body.String()).ID)
+
+	response = request(t, s, "PUT", "/othertopic", "other topic", map[string]string{
+		"Dedup-Key": "backup-1",
+	})
+	require.Equal(t, 200, response.Code)
+	require.NotEqual(t, msg1.ID, toMessage(t, response.Body.String()).ID)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "backup done", messages[0].Message)
+	require.Equal(t, "another backup", messages[1].Message)
+}
+
+func TestServer_PublishWithDedupKey_Disabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.DedupWindow = 0
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic?dedup=backup-1", "backup done", nil)
+	msg1 := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/mytopic?dedup=backup-1", "backup done", nil)
+	require.NotEqual(t, msg1.ID, toMessage(t, response.Body.String()).ID)
+}
+
+func TestServer_PublishWithDedupKey_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+		"Dedup-Key": strings.Repeat("x", 257),
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40027, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+		"Dedup-Key": "backup-1",
+		"Cache":     "no",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40028, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishWithCollapseKey(t *testing.T) {
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	msg1 := toMessage(t, request(t, s, "PUT", "/sensors", "Temperature: 21C", map[string]string{"X-Collapse-Key": "living-room"}).Body.String())
+	require.Equal(t, "living-room", msg1.CollapseKey)
+
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/sensors/json", rr)
+	msg2 := toMessage(t, request(t, s, "PUT", "/sensors?collapse=living-room", "Temperature: 22C", nil).Body.String())
+	request(t, s, "PUT", "/sensors?collapse=kitchen", "Temperature: 19C", nil)
+	cancel()
+	events := toMessages(t, rr.Body.String())
+	require.Len(t, events, 4)
+	deleted := 0
+	for _, e := range events {
+		if e.Event == messageDeletedEvent {
+			require.Equal(t, msg1.ID, e.ID)
+			deleted++
+		}
+	}
+	require.Equal(t, 1, deleted)
+
+	// Messages of other publishers are not replaced
+	response := request(t, s, "PUT", "/sensors?collapse=living-room", "Temperature: 5C", map[string]string{"X-Forwarded-For": "1.2.3.4"})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/sensors/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Len(t, messages, 3)
+	require.Equal(t, msg2.ID, messages[0].ID)
+	require.Equal(t, "Temperature: 19C", messages[1].Message)
+	require.Equal(t, "Temperature: 5C", messages[2].Message)
+}
+
+func TestServer_PublishWithCollapseKey_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/sensors", "a message", map[string]string{
+		"Collapse-Key": strings.Repeat("x", 65),
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40049, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_ScheduledListAndCancel(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "in one hour", map[string]string{
+		"In": "1h",
+	})
+	later := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/mytopic", "in 30 minutes", map[string]string{
+		"In": "30m",
+	})
+	sooner := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/mytopic", "right now", nil)
+	now := toMessage(t, response.Body.String())
+
+	response = request(t, s, "GET", "/mytopic/scheduled", "", nil)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, sooner.ID, messages[0].ID)
+	require.Equal(t, later.ID, messages[1].ID)
+
+	response = request(t, s, "DELETE", "/mytopic/scheduled/"+sooner.ID, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "in 30 minutes", toMessage(t, response.Body.String()).Message)
+
+	response = request(t, s, "GET", "/mytopic/scheduled", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, later.ID, messages[0].ID)
+
+	response = request(t, s, "DELETE", "/mytopic/scheduled/"+sooner.ID, "", nil)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40403, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "DELETE", "/mytopic/scheduled/"+now.ID, "", nil)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40403, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_ScheduledCancel_OtherPublisher(t *testing.T) {
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "in one hour", map[string]string{
+		"In": "1h",
+	})
+	msg := toMessage(t, response.Body.String())
+
+	response = request(t, s, "DELETE", "/mytopic/scheduled/"+msg.ID, "", map[string]string{
+		"X-Forwarded-For": "1.2.3.4",
+	})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/scheduled", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+}
+
 func TestServer_PublishAtWithCacheError(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -309,6 +533,43 @@ func TestServer_PublishAtAndPrune(t *testing.T) {
 	require.Equal(t, "a message", messages[0].Message)
 }
 
+func TestServer_CacheDurationTopics(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheDuration = time.Hour
+	c.CacheDurationTopics = map[string]time.Duration{
+		"backups":     30 * 24 * time.Hour,
+		"chatty-logs": time.Minute,
+	}
+	s := newTestServer(t, c)
+	for _, topic := range []string{"mytopic", "backups", "chatty-logs"} {
+		m := newDefaultMessage(topic, "two days old")
+		m.Time = time.Now().Add(-48 * time.Hour).Unix()
+		require.Nil(t, s.messageCache.AddMessage(m))
+		m = newDefaultMessage(topic, "ten minutes old")
+		m.Time = time.Now().Add(-10 * time.Minute).Unix()
+		require.Nil(t, s.messageCache.AddMessage(m))
+	}
+
+	// Expired messages are hidden before the pruning job has run ...
+	response := request(t, s, "GET", "/mytopic,backups,chatty-logs/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "mytopic", messages[0].Topic)
+	require.Equal(t, "ten minutes old", messages[0].Message)
+	require.Equal(t, "backups", messages[1].Topic)
+	require.Equal(t, "two days old", messages[1].Message)
+	require.Equal(t, "backups", messages[2].Topic)
+	require.Equal(t, "ten minutes old", messages[2].Message)
+
+	// ... and then removed by it
+	s.updateStatsAndPrune()
+	for topic, expected := range map[string]int{"mytopic": 1, "backups": 2, "chatty-logs": 0} {
+		count, err := s.messageCache.MessageCount(topic)
+		require.Nil(t, err)
+		require.Equal(t, expected, count, topic)
+	}
+}
+
 func TestServer_PublishAndMultiPoll(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -390,6 +651,79 @@ func TestServer_PublishAndPollSince(t *testing.T) {
 	require.Equal(t, 40008, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_PollWithCursor(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for i := 1; i <= 5; i++ {
+		topic := "mytopic"
+		if i%2 == 0 {
+			topic = "othertopic"
+		}
+		request(t, s, "PUT", "/"+topic, fmt.Sprintf("test %d", i), nil) // Most likely all in the same second
+	}
+
+	response := request(t, s, "GET", "/mytopic,othertopic/json?poll=1&limit=2", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "test 1", messages[0].Message)
+	require.Equal(t, "test 2", messages[1].Message)
+	cursor := response.Header().Get("X-Cursor")
+	require.NotEmpty(t, cursor)
+
+	response = request(t, s, "GET", "/mytopic,othertopic/json?poll=1&limit=2&since="+cursor, "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "test 3", messages[0].Message)
+	require.Equal(t, "test 4", messages[1].Message)
+	cursor = response.Header().Get("X-Cursor")
+
+	response = request(t, s, "GET", "/mytopic,othertopic/json?poll=1&since="+cursor, "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "test 5", messages[0].Message)
+	cursor = response.Header().Get("X-Cursor")
+
+	response = request(t, s, "GET", "/mytopic,othertopic/json?poll=1&since="+cursor, "", map[string]string{"X-Limit": "2"})
+	require.Equal(t, 200, response.Code)
+	require.Empty(t, response.Body.String())
+	require.Equal(t, cursor, response.Header().Get("X-Cursor")) // Nothing new, same cursor
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since="+cursor, "", nil)
+	require.Equal(t, cursor, response.Header().Get("X-Cursor")) // Cursors are not tied to topics
+}
+
+func TestServer_PollWithCursor_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", "test", nil).Body.String())
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&since=c_invalid", "", nil)
+	require.Equal(t, 40008, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&limit=-1", "", nil)
+	require.Equal(t, 40024, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&limit=1&since="+msg.ID, "", nil)
+	require.Equal(t, 40024, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&limit=1&scheduled=1", "", nil)
+	require.Equal(t, 40024, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since="+msg.ID, "", nil)
+	require.Empty(t, response.Header().Get("X-Cursor"))
+}
+
+func TestParseSinceCursor(t *testing.T) {
+	cursor, err := parseSinceCursor(newSinceCursor(1650000000, 42).String())
+	require.Nil(t, err)
+	require.True(t, cursor.IsCursor())
+	require.Equal(t, int64(1650000000), cursor.Time().Unix())
+	require.Equal(t, int64(42), cursor.Seq())
+
+	for _, s := range []string{"", "c_", "x_MTIzOjQ1", "c_!!!", "c_MTIz", "c_YTpi", "c_LTE6MQ"} {
+		_, err := parseSinceCursor(s)
+		require.Equal(t, errInvalidCursor, err, s)
+	}
+}
+
 func TestServer_PublishViaGET(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -425,120 +759,589 @@ func TestServer_PublishFirebase(t *testing.T) {
 	// I tried everything. I already had written the test, and it increases the code coverage, so I'll leave it ... :shrug: ...
 
 	c := newTestConfig(t)
-	c.FirebaseKeyFile = firebaseServiceAccountFile(t) // May skip the test!
+	c.FirebaseKeyFile = firebaseServiceAccountFile(t) // May skip the test!
+	s := newTestServer(t, c)
+
+	// Normal message
+	response := request(t, s, "PUT", "/mytopic", "This is a message for firebase", nil)
+	msg := toMessage(t, response.Body.String())
+	require.NotEmpty(t, msg.ID)
+
+	// Keepalive message
+	require.Nil(t, s.firebase(newKeepaliveMessage(firebaseControlTopic)))
+
+	time.Sleep(500 * time.Millisecond) // Time for sends
+}
+
+func TestServer_PublishInvalidTopic(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	s.mailer = &testMailer{}
+	response := request(t, s, "PUT", "/docs", "fail", nil)
+	require.Equal(t, 40010, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PollWithQueryFilters(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic?priority=1&tags=tag1,tag2", "my first message", nil)
+	msg := toMessage(t, response.Body.String())
+	require.NotEmpty(t, msg.ID)
+
+	response = request(t, s, "PUT", "/mytopic?title=a+title", "my second message", map[string]string{
+		"Tags": "tag2,tag3",
+	})
+	msg = toMessage(t, response.Body.String())
+	require.NotEmpty(t, msg.ID)
+
+	queriesThatShouldReturnMessageOne := []string{
+		"/mytopic/json?poll=1&priority=1",
+		"/mytopic/json?poll=1&priority=min",
+		"/mytopic/json?poll=1&priority=min,low",
+		"/mytopic/json?poll=1&priority=1,2",
+		"/mytopic/json?poll=1&p=2,min",
+		"/mytopic/json?poll=1&tags=tag1",
+		"/mytopic/json?poll=1&tags=tag1,tag2",
+		"/mytopic/json?poll=1&message=my+first+message",
+	}
+	for _, query := range queriesThatShouldReturnMessageOne {
+		response = request(t, s, "GET", query, "", nil)
+		messages := toMessages(t, response.Body.String())
+		require.Equal(t, 1, len(messages), "Query failed: "+query)
+		require.Equal(t, "my first message", messages[0].Message, "Query failed: "+query)
+	}
+
+	queriesThatShouldReturnMessageTwo := []string{
+		"/mytopic/json?poll=1&x-priority=3", // !
+		"/mytopic/json?poll=1&priority=3",
+		"/mytopic/json?poll=1&priority=default",
+		"/mytopic/json?poll=1&p=3",
+		"/mytopic/json?poll=1&x-tags=tag2,tag3",
+		"/mytopic/json?poll=1&tags=tag2,tag3",
+		"/mytopic/json?poll=1&tag=tag2,tag3",
+		"/mytopic/json?poll=1&ta=tag2,tag3",
+		"/mytopic/json?poll=1&x-title=a+title",
+		"/mytopic/json?poll=1&title=a+title",
+		"/mytopic/json?poll=1&t=a+title",
+		"/mytopic/json?poll=1&x-message=my+second+message",
+		"/mytopic/json?poll=1&message=my+second+message",
+		"/mytopic/json?poll=1&m=my+second+message",
+		"/mytopic/json?x-poll=1&m=my+second+message",
+		"/mytopic/json?po=1&m=my+second+message",
+	}
+	for _, query := range queriesThatShouldReturnMessageTwo {
+		response = request(t, s, "GET", query, "", nil)
+		messages := toMessages(t, response.Body.String())
+		require.Equal(t, 1, len(messages), "Query failed: "+query)
+		require.Equal(t, "my second message", messages[0].Message, "Query failed: "+query)
+	}
+
+	queriesThatShouldReturnNoMessages := []string{
+		"/mytopic/json?poll=1&priority=4",
+		"/mytopic/json?poll=1&tags=tag1,tag2,tag3",
+		"/mytopic/json?poll=1&title=another+title",
+		"/mytopic/json?poll=1&message=my+third+message",
+		"/mytopic/json?poll=1&message=my+third+message",
+	}
+	for _, query := range queriesThatShouldReturnNoMessages {
+		response = request(t, s, "GET", query, "", nil)
+		messages := toMessages(t, response.Body.String())
+		require.Equal(t, 0, len(messages), "Query failed: "+query)
+	}
+}
+
+func TestServer_PublishReplyAndPollThread(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/incidents", "Database is down", nil)
+	alert := toMessage(t, response.Body.String())
+	require.Empty(t, alert.InReplyTo)
+
+	response = request(t, s, "PUT", "/incidents", "Looking into it", map[string]string{"X-In-Reply-To": alert.ID})
+	require.Equal(t, 200, response.Code)
+	update := toMessage(t, response.Body.String())
+	require.Equal(t, alert.ID, update.InReplyTo)
+	response = request(t, s, "PUT", "/incidents?reply-to="+update.ID, "Fixed, it was the disk", nil)
+	fixed := toMessage(t, response.Body.String())
+	require.Equal(t, update.ID, fixed.InReplyTo) // The parent, not the first message of the thread
+	response = request(t, s, "POST", "/", `{"topic":"incidents","message":"Thanks!","in_reply_to":"`+alert.ID+`"}`, nil)
+	require.Equal(t, alert.ID, toMessage(t, response.Body.String()).InReplyTo)
+	request(t, s, "PUT", "/incidents", "Unrelated", nil)
+
+	response = request(t, s, "GET", "/incidents/json?poll=1&thread="+alert.ID, "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, "Database is down", messages[0].Message)
+	require.Equal(t, "Fixed, it was the disk", messages[2].Message)
+	require.Equal(t, alert.ID, messages[3].InReplyTo)
+
+	response = request(t, s, "GET", "/incidents/json?poll=1", "", nil)
+	require.Equal(t, 5, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_PublishReplyUnknownParent(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/incidents", "Reply to a pruned message", map[string]string{"In-Reply-To": "abcdefghijkl"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "abcdefghijkl", toMessage(t, response.Body.String()).InReplyTo)
+	response = request(t, s, "GET", "/incidents/json?poll=1&thread=abcdefghijkl", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+
+	response = request(t, s, "PUT", "/incidents", "Invalid", map[string]string{"X-In-Reply-To": "not a message ID"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40045, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Search(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/mytopic?tags=warning", "Disk full on the backup server", nil)
+	request(t, s, "PUT", "/mytopic?priority=5", "Backup failed", nil)
+	request(t, s, "PUT", "/othertopic", "Backup failed, too", nil)
+
+	response := request(t, s, "GET", "/mytopic/search?q=backup", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/x-ndjson; charset=utf-8", response.Header().Get("Content-Type"))
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "Disk full on the backup server", messages[0].Message)
+	require.Equal(t, "Backup failed", messages[1].Message)
+
+	response = request(t, s, "GET", "/mytopic/search?q=WARN+disk", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Disk full on the backup server", messages[0].Message)
+
+	response = request(t, s, "GET", "/mytopic,othertopic/search?q=failed&priority=high,urgent", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Backup failed", messages[0].Message)
+
+	response = request(t, s, "GET", "/mytopic,othertopic/search", "", map[string]string{
+		"X-Query": "failed",
+	})
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+
+	response = request(t, s, "GET", "/mytopic/search?q=nothing", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Empty(t, response.Body.String())
+}
+
+func TestServer_Search_QueryInvalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, path := range []string{"/mytopic/search", "/mytopic/search?q=", "/mytopic/search?q=%2A%2B%21"} {
+		response := request(t, s, "GET", path, "", nil)
+		require.Equal(t, 400, response.Code)
+		require.Equal(t, 40021, toHTTPError(t, response.Body.String()).Code)
+	}
+}
+
+func TestServer_Search_CacheEncrypted(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheEncryptionKeyFile = writeTestCacheKeyFile(t, base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	s := newTestServer(t, c)
+
+	request(t, s, "PUT", "/mytopic", "Backup failed", nil)
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, "Backup failed", toMessage(t, response.Body.String()).Message)
+
+	response = request(t, s, "GET", "/mytopic/search?q=backup", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40029, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_SubscribeWithQueryFilters(t *testing.T) {
+	c := newTestConfig(t)
+	c.KeepaliveInterval = 800 * time.Millisecond
+	s := newTestServer(t, c)
+
+	subscribeResponse := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json?tags=zfs-issue", subscribeResponse)
+
+	response := request(t, s, "PUT", "/mytopic", "my first message", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "ZFS scrub failed", map[string]string{
+		"Tags": "zfs-issue,zfs-scrub",
+	})
+	require.Equal(t, 200, response.Code)
+
+	time.Sleep(850 * time.Millisecond)
+	subscribeCancel()
+
+	messages := toMessages(t, subscribeResponse.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, messageEvent, messages[1].Event)
+	require.Equal(t, "ZFS scrub failed", messages[1].Message)
+	require.Equal(t, keepaliveEvent, messages[2].Event)
+}
+
+func TestServer_ExportImport(t *testing.T) {
+	s1 := newTestServer(t, newTestConfig(t))
+	request(t, s1, "PUT", "/mytopic?title=Backup&tags=disk", "backup failed", nil)
+	request(t, s1, "PUT", "/mytopic", "later", map[string]string{"In": "1h"})
+	request(t, s1, "PUT", "/othertopic", "not exported", nil)
+
+	response := request(t, s1, "GET", "/mytopic/export", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "attachment; filename=mytopic.ndjson", response.Header().Get("Content-Disposition"))
+	exported := response.Body.String()
+	messages := toMessages(t, exported)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "backup failed", messages[0].Message)
+	require.Equal(t, "later", messages[1].Message)
+
+	s2 := newTestServer(t, newTestConfig(t))
+	response = request(t, s2, "PUT", "/newtopic/import", exported, nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"imported":2,"skipped":0}`+"\n", response.Body.String())
+
+	response = request(t, s2, "POST", "/newtopic/import", exported, nil) // Repeated imports are fine
+	require.Equal(t, `{"imported":0,"skipped":2}`+"\n", response.Body.String())
+
+	response = request(t, s2, "GET", "/newtopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "newtopic", messages[0].Topic)
+	require.Equal(t, "backup failed", messages[0].Message)
+	require.Equal(t, "Backup", messages[0].Title)
+	require.Equal(t, []string{"disk"}, messages[0].Tags)
+
+	response = request(t, s2, "GET", "/newtopic/json?poll=1&sched=1", "", nil)
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_Import_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, body := range []string{
+		"not json",
+		`{"id":"abc","time":1,"event":"message","topic":"mytopic","message":"invalid ID"}`,
+		`{"id":"nFS3knfcQ1xe","time":1,"event":"open","topic":"mytopic"}`,
+		`{"id":"nFS3knfcQ1xe","event":"message","topic":"mytopic","message":"no time"}`,
+	} {
+		response := request(t, s, "PUT", "/mytopic/import", body, nil)
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40022, toHTTPError(t, response.Body.String()).Code)
+	}
+	count, err := s.messageCache.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+
+	c := newTestConfig(t)
+	c.CacheDuration = 0
+	s = newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic/import", `{"id":"nFS3knfcQ1xe","time":1,"event":"message","topic":"mytopic"}`, nil)
+	require.Equal(t, 40023, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_ExportImport_AdminOnly(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = true
+	c.AuthDefaultWrite = true
+	s := newTestServer(t, c)
+
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleAdmin))
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+
+	response := request(t, s, "GET", "/mytopic/export", "", nil)
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "GET", "/mytopic/export", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/mytopic/import", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/mytopic/export", "", map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_UpdateMessage(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", "Downloading: 10%", map[string]string{
+		"Title": "Download",
+		"Tags":  "download",
+	}).Body.String())
+	time.Sleep(200 * time.Millisecond) // Publishing is asynchronous
+
+	response := request(t, s, "PUT", "/mytopic/"+msg.ID, "Downloading: 50%", map[string]string{
+		"Priority": "high",
+	})
+	require.Equal(t, 200, response.Code)
+	updated := toMessage(t, response.Body.String())
+	require.Equal(t, messageUpdatedEvent, updated.Event)
+	require.Equal(t, msg.ID, updated.ID)
+	require.Equal(t, msg.Time, updated.Time)
+	require.Equal(t, "Downloading: 50%", updated.Message)
+	require.Equal(t, "Download", updated.Title) // Unchanged
+	require.Equal(t, 4, updated.Priority)
+	require.Equal(t, []string{"download"}, updated.Tags)
+	subscribeCancel()
+
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, messageEvent, messages[1].Event)
+	require.Equal(t, messageUpdatedEvent, messages[2].Event)
+	require.Equal(t, "Downloading: 50%", messages[2].Message)
+
+	response = request(t, s, "PUT", "/mytopic/"+msg.ID, "", map[string]string{
+		"Title": "Download complete",
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, messageEvent, messages[0].Event)
+	require.Equal(t, "Downloading: 50%", messages[0].Message)
+	require.Equal(t, "Download complete", messages[0].Title)
+}
+
+func TestServer_UpdateMessage_Invalid(t *testing.T) {
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", "my message", nil).Body.String())
+
+	response := request(t, s, "PUT", "/mytopic/"+msg.ID, "", nil)
+	require.Equal(t, 40025, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic/"+msg.ID, "", map[string]string{"Priority": "urgentest"})
+	require.Equal(t, 40007, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic/abcdefghijkl", "new message", nil)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic/"+msg.ID, "new message", map[string]string{
+		"X-Forwarded-For": "5.6.7.8", // Not the publisher
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_DeleteMessage(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", "oops, wrong topic", nil).Body.String())
+	time.Sleep(200 * time.Millisecond) // Publishing is asynchronous
+
+	response := request(t, s, "DELETE", "/mytopic/"+msg.ID, "", nil)
+	require.Equal(t, 200, response.Code)
+	deleted := toMessage(t, response.Body.String())
+	require.Equal(t, messageDeletedEvent, deleted.Event)
+	require.Equal(t, msg.ID, deleted.ID)
+	subscribeCancel()
+
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, messageEvent, messages[1].Event)
+	require.Equal(t, messageDeletedEvent, messages[2].Event)
+	require.Equal(t, msg.ID, messages[2].ID)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Empty(t, toMessages(t, response.Body.String()))
+
+	response = request(t, s, "DELETE", "/mytopic/"+msg.ID, "", nil)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_DeleteMessage_OtherPublisher(t *testing.T) {
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", "my message", map[string]string{
+		"X-Forwarded-For": "1.2.3.4",
+	}).Body.String())
+
+	response := request(t, s, "DELETE", "/mytopic/"+msg.ID, "", map[string]string{
+		"X-Forwarded-For": "5.6.7.8",
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/mytopic/"+msg.ID, "", map[string]string{
+		"X-Forwarded-For": "1.2.3.4",
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_DeleteMessage_Auth(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = true
+	c.AuthDefaultWrite = true
+	s := newTestServer(t, c)
+
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleAdmin))
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AddUser("marian", "marian", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "protected", true, true))
+	require.Nil(t, manager.AllowAccess(auth.Everyone, "protected", true, false))
+
+	// Publisher may delete their own message, other users may not
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", "from marian", map[string]string{
+		"Authorization": basicAuth("marian:marian"),
+	}).Body.String())
+	response := request(t, s, "DELETE", "/mytopic/"+msg.ID, "", nil) // Same IP, but not anonymous
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/mytopic/"+msg.ID, "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/mytopic/"+msg.ID, "", map[string]string{
+		"Authorization": basicAuth("marian:marian"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Topic owner may delete messages of others, and so may admins
+	for _, user := range []string{"ben:ben", "phil:phil"} {
+		msg = toMessage(t, request(t, s, "PUT", "/protected", "from phil", map[string]string{
+			"Authorization": basicAuth("phil:phil"),
+		}).Body.String())
+		response = request(t, s, "DELETE", "/protected/"+msg.ID, "", map[string]string{
+			"Authorization": basicAuth(user),
+		})
+		require.Equal(t, 200, response.Code)
+	}
+
+	// Users without write access cannot delete at all
+	msg = toMessage(t, request(t, s, "PUT", "/protected", "from ben", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	}).Body.String())
+	response = request(t, s, "DELETE", "/protected/"+msg.ID, "", map[string]string{
+		"Authorization": basicAuth("marian:marian"),
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_StopWritesBatchedMessages(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheBatchSize = 10
+	c.CacheBatchTimeout = time.Minute
 	s := newTestServer(t, c)
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), nil)
+		require.Equal(t, 200, response.Code)
+	}
+	s.closeChan = make(chan bool) // Normally created by Run
+	s.Stop()
 
-	// Normal message
-	response := request(t, s, "PUT", "/mytopic", "This is a message for firebase", nil)
-	msg := toMessage(t, response.Body.String())
-	require.NotEmpty(t, msg.ID)
-
-	// Keepalive message
-	require.Nil(t, s.firebase(newKeepaliveMessage(firebaseControlTopic)))
-
-	time.Sleep(500 * time.Millisecond) // Time for sends
+	cache, err := newSqliteCache(c.CacheFile, 0, 0, false)
+	require.Nil(t, err)
+	count, err := cache.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
 }
 
-func TestServer_PublishInvalidTopic(t *testing.T) {
-	s := newTestServer(t, newTestConfig(t))
-	s.mailer = &testMailer{}
-	response := request(t, s, "PUT", "/docs", "fail", nil)
-	require.Equal(t, 40010, toHTTPError(t, response.Body.String()).Code)
+func TestServer_PublishWithDedupKey_Batched(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheBatchSize = 10
+	c.CacheBatchTimeout = time.Minute
+	s := newTestServer(t, c)
+	msg1 := toMessage(t, request(t, s, "PUT", "/mytopic?dedup=backup-1", "backup done", nil).Body.String())
+	msg2 := toMessage(t, request(t, s, "PUT", "/mytopic?dedup=backup-1", "backup done (retry)", nil).Body.String())
+	require.Equal(t, msg1.ID, msg2.ID) // The first message is still queued, but found anyway
+	response := request(t, s, "POST", "/mytopic/"+msg1.ID+"/ack", "", nil)
+	require.Equal(t, 200, response.Code)
 }
 
-func TestServer_PollWithQueryFilters(t *testing.T) {
-	s := newTestServer(t, newTestConfig(t))
-
-	response := request(t, s, "PUT", "/mytopic?priority=1&tags=tag1,tag2", "my first message", nil)
-	msg := toMessage(t, response.Body.String())
-	require.NotEmpty(t, msg.ID)
-
-	response = request(t, s, "PUT", "/mytopic?title=a+title", "my second message", map[string]string{
-		"Tags": "tag2,tag3",
-	})
-	msg = toMessage(t, response.Body.String())
-	require.NotEmpty(t, msg.ID)
-
-	queriesThatShouldReturnMessageOne := []string{
-		"/mytopic/json?poll=1&priority=1",
-		"/mytopic/json?poll=1&priority=min",
-		"/mytopic/json?poll=1&priority=min,low",
-		"/mytopic/json?poll=1&priority=1,2",
-		"/mytopic/json?poll=1&p=2,min",
-		"/mytopic/json?poll=1&tags=tag1",
-		"/mytopic/json?poll=1&tags=tag1,tag2",
-		"/mytopic/json?poll=1&message=my+first+message",
-	}
-	for _, query := range queriesThatShouldReturnMessageOne {
-		response = request(t, s, "GET", query, "", nil)
-		messages := toMessages(t, response.Body.String())
-		require.Equal(t, 1, len(messages), "Query failed: "+query)
-		require.Equal(t, "my first message", messages[0].Message, "Query failed: "+query)
-	}
+func TestServer_PurgeTopic(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "mytopic", "othertopic")
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+	msg1 := toMessage(t, request(t, s, "PUT", "/mytopic", "password=hunter2", phil).Body.String())
+	msg2 := toMessage(t, request(t, s, "PUT", "/mytopic?f=secrets.txt", "password=hunter2", phil).Body.String())
+	request(t, s, "PUT", "/mytopic?delay=1h", "scheduled", phil)
+	request(t, s, "PUT", "/othertopic", "other", phil)
+	require.FileExists(t, attachmentFile(t, s, msg2))
+	time.Sleep(200 * time.Millisecond) // Publishing is asynchronous
+
+	response := request(t, s, "DELETE", "/mytopic", "", phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"deleted":3}`+"\n", response.Body.String())
+	subscribeCancel()
 
-	queriesThatShouldReturnMessageTwo := []string{
-		"/mytopic/json?poll=1&x-priority=3", // !
-		"/mytopic/json?poll=1&priority=3",
-		"/mytopic/json?poll=1&priority=default",
-		"/mytopic/json?poll=1&p=3",
-		"/mytopic/json?poll=1&x-tags=tag2,tag3",
-		"/mytopic/json?poll=1&tags=tag2,tag3",
-		"/mytopic/json?poll=1&tag=tag2,tag3",
-		"/mytopic/json?poll=1&ta=tag2,tag3",
-		"/mytopic/json?poll=1&x-title=a+title",
-		"/mytopic/json?poll=1&title=a+title",
-		"/mytopic/json?poll=1&t=a+title",
-		"/mytopic/json?poll=1&x-message=my+second+message",
-		"/mytopic/json?poll=1&message=my+second+message",
-		"/mytopic/json?poll=1&m=my+second+message",
-		"/mytopic/json?x-poll=1&m=my+second+message",
-		"/mytopic/json?po=1&m=my+second+message",
-	}
-	for _, query := range queriesThatShouldReturnMessageTwo {
-		response = request(t, s, "GET", query, "", nil)
-		messages := toMessages(t, response.Body.String())
-		require.Equal(t, 1, len(messages), "Query failed: "+query)
-		require.Equal(t, "my second message", messages[0].Message, "Query failed: "+query)
-	}
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 5, len(messages)) // open, two messages, and no message_deleted for the scheduled message
+	require.Equal(t, messageDeletedEvent, messages[3].Event)
+	require.Equal(t, messageDeletedEvent, messages[4].Event)
+	require.ElementsMatch(t, []string{msg1.ID, msg2.ID}, []string{messages[3].ID, messages[4].ID})
 
-	queriesThatShouldReturnNoMessages := []string{
-		"/mytopic/json?poll=1&priority=4",
-		"/mytopic/json?poll=1&tags=tag1,tag2,tag3",
-		"/mytopic/json?poll=1&title=another+title",
-		"/mytopic/json?poll=1&message=my+third+message",
-		"/mytopic/json?poll=1&message=my+third+message",
-	}
-	for _, query := range queriesThatShouldReturnNoMessages {
-		response = request(t, s, "GET", query, "", nil)
-		messages := toMessages(t, response.Body.String())
-		require.Equal(t, 0, len(messages), "Query failed: "+query)
-	}
+	require.NoFileExists(t, attachmentFile(t, s, msg2))
+	response = request(t, s, "GET", "/mytopic/json?poll=1&scheduled=1", "", nil)
+	require.Empty(t, toMessages(t, response.Body.String()))
+	response = request(t, s, "GET", "/othertopic/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
 }
 
-func TestServer_SubscribeWithQueryFilters(t *testing.T) {
+func TestServer_PurgeTopic_Auth(t *testing.T) {
 	c := newTestConfig(t)
-	c.KeepaliveInterval = 800 * time.Millisecond
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = true
+	c.AuthDefaultWrite = true
 	s := newTestServer(t, c)
 
-	subscribeResponse := httptest.NewRecorder()
-	subscribeCancel := subscribe(t, s, "/mytopic/json?tags=zfs-issue", subscribeResponse)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleAdmin))
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "protected", true, true))
+	require.Nil(t, manager.AllowAccess(auth.Everyone, "protected", true, false))
 
-	response := request(t, s, "PUT", "/mytopic", "my first message", nil)
+	// Everyone can write to mytopic, so only admins own it
+	request(t, s, "PUT", "/mytopic", "my message", nil)
+	response := request(t, s, "DELETE", "/mytopic", "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/mytopic", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/mytopic", "", map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+	})
 	require.Equal(t, 200, response.Code)
-	response = request(t, s, "PUT", "/mytopic", "ZFS scrub failed", map[string]string{
-		"Tags": "zfs-issue,zfs-scrub",
+	require.Equal(t, `{"deleted":1}`+"\n", response.Body.String())
+
+	// Ben owns the protected topic
+	response = request(t, s, "DELETE", "/protected", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
 	})
 	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/protected", "", nil)
+	require.Equal(t, 403, response.Code)
+}
 
-	time.Sleep(850 * time.Millisecond)
-	subscribeCancel()
+func TestServer_PurgeTopic_PublishOnly(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "mytopic")
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowPermissions("ben", "mytopic", auth.PermissionPublish))
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
 
-	messages := toMessages(t, subscribeResponse.Body.String())
-	require.Equal(t, 3, len(messages))
-	require.Equal(t, openEvent, messages[0].Event)
-	require.Equal(t, messageEvent, messages[1].Event)
-	require.Equal(t, "ZFS scrub failed", messages[1].Message)
-	require.Equal(t, keepaliveEvent, messages[2].Event)
+	// Ben may publish, but doesn't own the topic
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "my message", ben).Code)
+	response := request(t, s, "DELETE", "/mytopic", "", ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/mytopic/webhooks", `{"webhooks":[{"url":"https://example.com/hook"}]}`, ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/mytopic", "", phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"deleted":1}`+"\n", response.Body.String())
+}
+
+func TestServer_PurgeTopic_NoAuth(t *testing.T) {
+	// Without access control, nobody owns a topic, so it can't be purged
+	s := newTestServer(t, newTestConfig(t))
+	request(t, s, "PUT", "/mytopic", "my message", nil)
+	response := request(t, s, "DELETE", "/mytopic", "", nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
 }
 
 func TestServer_Auth_Success_Admin(t *testing.T) {
@@ -662,6 +1465,47 @@ func TestServer_Auth_Fail_CannotPublish(t *testing.T) {
 	require.Equal(t, 403, response.Code) // Anonymous read not allowed
 }
 
+func TestServer_Auth_FineGrainedPermissions(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	s := newTestServer(t, c)
+
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("sensor", "sensor", auth.RoleUser))
+	require.Nil(t, manager.AddUser("viewer", "viewer", auth.RoleUser))
+	require.Nil(t, manager.AllowPermissions("sensor", "readings", auth.PermissionPublish))
+	require.Nil(t, manager.AllowPermissions("viewer", "readings", auth.PermissionSubscribe|auth.PermissionPublish))
+	sensor := map[string]string{"Authorization": basicAuth("sensor:sensor")}
+	viewer := map[string]string{"Authorization": basicAuth("viewer:viewer")}
+
+	response := request(t, s, "PUT", "/readings", "21.5", sensor)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/readings?filename=data.txt", "21.5", sensor)
+	require.Equal(t, 403, response.Code) // Cannot attach
+	response = request(t, s, "PUT", "/readings?attach=https://example.com/data.txt", "21.5", sensor)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/readings/json?poll=1", "", sensor)
+	require.Equal(t, 403, response.Code) // Cannot read history
+
+	response = request(t, s, "GET", "/readings/json?poll=1", "", viewer)
+	require.Equal(t, 403, response.Code) // Can only subscribe to new messages
+	response = request(t, s, "GET", "/readings/json?since=all", "", viewer)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/readings/search?q=21", "", viewer)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/readings", "hi", viewer)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/readings?attach=https://example.com/data.txt", "hi", viewer)
+	require.Equal(t, 403, response.Code)
+
+	require.Nil(t, manager.AllowPermissions("viewer", "readings", auth.PermissionPoll|auth.PermissionAttach))
+	response = request(t, s, "GET", "/readings/json?poll=1", "", viewer)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+	response = request(t, s, "PUT", "/readings?filename=data.txt", "hi", viewer)
+	require.Equal(t, 403, response.Code) // Publish permission was replaced
+}
+
 func TestServer_Auth_ViaQuery(t *testing.T) {
 	c := newTestConfig(t)
 	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
@@ -704,13 +1548,21 @@ func TestServer_Curl_Publish_Poll(t *testing.T) {
 
 type testMailer struct {
 	count int
+	last  *message
+	errs  []error // Returned by the next calls to Send, if any
 	mu    sync.Mutex
 }
 
 func (t *testMailer) Send(from, to string, m *message) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if len(t.errs) > 0 {
+		err := t.errs[0]
+		t.errs = t.errs[1:]
+		return err
+	}
 	t.count++
+	t.last = m
 	return nil
 }
 
@@ -896,6 +1748,22 @@ func TestServer_PublishActions_AndPoll(t *testing.T) {
 	require.Equal(t, "target_temp_f=65", m.Actions[1].Body)
 }
 
+func TestServer_PublishGroup_AndPoll(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "backup failed", map[string]string{
+		"X-Group": "backup-job-17",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "backup-job-17", toMessage(t, response.Body.String()).Group)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "backup-job-17", toMessage(t, response.Body.String()).Group)
+
+	response = request(t, s, "PUT", "/mytopic?group="+strings.Repeat("x", 257), "backup failed again", nil)
+	require.Equal(t, 40019, toHTTPError(t, response.Body.String()).Code)
+}
+
 func TestServer_PublishAsJSON(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	body := `{"topic":"mytopic","message":"A message","title":"a title\nwith lines","tags":["tag1","tag 2"],` +
@@ -931,6 +1799,100 @@ func TestServer_PublishAsJSON_WithEmail(t *testing.T) {
 	require.Equal(t, 1, mailer.Count())
 }
 
+func TestServer_SendEmail_Retry(t *testing.T) {
+	c := newTestConfig(t)
+	c.EnableMetrics = true
+	s := newTestServer(t, c)
+	mailer := &testMailer{errs: []error{
+		&textproto.Error{Code: 451, Msg: "4.7.1 Greylisted"},
+		errors.New("connection reset by peer"),
+	}}
+	s.mailer = mailer
+	s.sendEmail("1.2.3.4", "phil@example.com", newDefaultMessage("mytopic", "A message"))
+	require.Equal(t, 0, mailer.Count())
+
+	// Not due yet
+	require.Nil(t, s.sendQueuedEmails())
+	require.Equal(t, 0, mailer.Count())
+
+	// Second attempt fails again, third attempt succeeds
+	_, err := s.messageCache.(*sqlCache).db.Exec(`UPDATE emails SET next_attempt = 0`)
+	require.Nil(t, err)
+	require.Nil(t, s.sendQueuedEmails())
+	emails, err := s.messageCache.EmailsDue()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(emails))
+	_, err = s.messageCache.(*sqlCache).db.Exec(`UPDATE emails SET next_attempt = 0`)
+	require.Nil(t, err)
+	require.Nil(t, s.sendQueuedEmails())
+	require.Equal(t, 1, mailer.Count())
+
+	response := request(t, s, "GET", "/metrics", "", nil)
+	body := response.Body.String()
+	require.Contains(t, body, "ntfy_emails_sent_total 1\n")
+	require.Contains(t, body, "ntfy_emails_retried_total 2\n")
+	require.Contains(t, body, "ntfy_emails_failed_total 0\n")
+	require.Contains(t, body, "ntfy_emails_queued 0\n")
+}
+
+func TestServer_SendEmail_PermanentErrorAndMaxAge(t *testing.T) {
+	c := newTestConfig(t)
+	c.EnableMetrics = true
+	s := newTestServer(t, c)
+	s.mailer = &testMailer{errs: []error{&textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}}}
+	s.sendEmail("1.2.3.4", "nobody@example.com", newDefaultMessage("mytopic", "A message"))
+
+	c.SMTPSenderRetryMaxAge = 0 // Retries disabled
+	s.mailer = &testMailer{errs: []error{errors.New("connection refused")}}
+	s.sendEmail("1.2.3.4", "phil@example.com", newDefaultMessage("mytopic", "A message"))
+
+	response := request(t, s, "GET", "/metrics", "", nil)
+	body := response.Body.String()
+	require.Contains(t, body, "ntfy_emails_sent_total 0\n")
+	require.Contains(t, body, "ntfy_emails_failed_total 2\n")
+	require.Contains(t, body, "ntfy_emails_queued 0\n")
+}
+
+func TestServer_PublishWithEmailDigest(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	mailer := &testMailer{}
+	s.mailer = mailer
+	for i := 0; i < 20; i++ { // More than the e-mail limit
+		response := request(t, s, "PUT", "/ci", fmt.Sprintf("build %d failed", i), map[string]string{
+			"Email":        "phil@example.com",
+			"Email-Digest": "15m",
+			"Priority":     "high",
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	require.Nil(t, s.sendEmailDigests())
+	require.Equal(t, 0, mailer.Count()) // Window has not passed yet
+
+	_, err := s.messageCache.(*sqlCache).db.Exec(`UPDATE email_digests SET due = 0`)
+	require.Nil(t, err)
+	require.Nil(t, s.sendEmailDigests())
+	require.Equal(t, 1, mailer.Count())
+	require.Equal(t, "20 messages in ci", mailer.last.Title)
+	require.Equal(t, 4, mailer.last.Priority)
+	require.Contains(t, mailer.last.Message, "build 0 failed")
+	require.Contains(t, mailer.last.Message, "build 19 failed")
+
+	pending, err := s.messageCache.EmailDigestPending("ci", "phil@example.com")
+	require.Nil(t, err)
+	require.False(t, pending)
+}
+
+func TestServer_PublishWithEmailDigest_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	s.mailer = &testMailer{}
+	response := request(t, s, "PUT", "/ci", "build failed", map[string]string{"Email-Digest": "15m"}) // No e-mail
+	require.Equal(t, 40020, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/ci?email=phil@example.com&digest=10s", "build failed", nil) // Too short
+	require.Equal(t, 40020, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/ci?email=phil@example.com&digest=soon", "build failed", nil)
+	require.Equal(t, 40020, toHTTPError(t, response.Body.String()).Code)
+}
+
 func TestServer_PublishAsJSON_WithActions(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	body := `{
@@ -984,7 +1946,7 @@ func TestServer_PublishAttachment(t *testing.T) {
 	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(179*time.Minute).Unix()) // Almost 3 hours
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
 	require.Equal(t, "", msg.Attachment.Owner) // Should never be returned
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+	require.FileExists(t, attachmentFile(t, s, msg))
 
 	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
 	response = request(t, s, "GET", path, "", nil)
@@ -1013,7 +1975,7 @@ func TestServer_PublishAttachmentShortWithFilename(t *testing.T) {
 	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(3*time.Hour).Unix())
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
 	require.Equal(t, "", msg.Attachment.Owner) // Should never be returned
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+	require.FileExists(t, attachmentFile(t, s, msg))
 
 	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
 	response = request(t, s, "GET", path, "", nil)
@@ -1139,7 +2101,7 @@ func TestServer_PublishAttachmentAndPrune(t *testing.T) {
 	response := request(t, s, "PUT", "/mytopic", content, nil)
 	msg := toMessage(t, response.Body.String())
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-	file := filepath.Join(s.config.AttachmentCacheDir, msg.ID)
+	file := attachmentFile(t, s, msg)
 	require.FileExists(t, file)
 
 	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
@@ -1155,6 +2117,71 @@ func TestServer_PublishAttachmentAndPrune(t *testing.T) {
 	require.Equal(t, 404, response.Code)
 }
 
+func TestServer_PublishAttachmentDeduplicated(t *testing.T) {
+	content := util.RandomString(5000) // > 4096
+	s := newTestServer(t, newTestConfig(t))
+
+	msg1 := toMessage(t, request(t, s, "PUT", "/mytopic", content, nil).Body.String())
+	msg2 := toMessage(t, request(t, s, "PUT", "/mytopic?f=snapshot.txt", content, nil).Body.String())
+	msg3 := toMessage(t, request(t, s, "PUT", "/mytopic", util.RandomString(5000), nil).Body.String())
+	require.Equal(t, attachmentFile(t, s, msg1), attachmentFile(t, s, msg2))
+	require.NotEqual(t, attachmentFile(t, s, msg1), attachmentFile(t, s, msg3))
+	require.Equal(t, int64(5000), msg2.Attachment.Size)
+	entries, err := os.ReadDir(s.config.AttachmentCacheDir)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, int64(10000), s.fileCache.Size())
+
+	size, err := s.messageCache.AttachmentBytesUsed("9.9.9.9") // See request()
+	require.Nil(t, err)
+	require.Equal(t, int64(10000), size)
+
+	path := strings.TrimPrefix(msg2.Attachment.URL, "http://127.0.0.1:12345")
+	response := request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+
+	// File is only deleted once no message references it anymore
+	require.Equal(t, 200, request(t, s, "DELETE", "/mytopic/"+msg1.ID, "", nil).Code)
+	require.FileExists(t, attachmentFile(t, s, msg2))
+	require.Equal(t, 200, request(t, s, "DELETE", "/mytopic/"+msg2.ID, "", nil).Code)
+	require.NoFileExists(t, attachmentFile(t, s, msg2))
+	require.FileExists(t, attachmentFile(t, s, msg3))
+}
+
+func TestServer_PublishAttachmentThumbnail(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	photo := newTestPNG(t, 1000, 800, color.RGBA{G: 255, A: 255})
+	msg1 := toMessage(t, request(t, s, "PUT", "/mytopic", string(photo), nil).Body.String())
+	require.Equal(t, "image/png", msg1.Attachment.Type)
+	require.Equal(t, strings.TrimSuffix(msg1.Attachment.URL, ".png")+"-thumb.jpg", msg1.Attachment.Thumbnail)
+
+	response := request(t, s, "GET", strings.TrimPrefix(msg1.Attachment.Thumbnail, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "image/jpeg", response.Header().Get("Content-Type"))
+	require.Equal(t, image.Rect(0, 0, 640, 512), decodeTestJPEG(t, response.Body.Bytes()).Bounds())
+
+	// Same image again: same thumbnail
+	msg2 := toMessage(t, request(t, s, "PUT", "/mytopic", string(photo), nil).Body.String())
+	require.Equal(t, msg1.Attachment.Thumbnail, msg2.Attachment.Thumbnail)
+	messages := toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", nil).Body.String())
+	require.Equal(t, msg1.Attachment.Thumbnail, messages[0].Attachment.Thumbnail)
+
+	// Small images and other files have no thumbnails
+	icon := toMessage(t, request(t, s, "PUT", "/mytopic", string(newTestPNG(t, 64, 64, color.RGBA{A: 255})), nil).Body.String())
+	require.Equal(t, "", icon.Attachment.Thumbnail)
+	text := toMessage(t, request(t, s, "PUT", "/mytopic", util.RandomString(5000), nil).Body.String())
+	require.Equal(t, "", text.Attachment.Thumbnail)
+
+	// Thumbnail is removed with the file
+	thumbnail := filepath.Join(s.config.AttachmentCacheDir, thumbnailFileID(strings.TrimSuffix(filepath.Base(attachmentFile(t, s, msg1)), ".png")))
+	require.FileExists(t, thumbnail)
+	require.Equal(t, 200, request(t, s, "DELETE", "/mytopic/"+msg1.ID, "", nil).Code)
+	require.FileExists(t, thumbnail)
+	require.Equal(t, 200, request(t, s, "DELETE", "/mytopic/"+msg2.ID, "", nil).Code)
+	require.NoFileExists(t, thumbnail)
+}
+
 func TestServer_PublishAttachmentBandwidthLimit(t *testing.T) {
 	content := util.RandomString(5000) // > 4096
 
@@ -1203,6 +2230,71 @@ func TestServer_PublishAttachmentBandwidthLimitUploadOnly(t *testing.T) {
 	require.Equal(t, 41301, err.Code)
 }
 
+func TestServer_PublishAttachmentDownloadRateLimit(t *testing.T) {
+	content := util.RandomString(5000) // > 4096
+
+	c := newTestConfig(t)
+	c.VisitorAttachmentDownloadRateLimit = 2500 // Half the file right away, the other half after a second
+	s := newTestServer(t, c)
+
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", content, nil).Body.String())
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	start := time.Now()
+	response := request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+	require.Equal(t, "text/plain; charset=utf-8", response.Header().Get("Content-Type"))
+	require.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestServer_PublishAttachmentGlobalDownloadRateLimit(t *testing.T) {
+	content := util.RandomString(5000) // > 4096
+
+	c := newTestConfig(t)
+	c.TotalAttachmentDownloadRateLimit = 5000 // Only the first download is not throttled
+	s := newTestServer(t, c)
+
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", content, nil).Body.String())
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	start := time.Now()
+	require.Equal(t, content, request(t, s, "GET", path, "", nil).Body.String())
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", path, nil)
+	req.RemoteAddr = "1.2.3.4" // Different visitor, same global limiter
+	s.handle(rr, req)
+	require.Equal(t, content, rr.Body.String())
+	require.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestServer_PublishAttachmentAllowedTypes(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentAllowedTypes = []string{"image/*", "text/plain"}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic?f=flower.png", string(newTestPNG(t, 10, 10, color.RGBA{R: 255, A: 255})), nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "image/png", toMessage(t, response.Body.String()).Attachment.Type)
+
+	response = request(t, s, "PUT", "/mytopic?f=notes.txt", "some notes", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic?f=invoice.pdf", "%PDF-1.4 not really a PDF", nil)
+	require.Equal(t, 415, response.Code)
+	require.Equal(t, 41501, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic?f=page.txt", "<!DOCTYPE html><html><script>alert(1)</script></html>", nil) // Sniffed as HTML
+	require.Equal(t, 415, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic?f=flower.apk", string(newTestPNG(t, 10, 10, color.RGBA{R: 255, A: 255})), nil) // Typed as APK
+	require.Equal(t, 415, response.Code)
+
+	entries, err := os.ReadDir(c.AttachmentCacheDir)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+}
+
 func TestServer_PublishAttachmentUserStats(t *testing.T) {
 	content := util.RandomString(4999) // > 4096
 
@@ -1243,6 +2335,21 @@ func newTestServer(t *testing.T, config *Config) *Server {
 	return server
 }
 
+// newTestServerWithTopicOwner returns a server with access control, on which the user "phil" owns the given topics
+// (see topicOwner), and the headers to authenticate as phil. Everyone may read, but not write.
+func newTestServerWithTopicOwner(t *testing.T, c *Config, topics ...string) (*Server, map[string]string) {
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = true
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	for _, topic := range topics {
+		require.Nil(t, manager.AllowAccess("phil", topic, true, true))
+	}
+	return s, map[string]string{"Authorization": basicAuth("phil:phil")}
+}
+
 func request(t *testing.T, s *Server, method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
 	req, err := http.NewRequest(method, url, strings.NewReader(body))
@@ -1292,6 +2399,15 @@ func toMessage(t *testing.T, s string) *message {
 	return &m
 }
 
+// attachmentFile returns the path of the uploaded file of the message in the attachment cache directory
+func attachmentFile(t *testing.T, s *Server, m *message) string {
+	u, err := url.Parse(strings.TrimPrefix(m.Attachment.URL, s.config.BaseURL))
+	require.Nil(t, err)
+	matches := fileRegex.FindStringSubmatch(u.Path) // Without the signature, see fileURL
+	require.Equal(t, 2, len(matches))
+	return filepath.Join(s.config.AttachmentCacheDir, matches[1])
+}
+
 func toHTTPError(t *testing.T, s string) *errHTTP {
 	var e errHTTP
 	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&e))
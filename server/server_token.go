@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	userTokensPath     = "/user/tokens"
+	apiRequestMaxBytes = 4096
+	tokenMaxTopics     = 50
+)
+
+var (
+	userTokenPathRegex = regexp.MustCompile(`^/user/tokens/(tk_[A-Za-z0-9]{29})$`)
+)
+
+// tokenRequest is the body of a request to create an access token, e.g.
+// {"label":"backup script","topics":["backups"],"permission":"write-only","expires":"30d"}
+type tokenRequest struct {
+	Label      string   `json:"label"`
+	Topics     []string `json:"topics"`
+	Permission string   `json:"permission"`
+	Expires    string   `json:"expires"` // Duration, unix timestamp, or natural language; never expires if empty
+}
+
+type tokenResponse struct {
+	Token   string        `json:"token"`
+	Label   string        `json:"label,omitempty"`
+	Access  []accessGrant `json:"access"`
+	Expires int64         `json:"expires,omitempty"`
+}
+
+// accessGrant is the JSON representation of an auth.Grant. Permissions is only set if the grant restricts
+// read or write access to some fine-grained permissions, e.g. ["publish"].
+type accessGrant struct {
+	Topic       string   `json:"topic"`
+	Read        bool     `json:"read"`
+	Write       bool     `json:"write"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+func (s *Server) handleUserTokens(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	tokens, err := manager.Tokens(user.Name)
+	if err != nil {
+		return err
+	}
+	response := make([]*tokenResponse, 0)
+	for _, token := range tokens {
+		response = append(response, newTokenResponse(token))
+	}
+	return writeJSON(w, response)
+}
+
+func (s *Server) handleUserTokenAdd(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	var req tokenRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return errHTTPBadRequestTokenInvalid
+	}
+	read, write, ok := parseTokenPermission(req.Permission)
+	if !ok || len(req.Topics) == 0 || len(req.Topics) > tokenMaxTopics {
+		return errHTTPBadRequestTokenInvalid
+	}
+	grants := make([]auth.Grant, 0)
+	for _, topic := range req.Topics {
+		if !auth.AllowedTopicPattern(topic) {
+			return errHTTPBadRequestTokenInvalid
+		}
+		grants = append(grants, auth.Grant{TopicPattern: topic, AllowRead: read, AllowWrite: write})
+	}
+	var expires time.Time
+	if req.Expires != "" {
+		var err error
+		expires, err = util.ParseFutureTime(req.Expires, time.Now())
+		if err != nil || expires.Before(time.Now()) {
+			return errHTTPBadRequestTokenInvalid
+		}
+	}
+	token, err := manager.AddToken(user.Name, req.Label, grants, expires)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Created access token for user %s", r.RemoteAddr, user.Name)
+	s.audit(r, &auditEvent{Event: auditEventTokenCreated, User: user.Name, Token: auditToken(token.Value), Topic: strings.Join(req.Topics, ","), Permission: req.Permission})
+	return writeJSON(w, newTokenResponse(token))
+}
+
+func (s *Server) handleUserTokenDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	matches := userTokenPathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPNotFound
+	}
+	tokens, err := manager.Tokens(user.Name)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if token.Value == matches[1] {
+			if err := manager.RemoveToken(user.Name, token.Value); err != nil {
+				return err
+			}
+			s.audit(r, &auditEvent{Event: auditEventTokenRevoked, User: user.Name, Token: auditToken(token.Value)})
+			return writeJSON(w, map[string]bool{"success": true})
+		}
+	}
+	return errHTTPNotFoundToken
+}
+
+// authUserPassword only lets users through that authenticated with their password, since access tokens must
+// not be able to create other (less restricted) tokens, or reserve topics. Both are only supported by the
+// SQLite and PostgreSQL auth backends. Users with two-factor authentication must also pass a TOTP code.
+func (s *Server) authUserPassword(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		if _, ok := s.auth.(auth.Manager); !ok {
+			return errHTTPNotFound
+		}
+		user, err := s.authenticate(r)
+		if err != nil {
+			return err
+		} else if user == nil {
+			return errHTTPUnauthorized
+		} else if user.Token != nil {
+			log.Printf("unauthorized: user %s cannot use an access token for %s", user.Name, r.URL.Path)
+			s.auditAccessDenied(r, user, "", 0, "access tokens cannot be used for "+r.URL.Path)
+			return errHTTPForbidden
+		} else if err := s.verifyTOTP(r, user); err != nil {
+			return err
+		}
+		return next(w, withUser(r, user), v)
+	}
+}
+
+// userManager returns the auth manager and the user authenticated by authUserPassword
+func (s *Server) userManager(r *http.Request) (auth.Manager, *auth.User) {
+	return s.auth.(auth.Manager), userFromRequest(r)
+}
+
+func newTokenResponse(token *auth.Token) *tokenResponse {
+	response := &tokenResponse{
+		Token:  token.Value,
+		Label:  token.Label,
+		Access: newAccessGrants(token.Grants),
+	}
+	if !token.Expires.IsZero() {
+		response.Expires = token.Expires.Unix()
+	}
+	return response
+}
+
+func newAccessGrants(grants []auth.Grant) []accessGrant {
+	access := make([]accessGrant, 0)
+	for _, grant := range grants {
+		a := accessGrant{
+			Topic: grant.TopicPattern,
+			Read:  grant.AllowRead,
+			Write: grant.AllowWrite,
+		}
+		if grant.Deny != 0 {
+			a.Permissions = strings.Split(grant.Permissions().String(), ",")
+		}
+		access = append(access, a)
+	}
+	return access
+}
+
+// parseTokenPermission parses the permission of an access token. Unlike access control entries,
+// tokens cannot deny access, since they only ever grant a subset of the user's permissions.
+func parseTokenPermission(perm string) (read bool, write bool, ok bool) {
+	switch strings.ToLower(perm) {
+	case "read-write", "rw":
+		return true, true, true
+	case "read-only", "read", "ro":
+		return true, false, true
+	case "write-only", "write", "wo":
+		return false, true, true
+	}
+	return false, false, false
+}
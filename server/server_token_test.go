@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Tokens_AddUseRemove(t *testing.T) {
+	s := newTestServerWithTokenUser(t)
+
+	response := request(t, s, "POST", "/user/tokens", `{"label":"backup script","topics":["backups"],"permission":"write-only"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	token := toTokenResponse(t, response.Body.String())
+	require.True(t, strings.HasPrefix(token.Token, "tk_"))
+	require.Equal(t, "backup script", token.Label)
+	require.Equal(t, []accessGrant{{Topic: "backups", Read: false, Write: true}}, token.Access)
+	require.Equal(t, int64(0), token.Expires)
+
+	response = request(t, s, "PUT", "/backups", "backup done", map[string]string{
+		"Authorization": "Bearer " + token.Token,
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/backups/json?poll=1", "", map[string]string{
+		"Authorization": "Bearer " + token.Token,
+	})
+	require.Equal(t, 403, response.Code) // Write-only token
+
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": "Bearer " + token.Token,
+	})
+	require.Equal(t, 403, response.Code) // Not in token, but allowed for user
+
+	response = request(t, s, "GET", "/user/tokens", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	var tokens []*tokenResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&tokens))
+	require.Equal(t, 1, len(tokens))
+	require.Equal(t, token.Token, tokens[0].Token)
+
+	response = request(t, s, "DELETE", "/user/tokens/"+token.Token, "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/backups", "backup done", map[string]string{
+		"Authorization": "Bearer " + token.Token,
+	})
+	require.Equal(t, 401, response.Code)
+
+	response = request(t, s, "DELETE", "/user/tokens/"+token.Token, "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40404, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Tokens_Expires(t *testing.T) {
+	s := newTestServerWithTokenUser(t)
+	response := request(t, s, "POST", "/user/tokens", `{"topics":["backups","mytopic"],"permission":"rw","expires":"1h"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	token := toTokenResponse(t, response.Body.String())
+	require.Equal(t, 2, len(token.Access))
+	require.InDelta(t, time.Now().Add(time.Hour).Unix(), token.Expires, 5)
+}
+
+func TestServer_Tokens_CannotManageWithToken(t *testing.T) {
+	s := newTestServerWithTokenUser(t)
+	token, err := s.auth.(auth.Manager).AddToken("ben", "", []auth.Grant{{TopicPattern: "*", AllowRead: true, AllowWrite: true}}, time.Time{})
+	require.Nil(t, err)
+
+	response := request(t, s, "POST", "/user/tokens", `{"topics":["mytopic"],"permission":"rw"}`, map[string]string{
+		"Authorization": "Bearer " + token.Value,
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/user/tokens", "", map[string]string{
+		"Authorization": "Bearer " + token.Value,
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_Tokens_AdminTokenCannotExport(t *testing.T) {
+	s := newTestServerWithTokenUser(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleAdmin))
+	token, err := manager.AddToken("phil", "", []auth.Grant{{TopicPattern: "mytopic", AllowRead: true, AllowWrite: false}}, time.Time{})
+	require.Nil(t, err)
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Authorization": "Bearer " + token.Value,
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": "Bearer " + token.Value,
+	})
+	require.Equal(t, 403, response.Code) // Admin, but read-only token
+	response = request(t, s, "GET", "/mytopic/export", "", map[string]string{
+		"Authorization": "Bearer " + token.Value,
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_Tokens_Invalid(t *testing.T) {
+	s := newTestServerWithTokenUser(t)
+	for _, body := range []string{
+		`not json`,
+		`{"topics":[],"permission":"rw"}`,
+		`{"topics":["mytopic"],"permission":"deny"}`,
+		`{"topics":["my/topic"],"permission":"rw"}`,
+		`{"topics":["mytopic"],"permission":"rw","expires":"1000"}`,
+	} {
+		response := request(t, s, "POST", "/user/tokens", body, map[string]string{
+			"Authorization": basicAuth("ben:ben"),
+		})
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40032, toHTTPError(t, response.Body.String()).Code, body)
+	}
+
+	response := request(t, s, "POST", "/user/tokens", `{"topics":["mytopic"],"permission":"rw"}`, nil)
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "POST", "/user/tokens", `{"topics":["mytopic"],"permission":"rw"}`, map[string]string{
+		"Authorization": basicAuth("ben:wrong"),
+	})
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_Tokens_NoAuth(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/user/tokens", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func newTestServerWithTokenUser(t *testing.T) *Server {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "mytopic", true, true))
+	require.Nil(t, manager.AllowAccess("ben", "backups", true, true))
+	return s
+}
+
+func toTokenResponse(t *testing.T, s string) *tokenResponse {
+	var token tokenResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&token))
+	return &token
+}
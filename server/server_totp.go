@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	userTOTPPath        = "/user/totp"
+	userTOTPConfirmPath = "/user/totp/confirm"
+	totpIssuerDefault   = "ntfy"
+)
+
+// totpEnrollResponse is the response to a TOTP enrollment. The URL is usually shown as a QR code,
+// so it can be scanned with an authenticator app.
+type totpEnrollResponse struct {
+	Secret string `json:"secret"`
+	URL    string `json:"url"`
+}
+
+// totpConfirmRequest is the body of a request to confirm a TOTP enrollment, e.g. {"code":"123456"}
+type totpConfirmRequest struct {
+	Code string `json:"code"`
+}
+
+func (s *Server) handleUserTOTPEnroll(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	secret, err := manager.EnrollTOTP(user.Name)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &totpEnrollResponse{
+		Secret: secret,
+		URL:    s.totpURL(user.Name, secret),
+	})
+}
+
+func (s *Server) handleUserTOTPConfirm(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	var req totpConfirmRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return errHTTPBadRequestTOTPInvalid
+	}
+	if err := manager.EnableTOTP(user.Name, req.Code); err == auth.ErrNotFound {
+		return errHTTPNotFoundTOTPEnrollment
+	} else if err == auth.ErrUnauthenticated {
+		return errHTTPBadRequestTOTPInvalid
+	} else if err != nil {
+		return err
+	}
+	log.Printf("[%s] Enabled two-factor authentication for user %s", r.RemoteAddr, user.Name)
+	s.audit(r, &auditEvent{Event: auditEventTOTPEnabled, User: user.Name})
+	return writeJSON(w, map[string]bool{"success": true})
+}
+
+func (s *Server) handleUserTOTPDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, user := s.userManager(r)
+	if err := manager.DisableTOTP(user.Name); err != nil {
+		return err
+	}
+	log.Printf("[%s] Disabled two-factor authentication for user %s", r.RemoteAddr, user.Name)
+	s.audit(r, &auditEvent{Event: auditEventTOTPDisabled, User: user.Name})
+	return writeJSON(w, map[string]bool{"success": true})
+}
+
+// verifyTOTP checks the TOTP code (X-TOTP header, or ?totp=...) of a request, if the user enabled two-factor
+// authentication. Access tokens are not checked, since they can only be created with a code in the first place.
+func (s *Server) verifyTOTP(r *http.Request, user *auth.User) error {
+	if user == nil || user.TOTP == "" || user.Token != nil {
+		return nil
+	}
+	if !auth.ValidateTOTP(user.TOTP, readParam(r, "x-totp", "totp"), time.Now()) {
+		log.Printf("unauthorized: two-factor authentication code of user %s missing or invalid", user.Name)
+		s.audit(r, &auditEvent{Event: auditEventAuthFailed, User: user.Name, Reason: "two-factor authentication code missing or invalid"})
+		return errHTTPUnauthorizedTOTPRequired
+	}
+	return nil
+}
+
+// totpURL returns the otpauth:// URL of a TOTP secret, see https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+// The issuer is the host name of the base URL, so that users can tell multiple ntfy servers apart in their app.
+func (s *Server) totpURL(username, secret string) string {
+	issuer := totpIssuerDefault
+	if u, err := url.Parse(s.config.BaseURL); err == nil && u.Hostname() != "" {
+		issuer = u.Hostname()
+	}
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(username), query.Encode())
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_TOTP_EnrollConfirmDisable(t *testing.T) {
+	s := newTestServerWithTokenUser(t)
+
+	response := request(t, s, "POST", "/user/totp", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	enroll := toTOTPEnrollResponse(t, response.Body.String())
+	require.Len(t, enroll.Secret, 32)
+	require.Equal(t, "otpauth://totp/127.0.0.1:ben?issuer=127.0.0.1&secret="+enroll.Secret, enroll.URL)
+
+	response = request(t, s, "GET", "/mytopic/auth", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code) // Not enabled until confirmed
+
+	response = request(t, s, "POST", "/user/totp/confirm", `{"code":"000000"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40036, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/user/totp/confirm", `{"code":"`+testTOTPCode(t, enroll.Secret)+`"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Web login and token issuance require a code now; subscribing does not
+	response = request(t, s, "GET", "/mytopic/auth", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 401, response.Code)
+	require.Equal(t, 40102, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/mytopic/auth", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+		"X-TOTP":        testTOTPCode(t, enroll.Secret),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/user/tokens", `{"topics":["backups"],"permission":"write-only"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "POST", "/user/tokens?totp="+testTOTPCode(t, enroll.Secret), `{"topics":["backups"],"permission":"write-only"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	token := toTokenResponse(t, response.Body.String())
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/backups", "backup done", map[string]string{
+		"Authorization": "Bearer " + token.Token,
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "DELETE", "/user/totp", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "DELETE", "/user/totp", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+		"X-TOTP":        testTOTPCode(t, enroll.Secret),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/mytopic/auth", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_TOTP_ConfirmWithoutEnroll(t *testing.T) {
+	s := newTestServerWithTokenUser(t)
+	response := request(t, s, "POST", "/user/totp/confirm", `{"code":"123456"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40407, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_TOTP_AdminEndpoints(t *testing.T) {
+	s := newTestServerWithTokenUser(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleAdmin))
+	secret, err := manager.EnrollTOTP("phil")
+	require.Nil(t, err)
+	require.Nil(t, manager.EnableTOTP("phil", testTOTPCode(t, secret)))
+
+	response := request(t, s, "GET", "/admin/users", "", map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+	})
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "GET", "/admin/users", "", map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+		"X-TOTP":        testTOTPCode(t, secret),
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func testTOTPCode(t *testing.T, secret string) string {
+	code, err := auth.TOTPCode(secret, time.Now())
+	require.Nil(t, err)
+	return code
+}
+
+func toTOTPEnrollResponse(t *testing.T, s string) *totpEnrollResponse {
+	var response totpEnrollResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&response))
+	return &response
+}
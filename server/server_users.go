@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/ntfy/auth"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+const (
+	adminUsersPath = "/admin/users"
+	userEveryone   = "everyone" // Alias for auth.Everyone in paths, as in 'ntfy access'
+)
+
+var (
+	adminUserPathRegex       = regexp.MustCompile(`^/admin/users/([-_.@a-zA-Z0-9]+|\*)$`)
+	adminUserAccessPathRegex = regexp.MustCompile(`^/admin/users/([-_.@a-zA-Z0-9]+|\*)/access$`)
+)
+
+// userRequest is the body of a request to add or change a user, e.g. {"username":"phil","password":"mypass","role":"admin"}.
+// When changing a user, the username is taken from the path, and password and role are optional.
+type userRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// accessRequest is the body of a request to change the access of a user, e.g. {"topic":"alerts*","permission":"read-only"}.
+// The permission may also be a list of fine-grained permissions, e.g. "publish,attach" (see auth.ParsePermissions).
+type accessRequest struct {
+	Topic      string `json:"topic"`
+	Permission string `json:"permission"`
+}
+
+type userResponse struct {
+	Username string        `json:"username"`
+	Role     auth.Role     `json:"role"`
+	Access   []accessGrant `json:"access"`
+}
+
+func (s *Server) handleAdminUsers(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	manager, err := s.authManager()
+	if err != nil {
+		return err
+	}
+	users, err := manager.Users()
+	if err != nil {
+		return err
+	}
+	response := make([]*userResponse, 0)
+	for _, user := range users {
+		response = append(response, newUserResponse(user))
+	}
+	return writeJSON(w, response)
+}
+
+func (s *Server) handleAdminUserAdd(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, err := s.authManager()
+	if err != nil {
+		return err
+	}
+	var req userRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return errHTTPBadRequestUserInvalid
+	}
+	role := auth.RoleUser
+	if req.Role != "" {
+		role = auth.Role(req.Role)
+	}
+	if !auth.AllowedUsername(req.Username) || req.Username == userEveryone || req.Password == "" || !auth.AllowedRole(role) {
+		return errHTTPBadRequestUserInvalid
+	}
+	if user, _ := manager.User(req.Username); user != nil {
+		return errHTTPConflictUserExists
+	}
+	if err := manager.AddUser(req.Username, req.Password, role); err != nil {
+		return err
+	}
+	log.Printf("[%s] Admin %s added user %s with role %s", r.RemoteAddr, userFromRequest(r).Name, req.Username, role)
+	s.audit(r, &auditEvent{Event: auditEventUserAdded, User: userFromRequest(r).Name, Target: req.Username, Reason: "role " + string(role)})
+	return s.writeUser(w, manager, req.Username)
+}
+
+func (s *Server) handleAdminUserChange(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, username, err := s.adminUserFromPath(r, adminUserPathRegex)
+	if err != nil {
+		return err
+	} else if username == auth.Everyone {
+		return errHTTPBadRequestUserInvalid
+	}
+	var req userRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return errHTTPBadRequestUserInvalid
+	} else if (req.Password == "" && req.Role == "") || (req.Role != "" && !auth.AllowedRole(auth.Role(req.Role))) {
+		return errHTTPBadRequestUserInvalid
+	}
+	if req.Password != "" {
+		if err := manager.ChangePassword(username, req.Password); err != nil {
+			return err
+		}
+		log.Printf("[%s] Admin %s changed password of user %s", r.RemoteAddr, userFromRequest(r).Name, username)
+		s.audit(r, &auditEvent{Event: auditEventUserChanged, User: userFromRequest(r).Name, Target: username, Reason: "password changed"})
+	}
+	if req.Role != "" {
+		if err := manager.ChangeRole(username, auth.Role(req.Role)); err != nil {
+			return err
+		}
+		log.Printf("[%s] Admin %s changed role of user %s to %s", r.RemoteAddr, userFromRequest(r).Name, username, req.Role)
+		s.audit(r, &auditEvent{Event: auditEventUserChanged, User: userFromRequest(r).Name, Target: username, Reason: "role changed to " + req.Role})
+	}
+	return s.writeUser(w, manager, username)
+}
+
+func (s *Server) handleAdminUserDelete(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, username, err := s.adminUserFromPath(r, adminUserPathRegex)
+	if err != nil {
+		return err
+	} else if username == auth.Everyone {
+		return errHTTPBadRequestUserInvalid
+	}
+	if err := manager.RemoveUser(username); err != nil {
+		return err
+	}
+	log.Printf("[%s] Admin %s removed user %s", r.RemoteAddr, userFromRequest(r).Name, username)
+	s.audit(r, &auditEvent{Event: auditEventUserRemoved, User: userFromRequest(r).Name, Target: username})
+	return writeJSON(w, map[string]bool{"success": true})
+}
+
+func (s *Server) handleAdminAccessAllow(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, username, err := s.adminUserFromPath(r, adminUserAccessPathRegex)
+	if err != nil {
+		return err
+	}
+	var req accessRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return errHTTPBadRequestAccessInvalid
+	}
+	perms, err := auth.ParsePermissions(req.Permission)
+	if err != nil || !auth.AllowedTopicPattern(req.Topic) {
+		return errHTTPBadRequestAccessInvalid
+	}
+	user, err := manager.User(username)
+	if err != nil {
+		return err
+	} else if user.Role == auth.RoleAdmin {
+		return wrapErrHTTP(errHTTPBadRequestAccessInvalid, "user %s is an admin user, access control entries have no effect", username)
+	}
+	if err := manager.AllowPermissions(username, req.Topic, perms); err != nil {
+		return err
+	}
+	log.Printf("[%s] Admin %s changed access of user %s to topic %s", r.RemoteAddr, userFromRequest(r).Name, username, req.Topic)
+	s.audit(r, &auditEvent{Event: auditEventAccessChanged, User: userFromRequest(r).Name, Target: username, Topic: req.Topic, Permission: req.Permission})
+	return s.writeUser(w, manager, username)
+}
+
+// handleAdminAccessReset removes the access control entries of a user, or (if the topic query
+// parameter is set) only the entry for a specific topic
+func (s *Server) handleAdminAccessReset(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	manager, username, err := s.adminUserFromPath(r, adminUserAccessPathRegex)
+	if err != nil {
+		return err
+	}
+	topic := readQueryParam(r, "topic")
+	if topic != "" && !auth.AllowedTopicPattern(topic) {
+		return errHTTPBadRequestAccessInvalid
+	}
+	if err := manager.ResetAccess(username, topic); err != nil {
+		return err
+	}
+	log.Printf("[%s] Admin %s reset access of user %s", r.RemoteAddr, userFromRequest(r).Name, username)
+	s.audit(r, &auditEvent{Event: auditEventAccessReset, User: userFromRequest(r).Name, Target: username, Topic: topic})
+	return s.writeUser(w, manager, username)
+}
+
+// authManager returns the auth backend as auth.Manager, or errHTTPNotFound if users are not managed by ntfy,
+// e.g. with the LDAP backend
+func (s *Server) authManager() (auth.Manager, error) {
+	manager, ok := s.auth.(auth.Manager)
+	if !ok {
+		return nil, errHTTPNotFound
+	}
+	return manager, nil
+}
+
+// adminUserFromPath returns the username from the request path (mapping "everyone" to auth.Everyone),
+// or errHTTPNotFoundUser if the user does not exist
+func (s *Server) adminUserFromPath(r *http.Request, pathRegex *regexp.Regexp) (auth.Manager, string, error) {
+	manager, err := s.authManager()
+	if err != nil {
+		return nil, "", err
+	}
+	matches := pathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return nil, "", errHTTPNotFound
+	}
+	username := matches[1]
+	if username == userEveryone {
+		username = auth.Everyone
+	}
+	if _, err := manager.User(username); err == auth.ErrNotFound {
+		return nil, "", errHTTPNotFoundUser
+	} else if err != nil {
+		return nil, "", err
+	}
+	return manager, username, nil
+}
+
+func (s *Server) writeUser(w http.ResponseWriter, manager auth.Manager, username string) error {
+	user, err := manager.User(username)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, newUserResponse(user))
+}
+
+func newUserResponse(user *auth.User) *userResponse {
+	return &userResponse{
+		Username: user.Name,
+		Role:     user.Role,
+		Access:   newAccessGrants(user.Grants),
+	}
+}
+
+// parseAccessPermission parses a read/write permission, like parseTokenPermission, but also allows denying access.
+// Unlike the admin API, fine-grained permissions are not supported.
+func parseAccessPermission(perm string) (read bool, write bool, ok bool) {
+	if perm == "deny" || perm == "none" {
+		return false, false, true
+	}
+	return parseTokenPermission(perm)
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServer_AdminUsers_AddChangeDelete(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	admin := map[string]string{"Authorization": basicAuth("phil:phil")}
+
+	response := request(t, s, "POST", "/admin/users", `{"username":"ben","password":"ben"}`, admin)
+	require.Equal(t, 200, response.Code)
+	user := toUserResponse(t, response.Body.String())
+	require.Equal(t, "ben", user.Username)
+	require.Equal(t, auth.RoleUser, user.Role)
+	require.Equal(t, []accessGrant{}, user.Access)
+
+	response = request(t, s, "POST", "/admin/users", `{"username":"ben","password":"other"}`, admin)
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40901, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/admin/users/ben/access", `{"topic":"mytopic","permission":"rw"}`, admin)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, []accessGrant{{Topic: "mytopic", Read: true, Write: true}}, toUserResponse(t, response.Body.String()).Access)
+
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/admin/users/ben", `{"password":"newpass"}`, admin)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Authorization": basicAuth("ben:newpass")})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/admin/users", "", admin)
+	require.Equal(t, 200, response.Code)
+	var users []*userResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&users))
+	require.Equal(t, 3, len(users))
+	require.Equal(t, "phil", users[0].Username)
+	require.Equal(t, "ben", users[1].Username)
+	require.Equal(t, "*", users[2].Username)
+
+	response = request(t, s, "PUT", "/admin/users/ben", `{"role":"admin"}`, admin)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, auth.RoleAdmin, toUserResponse(t, response.Body.String()).Role)
+
+	response = request(t, s, "DELETE", "/admin/users/ben", "", admin)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/admin/users/ben", "", admin)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40405, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_AdminUsers_Access(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	admin := map[string]string{"Authorization": basicAuth("phil:phil")}
+
+	response := request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "PUT", "/admin/users/everyone/access", `{"topic":"mytopic","permission":"write-only"}`, admin)
+	require.Equal(t, 200, response.Code)
+	user := toUserResponse(t, response.Body.String())
+	require.Equal(t, "*", user.Username)
+	require.Equal(t, []accessGrant{{Topic: "mytopic", Read: false, Write: true}}, user.Access)
+
+	response = request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/admin/users/*/access", `{"topic":"up*","permission":"deny"}`, admin)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 2, len(toUserResponse(t, response.Body.String()).Access))
+
+	response = request(t, s, "DELETE", "/admin/users/everyone/access?topic=mytopic", "", admin)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, []accessGrant{{Topic: "up*", Read: false, Write: false}}, toUserResponse(t, response.Body.String()).Access)
+
+	response = request(t, s, "DELETE", "/admin/users/everyone/access", "", admin)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, []accessGrant{}, toUserResponse(t, response.Body.String()).Access)
+
+	response = request(t, s, "PUT", "/admin/users/everyone/access", `{"topic":"readings","permission":"subscribe,publish"}`, admin)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, []accessGrant{{Topic: "readings", Read: true, Write: true, Permissions: []string{"subscribe", "publish"}}}, toUserResponse(t, response.Body.String()).Access)
+	response = request(t, s, "GET", "/readings/json?poll=1", "", nil)
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "PUT", "/admin/users/everyone/access", `{"topic":"readings","permission":"publish,maybe"}`, admin)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40034, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/admin/users/phil/access", `{"topic":"mytopic","permission":"rw"}`, admin)
+	require.Equal(t, 400, response.Code)
+	require.Contains(t, toHTTPError(t, response.Body.String()).Message, "user phil is an admin user")
+
+	response = request(t, s, "PUT", "/admin/users/everyone/access", `{"topic":"my/topic","permission":"rw"}`, admin)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40034, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_AdminUsers_AdminOnly(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+
+	response := request(t, s, "GET", "/admin/users", "", nil)
+	require.Equal(t, 401, response.Code)
+	response = request(t, s, "POST", "/admin/users", `{"username":"eve","password":"eve"}`, map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 403, response.Code)
+	_, err := manager.User("eve")
+	require.Equal(t, auth.ErrNotFound, err)
+}
+
+func TestServer_AdminUsers_Invalid(t *testing.T) {
+	s := newTestServerWithAdmin(t)
+	admin := map[string]string{"Authorization": basicAuth("phil:phil")}
+	for _, body := range []string{
+		`not json`,
+		`{"username":"ben"}`,
+		`{"username":"ben/1","password":"ben"}`,
+		`{"username":"everyone","password":"ben"}`,
+		`{"username":"ben","password":"ben","role":"superuser"}`,
+	} {
+		response := request(t, s, "POST", "/admin/users", body, admin)
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40033, toHTTPError(t, response.Body.String()).Code, body)
+	}
+	response := request(t, s, "PUT", "/admin/users/phil", `{}`, admin)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "PUT", "/admin/users/nobody", `{"password":"x"}`, admin)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "DELETE", "/admin/users/everyone", "", admin)
+	require.Equal(t, 400, response.Code)
+}
+
+func TestServer_AdminUsers_NoAuth(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/admin/users", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func newTestServerWithAdmin(t *testing.T) *Server {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	require.Nil(t, s.auth.(auth.Manager).AddUser("phil", "phil", auth.RoleAdmin))
+	return s
+}
+
+func toUserResponse(t *testing.T, s string) *userResponse {
+	var user userResponse
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&user))
+	return &user
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	userPhonePath                = "/user/phone"
+	userPhoneVerifyPath          = "/user/phone/verify"
+	phoneNumbersMax              = 3                // Verified phone numbers per user
+	phoneVerificationTimeout     = 10 * time.Minute // Time the user has to enter the code from the verification SMS
+	phoneVerificationMaxAttempts = 3                // Wrong codes before the verification has to be started again
+	smsPriority                  = 5                // Only max priority messages can be sent as SMS, or trigger phone calls
+	phoneChannelSMS              = "sms"
+	phoneChannelCall             = "call"
+)
+
+var (
+	phoneNumberRegex = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`) // E.164
+)
+
+// phoneVerification is a verification that was started in handleUserPhoneNumberVerify, and that is completed once
+// the user sends the code from the SMS, see handleUserPhoneNumberAdd. Only one is pending per user.
+type phoneVerification struct {
+	number   string
+	code     string
+	expires  time.Time
+	attempts int
+}
+
+// handleUserPhoneNumbers returns the verified phone numbers of the user, e.g. {"phone_numbers":["+12025550123"]}
+func (s *Server) handleUserPhoneNumbers(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	phoneNumbers, err := s.messageCache.PhoneNumbers(userFromRequest(r).Name)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &phoneNumbersResponse{PhoneNumbers: phoneNumbers})
+}
+
+// handleUserPhoneNumberVerify sends a verification code to a phone number, e.g. {"number":"+12025550123"}. If phone
+// calls are enabled, the code can also be read out in a call instead, e.g. for landlines ({"channel":"call"}). The SMS
+// or call counts towards the limits of the user, so that the endpoint cannot be used to spam arbitrary numbers.
+func (s *Server) handleUserPhoneNumberVerify(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	user := userFromRequest(r)
+	req, err := readPhoneNumberRequest(r)
+	if err != nil {
+		return err
+	} else if req.Channel != "" && req.Channel != phoneChannelSMS && (req.Channel != phoneChannelCall || s.caller == nil) {
+		return wrapErrHTTP(errHTTPBadRequestPhoneNumberInvalid, "channel must be 'sms', or 'call' if phone calls are enabled")
+	}
+	phoneNumbers, err := s.messageCache.PhoneNumbers(user.Name)
+	if err != nil {
+		return err
+	} else if !util.InStringList(phoneNumbers, req.Number) && len(phoneNumbers) >= phoneNumbersMax {
+		return wrapErrHTTP(errHTTPBadRequestPhoneNumberInvalid, "at most %d phone numbers are allowed", phoneNumbersMax)
+	}
+	code, err := newPhoneVerificationCode()
+	if err != nil {
+		return err
+	}
+	if req.Channel == phoneChannelCall {
+		if err := s.callAllowed(r, v); err != nil {
+			return err
+		}
+		digits := strings.Join(strings.Split(code, ""), ", ") // Read out one by one, not as a number
+		if err := s.caller.Call(req.Number, fmt.Sprintf("Your ntfy verification code is %s. Again, your code is %s.", digits, digits)); err != nil {
+			log.Printf("[%s] CALL - Unable to call %s with verification code: %v", v.ip, req.Number, err.Error())
+			return wrapErrHTTP(errHTTPBadRequestPhoneNumberInvalid, "unable to place call")
+		}
+	} else {
+		if err := s.smsAllowed(r, v); err != nil {
+			return err
+		}
+		if err := s.sms.Send(req.Number, fmt.Sprintf("Your ntfy verification code is %s", code)); err != nil {
+			log.Printf("[%s] SMS - Unable to send verification code to %s: %v", v.ip, req.Number, err.Error())
+			return wrapErrHTTP(errHTTPBadRequestPhoneNumberInvalid, "unable to send SMS")
+		}
+	}
+	s.mu.Lock()
+	s.phoneCodes[user.Name] = &phoneVerification{
+		number:  req.Number,
+		code:    code,
+		expires: time.Now().Add(phoneVerificationTimeout),
+	}
+	s.mu.Unlock()
+	log.Printf("[%s] User %s started verification of phone number %s", v.ip, user.Name, req.Number)
+	return writeJSON(w, map[string]bool{"success": true})
+}
+
+// handleUserPhoneNumberAdd adds a phone number once it is verified, e.g. {"number":"+12025550123","code":"123456"}
+func (s *Server) handleUserPhoneNumberAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	user := userFromRequest(r)
+	req, err := readPhoneNumberRequest(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	pending, ok := s.phoneCodes[user.Name]
+	valid := ok && pending.number == req.Number && time.Now().Before(pending.expires) && subtle.ConstantTimeCompare([]byte(pending.code), []byte(req.Code)) == 1
+	if valid {
+		delete(s.phoneCodes, user.Name)
+	} else if ok {
+		pending.attempts++
+		if pending.attempts >= phoneVerificationMaxAttempts {
+			delete(s.phoneCodes, user.Name)
+		}
+	}
+	s.mu.Unlock()
+	if !valid {
+		return errHTTPBadRequestPhoneVerificationInvalid
+	}
+	if err := s.messageCache.AddPhoneNumber(user.Name, req.Number); err != nil {
+		return err
+	}
+	phoneNumbers, err := s.messageCache.PhoneNumbers(user.Name)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] User %s added phone number %s", v.ip, user.Name, req.Number)
+	return writeJSON(w, &phoneNumbersResponse{PhoneNumbers: phoneNumbers})
+}
+
+// handleUserPhoneNumberRemove removes a phone number of the user
+func (s *Server) handleUserPhoneNumberRemove(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	user := userFromRequest(r)
+	req, err := readPhoneNumberRequest(r)
+	if err != nil {
+		return err
+	}
+	if err := s.messageCache.DeletePhoneNumber(user.Name, req.Number); err != nil {
+		return err
+	}
+	phoneNumbers, err := s.messageCache.PhoneNumbers(user.Name)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] User %s removed phone number %s", v.ip, user.Name, req.Number)
+	return writeJSON(w, &phoneNumbersResponse{PhoneNumbers: phoneNumbers})
+}
+
+func readPhoneNumberRequest(r *http.Request) (*phoneNumberRequest, error) {
+	var req phoneNumberRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return nil, errHTTPBadRequestJSONInvalid
+	} else if !phoneNumberRegex.MatchString(req.Number) {
+		return nil, errHTTPBadRequestPhoneNumberInvalid
+	}
+	return &req, nil
+}
+
+// newPhoneVerificationCode returns a random 6-digit code
+func newPhoneVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// parsePublishSMS reads the phone number that a message is to be sent to as SMS (X-SMS), if any. Only max priority
+// messages that are not delayed can be sent, and only to the verified phone numbers of the publishing user.
+func (s *Server) parsePublishSMS(r *http.Request, v *visitor, m *message) (string, error) {
+	number := readParam(r, "x-sms", "sms")
+	if number == "" {
+		return "", nil
+	} else if s.sms == nil || s.auth == nil {
+		return "", errHTTPBadRequestSMSDisabled
+	} else if err := s.checkPublishPhoneNumber(r, m, number, errHTTPBadRequestSMSInvalid, "sent as SMS"); err != nil {
+		return "", err
+	} else if err := s.smsAllowed(r, v); err != nil {
+		return "", err
+	}
+	return number, nil
+}
+
+// checkPublishPhoneNumber checks that a message can be sent to a phone number, see parsePublishSMS and
+// parsePublishCall. What is, e.g. "sent as SMS", is only used in the error messages.
+func (s *Server) checkPublishPhoneNumber(r *http.Request, m *message, number string, errInvalid *errHTTP, what string) error {
+	if !phoneNumberRegex.MatchString(number) {
+		return errHTTPBadRequestPhoneNumberInvalid
+	} else if m.Priority != smsPriority {
+		return wrapErrHTTP(errInvalid, "only messages with priority %d can be %s", smsPriority, what)
+	} else if m.Time > time.Now().Unix() {
+		return wrapErrHTTP(errInvalid, "delayed messages cannot be %s", what)
+	}
+	return s.checkVerifiedPhoneNumber(userFromRequest(r), number, errInvalid)
+}
+
+// checkVerifiedPhoneNumber checks that the phone number is one of the verified phone numbers of the user
+func (s *Server) checkVerifiedPhoneNumber(user *auth.User, number string, errInvalid *errHTTP) error {
+	if user == nil {
+		return wrapErrHTTP(errInvalid, "only users can send messages to their verified phone numbers")
+	}
+	phoneNumbers, err := s.messageCache.PhoneNumbers(user.Name)
+	if err != nil {
+		return err
+	} else if !util.InStringList(phoneNumbers, number) {
+		return wrapErrHTTP(errInvalid, "phone number %s is not verified", number)
+	}
+	return nil
+}
+
+// sendSMS sends a message as SMS. Failed SMS are not retried. This is meant to be called in a goroutine.
+func (s *Server) sendSMS(senderIP, to string, m *message) {
+	if err := s.sms.Send(to, toSMSText(m)); err != nil {
+		log.Printf("[%s] SMS - Unable to send message %s to %s: %v", senderIP, m.ID, to, err.Error())
+	}
+}
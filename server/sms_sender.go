@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	twilioAPIURL           = "https://api.twilio.com"
+	vonageAPIURL           = "https://rest.nexmo.com"
+	smsProviderTimeout     = 30 * time.Second
+	smsProviderMaxBodySize = 4096
+	smsTextMaxLength       = 320 // In characters; longer texts are sent as multiple SMS (and billed as such)
+)
+
+// smsSender sends text messages to phone numbers in E.164 format, via the API of an SMS provider (sms-provider)
+type smsSender interface {
+	Send(to, text string) error
+}
+
+// phoneCaller places phone calls to phone numbers in E.164 format, which read out a text (enable-calls)
+type phoneCaller interface {
+	Call(to, text string) error
+}
+
+// newSMSSender returns the sender of the configured SMS provider, or nil if SMS notifications are disabled
+func newSMSSender(conf *Config) smsSender {
+	switch conf.SMSProvider {
+	case SMSProviderTwilio:
+		return newTwilioClient(conf)
+	case SMSProviderVonage:
+		return &vonageSMSSender{
+			baseURL: vonageAPIURL,
+			key:     conf.SMSUser,
+			secret:  conf.SMSPass,
+			from:    conf.SMSFrom,
+			client:  &http.Client{Timeout: smsProviderTimeout},
+		}
+	}
+	return nil
+}
+
+// newPhoneCaller returns the Twilio client if phone calls are enabled, or nil otherwise. Only Twilio can place calls.
+func newPhoneCaller(conf *Config) phoneCaller {
+	if !conf.EnableCalls || conf.SMSProvider != SMSProviderTwilio {
+		return nil
+	}
+	return newTwilioClient(conf)
+}
+
+func newTwilioClient(conf *Config) *twilioClient {
+	return &twilioClient{
+		baseURL: twilioAPIURL,
+		sid:     conf.SMSUser,
+		token:   conf.SMSPass,
+		from:    conf.SMSFrom,
+		client:  &http.Client{Timeout: smsProviderTimeout},
+	}
+}
+
+// twilioClient sends SMS via the Twilio Messages API, and places phone calls via the Calls API, authenticating with
+// the account SID and auth token, see https://www.twilio.com/docs/messaging/api/message-resource#create-a-message-resource
+// and https://www.twilio.com/docs/voice/api/call-resource#create-a-call-resource
+type twilioClient struct {
+	baseURL string
+	sid     string
+	token   string
+	from    string
+	client  *http.Client
+}
+
+type twilioErrorResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (c *twilioClient) Send(to, text string) error {
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", c.from)
+	form.Set("Body", text)
+	return c.do("Messages", form)
+}
+
+// Call places a phone call that reads out the text twice, using Twilio's text-to-speech
+func (c *twilioClient) Call(to, text string) error {
+	var twiml bytes.Buffer
+	twiml.WriteString(`<Response><Say loop="2">`)
+	if err := xml.EscapeText(&twiml, []byte(text)); err != nil {
+		return err
+	}
+	twiml.WriteString(`</Say></Response>`)
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", c.from)
+	form.Set("Twiml", twiml.String())
+	return c.do("Calls", form)
+}
+
+func (c *twilioClient) do(resource string, form url.Values) error {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/2010-04-01/Accounts/%s/%s.json", c.baseURL, c.sid, resource), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.sid, c.token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	var response twilioErrorResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, smsProviderMaxBodySize)).Decode(&response); err != nil || response.Message == "" {
+		return fmt.Errorf("twilio: unexpected response status %d", resp.StatusCode)
+	}
+	return fmt.Errorf("twilio: error %d: %s", response.Code, response.Message)
+}
+
+// vonageSMSSender sends SMS via the Vonage SMS API, authenticating with the API key and secret. The API returns
+// 200 even for rejected messages, so the status of the message must be checked, see
+// https://developer.vonage.com/en/api/sms#send-an-sms
+type vonageSMSSender struct {
+	baseURL string
+	key     string
+	secret  string
+	from    string
+	client  *http.Client
+}
+
+type vonageResponse struct {
+	Messages []struct {
+		Status    string `json:"status"`
+		ErrorText string `json:"error-text"`
+	} `json:"messages"`
+}
+
+func (s *vonageSMSSender) Send(to, text string) error {
+	form := url.Values{}
+	form.Set("api_key", s.key)
+	form.Set("api_secret", s.secret)
+	form.Set("from", s.from)
+	form.Set("to", strings.TrimPrefix(to, "+")) // Vonage expects the number without the leading plus
+	form.Set("text", text)
+	form.Set("type", "unicode")
+	resp, err := s.client.PostForm(s.baseURL+"/sms/json", form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var response vonageResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, smsProviderMaxBodySize)).Decode(&response); err != nil || len(response.Messages) == 0 {
+		return fmt.Errorf("vonage: unexpected response status %d", resp.StatusCode)
+	}
+	for _, m := range response.Messages {
+		if m.Status != "0" {
+			return fmt.Errorf("vonage: status %s: %s", m.Status, m.ErrorText)
+		}
+	}
+	return nil
+}
+
+// toSMSText formats a message as plain text: the title and the topic, followed by the message. Binary messages are
+// left out, and the text is cut off after smsTextMaxLength characters.
+func toSMSText(m *message) string {
+	lines := make([]string, 0)
+	if m.Title != "" {
+		lines = append(lines, fmt.Sprintf("[%s] %s", m.Topic, m.Title))
+	} else {
+		lines = append(lines, fmt.Sprintf("[%s]", m.Topic))
+	}
+	if m.Encoding == "" && m.Message != "" {
+		lines = append(lines, m.Message)
+	}
+	return truncateRunes(strings.Join(lines, "\n"), smsTextMaxLength)
+}
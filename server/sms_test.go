@@ -0,0 +1,250 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPhoneNumber = "+12025550123"
+
+type testSMS struct {
+	to   string
+	text string
+}
+
+// testSMSSender passes all SMS to its channel, instead of sending them via an SMS provider
+type testSMSSender struct {
+	sent chan *testSMS
+}
+
+func (s *testSMSSender) Send(to, text string) error {
+	s.sent <- &testSMS{to: to, text: text}
+	return nil
+}
+
+func (s *testSMSSender) read(t *testing.T) *testSMS {
+	select {
+	case sms := <-s.sent:
+		return sms
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for SMS")
+		return nil
+	}
+}
+
+func TestServer_SMS_VerifyAndPublish(t *testing.T) {
+	s, sender := newTestSMSServer(t, newTestConfig(t))
+	verifyTestPhoneNumber(t, s, sender, "phil:phil", testPhoneNumber)
+
+	response := request(t, s, "GET", "/user/phone", "", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"phone_numbers":["+12025550123"]}`+"\n", response.Body.String())
+
+	response = request(t, s, "PUT", "/alerts", "Disk full", map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+		"Title":         "Server down",
+		"Priority":      "5",
+		"X-SMS":         testPhoneNumber,
+	})
+	require.Equal(t, 200, response.Code)
+	sms := sender.read(t)
+	require.Equal(t, testPhoneNumber, sms.to)
+	require.Equal(t, "[alerts] Server down\nDisk full", sms.text)
+
+	response = request(t, s, "DELETE", "/user/phone", `{"number":"+12025550123"}`, map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"phone_numbers":[]}`+"\n", response.Body.String())
+	response = request(t, s, "PUT", "/alerts", "Disk full", map[string]string{
+		"Authorization": basicAuth("phil:phil"),
+		"Priority":      "5",
+		"X-SMS":         testPhoneNumber,
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_SMS_Invalid(t *testing.T) {
+	s, sender := newTestSMSServer(t, newTestConfig(t))
+	verifyTestPhoneNumber(t, s, sender, "phil:phil", testPhoneNumber)
+
+	response := request(t, s, "PUT", "/alerts", "Not urgent", map[string]string{"Authorization": basicAuth("phil:phil"), "Priority": "4", "X-SMS": testPhoneNumber})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/alerts?sms=%2B12025550123&priority=5&delay=1h", "Later", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/alerts", "Not a number", map[string]string{"Authorization": basicAuth("phil:phil"), "Priority": "5", "X-SMS": "12025550123"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40060, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/alerts", "Anonymous", map[string]string{"Priority": "5", "X-SMS": testPhoneNumber})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/alerts", "Number of another user", map[string]string{"Authorization": basicAuth("ben:ben"), "Priority": "5", "X-SMS": testPhoneNumber})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40059, toHTTPError(t, response.Body.String()).Code)
+
+	s = newTestServer(t, newTestConfig(t)) // SMS disabled
+	response = request(t, s, "PUT", "/alerts", "Urgent", map[string]string{"Priority": "5", "X-SMS": testPhoneNumber})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40058, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/user/phone", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_SMS_VerificationInvalid(t *testing.T) {
+	s, sender := newTestSMSServer(t, newTestConfig(t))
+	headers := map[string]string{"Authorization": basicAuth("phil:phil")}
+	response := request(t, s, "POST", "/user/phone/verify", `{"number":"not a number"}`, headers)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40060, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/user/phone/verify", `{"number":"+12025550123"}`, headers)
+	require.Equal(t, 200, response.Code)
+	code := readTestPhoneVerificationCode(t, sender)
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	response = request(t, s, "PUT", "/user/phone", `{"number":"+12025550124","code":"`+code+`"}`, headers) // Other number
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40061, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/user/phone", `{"number":"+12025550123","code":"`+code+`"}`, map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 400, response.Code)
+	for i := 0; i < phoneVerificationMaxAttempts-1; i++ {
+		response = request(t, s, "PUT", "/user/phone", `{"number":"+12025550123","code":"`+wrong+`"}`, headers)
+		require.Equal(t, 400, response.Code)
+	}
+	response = request(t, s, "PUT", "/user/phone", `{"number":"+12025550123","code":"`+code+`"}`, headers) // Too many attempts
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40061, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/user/phone", "", nil)
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_SMS_Limits(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorSMSDailyLimit = 2
+	s, sender := newTestSMSServer(t, c)
+	verifyTestPhoneNumber(t, s, sender, "phil:phil", testPhoneNumber) // Counts towards the limit
+	headers := map[string]string{"Authorization": basicAuth("phil:phil"), "Priority": "5", "X-SMS": testPhoneNumber}
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "First", headers).Code)
+	sender.read(t)
+	response := request(t, s, "PUT", "/alerts", "Second", headers)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42910, toHTTPError(t, response.Body.String()).Code)
+
+	// Users in a tier with an SMS limit are not limited by the visitor limit
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddTier(&auth.Tier{Code: "pro", SMSLimit: 3}))
+	require.Nil(t, manager.ChangeTier("phil", "pro"))
+	for i := 0; i < 3; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/alerts", "Urgent", headers).Code)
+		sender.read(t)
+	}
+	response = request(t, s, "PUT", "/alerts", "Too many", headers)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42910, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_SMS_AccountDelete(t *testing.T) {
+	s, sender := newTestSMSServer(t, newTestConfig(t))
+	verifyTestPhoneNumber(t, s, sender, "phil:phil", testPhoneNumber)
+	response := request(t, s, "DELETE", "/v1/account", "", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	phoneNumbers, err := s.messageCache.PhoneNumbers("phil")
+	require.Nil(t, err)
+	require.Empty(t, phoneNumbers)
+}
+
+func TestTwilioSMSSender_Send(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/2010-04-01/Accounts/AC123/Messages.json", r.URL.Path)
+		user, pass, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "AC123", user)
+		require.Equal(t, "secret", pass)
+		require.Nil(t, r.ParseForm())
+		if r.PostForm.Get("To") == "+15005550001" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"code":21211,"message":"The 'To' number +15005550001 is not a valid phone number.","status":400}`)
+			return
+		}
+		require.Equal(t, testPhoneNumber, r.PostForm.Get("To"))
+		require.Equal(t, "+15005550006", r.PostForm.Get("From"))
+		require.Equal(t, "Hello", r.PostForm.Get("Body"))
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"sid":"SM123","status":"queued"}`)
+	}))
+	defer server.Close()
+	sender := newSMSSender(&Config{SMSProvider: SMSProviderTwilio, SMSUser: "AC123", SMSPass: "secret", SMSFrom: "+15005550006"}).(*twilioClient)
+	sender.baseURL = server.URL
+	require.Nil(t, sender.Send(testPhoneNumber, "Hello"))
+	require.Equal(t, "twilio: error 21211: The 'To' number +15005550001 is not a valid phone number.", sender.Send("+15005550001", "Hello").Error())
+}
+
+func TestVonageSMSSender_Send(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/sms/json", r.URL.Path)
+		require.Nil(t, r.ParseForm())
+		require.Equal(t, "key", r.PostForm.Get("api_key"))
+		require.Equal(t, "secret", r.PostForm.Get("api_secret"))
+		require.Equal(t, "ntfy", r.PostForm.Get("from"))
+		require.Equal(t, "Hello", r.PostForm.Get("text"))
+		if r.PostForm.Get("to") == "15005550001" {
+			io.WriteString(w, `{"message-count":"1","messages":[{"status":"6","error-text":"Unroutable message - rejected"}]}`)
+			return
+		}
+		require.Equal(t, "12025550123", r.PostForm.Get("to"))
+		io.WriteString(w, `{"message-count":"1","messages":[{"to":"12025550123","message-id":"abc","status":"0"}]}`)
+	}))
+	defer server.Close()
+	sender := newSMSSender(&Config{SMSProvider: SMSProviderVonage, SMSUser: "key", SMSPass: "secret", SMSFrom: "ntfy"}).(*vonageSMSSender)
+	sender.baseURL = server.URL
+	require.Nil(t, sender.Send(testPhoneNumber, "Hello"))
+	require.Equal(t, "vonage: status 6: Unroutable message - rejected", sender.Send("+15005550001", "Hello").Error())
+}
+
+func TestToSMSText_Truncated(t *testing.T) {
+	m := newDefaultMessage("alerts", strings.Repeat("x", 1000))
+	text := toSMSText(m)
+	require.True(t, strings.HasPrefix(text, "[alerts]\nxxx"))
+	require.Equal(t, smsTextMaxLength, len([]rune(text)))
+}
+
+// newTestSMSServer creates a server with access control and the users phil and ben, which sends SMS to the returned
+// test sender instead of an SMS provider
+func newTestSMSServer(t *testing.T, c *Config) (*Server, *testSMSSender) {
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.SMSProvider = SMSProviderTwilio
+	s := newTestServer(t, c)
+	sender := &testSMSSender{sent: make(chan *testSMS, 10)}
+	s.sms = sender
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	return s, sender
+}
+
+func verifyTestPhoneNumber(t *testing.T, s *Server, sender *testSMSSender, userPass, number string) {
+	headers := map[string]string{"Authorization": basicAuth(userPass)}
+	response := request(t, s, "POST", "/user/phone/verify", `{"number":"`+number+`"}`, headers)
+	require.Equal(t, 200, response.Code)
+	code := readTestPhoneVerificationCode(t, sender)
+	response = request(t, s, "PUT", "/user/phone", `{"number":"`+number+`","code":"`+code+`"}`, headers)
+	require.Equal(t, 200, response.Code)
+}
+
+func readTestPhoneVerificationCode(t *testing.T, sender *testSMSSender) string {
+	matches := regexp.MustCompile(`([0-9]{6})$`).FindStringSubmatch(sender.read(t).text)
+	require.NotNil(t, matches)
+	return matches[1]
+}
@@ -1,23 +1,81 @@
 package server
 
 import (
+	"bytes"
 	_ "embed" // required by go:embed
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"heckel.io/ntfy/util"
+	htmltemplate "html/template"
+	"io"
 	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net"
+	"net/http"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
 	"strings"
+	texttemplate "text/template"
 	"time"
 )
 
+const (
+	smtpSenderMaxAttachmentSize   = 5 * 1024 * 1024 // Larger attachments are only linked, many mail servers reject large e-mails
+	smtpSenderRetryInitialBackoff = time.Minute     // Doubled after every failed attempt, see mailRetryBackoff
+	smtpSenderRetryMaxBackoff     = time.Hour
+	emailDigestMinWindow          = time.Minute
+	emailDigestMaxWindow          = 24 * time.Hour
+	emailDigestMaxMessages        = 100 // Further messages are only counted in the digest
+)
+
 type mailer interface {
 	Send(from, to string, m *message) error
 }
 
+// newMailer creates the mailer for the configured provider, or returns nil if sending e-mails is not enabled
+func newMailer(conf *Config) (mailer, error) {
+	if conf.SMTPSenderProvider == SMTPSenderProviderSMTP && conf.SMTPSenderAddr == "" {
+		return nil, nil
+	}
+	formatter := mailFormatter{config: conf}
+	if conf.SMTPSenderTemplateFile != "" {
+		template, err := loadMailTemplate(conf.SMTPSenderTemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		formatter.template = template
+	}
+	if conf.SMTPSenderDKIMKeyFile != "" {
+		from, err := mail.ParseAddress(conf.SMTPSenderFrom)
+		if err != nil {
+			return nil, err
+		}
+		domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+		dkim, err := loadDKIMSigner(conf.SMTPSenderDKIMKeyFile, conf.SMTPSenderDKIMSelector, domain)
+		if err != nil {
+			return nil, err
+		}
+		formatter.dkim = dkim
+	}
+	switch conf.SMTPSenderProvider {
+	case SMTPSenderProviderSES:
+		return newSESSender(formatter), nil
+	case SMTPSenderProviderMailgun:
+		return newMailgunSender(formatter), nil
+	case SMTPSenderProviderSendGrid:
+		return newSendGridSender(formatter), nil
+	}
+	return &smtpSender{mailFormatter: formatter}, nil
+}
+
 type smtpSender struct {
-	config *Config
+	mailFormatter
 }
 
 func (s *smtpSender) Send(senderIP, to string, m *message) error {
@@ -25,7 +83,7 @@ func (s *smtpSender) Send(senderIP, to string, m *message) error {
 	if err != nil {
 		return err
 	}
-	message, err := formatMail(s.config.BaseURL, senderIP, s.config.SMTPSenderFrom, to, m)
+	message, err := s.format(senderIP, to, m)
 	if err != nil {
 		return err
 	}
@@ -33,41 +91,143 @@ func (s *smtpSender) Send(senderIP, to string, m *message) error {
 	return smtp.SendMail(s.config.SMTPSenderAddr, auth, s.config.SMTPSenderFrom, []string{to}, []byte(message))
 }
 
-func formatMail(baseURL, senderIP, from, to string, m *message) (string, error) {
-	topicURL := baseURL + "/" + m.Topic
-	subject := m.Title
-	if subject == "" {
-		subject = m.Message
+// mailErrorPermanent returns true if retrying to send the e-mail is pointless, e.g. because the recipient does not
+// exist (SMTP 5xx) or the request was rejected by the API (4xx, except for rate limiting). Greylisting, timeouts
+// and other transient errors are retried.
+func mailErrorPermanent(err error) bool {
+	var smtpErr *textproto.Error
+	var providerErr *mailProviderError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	} else if errors.As(err, &providerErr) {
+		return providerErr.statusCode >= 400 && providerErr.statusCode < 500 && providerErr.statusCode != http.StatusTooManyRequests
 	}
-	subject = strings.ReplaceAll(strings.ReplaceAll(subject, "\r", ""), "\n", " ")
-	message := m.Message
-	trailer := ""
-	if len(m.Tags) > 0 {
-		emojis, tags, err := toEmojis(m.Tags)
-		if err != nil {
-			return "", err
+	return false
+}
+
+// mailRetryBackoff returns the time to wait before the next attempt, after the given number of failed attempts
+func mailRetryBackoff(attempts int) time.Duration {
+	backoff := smtpSenderRetryInitialBackoff
+	for i := 1; i < attempts && backoff < smtpSenderRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > smtpSenderRetryMaxBackoff {
+		return smtpSenderRetryMaxBackoff
+	}
+	return backoff
+}
+
+// newEmailDigestMessage combines the messages of a digest into a single message, which is then sent like any other
+// message (using the template, if any). A digest with a single message is sent as is.
+func newEmailDigestMessage(d *emailDigest) *message {
+	if len(d.Messages) == 1 {
+		return d.Messages[0]
+	}
+	var body strings.Builder
+	tags := make([]string, 0)
+	priority := 0
+	for i, m := range d.Messages {
+		if m.Priority > priority {
+			priority = m.Priority
 		}
-		if len(emojis) > 0 {
-			subject = strings.Join(emojis, " ") + " " + subject
+		for _, tag := range m.Tags {
+			if !util.InStringList(tags, tag) {
+				tags = append(tags, tag)
+			}
 		}
-		if len(tags) > 0 {
-			trailer = "Tags: " + strings.Join(tags, ", ")
+		if i >= emailDigestMaxMessages {
+			continue
+		} else if i > 0 {
+			body.WriteString("\n\n")
+		}
+		fmt.Fprintf(&body, "[%s]", time.Unix(m.Time, 0).UTC().Format("15:04:05 UTC"))
+		if m.Title != "" {
+			fmt.Fprintf(&body, " %s", m.Title)
+		}
+		fmt.Fprintf(&body, "\n%s", m.Message)
+		if m.Attachment != nil {
+			fmt.Fprintf(&body, "\nAttachment: %s (%s)", m.Attachment.Name, m.Attachment.URL)
 		}
 	}
-	if m.Priority != 0 && m.Priority != 3 {
-		priority, err := util.PriorityString(m.Priority)
+	if len(d.Messages) > emailDigestMaxMessages {
+		fmt.Fprintf(&body, "\n\n... and %d more messages", len(d.Messages)-emailDigestMaxMessages)
+	}
+	m := newDefaultMessage(d.Topic, body.String())
+	m.Title = fmt.Sprintf("%d messages in %s", len(d.Messages), d.Topic)
+	m.Priority = priority
+	m.Tags = tags
+	return m
+}
+
+// mailFormatter creates the e-mail (including headers) for a message. It is shared by all mailers.
+type mailFormatter struct {
+	config   *Config
+	template *mailTemplate // Optional, see smtp-sender-template-file
+	dkim     *dkimSigner   // Optional, see smtp-sender-dkim-key-file
+}
+
+func (f *mailFormatter) format(senderIP, to string, m *message) (string, error) {
+	var email string
+	var err error
+	if f.template != nil {
+		email, err = f.template.Format(f.config.BaseURL, senderIP, f.config.SMTPSenderFrom, to, m)
+	} else {
+		email, err = formatMail(f.config.BaseURL, senderIP, f.config.SMTPSenderFrom, to, m)
+	}
+	if err != nil {
+		return "", err
+	}
+	if content := f.attachmentContent(m); content != nil {
+		email, err = attachMailFile(email, m.Attachment, content)
 		if err != nil {
 			return "", err
 		}
+	}
+	if f.dkim != nil {
+		return f.dkim.Sign(email) // Must be last, any later change to the e-mail breaks the signature
+	}
+	return email, nil
+}
+
+// attachmentContent returns the content of the message's attachment, if it was uploaded to the attachment cache
+// and is small enough to be attached to the e-mail. All other attachments are only linked in the e-mail.
+func (f *mailFormatter) attachmentContent(m *message) []byte {
+	if m.Attachment == nil || m.Attachment.Owner == "" || f.config.AttachmentCacheDir == "" || m.Attachment.Size > smtpSenderMaxAttachmentSize {
+		return nil
+	}
+	content, err := os.ReadFile(filepath.Join(f.config.AttachmentCacheDir, attachmentFileID(m)))
+	if err != nil || int64(len(content)) > smtpSenderMaxAttachmentSize {
+		return nil
+	}
+	return content
+}
+
+func formatMail(baseURL, senderIP, from, to string, m *message) (string, error) {
+	data, err := newMailTemplateData(baseURL, senderIP, m)
+	if err != nil {
+		return "", err
+	}
+	message := data.Message
+	trailer := ""
+	if len(data.Tags) > 0 {
+		trailer = "Tags: " + strings.Join(data.Tags, ", ")
+	}
+	if data.Priority != "" {
 		if trailer != "" {
 			trailer += "\n"
 		}
-		trailer += fmt.Sprintf("Priority: %s", priority)
+		trailer += fmt.Sprintf("Priority: %s", data.Priority)
+	}
+	if data.Attachment != nil {
+		if trailer != "" {
+			trailer += "\n"
+		}
+		trailer += fmt.Sprintf("Attachment: %s (%s)", data.Attachment.Name, data.Attachment.URL)
 	}
 	if trailer != "" {
 		message += "\n\n" + trailer
 	}
-	subject = mime.BEncoding.Encode("utf-8", subject)
+	subject := mime.BEncoding.Encode("utf-8", data.Subject)
 	body := `From: "{shortTopicURL}" <{from}>
 To: {to}
 Subject: {subject}
@@ -81,13 +241,230 @@ This message was sent by {ip} at {time} via {topicURL}`
 	body = strings.ReplaceAll(body, "{to}", to)
 	body = strings.ReplaceAll(body, "{subject}", subject)
 	body = strings.ReplaceAll(body, "{message}", message)
-	body = strings.ReplaceAll(body, "{topicURL}", topicURL)
-	body = strings.ReplaceAll(body, "{shortTopicURL}", util.ShortTopicURL(topicURL))
-	body = strings.ReplaceAll(body, "{time}", time.Unix(m.Time, 0).UTC().Format(time.RFC1123))
+	body = strings.ReplaceAll(body, "{topicURL}", data.TopicURL)
+	body = strings.ReplaceAll(body, "{shortTopicURL}", data.ShortTopicURL)
+	body = strings.ReplaceAll(body, "{time}", data.Time.Format(time.RFC1123))
 	body = strings.ReplaceAll(body, "{ip}", senderIP)
 	return body, nil
 }
 
+// mailTemplateData is passed to the templates of the smtp-sender-template-file
+type mailTemplateData struct {
+	ID            string
+	Topic         string
+	TopicURL      string
+	ShortTopicURL string
+	Subject       string // Title (or message, if there is no title) in a single line, prefixed with the emojis
+	Title         string
+	Message       string
+	Emojis        []string // Tags that map to emojis
+	Tags          []string // All other tags
+	Priority      string   // Priority name (e.g. "high"), empty for the default priority
+	Click         string
+	Attachment    *attachment // Nil if the message has no attachment
+	Time          time.Time
+	SenderIP      string
+}
+
+func newMailTemplateData(baseURL, senderIP string, m *message) (*mailTemplateData, error) {
+	topicURL := baseURL + "/" + m.Topic
+	data := &mailTemplateData{
+		ID:            m.ID,
+		Topic:         m.Topic,
+		TopicURL:      topicURL,
+		ShortTopicURL: util.ShortTopicURL(topicURL),
+		Title:         m.Title,
+		Message:       m.Message,
+		Emojis:        make([]string, 0),
+		Tags:          make([]string, 0),
+		Click:         m.Click,
+		Attachment:    m.Attachment,
+		Time:          time.Unix(m.Time, 0).UTC(),
+		SenderIP:      senderIP,
+	}
+	subject := m.Title
+	if subject == "" {
+		subject = m.Message
+	}
+	subject = strings.ReplaceAll(strings.ReplaceAll(subject, "\r", ""), "\n", " ")
+	if len(m.Tags) > 0 {
+		emojis, tags, err := toEmojis(m.Tags)
+		if err != nil {
+			return nil, err
+		}
+		if len(emojis) > 0 {
+			subject = strings.Join(emojis, " ") + " " + subject
+		}
+		data.Emojis, data.Tags = emojis, tags
+	}
+	if m.Priority != 0 && m.Priority != 3 {
+		priority, err := util.PriorityString(m.Priority)
+		if err != nil {
+			return nil, err
+		}
+		data.Priority = priority
+	}
+	data.Subject = subject
+	return data, nil
+}
+
+// mailTemplate is a custom format for outgoing e-mails, loaded from the smtp-sender-template-file. The file
+// must define the "subject" and "text" templates (Go text/template syntax), and may define an "html" template
+// (Go html/template syntax). If it does, the e-mail is sent as multipart/alternative with both variants.
+type mailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+func loadMailTemplate(filename string) (*mailTemplate, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	text, err := texttemplate.New(filepath.Base(filename)).Parse(string(b))
+	if err != nil {
+		return nil, err
+	} else if text.Lookup("subject") == nil || text.Lookup("text") == nil {
+		return nil, fmt.Errorf("mail template %s must define the \"subject\" and \"text\" templates", filename)
+	}
+	t := &mailTemplate{text: text}
+	if text.Lookup("html") != nil {
+		t.html, err = htmltemplate.New(filepath.Base(filename)).Parse(string(b))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Format renders the e-mail, including headers, for the given message
+func (t *mailTemplate) Format(baseURL, senderIP, from, to string, m *message) (string, error) {
+	data, err := newMailTemplateData(baseURL, senderIP, m)
+	if err != nil {
+		return "", err
+	}
+	var subject, text bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return "", err
+	}
+	if err := t.text.ExecuteTemplate(&text, "text", data); err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", (&mail.Address{Name: data.ShortTopicURL, Address: from}).String())
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.BEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	if t.html == nil {
+		fmt.Fprintf(&b, "Content-Type: text/plain; charset=\"utf-8\"\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&b, text.Bytes()); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	var html bytes.Buffer
+	if err := t.html.ExecuteTemplate(&html, "html", data); err != nil {
+		return "", err
+	}
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{{"text/plain", text.Bytes()}, {"text/html", html.Bytes()}} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType + `; charset="utf-8"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return "", err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// attachMailFile turns the given e-mail into a multipart/mixed e-mail, with the original body as first part, and
+// the file as second part. The content headers of the original e-mail are moved to the first part.
+func attachMailFile(email string, a *attachment, content []byte) (string, error) {
+	headerEnd, bodyStart := strings.Index(email, "\r\n\r\n"), 4
+	if lf := strings.Index(email, "\n\n"); headerEnd == -1 || (lf != -1 && lf < headerEnd) {
+		headerEnd, bodyStart = lf, 2
+	}
+	if headerEnd == -1 {
+		return "", errors.New("invalid e-mail, no header/body separator")
+	}
+	var b bytes.Buffer
+	var name string
+	contentHeader := textproto.MIMEHeader{}
+	for _, line := range strings.Split(email[:headerEnd], "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		folded := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		if !folded {
+			name = strings.ToLower(line[:strings.Index(line+":", ":")])
+		}
+		if name == "content-type" || name == "content-transfer-encoding" {
+			if folded {
+				contentHeader.Set(name, contentHeader.Get(name)+" "+strings.TrimSpace(line))
+			} else {
+				contentHeader.Set(name, strings.TrimSpace(line[len(name)+1:]))
+			}
+		} else if name != "mime-version" {
+			fmt.Fprintf(&b, "%s\r\n", line)
+		}
+	}
+	parts := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+	w, err := parts.CreatePart(contentHeader)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(w, email[headerEnd+bodyStart:]); err != nil {
+		return "", err
+	}
+	contentType := a.Type
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w, err = parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 { // Max line length, see RFC 2045
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return "", err
+		}
+		encoded = encoded[76:]
+	}
+	if _, err := io.WriteString(w, encoded); err != nil {
+		return "", err
+	}
+	if err := parts.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// writeQuotedPrintable encodes the body as quoted-printable, which keeps lines short, even if the template
+// produces long (HTML) lines
+func writeQuotedPrintable(w io.Writer, body []byte) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write(body); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
 var (
 	//go:embed "mailer_emoji.json"
 	emojisJSON string
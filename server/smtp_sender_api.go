@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	mailProviderTimeout          = 30 * time.Second
+	mailProviderMaxErrorBodySize = 1024 // Error responses contain the reason for rejected e-mails, e.g. unverified senders
+)
+
+// sesSender sends e-mails via the Amazon SES v2 API (SendEmail with raw content). The requests are signed with
+// AWS Signature Version 4, using smtp-sender-user/smtp-sender-pass as access key ID and secret access key.
+type sesSender struct {
+	mailFormatter
+	endpoint string
+	client   *http.Client
+}
+
+type sesSendEmailRequest struct {
+	FromEmailAddress string         `json:"FromEmailAddress"`
+	Destination      sesDestination `json:"Destination"`
+	Content          sesContent     `json:"Content"`
+}
+
+type sesDestination struct {
+	ToAddresses []string `json:"ToAddresses"`
+}
+
+type sesContent struct {
+	Raw sesRawMessage `json:"Raw"`
+}
+
+type sesRawMessage struct {
+	Data []byte `json:"Data"` // Base64-encoded by encoding/json
+}
+
+func newSESSender(formatter mailFormatter) *sesSender {
+	return &sesSender{
+		mailFormatter: formatter,
+		endpoint:      fmt.Sprintf("https://email.%s.amazonaws.com", formatter.config.SMTPSenderAddr),
+		client:        &http.Client{Timeout: mailProviderTimeout},
+	}
+}
+
+func (s *sesSender) Send(senderIP, to string, m *message) error {
+	email, err := s.format(senderIP, to, m)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(&sesSendEmailRequest{
+		FromEmailAddress: s.config.SMTPSenderFrom,
+		Destination:      sesDestination{ToAddresses: []string{to}},
+		Content:          sesContent{Raw: sesRawMessage{Data: []byte(email)}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWSv4(req, body, s.config.SMTPSenderUser, s.config.SMTPSenderPass, s.config.SMTPSenderAddr, "ses", time.Now())
+	return doMailProviderRequest(s.client, req, SMTPSenderProviderSES)
+}
+
+// signAWSv4 adds the X-Amz-Date and Authorization header to the request, as defined by AWS Signature Version 4
+// (see https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html). Only the Content-Type, Host and
+// X-Amz-Date headers are signed.
+func signAWSv4(req *http.Request, body []byte, accessKeyID, secretAccessKey, region, service string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	signedHeaders := "content-type;host;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		fmt.Sprintf("content-type:%s\nhost:%s\nx-amz-date:%s\n", req.Header.Get("Content-Type"), req.URL.Host, amzDate),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", amzDate, scope, hex.EncodeToString(canonicalRequestHash[:]))
+	key := []byte("AWS4" + secretAccessKey)
+	for _, data := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, data)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// mailgunSender sends e-mails via the Mailgun API (messages.mime endpoint), using smtp-sender-addr as the sending
+// domain and smtp-sender-pass as API key
+type mailgunSender struct {
+	mailFormatter
+	endpoint string
+	client   *http.Client
+}
+
+func newMailgunSender(formatter mailFormatter) *mailgunSender {
+	return &mailgunSender{
+		mailFormatter: formatter,
+		endpoint:      "https://api.mailgun.net",
+		client:        &http.Client{Timeout: mailProviderTimeout},
+	}
+}
+
+func (s *mailgunSender) Send(senderIP, to string, m *message) error {
+	email, err := s.format(senderIP, to, m)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("to", to); err != nil {
+		return err
+	}
+	w, err := form.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, email); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v3/%s/messages.mime", s.endpoint, s.config.SMTPSenderAddr), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("api", s.config.SMTPSenderPass)
+	return doMailProviderRequest(s.client, req, SMTPSenderProviderMailgun)
+}
+
+// sendGridSender sends e-mails via the SendGrid v3 API, using smtp-sender-pass as API key. Since the API does not
+// accept raw e-mails, the formatted e-mail is split into subject, text/HTML content and attachments.
+type sendGridSender struct {
+	mailFormatter
+	endpoint string
+	client   *http.Client
+}
+
+type sendGridMailRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To []sendGridAddress `json:"to"`
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     []byte `json:"content"` // Base64-encoded by encoding/json
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition"`
+}
+
+func newSendGridSender(formatter mailFormatter) *sendGridSender {
+	return &sendGridSender{
+		mailFormatter: formatter,
+		endpoint:      "https://api.sendgrid.com",
+		client:        &http.Client{Timeout: mailProviderTimeout},
+	}
+}
+
+func (s *sendGridSender) Send(senderIP, to string, m *message) error {
+	email, err := s.format(senderIP, to, m)
+	if err != nil {
+		return err
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(email))
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return err
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return err
+	}
+	parts, err := readMailParts(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body)
+	if err != nil {
+		return err
+	}
+	request := &sendGridMailRequest{
+		Personalizations: []sendGridPersonalization{{To: []sendGridAddress{{Email: to}}}},
+		From:             sendGridAddress{Email: from.Address, Name: from.Name},
+		Subject:          subject,
+	}
+	for _, part := range parts {
+		if part.filename == "" && (part.contentType == "text/plain" || part.contentType == "text/html") {
+			request.Content = append(request.Content, sendGridContent{Type: part.contentType, Value: string(part.content)})
+		} else {
+			request.Attachments = append(request.Attachments, sendGridAttachment{
+				Content:     part.content,
+				Type:        part.contentType,
+				Filename:    part.filename,
+				Disposition: "attachment",
+			})
+		}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint+"/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.config.SMTPSenderPass)
+	return doMailProviderRequest(s.client, req, SMTPSenderProviderSendGrid)
+}
+
+type mailPart struct {
+	contentType string
+	filename    string
+	content     []byte
+}
+
+// readMailParts returns the decoded leaf parts of an e-mail body, descending into nested multipart bodies
+func readMailParts(contentType, transferEncoding, filename string, body io.Reader) ([]*mailPart, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := make([]*mailPart, 0)
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart() // Decodes quoted-printable, but not base64
+			if err == io.EOF {
+				return parts, nil
+			} else if err != nil {
+				return nil, err
+			}
+			children, err := readMailParts(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.FileName(), part)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, children...)
+		}
+	}
+	switch strings.ToLower(transferEncoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return []*mailPart{{contentType: mediaType, filename: filename, content: content}}, nil
+}
+
+// mailProviderError is returned if a mail provider API did not accept an e-mail
+type mailProviderError struct {
+	provider   string
+	statusCode int
+	status     string
+	body       string
+}
+
+func (e *mailProviderError) Error() string {
+	return fmt.Sprintf("%s: unexpected response %s: %s", e.provider, e.status, e.body)
+}
+
+// doMailProviderRequest performs the API request, and returns the response body as part of the error if the
+// provider did not accept the e-mail, so that the reason ends up in the logs
+func doMailProviderRequest(client *http.Client, req *http.Request, provider string) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, mailProviderMaxErrorBodySize))
+	return &mailProviderError{
+		provider:   provider,
+		statusCode: resp.StatusCode,
+		status:     resp.Status,
+		body:       strings.TrimSpace(string(body)),
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignAWSv4(t *testing.T) {
+	// Example from the AWS documentation, see https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Version=2010-05-08&Action=ListUsers", nil)
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSv4(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	require.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	require.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7", req.Header.Get("Authorization"))
+}
+
+func TestSESSender_Send(t *testing.T) {
+	var request sesSendEmailRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v2/email/outbound-emails", r.URL.Path)
+		require.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"))
+		require.Contains(t, r.Header.Get("Authorization"), "/us-east-2/ses/aws4_request")
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&request))
+		w.Write([]byte(`{"MessageId":"0100abc"}`))
+	}))
+	defer server.Close()
+
+	conf := newTestMailProviderConfig(t, SMTPSenderProviderSES)
+	conf.SMTPSenderAddr = "us-east-2"
+	conf.SMTPSenderUser = "AKIDEXAMPLE"
+	sender := newSESSender(mailFormatter{config: conf})
+	sender.endpoint = server.URL
+	require.Nil(t, sender.Send("1.2.3.4", "phil@example.com", newTestMailProviderMessage()))
+	require.Equal(t, "ntfy@ntfy.sh", request.FromEmailAddress)
+	require.Equal(t, []string{"phil@example.com"}, request.Destination.ToAddresses)
+	require.Contains(t, string(request.Content.Raw.Data), "Subject: Backup failed\n")
+	require.Contains(t, string(request.Content.Raw.Data), "Disk full on backup host")
+}
+
+func TestMailgunSender_Send(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v3/mg.example.com/messages.mime", r.URL.Path)
+		username, password, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "api", username)
+		require.Equal(t, "secret-key", password)
+		require.Nil(t, r.ParseMultipartForm(1024*1024))
+		require.Equal(t, "phil@example.com", r.FormValue("to"))
+		file, _, err := r.FormFile("message")
+		require.Nil(t, err)
+		email, err := io.ReadAll(file)
+		require.Nil(t, err)
+		require.Contains(t, string(email), "Subject: Backup failed\n")
+		w.Write([]byte(`{"id":"<abc@mg.example.com>","message":"Queued. Thank you."}`))
+	}))
+	defer server.Close()
+
+	conf := newTestMailProviderConfig(t, SMTPSenderProviderMailgun)
+	conf.SMTPSenderAddr = "mg.example.com"
+	sender := newMailgunSender(mailFormatter{config: conf})
+	sender.endpoint = server.URL
+	require.Nil(t, sender.Send("1.2.3.4", "phil@example.com", newTestMailProviderMessage()))
+}
+
+func TestSendGridSender_Send(t *testing.T) {
+	var request sendGridMailRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v3/mail/send", r.URL.Path)
+		require.Equal(t, "Bearer secret-key", r.Header.Get("Authorization"))
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&request))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	conf := newTestMailProviderConfig(t, SMTPSenderProviderSendGrid)
+	conf.AttachmentCacheDir = t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(conf.AttachmentCacheDir, "abc"), []byte("disk usage: 100%"), 0600))
+	m := newTestMailProviderMessage()
+	m.Attachment = &attachment{Name: "df.txt", Type: "text/plain", Size: 16, URL: "https://ntfy.sh/file/abc.txt", Owner: "1.2.3.4"}
+	sender := newSendGridSender(mailFormatter{config: conf})
+	sender.endpoint = server.URL
+	require.Nil(t, sender.Send("1.2.3.4", "phil@example.com", m))
+	require.Equal(t, "phil@example.com", request.Personalizations[0].To[0].Email)
+	require.Equal(t, "ntfy@ntfy.sh", request.From.Email)
+	require.Equal(t, "ntfy.sh/alerts", request.From.Name)
+	require.Equal(t, "Backup failed", request.Subject)
+	require.Equal(t, 1, len(request.Content))
+	require.Equal(t, "text/plain", request.Content[0].Type)
+	require.True(t, strings.HasPrefix(request.Content[0].Value, "Disk full on backup host\n\nAttachment: df.txt"))
+	require.Equal(t, 1, len(request.Attachments))
+	require.Equal(t, "df.txt", request.Attachments[0].Filename)
+	require.Equal(t, "text/plain", request.Attachments[0].Type)
+	require.Equal(t, "disk usage: 100%", string(request.Attachments[0].Content))
+}
+
+func TestSendGridSender_Send_Rejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":[{"message":"The from address does not match a verified Sender Identity."}]}`))
+	}))
+	defer server.Close()
+
+	sender := newSendGridSender(mailFormatter{config: newTestMailProviderConfig(t, SMTPSenderProviderSendGrid)})
+	sender.endpoint = server.URL
+	err := sender.Send("1.2.3.4", "phil@example.com", newTestMailProviderMessage())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "sendgrid: unexpected response 403 Forbidden")
+	require.Contains(t, err.Error(), "does not match a verified Sender Identity")
+}
+
+func TestNewMailer(t *testing.T) {
+	conf := newTestConfig(t)
+	mailer, err := newMailer(conf)
+	require.Nil(t, err)
+	require.Nil(t, mailer)
+
+	conf.SMTPSenderAddr = "mail.example.com:587"
+	mailer, err = newMailer(conf)
+	require.Nil(t, err)
+	require.IsType(t, &smtpSender{}, mailer)
+
+	conf.SMTPSenderProvider = SMTPSenderProviderSendGrid
+	conf.SMTPSenderAddr = ""
+	mailer, err = newMailer(conf)
+	require.Nil(t, err)
+	require.IsType(t, &sendGridSender{}, mailer)
+}
+
+func newTestMailProviderConfig(t *testing.T, provider string) *Config {
+	conf := newTestConfig(t)
+	conf.BaseURL = "https://ntfy.sh"
+	conf.SMTPSenderProvider = provider
+	conf.SMTPSenderPass = "secret-key"
+	conf.SMTPSenderFrom = "ntfy@ntfy.sh"
+	return conf
+}
+
+func newTestMailProviderMessage() *message {
+	return &message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Title:   "Backup failed",
+		Message: "Disk full on backup host",
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// dkimSignedHeaders are the header fields that are signed, if they exist in the e-mail
+var dkimSignedHeaders = []string{"from", "to", "subject", "date", "message-id", "mime-version", "content-type", "content-transfer-encoding"}
+
+// dkimSigner signs outgoing e-mails with DKIM (RFC 6376), using relaxed/relaxed canonicalization. The public key
+// must be published in the TXT record <selector>._domainkey.<domain>.
+type dkimSigner struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+}
+
+// loadDKIMSigner reads a PEM-encoded RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8) private key from the given file
+func loadDKIMSigner(filename, selector, domain string) (*dkimSigner, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("invalid DKIM key file %s: no PEM data found", filename)
+	}
+	var key interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid DKIM key file %s: %s", filename, err.Error())
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &dkimSigner{domain: domain, selector: selector, key: k, algorithm: "rsa-sha256"}, nil
+	case ed25519.PrivateKey:
+		return &dkimSigner{domain: domain, selector: selector, key: k, algorithm: "ed25519-sha256"}, nil
+	}
+	return nil, fmt.Errorf("invalid DKIM key file %s: only RSA and Ed25519 keys are supported", filename)
+}
+
+// Sign adds a DKIM-Signature header to the e-mail. Line endings of the returned e-mail are normalized to CRLF,
+// so that the signature is not broken by later conversions.
+func (s *dkimSigner) Sign(email string) (string, error) {
+	headers, body := splitMailHeaderBody([]byte(email))
+	if len(headers) == 0 {
+		return "", errors.New("cannot sign e-mail without headers")
+	}
+	signed := make([]string, 0)
+	h := sha256.New()
+	for _, name := range dkimSignedHeaders {
+		for i := len(headers) - 1; i >= 0; i-- { // Bottom-most field is used, see RFC 6376, section 5.4.2
+			if strings.EqualFold(headers[i].name, name) {
+				signed = append(signed, name)
+				h.Write([]byte(dkimCanonicalizeHeader(headers[i].raw, "relaxed")))
+				break
+			}
+		}
+	}
+	bodyHash := sha256.Sum256(dkimCanonicalizeBody(body, "relaxed"))
+	sigHeader := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		s.algorithm, s.domain, s.selector, time.Now().Unix(), strings.Join(signed, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	h.Write([]byte(strings.TrimSuffix(dkimCanonicalizeHeader(sigHeader, "relaxed"), "\r\n")))
+	opts := crypto.Hash(crypto.SHA256)
+	if s.algorithm == "ed25519-sha256" {
+		opts = crypto.Hash(0) // Ed25519 signs the SHA-256 hash itself, see RFC 8463
+	}
+	signature, err := s.key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	b.WriteString(sigHeader + base64.StdEncoding.EncodeToString(signature) + "\r\n")
+	for _, field := range headers {
+		b.WriteString(field.raw)
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+	return b.String(), nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDKIMSigner_Sign_RSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	keyFile := writeTestDKIMKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	resolver := newTestResolver()
+	resolver.txt["ntfy._domainkey.ntfy.sh"] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}
+
+	signer, err := loadDKIMSigner(keyFile, "ntfy", "ntfy.sh")
+	require.Nil(t, err)
+	email, err := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", newTestMailProviderMessage())
+	require.Nil(t, err)
+	signed, err := signer.Sign(email)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(signed, "DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=ntfy.sh; s=ntfy;"))
+	require.Contains(t, signed, "h=from:to:subject:content-type;")
+	require.Contains(t, signed, "\r\nSubject: Backup failed\r\n")
+	require.NotContains(t, strings.ReplaceAll(signed, "\r\n", ""), "\n")
+
+	result, domain := verifyDKIM(context.Background(), resolver, []byte(signed))
+	require.Equal(t, mailAuthPass, result)
+	require.Equal(t, "ntfy.sh", domain)
+
+	result, _ = verifyDKIM(context.Background(), resolver, []byte(strings.ReplaceAll(signed, "Disk full", "Disk empty")))
+	require.Equal(t, mailAuthFail, result)
+}
+
+func TestDKIMSigner_Sign_Ed25519(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	keyFile := writeTestDKIMKey(t, "PRIVATE KEY", der)
+	resolver := newTestResolver()
+	resolver.txt["mail._domainkey.example.com"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}
+
+	signer, err := loadDKIMSigner(keyFile, "mail", "example.com")
+	require.Nil(t, err)
+	signed, err := signer.Sign("From: ntfy <ntfy@example.com>\nTo: phil@example.com\nSubject: Hi\n\nHello  there\n")
+	require.Nil(t, err)
+	require.Contains(t, signed, "a=ed25519-sha256;")
+	require.Contains(t, signed, "h=from:to:subject;")
+
+	result, domain := verifyDKIM(context.Background(), resolver, []byte(signed))
+	require.Equal(t, mailAuthPass, result)
+	require.Equal(t, "example.com", domain)
+}
+
+func TestLoadDKIMSigner_Invalid(t *testing.T) {
+	_, err := loadDKIMSigner(filepath.Join(t.TempDir(), "missing.pem"), "mail", "example.com")
+	require.Error(t, err)
+
+	_, err = loadDKIMSigner(writeTestDKIMKey(t, "PRIVATE KEY", []byte("not a key")), "mail", "example.com")
+	require.Error(t, err)
+
+	notPEM := filepath.Join(t.TempDir(), "key.txt")
+	require.Nil(t, os.WriteFile(notPEM, []byte("not a key"), 0600))
+	_, err = loadDKIMSigner(notPEM, "mail", "example.com")
+	require.Error(t, err)
+}
+
+func TestNewMailer_DKIM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	conf := newTestMailProviderConfig(t, SMTPSenderProviderMailgun)
+	conf.SMTPSenderAddr = "mg.ntfy.sh"
+	conf.SMTPSenderFrom = "ntfy <ntfy@mg.ntfy.sh>"
+	conf.SMTPSenderDKIMSelector = "mg"
+	conf.SMTPSenderDKIMKeyFile = writeTestDKIMKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	mailer, err := newMailer(conf)
+	require.Nil(t, err)
+	sender := mailer.(*mailgunSender)
+	require.Equal(t, "mg.ntfy.sh", sender.dkim.domain)
+	require.Equal(t, "mg", sender.dkim.selector)
+
+	email, err := sender.format("1.2.3.4", "phil@example.com", newTestMailProviderMessage())
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(email, "DKIM-Signature: "))
+}
+
+func writeTestDKIMKey(t *testing.T, blockType string, der []byte) string {
+	filename := filepath.Join(t.TempDir(), "dkim.pem")
+	require.Nil(t, os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return filename
+}
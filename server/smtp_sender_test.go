@@ -1,8 +1,20 @@
 package server
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFormatMail_Basic(t *testing.T) {
@@ -139,3 +151,203 @@ Priority: max
 This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
 	require.Equal(t, expected, actual)
 }
+
+func TestFormatMail_Template(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mail.tmpl")
+	require.Nil(t, os.WriteFile(filename, []byte(`{{define "subject"}}[{{.Topic}}] {{.Subject}}{{end}}
+{{define "text"}}{{.Message}}
+{{if .Priority}}Priorität: {{.Priority}}{{end}}
+Gesendet um {{.Time.Format "15:04"}} via {{.TopicURL}}{{end}}`), 0600))
+	tpl, err := loadMailTemplate(filename)
+	require.Nil(t, err)
+	actual, err := tpl.Format("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:       "abc",
+		Time:     1640382204,
+		Event:    "message",
+		Topic:    "alerts",
+		Priority: 4,
+		Tags:     []string{"warning"},
+		Message:  "Festplatte voll",
+	})
+	require.Nil(t, err)
+	expected := "From: \"ntfy.sh/alerts\" <ntfy@ntfy.sh>\r\n" +
+		"To: phil@example.com\r\n" +
+		"Subject: =?utf-8?b?W2FsZXJ0c10g4pqg77iPIEZlc3RwbGF0dGUgdm9sbA==?=\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=\"utf-8\"\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"Festplatte voll\r\nPriorit=C3=A4t: high\r\nGesendet um 21:43 via https://ntfy.sh/alerts"
+	require.Equal(t, expected, actual)
+}
+
+func TestFormatMail_TemplateHTML(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mail.tmpl")
+	require.Nil(t, os.WriteFile(filename, []byte(`{{define "subject"}}{{.Subject}}{{end}}
+{{define "text"}}{{.Message}}{{end}}
+{{define "html"}}<p>{{.Message}}</p>{{if .Click}}<a href="{{.Click}}">Open</a>{{end}}{{end}}`), 0600))
+	tpl, err := loadMailTemplate(filename)
+	require.Nil(t, err)
+	actual, err := tpl.Format("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Message: "Disk <sda> full",
+		Click:   "https://grafana.example.com/d/disk",
+	})
+	require.Nil(t, err)
+	msg, err := mail.ReadMessage(strings.NewReader(actual))
+	require.Nil(t, err)
+	require.Equal(t, "Disk <sda> full", msg.Header.Get("Subject"))
+	contentType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.Nil(t, err)
+	require.Equal(t, "multipart/alternative", contentType)
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	bodies := make(map[string]string)
+	for {
+		part, err := parts.NextPart() // Decodes quoted-printable transparently
+		if err == io.EOF {
+			break
+		}
+		require.Nil(t, err)
+		body, err := io.ReadAll(part)
+		require.Nil(t, err)
+		bodies[part.Header.Get("Content-Type")] = string(body)
+	}
+	require.Equal(t, "Disk <sda> full", bodies[`text/plain; charset="utf-8"`])
+	require.Equal(t, `<p>Disk &lt;sda&gt; full</p><a href="https://grafana.example.com/d/disk">Open</a>`, bodies[`text/html; charset="utf-8"`])
+}
+
+func TestFormatMail_TemplateInvalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "mail.tmpl")
+	require.Nil(t, os.WriteFile(filename, []byte(`{{define "text"}}{{.Message}}{{end}}`), 0600))
+	_, err := loadMailTemplate(filename)
+	require.Error(t, err) // No subject template
+	require.Nil(t, os.WriteFile(filename, []byte(`{{define "subject"}}{{.Subject}{{end}}`), 0600))
+	_, err = loadMailTemplate(filename)
+	require.Error(t, err)
+}
+
+func TestFormatMail_AttachmentLink(t *testing.T) {
+	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Message: "Backup log attached",
+		Attachment: &attachment{
+			Name: "backup.log",
+			Type: "text/plain",
+			Size: 123,
+			URL:  "https://ntfy.sh/file/abc.log",
+		},
+	})
+	require.Contains(t, actual, "\n\nAttachment: backup.log (https://ntfy.sh/file/abc.log)\n\n--\n")
+}
+
+func TestAttachMailFile(t *testing.T) {
+	email, err := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:      "abc",
+		Time:    1640382204,
+		Event:   "message",
+		Topic:   "alerts",
+		Message: "Screenshot attached",
+	})
+	require.Nil(t, err)
+	content := []byte(strings.Repeat("some binary \x00\x01\x02 content ", 10))
+	actual, err := attachMailFile(email, &attachment{Name: "screen shot.png", Type: "image/png"}, content)
+	require.Nil(t, err)
+
+	msg, err := mail.ReadMessage(strings.NewReader(actual))
+	require.Nil(t, err)
+	require.Equal(t, "phil@example.com", msg.Header.Get("To"))
+	require.Equal(t, "1.0", msg.Header.Get("MIME-Version"))
+	contentType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.Nil(t, err)
+	require.Equal(t, "multipart/mixed", contentType)
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+
+	part, err := parts.NextPart()
+	require.Nil(t, err)
+	require.Equal(t, `text/plain; charset="utf-8"`, part.Header.Get("Content-Type"))
+	body, err := io.ReadAll(part)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(body), "Screenshot attached\n\n--\n"))
+
+	part, err = parts.NextPart()
+	require.Nil(t, err)
+	require.Equal(t, "image/png", part.Header.Get("Content-Type"))
+	require.Equal(t, "screen shot.png", part.FileName())
+	encoded, err := io.ReadAll(part)
+	require.Nil(t, err)
+	for _, line := range strings.Split(string(encoded), "\r\n") {
+		require.LessOrEqual(t, len(line), 76)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+	require.Nil(t, err)
+	require.Equal(t, content, decoded)
+
+	_, err = parts.NextPart()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestMailFormatter_AttachmentContent(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.AttachmentCacheDir = t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(conf.AttachmentCacheDir, "abc"), []byte("hello"), 0600))
+	s := &mailFormatter{config: conf}
+	require.Equal(t, []byte("hello"), s.attachmentContent(&message{ID: "abc", Attachment: &attachment{Owner: "1.2.3.4", Size: 5}}))
+	require.Nil(t, s.attachmentContent(&message{ID: "abc", Attachment: &attachment{Size: 5}}))                                                 // External attachment
+	require.Nil(t, s.attachmentContent(&message{ID: "abc", Attachment: &attachment{Owner: "1.2.3.4", Size: smtpSenderMaxAttachmentSize + 1}})) // Too large
+	require.Nil(t, s.attachmentContent(&message{ID: "xyz", Attachment: &attachment{Owner: "1.2.3.4", Size: 5}}))                               // Missing file
+	require.Nil(t, s.attachmentContent(&message{ID: "abc"}))
+}
+
+func TestMailErrorPermanent(t *testing.T) {
+	require.False(t, mailErrorPermanent(errors.New("dial tcp: connection refused")))
+	require.False(t, mailErrorPermanent(&textproto.Error{Code: 451, Msg: "4.7.1 Greylisted, please try again later"}))
+	require.True(t, mailErrorPermanent(&textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}))
+	require.False(t, mailErrorPermanent(&mailProviderError{provider: "sendgrid", statusCode: 503}))
+	require.False(t, mailErrorPermanent(&mailProviderError{provider: "sendgrid", statusCode: 429}))
+	require.True(t, mailErrorPermanent(&mailProviderError{provider: "sendgrid", statusCode: 403}))
+	require.True(t, mailErrorPermanent(fmt.Errorf("wrapped: %w", &textproto.Error{Code: 554})))
+}
+
+func TestMailRetryBackoff(t *testing.T) {
+	require.Equal(t, time.Minute, mailRetryBackoff(1))
+	require.Equal(t, 2*time.Minute, mailRetryBackoff(2))
+	require.Equal(t, 32*time.Minute, mailRetryBackoff(6))
+	require.Equal(t, time.Hour, mailRetryBackoff(7))
+	require.Equal(t, time.Hour, mailRetryBackoff(100))
+}
+
+func TestNewEmailDigestMessage(t *testing.T) {
+	m1 := newDefaultMessage("ci", "Tests failed on main")
+	m1.Time = 1640382204
+	m1.Title = "Build #12"
+	m1.Tags = []string{"warning", "ci"}
+	m2 := newDefaultMessage("ci", "Deploy done")
+	m2.Time = 1640382264
+	m2.Priority = 4
+	m2.Tags = []string{"ci", "rocket"}
+	m2.Attachment = &attachment{Name: "deploy.log", URL: "https://ntfy.sh/file/abc.log"}
+	m := newEmailDigestMessage(&emailDigest{Topic: "ci", Messages: []*message{m1, m2}})
+	require.Equal(t, "ci", m.Topic)
+	require.Equal(t, "2 messages in ci", m.Title)
+	require.Equal(t, 4, m.Priority)
+	require.Equal(t, []string{"warning", "ci", "rocket"}, m.Tags)
+	require.Equal(t, "[21:43:24 UTC] Build #12\nTests failed on main\n\n[21:44:24 UTC]\nDeploy done\nAttachment: deploy.log (https://ntfy.sh/file/abc.log)", m.Message)
+
+	// Single message is sent as is
+	require.Equal(t, m1, newEmailDigestMessage(&emailDigest{Topic: "ci", Messages: []*message{m1}}))
+}
+
+func TestNewEmailDigestMessage_TooManyMessages(t *testing.T) {
+	messages := make([]*message, 0)
+	for i := 0; i < emailDigestMaxMessages+5; i++ {
+		messages = append(messages, newDefaultMessage("ci", fmt.Sprintf("build %d", i)))
+	}
+	m := newEmailDigestMessage(&emailDigest{Topic: "ci", Messages: messages})
+	require.Equal(t, "105 messages in ci", m.Title)
+	require.True(t, strings.HasSuffix(m.Message, "build 99\n\n... and 5 more messages"))
+}
@@ -2,46 +2,202 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
 	"github.com/emersion/go-smtp"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/time/rate"
+	"heckel.io/ntfy/util"
 	"io"
+	"log"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/mail"
+	"net/textproto"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	smtpServerMaxMessageBytes   = 1024 * 1024 // Base limit, excluding attachments
+	smtpServerMaxMultipartDepth = 10
+	smtpServerVerifyTimeout     = 10 * time.Second // Total time for all DNS lookups of the SPF/DKIM checks
 )
 
 var (
+	mailWordDecoder           = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+	mailMessageIDRegex        = regexp.MustCompile(`<([^<>]+)>`)
+	mailURLRegex              = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+`)
+	errRateLimitReached       = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "rate limit reached, please try again later"}
+	errSenderVerification     = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "sender verification (SPF/DKIM) failed"}
+	errUnauthorizedTopic      = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "not authorized to publish to this topic"}
+	errSenderNotAllowed       = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "sender not allowed"}
 	errInvalidDomain          = errors.New("invalid domain")
 	errInvalidAddress         = errors.New("invalid address")
 	errInvalidTopic           = errors.New("invalid topic")
 	errTooManyRecipients      = errors.New("too many recipients")
+	errMultipartNestedTooDeep = errors.New("multipart message nested too deep")
+	errAttachmentTooLarge     = &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 3, 4}, Message: "attachment too large"}
 	errUnsupportedContentType = errors.New("unsupported content type")
 )
 
+// mailPublisher is a function that is called for every incoming e-mail. The sender IP is the IP address of
+// the SMTP client, and the attachment is optional and may be nil if the e-mail had no file attached.
+type mailPublisher func(senderIP string, m *message, a *mailAttachment) error
+
+// mailAttachment is the (decoded) file attached to an incoming e-mail
+type mailAttachment struct {
+	Name string
+	Type string
+	Body []byte
+}
+
 // smtpBackend implements SMTP server methods.
 type smtpBackend struct {
-	config  *Config
-	sub     subscriber
-	success int64
-	failure int64
-	mu      sync.Mutex
+	config        *Config
+	visitor       func(ip string) *visitor // Per-sender rate limiting, based on the IP of the SMTP client
+	authorize     func(topic string) error // Optional, checks if anonymous users may publish to the topic
+	resolver      mailResolver             // Used for sender verification (SPF/DKIM), if enabled
+	sub           mailPublisher
+	topicLimiters map[string]*smtpTopicLimiter
+	success       int64
+	failure       int64
+	errors        map[string]int64 // Failures by reason, see smtpErrorReason
+	bytes         int64
+	sessions      int64
+	mu            sync.Mutex
+}
+
+// smtpMetrics is a snapshot of the SMTP server counters, see smtpBackend.Metrics
+type smtpMetrics struct {
+	Success        int64
+	Failure        int64
+	Errors         map[string]int64
+	BytesReceived  int64
+	ActiveSessions int64
 }
 
-func newMailBackend(conf *Config, sub subscriber) *smtpBackend {
+// smtpTopicLimiter limits the number of e-mails that can be published to a topic, regardless of the sender
+type smtpTopicLimiter struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+func newMailBackend(conf *Config, visitor func(ip string) *visitor, authorize func(topic string) error, sub mailPublisher) *smtpBackend {
 	return &smtpBackend{
-		config: conf,
-		sub:    sub,
+		config:        conf,
+		visitor:       visitor,
+		authorize:     authorize,
+		resolver:      net.DefaultResolver,
+		sub:           sub,
+		topicLimiters: make(map[string]*smtpTopicLimiter),
+		errors:        make(map[string]int64),
 	}
 }
 
 func (b *smtpBackend) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
-	return &smtpSession{backend: b}, nil
+	return b.newSession(state), nil
 }
 
 func (b *smtpBackend) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
-	return &smtpSession{backend: b}, nil
+	return b.newSession(state), nil
+}
+
+func (b *smtpBackend) newSession(state *smtp.ConnectionState) *smtpSession {
+	var helo string
+	if state != nil {
+		helo = state.Hostname
+	}
+	b.mu.Lock()
+	b.sessions++
+	b.mu.Unlock()
+	return &smtpSession{backend: b, remoteIP: remoteIP(state), helo: helo}
+}
+
+// topicFromAddress determines the topic for an e-mail address (without plus-addressing extensions). The first
+// matching topic rule wins; if no rule matches, the address must be <prefix><topic>@<domain>.
+func (b *smtpBackend) topicFromAddress(address string) (string, error) {
+	for _, rule := range b.config.SMTPServerTopicRules {
+		match := rule.Pattern.FindStringSubmatchIndex(address)
+		if match == nil {
+			continue
+		}
+		topic := string(rule.Pattern.ExpandString(nil, rule.Topic, address, match))
+		if !topicRegex.MatchString(topic) {
+			return "", errInvalidTopic
+		}
+		return topic, nil
+	}
+	if !strings.HasSuffix(address, "@"+b.config.SMTPServerDomain) {
+		return "", errInvalidDomain
+	}
+	topic := strings.TrimSuffix(address, "@"+b.config.SMTPServerDomain)
+	if b.config.SMTPServerAddrPrefix != "" {
+		if !strings.HasPrefix(topic, b.config.SMTPServerAddrPrefix) {
+			return "", errInvalidAddress
+		}
+		topic = strings.TrimPrefix(topic, b.config.SMTPServerAddrPrefix)
+	}
+	if !topicRegex.MatchString(topic) {
+		return "", errInvalidTopic
+	}
+	return topic, nil
+}
+
+// SenderAllowed checks the sender address (MAIL FROM) against the allowed and denied senders. Denied senders
+// take precedence. If allowed senders are defined, all other senders (including the null sender) are rejected.
+func (b *smtpBackend) SenderAllowed(from string) bool {
+	for _, pattern := range b.config.SMTPServerDeniedSenders {
+		if pattern.MatchString(from) {
+			return false
+		}
+	}
+	if len(b.config.SMTPServerAllowedSenders) == 0 {
+		return true
+	}
+	for _, pattern := range b.config.SMTPServerAllowedSenders {
+		if pattern.MatchString(from) {
+			return true
+		}
+	}
+	return false
+}
+
+// TopicAllowed returns errRateLimitReached if too many e-mails have been published to the given topic recently
+func (b *smtpBackend) TopicAllowed(topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l, ok := b.topicLimiters[topic]
+	if !ok {
+		l = &smtpTopicLimiter{
+			limiter: rate.NewLimiter(rate.Every(b.config.SMTPServerTopicLimitReplenish), b.config.SMTPServerTopicLimitBurst),
+		}
+		b.topicLimiters[topic] = l
+	}
+	l.seen = time.Now()
+	if !l.limiter.Allow() {
+		return errRateLimitReached
+	}
+	return nil
+}
+
+// Prune removes all topic limiters that have been fully replenished, i.e. that haven't been used in a while
+func (b *smtpBackend) Prune() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	replenishedAfter := time.Duration(b.config.SMTPServerTopicLimitBurst) * b.config.SMTPServerTopicLimitReplenish
+	for topic, l := range b.topicLimiters {
+		if time.Since(l.seen) > replenishedAfter {
+			delete(b.topicLimiters, topic)
+		}
+	}
 }
 
 func (b *smtpBackend) Counts() (success int64, failure int64) {
@@ -50,11 +206,40 @@ func (b *smtpBackend) Counts() (success int64, failure int64) {
 	return b.success, b.failure
 }
 
+// Metrics returns a snapshot of all counters, which are exposed via the metrics endpoint
+func (b *smtpBackend) Metrics() *smtpMetrics {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	errs := make(map[string]int64)
+	for reason, count := range b.errors {
+		errs[reason] = count
+	}
+	return &smtpMetrics{
+		Success:        b.success,
+		Failure:        b.failure,
+		Errors:         errs,
+		BytesReceived:  b.bytes,
+		ActiveSessions: b.sessions,
+	}
+}
+
 // smtpSession is returned after EHLO.
 type smtpSession struct {
-	backend *smtpBackend
-	topic   string
-	mu      sync.Mutex
+	backend    *smtpBackend
+	remoteIP   string
+	helo       string
+	from       string
+	recipients []*smtpRecipient
+	mu         sync.Mutex
+}
+
+// smtpRecipient is a single recipient of an e-mail, i.e. the topic and the optional address extensions
+type smtpRecipient struct {
+	address  string // As passed to RCPT TO, used for the per-recipient status in LMTP mode
+	topic    string
+	title    string   // From address extension (+title=...), overrides subject
+	priority int      // From address extension (+high, +urgent, ...), overrides priority headers
+	tags     []string // From address extension (+sometag)
 }
 
 func (s *smtpSession) AuthPlain(username, password string) error {
@@ -62,7 +247,20 @@ func (s *smtpSession) AuthPlain(username, password string) error {
 }
 
 func (s *smtpSession) Mail(from string, opts smtp.MailOptions) error {
-	return nil
+	return s.withFailCount(func() error {
+		if !s.backend.SenderAllowed(from) {
+			return errSenderNotAllowed
+		}
+		s.mu.Lock()
+		s.from = from
+		s.mu.Unlock()
+		if s.backend.visitor == nil || util.InStringList(s.backend.config.VisitorRequestExemptIPAddrs, s.remoteIP) {
+			return nil
+		} else if s.backend.visitor(s.remoteIP).RequestLimitReached() {
+			return errRateLimitReached // Reject early, before the client sends the (potentially large) message
+		}
+		return nil
+	})
 }
 
 func (s *smtpSession) Rcpt(to string) error {
@@ -74,122 +272,546 @@ func (s *smtpSession) Rcpt(to string) error {
 		} else if len(addressList) != 1 {
 			return errTooManyRecipients
 		}
-		to = addressList[0].Address
-		if !strings.HasSuffix(to, "@"+conf.SMTPServerDomain) {
-			return errInvalidDomain
+		s.mu.Lock()
+		recipients := len(s.recipients)
+		s.mu.Unlock()
+		if recipients >= conf.SMTPServerMaxRecipients {
+			return errTooManyRecipients
 		}
-		to = strings.TrimSuffix(to, "@"+conf.SMTPServerDomain)
-		if conf.SMTPServerAddrPrefix != "" {
-			if !strings.HasPrefix(to, conf.SMTPServerAddrPrefix) {
-				return errInvalidAddress
+		address, extensions := splitAddressExtensions(addressList[0].Address)
+		topic, err := s.backend.topicFromAddress(address)
+		if err != nil {
+			return err
+		}
+		title, priority, tags, err := parseAddressExtensions(extensions)
+		if err != nil {
+			return err
+		}
+		if s.backend.authorize != nil {
+			if err := s.backend.authorize(topic); err != nil {
+				return errUnauthorizedTopic
 			}
-			to = strings.TrimPrefix(to, conf.SMTPServerAddrPrefix)
 		}
-		if !topicRegex.MatchString(to) {
-			return errInvalidTopic
+		if err := s.backend.TopicAllowed(topic); err != nil {
+			return err
 		}
 		s.mu.Lock()
-		s.topic = to
+		s.recipients = append(s.recipients, &smtpRecipient{
+			address:  to,
+			topic:    topic,
+			title:    title,
+			priority: priority,
+			tags:     tags,
+		})
 		s.mu.Unlock()
 		return nil
 	})
 }
 
 func (s *smtpSession) Data(r io.Reader) error {
+	return s.data(r, nil)
+}
+
+// LMTPData is the LMTP version of Data. Other than in SMTP mode, a failure to publish to one of the recipient
+// topics does not fail the e-mail for all recipients, since the status is reported for each recipient.
+func (s *smtpSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	return s.data(r, status)
+}
+
+func (s *smtpSession) data(r io.Reader, status smtp.StatusCollector) error {
 	return s.withFailCount(func() error {
 		conf := s.backend.config
-		b, err := io.ReadAll(r) // Protected by MaxMessageBytes
-		if err != nil {
-			return err
+		limiter := util.NewFixedLimiter(smtpMaxMessageBytes(conf))
+		defer func() {
+			s.backend.mu.Lock()
+			s.backend.bytes += limiter.Value()
+			s.backend.mu.Unlock()
+		}()
+		var reader io.Reader = util.NewLimitReader(r, limiter)
+		var raw bytes.Buffer
+		verify := conf.SMTPServerVerifySender != SMTPServerVerifySenderOff
+		if verify {
+			reader = io.TeeReader(reader, &raw) // DKIM verification needs the raw message
 		}
-		msg, err := mail.ReadMessage(bytes.NewReader(b))
+		msg, err := mail.ReadMessage(reader)
 		if err != nil {
-			return err
+			return limitError(err)
 		}
-		body, err := readMailBody(msg)
+		body, attachment, err := readMailBody(msg, conf.AttachmentFileSizeLimit)
 		if err != nil {
-			return err
+			return limitError(err)
 		}
 		body = strings.TrimSpace(body)
+		var click string
+		if conf.SMTPServerClickURL != SMTPServerClickURLOff {
+			click, body = mailClickURL(body, conf.SMTPServerClickURL == SMTPServerClickURLStrip)
+		}
 		if len(body) > conf.MessageLimit {
 			body = body[:conf.MessageLimit]
 		}
-		m := newDefaultMessage(s.topic, body)
+		var title string
 		subject := strings.TrimSpace(msg.Header.Get("Subject"))
 		if subject != "" {
-			dec := mime.WordDecoder{}
-			subject, err := dec.DecodeHeader(subject)
+			title, err = mailWordDecoder.DecodeHeader(subject)
 			if err != nil {
 				return err
 			}
-			m.Title = subject
 		}
-		if m.Title != "" && m.Message == "" {
-			m.Message = m.Title // Flip them, this makes more sense
-			m.Title = ""
+		priority := mailPriority(msg.Header, conf.SMTPServerPriorityMapping)
+		group := mailThreadGroup(msg.Header)
+		var tags []string
+		if verify {
+			if _, err := io.Copy(io.Discard, reader); err != nil { // Read the rest of the message, e.g. the epilogue
+				return limitError(err)
+			}
 		}
-		if err := s.backend.sub(m); err != nil {
-			return err
+		if verify && !s.verifySender(raw.Bytes()) {
+			if conf.SMTPServerVerifySender == SMTPServerVerifySenderReject {
+				return errSenderVerification
+			} else if conf.SMTPServerVerifySender == SMTPServerVerifySenderTag {
+				priority = 0 // Unverified e-mails must not trigger urgent notifications
+				tags = []string{"warning", "unverified"}
+			}
+		}
+		s.mu.Lock()
+		recipients := s.recipients
+		s.mu.Unlock()
+		for _, rcpt := range recipients { // Same e-mail is published to each recipient topic
+			m := newDefaultMessage(rcpt.topic, body)
+			m.Title = title
+			m.Priority = priority
+			m.Click = click
+			m.Group = group
+			if rcpt.title != "" {
+				m.Title = rcpt.title
+			}
+			if rcpt.priority != 0 {
+				m.Priority = rcpt.priority
+			}
+			if len(rcpt.tags) > 0 {
+				m.Tags = rcpt.tags
+			}
+			if len(tags) > 0 {
+				m.Priority = priority
+				m.Tags = append(tags, m.Tags...)
+			}
+			if m.Title != "" && m.Message == "" {
+				m.Message = m.Title // Flip them, this makes more sense
+				m.Title = ""
+			}
+			err := s.backend.sub(s.remoteIP, m, attachment)
+			if err != nil && status == nil {
+				return err
+			} else if status != nil {
+				status.SetStatus(rcpt.address, err)
+			}
+			s.backend.mu.Lock()
+			if err != nil {
+				s.backend.failure++
+				s.backend.errors[smtpErrorReason(err)]++
+			} else {
+				s.backend.success++
+			}
+			s.backend.mu.Unlock()
 		}
-		s.backend.mu.Lock()
-		s.backend.success++
-		s.backend.mu.Unlock()
 		return nil
 	})
 }
 
 func (s *smtpSession) Reset() {
 	s.mu.Lock()
-	s.topic = ""
+	s.from = ""
+	s.recipients = nil
 	s.mu.Unlock()
 }
 
 func (s *smtpSession) Logout() error {
+	s.backend.mu.Lock()
+	s.backend.sessions--
+	s.backend.mu.Unlock()
 	return nil
 }
 
+// verifySender checks the SPF record of the sender domain and the DKIM signatures of the raw e-mail. It returns
+// false if either of the checks fails; e-mails without SPF record or DKIM signature are not considered failures.
+func (s *smtpSession) verifySender(raw []byte) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), smtpServerVerifyTimeout)
+	defer cancel()
+	s.mu.Lock()
+	from := s.from
+	s.mu.Unlock()
+	spf := checkSPF(ctx, s.backend.resolver, net.ParseIP(s.remoteIP), from, s.helo)
+	dkim, _ := verifyDKIM(ctx, s.backend.resolver, raw)
+	if spf == mailAuthFail || spf == mailAuthSoftFail || dkim == mailAuthFail {
+		log.Printf("[%s] SMTP sender verification failed for %s: spf=%s, dkim=%s", s.remoteIP, from, spf, dkim)
+		return false
+	}
+	return true
+}
+
 func (s *smtpSession) withFailCount(fn func() error) error {
 	err := fn()
 	s.backend.mu.Lock()
 	defer s.backend.mu.Unlock()
 	if err != nil {
 		s.backend.failure++
+		s.backend.errors[smtpErrorReason(err)]++
 	}
 	return err
 }
 
-func readMailBody(msg *mail.Message) (string, error) {
+// smtpErrorReason maps an error to a short reason, which is used as label in the metrics
+func smtpErrorReason(err error) string {
+	switch err {
+	case errRateLimitReached:
+		return "rate_limit"
+	case errInvalidDomain, errInvalidAddress, errInvalidTopic:
+		return "invalid_address"
+	case errTooManyRecipients:
+		return "too_many_recipients"
+	case errUnauthorizedTopic:
+		return "unauthorized"
+	case errSenderNotAllowed:
+		return "sender_not_allowed"
+	case errSenderVerification:
+		return "sender_verification"
+	case errUnsupportedContentType, errMultipartNestedTooDeep:
+		return "unsupported_content"
+	case smtp.ErrDataTooLarge, errAttachmentTooLarge:
+		return "too_large"
+	default:
+		return "other"
+	}
+}
+
+// smtpMaxMessageBytes returns the max size of an incoming e-mail. If attachments are enabled, an e-mail may
+// additionally contain a file attachment up to the attachment file size limit.
+func smtpMaxMessageBytes(conf *Config) int64 {
+	if conf.AttachmentCacheDir == "" && conf.AttachmentS3URL == "" {
+		return smtpServerMaxMessageBytes
+	}
+	return smtpServerMaxMessageBytes + conf.AttachmentFileSizeLimit*4/3 // Attachments are base64-encoded
+}
+
+// limitError maps util.ErrLimitReached (possibly wrapped, e.g. by the multipart reader) to the SMTP error
+// that the message is too large, and returns all other errors as is
+func limitError(err error) error {
+	if errors.Is(err, util.ErrLimitReached) {
+		return smtp.ErrDataTooLarge
+	}
+	return err
+}
+
+// remoteIP returns the IP address of the SMTP client, or an empty string if it is not known
+func remoteIP(state *smtp.ConnectionState) string {
+	if state == nil || state.RemoteAddr == nil {
+		return ""
+	}
+	ip, _, err := net.SplitHostPort(state.RemoteAddr.String())
+	if err != nil {
+		return state.RemoteAddr.String()
+	}
+	return ip
+}
+
+// splitAddressExtensions removes the "+"-separated extensions from the local part of an e-mail address, e.g.
+// ntfy-mytopic+urgent+backup@ntfy.sh is split into ntfy-mytopic@ntfy.sh and [urgent backup]
+func splitAddressExtensions(address string) (string, []string) {
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		at = len(address)
+	}
+	parts := strings.Split(address[:at], "+")
+	return parts[0] + address[at:], parts[1:]
+}
+
+// parseAddressExtensions parses the "+"-separated extensions of an e-mail address (plus-addressing), e.g.
+// ntfy-mytopic+urgent+warning+title=Backup@ntfy.sh. Extensions that are valid priorities set the priority,
+// "title=..." sets the title, and all others are treated as tags.
+func parseAddressExtensions(extensions []string) (title string, priority int, tags []string, err error) {
+	for _, ext := range extensions {
+		if ext == "" {
+			return "", 0, nil, errInvalidAddress
+		} else if strings.HasPrefix(strings.ToLower(ext), "title=") {
+			title = ext[len("title="):]
+		} else if p, err := util.ParsePriority(ext); err == nil {
+			priority = p
+		} else {
+			tags = append(tags, ext)
+		}
+	}
+	return
+}
+
+// mailPriority maps the priority headers of an e-mail to a message priority using the given mapping. The
+// "X-Priority" header often contains a description after the number (e.g. "1 (Highest)"), which is ignored.
+func mailPriority(header mail.Header, mapping map[string]int) int {
+	for _, name := range []string{"X-Priority", "Priority", "Importance"} {
+		fields := strings.Fields(strings.ToLower(header.Get(name)))
+		if len(fields) == 0 {
+			continue
+		}
+		if priority, ok := mapping[fields[0]]; ok {
+			return priority
+		}
+	}
+	return 0
+}
+
+// mailThreadGroup returns a message group for the e-mail thread, so that replies to (and follow-ups of) an
+// e-mail end up in the same group as the original e-mail. The thread is identified by the root message ID,
+// which is the first ID in the "References" header, or the "In-Reply-To" ID if there are no references. E-mails
+// that don't belong to a thread (yet) are grouped by their own "Message-ID".
+func mailThreadGroup(header mail.Header) string {
+	for _, name := range []string{"References", "In-Reply-To", "Message-ID"} {
+		if ids := mailMessageIDRegex.FindStringSubmatch(header.Get(name)); ids != nil {
+			group := strings.TrimSpace(ids[1])
+			if len(group) > groupMaxLength {
+				group = group[:groupMaxLength]
+			}
+			return group
+		}
+	}
+	return ""
+}
+
+// mailClickURL returns the first http(s) URL in the body of an e-mail (e.g. a "view incident" link), so it can be
+// used as click action. Trailing punctuation is not considered part of the URL. If strip is set, the URL is removed
+// from the returned body.
+func mailClickURL(body string, strip bool) (string, string) {
+	loc := mailURLRegex.FindStringIndex(body)
+	if loc == nil {
+		return "", body
+	}
+	click := strings.TrimRight(body[loc[0]:loc[1]], ".,;:!?)]}'")
+	if !strip {
+		return click, body
+	}
+	before, after := body[:loc[0]], body[loc[0]+len(click):]
+	if strings.HasSuffix(before, "<") && strings.HasPrefix(after, ">") {
+		before, after = before[:len(before)-1], after[1:] // Plain text e-mails often enclose URLs in <...>
+	}
+	before, after = strings.TrimRight(before, " \t"), strings.TrimLeft(after, " \t")
+	if strings.HasSuffix(before, "\n") || before == "" {
+		after = strings.TrimPrefix(after, "\n") // Remove the line if the URL was the only thing on it
+	} else if after != "" && !strings.HasPrefix(after, "\n") {
+		before += " "
+	}
+	return click, strings.TrimSpace(before + after)
+}
+
+// readMailBody reads the text body of the e-mail, preferring the plain text part over the HTML part (which is
+// converted to plain text). If the e-mail contains a file attachment, the first attachment is returned as well.
+func readMailBody(msg *mail.Message, attachmentLimit int64) (string, *mailAttachment, error) {
 	contentType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	if contentType == "text/plain" {
-		body, err := io.ReadAll(msg.Body)
+	if contentType == "text/plain" || contentType == "text/html" {
+		body, err := readMailText(msg.Body, textproto.MIMEHeader(msg.Header), params)
 		if err != nil {
-			return "", err
+			return "", nil, err
+		}
+		if contentType == "text/html" {
+			return htmlToText(body), nil, nil
 		}
-		return string(body), nil
+		return body, nil, nil
 	}
 	if strings.HasPrefix(contentType, "multipart/") {
-		mr := multipart.NewReader(msg.Body, params["boundary"])
-		for {
-			part, err := mr.NextPart()
-			if err != nil { // may be io.EOF
-				return "", err
+		parts := &mailParts{attachmentLimit: attachmentLimit}
+		if err := readMailMultipart(msg.Body, params["boundary"], parts, 0); err != nil {
+			return "", nil, err
+		}
+		if parts.plainFound {
+			return parts.plain, parts.attachment, nil
+		} else if parts.htmlFound { // Only use HTML if there is no plain text part
+			return htmlToText(parts.html), parts.attachment, nil
+		} else if parts.attachment != nil {
+			return "", parts.attachment, nil
+		}
+	}
+	return "", nil, errUnsupportedContentType
+}
+
+// mailParts collects the first plain text part, the first HTML part and the first attachment of a
+// (possibly nested) multipart e-mail
+type mailParts struct {
+	plain, html           string
+	plainFound, htmlFound bool
+	attachment            *mailAttachment
+	attachmentLimit       int64
+}
+
+// readMailMultipart reads all parts of a multipart body, and descends into nested multipart parts, e.g. a
+// multipart/alternative part inside of a multipart/mixed e-mail (common for e-mails with attachments)
+func readMailMultipart(r io.Reader, boundary string, parts *mailParts, depth int) error {
+	if depth >= smtpServerMaxMultipartDepth {
+		return errMultipartNestedTooDeep
+	}
+	mr := multipart.NewReader(r, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			return err
+		}
+		filename := mailPartFilename(part, params)
+		if strings.HasPrefix(contentType, "multipart/") && filename == "" {
+			if err := readMailMultipart(part, params["boundary"], parts, depth+1); err != nil {
+				return err
 			}
-			partContentType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
-			if err != nil {
-				return "", err
+		} else if filename != "" || (contentType != "text/plain" && contentType != "text/html") {
+			if parts.attachment != nil {
+				continue // Only one attachment per message is supported
 			}
-			if partContentType != "text/plain" {
-				continue
+			parts.attachment, err = readMailAttachment(part, contentType, filename, parts.attachmentLimit)
+			if err != nil {
+				return err
 			}
-			body, err := io.ReadAll(part)
+		} else {
+			body, err := readMailText(part, part.Header, params)
 			if err != nil {
-				return "", err
+				return err
+			}
+			if contentType == "text/plain" && !parts.plainFound {
+				parts.plain, parts.plainFound = body, true
+			} else if contentType == "text/html" && !parts.htmlFound {
+				parts.html, parts.htmlFound = body, true
 			}
-			return string(body), nil
 		}
 	}
-	return "", errUnsupportedContentType
+}
+
+// readMailText reads a text body or part, decodes its transfer encoding, and converts it from
+// the charset given in the Content-Type parameters to UTF-8. Line endings are normalized to "\n".
+func readMailText(r io.Reader, header textproto.MIMEHeader, contentTypeParams map[string]string) (string, error) {
+	reader := mailTransferDecoder(r, header)
+	if label := contentTypeParams["charset"]; label != "" {
+		var err error
+		reader, err = charset.NewReaderLabel(label, reader)
+		if err != nil {
+			return "", err
+		}
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(string(body), "\r\n", "\n"), nil
+}
+
+// mailTransferDecoder wraps the reader to decode the Content-Transfer-Encoding of a body or part. Note that
+// multipart.Reader already decodes quoted-printable parts and removes the header in that case.
+func mailTransferDecoder(r io.Reader, header textproto.MIMEHeader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &mailBase64Filter{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// mailBase64Filter strips line breaks and other whitespace from base64 content, since base64.NewDecoder
+// only ignores "\r" and "\n", and some mailers add trailing spaces
+type mailBase64Filter struct {
+	r io.Reader
+}
+
+func (f *mailBase64Filter) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	j := 0
+	for i := 0; i < n; i++ {
+		if p[i] != ' ' && p[i] != '\t' && p[i] != '\r' && p[i] != '\n' {
+			p[j] = p[i]
+			j++
+		}
+	}
+	return j, err
+}
+
+// readMailAttachment reads and decodes a file attachment from a multipart e-mail part. If the decoded
+// attachment is larger than the given limit, errAttachmentTooLarge is returned.
+func readMailAttachment(part *multipart.Part, contentType, filename string, limit int64) (*mailAttachment, error) {
+	body, err := io.ReadAll(util.NewLimitReader(mailTransferDecoder(part, part.Header), util.NewFixedLimiter(limit)))
+	if err == util.ErrLimitReached {
+		return nil, errAttachmentTooLarge
+	} else if err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		filename = "attachment"
+	}
+	return &mailAttachment{
+		Name: filename,
+		Type: contentType,
+		Body: body,
+	}, nil
+}
+
+// mailPartFilename returns the filename of a multipart part, either from the Content-Disposition
+// header or from the "name" parameter of the Content-Type header
+func mailPartFilename(part *multipart.Part, contentTypeParams map[string]string) string {
+	if filename := part.FileName(); filename != "" {
+		return filename
+	}
+	name, err := mailWordDecoder.DecodeHeader(contentTypeParams["name"])
+	if err != nil {
+		return contentTypeParams["name"]
+	}
+	return name
+}
+
+// htmlToText converts an HTML mail body to plain text. It drops all markup, as well as the contents of
+// non-visible elements (e.g. <style>), and inserts line breaks for block-level elements.
+func htmlToText(s string) string {
+	var b strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(s))
+	skip := 0
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			return collapseMailWhitespace(b.String())
+		case html.TextToken:
+			if skip == 0 {
+				b.WriteString(string(tokenizer.Text()))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			tag := atom.Lookup(name)
+			if tag == atom.Script || tag == atom.Style || tag == atom.Head || tag == atom.Title {
+				if tokenType == html.StartTagToken {
+					skip++
+				} else if tokenType == html.EndTagToken && skip > 0 {
+					skip--
+				}
+			} else if tag == atom.Br || tag == atom.P || tag == atom.Div || tag == atom.Tr || tag == atom.Li ||
+				tag == atom.H1 || tag == atom.H2 || tag == atom.H3 || tag == atom.H4 || tag == atom.H5 || tag == atom.H6 {
+				b.WriteString("\n")
+			} else if tag == atom.Td || tag == atom.Th {
+				b.WriteString(" ")
+			}
+		}
+	}
+}
+
+// collapseMailWhitespace trims all lines, collapses runs of spaces and removes duplicate empty lines
+func collapseMailWhitespace(s string) string {
+	lines := strings.Split(s, "\n")
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" && (len(out) == 0 || out[len(out)-1] == "") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
 }
@@ -3,8 +3,13 @@ package server
 import (
 	"github.com/emersion/go-smtp"
 	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"net"
+	"net/mail"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestSmtpBackend_Multipart(t *testing.T) {
@@ -27,7 +32,7 @@ Content-Type: text/html; charset="UTF-8"
 <div dir="ltr">what&#39;s up<br clear="all"><div><br></div></div>
 
 --000000000000f3320b05d42915c9--`
-	_, backend := newTestBackend(t, func(m *message) error {
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
 		require.Equal(t, "mytopic", m.Topic)
 		require.Equal(t, "and one more", m.Title)
 		require.Equal(t, "what's up", m.Message)
@@ -59,7 +64,7 @@ Content-Type: text/html; charset="UTF-8"
 <div dir="ltr"><br></div>
 
 --000000000000bcf4a405d429f8d4--`
-	_, backend := newTestBackend(t, func(m *message) error {
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
 		require.Equal(t, "emailtest", m.Topic)
 		require.Equal(t, "", m.Title) // We flipped message and body
 		require.Equal(t, "This email has a subject but no body", m.Message)
@@ -81,7 +86,7 @@ Content-Type: text/plain; charset="UTF-8"
 
 what's up
 `
-	conf, backend := newTestBackend(t, func(m *message) error {
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
 		require.Equal(t, "mytopic", m.Topic)
 		require.Equal(t, "and one more", m.Title)
 		require.Equal(t, "what's up", m.Message)
@@ -103,7 +108,7 @@ Content-Type: text/plain; charset="UTF-8"
 
 what's up
 `
-	_, backend := newTestBackend(t, func(m *message) error {
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
 		require.Equal(t, "Three santas 🎅🎅🎅", m.Title)
 		return nil
 	})
@@ -186,7 +191,7 @@ BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB
 BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB
 that should do it
 `
-	conf, backend := newTestBackend(t, func(m *message) error {
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
 		expected := `you know this is a string.
 it's a long string. 
 it's supposed to be longer than the max message length
@@ -270,7 +275,7 @@ Content-Type: text/SOMETHINGELSE
 
 what's up
 `
-	conf, backend := newTestBackend(t, func(m *message) error {
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
 		return nil
 	})
 	conf.SMTPServerAddrPrefix = ""
@@ -280,11 +285,759 @@ what's up
 	require.Equal(t, errUnsupportedContentType, session.Data(strings.NewReader(email)))
 }
 
-func newTestBackend(t *testing.T, sub subscriber) (*Config, *smtpBackend) {
+func TestSmtpBackend_HTMLEmail(t *testing.T) {
+	email := `Date: Tue, 28 Dec 2021 00:30:10 +0100
+Subject: Backup failed
+From: nas@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: text/html; charset="UTF-8"
+
+<html><head><title>Report</title><style>p { color: red; }</style></head>
+<body><h1>Backup   report</h1><p>Job <b>nightly</b> failed &amp; was aborted.</p>
+<table><tr><td>Disk</td><td>sda1</td></tr></table></body></html>
+`
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, "mytopic", m.Topic)
+		require.Equal(t, "Backup failed", m.Title)
+		require.Equal(t, "Backup report\n\nJob nightly failed & was aborted.\n\nDisk sda1", m.Message)
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("nas@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_MultipartHTMLOnly(t *testing.T) {
+	email := `MIME-Version: 1.0
+Subject: Router alert
+From: router@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: multipart/alternative; boundary="000000000000f3320b05d42915c9"
+
+--000000000000f3320b05d42915c9
+Content-Type: text/html; charset="UTF-8"
+
+<div dir="ltr">WAN link is down<br>since 10:00</div>
+
+--000000000000f3320b05d42915c9--`
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, "Router alert", m.Title)
+		require.Equal(t, "WAN link is down\nsince 10:00", m.Message)
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("router@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_MultipartAttachment(t *testing.T) {
+	email := `MIME-Version: 1.0
+Subject: Camera snapshot
+From: camera@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: multipart/mixed; boundary="XXXXboundary"
+
+--XXXXboundary
+Content-Type: text/plain; charset="UTF-8"
+
+Motion detected
+
+--XXXXboundary
+Content-Type: image/png; name="snapshot.png"
+Content-Disposition: attachment; filename="snapshot.png"
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==
+
+--XXXXboundary--`
+	_, backend := newTestBackend(t, func(_ string, m *message, a *mailAttachment) error {
+		require.Equal(t, "Camera snapshot", m.Title)
+		require.Equal(t, "Motion detected", m.Message)
+		require.NotNil(t, a)
+		require.Equal(t, "snapshot.png", a.Name)
+		require.Equal(t, "image/png", a.Type)
+		require.Equal(t, 70, len(a.Body))
+		require.Equal(t, "\x89PNG", string(a.Body[:4]))
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("camera@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_MultipartAttachmentTooLarge(t *testing.T) {
+	email := `MIME-Version: 1.0
+Subject: Camera snapshot
+From: camera@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: multipart/mixed; boundary="XXXXboundary"
+
+--XXXXboundary
+Content-Type: text/plain; charset="UTF-8"
+
+Motion detected
+
+--XXXXboundary
+Content-Type: image/png; name="snapshot.png"
+Content-Disposition: attachment; filename="snapshot.png"
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==
+
+--XXXXboundary--`
+	conf, backend := newTestBackend(t, func(_ string, m *message, a *mailAttachment) error {
+		t.Fatal("should not be called")
+		return nil
+	})
+	conf.AttachmentFileSizeLimit = 69
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("camera@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Equal(t, errAttachmentTooLarge, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_MessageTooLarge(t *testing.T) {
+	email := `Subject: Log file
+From: phil@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+` + strings.Repeat("log line\n", 120000)
+	conf, backend := newTestBackend(t, func(_ string, m *message, a *mailAttachment) error {
+		t.Fatal("should not be called")
+		return nil
+	})
+	conf.AttachmentCacheDir = ""
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("phil@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Equal(t, smtp.ErrDataTooLarge, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_MultipartNested(t *testing.T) {
+	email := `MIME-Version: 1.0
+Subject: Camera snapshot
+From: camera@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset="UTF-8"
+
+Motion detected
+
+--inner
+Content-Type: text/html; charset="UTF-8"
+
+<p>Motion <b>detected</b></p>
+
+--inner--
+
+--outer
+Content-Type: image/png; name="snapshot.png"
+Content-Disposition: attachment; filename="snapshot.png"
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg==
+
+--outer--`
+	_, backend := newTestBackend(t, func(_ string, m *message, a *mailAttachment) error {
+		require.Equal(t, "Camera snapshot", m.Title)
+		require.Equal(t, "Motion detected", m.Message)
+		require.NotNil(t, a)
+		require.Equal(t, "snapshot.png", a.Name)
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("camera@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_MultipartNestedHTMLOnly(t *testing.T) {
+	email := `MIME-Version: 1.0
+Subject: Weekly report
+From: reports@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/related; boundary="inner"
+
+--inner
+Content-Type: text/html; charset="UTF-8"
+
+<p>All systems <b>operational</b></p>
+
+--inner--
+
+--outer--`
+	_, backend := newTestBackend(t, func(_ string, m *message, a *mailAttachment) error {
+		require.Equal(t, "Weekly report", m.Title)
+		require.Equal(t, "All systems operational", m.Message)
+		require.Nil(t, a)
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("reports@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_MultipartAttachmentNoText(t *testing.T) {
+	email := `MIME-Version: 1.0
+Subject: Daily log
+From: server@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: multipart/mixed; boundary="XXXXboundary"
+
+--XXXXboundary
+Content-Type: text/plain; name="backup.log"
+Content-Disposition: attachment
+
+backup finished
+--XXXXboundary--`
+	_, backend := newTestBackend(t, func(_ string, m *message, a *mailAttachment) error {
+		require.Equal(t, "", m.Title)
+		require.Equal(t, "Daily log", m.Message)
+		require.NotNil(t, a)
+		require.Equal(t, "backup.log", a.Name)
+		require.Equal(t, "text/plain", a.Type)
+		require.Equal(t, "backup finished", string(a.Body))
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("server@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_QuotedPrintable(t *testing.T) {
+	email := `Subject: =?windows-1252?Q?Gr=FC=DFe?=
+From: phil@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: text/plain; charset="ISO-8859-1"
+Content-Transfer-Encoding: quoted-printable
+
+Sch=F6ne Gr=FC=DFe aus M=FCnchen, dies ist eine sehr lange Zeile, die umgebro=
+chen wurde
+`
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, "mytopic", m.Topic)
+		require.Equal(t, "Grüße", m.Title)
+		require.Equal(t, "Schöne Grüße aus München, dies ist eine sehr lange Zeile, die umgebrochen wurde", m.Message)
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("phil@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_MultipartBase64(t *testing.T) {
+	email := "Subject: Temperature alert\r\n" +
+		"From: sensor@example.com\r\n" +
+		"To: ntfy-mytopic@ntfy.sh\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"XXX\"\r\n" +
+		"\r\n" +
+		"--XXX\r\n" +
+		"Content-Type: text/plain; charset=\"ISO-8859-1\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"RGllIFRlbXBlcmF0dXIgaXN0IPxiZXIgMzCwQw0K\r\n" +
+		"Qml0dGUgcHL8ZmVu\r\n" +
+		"--XXX--\r\n"
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, "Temperature alert", m.Title)
+		require.Equal(t, "Die Temperatur ist über 30°C\nBitte prüfen", m.Message)
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("sensor@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_PriorityHeaders(t *testing.T) {
+	headers := []string{"X-Priority: 1 (Highest)", "X-Priority: 5", "Importance: high", "Importance: Low", "Priority: non-urgent", "X-Priority: 99", "X-Mailer: ntfy"}
+	expected := []int{5, 1, 5, 2, 2, 0, 0}
+	for i, header := range headers {
+		email := `Subject: Disk full
+From: nas@example.com
+To: ntfy-mytopic@ntfy.sh
+` + header + `
+Content-Type: text/plain; charset="UTF-8"
+
+disk is full
+`
+		_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+			require.Equal(t, expected[i], m.Priority, "header: %s", header)
+			return nil
+		})
+		session, _ := backend.AnonymousLogin(nil)
+		require.Nil(t, session.Mail("nas@example.com", smtp.MailOptions{}))
+		require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+		require.Nil(t, session.Data(strings.NewReader(email)))
+	}
+}
+
+func TestSmtpBackend_PriorityHeaders_CustomMapping(t *testing.T) {
+	email := `Subject: Disk full
+From: nas@example.com
+To: ntfy-mytopic@ntfy.sh
+X-Priority: 1
+Content-Type: text/plain; charset="UTF-8"
+
+disk is full
+`
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, 4, m.Priority)
+		return nil
+	})
+	conf.SMTPServerPriorityMapping = map[string]int{"1": 4}
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("nas@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_PlusAddressing(t *testing.T) {
+	email := `Subject: Disk full
+From: nas@example.com
+To: ntfy-mytopic+urgent+warning+disk@ntfy.sh
+X-Priority: 5
+Content-Type: text/plain; charset="UTF-8"
+
+disk is full
+`
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, "mytopic", m.Topic)
+		require.Equal(t, "Disk full", m.Title)
+		require.Equal(t, 5, m.Priority)
+		require.Equal(t, []string{"warning", "disk"}, m.Tags)
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("nas@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic+urgent+warning+disk@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_PlusAddressing_Title(t *testing.T) {
+	email := `Subject: [SYNO] Notification 123
+From: nas@example.com
+To: ntfy-mytopic+title=Backup+low@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+backup done
+`
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, "mytopic", m.Topic)
+		require.Equal(t, "Backup", m.Title)
+		require.Equal(t, 2, m.Priority)
+		require.Nil(t, m.Tags)
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("nas@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic+title=Backup+low@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_PlusAddressing_Invalid(t *testing.T) {
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("nas@example.com", smtp.MailOptions{}))
+	require.Equal(t, errInvalidAddress, session.Rcpt("ntfy-mytopic++urgent@ntfy.sh"))
+	require.Equal(t, errInvalidTopic, session.Rcpt("ntfy-my.topic+urgent@ntfy.sh"))
+}
+
+func TestSmtpBackend_TopicRules(t *testing.T) {
+	email := `Subject: Disk full
+From: monitoring@corp.example.com
+To: alerts-dc1@corp.example.com
+Content-Type: text/plain; charset="UTF-8"
+
+/var is 98% full
+`
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, "datacenter-dc1", m.Topic)
+		require.Equal(t, 5, m.Priority)
+		require.Equal(t, "Disk full", m.Title)
+		return nil
+	})
+	conf.SMTPServerTopicRules = []*SMTPServerTopicRule{
+		{Pattern: regexp.MustCompile(`^(?:alerts-(.+)@corp\.example\.com)$`), Topic: "datacenter-$1"},
+		{Pattern: regexp.MustCompile(`^(?:.+@invalid\.example\.com)$`), Topic: "invalid/topic"},
+	}
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("monitoring@corp.example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("alerts-dc1+urgent@corp.example.com"))
+	require.Equal(t, errInvalidDomain, session.Rcpt("backup@corp.example.com"))
+	require.Equal(t, errInvalidTopic, session.Rcpt("phil@invalid.example.com"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+
+	// Fallback to the default <prefix><topic>@<domain> scheme
+	session.Reset()
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+}
+
+func TestSmtpBackend_CheckAccess(t *testing.T) {
+	email := `Subject: Hi there
+From: phil@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+hello
+`
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, "mytopic", m.Topic)
+		return nil
+	})
+	backend.authorize = func(topic string) error {
+		if topic == "reserved" {
+			return auth.ErrUnauthorized
+		}
+		return nil
+	}
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("phil@example.com", smtp.MailOptions{}))
+	require.Equal(t, errUnauthorizedTopic, session.Rcpt("ntfy-reserved@ntfy.sh"))
+	require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+	success, failure := backend.Counts()
+	require.Equal(t, int64(1), success)
+	require.Equal(t, int64(1), failure)
+}
+
+func TestSmtpBackend_VerifySender_Reject(t *testing.T) {
+	email := `Subject: Server down
+From: alerts@example.com
+To: ntfy-mytopic+urgent@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+server is down
+`
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, "server is down", m.Message)
+		return nil
+	})
+	conf.SMTPServerVerifySender = SMTPServerVerifySenderReject
+	resolver := newTestResolver()
+	resolver.txt["example.com"] = []string{"v=spf1 ip4:1.2.3.4 -all"}
+	backend.resolver = resolver
+
+	session, _ := backend.AnonymousLogin(&smtp.ConnectionState{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("6.6.6.6"), Port: 1234}})
+	require.Nil(t, session.Mail("alerts@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic+urgent@ntfy.sh"))
+	require.Equal(t, errSenderVerification, session.Data(strings.NewReader(email)))
+
+	session, _ = backend.AnonymousLogin(&smtp.ConnectionState{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}})
+	require.Nil(t, session.Mail("alerts@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic+urgent@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_VerifySender_Tag(t *testing.T) {
+	email := `Subject: Server down
+From: alerts@example.com
+To: ntfy-mytopic+urgent+server@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+server is down
+`
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		require.Equal(t, 0, m.Priority)
+		require.Equal(t, []string{"warning", "unverified", "server"}, m.Tags)
+		return nil
+	})
+	conf.SMTPServerVerifySender = SMTPServerVerifySenderTag
+	resolver := newTestResolver()
+	resolver.txt["example.com"] = []string{"v=spf1 ip4:1.2.3.4 ~all"}
+	backend.resolver = resolver
+
+	session, _ := backend.AnonymousLogin(&smtp.ConnectionState{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("6.6.6.6"), Port: 1234}})
+	require.Nil(t, session.Mail("alerts@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-mytopic+urgent+server@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+}
+
+func TestSmtpBackend_RateLimitPerSender(t *testing.T) {
+	email := `Subject: Spam
+From: spammer@example.com
+To: ntfy-mytopic@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+spam spam spam
+`
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		return nil
+	})
+	conf.VisitorRequestLimitBurst = 2
+	state := &smtp.ConnectionState{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}}
+	session, _ := backend.AnonymousLogin(state)
+	for i := 0; i < 2; i++ {
+		require.Nil(t, session.Mail("spammer@example.com", smtp.MailOptions{}))
+		require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+		require.Nil(t, session.Data(strings.NewReader(email)))
+		backend.visitor("1.2.3.4").RequestAllowed() // This is what the HTTP handler does
+		session.Reset()
+	}
+	require.Equal(t, errRateLimitReached, session.Mail("spammer@example.com", smtp.MailOptions{}))
+
+	// Other senders are not affected
+	otherState := &smtp.ConnectionState{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 1234}}
+	otherSession, _ := backend.AnonymousLogin(otherState)
+	require.Nil(t, otherSession.Mail("someone@example.com", smtp.MailOptions{}))
+
+	// Exempt senders are not limited
+	conf.VisitorRequestExemptIPAddrs = []string{"1.2.3.4"}
+	require.Nil(t, session.Mail("spammer@example.com", smtp.MailOptions{}))
+}
+
+func TestSmtpBackend_RateLimitPerTopic(t *testing.T) {
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		return nil
+	})
+	conf.SMTPServerTopicLimitBurst = 3
+	for i := 0; i < 3; i++ {
+		session, _ := backend.AnonymousLogin(&smtp.ConnectionState{RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 1, 1, byte(i))}})
+		require.Nil(t, session.Mail("someone@example.com", smtp.MailOptions{}))
+		require.Nil(t, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	}
+	session, _ := backend.AnonymousLogin(&smtp.ConnectionState{RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 1, 1, 100)}})
+	require.Nil(t, session.Mail("someone@example.com", smtp.MailOptions{}))
+	require.Equal(t, errRateLimitReached, session.Rcpt("ntfy-mytopic@ntfy.sh"))
+	require.Nil(t, session.Rcpt("ntfy-othertopic@ntfy.sh"))
+
+	// Limiters are only pruned once they are fully replenished
+	backend.Prune()
+	require.Equal(t, 2, len(backend.topicLimiters))
+	backend.topicLimiters["mytopic"].seen = time.Now().Add(-time.Hour)
+	backend.Prune()
+	require.Equal(t, 1, len(backend.topicLimiters))
+}
+
+func TestSmtpBackend_MultipleRecipients(t *testing.T) {
+	email := `Subject: UPS on battery
+From: ups@example.com
+To: ntfy-alerts@ntfy.sh, ntfy-power+urgent@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+power outage
+`
+	topics := make([]string, 0)
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		topics = append(topics, m.Topic)
+		require.Equal(t, "UPS on battery", m.Title)
+		require.Equal(t, "power outage", m.Message)
+		if m.Topic == "power" {
+			require.Equal(t, 5, m.Priority)
+		} else {
+			require.Equal(t, 0, m.Priority)
+		}
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("ups@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-alerts@ntfy.sh"))
+	require.Nil(t, session.Rcpt("ntfy-power+urgent@ntfy.sh"))
+	require.Nil(t, session.Data(strings.NewReader(email)))
+	require.Equal(t, []string{"alerts", "power"}, topics)
+	success, failure := backend.Counts()
+	require.Equal(t, int64(2), success)
+	require.Equal(t, int64(0), failure)
+}
+
+func TestSmtpBackend_MultipleRecipients_TooMany(t *testing.T) {
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		return nil
+	})
+	conf.SMTPServerMaxRecipients = 2
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("ups@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-topic1@ntfy.sh"))
+	require.Nil(t, session.Rcpt("ntfy-topic2@ntfy.sh"))
+	require.Equal(t, errTooManyRecipients, session.Rcpt("ntfy-topic3@ntfy.sh"))
+	session.Reset()
+	require.Nil(t, session.Rcpt("ntfy-topic3@ntfy.sh"))
+}
+
+func TestSmtpBackend_ThreadGroup(t *testing.T) {
+	original := `Subject: Disk full on backup01
+Message-ID: <alert-1234@monitoring.example.com>
+From: monitoring@example.com
+To: ntfy-alerts@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+/var is 98% full
+`
+	followUp := `Subject: Re: Disk full on backup01
+Message-ID: <alert-1240@monitoring.example.com>
+In-Reply-To: <alert-1235@monitoring.example.com>
+References: <alert-1234@monitoring.example.com>
+ <alert-1235@monitoring.example.com>
+From: monitoring@example.com
+To: ntfy-alerts@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+/var is 99% full
+`
+	groups := make([]string, 0)
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		groups = append(groups, m.Group)
+		return nil
+	})
+	for _, email := range []string{original, followUp} {
+		session, _ := backend.AnonymousLogin(nil)
+		require.Nil(t, session.Mail("monitoring@example.com", smtp.MailOptions{}))
+		require.Nil(t, session.Rcpt("ntfy-alerts@ntfy.sh"))
+		require.Nil(t, session.Data(strings.NewReader(email)))
+	}
+	require.Equal(t, []string{"alert-1234@monitoring.example.com", "alert-1234@monitoring.example.com"}, groups)
+}
+
+func TestMailThreadGroup(t *testing.T) {
+	require.Equal(t, "", mailThreadGroup(mail.Header{}))
+	require.Equal(t, "a@b", mailThreadGroup(mail.Header{"Message-Id": []string{"<a@b>"}}))
+	require.Equal(t, "c@d", mailThreadGroup(mail.Header{"Message-Id": []string{"<a@b>"}, "In-Reply-To": []string{"<c@d>"}}))
+	require.Equal(t, "e@f", mailThreadGroup(mail.Header{"In-Reply-To": []string{"<c@d>"}, "References": []string{"<e@f> <c@d>"}}))
+	require.Equal(t, "", mailThreadGroup(mail.Header{"Message-Id": []string{"not-an-id"}}))
+	require.Equal(t, groupMaxLength, len(mailThreadGroup(mail.Header{"Message-Id": []string{"<" + strings.Repeat("x", 300) + "@b>"}})))
+}
+
+func TestSmtpBackend_ClickURL(t *testing.T) {
+	email := `Subject: Incident #1234 opened
+From: alerts@example.com
+To: ntfy-alerts@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+Database replication lag above threshold.
+View incident: https://status.example.com/incidents/1234.
+Runbook: https://wiki.example.com/runbooks/db
+`
+	var click, msg string
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		click, msg = m.Click, m.Message
+		return nil
+	})
+	for _, mode := range []string{SMTPServerClickURLOff, SMTPServerClickURLKeep, SMTPServerClickURLStrip} {
+		conf.SMTPServerClickURL = mode
+		session, _ := backend.AnonymousLogin(nil)
+		require.Nil(t, session.Mail("alerts@example.com", smtp.MailOptions{}))
+		require.Nil(t, session.Rcpt("ntfy-alerts@ntfy.sh"))
+		require.Nil(t, session.Data(strings.NewReader(email)))
+		if mode == SMTPServerClickURLOff {
+			require.Equal(t, "", click)
+		} else {
+			require.Equal(t, "https://status.example.com/incidents/1234", click)
+		}
+		if mode == SMTPServerClickURLStrip {
+			require.Equal(t, "Database replication lag above threshold.\nView incident: .\nRunbook: https://wiki.example.com/runbooks/db", msg)
+		} else {
+			require.Equal(t, "Database replication lag above threshold.\nView incident: https://status.example.com/incidents/1234.\nRunbook: https://wiki.example.com/runbooks/db", msg)
+		}
+	}
+}
+
+func TestMailClickURL(t *testing.T) {
+	click, body := mailClickURL("no links here", true)
+	require.Equal(t, "", click)
+	require.Equal(t, "no links here", body)
+
+	click, body = mailClickURL("Details (see HTTPS://example.com/a?b=c&d=e) below", false)
+	require.Equal(t, "HTTPS://example.com/a?b=c&d=e", click)
+	require.Equal(t, "Details (see HTTPS://example.com/a?b=c&d=e) below", body)
+
+	click, body = mailClickURL("Backup failed\nhttps://backup.example.com/jobs/17\nRetrying in 1h", true)
+	require.Equal(t, "https://backup.example.com/jobs/17", click)
+	require.Equal(t, "Backup failed\nRetrying in 1h", body)
+
+	click, body = mailClickURL("Open https://example.com/x to acknowledge", true)
+	require.Equal(t, "https://example.com/x", click)
+	require.Equal(t, "Open to acknowledge", body)
+
+	click, body = mailClickURL("ftp://example.com/file and <http://example.com/y>", true)
+	require.Equal(t, "http://example.com/y", click)
+	require.Equal(t, "ftp://example.com/file and", body)
+}
+
+func TestSmtpBackend_LMTPData_StatusPerRecipient(t *testing.T) {
+	email := `Subject: UPS on battery
+From: ups@example.com
+To: ntfy-alerts@ntfy.sh, ntfy-power@ntfy.sh
+Content-Type: text/plain; charset="UTF-8"
+
+power outage
+`
+	topics := make([]string, 0)
+	_, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		if m.Topic == "alerts" {
+			return errRateLimitReached
+		}
+		topics = append(topics, m.Topic)
+		return nil
+	})
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("ups@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Rcpt("ntfy-alerts@ntfy.sh"))
+	require.Nil(t, session.Rcpt("<ntfy-power@ntfy.sh>"))
+	status := &testStatusCollector{statuses: make(map[string]error)}
+	require.Nil(t, session.(smtp.LMTPSession).LMTPData(strings.NewReader(email), status))
+	require.Equal(t, []string{"power"}, topics)
+	require.Equal(t, map[string]error{"ntfy-alerts@ntfy.sh": errRateLimitReached, "<ntfy-power@ntfy.sh>": nil}, status.statuses)
+	success, failure := backend.Counts()
+	require.Equal(t, int64(1), success)
+	require.Equal(t, int64(1), failure)
+}
+
+type testStatusCollector struct {
+	statuses map[string]error
+}
+
+func (c *testStatusCollector) SetStatus(rcptTo string, err error) {
+	c.statuses[rcptTo] = err
+}
+
+func TestSmtpBackend_AllowedAndDeniedSenders(t *testing.T) {
+	conf, backend := newTestBackend(t, func(_ string, m *message, _ *mailAttachment) error {
+		return nil
+	})
+	conf.SMTPServerAllowedSenders = []*regexp.Regexp{regexp.MustCompile(`(?i)^(?:.*@example\.com)$`)}
+	conf.SMTPServerDeniedSenders = []*regexp.Regexp{regexp.MustCompile(`(?i)^(?:spam@example\.com)$`)}
+	session, _ := backend.AnonymousLogin(nil)
+	require.Nil(t, session.Mail("alerts@example.com", smtp.MailOptions{}))
+	require.Nil(t, session.Mail("Backup@EXAMPLE.com", smtp.MailOptions{}))
+	require.Equal(t, errSenderNotAllowed, session.Mail("spam@example.com", smtp.MailOptions{}))
+	require.Equal(t, errSenderNotAllowed, session.Mail("phil@example.org", smtp.MailOptions{}))
+	require.Equal(t, errSenderNotAllowed, session.Mail("", smtp.MailOptions{}))
+
+	conf.SMTPServerAllowedSenders = nil
+	require.Nil(t, session.Mail("phil@example.org", smtp.MailOptions{}))
+	require.Equal(t, errSenderNotAllowed, session.Mail("spam@example.com", smtp.MailOptions{}))
+	require.Equal(t, int64(4), backend.Metrics().Errors["sender_not_allowed"])
+}
+
+func newTestBackend(t *testing.T, sub mailPublisher) (*Config, *smtpBackend) {
 	conf := newTestConfig(t)
 	conf.SMTPServerListen = ":25"
 	conf.SMTPServerDomain = "ntfy.sh"
 	conf.SMTPServerAddrPrefix = "ntfy-"
-	backend := newMailBackend(conf, sub)
+	visitors := make(map[string]*visitor)
+	visitorFn := func(ip string) *visitor {
+		if _, ok := visitors[ip]; !ok {
+			visitors[ip] = newVisitor(conf, nil, ip)
+		}
+		return visitors[ip]
+	}
+	backend := newMailBackend(conf, visitorFn, nil, sub)
 	return conf, backend
 }
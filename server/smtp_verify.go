@@ -0,0 +1,710 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"heckel.io/ntfy/util"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file implements a basic sender verification for incoming e-mails, namely an SPF check (RFC 7208)
+// of the connecting IP address, and DKIM signature validation (RFC 6376, RFC 8463).
+
+const (
+	spfMaxDNSLookups     = 10 // As per RFC 7208, section 4.6.4
+	dkimMaxSignatures    = 5
+	spfMaxMXHosts        = 10
+	dkimDefaultCanonical = "simple"
+)
+
+// SPF and DKIM verification results
+const (
+	mailAuthPass      = "pass"
+	mailAuthFail      = "fail"
+	mailAuthSoftFail  = "softfail"
+	mailAuthNeutral   = "neutral"
+	mailAuthNone      = "none"
+	mailAuthTempError = "temperror"
+	mailAuthPermError = "permerror"
+)
+
+var (
+	errSPFTooManyLookups   = errors.New("too many DNS lookups")
+	errSPFInvalidRecord    = errors.New("invalid SPF record")
+	errSPFInvalidMacro     = errors.New("invalid SPF macro")
+	errDKIMInvalidHeader   = errors.New("invalid DKIM-Signature header")
+	errDKIMInvalidKey      = errors.New("invalid DKIM public key")
+	errDKIMBodyHash        = errors.New("body hash does not match")
+	errDKIMRevokedKey      = errors.New("DKIM key revoked")
+	dkimSignatureTagRegex  = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+	spfMacroTransformRegex = regexp.MustCompile(`^([slodiphcrtv])(\d*)(r?)([.\-+,/_=]*)$`)
+)
+
+// mailResolver is the subset of net.Resolver used for sender verification
+type mailResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// spfChecker evaluates the SPF record of a domain for the given sender, see RFC 7208
+type spfChecker struct {
+	resolver mailResolver
+	ip       net.IP
+	sender   string // MAIL FROM address, or postmaster@<helo> if empty
+	helo     string
+	lookups  int
+}
+
+// checkSPF returns the SPF result for the connecting IP address, the MAIL FROM address and HELO name. If
+// the MAIL FROM address is empty (e.g. for bounces), the HELO name is checked instead.
+func checkSPF(ctx context.Context, resolver mailResolver, ip net.IP, from, helo string) string {
+	sender := from
+	if sender == "" {
+		sender = "postmaster@" + helo
+	} else if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + sender
+	}
+	domain := sender[strings.LastIndex(sender, "@")+1:]
+	if ip == nil || domain == "" {
+		return mailAuthNone
+	}
+	c := &spfChecker{
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+	result, _ := c.check(ctx, domain)
+	return result
+}
+
+func (c *spfChecker) check(ctx context.Context, domain string) (string, error) {
+	record, err := c.record(ctx, domain)
+	if isDNSNotFound(err) || (err == nil && record == "") {
+		return mailAuthNone, nil
+	} else if err != nil {
+		return spfErrorResult(err), err
+	}
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if i := strings.IndexAny(term, "=:/"); i > 0 && term[i] == '=' {
+			if strings.ToLower(term[:i]) == "redirect" {
+				redirect = term[i+1:]
+			}
+			continue // Other modifiers (e.g. "exp") are ignored
+		}
+		qualifier := mailAuthPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = mailAuthFail, term[1:]
+		case '~':
+			qualifier, term = mailAuthSoftFail, term[1:]
+		case '?':
+			qualifier, term = mailAuthNeutral, term[1:]
+		}
+		match, err := c.matches(ctx, domain, term)
+		if err != nil {
+			return spfErrorResult(err), err
+		} else if match {
+			return qualifier, nil
+		}
+	}
+	if redirect != "" {
+		if err := c.countLookup(); err != nil {
+			return mailAuthPermError, err
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return mailAuthPermError, err
+		}
+		result, err := c.check(ctx, target)
+		if result == mailAuthNone {
+			return mailAuthPermError, errSPFInvalidRecord
+		}
+		return result, err
+	}
+	return mailAuthNeutral, nil
+}
+
+// record returns the SPF record of the domain, or an empty string if there is none
+func (c *spfChecker) record(ctx context.Context, domain string) (string, error) {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	var record string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			if record != "" {
+				return "", errSPFInvalidRecord // Multiple records are not allowed
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+// matches evaluates a single mechanism. DNS errors (other than non-existing domains) and errors in
+// nested includes are returned as error.
+func (c *spfChecker) matches(ctx context.Context, domain, mechanism string) (bool, error) {
+	name, arg := mechanism, ""
+	if i := strings.IndexAny(mechanism, ":/"); i != -1 {
+		name, arg = mechanism[:i], mechanism[i:]
+	}
+	switch strings.ToLower(name) {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFInvalidRecord
+		}
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if strings.ToLower(name) == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, errSPFInvalidRecord
+		}
+		return ipNet.Contains(c.ip), nil
+	case "a", "mx":
+		target, cidr4, cidr6, err := c.targetAndCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.ToLower(name) == "mx" {
+			mxs, err := c.resolver.LookupMX(ctx, target)
+			if isDNSNotFound(err) {
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+			hosts = hosts[:0]
+			for i := 0; i < len(mxs) && i < spfMaxMXHosts; i++ {
+				hosts = append(hosts, mxs[i].Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := c.resolver.LookupIPAddr(ctx, host)
+			if isDNSNotFound(err) {
+				continue
+			} else if err != nil {
+				return false, err
+			}
+			for _, addr := range addrs {
+				bits, ones := 128, cidr6
+				if addr.IP.To4() != nil {
+					bits, ones = 32, cidr4
+				}
+				ipNet := &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(ones, bits)}
+				if (addr.IP.To4() != nil) == (c.ip.To4() != nil) && ipNet.Contains(c.ip) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "include", "exists":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errSPFInvalidRecord
+		}
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(arg[1:], domain)
+		if err != nil {
+			return false, err
+		}
+		if strings.ToLower(name) == "exists" {
+			addrs, err := c.resolver.LookupIPAddr(ctx, target)
+			if isDNSNotFound(err) {
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+			return len(addrs) > 0, nil
+		}
+		result, err := c.check(ctx, target)
+		switch result {
+		case mailAuthPass:
+			return true, nil
+		case mailAuthFail, mailAuthSoftFail, mailAuthNeutral:
+			return false, nil
+		case mailAuthTempError:
+			return false, err
+		default:
+			return false, errSPFInvalidRecord // An include without SPF record is a permerror
+		}
+	case "ptr":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		return false, nil // Deprecated, see RFC 7208, section 5.5; treated as no match
+	default:
+		return false, errSPFInvalidRecord
+	}
+}
+
+// targetAndCIDR parses the arguments of the "a" and "mx" mechanisms, e.g. ":example.com/24//64"
+func (c *spfChecker) targetAndCIDR(arg, domain string) (target string, cidr4 int, cidr6 int, err error) {
+	target, cidr4, cidr6 = domain, 32, 128
+	if i := strings.Index(arg, "//"); i != -1 {
+		if cidr6, err = strconv.Atoi(arg[i+2:]); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, errSPFInvalidRecord
+		}
+		arg = arg[:i]
+	}
+	if i := strings.Index(arg, "/"); i != -1 {
+		if cidr4, err = strconv.Atoi(arg[i+1:]); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, errSPFInvalidRecord
+		}
+		arg = arg[:i]
+	}
+	if strings.HasPrefix(arg, ":") {
+		if target, err = c.expand(arg[1:], domain); err != nil {
+			return "", 0, 0, err
+		}
+	} else if arg != "" {
+		return "", 0, 0, errSPFInvalidRecord
+	}
+	return target, cidr4, cidr6, nil
+}
+
+// spfErrorResult maps an error to "temperror" for temporary DNS errors, and "permerror" otherwise
+func spfErrorResult(err error) string {
+	if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.IsNotFound {
+		return mailAuthTempError
+	}
+	return mailAuthPermError
+}
+
+func isDNSNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func (c *spfChecker) countLookup() error {
+	c.lookups++
+	if c.lookups > spfMaxDNSLookups {
+		return errSPFTooManyLookups
+	}
+	return nil
+}
+
+// expand expands the macros in a domain spec, e.g. "%{ir}.%{v}._spf.%{d}", see RFC 7208, section 7
+func (c *spfChecker) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		} else if i+1 >= len(spec) {
+			return "", errSPFInvalidMacro
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end == -1 {
+				return "", errSPFInvalidMacro
+			}
+			value, err := c.expandMacro(strings.ToLower(spec[i+1:i+end]), domain)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", errSPFInvalidMacro
+		}
+	}
+	return b.String(), nil
+}
+
+func (c *spfChecker) expandMacro(macro, domain string) (string, error) {
+	matches := spfMacroTransformRegex.FindStringSubmatch(macro)
+	if matches == nil {
+		return "", errSPFInvalidMacro
+	}
+	var value string
+	at := strings.LastIndex(c.sender, "@")
+	switch matches[1] {
+	case "s":
+		value = c.sender
+	case "l":
+		value = c.sender[:at]
+	case "o":
+		value = c.sender[at+1:]
+	case "d":
+		value = domain
+	case "h":
+		value = c.helo
+	case "v":
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case "i":
+		if ip4 := c.ip.To4(); ip4 != nil {
+			value = ip4.String()
+		} else {
+			nibbles := make([]string, 0, 32)
+			for _, b := range c.ip.To16() {
+				nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+			}
+			value = strings.Join(nibbles, ".")
+		}
+	default:
+		return "", errSPFInvalidMacro // "p", "c", "r" and "t" are not supported
+	}
+	delimiters := matches[4]
+	if delimiters == "" {
+		delimiters = "."
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if matches[3] == "r" {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if matches[2] != "" {
+		n, err := strconv.Atoi(matches[2])
+		if err != nil || n == 0 {
+			return "", errSPFInvalidMacro
+		} else if n < len(parts) {
+			parts = parts[len(parts)-n:]
+		}
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// dkimSignature is a parsed DKIM-Signature header
+type dkimSignature struct {
+	raw              string // Entire header field, incl. name
+	algorithm        string
+	hash             crypto.Hash
+	signature        []byte
+	bodyHash         []byte
+	domain           string
+	selector         string
+	headers          []string
+	headerCanonical  string
+	bodyCanonical    string
+	bodyLength       int64
+	bodyLengthExists bool
+}
+
+// mailHeaderField is a raw header field of an e-mail, including the name and all folded lines
+type mailHeaderField struct {
+	name string
+	raw  string
+}
+
+// verifyDKIM verifies the DKIM signatures of the raw e-mail. It returns "pass" and the signing domain if at
+// least one signature is valid, "none" if the e-mail is not signed, and "fail" (or "temperror") otherwise.
+func verifyDKIM(ctx context.Context, resolver mailResolver, raw []byte) (result string, domain string) {
+	headers, body := splitMailHeaderBody(raw)
+	result = mailAuthNone
+	signatures := 0
+	for _, field := range headers {
+		if !strings.EqualFold(field.name, "DKIM-Signature") {
+			continue
+		} else if signatures++; signatures > dkimMaxSignatures {
+			break
+		}
+		sig, err := parseDKIMSignature(field.raw)
+		if err != nil {
+			result = mailAuthFail
+			continue
+		}
+		if err := sig.verify(ctx, resolver, headers, body); err != nil {
+			if spfErrorResult(err) == mailAuthTempError && result != mailAuthFail {
+				result = mailAuthTempError
+			} else {
+				result = mailAuthFail
+			}
+			continue
+		}
+		return mailAuthPass, sig.domain
+	}
+	return result, ""
+}
+
+// splitMailHeaderBody splits a raw e-mail into header fields and body. Line endings are normalized to CRLF,
+// since the canonicalization algorithms rely on them.
+func splitMailHeaderBody(raw []byte) ([]*mailHeaderField, []byte) {
+	raw = bytes.ReplaceAll(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	var header, body []byte
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i != -1 {
+		header, body = raw[:i+2], raw[i+4:]
+	} else {
+		header = raw
+	}
+	fields := make([]*mailHeaderField, 0)
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		} else if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line // Folded line
+			continue
+		}
+		name := line
+		if i := strings.IndexByte(line, ':'); i != -1 {
+			name = line[:i]
+		}
+		fields = append(fields, &mailHeaderField{name: strings.TrimSpace(name), raw: line})
+	}
+	return fields, body
+}
+
+func parseDKIMSignature(raw string) (*dkimSignature, error) {
+	value := raw[strings.IndexByte(raw, ':')+1:]
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		k, v := splitDKIMTag(tag)
+		if k != "" {
+			tags[k] = v
+		}
+	}
+	sig := &dkimSignature{
+		raw:             raw,
+		algorithm:       strings.ToLower(tags["a"]),
+		domain:          strings.ToLower(tags["d"]),
+		selector:        tags["s"],
+		headerCanonical: dkimDefaultCanonical,
+		bodyCanonical:   dkimDefaultCanonical,
+	}
+	if tags["v"] != "1" || sig.domain == "" || sig.selector == "" || tags["h"] == "" {
+		return nil, errDKIMInvalidHeader
+	}
+	switch sig.algorithm {
+	case "rsa-sha256", "ed25519-sha256":
+		sig.hash = crypto.SHA256
+	case "rsa-sha1":
+		sig.hash = crypto.SHA1
+	default:
+		return nil, errDKIMInvalidHeader
+	}
+	var err error
+	if sig.signature, err = base64.StdEncoding.DecodeString(tags["b"]); err != nil || len(sig.signature) == 0 {
+		return nil, errDKIMInvalidHeader
+	}
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(tags["bh"]); err != nil || len(sig.bodyHash) == 0 {
+		return nil, errDKIMInvalidHeader
+	}
+	for _, h := range strings.Split(tags["h"], ":") {
+		sig.headers = append(sig.headers, strings.ToLower(strings.TrimSpace(h)))
+	}
+	if !util.InStringList(sig.headers, "from") {
+		return nil, errDKIMInvalidHeader
+	}
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		sig.headerCanonical = parts[0]
+		if len(parts) == 2 {
+			sig.bodyCanonical = parts[1]
+		}
+		for _, canonical := range []string{sig.headerCanonical, sig.bodyCanonical} {
+			if canonical != "simple" && canonical != "relaxed" {
+				return nil, errDKIMInvalidHeader
+			}
+		}
+	}
+	if l, ok := tags["l"]; ok {
+		if sig.bodyLength, err = strconv.ParseInt(l, 10, 64); err != nil || sig.bodyLength < 0 {
+			return nil, errDKIMInvalidHeader
+		}
+		sig.bodyLengthExists = true
+	}
+	return sig, nil
+}
+
+// splitDKIMTag splits a tag=value pair, and removes all whitespace from the value (as required for
+// base64 values that may be folded across multiple lines)
+func splitDKIMTag(tag string) (string, string) {
+	kv := strings.SplitN(tag, "=", 2)
+	if len(kv) != 2 {
+		return "", ""
+	}
+	return strings.TrimSpace(kv[0]), strings.Join(strings.Fields(kv[1]), "")
+}
+
+func (sig *dkimSignature) verify(ctx context.Context, resolver mailResolver, headers []*mailHeaderField, body []byte) error {
+	canonicalBody := dkimCanonicalizeBody(body, sig.bodyCanonical)
+	if sig.bodyLengthExists && sig.bodyLength < int64(len(canonicalBody)) {
+		canonicalBody = canonicalBody[:sig.bodyLength]
+	}
+	h := sig.newHash()
+	h.Write(canonicalBody)
+	if !bytes.Equal(h.Sum(nil), sig.bodyHash) {
+		return errDKIMBodyHash
+	}
+	h = sig.newHash()
+	used := make(map[string]int)
+	for _, name := range sig.headers {
+		// Header fields are selected from the bottom up; non-existing fields are treated as empty
+		seen := 0
+		for i := len(headers) - 1; i >= 0; i-- {
+			if strings.ToLower(headers[i].name) != name {
+				continue
+			} else if seen++; seen > used[name] {
+				h.Write([]byte(dkimCanonicalizeHeader(headers[i].raw, sig.headerCanonical)))
+				break
+			}
+		}
+		used[name]++
+	}
+	colon := strings.IndexByte(sig.raw, ':')
+	unsigned := sig.raw[:colon+1] + dkimSignatureTagRegex.ReplaceAllString(sig.raw[colon+1:], "$1$2")
+	h.Write([]byte(strings.TrimSuffix(dkimCanonicalizeHeader(unsigned, sig.headerCanonical), "\r\n")))
+	hashed := h.Sum(nil)
+	key, err := lookupDKIMKey(ctx, resolver, sig.selector, sig.domain)
+	if err != nil {
+		return err
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(sig.algorithm, "rsa-") {
+			return errDKIMInvalidKey
+		}
+		return rsa.VerifyPKCS1v15(k, sig.hash, hashed, sig.signature)
+	case ed25519.PublicKey:
+		if sig.algorithm != "ed25519-sha256" || !ed25519.Verify(k, hashed, sig.signature) {
+			return errDKIMInvalidKey
+		}
+		return nil
+	default:
+		return errDKIMInvalidKey
+	}
+}
+
+func (sig *dkimSignature) newHash() hash.Hash {
+	if sig.hash == crypto.SHA1 {
+		return sha1.New()
+	}
+	return sha256.New()
+}
+
+// lookupDKIMKey retrieves the public key from the <selector>._domainkey.<domain> TXT record
+func lookupDKIMKey(ctx context.Context, resolver mailResolver, selector, domain string) (crypto.PublicKey, error) {
+	txts, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, err
+	} else if len(txts) == 0 {
+		return nil, errDKIMInvalidKey
+	}
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(strings.Join(txts, ""), ";") {
+		k, v := splitDKIMTag(tag)
+		if k != "" {
+			tags[k] = v
+		}
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, errDKIMInvalidKey
+	}
+	p, ok := tags["p"]
+	if !ok {
+		return nil, errDKIMInvalidKey
+	} else if p == "" {
+		return nil, errDKIMRevokedKey
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errDKIMInvalidKey
+	}
+	switch strings.ToLower(tags["k"]) {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(keyBytes); err == nil {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok {
+				return rsaKey, nil
+			}
+			return nil, errDKIMInvalidKey
+		}
+		key, err := x509.ParsePKCS1PublicKey(keyBytes)
+		if err != nil {
+			return nil, errDKIMInvalidKey
+		}
+		return key, nil
+	case "ed25519":
+		if len(keyBytes) != ed25519.PublicKeySize {
+			return nil, errDKIMInvalidKey
+		}
+		return ed25519.PublicKey(keyBytes), nil
+	default:
+		return nil, errDKIMInvalidKey
+	}
+}
+
+// dkimCanonicalizeHeader canonicalizes a raw header field (incl. trailing CRLF), see RFC 6376, section 3.4
+func dkimCanonicalizeHeader(raw, canonical string) string {
+	if canonical != "relaxed" {
+		return raw
+	}
+	i := strings.IndexByte(raw, ':')
+	if i == -1 {
+		return raw
+	}
+	name := strings.ToLower(strings.TrimSpace(raw[:i]))
+	value := strings.ReplaceAll(strings.ReplaceAll(raw[i+1:], "\r\n", ""), "\t", " ")
+	value = strings.Join(strings.Fields(value), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// dkimCanonicalizeBody canonicalizes a CRLF-normalized body, see RFC 6376, section 3.4
+func dkimCanonicalizeBody(body []byte, canonical string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if canonical == "relaxed" {
+		for i, line := range lines {
+			line = strings.ReplaceAll(line, "\t", " ")
+			for strings.Contains(line, "  ") {
+				line = strings.ReplaceAll(line, "  ", " ")
+			}
+			lines[i] = strings.TrimRight(line, " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if canonical == "relaxed" {
+			return []byte{}
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckSPF(t *testing.T) {
+	resolver := newTestResolver()
+	resolver.txt["example.com"] = []string{"some-verification=123", "v=spf1 ip4:1.2.3.0/24 include:_spf.example.net -all"}
+	resolver.txt["_spf.example.net"] = []string{"v=spf1 a:mail.example.net mx/24 ip6:2001:db8::/32 ~all"}
+	resolver.ip["mail.example.net"] = []string{"5.6.7.8"}
+	resolver.mx["_spf.example.net"] = []string{"mx.example.net"}
+	resolver.ip["mx.example.net"] = []string{"9.9.9.1"}
+	resolver.txt["redirect.example.com"] = []string{"v=spf1 redirect=example.com"}
+	resolver.txt["neutral.example.com"] = []string{"v=spf1 ?all"}
+	resolver.txt["loop.example.com"] = []string{"v=spf1 include:loop.example.com -all"}
+	resolver.txt["macro.example.com"] = []string{"v=spf1 exists:%{ir}.%{v}._spf.%{d} -all"}
+	resolver.ip["4.3.2.1.in-addr._spf.macro.example.com"] = []string{"127.0.0.2"}
+	resolver.txt["broken.example.com"] = []string{"v=spf1 ip4:not-an-ip -all"}
+
+	ctx := context.Background()
+	require.Equal(t, mailAuthPass, checkSPF(ctx, resolver, net.ParseIP("1.2.3.4"), "phil@example.com", ""))
+	require.Equal(t, mailAuthPass, checkSPF(ctx, resolver, net.ParseIP("5.6.7.8"), "phil@example.com", ""))
+	require.Equal(t, mailAuthPass, checkSPF(ctx, resolver, net.ParseIP("9.9.9.200"), "phil@example.com", ""))
+	require.Equal(t, mailAuthPass, checkSPF(ctx, resolver, net.ParseIP("2001:db8::1"), "phil@example.com", ""))
+	require.Equal(t, mailAuthFail, checkSPF(ctx, resolver, net.ParseIP("8.8.8.8"), "phil@example.com", ""))
+	require.Equal(t, mailAuthPass, checkSPF(ctx, resolver, net.ParseIP("1.2.3.4"), "phil@redirect.example.com", ""))
+	require.Equal(t, mailAuthFail, checkSPF(ctx, resolver, net.ParseIP("8.8.8.8"), "phil@redirect.example.com", ""))
+	require.Equal(t, mailAuthPass, checkSPF(ctx, resolver, net.ParseIP("1.2.3.4"), "", "example.com"))
+	require.Equal(t, mailAuthNeutral, checkSPF(ctx, resolver, net.ParseIP("1.2.3.4"), "phil@neutral.example.com", ""))
+	require.Equal(t, mailAuthNone, checkSPF(ctx, resolver, net.ParseIP("1.2.3.4"), "phil@unknown.example.com", ""))
+	require.Equal(t, mailAuthPermError, checkSPF(ctx, resolver, net.ParseIP("1.2.3.4"), "phil@loop.example.com", ""))
+	require.Equal(t, mailAuthPermError, checkSPF(ctx, resolver, net.ParseIP("1.2.3.4"), "phil@broken.example.com", ""))
+	require.Equal(t, mailAuthPass, checkSPF(ctx, resolver, net.ParseIP("1.2.3.4"), "phil@macro.example.com", ""))
+	require.Equal(t, mailAuthFail, checkSPF(ctx, resolver, net.ParseIP("1.2.3.5"), "phil@macro.example.com", ""))
+
+	resolver.tempError = true
+	require.Equal(t, mailAuthTempError, checkSPF(ctx, resolver, net.ParseIP("1.2.3.4"), "phil@example.com", ""))
+}
+
+func TestDKIMCanonicalize(t *testing.T) {
+	// Examples from RFC 6376, section 3.4.5
+	headers, body := splitMailHeaderBody([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	require.Equal(t, 2, len(headers))
+	require.Equal(t, "a:X\r\n", dkimCanonicalizeHeader(headers[0].raw, "relaxed"))
+	require.Equal(t, "b:Y Z\r\n", dkimCanonicalizeHeader(headers[1].raw, "relaxed"))
+	require.Equal(t, " C\r\nD E\r\n", string(dkimCanonicalizeBody(body, "relaxed")))
+	require.Equal(t, "A: X\r\n", dkimCanonicalizeHeader(headers[0].raw, "simple"))
+	require.Equal(t, "B : Y\t\r\n\tZ  \r\n", dkimCanonicalizeHeader(headers[1].raw, "simple"))
+	require.Equal(t, " C \r\nD \t E\r\n", string(dkimCanonicalizeBody(body, "simple")))
+	require.Equal(t, "\r\n", string(dkimCanonicalizeBody([]byte(""), "simple")))
+	require.Equal(t, "", string(dkimCanonicalizeBody([]byte("\r\n"), "relaxed")))
+}
+
+func TestVerifyDKIM_RSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	resolver := newTestResolver()
+	resolver.txt["mail._domainkey.example.com"] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}
+
+	email := "From: Phil <phil@example.com>\r\nTo: ntfy-mytopic@ntfy.sh\r\nSubject: Backup  done\r\n\r\nAll good  \r\n\r\n"
+	signed := signTestDKIM(t, email, key, "rsa-sha256", "example.com", "mail")
+	result, domain := verifyDKIM(context.Background(), resolver, []byte(signed))
+	require.Equal(t, mailAuthPass, result)
+	require.Equal(t, "example.com", domain)
+
+	// Relaxed canonicalization tolerates whitespace changes
+	result, _ = verifyDKIM(context.Background(), resolver, []byte(strings.ReplaceAll(signed, "Backup  done", "Backup done")))
+	require.Equal(t, mailAuthPass, result)
+
+	// Tampered body or subject
+	result, _ = verifyDKIM(context.Background(), resolver, []byte(strings.ReplaceAll(signed, "All good", "All bad")))
+	require.Equal(t, mailAuthFail, result)
+	result, _ = verifyDKIM(context.Background(), resolver, []byte(strings.ReplaceAll(signed, "Backup  done", "Backup failed")))
+	require.Equal(t, mailAuthFail, result)
+
+	// Unknown key
+	resolver.txt["mail._domainkey.example.com"] = []string{"v=DKIM1; k=rsa; p="}
+	result, _ = verifyDKIM(context.Background(), resolver, []byte(signed))
+	require.Equal(t, mailAuthFail, result)
+
+	// Not signed
+	result, _ = verifyDKIM(context.Background(), resolver, []byte(email))
+	require.Equal(t, mailAuthNone, result)
+}
+
+func TestVerifyDKIM_Ed25519(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	resolver := newTestResolver()
+	resolver.txt["brisbane._domainkey.football.example.com"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}
+
+	email := "From: Joe SixPack <joe@football.example.com>\nTo: Suzie Q <suzie@shopping.example.net>\nSubject: Is dinner ready?\n\nHi.\n\nWe lost the game.  Are you hungry yet?\n\nJoe.\n"
+	signed := signTestDKIM(t, email, key, "ed25519-sha256", "football.example.com", "brisbane")
+	result, domain := verifyDKIM(context.Background(), resolver, []byte(signed))
+	require.Equal(t, mailAuthPass, result)
+	require.Equal(t, "football.example.com", domain)
+
+	result, _ = verifyDKIM(context.Background(), resolver, []byte(strings.ReplaceAll(signed, "lost", "won")))
+	require.Equal(t, mailAuthFail, result)
+}
+
+// signTestDKIM adds a DKIM-Signature header (relaxed/relaxed, signing From, To and Subject) to the e-mail
+func signTestDKIM(t *testing.T, email string, key crypto.Signer, algorithm, domain, selector string) string {
+	headers, body := splitMailHeaderBody([]byte(email))
+	bodyHash := sha256.Sum256(dkimCanonicalizeBody(body, "relaxed"))
+	sigHeader := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\th=from:to:subject; bh=%s; b=",
+		algorithm, domain, selector, base64.StdEncoding.EncodeToString(bodyHash[:]))
+	h := sha256.New()
+	for _, field := range headers {
+		h.Write([]byte(dkimCanonicalizeHeader(field.raw, "relaxed")))
+	}
+	h.Write([]byte(strings.TrimSuffix(dkimCanonicalizeHeader(sigHeader, "relaxed"), "\r\n")))
+	opts := crypto.Hash(crypto.SHA256)
+	if algorithm == "ed25519-sha256" {
+		opts = crypto.Hash(0)
+	}
+	signature, err := key.Sign(rand.Reader, h.Sum(nil), opts)
+	require.Nil(t, err)
+	return sigHeader + base64.StdEncoding.EncodeToString(signature) + "\r\n" + email
+}
+
+type testResolver struct {
+	txt       map[string][]string
+	ip        map[string][]string
+	mx        map[string][]string
+	tempError bool
+}
+
+func newTestResolver() *testResolver {
+	return &testResolver{
+		txt: make(map[string][]string),
+		ip:  make(map[string][]string),
+		mx:  make(map[string][]string),
+	}
+}
+
+func (r *testResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if err := r.err(name, r.txt); err != nil {
+		return nil, err
+	}
+	return r.txt[name], nil
+}
+
+func (r *testResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	if err := r.err(host, r.ip); err != nil {
+		return nil, err
+	}
+	addrs := make([]net.IPAddr, 0)
+	for _, ip := range r.ip[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *testResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if err := r.err(name, r.mx); err != nil {
+		return nil, err
+	}
+	mxs := make([]*net.MX, 0)
+	for _, host := range r.mx[name] {
+		mxs = append(mxs, &net.MX{Host: host, Pref: 10})
+	}
+	return mxs, nil
+}
+
+func (r *testResolver) err(name string, records map[string][]string) error {
+	if r.tempError {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	} else if _, ok := records[name]; !ok {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return nil
+}
@@ -0,0 +1,596 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/util"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The SNMP trap receiver lets legacy hardware (UPSes, switches, printers, ...) publish to snmp-trap-topic. SNMPv1
+// traps, SNMPv2c traps and SNMPv2c informs are accepted via UDP; SNMPv3 is not supported. Traps and their variable
+// bindings only consist of numeric OIDs, so they are translated to friendly names with the OID maps (see snmpOIDMap)
+// before they are published. Like CoAP and syslog, every trap is turned into an internal HTTP request, so access
+// control and rate limiting work like they do for HTTP.
+
+const (
+	snmpVersion1  = 0
+	snmpVersion2c = 1
+
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagNull        = 0x05
+	berTagOID         = 0x06
+	berTagSequence    = 0x30
+
+	snmpTagIPAddress      = 0x40
+	snmpTagCounter32      = 0x41
+	snmpTagGauge32        = 0x42
+	snmpTagTimeTicks      = 0x43
+	snmpTagCounter64      = 0x46
+	snmpTagNoSuchObject   = 0x80
+	snmpTagNoSuchInstance = 0x81
+	snmpTagEndOfMibView   = 0x82
+
+	snmpPDUResponse = 0xa2
+	snmpPDUTrapV1   = 0xa4
+	snmpPDUInform   = 0xa6
+	snmpPDUTrapV2   = 0xa7
+
+	snmpDatagramMaxBytes = 64 * 1024
+	snmpOIDSysUpTime     = "1.3.6.1.2.1.1.3.0"
+	snmpOIDTrapOID       = "1.3.6.1.6.3.1.1.4.1.0"
+	snmpOIDGenericTraps  = "1.3.6.1.6.3.1.1.5" // Followed by the generic trap number + 1, see RFC 3584
+	snmpGenericTrapMax   = 5                   // egpNeighborLoss; 6 is enterpriseSpecific
+)
+
+var (
+	errSNMPMessageInvalid = errors.New("invalid SNMP message")
+	errSNMPVersion        = errors.New("unsupported SNMP version")
+
+	snmpOIDRegex = regexp.MustCompile(`^\.?[0-9]+(\.[0-9]+)+$`)
+
+	// snmpDefaultOIDMap contains the generic traps and the most common variable bindings. OID map files can
+	// override them.
+	snmpDefaultOIDMap = map[string]*snmpOIDName{
+		"1.3.6.1.2.1.1.1":        {name: "sysDescr"},
+		"1.3.6.1.2.1.1.3":        {name: "sysUpTime"},
+		"1.3.6.1.2.1.1.5":        {name: "sysName"},
+		"1.3.6.1.2.1.1.6":        {name: "sysLocation"},
+		"1.3.6.1.2.1.2.2.1.1":    {name: "ifIndex"},
+		"1.3.6.1.2.1.2.2.1.2":    {name: "ifDescr"},
+		"1.3.6.1.2.1.2.2.1.7":    {name: "ifAdminStatus"},
+		"1.3.6.1.2.1.2.2.1.8":    {name: "ifOperStatus"},
+		"1.3.6.1.2.1.31.1.1.1.1": {name: "ifName"},
+		"1.3.6.1.6.3.1.1.4.1":    {name: "snmpTrapOID"},
+		"1.3.6.1.6.3.1.1.4.3":    {name: "snmpTrapEnterprise"},
+		"1.3.6.1.6.3.1.1.5.1":    {name: "coldStart"},
+		"1.3.6.1.6.3.1.1.5.2":    {name: "warmStart"},
+		"1.3.6.1.6.3.1.1.5.3":    {name: "linkDown", priority: 4},
+		"1.3.6.1.6.3.1.1.5.4":    {name: "linkUp"},
+		"1.3.6.1.6.3.1.1.5.5":    {name: "authenticationFailure"},
+		"1.3.6.1.6.3.1.1.5.6":    {name: "egpNeighborLoss"},
+		"1.3.6.1.4.1.8072.4.0.1": {name: "nsNotifyStart"},
+		"1.3.6.1.4.1.8072.4.0.2": {name: "nsNotifyShutdown"},
+		"1.3.6.1.4.1.8072.4.0.3": {name: "nsNotifyRestart"},
+		"1.3.6.1.4.1.2021.251.1": {name: "ucdStart"},
+		"1.3.6.1.4.1.2021.251.2": {name: "ucdShutdown"},
+	}
+)
+
+// snmpOIDName is the friendly name of an OID, and optionally the priority that traps with this OID are published with
+type snmpOIDName struct {
+	name     string
+	priority int // 0 means default priority
+}
+
+// snmpOIDMap translates OIDs to friendly names. OIDs of variable bindings are usually followed by an index, e.g.
+// 1.3.6.1.2.1.2.2.1.2.3 is the description of interface 3, so the longest known prefix is translated ("ifDescr.3").
+type snmpOIDMap struct {
+	names map[string]*snmpOIDName
+}
+
+// snmpTrap is a parsed trap or inform. SNMPv1 traps are converted to the SNMPv2 format, see parseSNMPMessage.
+type snmpTrap struct {
+	version   int
+	community string
+	pduType   byte
+	requestID []byte // Encoded INTEGER, only used to respond to informs
+	agent     string // Agent address of SNMPv1 traps; empty for SNMPv2c
+	trapOID   string
+	varBinds  []*snmpVarBind // Without sysUpTime.0 and snmpTrapOID.0
+	raw       []byte         // Encoded variable bindings, only used to respond to informs
+}
+
+type snmpVarBind struct {
+	oid   string
+	tag   byte
+	value []byte
+}
+
+// loadSNMPOIDMap reads the OID map files (snmp-trap-oid-map) on top of the default map. Each line of a file
+// consists of an OID, its friendly name and an optional priority, e.g. "1.3.6.1.4.1.318.0.5 upsOnBattery urgent".
+// Empty lines and lines starting with "#" are ignored.
+func loadSNMPOIDMap(filenames []string) (*snmpOIDMap, error) {
+	m := &snmpOIDMap{names: make(map[string]*snmpOIDName)}
+	for oid, name := range snmpDefaultOIDMap {
+		m.names[oid] = name
+	}
+	for _, filename := range filenames {
+		if err := m.load(filename); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *snmpOIDMap) load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		} else if len(fields) < 2 || len(fields) > 3 || !snmpOIDRegex.MatchString(fields[0]) {
+			return fmt.Errorf("invalid OID map file %s, line %d: expected format <oid> <name> [<priority>]", filename, line)
+		}
+		name := &snmpOIDName{name: fields[1]}
+		if len(fields) == 3 {
+			name.priority, err = util.ParsePriority(fields[2])
+			if err != nil {
+				return fmt.Errorf("invalid OID map file %s, line %d: %s", filename, line, err.Error())
+			}
+		}
+		m.names[strings.TrimPrefix(fields[0], ".")] = name
+	}
+	return scanner.Err()
+}
+
+// name returns the friendly name of the OID, or of its longest known prefix followed by the rest of the OID.
+// Unknown OIDs are returned as they are.
+func (m *snmpOIDMap) name(oid string) string {
+	for prefix := oid; prefix != ""; {
+		if name, ok := m.names[prefix]; ok {
+			return name.name + strings.TrimPrefix(oid, prefix)
+		}
+		i := strings.LastIndexByte(prefix, '.')
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+	return oid
+}
+
+// priority returns the priority of traps with the OID, or 0 if it has none
+func (m *snmpOIDMap) priority(oid string) int {
+	if name, ok := m.names[oid]; ok {
+		return name.priority
+	}
+	return 0
+}
+
+// runSNMPTrapServer starts the SNMP trap receiver on snmp-trap-listen
+func (s *Server) runSNMPTrapServer() error {
+	conn, err := net.ListenPacket("udp", s.config.SNMPTrapListen)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.snmpConn = conn
+	s.mu.Unlock()
+	return s.serveSNMPTraps(conn)
+}
+
+func (s *Server) serveSNMPTraps(conn net.PacketConn) error {
+	buf := make([]byte, snmpDatagramMaxBytes)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		trap, err := parseSNMPMessage(buf[:n])
+		if err != nil {
+			continue // Also SNMPv3, and requests that have no business here
+		} else if len(s.config.SNMPTrapCommunities) > 0 && !util.InStringList(s.config.SNMPTrapCommunities, trap.community) {
+			continue // Like agents do, traps with the wrong community are dropped without a response
+		}
+		if published := s.publishSNMPTrap(trap, addr.String()); published && trap.pduType == snmpPDUInform {
+			// Only acknowledged once published; if not, the agent sends the inform again
+			if _, err := conn.WriteTo(trap.response(), addr); err != nil {
+				log.Printf("[%s] SNMP: Unable to acknowledge inform: %s", addr.String(), err.Error())
+			}
+		}
+	}
+}
+
+// publishSNMPTrap publishes a trap to snmp-trap-topic, with the name of the trap and the agent as title, and the
+// variable bindings as message, one per line. It returns true if the trap was published.
+func (s *Server) publishSNMPTrap(trap *snmpTrap, addr string) bool {
+	agent := trap.agent
+	if agent == "" {
+		agent, _, _ = net.SplitHostPort(addr)
+	}
+	lines := make([]string, 0)
+	for _, varBind := range trap.varBinds {
+		lines = append(lines, fmt.Sprintf("%s: %s", s.snmpNames.name(varBind.oid), s.formatSNMPValue(varBind.tag, varBind.value)))
+	}
+	message := strings.Join(lines, "\n")
+	if message == "" {
+		message = trap.trapOID
+	}
+	r, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/%s", s.config.BaseURL, s.config.SNMPTrapTopic), strings.NewReader(message))
+	if err != nil {
+		return false
+	}
+	r.Header.Set("Title", fmt.Sprintf("%s from %s", s.snmpNames.name(trap.trapOID), agent))
+	r.Header.Set("Tags", "snmp")
+	if priority := s.snmpNames.priority(trap.trapOID); priority > 0 {
+		r.Header.Set("Priority", strconv.Itoa(priority))
+	}
+	if s.config.SNMPTrapToken != "" {
+		r.Header.Set("Authorization", bearerAuthPrefix+s.config.SNMPTrapToken)
+	}
+	r.RemoteAddr = addr // Rate limiting is done based on the (unverified!) address of the datagram
+	w := newInternalResponseWriter(nil)
+	s.handle(w, r)
+	if w.code != http.StatusOK && w.code != http.StatusAccepted {
+		log.Printf("[%s] SNMP: Unable to publish trap %s: %s", addr, trap.trapOID, strings.TrimSpace(w.buf.String()))
+		return false
+	}
+	return true
+}
+
+// formatSNMPValue formats the value of a variable binding as text. OIDs are translated to friendly names, octet
+// strings that aren't printable (e.g. MAC addresses) are formatted as hex.
+func (s *Server) formatSNMPValue(tag byte, value []byte) string {
+	switch tag {
+	case berTagInteger:
+		if i, err := berInt(value); err == nil {
+			return strconv.FormatInt(i, 10)
+		}
+	case berTagOctetString:
+		if snmpPrintable(value) {
+			return string(value)
+		}
+		return snmpHex(value)
+	case berTagNull:
+		return ""
+	case berTagOID:
+		if oid, err := berOID(value); err == nil {
+			return s.snmpNames.name(oid)
+		}
+	case snmpTagIPAddress:
+		if len(value) == net.IPv4len {
+			return net.IP(value).String()
+		}
+	case snmpTagCounter32, snmpTagGauge32, snmpTagCounter64:
+		if i, err := berUint(value); err == nil {
+			return strconv.FormatUint(i, 10)
+		}
+	case snmpTagTimeTicks:
+		if i, err := berUint(value); err == nil {
+			return (time.Duration(i) * 10 * time.Millisecond).String() // Hundredths of a second
+		}
+	case snmpTagNoSuchObject:
+		return "noSuchObject"
+	case snmpTagNoSuchInstance:
+		return "noSuchInstance"
+	case snmpTagEndOfMibView:
+		return "endOfMibView"
+	}
+	return snmpHex(value)
+}
+
+// response returns the Response-PDU that acknowledges an inform, which repeats its request ID and variable bindings
+func (t *snmpTrap) response() []byte {
+	pdu := berEncode(berTagInteger, t.requestID)
+	pdu = append(pdu, berEncode(berTagInteger, []byte{0})...) // error-status
+	pdu = append(pdu, berEncode(berTagInteger, []byte{0})...) // error-index
+	pdu = append(pdu, t.raw...)
+	message := berEncode(berTagInteger, []byte{byte(t.version)})
+	message = append(message, berEncode(berTagOctetString, []byte(t.community))...)
+	message = append(message, berEncode(snmpPDUResponse, pdu)...)
+	return berEncode(berTagSequence, message)
+}
+
+// parseSNMPMessage parses an SNMPv1 or SNMPv2c message, which must contain a trap or an inform:
+//
+//	Message  ::= SEQUENCE { version INTEGER, community OCTET STRING, pdu }
+//	Trap-PDU ::= [4] { enterprise OID, agent-addr IpAddress, generic-trap INTEGER, specific-trap INTEGER,
+//	                   time-stamp TimeTicks, variable-bindings }                              (SNMPv1)
+//	Trap/Inform ::= [7]/[6] { request-id INTEGER, error-status INTEGER, error-index INTEGER,
+//	                          variable-bindings }                                             (SNMPv2c)
+//
+// SNMPv1 traps are converted as described in RFC 3584, i.e. generic traps get the OIDs of the SNMPv2 generic traps,
+// and enterprise-specific traps the OID <enterprise>.0.<specific-trap>.
+func parseSNMPMessage(b []byte) (*snmpTrap, error) {
+	message, _, err := berExpect(b, berTagSequence)
+	if err != nil {
+		return nil, err
+	}
+	versionBytes, message, err := berExpect(message, berTagInteger)
+	if err != nil {
+		return nil, err
+	}
+	version, err := berInt(versionBytes)
+	if err != nil {
+		return nil, err
+	} else if version != snmpVersion1 && version != snmpVersion2c {
+		return nil, errSNMPVersion
+	}
+	community, message, err := berExpect(message, berTagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	pduType, pdu, _, err := berRead(message)
+	if err != nil {
+		return nil, err
+	}
+	trap := &snmpTrap{
+		version:   int(version),
+		community: string(community),
+		pduType:   pduType,
+	}
+	if version == snmpVersion1 && pduType == snmpPDUTrapV1 {
+		err = trap.parseV1(pdu)
+	} else if version == snmpVersion2c && (pduType == snmpPDUTrapV2 || pduType == snmpPDUInform) {
+		err = trap.parseV2(pdu)
+	} else {
+		err = errSNMPMessageInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return trap, nil
+}
+
+func (t *snmpTrap) parseV1(pdu []byte) error {
+	enterpriseBytes, pdu, err := berExpect(pdu, berTagOID)
+	if err != nil {
+		return err
+	}
+	enterprise, err := berOID(enterpriseBytes)
+	if err != nil {
+		return err
+	}
+	agent, pdu, err := berExpect(pdu, snmpTagIPAddress)
+	if err != nil {
+		return err
+	} else if len(agent) == net.IPv4len {
+		t.agent = net.IP(agent).String()
+	}
+	genericBytes, pdu, err := berExpect(pdu, berTagInteger)
+	if err != nil {
+		return err
+	}
+	specificBytes, pdu, err := berExpect(pdu, berTagInteger)
+	if err != nil {
+		return err
+	}
+	generic, err := berInt(genericBytes)
+	if err != nil || generic < 0 || generic > snmpGenericTrapMax+1 {
+		return errSNMPMessageInvalid
+	}
+	specific, err := berInt(specificBytes)
+	if err != nil {
+		return err
+	}
+	if generic <= snmpGenericTrapMax {
+		t.trapOID = fmt.Sprintf("%s.%d", snmpOIDGenericTraps, generic+1)
+	} else {
+		t.trapOID = fmt.Sprintf("%s.0.%d", enterprise, specific)
+	}
+	if _, pdu, err = berExpect(pdu, snmpTagTimeTicks); err != nil {
+		return err
+	}
+	t.varBinds, err = parseSNMPVarBinds(pdu)
+	return err
+}
+
+func (t *snmpTrap) parseV2(pdu []byte) error {
+	var err error
+	t.requestID, pdu, err = berExpect(pdu, berTagInteger)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ { // error-status and error-index, always 0
+		if _, pdu, err = berExpect(pdu, berTagInteger); err != nil {
+			return err
+		}
+	}
+	t.raw = pdu
+	varBinds, err := parseSNMPVarBinds(pdu)
+	if err != nil {
+		return err
+	}
+	for _, varBind := range varBinds {
+		if varBind.oid == snmpOIDTrapOID && varBind.tag == berTagOID {
+			t.trapOID, err = berOID(varBind.value)
+			if err != nil {
+				return err
+			}
+		} else if varBind.oid != snmpOIDSysUpTime {
+			t.varBinds = append(t.varBinds, varBind)
+		}
+	}
+	if t.trapOID == "" {
+		return errSNMPMessageInvalid
+	}
+	return nil
+}
+
+func parseSNMPVarBinds(b []byte) ([]*snmpVarBind, error) {
+	list, _, err := berExpect(b, berTagSequence)
+	if err != nil {
+		return nil, err
+	}
+	varBinds := make([]*snmpVarBind, 0)
+	for len(list) > 0 {
+		var varBind []byte
+		varBind, list, err = berExpect(list, berTagSequence)
+		if err != nil {
+			return nil, err
+		}
+		oidBytes, rest, err := berExpect(varBind, berTagOID)
+		if err != nil {
+			return nil, err
+		}
+		oid, err := berOID(oidBytes)
+		if err != nil {
+			return nil, err
+		}
+		tag, value, _, err := berRead(rest)
+		if err != nil {
+			return nil, err
+		}
+		varBinds = append(varBinds, &snmpVarBind{oid: oid, tag: tag, value: value})
+	}
+	return varBinds, nil
+}
+
+// berRead reads a single BER-encoded element, and returns its tag, its value and the remaining bytes. SNMP only
+// uses single-byte tags and definite lengths.
+func berRead(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 || b[0]&0x1f == 0x1f {
+		return 0, nil, nil, errSNMPMessageInvalid
+	}
+	tag, length, b := b[0], int(b[1]), b[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 3 || len(b) < n {
+			return 0, nil, nil, errSNMPMessageInvalid
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if length > len(b) {
+		return 0, nil, nil, errSNMPMessageInvalid
+	}
+	return tag, b[:length], b[length:], nil
+}
+
+// berExpect is like berRead, but fails if the element doesn't have the expected tag
+func berExpect(b []byte, expected byte) ([]byte, []byte, error) {
+	tag, value, rest, err := berRead(b)
+	if err != nil {
+		return nil, nil, err
+	} else if tag != expected {
+		return nil, nil, errSNMPMessageInvalid
+	}
+	return value, rest, nil
+}
+
+func berEncode(tag byte, value []byte) []byte {
+	b := []byte{tag}
+	if length := len(value); length < 0x80 {
+		b = append(b, byte(length))
+	} else if length <= 0xff {
+		b = append(b, 0x81, byte(length))
+	} else {
+		b = append(b, 0x82, byte(length>>8), byte(length))
+	}
+	return append(b, value...)
+}
+
+// berInt decodes a signed (two's complement) integer
+func berInt(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, errSNMPMessageInvalid
+	}
+	i := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		i = i<<8 | int64(c)
+	}
+	return i, nil
+}
+
+// berUint decodes an unsigned integer, i.e. Counter32, Gauge32, TimeTicks or Counter64, which may have a leading
+// zero byte to keep the sign bit clear
+func berUint(b []byte) (uint64, error) {
+	if len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	if len(b) == 0 || len(b) > 8 {
+		return 0, errSNMPMessageInvalid
+	}
+	var i uint64
+	for _, c := range b {
+		i = i<<8 | uint64(c)
+	}
+	return i, nil
+}
+
+// berOID decodes an object identifier in dotted notation. The first byte encodes the first two numbers (40x+y),
+// all others are base-128 with the high bit set on all but the last byte of a number.
+func berOID(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", errSNMPMessageInvalid
+	}
+	numbers := make([]string, 0)
+	var n uint64
+	for i, c := range b {
+		if n > 1<<56 {
+			return "", errSNMPMessageInvalid
+		}
+		n = n<<7 | uint64(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return "", errSNMPMessageInvalid
+			}
+			continue
+		}
+		if len(numbers) == 0 {
+			first := n / 40
+			if first > 2 {
+				first = 2
+			}
+			numbers = append(numbers, strconv.FormatUint(first, 10), strconv.FormatUint(n-first*40, 10))
+		} else {
+			numbers = append(numbers, strconv.FormatUint(n, 10))
+		}
+		n = 0
+	}
+	return strings.Join(numbers, "."), nil
+}
+
+func snmpPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// snmpHex formats bytes like MAC addresses are usually written, e.g. 00:1a:2b:3c:4d:5e
+func snmpHex(b []byte) string {
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = hex.EncodeToString(b[i : i+1])
+	}
+	return strings.Join(parts, ":")
+}
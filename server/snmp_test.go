@@ -0,0 +1,236 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBerOID(t *testing.T) {
+	oid, err := berOID([]byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x82, 0x3e, 0x00, 0x05})
+	require.Nil(t, err)
+	require.Equal(t, "1.3.6.1.4.1.318.0.5", oid)
+	require.Equal(t, []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x82, 0x3e, 0x00, 0x05}, encodeTestOID("1.3.6.1.4.1.318.0.5"))
+
+	_, err = berOID([]byte{0x2b, 0x86}) // Unterminated number
+	require.Equal(t, errSNMPMessageInvalid, err)
+	_, err = berOID([]byte{})
+	require.Equal(t, errSNMPMessageInvalid, err)
+}
+
+func TestParseSNMPMessage_V1(t *testing.T) {
+	trap, err := parseSNMPMessage(newTestSNMPv1Trap("public", "1.3.6.1.4.1.318", 6, 5, testVarBind("1.3.6.1.4.1.318.2.3.10.0", berTagOctetString, []byte("UPS: On battery power"))))
+	require.Nil(t, err)
+	require.Equal(t, "public", trap.community)
+	require.Equal(t, "10.0.0.5", trap.agent)
+	require.Equal(t, "1.3.6.1.4.1.318.0.5", trap.trapOID)
+	require.Len(t, trap.varBinds, 1)
+	require.Equal(t, "1.3.6.1.4.1.318.2.3.10.0", trap.varBinds[0].oid)
+
+	trap, err = parseSNMPMessage(newTestSNMPv1Trap("public", "1.3.6.1.4.1.9", 2, 0, testVarBind("1.3.6.1.2.1.2.2.1.1.3", berTagInteger, []byte{3})))
+	require.Nil(t, err)
+	require.Equal(t, "1.3.6.1.6.3.1.1.5.3", trap.trapOID) // linkDown
+}
+
+func TestParseSNMPMessage_Invalid(t *testing.T) {
+	trap := newTestSNMPv2Trap(snmpPDUTrapV2, "public", "1.3.6.1.6.3.1.1.5.1")
+	for i := 0; i < len(trap); i++ {
+		_, err := parseSNMPMessage(trap[:i])
+		require.Error(t, err, i)
+	}
+	v3 := berEncode(berTagSequence, append(berEncode(berTagInteger, []byte{3}), berEncode(berTagSequence, nil)...))
+	_, err := parseSNMPMessage(v3)
+	require.Equal(t, errSNMPVersion, err)
+	get := berEncode(berTagSequence, concatTestBytes(berEncode(berTagInteger, []byte{1}), berEncode(berTagOctetString, []byte("public")), berEncode(0xa0, nil)))
+	_, err = parseSNMPMessage(get)
+	require.Equal(t, errSNMPMessageInvalid, err)
+}
+
+func TestSNMPOIDMap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "apc.map")
+	require.Nil(t, os.WriteFile(filename, []byte(`# APC PowerNet-MIB
+.1.3.6.1.4.1.318.0.5     upsOnBattery    urgent
+1.3.6.1.4.1.318.0.9      upsOnLine
+
+1.3.6.1.2.1.2.2.1.2      interfaceDescription
+`), 0600))
+	m, err := loadSNMPOIDMap([]string{filename})
+	require.Nil(t, err)
+	require.Equal(t, "upsOnBattery", m.name("1.3.6.1.4.1.318.0.5"))
+	require.Equal(t, 5, m.priority("1.3.6.1.4.1.318.0.5"))
+	require.Equal(t, "upsOnLine", m.name("1.3.6.1.4.1.318.0.9"))
+	require.Equal(t, 0, m.priority("1.3.6.1.4.1.318.0.9"))
+	require.Equal(t, "interfaceDescription.3", m.name("1.3.6.1.2.1.2.2.1.2.3")) // Overrides the default
+	require.Equal(t, "ifOperStatus.3", m.name("1.3.6.1.2.1.2.2.1.8.3"))
+	require.Equal(t, "1.3.6.1.4.1.318.0.1", m.name("1.3.6.1.4.1.318.0.1"))
+
+	require.Nil(t, os.WriteFile(filename, []byte("1.3.6.1.4.1.318.0.5 upsOnBattery ultra\n"), 0600))
+	_, err = loadSNMPOIDMap([]string{filename})
+	require.Error(t, err)
+	require.Nil(t, os.WriteFile(filename, []byte("upsOnBattery 1.3.6.1.4.1.318.0.5\n"), 0600))
+	_, err = loadSNMPOIDMap([]string{filename})
+	require.EqualError(t, err, "invalid OID map file "+filename+", line 1: expected format <oid> <name> [<priority>]")
+}
+
+func TestServer_SNMP_Trap(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "apc.map")
+	require.Nil(t, os.WriteFile(filename, []byte("1.3.6.1.4.1.318.0.5 upsOnBattery urgent\n1.3.6.1.4.1.318.2.3.10 mtrapargsString\n"), 0600))
+	c := newTestConfig(t)
+	c.SNMPTrapListen = "127.0.0.1:0" // Not used, only loads the OID maps
+	c.SNMPTrapTopic = "hardware"
+	c.SNMPTrapCommunities = []string{"secret"}
+	c.SNMPTrapOIDMapFiles = []string{filename}
+	s := newTestServer(t, c)
+	conn := newTestSNMPConn(t, s)
+
+	for _, trap := range [][]byte{
+		newTestSNMPv1Trap("public", "1.3.6.1.4.1.318", 6, 5), // Wrong community
+		newTestSNMPv1Trap("secret", "1.3.6.1.4.1.318", 6, 5, testVarBind("1.3.6.1.4.1.318.2.3.10.0", berTagOctetString, []byte("UPS: On battery power"))),
+		newTestSNMPv2Trap(snmpPDUTrapV2, "secret", "1.3.6.1.6.3.1.1.5.3",
+			testVarBind("1.3.6.1.2.1.2.2.1.1.3", berTagInteger, []byte{3}),
+			testVarBind("1.3.6.1.2.1.2.2.1.2.3", berTagOctetString, []byte("GigabitEthernet0/3")),
+			testVarBind("1.3.6.1.2.1.2.2.1.6.3", berTagOctetString, []byte{0x00, 0x1a, 0x2b, 0x3c, 0x4d, 0x5e}),
+			testVarBind("1.3.6.1.4.1.9.2.2.1.1.20.3", berTagOID, encodeTestOID("1.3.6.1.2.1.2.2.1.8")),
+		),
+	} {
+		_, err := conn.Write(trap)
+		require.Nil(t, err)
+	}
+	var messages []*message
+	require.Eventually(t, func() bool {
+		messages = toMessages(t, request(t, s, "GET", "/hardware/json?poll=1", "", nil).Body.String())
+		return len(messages) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "upsOnBattery from 10.0.0.5", messages[0].Title)
+	require.Equal(t, "mtrapargsString.0: UPS: On battery power", messages[0].Message)
+	require.Equal(t, 5, messages[0].Priority)
+	require.Equal(t, []string{"snmp"}, messages[0].Tags)
+	require.Equal(t, "linkDown from 127.0.0.1", messages[1].Title)
+	require.Equal(t, "ifIndex.3: 3\nifDescr.3: GigabitEthernet0/3\n1.3.6.1.2.1.2.2.1.6.3: 00:1a:2b:3c:4d:5e\n1.3.6.1.4.1.9.2.2.1.1.20.3: ifOperStatus", messages[1].Message)
+	require.Equal(t, 4, messages[1].Priority)
+}
+
+func TestServer_SNMP_Inform(t *testing.T) {
+	c := newTestConfig(t)
+	c.SNMPTrapListen = "127.0.0.1:0"
+	c.SNMPTrapTopic = "hardware"
+	s := newTestServer(t, c)
+	conn := newTestSNMPConn(t, s)
+
+	_, err := conn.Write(newTestSNMPv2Trap(snmpPDUInform, "public", "1.3.6.1.6.3.1.1.5.1"))
+	require.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, snmpDatagramMaxBytes)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	response, _, err := berExpect(buf[:n], berTagSequence)
+	require.Nil(t, err)
+	_, response, err = berExpect(response, berTagInteger)
+	require.Nil(t, err)
+	community, response, err := berExpect(response, berTagOctetString)
+	require.Nil(t, err)
+	require.Equal(t, "public", string(community))
+	pdu, _, err := berExpect(response, snmpPDUResponse)
+	require.Nil(t, err)
+	requestID, _, err := berExpect(pdu, berTagInteger)
+	require.Nil(t, err)
+	require.Equal(t, []byte{0x12, 0x34}, requestID)
+
+	var messages []*message
+	require.Eventually(t, func() bool {
+		messages = toMessages(t, request(t, s, "GET", "/hardware/json?poll=1", "", nil).Body.String())
+		return len(messages) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "coldStart from 127.0.0.1", messages[0].Title)
+	require.Equal(t, "1.3.6.1.6.3.1.1.5.1", messages[0].Message)
+}
+
+func TestServer_SNMP_InformNotPublished(t *testing.T) {
+	c := newTestConfig(t)
+	c.SNMPTrapListen = "127.0.0.1:0"
+	c.SNMPTrapTopic = "hardware"
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultWrite = false // No snmp-trap-token, so the trap can't be published
+	s := newTestServer(t, c)
+	conn := newTestSNMPConn(t, s)
+
+	_, err := conn.Write(newTestSNMPv2Trap(snmpPDUInform, "public", "1.3.6.1.6.3.1.1.5.1"))
+	require.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	_, err = conn.Read(make([]byte, snmpDatagramMaxBytes))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout()) // Not acknowledged, so that the agent retries
+}
+
+func newTestSNMPConn(t *testing.T, s *Server) net.Conn {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go s.serveSNMPTraps(listener)
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestSNMPv1Trap(community, enterprise string, generic, specific byte, varBinds ...[]byte) []byte {
+	pdu := concatTestBytes(
+		berEncode(berTagOID, encodeTestOID(enterprise)),
+		berEncode(snmpTagIPAddress, []byte{10, 0, 0, 5}),
+		berEncode(berTagInteger, []byte{generic}),
+		berEncode(berTagInteger, []byte{specific}),
+		berEncode(snmpTagTimeTicks, []byte{0x01, 0x00}),
+		berEncode(berTagSequence, concatTestBytes(varBinds...)),
+	)
+	return berEncode(berTagSequence, concatTestBytes(berEncode(berTagInteger, []byte{0}), berEncode(berTagOctetString, []byte(community)), berEncode(snmpPDUTrapV1, pdu)))
+}
+
+func newTestSNMPv2Trap(pduType byte, community, trapOID string, varBinds ...[]byte) []byte {
+	varBinds = append([][]byte{
+		testVarBind(snmpOIDSysUpTime, snmpTagTimeTicks, []byte{0x01, 0x00}),
+		testVarBind(snmpOIDTrapOID, berTagOID, encodeTestOID(trapOID)),
+	}, varBinds...)
+	pdu := concatTestBytes(
+		berEncode(berTagInteger, []byte{0x12, 0x34}),
+		berEncode(berTagInteger, []byte{0}),
+		berEncode(berTagInteger, []byte{0}),
+		berEncode(berTagSequence, concatTestBytes(varBinds...)),
+	)
+	return berEncode(berTagSequence, concatTestBytes(berEncode(berTagInteger, []byte{1}), berEncode(berTagOctetString, []byte(community)), berEncode(pduType, pdu)))
+}
+
+func testVarBind(oid string, tag byte, value []byte) []byte {
+	return berEncode(berTagSequence, append(berEncode(berTagOID, encodeTestOID(oid)), berEncode(tag, value)...))
+}
+
+func encodeTestOID(oid string) []byte {
+	numbers := make([]uint64, 0)
+	for _, s := range strings.Split(oid, ".") {
+		n, _ := strconv.ParseUint(s, 10, 64)
+		numbers = append(numbers, n)
+	}
+	numbers = append([]uint64{numbers[0]*40 + numbers[1]}, numbers[2:]...)
+	b := make([]byte, 0)
+	for _, n := range numbers {
+		chunk := []byte{byte(n & 0x7f)}
+		for n >>= 7; n > 0; n >>= 7 {
+			chunk = append([]byte{byte(n&0x7f) | 0x80}, chunk...)
+		}
+		b = append(b, chunk...)
+	}
+	return b
+}
+
+func concatTestBytes(parts ...[]byte) []byte {
+	b := make([]byte, 0)
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return b
+}
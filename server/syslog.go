@@ -0,0 +1,367 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/util"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The syslog receiver lets network gear and appliances publish without any HTTP glue: routers, switches, NAS boxes
+// and firewalls can only forward their logs via syslog. Messages in the RFC 5424 and RFC 3164 (BSD) formats are
+// accepted via UDP and TCP on syslog-listen, and via TLS (RFC 5425) on syslog-listen-tls. TCP and TLS connections may
+// use octet counting or newline-delimited framing (RFC 6587).
+//
+// The tag of a message (the APP-NAME of RFC 5424) is mapped to a topic via the syslog-topic-rule rules, the severity
+// to a priority via syslog-priority-mapping; the facility and severity are added as tags. Like CoAP and MQTT, every
+// message is turned into an internal HTTP request, so access control and rate limiting work like they do for HTTP.
+
+const (
+	syslogMessageMaxBytes = 64 * 1024 // Of a single message, including the header
+	syslogTagMaxLength    = 48        // Per RFC 5424, APP-NAME is at most 48 characters
+	syslogRFC3164Time     = "Jan _2 15:04:05"
+	syslogBOM             = "\xef\xbb\xbf"
+	syslogNilValue        = "-"
+)
+
+var (
+	errSyslogMessageInvalid = errors.New("invalid syslog message")
+
+	syslogFacilities = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp", "ntp",
+		"security", "console", "solaris-cron", "local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+	// syslogTagRegex matches the tag of RFC 3164 messages, e.g. "sshd[1234]:" or "kernel:", but not sequence
+	// numbers like "52:", which some devices send instead
+	syslogTagRegex = regexp.MustCompile(`^([^\s\[\]:0-9][^\s\[\]:]{0,47})(\[[^\]\s]*\])?:$`)
+)
+
+// syslogMessage is a parsed syslog message. Timestamps are ignored; messages are published with the time they are
+// received, since the clocks of network gear are notoriously wrong.
+type syslogMessage struct {
+	facility int
+	severity int
+	hostname string // May be empty
+	tag      string // May be empty
+	message  string
+}
+
+// runSyslogServer starts the syslog receiver on syslog-listen (UDP and TCP) and/or syslog-listen-tls
+func (s *Server) runSyslogServer() error {
+	conns := make([]io.Closer, 0)
+	closeAll := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	var packetConn net.PacketConn
+	listeners := make([]net.Listener, 0)
+	if s.config.SyslogListen != "" {
+		conn, err := net.ListenPacket("udp", s.config.SyslogListen)
+		if err != nil {
+			return err
+		}
+		packetConn = conn
+		conns = append(conns, conn)
+		listener, err := net.Listen("tcp", s.config.SyslogListen)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, listener)
+		conns = append(conns, listener)
+	}
+	if s.config.SyslogListenTLS != "" {
+		certReloader, err := util.NewCertReloader(s.config.CertFile, s.config.KeyFile)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listener, err := tls.Listen("tcp", s.config.SyslogListenTLS, &tls.Config{GetCertificate: certReloader.GetCertificate})
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, listener)
+		conns = append(conns, listener)
+	}
+	s.mu.Lock()
+	s.syslogConns = conns
+	s.mu.Unlock()
+	errChan := make(chan error, len(conns))
+	if packetConn != nil {
+		go func() {
+			errChan <- s.serveSyslogUDP(packetConn)
+		}()
+	}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errChan <- s.serveSyslogTCP(listener)
+		}(listener)
+	}
+	return <-errChan
+}
+
+// serveSyslogUDP handles the datagrams, each of which is a single message (RFC 5426)
+func (s *Server) serveSyslogUDP(conn net.PacketConn) error {
+	buf := make([]byte, syslogMessageMaxBytes)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		m, err := parseSyslogMessage(buf[:n])
+		if err != nil {
+			continue // There is no way to tell the sender
+		}
+		s.publishSyslogMessage(m, addr.String())
+	}
+}
+
+func (s *Server) serveSyslogTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go s.handleSyslogConn(conn)
+	}
+}
+
+// handleSyslogConn reads messages from a TCP or TLS connection until it is closed by the sender. Invalid messages
+// are skipped, but framing errors close the connection, since the start of the next message cannot be found.
+func (s *Server) handleSyslogConn(conn net.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+	reader := bufio.NewReaderSize(conn, syslogMessageMaxBytes)
+	for {
+		frame, err := readSyslogFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("[%s] Syslog: Closing connection: %s", addr, err.Error())
+			}
+			return
+		}
+		m, err := parseSyslogMessage(frame)
+		if err != nil {
+			continue
+		}
+		s.publishSyslogMessage(m, addr)
+	}
+}
+
+// publishSyslogMessage publishes a message to the topic of its tag. Messages that match no topic rule (if there is
+// no default topic), and messages with a severity that is not in the priority mapping are dropped.
+func (s *Server) publishSyslogMessage(m *syslogMessage, addr string) {
+	topic, ok := s.syslogTopic(m.tag)
+	if !ok {
+		return
+	}
+	severity := syslogSeverities[m.severity]
+	priority, ok := s.config.SyslogPriorityMapping[severity]
+	if !ok {
+		return
+	}
+	r, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/%s", s.config.BaseURL, topic), strings.NewReader(m.message))
+	if err != nil {
+		return
+	}
+	hostname := m.hostname
+	if hostname == "" {
+		hostname, _, _ = net.SplitHostPort(addr)
+	}
+	if m.tag != "" {
+		r.Header.Set("Title", fmt.Sprintf("%s on %s", m.tag, hostname))
+	} else {
+		r.Header.Set("Title", hostname)
+	}
+	r.Header.Set("Priority", strconv.Itoa(priority))
+	r.Header.Set("Tags", fmt.Sprintf("%s,%s", syslogFacilities[m.facility], severity))
+	if s.config.SyslogToken != "" {
+		r.Header.Set("Authorization", bearerAuthPrefix+s.config.SyslogToken)
+	}
+	r.RemoteAddr = addr // Rate limiting is done based on the (for UDP unverified!) address of the sender
+	w := newInternalResponseWriter(nil)
+	s.handle(w, r)
+	if w.code != http.StatusOK && w.code != http.StatusAccepted {
+		log.Printf("[%s] Syslog: Unable to publish message to %s: %s", addr, topic, strings.TrimSpace(w.buf.String()))
+	}
+}
+
+// syslogTopic determines the topic for a tag. The first matching topic rule wins; if no rule matches, the default
+// topic is used, if any.
+func (s *Server) syslogTopic(tag string) (string, bool) {
+	for _, rule := range s.config.SyslogTopicRules {
+		match := rule.Pattern.FindStringSubmatchIndex(tag)
+		if match == nil {
+			continue
+		}
+		topic := string(rule.Pattern.ExpandString(nil, rule.Topic, tag, match))
+		if !topicRegex.MatchString(topic) {
+			log.Printf("Syslog: Rule %s for tag %s results in invalid topic %s", rule.Pattern.String(), tag, topic)
+			return "", false
+		}
+		return topic, true
+	}
+	return s.config.SyslogDefaultTopic, s.config.SyslogDefaultTopic != ""
+}
+
+// readSyslogFrame reads a single message from a TCP stream. Messages may either be prefixed with their length
+// ("octet counting", e.g. "11 <13>1 - ..."), or terminated by a newline ("non-transparent framing"), see RFC 6587.
+// The first character tells them apart, since messages always start with "<".
+func readSyslogFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '0' && first[0] <= '9' {
+		lengthStr, err := reader.ReadString(' ')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSuffix(lengthStr, " "))
+		if err != nil || length <= 0 || length > syslogMessageMaxBytes {
+			return nil, fmt.Errorf("invalid message length %q", strings.TrimSpace(lengthStr))
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+	frame, err := reader.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, fmt.Errorf("message longer than %d bytes", syslogMessageMaxBytes)
+	} else if err != nil && (!errors.Is(err, io.EOF) || len(frame) == 0) {
+		return nil, err
+	}
+	return frame, nil // The newline is trimmed in parseSyslogMessage; the last message may not have one
+}
+
+// parseSyslogMessage parses a message in the RFC 5424 format, or in the much looser RFC 3164 format, which is
+// still what most devices send. Both start with the priority value "<PRI>", which encodes the facility and
+// severity (PRI = facility * 8 + severity). RFC 5424 messages continue with the version "1", followed by a space.
+func parseSyslogMessage(b []byte) (*syslogMessage, error) {
+	s := strings.TrimRight(string(b), "\r\n\x00")
+	end := strings.IndexByte(s, '>')
+	if !strings.HasPrefix(s, "<") || end < 2 || end > 4 {
+		return nil, errSyslogMessageInvalid
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri < 0 || pri >= len(syslogFacilities)*8 {
+		return nil, errSyslogMessageInvalid
+	}
+	m := &syslogMessage{
+		facility: pri / 8,
+		severity: pri % 8,
+	}
+	s = s[end+1:]
+	if strings.HasPrefix(s, "1 ") {
+		if err := parseSyslogRFC5424(m, s[2:]); err != nil {
+			return nil, err
+		}
+	} else {
+		parseSyslogRFC3164(m, s)
+	}
+	return m, nil
+}
+
+// parseSyslogRFC5424 parses the rest of an RFC 5424 message, i.e. "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG",
+// e.g. `2023-10-11T22:14:15.003Z router1 sshd 1234 - [origin ip="10.0.0.1"] Accepted password`
+func parseSyslogRFC5424(m *syslogMessage, s string) error {
+	fields := strings.SplitN(s, " ", 6)
+	if len(fields) < 6 {
+		return errSyslogMessageInvalid
+	}
+	if fields[1] != syslogNilValue {
+		m.hostname = fields[1]
+	}
+	if fields[2] != syslogNilValue {
+		m.tag = fields[2]
+	}
+	if len(m.tag) > syslogTagMaxLength {
+		return errSyslogMessageInvalid
+	}
+	rest, err := skipSyslogStructuredData(fields[5])
+	if err != nil {
+		return err
+	}
+	m.message = strings.TrimPrefix(strings.TrimPrefix(rest, " "), syslogBOM)
+	return nil
+}
+
+// skipSyslogStructuredData skips the STRUCTURED-DATA of an RFC 5424 message, which is either "-", or one or more
+// elements like `[id param="value"]`. Values may contain escaped quotes and brackets, e.g. `"a \"b\" [c\]"`.
+func skipSyslogStructuredData(s string) (string, error) {
+	if strings.HasPrefix(s, syslogNilValue) {
+		return s[1:], nil
+	}
+	i := 0
+	for i < len(s) && s[i] == '[' {
+		quoted := false
+		for i++; i < len(s); i++ {
+			if s[i] == '\\' && quoted {
+				i++
+			} else if s[i] == '"' {
+				quoted = !quoted
+			} else if s[i] == ']' && !quoted {
+				break
+			}
+		}
+		if i >= len(s) {
+			return "", errSyslogMessageInvalid
+		}
+		i++
+	}
+	if i == 0 {
+		return "", errSyslogMessageInvalid
+	}
+	return s[i:], nil
+}
+
+// parseSyslogRFC3164 parses the rest of an RFC 3164 message, i.e. "TIMESTAMP HOSTNAME TAG: MSG", e.g.
+// "Oct 11 22:14:15 router1 sshd[1234]: Accepted password". Many devices leave out the timestamp or the hostname,
+// or send something else entirely, so every part is optional; if nothing matches, everything is the message.
+func parseSyslogRFC3164(m *syslogMessage, s string) {
+	hasTime := false
+	if len(s) >= len(syslogRFC3164Time) {
+		if _, err := time.Parse(syslogRFC3164Time, s[:len(syslogRFC3164Time)]); err == nil {
+			s = strings.TrimPrefix(s[len(syslogRFC3164Time):], " ")
+			hasTime = true
+		}
+	}
+	word, rest := syslogNextWord(s)
+	if hasTime && word != "" && !syslogTagRegex.MatchString(word) {
+		m.hostname = word // The hostname is only expected after a timestamp
+		s = rest
+		word, rest = syslogNextWord(s)
+	}
+	if matches := syslogTagRegex.FindStringSubmatch(word); matches != nil {
+		m.tag = matches[1]
+		s = rest
+	}
+	m.message = s
+}
+
+func syslogNextWord(s string) (string, string) {
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
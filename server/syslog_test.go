@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogMessage_RFC5424(t *testing.T) {
+	m, err := parseSyslogMessage([]byte(`<34>1 2023-10-11T22:14:15.003Z router1 sshd 1234 ID47 [origin ip="10.0.0.1" note="a \"b\" [c\]"][meta x="y"] ` + syslogBOM + "Accepted password for phil\n"))
+	require.Nil(t, err)
+	require.Equal(t, 4, m.facility) // auth
+	require.Equal(t, 2, m.severity) // crit
+	require.Equal(t, "router1", m.hostname)
+	require.Equal(t, "sshd", m.tag)
+	require.Equal(t, "Accepted password for phil", m.message)
+
+	m, err = parseSyslogMessage([]byte(`<165>1 - - - - - -`))
+	require.Nil(t, err)
+	require.Equal(t, 20, m.facility) // local4
+	require.Equal(t, 5, m.severity)  // notice
+	require.Equal(t, "", m.hostname)
+	require.Equal(t, "", m.tag)
+	require.Equal(t, "", m.message)
+}
+
+func TestParseSyslogMessage_RFC3164(t *testing.T) {
+	tests := []struct {
+		input    string
+		hostname string
+		tag      string
+		message  string
+	}{
+		{"<13>Oct 11 22:14:15 router1 sshd[1234]: Accepted password", "router1", "sshd", "Accepted password"},
+		{"<13>Oct  1 22:14:15 nas kernel: disk sda failed", "nas", "kernel", "disk sda failed"},
+		{"<13>Oct 11 22:14:15 backup.sh: Backup done", "", "backup.sh", "Backup done"},
+		{"<13>Oct 11 22:14:15 switch3 Port 4 link down", "switch3", "", "Port 4 link down"},
+		{"<13>upsd: On battery", "", "upsd", "On battery"},
+		{"<189>52: *Mar  1 00:01:23.456: %LINK-3-UPDOWN: Interface Gi0/1, changed state to down", "", "", "52: *Mar  1 00:01:23.456: %LINK-3-UPDOWN: Interface Gi0/1, changed state to down"},
+	}
+	for _, test := range tests {
+		m, err := parseSyslogMessage([]byte(test.input))
+		require.Nil(t, err)
+		require.Equal(t, test.hostname, m.hostname, test.input)
+		require.Equal(t, test.tag, m.tag, test.input)
+		require.Equal(t, test.message, m.message, test.input)
+	}
+}
+
+func TestParseSyslogMessage_Invalid(t *testing.T) {
+	for _, input := range []string{"", "no priority", "<>1 - - - - - -", "<192>too high", "<1234>1 - - - - - -", "<13>1 too few fields", "<13>1 - - - - - [unterminated"} {
+		_, err := parseSyslogMessage([]byte(input))
+		require.Equal(t, errSyslogMessageInvalid, err, input)
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("26 <13>1 - - - - - multi\nline<13>newline\r\n26 <13>Oct 11 22:14:15 a b: c<13>last"))
+	for _, expected := range []string{"<13>1 - - - - - multi\nline", "<13>newline\r\n", "<13>Oct 11 22:14:15 a b: c", "<13>last"} {
+		frame, err := readSyslogFrame(reader)
+		require.Nil(t, err)
+		require.Equal(t, expected, string(frame))
+	}
+	_, err := readSyslogFrame(reader)
+	require.Error(t, err)
+
+	_, err = readSyslogFrame(bufio.NewReader(strings.NewReader("99999999 <13>too long")))
+	require.EqualError(t, err, `invalid message length "99999999"`)
+}
+
+func TestServer_Syslog_UDP(t *testing.T) {
+	c := newTestConfig(t)
+	c.SyslogTopicRules = []*SyslogTopicRule{
+		{Pattern: regexp.MustCompile(`^(?:sshd|sudo)$`), Topic: "auth-logs"},
+		{Pattern: regexp.MustCompile(`^(?:(.+)-backup)$`), Topic: "backups-$1"},
+	}
+	c.SyslogDefaultTopic = "syslog"
+	s := newTestServer(t, c)
+	conn := newTestSyslogConn(t, s)
+
+	for _, line := range []string{
+		"<34>Oct 11 22:14:15 router1 sshd[1234]: Failed password for root",
+		"<14>1 2023-10-11T22:14:15Z nas db-backup - - - Backup done",
+		"<15>Oct 11 22:14:15 router1 sshd[1234]: Debug messages are dropped",
+		"<11>Oct 11 22:14:15 switch3 Port 4 link down",
+		"No syslog message",
+	} {
+		_, err := conn.Write([]byte(line))
+		require.Nil(t, err)
+	}
+	messages := waitForTestSyslogMessages(t, s, "auth-logs", nil)
+	require.Equal(t, "Failed password for root", messages[0].Message)
+	require.Equal(t, "sshd on router1", messages[0].Title)
+	require.Equal(t, 5, messages[0].Priority)
+	require.Equal(t, []string{"auth", "crit"}, messages[0].Tags)
+
+	messages = waitForTestSyslogMessages(t, s, "backups-db", nil)
+	require.Equal(t, "db-backup on nas", messages[0].Title)
+	require.Equal(t, 2, messages[0].Priority)
+	require.Equal(t, []string{"user", "info"}, messages[0].Tags)
+
+	messages = waitForTestSyslogMessages(t, s, "syslog", nil)
+	require.Equal(t, "switch3", messages[0].Title)
+	require.Equal(t, "Port 4 link down", messages[0].Message)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Len(t, toMessages(t, request(t, s, "GET", "/auth-logs/json?poll=1", "", nil).Body.String()), 1) // Debug message was dropped
+}
+
+func TestServer_Syslog_TCP_Token(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	c.SyslogDefaultTopic = "syslog"
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "syslog", true, true))
+	token, err := manager.AddToken("phil", "Syslog", []auth.Grant{{TopicPattern: "syslog", AllowRead: false, AllowWrite: true}}, time.Time{})
+	require.Nil(t, err)
+	s.config.SyslogToken = token.Value
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go s.serveSyslogTCP(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	line := "<11>1 - fw1 - - - - Dropped packets\non eth0"
+	_, err = fmt.Fprintf(conn, "%d %s", len(line), line) // Octet counting, so the message may contain newlines
+	require.Nil(t, err)
+
+	messages := waitForTestSyslogMessages(t, s, "syslog", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, "Dropped packets\non eth0", messages[0].Message)
+	require.Equal(t, "fw1", messages[0].Title)
+}
+
+func TestServer_Syslog_TLS(t *testing.T) {
+	c := newTestConfig(t)
+	c.CertFile, c.KeyFile = newTestSyslogCertFiles(t)
+	c.SyslogListenTLS = "127.0.0.1:0"
+	c.SyslogDefaultTopic = "syslog"
+	s := newTestServer(t, c)
+	go s.runSyslogServer()
+
+	var addr string
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.syslogConns) == 0 {
+			return false
+		}
+		addr = s.syslogConns[0].(net.Listener).Addr().String()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	t.Cleanup(func() { s.syslogConns[0].Close() })
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("<10>Oct 11 22:14:15 ups1 upsd: On battery\n"))
+	require.Nil(t, err)
+
+	messages := waitForTestSyslogMessages(t, s, "syslog", nil)
+	require.Equal(t, "On battery", messages[0].Message)
+	require.Equal(t, "upsd on ups1", messages[0].Title)
+}
+
+func newTestSyslogConn(t *testing.T, s *Server) net.Conn {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go s.serveSyslogUDP(listener)
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func waitForTestSyslogMessages(t *testing.T, s *Server, topic string, headers map[string]string) []*message {
+	var messages []*message
+	require.Eventually(t, func() bool {
+		messages = toMessages(t, request(t, s, "GET", "/"+topic+"/json?poll=1", "", headers).Body.String())
+		return len(messages) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	return messages
+}
+
+func newTestSyslogCertFiles(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	certFile := filepath.Join(t.TempDir(), "cert.pem")
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
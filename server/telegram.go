@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/util"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	telegramAPIURL           = "https://api.telegram.org"
+	telegramRequestTimeout   = 15 * time.Second
+	telegramTopicChatsMax    = 5    // Chats per topic that can be added via the API, see handleTelegramChatAdd
+	telegramTextMaxLength    = 4096 // Of sendMessage, in characters
+	telegramCaptionMaxLength = 1024 // Of sendPhoto and sendDocument, in characters
+	telegramParseModeHTML    = "HTML"
+)
+
+var (
+	telegramPathRegex   = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/telegram$`)
+	telegramChatIDRegex = regexp.MustCompile(`^(-?[0-9]{1,20}|@[A-Za-z][A-Za-z0-9_]{3,31})$`) // Same as in cmd package
+)
+
+// telegramBot sends messages to Telegram chats via the Bot API, as the bot of telegram-bot-token
+type telegramBot struct {
+	baseURL string // Including the bot token, e.g. https://api.telegram.org/bot123:abc
+	client  *http.Client
+}
+
+// telegramRequest is the request of the sendMessage, sendPhoto and sendDocument methods,
+// see https://core.telegram.org/bots/api#sendmessage
+type telegramRequest struct {
+	ChatID              string `json:"chat_id"`
+	Text                string `json:"text,omitempty"`
+	Photo               string `json:"photo,omitempty"`
+	Document            string `json:"document,omitempty"`
+	Caption             string `json:"caption,omitempty"`
+	ParseMode           string `json:"parse_mode"`
+	DisableNotification bool   `json:"disable_notification,omitempty"`
+}
+
+type telegramResponse struct {
+	OK          bool   `json:"ok"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+}
+
+func newTelegramBot(conf *Config) *telegramBot {
+	return &telegramBot{
+		baseURL: fmt.Sprintf("%s/bot%s", telegramAPIURL, conf.TelegramBotToken),
+		client:  &http.Client{Timeout: telegramRequestTimeout},
+	}
+}
+
+// handleTelegramChats returns the Telegram chats that were added to a topic via the API, e.g.
+// {"topic":"alerts","chats":["-1001234567890"]}. Chats of telegram-chat are not included.
+func (s *Server) handleTelegramChats(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	chats, err := s.messageCache.TelegramChats(t.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, &topicTelegramChatsResponse{Topic: t.ID, Chats: chats})
+}
+
+// handleTelegramChatAdd forwards the messages of a topic to a Telegram chat, e.g. {"chat_id":"-1001234567890"}.
+// Like the outgoing webhooks, only owners of the topic may do this, so the routes only exist if access control is enabled.
+func (s *Server) handleTelegramChatAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	chatID, err := readTelegramChatID(r)
+	if err != nil {
+		return err
+	}
+	chats, err := s.messageCache.TelegramChats(t.ID)
+	if err != nil {
+		return err
+	}
+	if !util.InStringList(chats, chatID) {
+		if len(chats) >= telegramTopicChatsMax {
+			return wrapErrHTTP(errHTTPBadRequestTelegramChatInvalid, "at most %d chats are allowed", telegramTopicChatsMax)
+		}
+		if err := s.messageCache.AddTelegramChat(t.ID, chatID); err != nil {
+			return err
+		}
+		chats = append(chats, chatID)
+	}
+	log.Printf("[%s] Forwarding messages of topic %s to Telegram chat %s", v.ip, t.ID, chatID)
+	return writeJSON(w, &topicTelegramChatsResponse{Topic: t.ID, Chats: chats})
+}
+
+// handleTelegramChatRemove stops forwarding the messages of a topic to a Telegram chat
+func (s *Server) handleTelegramChatRemove(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	chatID, err := readTelegramChatID(r)
+	if err != nil {
+		return err
+	}
+	if err := s.messageCache.DeleteTelegramChat(t.ID, chatID); err != nil {
+		return err
+	}
+	chats, err := s.messageCache.TelegramChats(t.ID)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Stopped forwarding messages of topic %s to Telegram chat %s", v.ip, t.ID, chatID)
+	return writeJSON(w, &topicTelegramChatsResponse{Topic: t.ID, Chats: chats})
+}
+
+func readTelegramChatID(r *http.Request) (string, error) {
+	var req telegramChatRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiRequestMaxBytes)).Decode(&req); err != nil {
+		return "", errHTTPBadRequestJSONInvalid
+	} else if !telegramChatIDRegex.MatchString(req.ChatID) {
+		return "", errHTTPBadRequestTelegramChatInvalid
+	}
+	return req.ChatID, nil
+}
+
+// forwardTelegram sends a message to the Telegram chats of its topic, i.e. the chats of telegram-chat and the
+// chats added via the API. Failed deliveries are not retried. This is meant to be called in a goroutine.
+func (s *Server) forwardTelegram(m *message) {
+	if s.telegram == nil || m.Event != messageEvent {
+		return
+	}
+	added, err := s.messageCache.TelegramChats(m.Topic)
+	if err != nil {
+		log.Printf("TELEGRAM - Unable to read chats of topic %s: %v", m.Topic, err.Error())
+		return
+	}
+	chats := make([]string, 0)
+	for _, chatID := range append(append(chats, s.config.TelegramChats[m.Topic]...), added...) {
+		if !util.InStringList(chats, chatID) {
+			chats = append(chats, chatID)
+		}
+	}
+	for _, chatID := range chats {
+		if err := s.telegram.send(chatID, m); err != nil {
+			log.Printf("TELEGRAM - Unable to forward message %s of topic %s to chat %s: %v", m.ID, m.Topic, chatID, err.Error())
+		}
+	}
+}
+
+// send sends a message to a chat. Low priority messages are sent silently, and attachments are sent as photos
+// (images) or documents, with the message as caption. Telegram downloads the attachment itself, so if that fails
+// (e.g. because the server is not reachable from the internet), the message is sent with a link instead.
+func (b *telegramBot) send(chatID string, m *message) error {
+	silent := m.Priority == 1 || m.Priority == 2
+	if m.Attachment != nil {
+		req := &telegramRequest{ChatID: chatID, Caption: toTelegramText(m, telegramCaptionMaxLength, false), ParseMode: telegramParseModeHTML, DisableNotification: silent}
+		method := "sendDocument"
+		if strings.HasPrefix(m.Attachment.Type, "image/") {
+			method, req.Photo = "sendPhoto", m.Attachment.URL
+		} else {
+			req.Document = m.Attachment.URL
+		}
+		err := b.do(method, req)
+		if err == nil {
+			return nil
+		}
+		log.Printf("TELEGRAM - Unable to send attachment of message %s to chat %s, sending link instead: %v", m.ID, chatID, err.Error())
+	}
+	return b.do("sendMessage", &telegramRequest{ChatID: chatID, Text: toTelegramText(m, telegramTextMaxLength, true), ParseMode: telegramParseModeHTML, DisableNotification: silent})
+}
+
+func (b *telegramBot) do(method string, req *telegramRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Post(fmt.Sprintf("%s/%s", b.baseURL, method), "application/json", bytes.NewReader(body))
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err // The URL contains the bot token, which must not end up in the logs
+	} else if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var response telegramResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, apiRequestMaxBytes)).Decode(&response); err != nil {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	} else if !response.OK {
+		return fmt.Errorf("error %d: %s", response.ErrorCode, response.Description)
+	}
+	return nil
+}
+
+// toTelegramText formats a message as HTML: the emojis of the tags and the title in bold, followed by the message,
+// the remaining tags, and the click URL. If withAttachment is set, the attachment link is included as well. The
+// message is cut off to fit into maxLength, which Telegram applies to the text without the HTML tags.
+func toTelegramText(m *message, maxLength int, withAttachment bool) string {
+	emojis, tags, err := toEmojis(m.Tags)
+	if err != nil {
+		emojis, tags = make([]string, 0), m.Tags
+	}
+	lines, footer := make([]string, 0), make([]string, 0)
+	length := 0
+	if len(emojis) > 0 || m.Title != "" {
+		title := strings.Join(emojis, " ")
+		if m.Title != "" {
+			title = strings.TrimSpace(title + " <b>" + html.EscapeString(m.Title) + "</b>")
+		}
+		lines = append(lines, title)
+		length += utf8.RuneCountInString(strings.Join(emojis, " ")+" "+m.Title) + 1
+	}
+	if len(tags) > 0 {
+		text := "Tags: " + strings.Join(tags, ", ")
+		footer = append(footer, "<i>"+html.EscapeString(text)+"</i>")
+		length += utf8.RuneCountInString(text) + 1
+	}
+	if withAttachment && m.Attachment != nil {
+		name := m.Attachment.Name
+		if name == "" {
+			name = m.Attachment.URL
+		}
+		footer = append(footer, fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(m.Attachment.URL), html.EscapeString(name)))
+		length += utf8.RuneCountInString(name) + 1
+	}
+	if m.Click != "" {
+		footer = append(footer, html.EscapeString(m.Click))
+		length += utf8.RuneCountInString(m.Click) + 1
+	}
+	if m.Encoding == "" && m.Message != "" { // Binary messages are left out
+		lines = append(lines, html.EscapeString(truncateRunes(m.Message, maxLength-length)))
+	}
+	return strings.Join(append(lines, footer...), "\n")
+}
+
+// truncateRunes cuts off a string after maxLength characters (not bytes), ending it with an ellipsis
+func truncateRunes(s string, maxLength int) string {
+	if utf8.RuneCountInString(s) <= maxLength {
+		return s
+	} else if maxLength <= 1 {
+		return ""
+	}
+	return string([]rune(s)[:maxLength-1]) + "…"
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTelegramBotToken = "123456:ABC-DEF"
+
+type testTelegramRequest struct {
+	method string
+	req    *telegramRequest
+}
+
+func TestServer_Telegram_Forward(t *testing.T) {
+	c := newTestConfig(t)
+	c.TelegramChats = map[string][]string{"alerts": {"-1001234567890"}}
+	c.TelegramBotToken = testTelegramBotToken
+	s, phil := newTestServerWithTopicOwner(t, c, "alerts", "other")
+	requests := startTestTelegramAPI(t, s)
+
+	response := request(t, s, "PUT", "/alerts/telegram", `{"chat_id":"@ops_alerts"}`, phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"topic":"alerts","chats":["@ops_alerts"]}`+"\n", response.Body.String())
+
+	request(t, s, "PUT", "/alerts", "Disk <90%", map[string]string{"Title": "Server down", "Tags": "warning,backup", "Priority": "2", "Click": "https://example.com/logs", "Authorization": phil["Authorization"]})
+	first, second := readTestTelegramRequest(t, requests), readTestTelegramRequest(t, requests)
+	require.Equal(t, "sendMessage", first.method)
+	require.Equal(t, "-1001234567890", first.req.ChatID)
+	require.Equal(t, "@ops_alerts", second.req.ChatID)
+	require.Equal(t, "⚠️ <b>Server down</b>\nDisk &lt;90%\n<i>Tags: backup</i>\nhttps://example.com/logs", first.req.Text)
+	require.Equal(t, telegramParseModeHTML, first.req.ParseMode)
+	require.True(t, first.req.DisableNotification)
+
+	request(t, s, "PUT", "/alerts", "Urgent", map[string]string{"Priority": "5", "Authorization": phil["Authorization"]})
+	require.False(t, readTestTelegramRequest(t, requests).req.DisableNotification)
+	readTestTelegramRequest(t, requests)
+
+	request(t, s, "PUT", "/other", "Not forwarded", phil)
+	response = request(t, s, "DELETE", "/alerts/telegram", `{"chat_id":"@ops_alerts"}`, phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"topic":"alerts","chats":[]}`+"\n", response.Body.String())
+	request(t, s, "PUT", "/alerts", "Only to the configured chat", phil)
+	require.Equal(t, "-1001234567890", readTestTelegramRequest(t, requests).req.ChatID)
+	select {
+	case req := <-requests:
+		t.Fatalf("unexpected Telegram request to chat %s", req.req.ChatID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_Telegram_Attachment(t *testing.T) {
+	s, requests := newTestTelegramServer(t, newTestConfig(t))
+	m := newDefaultMessage("alerts", "Camera triggered")
+	m.Attachment = &attachment{Name: "front-door.jpg", Type: "image/jpeg", URL: "https://example.com/file/front-door.jpg"}
+	require.Nil(t, s.telegram.send("123456", m))
+	req := readTestTelegramRequest(t, requests)
+	require.Equal(t, "sendPhoto", req.method)
+	require.Equal(t, "https://example.com/file/front-door.jpg", req.req.Photo)
+	require.Equal(t, "Camera triggered", req.req.Caption)
+
+	// The test server rejects documents, so the message is sent with a link instead
+	m.Attachment = &attachment{Name: "report.pdf", Type: "application/pdf", URL: "https://example.com/file/report.pdf"}
+	require.Nil(t, s.telegram.send("123456", m))
+	req = readTestTelegramRequest(t, requests)
+	require.Equal(t, "sendMessage", req.method)
+	require.Equal(t, "Camera triggered\n<a href=\"https://example.com/file/report.pdf\">report.pdf</a>", req.req.Text)
+}
+
+func TestServer_Telegram_Auth(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s, _ := newTestTelegramServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "alerts", true, true))
+	require.Nil(t, manager.AllowAccess("ben", "alerts", true, false))
+
+	response := request(t, s, "PUT", "/alerts/telegram", `{"chat_id":"123456"}`, map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/alerts/telegram", `{"chat_id":"123456"}`, map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/alerts/telegram", "", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/alerts/telegram", "", map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"topic":"alerts","chats":["123456"]}`+"\n", response.Body.String())
+}
+
+func TestServer_Telegram_Invalid(t *testing.T) {
+	c := newTestConfig(t)
+	c.TelegramBotToken = testTelegramBotToken
+	s, phil := newTestServerWithTopicOwner(t, c, "alerts")
+	response := request(t, s, "PUT", "/alerts/telegram", `{"chat_id":"not a chat"}`, phil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40057, toHTTPError(t, response.Body.String()).Code)
+
+	for i := 0; i < telegramTopicChatsMax; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/alerts/telegram", `{"chat_id":"`+strings.Repeat("1", i+1)+`"}`, phil).Code)
+	}
+	response = request(t, s, "PUT", "/alerts/telegram", `{"chat_id":"999999"}`, phil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40057, toHTTPError(t, response.Body.String()).Code)
+
+	s = newTestServer(t, newTestConfig(t)) // Telegram disabled
+	response = request(t, s, "PUT", "/alerts/telegram", `{"chat_id":"123456"}`, nil)
+	require.Equal(t, 404, response.Code)
+
+	s, _ = newTestTelegramServer(t, newTestConfig(t)) // Access control disabled, so nobody owns a topic
+	response = request(t, s, "PUT", "/alerts/telegram", `{"chat_id":"123456"}`, nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestToTelegramText_Truncated(t *testing.T) {
+	m := newDefaultMessage("alerts", strings.Repeat("x", 2000))
+	m.Title = "Long message"
+	text := toTelegramText(m, telegramCaptionMaxLength, false)
+	require.True(t, strings.HasPrefix(text, "<b>Long message</b>\nxxx"))
+	require.True(t, strings.HasSuffix(text, "x…"))
+	require.LessOrEqual(t, len([]rune(text))-len("<b></b>"), telegramCaptionMaxLength)
+}
+
+// newTestTelegramServer creates a server that forwards messages to a fake Telegram Bot API, see startTestTelegramAPI
+func newTestTelegramServer(t *testing.T, c *Config) (*Server, chan *testTelegramRequest) {
+	c.TelegramBotToken = testTelegramBotToken
+	s := newTestServer(t, c)
+	return s, startTestTelegramAPI(t, s)
+}
+
+// startTestTelegramAPI points the Telegram bot of the server to a fake Telegram Bot API, which rejects sendDocument
+// requests, and passes all other requests to the returned channel
+func startTestTelegramAPI(t *testing.T, s *Server) chan *testTelegramRequest {
+	requests := make(chan *testTelegramRequest, 10)
+	telegramServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.TrimPrefix(r.URL.Path, "/bot"+testTelegramBotToken+"/")
+		if method == "sendDocument" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"ok":false,"error_code":400,"description":"Bad Request: failed to get HTTP URL content"}`)
+			return
+		}
+		var req telegramRequest
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		requests <- &testTelegramRequest{method: method, req: &req}
+		io.WriteString(w, `{"ok":true,"result":{}}`)
+	}))
+	t.Cleanup(telegramServer.Close)
+	s.telegram.baseURL = telegramServer.URL + "/bot" + testTelegramBotToken
+	return requests
+}
+
+func readTestTelegramRequest(t *testing.T, requests chan *testTelegramRequest) *testTelegramRequest {
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Telegram request")
+		return nil
+	}
+}
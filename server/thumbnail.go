@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"heckel.io/ntfy/util"
+	"image"
+	"image/color"
+	_ "image/gif" // Registers the GIF decoder
+	"image/jpeg"
+	_ "image/png" // Registers the PNG decoder
+)
+
+const (
+	thumbnailMaxSize      = 640 // Longest edge in pixels, roughly the width of a notification in the web app
+	thumbnailMaxPixels    = 40 * 1000 * 1000
+	thumbnailJPEGQuality  = 80
+	thumbnailSamples      = 4        // Max. number of samples per axis for each thumbnail pixel, see scaleImage
+	thumbnailFileIDSuffix = "-thumb" // Appended to the file ID of the attachment, see thumbnailFileID
+)
+
+var (
+	thumbnailMimeTypes   = []string{"image/jpeg", "image/png", "image/gif"}
+	errThumbnailTooLarge = errors.New("image too large for thumbnail")
+)
+
+// thumbnailSupported returns true if thumbnails can be created for images of the given mime type
+func thumbnailSupported(mimeType string) bool {
+	return util.InStringList(thumbnailMimeTypes, mimeType)
+}
+
+// thumbnailFileID returns the ID under which the thumbnail of the given file is stored in the attachment cache
+func thumbnailFileID(id string) string {
+	return id + thumbnailFileIDSuffix
+}
+
+// withThumbnailFileIDs returns the given file IDs, plus the IDs of their thumbnails, which may or may not exist
+func withThumbnailFileIDs(ids []string) []string {
+	all := make([]string, 0, 2*len(ids))
+	for _, id := range ids {
+		all = append(all, id, thumbnailFileID(id))
+	}
+	return all
+}
+
+// createThumbnail decodes the JPEG, PNG or GIF image (only the first frame) and scales it down to a JPEG, such that
+// its longest edge is at most thumbnailMaxSize pixels. It returns nil if the image is small enough already, in which
+// case clients can simply use the original.
+func createThumbnail(b []byte) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	} else if config.Width*config.Height > thumbnailMaxPixels {
+		return nil, errThumbnailTooLarge // Decoding would take too long and use too much memory
+	} else if config.Width <= thumbnailMaxSize && config.Height <= thumbnailMaxSize {
+		return nil, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	width, height := thumbnailMaxSize, config.Height*thumbnailMaxSize/config.Width
+	if config.Height > config.Width {
+		width, height = config.Width*thumbnailMaxSize/config.Height, thumbnailMaxSize
+	}
+	thumbnail := scaleImage(img, maxInt(width, 1), maxInt(height, 1))
+	if format == "jpeg" {
+		thumbnail = orientImage(thumbnail, jpegOrientation(b)) // The EXIF data is lost when re-encoding
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: thumbnailJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleImage scales the image down to the given size by averaging the source pixels of each target pixel. To keep
+// this fast for large photos, at most thumbnailSamples x thumbnailSamples of these pixels are sampled. Transparent
+// pixels are put on a white background, since JPEG has no alpha channel.
+func scaleImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	bounds := src.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	for y := 0; y < height; y++ {
+		y0, y1 := bounds.Min.Y+y*srcHeight/height, bounds.Min.Y+maxInt((y+1)*srcHeight/height, y*srcHeight/height+1)
+		stepY := maxInt((y1-y0)/thumbnailSamples, 1)
+		for x := 0; x < width; x++ {
+			x0, x1 := bounds.Min.X+x*srcWidth/width, bounds.Min.X+maxInt((x+1)*srcWidth/width, x*srcWidth/width+1)
+			stepX := maxInt((x1-x0)/thumbnailSamples, 1)
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy += stepY {
+				for sx := x0; sx < x1; sx += stepX {
+					sr, sg, sb, sa := src.At(sx, sy).RGBA() // Alpha-premultiplied
+					r, g, b, a, n = r+sr, g+sg, b+sb, a+sa, n+1
+				}
+			}
+			background := 0xffff - a/n
+			dst.Set(x, y, color.RGBA64{R: uint16(r/n + background), G: uint16(g/n + background), B: uint16(b/n + background), A: 0xffff})
+		}
+	}
+	return dst
+}
+
+// orientImage rotates and/or flips the image according to the EXIF orientation (1-8), so that it is displayed
+// the right way up
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dstWidth, dstHeight := w, h
+	if orientation >= 5 {
+		dstWidth, dstHeight = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Flipped horizontally
+				sx, sy = w-1-x, y
+			case 3: // Rotated by 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // Flipped vertically
+				sx, sy = x, h-1-y
+			case 5: // Transposed
+				sx, sy = y, x
+			case 6: // Rotated by 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // Transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // Rotated by 90° counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the orientation (1-8) from the EXIF data of the JPEG image, or 1 if it has none
+func jpegOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return 1
+		}
+		marker := b[i+1]
+		if marker == 0xDA || marker == 0xD9 { // Start of scan or end of image: no more metadata
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		if length < 2 || i+2+length > len(b) {
+			return 1
+		}
+		segment := b[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of the EXIF TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	if string(tiff[:2]) == "II" {
+		order = binary.LittleEndian
+	} else if string(tiff[:2]) == "MM" {
+		order = binary.BigEndian
+	} else {
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 { // Orientation, type SHORT
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestCreateThumbnail_Landscape(t *testing.T) {
+	thumbnail, err := createThumbnail(newTestPNG(t, 1000, 500, color.RGBA{R: 255, A: 255}))
+	require.Nil(t, err)
+	img := decodeTestJPEG(t, thumbnail)
+	require.Equal(t, image.Rect(0, 0, 640, 320), img.Bounds())
+	r, g, b, _ := img.At(320, 160).RGBA()
+	require.Greater(t, r>>8, uint32(240))
+	require.Less(t, g>>8, uint32(20))
+	require.Less(t, b>>8, uint32(20))
+}
+
+func TestCreateThumbnail_Portrait(t *testing.T) {
+	thumbnail, err := createThumbnail(newTestPNG(t, 300, 2000, color.RGBA{B: 255, A: 255}))
+	require.Nil(t, err)
+	require.Equal(t, image.Rect(0, 0, 96, 640), decodeTestJPEG(t, thumbnail).Bounds())
+}
+
+func TestCreateThumbnail_SmallImage(t *testing.T) {
+	thumbnail, err := createThumbnail(newTestPNG(t, 640, 100, color.RGBA{R: 255, A: 255}))
+	require.Nil(t, err)
+	require.Nil(t, thumbnail)
+}
+
+func TestCreateThumbnail_TransparentOnWhite(t *testing.T) {
+	thumbnail, err := createThumbnail(newTestPNG(t, 1000, 1000, color.RGBA{}))
+	require.Nil(t, err)
+	r, g, b, _ := decodeTestJPEG(t, thumbnail).At(10, 10).RGBA()
+	require.Greater(t, r>>8, uint32(240))
+	require.Greater(t, g>>8, uint32(240))
+	require.Greater(t, b>>8, uint32(240))
+}
+
+func TestCreateThumbnail_JPEGOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 800, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 800; x++ {
+			if x < 400 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255}) // Left half is red, right half is blue
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	require.Nil(t, jpeg.Encode(&buf, img, nil))
+	photo := withTestEXIFOrientation(buf.Bytes(), 6) // Rotate by 90° clockwise when displaying
+	require.Equal(t, 6, jpegOrientation(photo))
+
+	thumbnail, err := createThumbnail(photo)
+	require.Nil(t, err)
+	rotated := decodeTestJPEG(t, thumbnail)
+	require.Equal(t, image.Rect(0, 0, 320, 640), rotated.Bounds())
+	r, _, b, _ := rotated.At(160, 100).RGBA() // Red is now on top
+	require.Greater(t, r, b)
+	r, _, b, _ = rotated.At(160, 540).RGBA()
+	require.Greater(t, b, r)
+}
+
+func TestCreateThumbnail_TooLarge(t *testing.T) {
+	header := []byte("GIF89a")
+	header = append(header, 0x10, 0x27, 0x10, 0x27, 0, 0, 0) // 10000x10000 pixels, no color table
+	_, err := createThumbnail(header)
+	require.Equal(t, errThumbnailTooLarge, err)
+}
+
+func TestCreateThumbnail_Invalid(t *testing.T) {
+	_, err := createThumbnail([]byte("this is not an image"))
+	require.Error(t, err)
+	require.Equal(t, 1, jpegOrientation([]byte("this is not an image")))
+}
+
+func TestOrientImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1)) // Two pixels: red, blue
+	img.SetRGBA(0, 0, color.RGBA{R: 255, A: 255})
+	img.SetRGBA(1, 0, color.RGBA{B: 255, A: 255})
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	for orientation, expected := range map[int][]color.RGBA{
+		1: {red, blue},
+		2: {blue, red},
+		3: {blue, red},
+		6: {red, blue}, // Column, top to bottom
+		8: {blue, red},
+	} {
+		oriented := orientImage(img, orientation)
+		if orientation >= 5 {
+			require.Equal(t, image.Rect(0, 0, 1, 2), oriented.Bounds())
+			require.Equal(t, expected, []color.RGBA{oriented.RGBAAt(0, 0), oriented.RGBAAt(0, 1)}, orientation)
+		} else {
+			require.Equal(t, expected, []color.RGBA{oriented.RGBAAt(0, 0), oriented.RGBAAt(1, 0)}, orientation)
+		}
+	}
+}
+
+func newTestPNG(t *testing.T, width, height int, c color.RGBA) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func decodeTestJPEG(t *testing.T, b []byte) image.Image {
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	require.Nil(t, err)
+	return img
+}
+
+// withTestEXIFOrientation inserts an APP1 segment with a minimal big-endian EXIF structure right after the SOI marker
+func withTestEXIFOrientation(b []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08") // Header, first IFD at offset 8
+	tiff = append(tiff, 0, 1)                    // One entry
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112) // Orientation
+	binary.BigEndian.PutUint16(entry[2:], 3)      // SHORT
+	binary.BigEndian.PutUint32(entry[4:], 1)      // Count
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0) // No next IFD
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(segment)+2))
+	app1 := append(append([]byte{0xFF, 0xE1}, length...), segment...)
+	return append(append(append([]byte{}, b[:2]...), app1...), b[2:]...)
+}
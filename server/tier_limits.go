@@ -0,0 +1,173 @@
+package server
+
+import (
+	"golang.org/x/time/rate"
+	"heckel.io/ntfy/auth"
+	"net/http"
+	"time"
+)
+
+const (
+	tierAttachmentOwnerPrefix = "user:" // Owner of attachments that count towards a tier's attachment quota
+)
+
+// tierLimiter holds the daily message, e-mail, SMS and phone call limiters of a user whose tier sets these limits. Unlike the
+// visitor's limiters, which are per IP address, they apply to the user across all of its devices.
+type tierLimiter struct {
+	tier     auth.Tier
+	messages *rate.Limiter // May be nil if the tier does not limit messages
+	emails   *rate.Limiter // May be nil if the tier does not limit e-mails
+	sms      *rate.Limiter // May be nil if the tier does not set an SMS limit
+	calls    *rate.Limiter // May be nil if the tier does not set a phone call limit
+}
+
+func newTierLimiter(tier *auth.Tier) *tierLimiter {
+	return &tierLimiter{
+		tier:     *tier,
+		messages: newDailyLimiter(tier.MessagesLimit),
+		emails:   newDailyLimiter(tier.EmailsLimit),
+		sms:      newDailyLimiter(tier.SMSLimit),
+		calls:    newDailyLimiter(tier.CallsLimit),
+	}
+}
+
+// tierLimiter returns the limiters of the authenticated user, or nil if the user is not in a tier. If the limits
+// of the tier were changed (or the user was moved to another tier), the limiters are recreated.
+func (s *Server) tierLimiter(r *http.Request) *tierLimiter {
+	user := userFromRequest(r)
+	if user == nil || user.Tier == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tierLimiterFromUser(user)
+}
+
+// tierLimiterFromUser is like tierLimiter, but for a user outside of a request, e.g. the owner of an escalation
+// chain. Must be called with s.mu held.
+func (s *Server) tierLimiterFromUser(user *auth.User) *tierLimiter {
+	if user == nil || user.Tier == nil {
+		return nil
+	}
+	limiter, ok := s.tierLimiters[user.Name]
+	if !ok || limiter.tier != *user.Tier {
+		limiter = newTierLimiter(user.Tier)
+		s.tierLimiters[user.Name] = limiter
+	}
+	return limiter
+}
+
+// messageAllowed checks the daily message limit of the user's tier, or the visitor's limit if the tier does not set one
+func (s *Server) messageAllowed(r *http.Request, v *visitor) error {
+	return s.messagesAllowed(r, v, 1)
+}
+
+// messagesAllowed is like messageAllowed, but for n messages at once, e.g. a batch (see handlePublishBatch).
+// If the limit does not allow all of them, none are counted.
+func (s *Server) messagesAllowed(r *http.Request, v *visitor, n int) error {
+	if limiter := s.tierLimiter(r); limiter != nil && limiter.messages != nil {
+		if !limiter.messages.AllowN(time.Now(), n) {
+			return errHTTPTooManyRequestsLimitMessages
+		}
+		return nil
+	}
+	if err := v.MessagesAllowed(n); err != nil {
+		return errHTTPTooManyRequestsLimitMessages
+	}
+	return nil
+}
+
+// emailAllowed checks the daily e-mail limit of the user's tier, or the visitor's limit if the tier does not set one
+func (s *Server) emailAllowed(r *http.Request, v *visitor) error {
+	if limiter := s.tierLimiter(r); limiter != nil && limiter.emails != nil {
+		if !limiter.emails.Allow() {
+			return errHTTPTooManyRequestsLimitEmails
+		}
+		return nil
+	}
+	if err := v.EmailAllowed(); err != nil {
+		return errHTTPTooManyRequestsLimitEmails
+	}
+	return nil
+}
+
+// userEmailAllowed is like emailAllowed, but for a user outside of a request, see tierLimiterFromUser. Must be called
+// with s.mu held.
+func (s *Server) userEmailAllowed(user *auth.User, v *visitor) error {
+	if limiter := s.tierLimiterFromUser(user); limiter != nil && limiter.emails != nil {
+		if !limiter.emails.Allow() {
+			return errHTTPTooManyRequestsLimitEmails
+		}
+		return nil
+	}
+	if err := v.EmailAllowed(); err != nil {
+		return errHTTPTooManyRequestsLimitEmails
+	}
+	return nil
+}
+
+// smsAllowed checks the daily SMS limit of the user's tier, or the visitor's limit if the tier does not set one
+func (s *Server) smsAllowed(r *http.Request, v *visitor) error {
+	if limiter := s.tierLimiter(r); limiter != nil && limiter.sms != nil {
+		if !limiter.sms.Allow() {
+			return errHTTPTooManyRequestsLimitSMS
+		}
+		return nil
+	}
+	if err := v.SMSAllowed(); err != nil {
+		return errHTTPTooManyRequestsLimitSMS
+	}
+	return nil
+}
+
+// callAllowed checks the daily phone call limit of the user's tier, or the visitor's limit if the tier does not set one
+func (s *Server) callAllowed(r *http.Request, v *visitor) error {
+	if limiter := s.tierLimiter(r); limiter != nil && limiter.calls != nil {
+		if !limiter.calls.Allow() {
+			return errHTTPTooManyRequestsLimitCalls
+		}
+		return nil
+	}
+	if err := v.CallAllowed(); err != nil {
+		return errHTTPTooManyRequestsLimitCalls
+	}
+	return nil
+}
+
+// userCallAllowed is like callAllowed, but for a user outside of a request, see tierLimiterFromUser. Must be called
+// with s.mu held.
+func (s *Server) userCallAllowed(user *auth.User, v *visitor) error {
+	if limiter := s.tierLimiterFromUser(user); limiter != nil && limiter.calls != nil {
+		if !limiter.calls.Allow() {
+			return errHTTPTooManyRequestsLimitCalls
+		}
+		return nil
+	}
+	if err := v.CallAllowed(); err != nil {
+		return errHTTPTooManyRequestsLimitCalls
+	}
+	return nil
+}
+
+// attachmentQuota returns the owner of new attachments, and the total size of the attachments they may store. Users
+// whose tier sets an attachment quota own their attachments, everybody else shares the quota of their IP address.
+func (s *Server) attachmentQuota(r *http.Request, v *visitor) (owner string, limit int64) {
+	if user := userFromRequest(r); user != nil && user.Tier != nil && user.Tier.AttachmentTotalSizeLimit > 0 {
+		return tierAttachmentOwnerPrefix + user.Name, user.Tier.AttachmentTotalSizeLimit
+	}
+	return v.ip, s.config.VisitorAttachmentTotalSizeLimit
+}
+
+// visitorStats returns the attachment stats of the visitor, or of the user if their tier sets an attachment quota
+func (s *Server) visitorStats(r *http.Request, v *visitor) (*visitorStats, error) {
+	owner, limit := s.attachmentQuota(r, v)
+	return v.StatsFor(owner, limit)
+}
+
+// maxDelay returns how far into the future the user may schedule messages, which may be raised by their tier
+func (s *Server) maxDelay(r *http.Request) time.Duration {
+	if user := userFromRequest(r); user != nil && user.Tier != nil && user.Tier.MaxDelay > 0 {
+		return user.Tier.MaxDelay
+	}
+	return s.config.MaxDelay
+}
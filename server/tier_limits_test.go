@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_TierLimits_Messages(t *testing.T) {
+	s := newTestServerWithTierUser(t, &auth.Tier{Code: "pro", MessagesLimit: 4})
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/mytopic", "anonymous", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "anonymous", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42907, toHTTPError(t, response.Body.String()).Code)
+
+	for i := 0; i < 4; i++ {
+		response = request(t, s, "PUT", "/mytopic", "from ben", map[string]string{
+			"Authorization": basicAuth("ben:ben"),
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	response = request(t, s, "PUT", "/mytopic", "from ben", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42907, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_TierLimits_ChangedTierResetsLimiter(t *testing.T) {
+	s := newTestServerWithTierUser(t, &auth.Tier{Code: "pro", MessagesLimit: 1})
+	response := request(t, s, "PUT", "/mytopic", "from ben", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "from ben", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 429, response.Code)
+
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.UpdateTier(&auth.Tier{Code: "pro", MessagesLimit: 10}))
+	response = request(t, s, "PUT", "/mytopic", "from ben", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_TierLimits_AttachmentQuota(t *testing.T) {
+	s := newTestServerWithTierUser(t, &auth.Tier{Code: "pro", MessagesLimit: 100, AttachmentTotalSizeLimit: 20000})
+	response := request(t, s, "PUT", "/mytopic", util.RandomString(6000), nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(6000), nil)
+	require.Equal(t, 413, response.Code)
+
+	// Ben's attachments have their own quota, independent of the IP address
+	for i := 0; i < 3; i++ {
+		response = request(t, s, "PUT", "/mytopic", util.RandomString(6000), map[string]string{
+			"Authorization": basicAuth("ben:ben"),
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(6000), map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 413, response.Code)
+
+	response = request(t, s, "GET", "/user/stats", "", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	var stats visitorStats
+	require.Nil(t, json.NewDecoder(strings.NewReader(response.Body.String())).Decode(&stats))
+	require.Equal(t, int64(20000), stats.VisitorAttachmentBytesTotal)
+	require.Equal(t, int64(18000), stats.VisitorAttachmentBytesUsed)
+	require.Equal(t, int64(2000), stats.VisitorAttachmentBytesRemaining)
+}
+
+func TestServer_TierLimits_MaxDelay(t *testing.T) {
+	s := newTestServerWithTierUser(t, &auth.Tier{Code: "pro", MaxDelay: 7 * 24 * time.Hour})
+	response := request(t, s, "PUT", "/mytopic?delay=100h", "anonymous", nil)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "PUT", "/mytopic?delay=100h", "from ben", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic?delay=200h", "from ben", map[string]string{
+		"Authorization": basicAuth("ben:ben"),
+	})
+	require.Equal(t, 400, response.Code)
+}
+
+func newTestServerWithTierUser(t *testing.T, tier *auth.Tier) *Server {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.VisitorMessageDailyLimit = 2
+	c.VisitorAttachmentTotalSizeLimit = 10000
+	c.MaxDelay = 72 * time.Hour
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AddTier(tier))
+	require.Nil(t, manager.ChangeTier("ben", tier.Code))
+	return s
+}
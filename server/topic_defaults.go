@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/ntfy/util"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	topicDefaultsTagsMax = 10
+)
+
+var (
+	topicDefaultsPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/defaults$`)
+)
+
+// handleTopicDefaults returns the default message fields of a topic, e.g. {"topic":"backups","priority":2,"tags":["backup"]}
+func (s *Server) handleTopicDefaults(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	defaults, err := s.messageCache.TopicDefaults(t.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, defaults)
+}
+
+// handleTopicDefaultsUpdate replaces the default message fields of a topic, so that publishers don't have to pass
+// the same headers every time. Like handleTopicInfoUpdate, fields that are not passed are cleared, an empty object
+// removes the defaults, and only owners of the topic may do this if access control is enabled.
+func (s *Server) handleTopicDefaultsUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if s.auth != nil && !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	var defaults topicDefaults
+	if err := json.NewDecoder(io.LimitReader(r.Body, 2*apiRequestMaxBytes)).Decode(&defaults); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	defaults.Topic = t.ID
+	tags := make([]string, 0)
+	for _, tag := range defaults.Tags {
+		if tag = strings.TrimSpace(tag); strings.Contains(tag, ",") {
+			return errHTTPBadRequestTopicDefaultsInvalid // Tags are stored comma-separated
+		} else if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if defaults.Priority < 0 || defaults.Priority > 5 || len(tags) > topicDefaultsTagsMax {
+		return errHTTPBadRequestTopicDefaultsInvalid
+	}
+	defaults.Tags = nil
+	if len(tags) > 0 {
+		defaults.Tags = tags
+	}
+	if defaults.Title == "" && defaults.Priority == 0 && len(defaults.Tags) == 0 && defaults.Click == "" {
+		err = s.messageCache.DeleteTopicDefaults(t.ID)
+	} else {
+		err = s.messageCache.UpdateTopicDefaults(&defaults)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Updated default message fields of topic %s", v.ip, t.ID)
+	return writeJSON(w, &defaults)
+}
+
+// applyTopicDefaults sets the fields of the message that the publisher didn't set to the defaults of its topic.
+// Default tags are added to the tags of the message, unless it already has them.
+func (s *Server) applyTopicDefaults(m *message) error {
+	defaults, err := s.messageCache.TopicDefaults(m.Topic)
+	if err != nil {
+		return err
+	}
+	if m.Title == "" {
+		m.Title = defaults.Title
+	}
+	if m.Priority == 0 {
+		m.Priority = defaults.Priority
+	}
+	if m.Click == "" {
+		m.Click = defaults.Click
+	}
+	for _, tag := range defaults.Tags {
+		if !util.InStringList(m.Tags, tag) {
+			m.Tags = append(m.Tags, tag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServer_TopicDefaults(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/backups/defaults", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, &topicDefaults{Topic: "backups"}, toTopicDefaults(t, response.Body.String()))
+
+	response = request(t, s, "PUT", "/backups/defaults", `{"title":"Backup","priority":2,"tags":["backup"," floppy_disk "],"click":"https://backup.example.com"}`, nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/backups/defaults", "", nil)
+	require.Equal(t, &topicDefaults{
+		Topic:    "backups",
+		Title:    "Backup",
+		Priority: 2,
+		Tags:     []string{"backup", "floppy_disk"},
+		Click:    "https://backup.example.com",
+	}, toTopicDefaults(t, response.Body.String()))
+
+	response = request(t, s, "PUT", "/backups", "Backup of phils-laptop succeeded", nil)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Backup", m.Title)
+	require.Equal(t, 2, m.Priority)
+	require.Equal(t, []string{"backup", "floppy_disk"}, m.Tags)
+	require.Equal(t, "https://backup.example.com", m.Click)
+
+	response = request(t, s, "PUT", "/backups", "Backup of phils-laptop failed", map[string]string{
+		"Title":    "Backup failed",
+		"Priority": "high",
+		"Tags":     "warning,backup",
+	})
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, "Backup failed", m.Title)
+	require.Equal(t, 4, m.Priority)
+	require.Equal(t, []string{"warning", "backup", "floppy_disk"}, m.Tags)
+
+	response = request(t, s, "POST", "/", `{"topic":"backups","message":"Published as JSON"}`, nil)
+	require.Equal(t, 2, toMessage(t, response.Body.String()).Priority)
+	response = request(t, s, "PUT", "/mytopic", "No defaults here", nil)
+	require.Equal(t, 0, toMessage(t, response.Body.String()).Priority)
+
+	response = request(t, s, "PUT", "/backups/defaults", `{}`, nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/backups", "Back to normal", nil)
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, "", m.Title)
+	require.Empty(t, m.Tags)
+}
+
+func TestServer_TopicDefaults_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, body := range []string{
+		`{"priority":6}`,
+		`{"tags":["a,b"]}`,
+		`{"tags":["1","2","3","4","5","6","7","8","9","10","11"]}`,
+	} {
+		response := request(t, s, "PUT", "/mytopic/defaults", body, nil)
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40046, toHTTPError(t, response.Body.String()).Code, body)
+	}
+}
+
+func TestServer_TopicDefaults_OwnerOnly(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = true
+	c.AuthDefaultWrite = true
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "backups", true, true))
+	require.Nil(t, manager.AllowAccess(auth.Everyone, "backups", true, false))
+
+	response := request(t, s, "PUT", "/backups/defaults", `{"priority":5}`, nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/backups/defaults", `{"priority":1}`, map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/backups/defaults", "", nil)
+	require.Equal(t, 1, toTopicDefaults(t, response.Body.String()).Priority)
+}
+
+func toTopicDefaults(t *testing.T, s string) *topicDefaults {
+	var defaults topicDefaults
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&defaults))
+	return &defaults
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"unicode/utf8"
+)
+
+const (
+	topicInfoDisplayNameMaxLength = 64
+	topicInfoDescriptionMaxLength = 1024
+	topicInfoIconMaxLength        = 2048
+)
+
+var (
+	topicInfoPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/info$`)
+)
+
+// handleTopicInfo returns the metadata of a topic, e.g. {"topic":"backups","display_name":"Nightly backups"}, so
+// that all clients subscribed to the topic can show the same name, icon and description
+func (s *Server) handleTopicInfo(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	info, err := s.messageCache.TopicInfo(t.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, info)
+}
+
+// handleTopicInfoUpdate replaces the metadata of a topic. Fields that are not passed are cleared, and if all of
+// them are empty, the metadata is removed. If access control is enabled, only the owners of the topic
+// (see topicOwner) may do this, just like for handlePurge.
+func (s *Server) handleTopicInfoUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if s.auth != nil && !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	var info topicInfo
+	if err := json.NewDecoder(io.LimitReader(r.Body, 2*apiRequestMaxBytes)).Decode(&info); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	info.Topic = t.ID
+	if utf8.RuneCountInString(info.DisplayName) > topicInfoDisplayNameMaxLength ||
+		utf8.RuneCountInString(info.Description) > topicInfoDescriptionMaxLength ||
+		len(info.Icon) > topicInfoIconMaxLength || (info.Icon != "" && !attachURLRegex.MatchString(info.Icon)) {
+		return errHTTPBadRequestTopicInfoInvalid
+	}
+	if info.DisplayName == "" && info.Icon == "" && info.Description == "" {
+		err = s.messageCache.DeleteTopicInfo(t.ID)
+	} else {
+		err = s.messageCache.UpdateTopicInfo(&info)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Updated metadata of topic %s", v.ip, t.ID)
+	return writeJSON(w, &info)
+}
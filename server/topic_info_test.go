@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServer_TopicInfo(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/backups/info", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, &topicInfo{Topic: "backups"}, toTopicInfo(t, response.Body.String()))
+
+	response = request(t, s, "PUT", "/backups/info", `{"display_name":"Nightly backups","icon":"https://example.com/backup.png","description":"Results of the backup jobs"}`, nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/backups/info", "", nil)
+	info := toTopicInfo(t, response.Body.String())
+	require.Equal(t, "backups", info.Topic)
+	require.Equal(t, "Nightly backups", info.DisplayName)
+	require.Equal(t, "https://example.com/backup.png", info.Icon)
+	require.Equal(t, "Results of the backup jobs", info.Description)
+
+	response = request(t, s, "POST", "/backups/info", `{"display_name":"Backups"}`, nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/backups/info", "", nil)
+	require.Equal(t, &topicInfo{Topic: "backups", DisplayName: "Backups"}, toTopicInfo(t, response.Body.String())) // Replaced, not merged
+
+	response = request(t, s, "PUT", "/backups/info", `{}`, nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/backups/info", "", nil)
+	require.Equal(t, &topicInfo{Topic: "backups"}, toTopicInfo(t, response.Body.String()))
+}
+
+func TestServer_TopicInfo_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, body := range []string{
+		`{"display_name":"` + strings.Repeat("x", 65) + `"}`,
+		`{"description":"` + strings.Repeat("x", 1025) + `"}`,
+		`{"icon":"ftp://example.com/icon.png"}`,
+	} {
+		response := request(t, s, "PUT", "/mytopic/info", body, nil)
+		require.Equal(t, 400, response.Code)
+		require.Equal(t, 40044, toHTTPError(t, response.Body.String()).Code)
+	}
+	response := request(t, s, "PUT", "/mytopic/info", `{"display_name":"`+strings.Repeat("ü", 64)+`"}`, nil)
+	require.Equal(t, 200, response.Code) // Characters, not bytes
+}
+
+func TestServer_TopicInfo_OwnerOnly(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = true
+	c.AuthDefaultWrite = true
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("phil", "phil", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("phil", "backups", true, true))
+	require.Nil(t, manager.AllowAccess(auth.Everyone, "backups", true, false))
+
+	response := request(t, s, "PUT", "/backups/info", `{"display_name":"Anonymous"}`, nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/backups/info", `{"display_name":"Phil's backups"}`, map[string]string{"Authorization": basicAuth("phil:phil")})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/backups/info", "", nil)
+	require.Equal(t, "Phil's backups", toTopicInfo(t, response.Body.String()).DisplayName)
+
+	response = request(t, s, "PUT", "/mytopic/info", `{"display_name":"Nobody owns this"}`, nil)
+	require.Equal(t, 403, response.Code) // Writable by everyone, so not owned by anyone
+}
+
+func toTopicInfo(t *testing.T, s string) *topicInfo {
+	var info topicInfo
+	require.Nil(t, json.NewDecoder(strings.NewReader(s)).Decode(&info))
+	return &info
+}
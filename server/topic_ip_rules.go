@@ -0,0 +1,115 @@
+package server
+
+import (
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// topicIPRule restricts from which IP addresses a reserved topic can be published to, see auth.Reservation.
+// The rules of all topics are kept in memory (see Server.topicIPRules), so that they can be checked before
+// rate limiting without querying the auth database for every publish request.
+type topicIPRule struct {
+	allow []*net.IPNet // If empty, all addresses are allowed that are not denied
+	deny  []*net.IPNet
+}
+
+func newTopicIPRule(reservation auth.Reservation) (*topicIPRule, error) {
+	rule := &topicIPRule{
+		allow: make([]*net.IPNet, 0),
+		deny:  make([]*net.IPNet, 0),
+	}
+	for _, cidr := range reservation.PublishAllow {
+		ipNet, err := parseIPNet(cidr)
+		if err != nil {
+			return nil, err
+		}
+		rule.allow = append(rule.allow, ipNet)
+	}
+	for _, cidr := range reservation.PublishDeny {
+		ipNet, err := parseIPNet(cidr)
+		if err != nil {
+			return nil, err
+		}
+		rule.deny = append(rule.deny, ipNet)
+	}
+	return rule, nil
+}
+
+// allowed returns true if the IP address may publish, i.e. if it is not denied, and allowed (if there is an allow list)
+func (r *topicIPRule) allowed(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range r.deny {
+		if ipNet.Contains(parsed) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, ipNet := range r.allow {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitPublishIPs rejects publish requests to topics whose IP address restrictions do not allow the visitor. It
+// runs before limitRequests, so that drive-by publishes to well-known topic names do not count towards the rate
+// limits of the visitor, and do not even get to the point of creating the topic.
+func (s *Server) limitPublishIPs(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) < 2 {
+			return next(w, r, v)
+		}
+		for _, topic := range util.SplitNoEmpty(parts[1], ",") {
+			if !s.publishIPAllowed(topic, v.ip) {
+				return errHTTPForbiddenPublishIP
+			}
+		}
+		return next(w, r, v)
+	}
+}
+
+// publishIPAllowed returns true if the IP address restrictions of the topic (if any) allow publishing from the IP
+func (s *Server) publishIPAllowed(topic, ip string) bool {
+	s.mu.Lock()
+	rule, ok := s.topicIPRules[topic]
+	s.mu.Unlock()
+	return !ok || rule.allowed(ip)
+}
+
+// updateTopicIPRules reloads the IP address restrictions of all reserved topics from the auth database. It is
+// called after a user changed a reservation, and regularly by the manager, to pick up changes made by other
+// ntfy servers sharing the same PostgreSQL database.
+func (s *Server) updateTopicIPRules() error {
+	manager, ok := s.auth.(auth.Manager)
+	if !ok {
+		return nil
+	}
+	reservations, err := manager.ReservedTopicIPs()
+	if err != nil {
+		return err
+	}
+	rules := make(map[string]*topicIPRule)
+	for _, reservation := range reservations {
+		rule, err := newTopicIPRule(reservation)
+		if err != nil {
+			log.Printf("Ignoring invalid IP address restrictions of topic %s: %s", reservation.Topic, err.Error())
+			continue
+		}
+		rules[reservation.Topic] = rule
+	}
+	s.mu.Lock()
+	s.topicIPRules = rules
+	s.mu.Unlock()
+	return nil
+}
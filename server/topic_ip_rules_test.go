@@ -0,0 +1,83 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"testing"
+)
+
+func TestTopicIPRule_Allowed(t *testing.T) {
+	rule, err := newTopicIPRule(auth.Reservation{
+		PublishAllow: []string{"10.0.0.0/8", "1.2.3.4/32"},
+		PublishDeny:  []string{"10.1.0.0/16"},
+	})
+	require.Nil(t, err)
+	require.True(t, rule.allowed("1.2.3.4"))
+	require.True(t, rule.allowed("10.2.3.4"))
+	require.False(t, rule.allowed("10.1.2.3")) // Deny wins
+	require.False(t, rule.allowed("1.2.3.5"))
+	require.False(t, rule.allowed("not-an-ip"))
+
+	rule, err = newTopicIPRule(auth.Reservation{PublishDeny: []string{"9.9.9.0/24"}})
+	require.Nil(t, err)
+	require.True(t, rule.allowed("1.2.3.4"))
+	require.False(t, rule.allowed("9.9.9.9"))
+}
+
+func TestServer_Reservations_PublishAllow(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 2)
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "POST", "/user/reservations", `{"topic":"doorbell","everyone":"write-only","publish_allow":["1.2.3.4","10.0.0.0/8"]}`, ben)
+	require.Equal(t, 200, response.Code)
+	reservation := toReservationResponse(t, response.Body.String())
+	require.Equal(t, []string{"1.2.3.4/32", "10.0.0.0/8"}, reservation.PublishAllow)
+
+	// Requests come from 9.9.9.9, see request()
+	response = request(t, s, "PUT", "/doorbell", "ding dong", nil)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40304, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/doorbell", "ding dong", ben)
+	require.Equal(t, 403, response.Code) // Not even the owner
+	response = request(t, s, "POST", "/", `{"topic":"doorbell","message":"ding dong"}`, nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/doorbell/json?poll=1", "", ben)
+	require.Equal(t, 200, response.Code) // Only publishing is restricted
+
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"doorbell","everyone":"write-only","publish_allow":["9.9.9.0/24"]}`, ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/doorbell", "ding dong", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "POST", "/user/reservations", `{"topic":"doorbell","publish_allow":["1.2.3.4"]}`, ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/user/reservations/doorbell", "", ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/doorbell", "ding dong", nil)
+	require.Equal(t, 200, response.Code) // Released topics are no longer restricted
+}
+
+func TestServer_Reservations_PublishDenyBeforeRateLimit(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 2)
+	s.config.VisitorRequestLimitBurst = 3 // Before the visitor is created by the first request
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "POST", "/user/reservations", `{"topic":"doorbell","everyone":"write-only","publish_deny":["9.9.9.9"]}`, ben)
+	require.Equal(t, 200, response.Code)
+	for i := 0; i < 10; i++ {
+		response = request(t, s, "PUT", "/doorbell", "drive-by", nil)
+		require.Equal(t, 403, response.Code)
+	}
+	response = request(t, s, "PUT", "/mytopic", "not rate limited", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_Reservations_PublishAllowInvalid(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 2)
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+	response := request(t, s, "POST", "/user/reservations", `{"topic":"doorbell","publish_allow":["my-home"]}`, ben)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40035, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/doorbell", "not reserved", nil)
+	require.Equal(t, 200, response.Code)
+}
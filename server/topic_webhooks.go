@@ -0,0 +1,309 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"syscall"
+	"time"
+)
+
+const (
+	topicWebhooksMax            = 5
+	topicWebhookSecretMaxLength = 256
+	webhookSignatureHeader      = "X-Ntfy-Signature"
+	webhookForwardedHeader      = "X-Ntfy-Forwarded" // Set on deliveries, so that messages are not forwarded in a loop
+	webhookRequestTimeout       = 10 * time.Second
+	webhookRetryInitialBackoff  = 30 * time.Second
+	webhookRetryMaxBackoff      = 30 * time.Minute
+	webhookRetryMaxAge          = 12 * time.Hour
+)
+
+var (
+	topicWebhooksPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/webhooks$`)
+	webhookHTTPClient      = &http.Client{
+		Timeout: webhookRequestTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: webhookRequestTimeout,
+				Control: webhookDialControl,
+			}).DialContext,
+			TLSHandshakeTimeout: webhookRequestTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse // The signature is only meant for the registered URL
+		},
+	}
+	errWebhookAddressForbidden = errors.New("webhook address is a loopback, private or link-local address")
+
+	// webhookAddressAllowed decides whether webhooks may be sent to an IP address. Webhooks must not reach the server
+	// itself or the internal network (SSRF), so only public addresses are allowed. Overridden in tests.
+	webhookAddressAllowed = func(ip net.IP) bool {
+		return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+			!ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified()
+	}
+)
+
+// webhookError is returned by deliverWebhook if the webhook responded with an unexpected status code
+type webhookError struct {
+	statusCode int
+}
+
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("unexpected response status %d", e.statusCode)
+}
+
+// handleTopicWebhooks returns the outgoing webhooks of a topic, without their secrets, e.g.
+// {"topic":"alerts","webhooks":[{"url":"https://example.com/hook","signed":true}]}
+func (s *Server) handleTopicWebhooks(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden // The URLs may contain tokens, so only owners may see them
+	}
+	webhooks, err := s.messageCache.TopicWebhooks(t.ID)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, newTopicWebhooksResponse(webhooks))
+}
+
+// handleTopicWebhooksUpdate replaces the outgoing webhooks of a topic. Only owners of the topic may do this (the route
+// only exists if access control is enabled), and passing no webhooks removes them.
+func (s *Server) handleTopicWebhooksUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	if !s.topicOwner(userFromRequest(r), t.ID) {
+		return errHTTPForbidden
+	}
+	var webhooks topicWebhooks
+	if err := json.NewDecoder(io.LimitReader(r.Body, 2*apiRequestMaxBytes)).Decode(&webhooks); err != nil {
+		return errHTTPBadRequestJSONInvalid
+	}
+	webhooks.Topic = t.ID
+	if webhooks.Webhooks == nil {
+		webhooks.Webhooks = make([]*topicWebhook, 0)
+	}
+	if err := validateTopicWebhooks(&webhooks); err != nil {
+		return err
+	}
+	if len(webhooks.Webhooks) == 0 {
+		err = s.messageCache.DeleteTopicWebhooks(t.ID)
+	} else {
+		err = s.messageCache.UpdateTopicWebhooks(&webhooks)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] Updated outgoing webhooks of topic %s (%d webhook(s))", v.ip, t.ID, len(webhooks.Webhooks))
+	return writeJSON(w, newTopicWebhooksResponse(&webhooks))
+}
+
+func validateTopicWebhooks(webhooks *topicWebhooks) error {
+	if len(webhooks.Webhooks) > topicWebhooksMax {
+		return wrapErrHTTP(errHTTPBadRequestTopicWebhooksInvalid, "at most %d webhooks are allowed", topicWebhooksMax)
+	} else if len(webhooks.Secret) > topicWebhookSecretMaxLength {
+		return wrapErrHTTP(errHTTPBadRequestTopicWebhooksInvalid, "secret must not be longer than %d characters", topicWebhookSecretMaxLength)
+	}
+	for _, webhook := range webhooks.Webhooks {
+		if webhook == nil {
+			return errHTTPBadRequestTopicWebhooksInvalid
+		}
+		u, err := url.Parse(webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return wrapErrHTTP(errHTTPBadRequestTopicWebhooksInvalid, "invalid URL %s, only http:// and https:// URLs are allowed", webhook.URL)
+		} else if !webhookHostAllowed(u.Hostname()) {
+			return wrapErrHTTP(errHTTPBadRequestTopicWebhooksInvalid, "invalid URL %s, loopback, private and link-local addresses are not allowed", webhook.URL)
+		} else if len(webhook.Secret) > topicWebhookSecretMaxLength {
+			return wrapErrHTTP(errHTTPBadRequestTopicWebhooksInvalid, "secret must not be longer than %d characters", topicWebhookSecretMaxLength)
+		} else if webhook.Format != "" && webhook.Format != webhookFormatSlack && webhook.Format != webhookFormatDiscord {
+			return wrapErrHTTP(errHTTPBadRequestTopicWebhooksInvalid, "invalid format %s, only %s and %s are allowed", webhook.Format, webhookFormatSlack, webhookFormatDiscord)
+		}
+	}
+	return nil
+}
+
+// webhookHostAllowed returns false if the host is, or resolves to, an address that webhooks may not be sent to. Hosts
+// that can't be resolved (yet) are allowed, since the address is checked again when connecting, see webhookDialControl.
+func webhookHostAllowed(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return webhookAddressAllowed(ip)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), webhookRequestTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if !webhookAddressAllowed(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl rejects connections to addresses that webhooks may not be sent to. Since it is called for the
+// resolved address right before connecting, a host that resolves to a different address than when the webhook was
+// registered (DNS rebinding) is caught as well.
+func webhookDialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+		return errWebhookAddressForbidden
+	}
+	return nil
+}
+
+func newTopicWebhooksResponse(webhooks *topicWebhooks) *topicWebhooksResponse {
+	response := &topicWebhooksResponse{
+		Topic:    webhooks.Topic,
+		Webhooks: make([]*topicWebhookResponse, 0),
+		Signed:   webhooks.Secret != "",
+	}
+	for _, webhook := range webhooks.Webhooks {
+		response.Webhooks = append(response.Webhooks, &topicWebhookResponse{
+			URL:    webhook.URL,
+			Format: webhook.Format,
+			Signed: webhook.Secret != "" || webhooks.Secret != "",
+		})
+	}
+	return response
+}
+
+// forwardWebhooks POSTs the message to all outgoing webhooks of its topic, signed with the secret of the webhook, or
+// else the secret of the topic. Failed deliveries are added to the retry queue, see sendQueuedWebhooks. This is meant
+// to be called in a goroutine, since the webhooks may be slow.
+func (s *Server) forwardWebhooks(m *message) {
+	webhooks, err := s.messageCache.TopicWebhooks(m.Topic)
+	if err != nil {
+		log.Printf("unable to read webhooks of topic %s: %v", m.Topic, err.Error())
+		return
+	}
+	for _, webhook := range webhooks.Webhooks {
+		secret := webhook.Secret
+		if secret == "" {
+			secret = webhooks.Secret
+		}
+		s.forwardWebhook(&queuedWebhook{URL: webhook.URL, Format: webhook.Format, Secret: secret, Message: m, Attempts: 1, Queued: time.Now().Unix()})
+	}
+}
+
+func (s *Server) forwardWebhook(w *queuedWebhook) {
+	if err := deliverWebhook(w); err != nil {
+		log.Printf("WEBHOOK - Unable to forward message %s of topic %s to %s (attempt %d): %v", w.Message.ID, w.Message.Topic, w.URL, w.Attempts, err.Error())
+		s.retryWebhook(w, err)
+		return
+	}
+	if w.ID != 0 {
+		if err := s.messageCache.DeleteQueuedWebhook(w.ID); err != nil {
+			log.Printf("WEBHOOK - Unable to remove delivery from queue: %v", err.Error())
+		}
+	}
+}
+
+// sendQueuedWebhooks retries all queued webhook deliveries that are due. Like sendQueuedEmails, it does not hold
+// the lock while sending.
+func (s *Server) sendQueuedWebhooks() error {
+	webhooks, err := s.messageCache.WebhooksDue()
+	if err != nil {
+		return err
+	}
+	for _, w := range webhooks {
+		w.Attempts++
+		s.forwardWebhook(w)
+	}
+	return nil
+}
+
+// retryWebhook schedules the next attempt with exponential backoff, or gives up if the webhook rejected the message
+// (e.g. 404 or a redirect, but not 408 or 429), or if the next attempt would exceed the max age
+func (s *Server) retryWebhook(w *queuedWebhook, err error) {
+	next := time.Now().Add(webhookRetryBackoff(w.Attempts))
+	if webhookErrorPermanent(err) || next.After(time.Unix(w.Queued, 0).Add(webhookRetryMaxAge)) {
+		if w.ID != 0 {
+			if err := s.messageCache.DeleteQueuedWebhook(w.ID); err != nil {
+				log.Printf("WEBHOOK - Unable to remove delivery from queue: %v", err.Error())
+			}
+		}
+		return
+	}
+	w.NextAttempt = next.Unix()
+	if err := s.messageCache.QueueWebhook(w); err != nil {
+		log.Printf("WEBHOOK - Unable to queue delivery for retry: %v", err.Error())
+	}
+}
+
+// deliverWebhook POSTs the message to the webhook, in the format of the webhook. If the webhook has a secret, the body
+// is signed with HMAC-SHA256, so that the receiver can verify that it came from this server, e.g. X-Ntfy-Signature: sha256=...
+func deliverWebhook(w *queuedWebhook) error {
+	body, err := webhookBody(w)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookForwardedHeader, "1")
+	if w.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(w.Secret, body))
+	}
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, apiRequestMaxBytes)) // Allows reusing the connection
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// webhookSignature returns the hex-encoded HMAC-SHA256 of the body, keyed with the secret of the webhook
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookErrorPermanent(err error) bool {
+	var webhookErr *webhookError
+	if errors.Is(err, errWebhookAddressForbidden) {
+		return true
+	} else if errors.As(err, &webhookErr) {
+		return webhookErr.statusCode < 500 && webhookErr.statusCode != http.StatusRequestTimeout && webhookErr.statusCode != http.StatusTooManyRequests
+	}
+	return false
+}
+
+// webhookRetryBackoff returns the time to wait before the next attempt, after the given number of failed attempts
+func webhookRetryBackoff(attempts int) time.Duration {
+	backoff := webhookRetryInitialBackoff
+	for i := 1; i < attempts && backoff < webhookRetryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookRetryMaxBackoff {
+		return webhookRetryMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	webhookFormatSlack          = "slack"   // Slack incoming webhook, see https://api.slack.com/messaging/webhooks
+	webhookFormatDiscord        = "discord" // Discord webhook, see https://discord.com/developers/docs/resources/webhook
+	slackTextMaxLength          = 3000      // Of section blocks, in characters
+	slackButtonTextMaxLength    = 75
+	discordTitleMaxLength       = 256
+	discordDescriptionMaxLength = 4096
+	discordDefaultColor         = 0x338574 // The ntfy green
+)
+
+var discordPriorityColors = map[int]int{
+	1: 0x95a5a6,
+	2: 0x95a5a6,
+	4: 0xe67e22,
+	5: 0xe74c3c,
+}
+
+// slackMessage is the payload of a Slack incoming webhook; text is the fallback for notifications
+type slackMessage struct {
+	Text   string        `json:"text"`
+	Blocks []*slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string        `json:"type"`               // "section", "context" or "actions"
+	Text     *slackText    `json:"text,omitempty"`     // Of "section" blocks
+	Elements []interface{} `json:"elements,omitempty"` // *slackText for "context" blocks, *slackButton for "actions" blocks
+}
+
+type slackText struct {
+	Type string `json:"type"` // "mrkdwn" or "plain_text"
+	Text string `json:"text"`
+}
+
+type slackButton struct {
+	Type string     `json:"type"` // Always "button"
+	Text *slackText `json:"text"`
+	URL  string     `json:"url"`
+}
+
+// discordMessage is the payload of a Discord webhook. Webhooks that were not created by a bot cannot send buttons,
+// so actions are sent as links in the description instead.
+type discordMessage struct {
+	Embeds []*discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title       string              `json:"title,omitempty"`
+	Description string              `json:"description,omitempty"`
+	URL         string              `json:"url,omitempty"`
+	Color       int                 `json:"color"`
+	Timestamp   string              `json:"timestamp"`
+	Footer      *discordEmbedFooter `json:"footer,omitempty"`
+	Image       *discordEmbedImage  `json:"image,omitempty"`
+}
+
+type discordEmbedFooter struct {
+	Text string `json:"text"`
+}
+
+type discordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+// webhookLink is a link to show with the message, i.e. a "view" action, the click URL or the attachment
+type webhookLink struct {
+	label string
+	url   string
+}
+
+// webhookBody returns the body of a webhook request: the JSON-encoded message, or the payload that Slack or Discord
+// expect if the webhook has one of these formats
+func webhookBody(w *queuedWebhook) ([]byte, error) {
+	switch w.Format {
+	case webhookFormatSlack:
+		return json.Marshal(toSlackMessage(w.Message))
+	case webhookFormatDiscord:
+		return json.Marshal(toDiscordMessage(w.Message))
+	default:
+		return json.Marshal(w.Message)
+	}
+}
+
+// toSlackMessage formats a message as Slack blocks: the emojis of the tags and the title in bold, followed by the
+// message, the remaining tags, and a button for each link. Actions other than "view" cannot be performed by Slack,
+// so they are left out.
+func toSlackMessage(m *message) *slackMessage {
+	emojis, tags := webhookEmojis(m)
+	lines := make([]string, 0)
+	if len(emojis) > 0 || m.Title != "" {
+		title := strings.Join(emojis, " ")
+		if m.Title != "" {
+			title = strings.TrimSpace(title + " *" + escapeSlack(m.Title) + "*")
+		}
+		lines = append(lines, title)
+	}
+	if m.Encoding == "" && m.Message != "" { // Binary messages are left out
+		lines = append(lines, escapeSlack(m.Message))
+	}
+	text := truncateRunes(strings.Join(lines, "\n"), slackTextMaxLength)
+	if text == "" {
+		text = escapeSlack(m.Topic)
+	}
+	blocks := []*slackBlock{{Type: "section", Text: &slackText{Type: "mrkdwn", Text: text}}}
+	if len(tags) > 0 {
+		blocks = append(blocks, &slackBlock{
+			Type:     "context",
+			Elements: []interface{}{&slackText{Type: "mrkdwn", Text: escapeSlack("Tags: " + strings.Join(tags, ", "))}},
+		})
+	}
+	if links := webhookLinks(m); len(links) > 0 {
+		buttons := make([]interface{}, 0)
+		for _, link := range links {
+			buttons = append(buttons, &slackButton{
+				Type: "button",
+				Text: &slackText{Type: "plain_text", Text: truncateRunes(link.label, slackButtonTextMaxLength)},
+				URL:  link.url,
+			})
+		}
+		blocks = append(blocks, &slackBlock{Type: "actions", Elements: buttons})
+	}
+	return &slackMessage{Text: text, Blocks: blocks}
+}
+
+// toDiscordMessage formats a message as a Discord embed, colored by priority: the emojis of the tags and the title
+// as the title of the embed, the message (or its Markdown source) and the links as its description, and the remaining
+// tags in the footer. Image attachments are shown in the embed.
+func toDiscordMessage(m *message) *discordMessage {
+	emojis, tags := webhookEmojis(m)
+	embed := &discordEmbed{
+		Title:     truncateRunes(strings.TrimSpace(strings.Join(emojis, " ")+" "+m.Title), discordTitleMaxLength),
+		URL:       m.Click,
+		Color:     discordDefaultColor,
+		Timestamp: time.Unix(m.Time, 0).UTC().Format(time.RFC3339),
+	}
+	if color, ok := discordPriorityColors[m.Priority]; ok {
+		embed.Color = color
+	}
+	links := make([]string, 0)
+	for _, link := range webhookLinks(m) {
+		if link.url == m.Click {
+			continue // Already the URL of the title
+		}
+		links = append(links, fmt.Sprintf("[%s](%s)", strings.NewReplacer("[", "(", "]", ")").Replace(link.label), link.url))
+	}
+	linksText := strings.Join(links, " · ")
+	text := m.Message
+	if m.Markdown != "" {
+		text = m.Markdown
+	} else if m.Encoding != "" {
+		text = "" // Binary messages are left out
+	}
+	if linksText != "" && text != "" {
+		embed.Description = truncateRunes(text, discordDescriptionMaxLength-len([]rune(linksText))-2) + "\n\n" + linksText
+	} else {
+		embed.Description = truncateRunes(text+linksText, discordDescriptionMaxLength)
+	}
+	if len(tags) > 0 {
+		embed.Footer = &discordEmbedFooter{Text: "Tags: " + strings.Join(tags, ", ")}
+	}
+	if m.Attachment != nil && strings.HasPrefix(m.Attachment.Type, "image/") {
+		embed.Image = &discordEmbedImage{URL: m.Attachment.URL}
+	}
+	return &discordMessage{Embeds: []*discordEmbed{embed}}
+}
+
+// webhookEmojis splits the tags of a message into emojis and other tags, like the e-mail and Telegram formats do
+func webhookEmojis(m *message) ([]string, []string) {
+	emojis, tags, err := toEmojis(m.Tags)
+	if err != nil {
+		return make([]string, 0), m.Tags
+	}
+	return emojis, tags
+}
+
+// webhookLinks returns the "view" actions, the click URL and the attachment of a message, in this order
+func webhookLinks(m *message) []*webhookLink {
+	links := make([]*webhookLink, 0)
+	for _, a := range m.Actions {
+		if a.Action == actionView && a.URL != "" {
+			links = append(links, &webhookLink{label: a.Label, url: a.URL})
+		}
+	}
+	if m.Click != "" {
+		links = append(links, &webhookLink{label: "Open", url: m.Click})
+	}
+	if m.Attachment != nil && m.Attachment.URL != "" {
+		name := m.Attachment.Name
+		if name == "" {
+			name = "Attachment"
+		}
+		links = append(links, &webhookLink{label: name, url: m.Attachment.URL})
+	}
+	return links
+}
+
+// escapeSlack escapes the characters that Slack uses for its own markup, see
+// https://api.slack.com/reference/surfaces/formatting#escaping
+func escapeSlack(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_TopicWebhooks(t *testing.T) {
+	receiver := newTestWebhookReceiver(t, http.StatusOK)
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts", "backups")
+
+	response := request(t, s, "GET", "/alerts/webhooks", "", phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"topic":"alerts","webhooks":[],"signed":false}`+"\n", response.Body.String())
+
+	response = request(t, s, "PUT", "/alerts/webhooks", `{"webhooks":[{"url":"`+receiver.URL()+`","secret":"s3cr3t"}]}`, phil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/alerts/webhooks", "", phil)
+	require.Equal(t, 200, response.Code)
+	require.NotContains(t, response.Body.String(), "s3cr3t")
+	webhooks := toTopicWebhooksResponse(t, response.Body.String())
+	require.Len(t, webhooks.Webhooks, 1)
+	require.Equal(t, receiver.URL(), webhooks.Webhooks[0].URL)
+	require.True(t, webhooks.Webhooks[0].Signed)
+
+	response = request(t, s, "PUT", "/alerts", "Disk full", map[string]string{"Title": "Server down", "Authorization": phil["Authorization"]})
+	m := toMessage(t, response.Body.String())
+	requests := receiver.Wait(t, 1)
+	require.Equal(t, "application/json", requests[0].header.Get("Content-Type"))
+	require.Equal(t, "sha256="+webhookSignature("s3cr3t", requests[0].body), requests[0].header.Get(webhookSignatureHeader))
+	forwarded := toMessage(t, string(requests[0].body))
+	require.Equal(t, m.ID, forwarded.ID)
+	require.Equal(t, "alerts", forwarded.Topic)
+	require.Equal(t, "Server down", forwarded.Title)
+	require.Equal(t, "Disk full", forwarded.Message)
+
+	// Messages of other topics, and messages that were forwarded by a webhook are not forwarded
+	request(t, s, "PUT", "/backups", "Backup done", phil)
+	request(t, s, "PUT", "/alerts", "Forwarded", map[string]string{webhookForwardedHeader: "1", "Authorization": phil["Authorization"]})
+	time.Sleep(200 * time.Millisecond)
+	require.Len(t, receiver.Requests(), 1)
+
+	// No webhooks removes them
+	response = request(t, s, "PUT", "/alerts/webhooks", `{"webhooks":[]}`, phil)
+	require.Equal(t, 200, response.Code)
+	webhooks = toTopicWebhooksResponse(t, request(t, s, "GET", "/alerts/webhooks", "", phil).Body.String())
+	require.Empty(t, webhooks.Webhooks)
+}
+
+func TestServer_TopicWebhooks_TopicSecret(t *testing.T) {
+	receiver := newTestWebhookReceiver(t, http.StatusOK)
+	other := newTestWebhookReceiver(t, http.StatusOK)
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts")
+	body := `{"secret":"topic-secret","webhooks":[{"url":"` + receiver.URL() + `"},{"url":"` + other.URL() + `","secret":"own-secret"}]}`
+	response := request(t, s, "PUT", "/alerts/webhooks", body, phil)
+	require.Equal(t, 200, response.Code)
+	require.NotContains(t, response.Body.String(), "secret\":")
+	webhooks := toTopicWebhooksResponse(t, response.Body.String())
+	require.True(t, webhooks.Signed)
+	require.True(t, webhooks.Webhooks[0].Signed)
+	require.True(t, webhooks.Webhooks[1].Signed)
+
+	// Webhooks without their own secret are signed with the secret of the topic
+	request(t, s, "PUT", "/alerts", "Disk full", phil)
+	requests := receiver.Wait(t, 1)
+	require.Equal(t, "sha256="+webhookSignature("topic-secret", requests[0].body), requests[0].header.Get(webhookSignatureHeader))
+	requests = other.Wait(t, 1)
+	require.Equal(t, "sha256="+webhookSignature("own-secret", requests[0].body), requests[0].header.Get(webhookSignatureHeader))
+}
+
+func TestServer_TopicWebhooks_Retry(t *testing.T) {
+	receiver := newTestWebhookReceiver(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK)
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts")
+	response := request(t, s, "PUT", "/alerts/webhooks", `{"webhooks":[{"url":"`+receiver.URL()+`"}]}`, phil)
+	require.Equal(t, 200, response.Code)
+	request(t, s, "PUT", "/alerts", "Disk full", phil)
+	requests := receiver.Wait(t, 1)
+	require.Empty(t, requests[0].header.Get(webhookSignatureHeader))
+	require.Eventually(t, func() bool {
+		return testQueuedWebhooksCount(t, s) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Not due yet
+	require.Nil(t, s.sendQueuedWebhooks())
+	require.Len(t, receiver.Requests(), 1)
+
+	// Second attempt fails again, third attempt succeeds
+	_, err := s.messageCache.(*sqlCache).db.Exec(`UPDATE webhook_queue SET next_attempt = 0`)
+	require.Nil(t, err)
+	require.Nil(t, s.sendQueuedWebhooks())
+	require.Len(t, receiver.Requests(), 2)
+	require.Equal(t, 1, testQueuedWebhooksCount(t, s))
+	_, err = s.messageCache.(*sqlCache).db.Exec(`UPDATE webhook_queue SET next_attempt = 0`)
+	require.Nil(t, err)
+	require.Nil(t, s.sendQueuedWebhooks())
+	requests = receiver.Requests()
+	require.Len(t, requests, 3)
+	require.Equal(t, "Disk full", toMessage(t, string(requests[2].body)).Message)
+	require.Equal(t, 0, testQueuedWebhooksCount(t, s))
+}
+
+func TestServer_TopicWebhooks_PermanentError(t *testing.T) {
+	receiver := newTestWebhookReceiver(t, http.StatusNotFound)
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts")
+	request(t, s, "PUT", "/alerts/webhooks", `{"webhooks":[{"url":"`+receiver.URL()+`"}]}`, phil)
+	request(t, s, "PUT", "/alerts", "Disk full", phil)
+	receiver.Wait(t, 1)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, testQueuedWebhooksCount(t, s))
+}
+
+func TestServer_TopicWebhooks_Formats(t *testing.T) {
+	slack := newTestWebhookReceiver(t, http.StatusOK)
+	discord := newTestWebhookReceiver(t, http.StatusNoContent)
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts")
+	body := `{"webhooks":[{"url":"` + slack.URL() + `","format":"slack"},{"url":"` + discord.URL() + `","format":"discord"}]}`
+	response := request(t, s, "PUT", "/alerts/webhooks", body, phil)
+	require.Equal(t, 200, response.Code)
+	webhooks := toTopicWebhooksResponse(t, response.Body.String())
+	require.Equal(t, webhookFormatSlack, webhooks.Webhooks[0].Format)
+	require.Equal(t, webhookFormatDiscord, webhooks.Webhooks[1].Format)
+
+	request(t, s, "PUT", "/alerts", "Disk <90%", map[string]string{
+		"Title":         "Server down",
+		"Tags":          "warning,backup",
+		"Priority":      "5",
+		"Click":         "https://example.com/logs",
+		"Actions":       "view, Open dashboard, https://example.com/dashboard; http, Restart, https://example.com/restart",
+		"Authorization": phil["Authorization"],
+	})
+	var slackBody map[string]interface{}
+	require.Nil(t, json.Unmarshal(slack.Wait(t, 1)[0].body, &slackBody))
+	require.Equal(t, "⚠️ *Server down*\nDisk &lt;90%", slackBody["text"])
+	blocks := slackBody["blocks"].([]interface{})
+	require.Len(t, blocks, 3)
+	require.Equal(t, "Tags: backup", blocks[1].(map[string]interface{})["elements"].([]interface{})[0].(map[string]interface{})["text"])
+	buttons := blocks[2].(map[string]interface{})["elements"].([]interface{})
+	require.Len(t, buttons, 2)
+	require.Equal(t, "https://example.com/dashboard", buttons[0].(map[string]interface{})["url"])
+	require.Equal(t, "Open dashboard", buttons[0].(map[string]interface{})["text"].(map[string]interface{})["text"])
+	require.Equal(t, "https://example.com/logs", buttons[1].(map[string]interface{})["url"])
+
+	var discordBody discordMessage
+	require.Nil(t, json.Unmarshal(discord.Wait(t, 1)[0].body, &discordBody))
+	require.Len(t, discordBody.Embeds, 1)
+	embed := discordBody.Embeds[0]
+	require.Equal(t, "⚠️ Server down", embed.Title)
+	require.Equal(t, "Disk <90%\n\n[Open dashboard](https://example.com/dashboard)", embed.Description)
+	require.Equal(t, "https://example.com/logs", embed.URL)
+	require.Equal(t, discordPriorityColors[5], embed.Color)
+	require.Equal(t, "Tags: backup", embed.Footer.Text)
+	require.Equal(t, 0, testQueuedWebhooksCount(t, s))
+}
+
+func TestToDiscordMessage_Attachment(t *testing.T) {
+	m := newDefaultMessage("alerts", strings.Repeat("x", 5000))
+	m.Attachment = &attachment{Name: "front-door.jpg", Type: "image/jpeg", URL: "https://example.com/file/front-door.jpg"}
+	embed := toDiscordMessage(m).Embeds[0]
+	require.Equal(t, discordDefaultColor, embed.Color)
+	require.Equal(t, "https://example.com/file/front-door.jpg", embed.Image.URL)
+	require.True(t, strings.HasSuffix(embed.Description, "x…\n\n[front-door.jpg](https://example.com/file/front-door.jpg)"))
+	require.Equal(t, discordDescriptionMaxLength, len([]rune(embed.Description)))
+	require.Nil(t, embed.Footer)
+}
+
+func TestServer_TopicWebhooks_Invalid(t *testing.T) {
+	s, phil := newTestServerWithTopicOwner(t, newTestConfig(t), "alerts")
+	for _, body := range []string{
+		`{"webhooks":[{"url":"ftp://example.com/hook"}]}`,
+		`{"webhooks":[{"url":"example.com/hook"}]}`,
+		`{"webhooks":[{"url":"https://"}]}`,
+		`{"webhooks":[null]}`,
+		`{"webhooks":[{"url":"https://a.com","format":"teams"}]}`,
+		`{"secret":"` + strings.Repeat("x", 257) + `","webhooks":[{"url":"https://a.com"}]}`,
+		`{"webhooks":[{"url":"https://a.com"},{"url":"https://b.com"},{"url":"https://c.com"},{"url":"https://d.com"},{"url":"https://e.com"},{"url":"https://f.com"}]}`,
+		`{"webhooks":[{"url":"http://127.0.0.1:8080/hook"}]}`,
+		`{"webhooks":[{"url":"http://localhost/hook"}]}`,
+		`{"webhooks":[{"url":"http://10.0.0.1/hook"}]}`,
+		`{"webhooks":[{"url":"http://192.168.1.1/hook"}]}`,
+		`{"webhooks":[{"url":"http://169.254.169.254/latest/meta-data"}]}`,
+		`{"webhooks":[{"url":"http://[::1]/hook"}]}`,
+		`{"webhooks":[{"url":"http://[fd00::1]/hook"}]}`,
+		`{"webhooks":[{"url":"http://0.0.0.0/hook"}]}`,
+	} {
+		response := request(t, s, "PUT", "/alerts/webhooks", body, phil)
+		require.Equal(t, 400, response.Code, body)
+		require.Equal(t, 40052, toHTTPError(t, response.Body.String()).Code, body)
+	}
+	response := request(t, s, "PUT", "/alerts/webhooks", `not json`, phil)
+	require.Equal(t, 400, response.Code)
+}
+
+func TestServer_TopicWebhooks_OwnerOnly(t *testing.T) {
+	c := newTestConfig(t)
+	c.AuthFile = filepath.Join(t.TempDir(), "user.db")
+	c.AuthDefaultRead = false
+	c.AuthDefaultWrite = false
+	s := newTestServer(t, c)
+	manager := s.auth.(auth.Manager)
+	require.Nil(t, manager.AddUser("ben", "ben", auth.RoleUser))
+	require.Nil(t, manager.AllowAccess("ben", "alerts", true, true))
+	require.Nil(t, manager.AllowAccess("ben", "public", true, true))
+	require.Nil(t, manager.AllowAccess(auth.Everyone, "public", true, true))
+	ben := map[string]string{"Authorization": basicAuth("ben:ben")}
+
+	response := request(t, s, "PUT", "/alerts/webhooks", `{"webhooks":[{"url":"https://example.com/hook"}]}`, ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/alerts/webhooks", "", ben)
+	require.Equal(t, 200, response.Code)
+
+	// Everyone may write to the topic, so nobody owns it
+	response = request(t, s, "PUT", "/public/webhooks", `{"webhooks":[{"url":"https://example.com/hook"}]}`, ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/public/webhooks", "", ben)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/alerts/webhooks", "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/alerts/webhooks", `{"webhooks":[]}`, nil)
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_TopicWebhooks_NoAuth(t *testing.T) {
+	// Without access control, nobody owns a topic, so webhooks can't be set
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/alerts/webhooks", `{"webhooks":[{"url":"https://example.com/hook"}]}`, nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "GET", "/alerts/webhooks", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestDeliverWebhook_AddressForbidden(t *testing.T) {
+	// A host may resolve to a different address by the time the webhook is delivered, so the address is checked again
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("webhook must not be delivered")
+	}))
+	defer server.Close()
+	err := deliverWebhook(&queuedWebhook{URL: server.URL, Message: newDefaultMessage("alerts", "Disk full")})
+	require.ErrorIs(t, err, errWebhookAddressForbidden)
+	require.True(t, webhookErrorPermanent(err))
+}
+
+type testWebhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// testWebhookReceiver records the webhook requests it receives, and responds with the given status codes in order;
+// the last status code is repeated
+type testWebhookReceiver struct {
+	server   *httptest.Server
+	statuses []int
+	requests []*testWebhookRequest
+	mu       sync.Mutex
+}
+
+// newTestWebhookReceiver starts a testWebhookReceiver; since it listens on a loopback address, webhooks may be sent
+// to loopback addresses until the test ends
+func newTestWebhookReceiver(t *testing.T, statuses ...int) *testWebhookReceiver {
+	allowed := webhookAddressAllowed
+	webhookAddressAllowed = func(ip net.IP) bool {
+		return ip.IsLoopback() || allowed(ip)
+	}
+	t.Cleanup(func() {
+		webhookAddressAllowed = allowed
+	})
+	receiver := &testWebhookReceiver{statuses: statuses}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		receiver.mu.Lock()
+		status := receiver.statuses[0]
+		if len(receiver.statuses) > 1 {
+			receiver.statuses = receiver.statuses[1:]
+		}
+		receiver.requests = append(receiver.requests, &testWebhookRequest{header: r.Header.Clone(), body: body})
+		receiver.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.server.Close)
+	return receiver
+}
+
+func (r *testWebhookReceiver) URL() string {
+	return r.server.URL + "/hook"
+}
+
+func (r *testWebhookReceiver) Requests() []*testWebhookRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(make([]*testWebhookRequest, 0), r.requests...)
+}
+
+func (r *testWebhookReceiver) Wait(t *testing.T, count int) []*testWebhookRequest {
+	require.Eventually(t, func() bool {
+		return len(r.Requests()) >= count
+	}, 2*time.Second, 10*time.Millisecond)
+	return r.Requests()
+}
+
+func testQueuedWebhooksCount(t *testing.T, s *Server) int {
+	var count int
+	require.Nil(t, s.messageCache.(*sqlCache).db.QueryRow(`SELECT COUNT(*) FROM webhook_queue`).Scan(&count))
+	return count
+}
+
+func toTopicWebhooksResponse(t *testing.T, s string) *topicWebhooksResponse {
+	var response topicWebhooksResponse
+	require.Nil(t, json.Unmarshal([]byte(s), &response))
+	return &response
+}
@@ -1,17 +1,25 @@
 package server
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"heckel.io/ntfy/util"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // List of possible events
 const (
-	openEvent        = "open"
-	keepaliveEvent   = "keepalive"
-	messageEvent     = "message"
-	pollRequestEvent = "poll_request"
+	openEvent           = "open"
+	keepaliveEvent      = "keepalive"
+	messageEvent        = "message"
+	pollRequestEvent    = "poll_request"
+	messageUpdatedEvent = "message_updated"
+	messageDeletedEvent = "message_deleted"
+	messageAckedEvent   = "message_acked"
 )
 
 const (
@@ -20,40 +28,308 @@ const (
 
 // message represents a message published to a topic
 type message struct {
-	ID         string      `json:"id"`    // Random message ID
-	Time       int64       `json:"time"`  // Unix time in seconds
-	Event      string      `json:"event"` // One of the above
-	Topic      string      `json:"topic"`
-	Priority   int         `json:"priority,omitempty"`
-	Tags       []string    `json:"tags,omitempty"`
-	Click      string      `json:"click,omitempty"`
-	Actions    []*action   `json:"actions,omitempty"`
-	Attachment *attachment `json:"attachment,omitempty"`
-	Title      string      `json:"title,omitempty"`
-	Message    string      `json:"message,omitempty"`
-	Encoding   string      `json:"encoding,omitempty"` // empty for raw UTF-8, or "base64" for encoded bytes
+	ID          string      `json:"id"`                // Random message ID
+	Time        int64       `json:"time"`              // Unix time in seconds
+	Expires     int64       `json:"expires,omitempty"` // Unix time in seconds, after which the message is no longer delivered
+	Event       string      `json:"event"`             // One of the above
+	Topic       string      `json:"topic"`
+	Priority    int         `json:"priority,omitempty"`
+	Tags        []string    `json:"tags,omitempty"`
+	Click       string      `json:"click,omitempty"`
+	Group       string      `json:"group,omitempty"`
+	Actions     []*action   `json:"actions,omitempty"`
+	Attachment  *attachment `json:"attachment,omitempty"`
+	Title       string      `json:"title,omitempty"`
+	Message     string      `json:"message,omitempty"`
+	Encoding    string      `json:"encoding,omitempty"`     // empty for raw UTF-8, or "base64" for encoded bytes
+	InReplyTo   string      `json:"in_reply_to,omitempty"`  // ID of the message this message is a reply to (X-In-Reply-To)
+	AckRequired bool        `json:"ack_required,omitempty"` // Publisher asks subscribers to acknowledge the message (X-Ack-Required)
+	AckedBy     string      `json:"acked_by,omitempty"`     // User who acknowledged the message, only set for message_acked events
+	CollapseKey string      `json:"collapse_key,omitempty"` // A new message with the same key replaces this one (X-Collapse-Key)
+	Markdown    string      `json:"markdown,omitempty"`     // Markdown source of the message (X-Markdown), message is the plain text version then
+	HTML        string      `json:"html,omitempty"`         // Sanitized HTML rendering of the Markdown source, see renderMessageMarkdown
+	cursor      sinceMarker // Position in the message cache, only set by messageCache.MessagesAfter
+	senderIP    string      // IP address of the publisher, to authorize deleting the message
+	senderUser  string      // Name of the publisher, if authenticated
+	dedupKey    string      // Idempotency key passed by the publisher, see messageCache.MessageByDedupKey
+	thread      string      // ID of the first message of the thread, if this is a reply, see queryFilter
+	held        bool        // Added to the moderation queue instead of being published, see Server.holdMessage
+}
+
+// importResponse is returned by Server.handleImport
+type importResponse struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"` // Messages that existed already
+}
+
+// messageAck is the acknowledgment of a message by a subscriber, see Server.handleAck
+type messageAck struct {
+	User       string `json:"user,omitempty"` // Empty if the subscriber was not authenticated
+	Time       int64  `json:"time"`           // Unix time in seconds
+	subscriber string // User name or IP address, a message can only be acknowledged once per subscriber
+}
+
+// acksResponse is returned by Server.handleAcks
+type acksResponse struct {
+	ID   string        `json:"id"`
+	Acks []*messageAck `json:"acks"`
+}
+
+// purgeResponse is returned by Server.handlePurge
+type purgeResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// queuedEmail is an outgoing e-mail that could not be sent, and is retried later, see Server.sendEmail
+type queuedEmail struct {
+	ID          int64
+	SenderIP    string
+	To          string
+	Message     *message
+	Attempts    int
+	Queued      int64 // Unix time
+	NextAttempt int64 // Unix time
+}
+
+// emailDigest is a batch of messages for the same topic and recipient, which is sent as one e-mail,
+// see Server.sendEmailDigests
+type emailDigest struct {
+	Topic    string
+	To       string
+	SenderIP string // Of the first message
+	Messages []*message
+	LastID   int64 // Row ID of the last message, see messageCache.DeleteEmailDigest
+}
+
+// topicInfo is the metadata of a topic, which clients may show instead of the topic name, see Server.handleTopicInfo
+type topicInfo struct {
+	Topic       string `json:"topic"`
+	DisplayName string `json:"display_name,omitempty"`
+	Icon        string `json:"icon,omitempty"` // URL of the default icon of the topic's notifications
+	Description string `json:"description,omitempty"`
+}
+
+// topicDefaults are merged into every message published to the topic, unless the publisher sets the field itself,
+// see Server.applyTopicDefaults
+type topicDefaults struct {
+	Topic    string   `json:"topic"`
+	Title    string   `json:"title,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Tags     []string `json:"tags,omitempty"` // Added to the tags of the message
+	Click    string   `json:"click,omitempty"`
+}
+
+// topicWebhooks are the outgoing webhooks of a topic: every message published to the topic is POSTed to each of
+// them as JSON, see Server.forwardWebhooks
+type topicWebhooks struct {
+	Topic    string          `json:"topic"`
+	Webhooks []*topicWebhook `json:"webhooks"`
+	Secret   string          `json:"secret,omitempty"` // Signs the deliveries of all webhooks without their own secret
+}
+
+type topicWebhook struct {
+	URL    string `json:"url"`
+	Format string `json:"format,omitempty"` // Empty for the ntfy JSON format, or "slack" or "discord", see webhookBody
+	Secret string `json:"secret,omitempty"` // Key of the HMAC-SHA256 signature, never returned, see topicWebhooksResponse
+}
+
+// topicWebhooksResponse is returned by Server.handleTopicWebhooks and Server.handleTopicWebhooksUpdate
+type topicWebhooksResponse struct {
+	Topic    string                  `json:"topic"`
+	Webhooks []*topicWebhookResponse `json:"webhooks"`
+	Signed   bool                    `json:"signed"` // True if the topic has a secret
+}
+
+type topicWebhookResponse struct {
+	URL    string `json:"url"`
+	Format string `json:"format,omitempty"`
+	Signed bool   `json:"signed"` // True if the webhook or the topic has a secret
+}
+
+// queuedWebhook is a message that could not be delivered to a webhook, and is retried later, see Server.forwardWebhook
+type queuedWebhook struct {
+	ID          int64
+	URL         string
+	Format      string
+	Secret      string
+	Message     *message
+	Attempts    int
+	Queued      int64 // Unix time
+	NextAttempt int64 // Unix time
+}
+
+// topicEscalation is the escalation chain of a topic: max priority messages that are not acknowledged in time are
+// forwarded to other topics, e-mail addresses or phone numbers, step by step, see Server.sendEscalations
+type topicEscalation struct {
+	Topic string            `json:"topic"`
+	Steps []*escalationStep `json:"steps"`
+}
+
+// escalationStep is part of topicEscalation; at least one of Topic, Email and Call is set
+type escalationStep struct {
+	After string `json:"after"`           // Duration after the message was published, e.g. 10m
+	Topic string `json:"topic,omitempty"` // Topic to republish the message to
+	Email string `json:"email,omitempty"` // E-mail address to send the message to
+	Call  string `json:"call,omitempty"`  // Phone number to call to read out the message, see placeCall
+	User  string `json:"user,omitempty"`  // User who added the e-mail or call step, whose permissions and limits apply
+}
+
+// escalation is the progress of the escalation chain of a message, see Server.scheduleEscalation
+type escalation struct {
+	Topic     string
+	MessageID string
+	Step      int      // Index into topicEscalation.Steps of the next step
+	Due       int64    // Unix time of the next step
+	Copies    []string // Republished messages as topic/id, acknowledging them ends the escalation as well
+}
+
+// heartbeat is the dead man's switch of a topic: if no message is published to the topic within the interval, an
+// alert is published to the target topic and/or sent to the e-mail address, see Server.sendHeartbeatAlerts
+type heartbeat struct {
+	Topic    string `json:"topic"`
+	Interval string `json:"interval"`          // Duration, e.g. 1h
+	Target   string `json:"target,omitempty"`  // Topic that the alert is published to
+	Email    string `json:"email,omitempty"`   // E-mail address that the alert is sent to
+	Message  string `json:"message,omitempty"` // Alert message, a default message is used if empty
+	Due      int64  `json:"due"`               // Unix time by which the next message is expected
+	Alerted  bool   `json:"alerted"`           // True if the alert was sent, and no message was published since
+	User     string `json:"user,omitempty"`    // User who set up the heartbeat, whose e-mail limit applies to the alerts
+}
+
+// moderationRequest turns the moderation of a topic on or off, see Server.handleTopicModerationUpdate
+type moderationRequest struct {
+	Moderated bool `json:"moderated"`
+}
+
+// moderationResponse is returned by Server.handleTopicModeration and Server.handleTopicModerationUpdate
+type moderationResponse struct {
+	Topic     string     `json:"topic"`
+	Moderated bool       `json:"moderated"`
+	Messages  []*message `json:"messages"` // Messages waiting for approval, oldest first
+}
+
+// apnsDevice is an iOS device that receives the messages of a topic via APNs, see Server.handleAPNSRegister
+type apnsDevice struct {
+	Topic string
+	Token string // Hex-encoded device token, as returned by the app's registration with APNs
+	User  string // User that registered the device, if any; their permissions are checked for every push
+}
+
+// apnsRegistration is the request and response of Server.handleAPNSRegister and Server.handleAPNSUnregister
+type apnsRegistration struct {
+	Topic string `json:"topic,omitempty"`
+	Token string `json:"token"`
+}
+
+// telegramChatRequest is the request of Server.handleTelegramChatAdd and Server.handleTelegramChatRemove
+type telegramChatRequest struct {
+	ChatID string `json:"chat_id"`
+}
+
+// topicTelegramChatsResponse is returned by Server.handleTelegramChats, and after adding or removing a chat
+type topicTelegramChatsResponse struct {
+	Topic string   `json:"topic"`
+	Chats []string `json:"chats"`
+}
+
+// phoneNumberRequest is the request of the Server.handleUserPhoneNumber* handlers; the code is only needed to add
+// a number (see Server.handleUserPhoneNumberAdd), and the channel only to verify one
+type phoneNumberRequest struct {
+	Number  string `json:"number"`
+	Code    string `json:"code,omitempty"`
+	Channel string `json:"channel,omitempty"` // "sms" (default) or "call"
+}
+
+// phoneNumbersResponse is returned by Server.handleUserPhoneNumbers, and after adding or removing a number
+type phoneNumbersResponse struct {
+	PhoneNumbers []string `json:"phone_numbers"`
+}
+
+// heldMessage is a message in the moderation queue of a topic, see Server.holdMessage. Unlike the message JSON, it
+// includes the fields that are needed to publish the message once it is approved.
+type heldMessage struct {
+	Message         *message `json:"message"`
+	SenderIP        string   `json:"sender_ip,omitempty"`
+	AttachmentOwner string   `json:"attachment_owner,omitempty"`
+	AttachmentHash  string   `json:"attachment_hash,omitempty"`
+	Thread          string   `json:"thread,omitempty"`
+}
+
+func newHeldMessage(m *message) *heldMessage {
+	h := &heldMessage{Message: m, SenderIP: m.senderIP, Thread: m.thread}
+	if m.Attachment != nil {
+		h.AttachmentOwner, h.AttachmentHash = m.Attachment.Owner, m.Attachment.Hash
+	}
+	return h
+}
+
+func (h *heldMessage) toMessage() *message {
+	m := h.Message
+	m.senderIP, m.thread = h.SenderIP, h.Thread
+	if m.Attachment != nil {
+		m.Attachment.Owner, m.Attachment.Hash = h.AttachmentOwner, h.AttachmentHash
+	}
+	return m
+}
+
+// quietHours is a daily time window in which messages below a priority are held back from a subscriber, and
+// delivered as a digest when the window ends, see Server.subscribeQuietHours
+type quietHours struct {
+	Start    string `json:"start"`              // Local time, e.g. 22:00
+	End      string `json:"end"`                // Local time, e.g. 07:00; may be earlier than Start
+	Timezone string `json:"timezone,omitempty"` // IANA time zone, the server time zone if empty
+	Priority int    `json:"priority,omitempty"` // Messages with at least this priority are delivered right away (default: 4)
+}
+
+// recurringMessage is a message that is published to the topic whenever the cron expression matches,
+// see Server.handleRecurringAdd and Server.sendRecurringMessages
+type recurringMessage struct {
+	ID         string    `json:"id"`
+	Topic      string    `json:"topic"`
+	Cron       string    `json:"cron"`               // Cron expression, see util.ParseCron
+	Timezone   string    `json:"timezone,omitempty"` // IANA time zone of the cron expression, server time zone if empty
+	Next       int64     `json:"next"`               // Unix time in seconds
+	Title      string    `json:"title,omitempty"`
+	Message    string    `json:"message"`
+	Priority   int       `json:"priority,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	Click      string    `json:"click,omitempty"`
+	Actions    []*action `json:"actions,omitempty"`
+	senderIP   string    // IP address of the creator, to authorize deleting the recurring message
+	senderUser string    // Name of the creator, if authenticated
+}
+
+// emailMetrics are the counters of outgoing e-mails, see Server.sendEmail
+type emailMetrics struct {
+	Sent    int64 // Sent on the first or a later attempt
+	Retried int64 // Failed attempts that were queued for retry
+	Failed  int64 // Given up due to a permanent error, or because the max age was exceeded
 }
 
 type attachment struct {
-	Name    string `json:"name"`
-	Type    string `json:"type,omitempty"`
-	Size    int64  `json:"size,omitempty"`
-	Expires int64  `json:"expires,omitempty"`
-	URL     string `json:"url"`
-	Owner   string `json:"-"` // IP address of uploader, used for rate limiting
+	Name      string `json:"name"`
+	Type      string `json:"type,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Expires   int64  `json:"expires,omitempty"`
+	URL       string `json:"url"`
+	Thumbnail string `json:"thumbnail,omitempty"` // URL of a scaled-down JPEG, only for large uploaded images
+	Owner     string `json:"-"`                   // IP address of uploader, used for rate limiting
+	Hash      string `json:"-"`                   // SHA-256 of the uploaded file, which is stored only once, see attachmentFileID
 }
 
 type action struct {
 	ID      string            `json:"id"`
-	Action  string            `json:"action"`            // "view", "broadcast", or "http"
+	Action  string            `json:"action"`            // "view", "broadcast", "http", or "publish"
 	Label   string            `json:"label"`             // action button label
 	Clear   bool              `json:"clear"`             // clear notification after successful execution
 	URL     string            `json:"url,omitempty"`     // used in "view" and "http" actions
 	Method  string            `json:"method,omitempty"`  // used in "http" action, default is POST (!)
-	Headers map[string]string `json:"headers,omitempty"` // used in "http" action
+	Headers map[string]string `json:"headers,omitempty"` // used in "http" and "publish" actions
 	Body    string            `json:"body,omitempty"`    // used in "http" action
 	Intent  string            `json:"intent,omitempty"`  // used in "broadcast" action
 	Extras  map[string]string `json:"extras,omitempty"`  // used in "broadcast" action
+	Topic   string            `json:"topic,omitempty"`   // used in "publish" action, topic on the same server
+	Message string            `json:"message,omitempty"` // used in "publish" action
 }
 
 func newAction() *action {
@@ -65,17 +341,25 @@ func newAction() *action {
 
 // publishMessage is used as input when publishing as JSON
 type publishMessage struct {
-	Topic    string   `json:"topic"`
-	Title    string   `json:"title"`
-	Message  string   `json:"message"`
-	Priority int      `json:"priority"`
-	Tags     []string `json:"tags"`
-	Click    string   `json:"click"`
-	Actions  []action `json:"actions"`
-	Attach   string   `json:"attach"`
-	Filename string   `json:"filename"`
-	Email    string   `json:"email"`
-	Delay    string   `json:"delay"`
+	Topic       string   `json:"topic"`
+	Title       string   `json:"title"`
+	Message     string   `json:"message"`
+	Priority    int      `json:"priority"`
+	Tags        []string `json:"tags"`
+	Click       string   `json:"click"`
+	Group       string   `json:"group"`
+	Actions     []action `json:"actions"`
+	Attach      string   `json:"attach"`
+	Filename    string   `json:"filename"`
+	Email       string   `json:"email"`
+	EmailDigest string   `json:"email_digest"`
+	SMS         string   `json:"sms"`
+	Call        string   `json:"call"`
+	Delay       string   `json:"delay"`
+	InReplyTo   string   `json:"in_reply_to"`
+	AckRequired bool     `json:"ack_required"`
+	CollapseKey string   `json:"collapse_key"`
+	Markdown    bool     `json:"markdown"`
 }
 
 // messageEncoder is a function that knows how to encode a message
@@ -105,6 +389,24 @@ func newKeepaliveMessage(topic string) *message {
 	return newMessage(keepaliveEvent, topic, "")
 }
 
+// newMessageDeletedMessage is a convenience method to create a message_deleted event for the message with the
+// given ID, telling subscribers to withdraw it
+func newMessageDeletedMessage(topic, id string) *message {
+	m := newMessage(messageDeletedEvent, topic, "")
+	m.ID = id
+	return m
+}
+
+// newMessageAckedMessage is a convenience method to create a message_acked event for the message with the
+// given ID, telling the publisher (and other subscribers) that it was seen
+func newMessageAckedMessage(topic, id string, ack *messageAck) *message {
+	m := newMessage(messageAckedEvent, topic, "")
+	m.ID = id
+	m.Time = ack.Time
+	m.AckedBy = ack.User
+	return m
+}
+
 // newDefaultMessage is a convenience method to create a notification message
 func newDefaultMessage(topic, msg string) *message {
 	return newMessage(messageEvent, topic, msg)
@@ -114,17 +416,58 @@ func validMessageID(s string) bool {
 	return util.ValidRandomString(s, messageIDLength)
 }
 
+// attachmentFileID returns the ID of the message's uploaded file in the attachment cache. Files are stored under
+// the hash of their content, except for files that were uploaded before that, which are stored under the message ID.
+func attachmentFileID(m *message) string {
+	if m.Attachment != nil && m.Attachment.Hash != "" {
+		return m.Attachment.Hash
+	}
+	return m.ID
+}
+
 type sinceMarker struct {
-	time time.Time
-	id   string
+	time   time.Time
+	id     string
+	seq    int64 // Insertion order within the same second, only for cursors
+	cursor bool
 }
 
 func newSinceTime(timestamp int64) sinceMarker {
-	return sinceMarker{time.Unix(timestamp, 0), ""}
+	return sinceMarker{time: time.Unix(timestamp, 0)}
 }
 
 func newSinceID(id string) sinceMarker {
-	return sinceMarker{time.Unix(0, 0), id}
+	return sinceMarker{time: time.Unix(0, 0), id: id}
+}
+
+// newSinceCursor creates a cursor pointing right after the message with the given time and sequence number.
+// Unlike a timestamp, a cursor is unambiguous even if many messages were published in the same second.
+func newSinceCursor(timestamp, seq int64) sinceMarker {
+	return sinceMarker{time: time.Unix(timestamp, 0), seq: seq, cursor: true}
+}
+
+// parseSinceCursor parses a cursor as returned by sinceMarker.String, e.g. in the X-Cursor header
+func parseSinceCursor(s string) (sinceMarker, error) {
+	if !strings.HasPrefix(s, sinceCursorPrefix) {
+		return sinceNoMessages, errInvalidCursor
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, sinceCursorPrefix))
+	if err != nil {
+		return sinceNoMessages, errInvalidCursor
+	}
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 2 {
+		return sinceNoMessages, errInvalidCursor
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || timestamp < 0 {
+		return sinceNoMessages, errInvalidCursor
+	}
+	seq, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || seq < 0 {
+		return sinceNoMessages, errInvalidCursor
+	}
+	return newSinceCursor(timestamp, seq), nil
 }
 
 func (t sinceMarker) IsAll() bool {
@@ -139,6 +482,10 @@ func (t sinceMarker) IsID() bool {
 	return t.id != ""
 }
 
+func (t sinceMarker) IsCursor() bool {
+	return t.cursor
+}
+
 func (t sinceMarker) Time() time.Time {
 	return t.time
 }
@@ -147,9 +494,29 @@ func (t sinceMarker) ID() string {
 	return t.id
 }
 
+func (t sinceMarker) Seq() int64 {
+	return t.seq
+}
+
+// Before returns true if this cursor points to an earlier position in the message cache than the other one
+func (t sinceMarker) Before(other sinceMarker) bool {
+	if t.time.Equal(other.time) {
+		return t.seq < other.seq
+	}
+	return t.time.Before(other.time)
+}
+
+// String returns the opaque representation of a cursor, which can be passed back as since=<cursor>
+func (t sinceMarker) String() string {
+	return sinceCursorPrefix + base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", t.time.Unix(), t.seq)))
+}
+
+const sinceCursorPrefix = "c_"
+
 var (
-	sinceAllMessages = sinceMarker{time.Unix(0, 0), ""}
-	sinceNoMessages  = sinceMarker{time.Unix(1, 0), ""}
+	sinceAllMessages = sinceMarker{time: time.Unix(0, 0)}
+	sinceNoMessages  = sinceMarker{time: time.Unix(1, 0)}
+	errInvalidCursor = errors.New("invalid cursor")
 )
 
 type queryFilter struct {
@@ -157,11 +524,13 @@ type queryFilter struct {
 	Title    string
 	Tags     []string
 	Priority []int
+	Thread   string // Message ID of the first message of a thread, which matches it and all its replies
 }
 
 func parseQueryFilters(r *http.Request) (*queryFilter, error) {
 	messageFilter := readParam(r, "x-message", "message", "m")
 	titleFilter := readParam(r, "x-title", "title", "t")
+	threadFilter := readParam(r, "x-thread", "thread")
 	tagsFilter := util.SplitNoEmpty(readParam(r, "x-tags", "tags", "tag", "ta"), ",")
 	priorityFilter := make([]int, 0)
 	for _, p := range util.SplitNoEmpty(readParam(r, "x-priority", "priority", "prio", "p"), ",") {
@@ -176,6 +545,7 @@ func parseQueryFilters(r *http.Request) (*queryFilter, error) {
 		Title:    titleFilter,
 		Tags:     tagsFilter,
 		Priority: priorityFilter,
+		Thread:   threadFilter,
 	}, nil
 }
 
@@ -199,5 +569,8 @@ func (q *queryFilter) Pass(msg *message) bool {
 	if len(q.Tags) > 0 && !util.InStringListAll(msg.Tags, q.Tags) {
 		return false
 	}
+	if q.Thread != "" && msg.ID != q.Thread && msg.thread != q.Thread {
+		return false
+	}
 	return true
 }
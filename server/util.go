@@ -1,8 +1,12 @@
 package server
 
 import (
+	"encoding/json"
+	"heckel.io/ntfy/util"
+	"net"
 	"net/http"
 	"strings"
+	"unicode"
 )
 
 func readBoolParam(r *http.Request, defaultValue bool, names ...string) bool {
@@ -40,3 +44,58 @@ func readQueryParam(r *http.Request, names ...string) string {
 	}
 	return ""
 }
+
+// parseSearchTerms splits a search query into distinct lower-case words. Everything but letters and digits is
+// treated as a separator, so the terms are safe to use in the full-text queries of all cache engines.
+func parseSearchTerms(query string) []string {
+	terms := make([]string, 0)
+	for _, word := range searchWords(query) {
+		if len(terms) == searchMaxTerms {
+			break
+		} else if !util.InStringList(terms, word) {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func searchWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// attachmentTypeAllowed returns true if the mime type matches one of the allowed types. These are either exact
+// types (e.g. application/pdf), or wildcards for a top-level type (e.g. image/*). Parameters are ignored.
+func attachmentTypeAllowed(allowedTypes []string, mimeType string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	for _, allowed := range allowedTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mimeType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON writes the given value as JSON response, allowing cross-origin requests
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	return json.NewEncoder(w).Encode(v)
+}
+
+// parseIPNet parses an IP address (e.g. 10.0.0.1) or CIDR range (e.g. 172.16.0.0/12). A single IP address is
+// returned as a range that only contains itself.
+func parseIPNet(s string) (*net.IPNet, error) {
+	cidr := s
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else {
+			cidr += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	return ipNet, err
+}
@@ -27,3 +27,22 @@ func TestReadBoolParam(t *testing.T) {
 	require.Equal(t, false, up)
 	require.Equal(t, true, firebase)
 }
+
+func TestParseSearchTerms(t *testing.T) {
+	require.Equal(t, []string{"disk", "full", "on", "nas1"}, parseSearchTerms(`Disk "full", disk on NAS1!`))
+	require.Equal(t, []string{"größe", "über"}, parseSearchTerms("Größe: über"))
+	require.Empty(t, parseSearchTerms(" *-+ "))
+	require.Equal(t, searchMaxTerms, len(parseSearchTerms("a b c d e f g h i j k l m")))
+}
+
+func TestAttachmentTypeAllowed(t *testing.T) {
+	allowed := []string{"image/*", "text/plain", "application/PDF"}
+	require.True(t, attachmentTypeAllowed(allowed, "image/png"))
+	require.True(t, attachmentTypeAllowed(allowed, "image/svg+xml"))
+	require.True(t, attachmentTypeAllowed(allowed, "text/plain; charset=utf-8"))
+	require.True(t, attachmentTypeAllowed(allowed, "application/pdf"))
+	require.False(t, attachmentTypeAllowed(allowed, "text/html; charset=utf-8"))
+	require.False(t, attachmentTypeAllowed(allowed, "application/vnd.microsoft.portable-executable"))
+	require.False(t, attachmentTypeAllowed(allowed, "imagex/png"))
+	require.False(t, attachmentTypeAllowed([]string{}, "image/png"))
+}
@@ -22,12 +22,16 @@ var (
 // visitor represents an API user, and its associated rate.Limiter used for rate limiting
 type visitor struct {
 	config        *Config
-	messageCache  *messageCache
+	messageCache  messageCache
 	ip            string
 	requests      *rate.Limiter
 	emails        *rate.Limiter
+	messages      *rate.Limiter // Messages per day, may be nil
+	sms           *rate.Limiter // SMS per day, may be nil
+	calls         *rate.Limiter // Phone calls per day, may be nil
 	subscriptions util.Limiter
 	bandwidth     util.Limiter
+	downloads     *rate.Limiter // Download rate in bytes per second, may be nil
 	seen          time.Time
 	mu            sync.Mutex
 }
@@ -39,15 +43,19 @@ type visitorStats struct {
 	VisitorAttachmentBytesRemaining int64 `json:"visitorAttachmentBytesRemaining"`
 }
 
-func newVisitor(conf *Config, messageCache *messageCache, ip string) *visitor {
+func newVisitor(conf *Config, messageCache messageCache, ip string) *visitor {
 	return &visitor{
 		config:        conf,
 		messageCache:  messageCache,
 		ip:            ip,
 		requests:      rate.NewLimiter(rate.Every(conf.VisitorRequestLimitReplenish), conf.VisitorRequestLimitBurst),
 		emails:        rate.NewLimiter(rate.Every(conf.VisitorEmailLimitReplenish), conf.VisitorEmailLimitBurst),
+		messages:      newDailyLimiter(int64(conf.VisitorMessageDailyLimit)),
+		sms:           newDailyLimiter(int64(conf.VisitorSMSDailyLimit)),
+		calls:         newDailyLimiter(int64(conf.VisitorCallDailyLimit)),
 		subscriptions: util.NewFixedLimiter(int64(conf.VisitorSubscriptionLimit)),
 		bandwidth:     util.NewBytesLimiter(conf.VisitorAttachmentDailyBandwidthLimit, 24*time.Hour),
+		downloads:     newDownloadRateLimiter(conf.VisitorAttachmentDownloadRateLimit),
 		seen:          time.Now(),
 	}
 }
@@ -63,6 +71,35 @@ func (v *visitor) RequestAllowed() error {
 	return nil
 }
 
+// RequestsAllowed takes n tokens from the request limiter at once, or none if there are not enough
+func (v *visitor) RequestsAllowed(n int) error {
+	if !v.requests.AllowN(time.Now(), n) {
+		return errVisitorLimitReached
+	}
+	return nil
+}
+
+// RequestLimitReached returns true if the next request would be rejected, without consuming a token
+func (v *visitor) RequestLimitReached() bool {
+	now := time.Now()
+	r := v.requests.ReserveN(now, 1)
+	defer r.CancelAt(now) // Same timestamp, so the token is returned even if it was available right away
+	return !r.OK() || r.DelayFrom(now) > 0
+}
+
+// MessageAllowed checks the visitor's daily message limit, if there is one
+func (v *visitor) MessageAllowed() error {
+	return v.MessagesAllowed(1)
+}
+
+// MessagesAllowed is like MessageAllowed, but for n messages at once
+func (v *visitor) MessagesAllowed(n int) error {
+	if v.messages != nil && !v.messages.AllowN(time.Now(), n) {
+		return errVisitorLimitReached
+	}
+	return nil
+}
+
 func (v *visitor) EmailAllowed() error {
 	if !v.emails.Allow() {
 		return errVisitorLimitReached
@@ -70,6 +107,22 @@ func (v *visitor) EmailAllowed() error {
 	return nil
 }
 
+// SMSAllowed checks the visitor's daily SMS limit. Unlike the message limit, a limit of 0 means no SMS at all.
+func (v *visitor) SMSAllowed() error {
+	if v.sms == nil || !v.sms.Allow() {
+		return errVisitorLimitReached
+	}
+	return nil
+}
+
+// CallAllowed checks the visitor's daily phone call limit. Like for SMS, a limit of 0 means no calls at all.
+func (v *visitor) CallAllowed() error {
+	if v.calls == nil || !v.calls.Allow() {
+		return errVisitorLimitReached
+	}
+	return nil
+}
+
 func (v *visitor) SubscriptionAllowed() error {
 	v.mu.Lock()
 	defer v.mu.Unlock()
@@ -95,6 +148,11 @@ func (v *visitor) BandwidthLimiter() util.Limiter {
 	return v.bandwidth
 }
 
+// DownloadRateLimiter returns the limiter for the visitor's attachment download rate, or nil if it is unlimited
+func (v *visitor) DownloadRateLimiter() *rate.Limiter {
+	return v.downloads
+}
+
 func (v *visitor) Stale() bool {
 	v.mu.Lock()
 	defer v.mu.Unlock()
@@ -102,18 +160,42 @@ func (v *visitor) Stale() bool {
 }
 
 func (v *visitor) Stats() (*visitorStats, error) {
-	attachmentsBytesUsed, err := v.messageCache.AttachmentBytesUsed(v.ip)
+	return v.StatsFor(v.ip, v.config.VisitorAttachmentTotalSizeLimit)
+}
+
+// StatsFor returns the stats of the attachments of the given owner, who may store up to attachmentsBytesTotal.
+// This is the visitor's IP address, unless the limit of the user's tier applies, see Server.attachmentQuota.
+func (v *visitor) StatsFor(owner string, attachmentsBytesTotal int64) (*visitorStats, error) {
+	attachmentsBytesUsed, err := v.messageCache.AttachmentBytesUsed(owner)
 	if err != nil {
 		return nil, err
 	}
-	attachmentsBytesRemaining := v.config.VisitorAttachmentTotalSizeLimit - attachmentsBytesUsed
+	attachmentsBytesRemaining := attachmentsBytesTotal - attachmentsBytesUsed
 	if attachmentsBytesRemaining < 0 {
 		attachmentsBytesRemaining = 0
 	}
 	return &visitorStats{
 		AttachmentFileSizeLimit:         v.config.AttachmentFileSizeLimit,
-		VisitorAttachmentBytesTotal:     v.config.VisitorAttachmentTotalSizeLimit,
+		VisitorAttachmentBytesTotal:     attachmentsBytesTotal,
 		VisitorAttachmentBytesUsed:      attachmentsBytesUsed,
 		VisitorAttachmentBytesRemaining: attachmentsBytesRemaining,
 	}, nil
 }
+
+// newDownloadRateLimiter creates a limiter for the given rate in bytes per second, which allows up to one second's
+// worth of bytes in a single write. It returns nil if the rate is unlimited (0).
+func newDownloadRateLimiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond)
+}
+
+// newDailyLimiter creates a limiter that allows the given number of events per day, replenished evenly over the
+// day. It returns nil if the number is unlimited (0).
+func newDailyLimiter(limit int64) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Every(24*time.Hour/time.Duration(limit)), int(limit))
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/ntfy/util"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// This file implements publishing via webhooks, which come with their own JSON format: The format is either selected
+// via the path (POST /<topic>/<format>, for built-in formats only), the X-Template header (or ?template=...), or
+// the topic (see webhook-template-topics). Besides the built-in formats, the format may also be a template, see
+// webhookTemplate. The payload is converted to a regular publish request, see transformBodyWebhook.
+
+const (
+	webhookRequestMaxBytes = 256 * 1024 // Payloads may contain many alerts, so they may be large
+)
+
+var (
+	webhookPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/(alertmanager|grafana)$`)
+
+	// webhookFormats are all supported webhook formats, see webhookFormat
+	webhookFormats = map[string]webhookFormat{
+		"alertmanager": newAlertmanagerWebhookMessage,
+		"grafana":      newGrafanaWebhookMessage,
+	}
+)
+
+// webhookFormat parses a webhook payload and converts it into a message, without topic. The message must not
+// be longer than the message limit, or it would be treated as attachment.
+type webhookFormat func(body io.Reader, messageLimit int) (*publishMessage, error)
+
+// transformBodyWebhook reads the webhook payload, and converts it to a regular publish request before passing it
+// on to the next handler (see rewritePublishRequest). This is meant to be used in combination with handlePublish.
+func (s *Server) transformBodyWebhook(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		defer r.Body.Close()
+		topic, name := strings.TrimPrefix(r.URL.Path, "/"), s.webhookName(r)
+		if matches := webhookPathRegex.FindStringSubmatch(r.URL.Path); matches != nil {
+			topic = strings.TrimSuffix(topic, "/"+matches[1])
+		}
+		format, err := s.webhookFormat(r, name)
+		if err != nil {
+			return err
+		}
+		m, err := format(io.LimitReader(r.Body, webhookRequestMaxBytes), s.config.MessageLimit)
+		if err != nil {
+			return err
+		}
+		m.Topic = topic
+		if err := rewritePublishRequest(r, m); err != nil {
+			return err
+		}
+		return next(w, r, v)
+	}
+}
+
+// webhookName returns the name of the webhook format (or template) of the request, which is taken from the path
+// (/<topic>/<format>), the X-Template header, or the webhook-template-topics. It is empty for regular requests.
+func (s *Server) webhookName(r *http.Request) string {
+	if matches := webhookPathRegex.FindStringSubmatch(r.URL.Path); matches != nil {
+		return matches[1]
+	} else if name := readParam(r, "x-template", "template"); name != "" {
+		return strings.ToLower(name)
+	}
+	return s.templates.topics[strings.TrimPrefix(r.URL.Path, "/")]
+}
+
+// webhookFormat returns the built-in webhook format or the template with the given name. For "X-Template: yes",
+// the template is passed with the request, see newRequestWebhookTemplate.
+func (s *Server) webhookFormat(r *http.Request, name string) (webhookFormat, error) {
+	if util.InStringList(webhookTemplateInline, name) {
+		t, err := newRequestWebhookTemplate(r)
+		if err != nil {
+			return nil, err
+		}
+		return t.Format, nil
+	} else if format, ok := webhookFormats[name]; ok {
+		return format, nil
+	} else if format, ok := s.templates.formats[name]; ok {
+		return format, nil
+	}
+	return nil, errHTTPBadRequestTemplateInvalid
+}
+
+// joinAlertTexts joins the descriptions of multiple alerts, separated by empty lines. Longer messages would be
+// treated as attachments, so once the message limit is reached, the remaining alerts are only counted. Unless
+// an alert is the last one, there must be enough room left to say so.
+func joinAlertTexts(texts []string, messageLimit int) string {
+	var body strings.Builder
+	for i, text := range texts {
+		if i > 0 {
+			text = "\n\n" + text
+		}
+		more := fmt.Sprintf("\n\n... and %d more alerts", len(texts)-i)
+		needed := body.Len() + len(text)
+		if i < len(texts)-1 {
+			needed += len(more)
+		}
+		if needed > messageLimit {
+			body.WriteString(more)
+			break
+		}
+		body.WriteString(text)
+	}
+	return strings.TrimSpace(body.String())
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
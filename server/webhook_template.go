@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/util"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// This file implements webhook templates: Go templates that map the JSON body of arbitrary webhooks (e.g. from
+// GitHub, GitLab or Sentry) to a message. Templates are either loaded from webhook-template-dir, one file per
+// template, or they are passed along with the request ("X-Template: yes"), in which case the title, message, tags,
+// priority, click and actions parameters are templates themselves.
+
+const (
+	webhookTemplateSuffix  = ".tmpl"
+	webhookTemplateNoValue = "<no value>" // Printed by text/template for missing values, see webhookTemplate.execute
+)
+
+var (
+	webhookTemplateNameRegex = regexp.MustCompile(`^[-_a-z0-9]{1,64}$`)
+	webhookTemplateInline    = []string{"yes", "true", "1"} // Values of X-Template for templates passed with the request
+
+	// webhookTemplateParams are the templates that make up a message, and the names of the corresponding publish
+	// parameters, which are used as templates if the template is passed with the request
+	webhookTemplateParams = map[string][]string{
+		"title":    {"x-title", "title", "t"},
+		"message":  {"x-message", "message", "m"},
+		"tags":     {"x-tags", "tags", "tag", "ta"},
+		"priority": {"x-priority", "priority", "prio", "p"},
+		"click":    {"x-click", "click"},
+		"actions":  {"x-actions", "actions", "action"},
+	}
+)
+
+// webhookTemplates are the templates from webhook-template-dir, and the topics they are applied to, see
+// webhook-template-topics
+type webhookTemplates struct {
+	formats map[string]webhookFormat // By template name, i.e. the file name without suffix
+	topics  map[string]string        // Template (or built-in format) name, by topic
+}
+
+// webhookTemplate is a set of templates (see webhookTemplateParams) that are executed with the JSON body of a webhook
+type webhookTemplate struct {
+	tmpl *template.Template
+}
+
+// newWebhookTemplates loads all templates from the directory (if any), and parses the topic mapping, format
+// <topic>=<template>. Topics may also be mapped to a built-in webhook format, e.g. myalerts=grafana.
+func newWebhookTemplates(dir string, topics []string) (*webhookTemplates, error) {
+	templates := &webhookTemplates{
+		formats: make(map[string]webhookFormat),
+		topics:  make(map[string]string),
+	}
+	if dir != "" {
+		filenames, err := filepath.Glob(filepath.Join(dir, "*"+webhookTemplateSuffix))
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range filenames {
+			name := strings.TrimSuffix(filepath.Base(filename), webhookTemplateSuffix)
+			if _, builtin := webhookFormats[name]; builtin || !webhookTemplateNameRegex.MatchString(name) || util.InStringList(webhookTemplateInline, name) {
+				return nil, fmt.Errorf("invalid webhook template %s: name must be lower-case, and must not be a built-in format", filename)
+			}
+			t, err := loadWebhookTemplate(filename)
+			if err != nil {
+				return nil, err
+			}
+			templates.formats[name] = t.Format
+		}
+	}
+	for _, entry := range topics {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !topicRegex.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid webhook template topic %s, expected format <topic>=<template>", entry)
+		}
+		if _, builtin := webhookFormats[parts[1]]; !builtin && templates.formats[parts[1]] == nil {
+			return nil, fmt.Errorf("invalid webhook template topic %s: template %s does not exist", entry, parts[1])
+		}
+		templates.topics[parts[0]] = parts[1]
+	}
+	return templates, nil
+}
+
+// loadWebhookTemplate reads a template file, which must define the "message" template, and may define the other
+// templates listed in webhookTemplateParams, e.g. {{define "title"}}{{.repository.full_name}}{{end}}
+func loadWebhookTemplate(filename string) (*webhookTemplate, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(filename)).Parse(string(b))
+	if err != nil {
+		return nil, err
+	} else if tmpl.Lookup("message") == nil {
+		return nil, fmt.Errorf("webhook template %s must define the \"message\" template", filename)
+	}
+	return &webhookTemplate{tmpl: tmpl}, nil
+}
+
+// newRequestWebhookTemplate parses the templates passed as publish parameters (see webhookTemplateParams). The
+// parameters are removed from the request, so that they are not mistaken for the message fields by handlePublish.
+func newRequestWebhookTemplate(r *http.Request) (*webhookTemplate, error) {
+	tmpl := template.New("request")
+	query := r.URL.Query()
+	for name, params := range webhookTemplateParams {
+		text := readParam(r, params...)
+		if name == "message" {
+			text = strings.ReplaceAll(text, "\\n", "\n")
+		}
+		if text != "" {
+			if _, err := tmpl.New(name).Parse(text); err != nil {
+				return nil, wrapErrHTTP(errHTTPBadRequestTemplateFailed, "%s", err.Error())
+			}
+		}
+		for _, param := range params {
+			r.Header.Del(param)
+			query.Del(param)
+		}
+	}
+	r.URL.RawQuery = query.Encode()
+	return &webhookTemplate{tmpl: tmpl}, nil
+}
+
+// Format executes the templates with the JSON body of the webhook, see webhookFormat. Tags are separated by commas,
+// and actions may use the JSON or the simple format, see parseActions.
+func (t *webhookTemplate) Format(body io.Reader, messageLimit int) (*publishMessage, error) {
+	var data interface{}
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber() // Print IDs like 1234567890 as such, not as 1.23456789e+09
+	if err := decoder.Decode(&data); err != nil {
+		return nil, errHTTPBadRequestWebhookInvalid
+	}
+	values := make(map[string]string)
+	for name := range webhookTemplateParams {
+		value, err := t.execute(name, data, messageLimit)
+		if err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	m := &publishMessage{
+		Title:   values["title"],
+		Message: values["message"],
+		Click:   values["click"],
+	}
+	for _, tag := range strings.Split(values["tags"], ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			m.Tags = append(m.Tags, tag)
+		}
+	}
+	var err error
+	if m.Priority, err = util.ParsePriority(values["priority"]); err != nil {
+		return nil, errHTTPBadRequestPriorityInvalid
+	}
+	if values["actions"] != "" {
+		actions, err := parseActions(values["actions"])
+		if err != nil {
+			return nil, wrapErrHTTP(errHTTPBadRequestActionsInvalid, "%s", err.Error())
+		}
+		for _, a := range actions {
+			m.Actions = append(m.Actions, *a)
+		}
+	}
+	return m, nil
+}
+
+// execute executes a single template, if it is defined. Since the data is untyped, text/template prints
+// "<no value>" for fields that do not exist in the webhook body; they are treated as empty instead.
+func (t *webhookTemplate) execute(name string, data interface{}, messageLimit int) (string, error) {
+	if t.tmpl.Lookup(name) == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	limitWriter := util.NewLimitWriter(&buf, util.NewFixedLimiter(int64(messageLimit)))
+	if err := t.tmpl.ExecuteTemplate(limitWriter, name, data); err != nil {
+		if err == util.ErrLimitReached {
+			return "", wrapErrHTTP(errHTTPBadRequestTemplateFailed, "%s is longer than %d bytes", name, messageLimit)
+		}
+		return "", wrapErrHTTP(errHTTPBadRequestTemplateFailed, "%s", err.Error())
+	}
+	return strings.TrimSpace(strings.ReplaceAll(buf.String(), webhookTemplateNoValue, "")), nil
+}
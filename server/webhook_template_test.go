@@ -0,0 +1,97 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testGitHubPayload = `{
+  "action": "opened",
+  "issue": {"number": 1234567890, "title": "Crash on startup", "html_url": "https://github.com/binwiederhier/ntfy/issues/1234567890"},
+  "repository": {"full_name": "binwiederhier/ntfy"},
+  "sender": {"login": "phil"}
+}`
+
+const testGitHubTemplate = `{{define "title"}}[{{.repository.full_name}}] Issue #{{.issue.number}} {{.action}}{{end}}
+{{define "message"}}{{.issue.title}} (by {{.sender.login}}){{end}}
+{{define "tags"}}github,{{.action}}{{end}}
+{{define "priority"}}{{if eq .action "opened"}}high{{end}}{{end}}
+{{define "click"}}{{.issue.html_url}}{{end}}
+{{define "actions"}}view, Open issue, {{.issue.html_url}}{{end}}`
+
+func TestServer_WebhookTemplate(t *testing.T) {
+	c := newTestConfig(t)
+	c.WebhookTemplateDir = t.TempDir()
+	c.WebhookTemplateTopics = []string{"github-events=github", "grafana-events=grafana"}
+	require.Nil(t, os.WriteFile(filepath.Join(c.WebhookTemplateDir, "github.tmpl"), []byte(testGitHubTemplate), 0600))
+	s := newTestServer(t, c)
+
+	response := request(t, s, "POST", "/mytopic", testGitHubPayload, map[string]string{"X-Template": "github"})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, "[binwiederhier/ntfy] Issue #1234567890 opened", m.Title)
+	require.Equal(t, "Crash on startup (by phil)", m.Message)
+	require.Equal(t, []string{"github", "opened"}, m.Tags)
+	require.Equal(t, 4, m.Priority)
+	require.Equal(t, "https://github.com/binwiederhier/ntfy/issues/1234567890", m.Click)
+	require.Equal(t, 1, len(m.Actions))
+	require.Equal(t, "Open issue", m.Actions[0].Label)
+
+	response = request(t, s, "POST", "/github-events", `{"action":"closed","issue":{"title":"Crash on startup","html_url":"https://github.com/binwiederhier/ntfy/issues/1"}}`, nil)
+	require.Equal(t, 200, response.Code)
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, "[] Issue # closed", m.Title) // Missing fields are empty
+	require.Equal(t, "Crash on startup (by )", m.Message)
+	require.Equal(t, 0, m.Priority)
+
+	response = request(t, s, "POST", "/grafana-events", testGrafanaPayload, nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "HighCPU", toMessage(t, response.Body.String()).Title)
+
+	response = request(t, s, "POST", "/mytopic", "not json", map[string]string{"X-Template": "github"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40039, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_WebhookTemplate_Request(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "POST", "/mytopic?template=yes&tags=sentry,{{.level}}", `{"project":"backend","level":"error","message":"Division by zero"}`, map[string]string{
+		"X-Title":    "{{.project}}: {{.level}}",
+		"X-Message":  "{{.message}}",
+		"X-Priority": `{{if eq .level "error"}}5{{else}}3{{end}}`,
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "backend: error", m.Title)
+	require.Equal(t, "Division by zero", m.Message)
+	require.Equal(t, []string{"sentry", "error"}, m.Tags)
+	require.Equal(t, 5, m.Priority)
+
+	response = request(t, s, "POST", "/mytopic", `{}`, map[string]string{"X-Template": "yes", "X-Title": "{{.project"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40041, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/mytopic", `{}`, map[string]string{"X-Template": "yes", "X-Message": `{{printf "%05000d" 0}}`})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40041, toHTTPError(t, response.Body.String()).Code) // Longer than the message limit
+	response = request(t, s, "POST", "/mytopic", `{}`, map[string]string{"X-Template": "github"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40040, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestNewWebhookTemplates_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	_, err := newWebhookTemplates("", []string{"mytopic=github"})
+	require.Error(t, err)
+	_, err = newWebhookTemplates("", []string{"mytopic"})
+	require.Error(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "grafana.tmpl"), []byte(`{{define "message"}}hi{{end}}`), 0600))
+	_, err = newWebhookTemplates(dir, nil)
+	require.Error(t, err) // Built-in format
+	require.Nil(t, os.Remove(filepath.Join(dir, "grafana.tmpl")))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "github.tmpl"), []byte(`{{define "title"}}hi{{end}}`), 0600))
+	_, err = newWebhookTemplates(dir, nil)
+	require.Error(t, err) // No message template
+}
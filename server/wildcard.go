@@ -0,0 +1,114 @@
+package server
+
+import (
+	"heckel.io/ntfy/auth"
+	"heckel.io/ntfy/util"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	topicWildcard = "*"
+)
+
+// topicPatterns matches the topics of a wildcard subscription, e.g. /alerts-*/json. Matching topics that already
+// have cached messages are subscribed to directly, see subscribeTopicPatterns. Messages of all other matching
+// topics, including topics that are created later, are received via the firehose, see publishFirehose.
+type topicPatterns struct {
+	patterns []string
+	excluded []string // Topics that are subscribed to directly
+	user     *auth.User
+	auth     auth.Auther
+}
+
+// subscribeTopicPatterns returns the cached topics that match the wildcard patterns of the subscription, as well
+// as the patterns themselves, or nil if the subscription has none. Since the name of a topic is often the only
+// thing protecting it, wildcard subscriptions are only allowed for authenticated users, and topics the user has
+// no access to are skipped, rather than failing the subscription.
+func (s *Server) subscribeTopicPatterns(r *http.Request, topics []*topic, poll bool, since sinceMarker) ([]*topic, *topicPatterns, error) {
+	patterns := topicPatternsFromPath(r.URL.Path)
+	if len(patterns) == 0 {
+		return nil, nil, nil
+	} else if s.auth == nil {
+		return nil, nil, errHTTPBadRequestTopicWildcardNotAllowed
+	}
+	user := userFromRequest(r)
+	if user == nil {
+		return nil, nil, errHTTPUnauthorized
+	}
+	p := &topicPatterns{
+		patterns: patterns,
+		excluded: make([]string, 0),
+		user:     user,
+		auth:     s.auth,
+	}
+	for _, t := range topics {
+		p.excluded = append(p.excluded, t.ID)
+	}
+	cached, err := s.messageCache.Topics()
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]string, 0)
+	for id := range cached {
+		if !p.matches(id) {
+			continue
+		} else if !poll && s.auth.Authorize(user, id, auth.PermissionSubscribe) != nil {
+			continue
+		} else if (poll || !since.IsNone()) && s.auth.Authorize(user, id, auth.PermissionPoll) != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	matched, err := s.topicsFromIDs(ids...)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.excluded = append(p.excluded, ids...)
+	return matched, p, nil
+}
+
+// Match returns true if the topic matches any of the patterns, is not subscribed to directly, and the user
+// may subscribe to it. Access is checked for every message, so that changes to the ACL apply right away.
+func (p *topicPatterns) Match(topic string) bool {
+	return p.matches(topic) && p.auth.Authorize(p.user, topic, auth.PermissionSubscribe) == nil
+}
+
+func (p *topicPatterns) matches(topic string) bool {
+	if util.InStringList(p.excluded, topic) {
+		return false
+	}
+	for _, pattern := range p.patterns {
+		if matched, _ := path.Match(pattern, topic); matched { // Topics never contain special characters other than '*'
+			return true
+		}
+	}
+	return false
+}
+
+// Subscriber returns a firehose subscriber that passes the messages of matching topics on to sub
+func (p *topicPatterns) Subscriber(sub subscriber) subscriber {
+	return func(m *message) error {
+		if !p.Match(m.Topic) {
+			return nil
+		}
+		return sub(m)
+	}
+}
+
+func topicPatternsFromPath(urlPath string) []string {
+	parts := strings.Split(urlPath, "/")
+	patterns := make([]string, 0)
+	if len(parts) < 2 {
+		return patterns
+	}
+	for _, id := range util.SplitNoEmpty(parts[1], ",") {
+		if strings.Contains(id, topicWildcard) {
+			patterns = append(patterns, id)
+		}
+	}
+	return patterns
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/auth"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+func TestServer_WildcardSubscribe(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 0)
+	require.Nil(t, s.auth.(auth.Manager).AllowAccess("ben", "alerts-secret", false, false))
+	request(t, s, "PUT", "/alerts-old", "Cached", nil)
+
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/alerts-*,backups/json?since=all&auth="+base64.RawURLEncoding.EncodeToString([]byte(basicAuth("ben:ben"))), rr)
+	request(t, s, "PUT", "/alerts-old", "Old topic", nil)
+	request(t, s, "PUT", "/alerts-new", "New topic", nil)
+	request(t, s, "PUT", "/alerts-secret", "Secret", nil)
+	request(t, s, "PUT", "/backups", "Backup done", nil)
+	request(t, s, "PUT", "/news", "Weather", nil)
+	cancel()
+	messages := toMessages(t, rr.Body.String())
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "alerts-*,backups", messages[0].Topic)
+	require.Equal(t, "Cached", messages[1].Message)
+	received := make([]string, 0)
+	for _, m := range messages[2:] {
+		received = append(received, m.Topic+": "+m.Message)
+	}
+	sort.Strings(received) // Messages of new topics arrive via the firehose, so the order may differ
+	require.Equal(t, []string{"alerts-new: New topic", "alerts-old: Old topic", "backups: Backup done"}, received)
+
+	// Polling only returns cached topics the user has access to
+	response := request(t, s, "GET", "/alerts-*/json?poll=1", "", map[string]string{"Authorization": basicAuth("ben:ben")})
+	require.Equal(t, 200, response.Code)
+	messages = toMessages(t, response.Body.String())
+	require.Len(t, messages, 3)
+	for _, m := range messages {
+		require.NotEqual(t, "alerts-secret", m.Topic)
+	}
+}
+
+func TestServer_WildcardSubscribe_NotAllowed(t *testing.T) {
+	s := newTestServerWithReservationUser(t, 0)
+	response := request(t, s, "GET", "/alerts-*/json?poll=1", "", nil)
+	require.Equal(t, 401, response.Code)
+
+	s = newTestServer(t, newTestConfig(t))
+	response = request(t, s, "GET", "/alerts-*/json?poll=1", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40050, toHTTPError(t, response.Body.String()).Code)
+	_, ok := s.topics["alerts-*"]
+	require.False(t, ok)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"heckel.io/ntfy/server/ntfypb"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Besides JSON, messages can be received and published as protobuf (the ntfypb.Message and ntfypb.PublishRequest
+// of the gRPC API) and as CBOR (with the keys of the JSON message, see cborMarshal), for embedded clients that
+// can't afford to parse JSON.
+
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeCBOR     = "application/cbor"
+	contentTypeCBORSeq  = "application/cbor-seq" // RFC 8742, CBOR items without any separator
+)
+
+// handleSubscribeProto streams the messages as protobuf. Since protobuf messages are not self-delimiting, every
+// message is prefixed with its length as a varint, like Java's writeDelimitedTo() and C#'s WriteDelimitedTo().
+func (s *Server) handleSubscribeProto(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	encoder := func(msg *message) (string, error) {
+		b, err := proto.Marshal(toGRPCMessage(msg))
+		if err != nil {
+			return "", err
+		}
+		return string(append(protowire.AppendVarint(nil, uint64(len(b))), b...)), nil
+	}
+	return s.handleSubscribeHTTP(w, r, v, contentTypeProtobuf, encoder)
+}
+
+// handleSubscribeCBOR streams the messages as a CBOR sequence, one CBOR map per message
+func (s *Server) handleSubscribeCBOR(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	encoder := func(msg *message) (string, error) {
+		b, err := cborMarshal(msg)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+	return s.handleSubscribeHTTP(w, r, v, contentTypeCBORSeq, encoder)
+}
+
+// decodePublishMessage decodes the body of a publish request to the root URL (see transformBodyJSON), depending on
+// its Content-Type: protobuf (ntfypb.PublishRequest), CBOR, or JSON (the default)
+func decodePublishMessage(r *http.Request, body io.Reader, m *publishMessage) error {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case contentTypeProtobuf:
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		var req ntfypb.PublishRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return errHTTPBadRequestProtobufInvalid
+		}
+		*m = publishMessage{
+			Topic:    req.Topic,
+			Title:    req.Title,
+			Message:  req.Message,
+			Priority: int(req.Priority),
+			Tags:     req.Tags,
+			Click:    req.Click,
+			Attach:   req.Attach,
+			Filename: req.Filename,
+			Email:    req.Email,
+			Delay:    req.Delay,
+			Markdown: req.Markdown,
+		}
+	case contentTypeCBOR:
+		b, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if err := cborUnmarshal(b, m); err != nil {
+			return errHTTPBadRequestCBORInvalid
+		}
+	default:
+		if err := json.NewDecoder(body).Decode(m); err != nil {
+			return errHTTPBadRequestJSONInvalid
+		}
+	}
+	return nil
+}
+
+// encodePublishResponse writes the published message in the format the client asked for in the Accept header,
+// i.e. as protobuf (not length-delimited, unlike the subscription stream), CBOR, or JSON (the default)
+func encodePublishResponse(w http.ResponseWriter, r *http.Request, m *message) error {
+	var b []byte
+	var err error
+	contentType := acceptedWireFormat(r)
+	switch contentType {
+	case contentTypeProtobuf:
+		b, err = proto.Marshal(toGRPCMessage(m))
+	case contentTypeCBOR:
+		b, err = cborMarshal(m)
+	default:
+		var buf bytes.Buffer
+		err = json.NewEncoder(&buf).Encode(m)
+		contentType, b = "application/json", buf.Bytes()
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	if m.held {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// acceptedWireFormat returns contentTypeProtobuf or contentTypeCBOR, if the Accept header of the request asks for
+// it, or an empty string otherwise
+func acceptedWireFormat(r *http.Request) string {
+	for _, value := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(value)
+		if mediaType == contentTypeProtobuf || mediaType == contentTypeCBOR {
+			return mediaType
+		}
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"heckel.io/ntfy/server/ntfypb"
+	"reflect"
+	"testing"
+)
+
+func TestServer_SubscribeProto(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	request(t, s, "PUT", "/mytopic", "Backup done", map[string]string{"Tags": "backup", "Priority": "2"})
+	request(t, s, "PUT", "/mytopic", "Backup failed", map[string]string{"Actions": "view, Open logs, https://example.com/logs", "X-Collapse-Key": "backup"})
+
+	response := request(t, s, "GET", "/mytopic/proto?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/x-protobuf", response.Header().Get("Content-Type"))
+	body := response.Body.Bytes()
+	messages := make([]*ntfypb.Message, 0)
+	for len(body) > 0 {
+		size, n := protowire.ConsumeVarint(body)
+		require.Greater(t, n, 0)
+		var m ntfypb.Message
+		require.Nil(t, proto.Unmarshal(body[n:n+int(size)], &m))
+		messages = append(messages, &m)
+		body = body[n+int(size):]
+	}
+	require.Len(t, messages, 2)
+	require.Equal(t, "Backup done", messages[0].Message)
+	require.Equal(t, []string{"backup"}, messages[0].Tags)
+	require.Equal(t, int32(2), messages[0].Priority)
+	require.Equal(t, "Backup failed", messages[1].Message)
+	require.Equal(t, "backup", messages[1].CollapseKey)
+	require.Equal(t, "https://example.com/logs", messages[1].Actions[0].Url)
+}
+
+func TestServer_SubscribeCBOR(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	request(t, s, "PUT", "/mytopic", "Backup done", map[string]string{"Title": "Backup"})
+	request(t, s, "PUT", "/mytopic", "Backup failed", map[string]string{"Priority": "5"})
+
+	response := request(t, s, "GET", "/mytopic/cbor?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/cbor-seq", response.Header().Get("Content-Type"))
+	d := &cborDecoder{data: response.Body.Bytes()}
+	messages := make([]*message, 0)
+	for d.pos < len(d.data) {
+		var m message
+		require.Nil(t, d.decode(reflect.ValueOf(&m).Elem(), 0))
+		messages = append(messages, &m)
+	}
+	require.Len(t, messages, 2)
+	require.Equal(t, "Backup done", messages[0].Message)
+	require.Equal(t, "Backup", messages[0].Title)
+	require.Equal(t, messageEvent, messages[0].Event)
+	require.Equal(t, "Backup failed", messages[1].Message)
+	require.Equal(t, 5, messages[1].Priority)
+	require.Equal(t, toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", nil).Body.String()), messages) // Same as JSON
+}
+
+func TestServer_PublishProto(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	body, err := proto.Marshal(&ntfypb.PublishRequest{Topic: "mytopic", Message: "Disk full", Title: "nas", Priority: 4, Tags: []string{"warning"}})
+	require.Nil(t, err)
+	response := request(t, s, "POST", "/", string(body), map[string]string{"Content-Type": "application/x-protobuf", "Accept": "application/x-protobuf"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/x-protobuf", response.Header().Get("Content-Type"))
+	var m ntfypb.Message
+	require.Nil(t, proto.Unmarshal(response.Body.Bytes(), &m))
+	require.Equal(t, "Disk full", m.Message)
+	require.Equal(t, "nas", m.Title)
+	require.Equal(t, int32(4), m.Priority)
+	require.Equal(t, []string{"warning"}, m.Tags)
+
+	messages := toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", nil).Body.String())
+	require.Len(t, messages, 1)
+	require.Equal(t, m.Id, messages[0].ID)
+
+	response = request(t, s, "POST", "/", "not protobuf", map[string]string{"Content-Type": "application/x-protobuf"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40064, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishCBOR(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	body, err := cborMarshal(&publishMessage{
+		Topic:    "mytopic",
+		Message:  "Disk full",
+		Priority: 5,
+		Actions:  []action{{Action: "http", Label: "Clean up", URL: "https://nas.lan/cleanup", Headers: map[string]string{"X-Force": "1"}}},
+	})
+	require.Nil(t, err)
+	response := request(t, s, "POST", "/", string(body), map[string]string{"Content-Type": "application/cbor", "Accept": "application/cbor"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/cbor", response.Header().Get("Content-Type"))
+	var m message
+	require.Nil(t, cborUnmarshal(response.Body.Bytes(), &m))
+	require.Equal(t, "Disk full", m.Message)
+	require.Equal(t, 5, m.Priority)
+	require.Equal(t, "Clean up", m.Actions[0].Label)
+	require.Equal(t, map[string]string{"X-Force": "1"}, m.Actions[0].Headers)
+
+	// Without an Accept header, the response is JSON
+	response = request(t, s, "POST", "/", string(body), map[string]string{"Content-Type": "application/cbor"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/json", response.Header().Get("Content-Type"))
+	require.Equal(t, "Disk full", toMessage(t, response.Body.String()).Message)
+
+	response = request(t, s, "POST", "/", `{"topic":"mytopic"}`, map[string]string{"Content-Type": "application/cbor"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40065, toHTTPError(t, response.Body.String()).Code)
+}
+
+// TestWireFormat_ProtoMatchesStructs makes sure that ntfy.proto is updated when a field is added to the message structs
+func TestWireFormat_ProtoMatchesStructs(t *testing.T) {
+	tests := []struct {
+		typ        reflect.Type
+		descriptor protoreflect.MessageDescriptor
+	}{
+		{reflect.TypeOf(message{}), (&ntfypb.Message{}).ProtoReflect().Descriptor()},
+		{reflect.TypeOf(attachment{}), (&ntfypb.Attachment{}).ProtoReflect().Descriptor()},
+		{reflect.TypeOf(action{}), (&ntfypb.Action{}).ProtoReflect().Descriptor()},
+	}
+	for _, tt := range tests {
+		for _, f := range cborFields(tt.typ) {
+			require.NotNil(t, tt.descriptor.Fields().ByName(protoreflect.Name(f.name)), "field %s of %s is missing in ntfy.proto", f.name, tt.typ.Name())
+		}
+	}
+}
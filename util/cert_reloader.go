@@ -0,0 +1,64 @@
+package util
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader loads a TLS certificate/key pair from disk, and transparently reloads it if one of the
+// files changes. It is meant to be used as tls.Config.GetCertificate, so that certificates can be renewed
+// (e.g. by certbot) without restarting the server. CertReloader may be used by multiple goroutines.
+type CertReloader struct {
+	certFile    string
+	keyFile     string
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	mu          sync.Mutex
+}
+
+// NewCertReloader creates a new CertReloader and loads the certificate/key pair for the first time
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, reloading it from disk if the certificate or key file
+// have been modified. If reloading fails (e.g. because the files are only partially written), the
+// previously loaded certificate is returned.
+func (r *CertReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_ = r.reloadIfChanged()
+	return r.cert, nil
+}
+
+func (r *CertReloader) reloadIfChanged() error {
+	certStat, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certStat.ModTime().Equal(r.certModTime) && keyStat.ModTime().Equal(r.keyModTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.certModTime = certStat.ModTime()
+	r.keyModTime = keyStat.ModTime()
+	return nil
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first.example.com")
+
+	r, err := NewCertReloader(certFile, keyFile)
+	require.Nil(t, err)
+	cert, err := r.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, "first.example.com", commonName(t, cert.Certificate[0]))
+
+	writeTestCert(t, certFile, keyFile, "second.example.com")
+	future := time.Now().Add(time.Minute) // Make sure the modification time changes
+	require.Nil(t, os.Chtimes(certFile, future, future))
+	require.Nil(t, os.Chtimes(keyFile, future, future))
+	cert, err = r.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, "second.example.com", commonName(t, cert.Certificate[0]))
+}
+
+func TestCertReloader_InvalidFileKeepsOldCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, "first.example.com")
+
+	r, err := NewCertReloader(certFile, keyFile)
+	require.Nil(t, err)
+
+	require.Nil(t, os.WriteFile(certFile, []byte("this is not a cert"), 0600))
+	future := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(certFile, future, future))
+	cert, err := r.GetCertificate(nil)
+	require.Nil(t, err)
+	require.Equal(t, "first.example.com", commonName(t, cert.Certificate[0]))
+}
+
+func TestCertReloader_FileMissing(t *testing.T) {
+	_, err := NewCertReloader("/does/not/exist.pem", "/does/not/exist.key")
+	require.NotNil(t, err)
+}
+
+func writeTestCert(t *testing.T, certFile, keyFile, cn string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func commonName(t *testing.T, der []byte) string {
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert.Subject.CommonName
+}
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMaxYears is how far ahead CronSchedule.Next looks, so that impossible schedules (e.g. February 30) terminate
+const cronMaxYears = 5
+
+var (
+	cronMacros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+	cronMonthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// CronSchedule is a parsed cron expression in the standard five-field format (minute, hour, day of month,
+// month, day of week), see ParseCron. Each field is a bitmask of the matching values.
+type CronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	anyDay, anyWeekday                     bool // Day of month and day of week are "*", see matchesDay
+}
+
+// ParseCron parses a cron expression like "0 9 * * mon-fri" or "*/15 * * * *". Fields may be lists of values,
+// ranges and steps, months and days of the week may also be given as (English) names. The macros @hourly, @daily,
+// @weekly, @monthly and @yearly are supported as well. Day of the week 7 is Sunday, just like 0.
+func ParseCron(expr string) (*CronSchedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %s: expected 5 fields, got %d", expr, len(fields))
+	}
+	var err error
+	c := &CronSchedule{anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	if c.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	} else if c.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	} else if c.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	} else if c.months, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, err
+	} else if c.weekdays, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return nil, err
+	}
+	if c.weekdays&(1<<7) != 0 {
+		c.weekdays |= 1 // Sunday
+	}
+	return c, nil
+}
+
+// Next returns the first time after t (at minute granularity) that matches the schedule, in the location of t.
+// It returns the zero time if there is no such time within the next few years.
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(cronMaxYears, 0, 0)
+	for t.Before(end) {
+		if c.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		} else if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		} else if c.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		} else if c.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay follows the (odd) cron convention: if both day of month and day of week are restricted, a day
+// matches if either of them matches
+func (c *CronSchedule) matchesDay(t time.Time) bool {
+	day := c.days&(1<<uint(t.Day())) != 0
+	weekday := c.weekdays&(1<<uint(t.Weekday())) != 0
+	if !c.anyDay && !c.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeStr, step := part, 1
+		if i := strings.Index(part, "/"); i != -1 {
+			var err error
+			rangeStr = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid cron field %s: invalid step", field)
+			}
+		}
+		from, to := min, max
+		if rangeStr != "*" {
+			bounds := strings.SplitN(rangeStr, "-", 2)
+			var err error
+			if from, err = parseCronValue(bounds[0], min, max, names); err != nil {
+				return 0, fmt.Errorf("invalid cron field %s: %s", field, err.Error())
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = parseCronValue(bounds[1], min, max, names); err != nil {
+					return 0, fmt.Errorf("invalid cron field %s: %s", field, err.Error())
+				}
+			} else if step > 1 {
+				to = max // e.g. "5/15" is every 15 minutes, starting at minute 5
+			}
+			if from > to {
+				return 0, fmt.Errorf("invalid cron field %s: invalid range", field)
+			}
+		}
+		for i := from; i <= to; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return i + min, nil
+		}
+	}
+	value, err := strconv.Atoi(s)
+	if err != nil || value < min || value > max {
+		return 0, fmt.Errorf("value %s out of range %d-%d", s, min, max)
+	}
+	return value, nil
+}
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseCron_Next(t *testing.T) {
+	now := time.Date(2022, 12, 1, 10, 17, 30, 0, time.UTC) // Thursday
+	tests := map[string]time.Time{
+		"* * * * *":         time.Date(2022, 12, 1, 10, 18, 0, 0, time.UTC),
+		"*/15 * * * *":      time.Date(2022, 12, 1, 10, 30, 0, 0, time.UTC),
+		"5/15 * * * *":      time.Date(2022, 12, 1, 10, 20, 0, 0, time.UTC),
+		"0 9 * * *":         time.Date(2022, 12, 2, 9, 0, 0, 0, time.UTC),
+		"0 9 * * mon-fri":   time.Date(2022, 12, 2, 9, 0, 0, 0, time.UTC),
+		"0 9 * * sat,7":     time.Date(2022, 12, 3, 9, 0, 0, 0, time.UTC),
+		"30 2 1 * *":        time.Date(2023, 1, 1, 2, 30, 0, 0, time.UTC),
+		"0 0 13 * fri":      time.Date(2022, 12, 2, 0, 0, 0, 0, time.UTC), // Either day of month or day of week
+		"0 12 29 feb *":     time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC),
+		"@hourly":           time.Date(2022, 12, 1, 11, 0, 0, 0, time.UTC),
+		"@weekly":           time.Date(2022, 12, 4, 0, 0, 0, 0, time.UTC),
+		"@yearly":           time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC),
+		"0,30 8-10 * DEC *": time.Date(2022, 12, 1, 10, 30, 0, 0, time.UTC),
+		"0 0 30 feb *":      {},
+	}
+	for expr, expected := range tests {
+		c, err := ParseCron(expr)
+		require.Nil(t, err, expr)
+		require.Equal(t, expected, c.Next(now), expr)
+	}
+}
+
+func TestParseCron_Location(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.Nil(t, err)
+	c, err := ParseCron("0 9 * * *")
+	require.Nil(t, err)
+	next := c.Next(time.Date(2022, 12, 1, 10, 0, 0, 0, time.UTC).In(berlin))
+	require.Equal(t, time.Date(2022, 12, 2, 8, 0, 0, 0, time.UTC), next.UTC())
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "*/0 * * * *", "10-5 * * * *", "* * * * funday", "@sometimes"} {
+		_, err := ParseCron(expr)
+		require.Error(t, err, expr)
+	}
+}
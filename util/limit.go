@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"errors"
 	"golang.org/x/time/rate"
 	"io"
@@ -44,6 +45,13 @@ func (l *FixedLimiter) Allow(n int64) error {
 	return nil
 }
 
+// Value returns the current internal value of the limiter
+func (l *FixedLimiter) Value() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.value
+}
+
 // RateLimiter is a Limiter that wraps a rate.Limiter, allowing a floating time-based limit.
 type RateLimiter struct {
 	limiter *rate.Limiter
@@ -108,3 +116,78 @@ func (w *LimitWriter) Write(p []byte) (n int, err error) {
 	w.written += int64(n)
 	return
 }
+
+// LimitReader implements an io.Reader that will pass through all Read calls to the underlying
+// reader r until any of the limiter's limit is reached, at which point a Read will return ErrLimitReached.
+// Each limiter's value is increased with every read.
+type LimitReader struct {
+	r        io.Reader
+	limiters []Limiter
+	mu       sync.Mutex
+}
+
+// NewLimitReader creates a new LimitReader
+func NewLimitReader(r io.Reader, limiters ...Limiter) *LimitReader {
+	return &LimitReader{
+		r:        r,
+		limiters: limiters,
+	}
+}
+
+// Read passes through all reads from the underlying reader until any of the given limiter's limit is reached
+func (r *LimitReader) Read(p []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, err = r.r.Read(p)
+	for i := 0; i < len(r.limiters); i++ {
+		if err := r.limiters[i].Allow(int64(n)); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				r.limiters[j].Allow(-int64(n)) // Revert limiters limits if allowed
+			}
+			return 0, ErrLimitReached
+		}
+	}
+	return
+}
+
+// ThrottleWriter implements an io.Writer that slows down all Write calls to the underlying writer w, so that
+// none of the rate limiters' rates (in bytes per second) is exceeded. Writes are split into chunks no larger
+// than the smallest burst of the limiters. Waiting is aborted with the context's error once ctx is done.
+type ThrottleWriter struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+// NewThrottleWriter creates a new ThrottleWriter
+func NewThrottleWriter(ctx context.Context, w io.Writer, limiters ...*rate.Limiter) *ThrottleWriter {
+	return &ThrottleWriter{
+		ctx:      ctx,
+		w:        w,
+		limiters: limiters,
+	}
+}
+
+// Write passes through all writes to the underlying writer, waiting for the limiters before each chunk
+func (w *ThrottleWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := len(p)
+		for _, limiter := range w.limiters {
+			if limiter.Burst() < chunk {
+				chunk = limiter.Burst()
+			}
+		}
+		for _, limiter := range w.limiters {
+			if err := limiter.WaitN(w.ctx, chunk); err != nil {
+				return n, err
+			}
+		}
+		written, err := w.w.Write(p[:chunk])
+		n += written
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
@@ -2,7 +2,10 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	"io"
 	"testing"
 	"time"
 )
@@ -137,3 +140,50 @@ func TestLimitWriter_WriteTwoDifferentLimiters_Wait_FixedLimiterFail(t *testing.
 	_, err = lw.Write(make([]byte, 8)) // <<< FixedLimiter fails
 	require.Equal(t, ErrLimitReached, err)
 }
+
+func TestLimitReader_ReadOneLimiter(t *testing.T) {
+	l := NewFixedLimiter(10)
+	lr := NewLimitReader(bytes.NewReader(make([]byte, 10)), l)
+	b, err := io.ReadAll(lr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 10 {
+		t.Fatalf("expected to read %d bytes, got %d", 10, len(b))
+	}
+	if l.Value() != 10 {
+		t.Fatalf("expected limiter value to be %d, got %d", 10, l.Value())
+	}
+}
+
+func TestLimitReader_ReadLimitReached(t *testing.T) {
+	l := NewFixedLimiter(10)
+	lr := NewLimitReader(bytes.NewReader(make([]byte, 11)), l)
+	if _, err := io.ReadAll(lr); err != ErrLimitReached {
+		t.Fatalf("expected ErrLimitReached, got %#v", err)
+	}
+}
+
+func TestThrottleWriter_Write(t *testing.T) {
+	var buf bytes.Buffer
+	visitor, global := rate.NewLimiter(1000, 100), rate.NewLimiter(2000, 1000)
+	w := NewThrottleWriter(context.Background(), &buf, visitor, global)
+	start := time.Now()
+	n, err := w.Write(make([]byte, 600)) // 100 bytes right away, then 500 bytes at 1000 bytes/s
+	require.Nil(t, err)
+	require.Equal(t, 600, n)
+	require.Equal(t, 600, buf.Len())
+	require.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestThrottleWriter_WriteCanceled(t *testing.T) {
+	var buf bytes.Buffer
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w := NewThrottleWriter(ctx, &buf, rate.NewLimiter(100, 100))
+	n, err := w.Write(make([]byte, 1000))
+	require.Error(t, err)
+	require.Equal(t, 100, n)
+	require.Equal(t, 100, buf.Len())
+}
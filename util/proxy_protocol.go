@@ -0,0 +1,186 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidProxyProtocolHeader is returned when reading from a connection that did not start with a valid
+// PROXY protocol header
+var ErrInvalidProxyProtocolHeader = errors.New("invalid PROXY protocol header")
+
+const (
+	proxyProtocolV1MaxLength = 107 // Max length of a v1 header line, including CRLF
+	proxyProtocolV2MaxLength = 2048
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolListener is a net.Listener for connections from a load balancer (e.g. HAProxy) that speaks the
+// PROXY protocol (version 1 or 2, see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt). The header
+// is required on every connection, and the remote address of the accepted connections is the client address
+// from the header.
+//
+// The header is read on the first Read or RemoteAddr call and not in Accept, so that slow clients do not
+// block other connections from being accepted.
+type ProxyProtocolListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+// NewProxyProtocolListener wraps the given listener. The timeout defines how long to wait for the header.
+func NewProxyProtocolListener(listener net.Listener, timeout time.Duration) *ProxyProtocolListener {
+	return &ProxyProtocolListener{
+		Listener: listener,
+		timeout:  timeout,
+	}
+}
+
+// Accept waits for and returns the next connection to the listener
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.timeout,
+	}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader       *bufio.Reader
+	timeout      time.Duration
+	readDeadline time.Time
+	remoteAddr   net.Addr
+	err          error
+	once         sync.Once
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	if c.timeout > 0 {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(c.readDeadline) // Restore the deadline set by the user of the connection
+	}
+	c.remoteAddr, c.err = readProxyProtocolHeader(c.reader)
+	if c.err != nil {
+		c.remoteAddr = nil
+	}
+}
+
+// readProxyProtocolHeader reads a v1 or v2 PROXY protocol header from the given reader, and returns the source
+// address from the header. If the header does not contain an address (e.g. for health checks, "UNKNOWN"
+// or "LOCAL"), a nil address is returned.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) == "PROXY" {
+		return readProxyProtocolV1Header(r)
+	}
+	prefix, err = r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	} else if !bytes.Equal(prefix, proxyProtocolV2Signature) {
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	return readProxyProtocolV2Header(r)
+}
+
+// readProxyProtocolV1Header reads the human-readable header, e.g. "PROXY TCP4 1.2.3.4 5.6.7.8 1234 25\r\n"
+func readProxyProtocolV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, ErrInvalidProxyProtocolHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	} else if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2Header reads the binary header: 12 bytes signature, 1 byte version and command, 1 byte
+// address family and protocol, 2 bytes length, followed by the addresses and optional TLVs (which are ignored)
+func readProxyProtocolV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	version, command, family := header[12]>>4, header[12]&0x0f, header[13]>>4
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+	if version != 2 || command > 1 || length > proxyProtocolV2MaxLength {
+		return nil, ErrInvalidProxyProtocolHeader
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if command == 0 { // LOCAL, e.g. health checks of the load balancer itself
+		return nil, nil
+	}
+	switch family {
+	case 1: // AF_INET: 4 bytes source address, 4 bytes destination address, 2 bytes source port, 2 bytes destination port
+		if length < 12 {
+			return nil, ErrInvalidProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6: same as above, but with 16 byte addresses
+		if length < 36 {
+			return nil, ErrInvalidProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil // AF_UNSPEC or AF_UNIX: no usable address
+}
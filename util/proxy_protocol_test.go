@@ -0,0 +1,113 @@
+package util
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolListener_V1(t *testing.T) {
+	conn := acceptProxyProtocolConn(t, []byte("PROXY TCP4 1.2.3.4 10.0.0.1 56324 25\r\nEHLO example.com\r\n"))
+	require.Equal(t, "1.2.3.4:56324", conn.RemoteAddr().String())
+	requireProxyProtocolData(t, conn, "EHLO example.com\r\n")
+}
+
+func TestProxyProtocolListener_V1_IPv6(t *testing.T) {
+	conn := acceptProxyProtocolConn(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\nEHLO example.com\r\n"))
+	requireProxyProtocolData(t, conn, "EHLO example.com\r\n") // Read before RemoteAddr
+	require.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+}
+
+func TestProxyProtocolListener_V1_Unknown(t *testing.T) {
+	conn := acceptProxyProtocolConn(t, []byte("PROXY UNKNOWN\r\nQUIT\r\n"))
+	require.Equal(t, "pipe", conn.RemoteAddr().Network()) // Falls back to the real remote address
+	requireProxyProtocolData(t, conn, "QUIT\r\n")
+}
+
+func TestProxyProtocolListener_V2(t *testing.T) {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12+7)            // v2, PROXY, TCP over IPv4, 12 bytes addresses + 7 bytes TLV
+	header = append(header, 5, 6, 7, 8, 10, 0, 0, 1)        // Source and destination address
+	header = append(header, 0x9c, 0x40, 0, 25)              // Source port (40000) and destination port (25)
+	header = append(header, 0x02, 0, 4, 'h', 'o', 's', 't') // PP2_TYPE_AUTHORITY TLV, ignored
+	conn := acceptProxyProtocolConn(t, append(header, []byte("EHLO example.com\r\n")...))
+	require.Equal(t, "5.6.7.8:40000", conn.RemoteAddr().String())
+	requireProxyProtocolData(t, conn, "EHLO example.com\r\n")
+}
+
+func TestProxyProtocolListener_V2_Local(t *testing.T) {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20, 0x00, 0, 0) // v2, LOCAL, AF_UNSPEC, no addresses
+	conn := acceptProxyProtocolConn(t, append(header, []byte("QUIT\r\n")...))
+	require.Equal(t, "pipe", conn.RemoteAddr().Network())
+	requireProxyProtocolData(t, conn, "QUIT\r\n")
+}
+
+func TestProxyProtocolListener_Invalid(t *testing.T) {
+	for _, data := range []string{
+		"EHLO example.com\r\n",
+		"PROXY TCP4 1.2.3.4 10.0.0.1\r\n",
+		"PROXY TCP4 not-an-ip 10.0.0.1 56324 25\r\n",
+		"PROXY TCP4 1.2.3.4 10.0.0.1 56324 25 and a very long line that exceeds the maximum length of a v1 header line\r\n",
+		string(proxyProtocolV2Signature) + "\x31\x11\x00\x00",
+	} {
+		conn := acceptProxyProtocolConn(t, []byte(data))
+		_, err := conn.Read(make([]byte, 10))
+		require.Equal(t, ErrInvalidProxyProtocolHeader, err, data)
+	}
+}
+
+func TestProxyProtocolListener_Timeout(t *testing.T) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	listener := NewProxyProtocolListener(&testListener{conns: []net.Conn{server}}, 50*time.Millisecond)
+	conn, err := listener.Accept()
+	require.Nil(t, err)
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 10))
+	require.NotNil(t, err)
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func acceptProxyProtocolConn(t *testing.T, data []byte) net.Conn {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		client.Write(data)
+	}()
+	listener := NewProxyProtocolListener(&testListener{conns: []net.Conn{server}}, time.Second)
+	conn, err := listener.Accept()
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func requireProxyProtocolData(t *testing.T, conn net.Conn, expected string) {
+	data := make([]byte, len(expected))
+	_, err := io.ReadFull(conn, data)
+	require.Nil(t, err)
+	require.Equal(t, expected, string(data))
+}
+
+type testListener struct {
+	conns []net.Conn
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	if len(l.conns) == 0 {
+		return nil, io.EOF
+	}
+	conn := l.conns[0]
+	l.conns = l.conns[1:]
+	return conn, nil
+}
+
+func (l *testListener) Close() error {
+	return nil
+}
+
+func (l *testListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
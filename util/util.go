@@ -25,6 +25,7 @@ var (
 	randomMutex        = sync.Mutex{}
 	sizeStrRegex       = regexp.MustCompile(`(?i)^(\d+)([gmkb])?$`)
 	errInvalidPriority = errors.New("invalid priority")
+	errInvalidMapping  = errors.New("invalid mapping")
 )
 
 // FileExists checks if a file exists, and returns true if it does
@@ -183,6 +184,24 @@ func PriorityString(priority int) (string, error) {
 	}
 }
 
+// ParsePriorityMapping parses a comma-separated list of key/priority pairs, e.g. "1=urgent,low=min",
+// into a map. Keys are converted to lower case, and priorities may be numbers or names (see ParsePriority).
+func ParsePriorityMapping(s string) (map[string]int, error) {
+	mapping := make(map[string]int)
+	for _, pair := range SplitNoEmpty(s, ",") {
+		key, value := SplitKV(pair, "=")
+		if key == "" {
+			return nil, errInvalidMapping
+		}
+		priority, err := ParsePriority(value)
+		if err != nil || priority == 0 {
+			return nil, errInvalidPriority
+		}
+		mapping[strings.ToLower(key)] = priority
+	}
+	return mapping, nil
+}
+
 // ExpandHome replaces "~" with the user's home directory
 func ExpandHome(path string) string {
 	return os.ExpandEnv(strings.ReplaceAll(path, "~", "$HOME"))
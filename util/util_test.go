@@ -116,6 +116,24 @@ func TestPriorityString_Invalid(t *testing.T) {
 	require.Equal(t, err, errInvalidPriority)
 }
 
+func TestParsePriorityMapping(t *testing.T) {
+	mapping, err := ParsePriorityMapping("1=urgent, 2 = high,Importance-High=5,low=min")
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"1": 5, "2": 4, "importance-high": 5, "low": 1}, mapping)
+
+	mapping, err = ParsePriorityMapping("")
+	require.Nil(t, err)
+	require.Empty(t, mapping)
+}
+
+func TestParsePriorityMapping_Invalid(t *testing.T) {
+	_, err := ParsePriorityMapping("1=urgent,2")
+	require.Equal(t, errInvalidMapping, err)
+
+	_, err = ParsePriorityMapping("1=super-urgent")
+	require.Equal(t, errInvalidPriority, err)
+}
+
 func TestShortTopicURL(t *testing.T) {
 	require.Equal(t, "ntfy.sh/mytopic", ShortTopicURL("https://ntfy.sh/mytopic"))
 	require.Equal(t, "ntfy.sh/mytopic", ShortTopicURL("http://ntfy.sh/mytopic"))
@@ -5,5 +5,6 @@
 
 var config = {
     appRoot: "/",
-    disallowedTopics: ["docs", "static", "file", "app", "settings"]
+    disallowedTopics: ["docs", "static", "file", "app", "settings"],
+    oidcLogin: false
 };
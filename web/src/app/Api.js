@@ -6,8 +6,11 @@ import {
     topicShortUrl,
     topicUrl,
     topicUrlAuth,
+    topicUrlInfo,
     topicUrlJsonPoll,
-    topicUrlJsonPollWithSince, userStatsUrl
+    topicUrlJsonPollWithSince,
+    topicUrlSearch,
+    userStatsUrl
 } from "./utils";
 import userManager from "./UserManager";
 
@@ -28,6 +31,21 @@ class Api {
         return messages;
     }
 
+    async search(baseUrl, topic, query) {
+        const user = await userManager.get(baseUrl);
+        const url = topicUrlSearch(baseUrl, topic, query);
+        const messages = [];
+        const headers = maybeWithBasicAuth({}, user);
+        console.log(`[Api] Searching ${url}`);
+        for await (let line of fetchLinesIterator(url, headers)) {
+            const message = JSON.parse(line);
+            if (message.event === "message") { // Skip error responses, e.g. for an empty query
+                messages.push(message);
+            }
+        }
+        return messages;
+    }
+
     async publish(baseUrl, topic, message, options) {
         const user = await userManager.get(baseUrl);
         console.log(`[Api] Publishing message to ${topicUrl(baseUrl, topic)}`);
@@ -48,6 +66,21 @@ class Api {
         return response;
     }
 
+    async publishAction(baseUrl, action) {
+        const user = await userManager.get(baseUrl);
+        const url = topicUrl(baseUrl, action.topic);
+        console.log(`[Api] Publishing action message to ${url}`);
+        const response = await fetch(url, {
+            method: 'POST',
+            body: action.message ?? "",
+            headers: maybeWithBasicAuth({ ...(action.headers ?? {}) }, user)
+        });
+        if (response.status < 200 || response.status > 299) {
+            throw new Error(`Unexpected response: ${response.status}`);
+        }
+        return response;
+    }
+
     /**
      * Publishes to a topic using XMLHttpRequest (XHR), and returns a Promise with the active request.
      * Unfortunately, fetch() does not support a progress hook, which is why XHR has to be used.
@@ -102,22 +135,39 @@ class Api {
         return send;
     }
 
-    async auth(baseUrl, topic, user) {
+    async auth(baseUrl, topic, user, totp) {
         const url = topicUrlAuth(baseUrl, topic);
         console.log(`[Api] Checking auth for ${url}`);
-        const response = await fetch(url, {
-            headers: maybeWithBasicAuth({}, user)
-        });
+        const headers = maybeWithBasicAuth({}, user);
+        if (totp) {
+            headers["X-TOTP"] = totp;
+        }
+        const response = await fetch(url, { headers });
         if (response.status >= 200 && response.status <= 299) {
             return true;
         } else if (!user && response.status === 404) {
             return true; // Special case: Anonymous login to old servers return 404 since /<topic>/auth doesn't exist
+        } else if (response.status === 401 && (await response.json().catch(() => ({}))).code === 40102) {
+            throw new TOTPRequiredError(); // Two-factor authentication code missing or invalid, see server/errors.go
         } else if (response.status === 401 || response.status === 403) { // See server/server.go
             return false;
         }
         throw new Error(`Unexpected server response ${response.status}`);
     }
 
+    async topicInfo(baseUrl, topic) {
+        const user = await userManager.get(baseUrl);
+        const url = topicUrlInfo(baseUrl, topic);
+        console.log(`[Api] Fetching topic info ${url}`);
+        const response = await fetch(url, { headers: maybeWithBasicAuth({}, user) });
+        if (response.status === 404) {
+            return null; // Older servers don't have the /<topic>/info endpoint
+        } else if (response.status !== 200) {
+            throw new Error(`Unexpected server response ${response.status}`);
+        }
+        return response.json();
+    }
+
     async userStats(baseUrl) {
         const url = userStatsUrl(baseUrl);
         console.log(`[Api] Fetching user stats ${url}`);
@@ -131,5 +181,11 @@ class Api {
     }
 }
 
+export class TOTPRequiredError extends Error {
+    constructor() {
+        super("Two-factor authentication code required");
+    }
+}
+
 const api = new Api();
 export default api;
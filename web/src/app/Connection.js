@@ -1,4 +1,4 @@
-import {basicAuth, encodeBase64Url, topicShortUrl, topicUrlWs} from "./utils";
+import {authHeader, encodeBase64Url, topicShortUrl, topicUrlWs} from "./utils";
 
 const retryBackoffSeconds = [5, 10, 15, 20, 30];
 
@@ -43,6 +43,9 @@ class Connection {
                 const data = JSON.parse(event.data);
                 if (data.event === 'open') {
                     return;
+                } else if ((data.event === 'message_updated' || data.event === 'message_deleted') && 'id' in data) {
+                    this.onNotification(this.subscriptionId, data); // Do not update "since", the message is gone
+                    return;
                 }
                 const relevantAndValid =
                     data.event === 'message' &&
@@ -96,7 +99,7 @@ class Connection {
             params.push(`since=${this.since}`);
         }
         if (this.user) {
-            const auth = encodeBase64Url(basicAuth(this.user.username, this.user.password));
+            const auth = encodeBase64Url(authHeader(this.user));
             params.push(`auth=${auth}`);
         }
         const wsUrl = topicUrlWs(this.baseUrl, this.topic);
@@ -33,6 +33,7 @@ class Poller {
     async poll(subscription) {
         console.log(`[Poller] Polling ${subscription.id}`);
 
+        await this.pollInfo(subscription);
         const since = subscription.last;
         const notifications = await api.poll(subscription.baseUrl, subscription.topic, since);
         if (!notifications || notifications.length === 0) {
@@ -43,6 +44,17 @@ class Poller {
         await subscriptionManager.addNotifications(subscription.id, notifications);
     }
 
+    async pollInfo(subscription) {
+        try {
+            const info = await api.topicInfo(subscription.baseUrl, subscription.topic);
+            if (info) {
+                await subscriptionManager.updateInfo(subscription.id, info);
+            }
+        } catch (e) {
+            console.log(`[Poller] Error fetching topic info for ${subscription.id}`, e); // Notifications are more important
+        }
+    }
+
     pollInBackground(subscription) {
         const fn = async () => {
             try {
@@ -29,6 +29,14 @@ class SubscriptionManager {
         return subscription;
     }
 
+    async updateInfo(subscriptionId, info) {
+        await db.subscriptions.update(subscriptionId, {
+            displayName: info.display_name || null,
+            icon: info.icon || null,
+            description: info.description || null
+        });
+    }
+
     async updateState(subscriptionId, state) {
         db.subscriptions.update(subscriptionId, { state: state });
     }
@@ -105,6 +113,16 @@ class SubscriptionManager {
         return true;
     }
 
+    /** Replaces title, message, priority, etc. of an existing notification with those of an updated message */
+    async replaceNotification(notification) {
+        const existing = await db.notifications.get(notification.id);
+        if (!existing) {
+            return false;
+        }
+        await db.notifications.put({ ...existing, ...notification, event: 'message' });
+        return true;
+    }
+
     async deleteNotification(notificationId) {
         await db.notifications.delete(notificationId);
     }
@@ -17,7 +17,17 @@ export const topicUrlJson = (baseUrl, topic) => `${topicUrl(baseUrl, topic)}/jso
 export const topicUrlJsonPoll = (baseUrl, topic) => `${topicUrlJson(baseUrl, topic)}?poll=1`;
 export const topicUrlJsonPollWithSince = (baseUrl, topic, since) => `${topicUrlJson(baseUrl, topic)}?poll=1&since=${since}`;
 export const topicUrlAuth = (baseUrl, topic) => `${topicUrl(baseUrl, topic)}/auth`;
+export const topicUrlInfo = (baseUrl, topic) => `${topicUrl(baseUrl, topic)}/info`;
+export const topicUrlSearch = (baseUrl, topic, query) => `${topicUrl(baseUrl, topic)}/search?q=${encodeURIComponent(query)}`;
 export const topicShortUrl = (baseUrl, topic) => shortUrl(topicUrl(baseUrl, topic));
+export const topicDisplayName = (subscription) => {
+    if (subscription.displayName) {
+        return subscription.displayName; // Set on the server, see Api.topicInfo
+    } else if (subscription.baseUrl === window.location.origin) {
+        return subscription.topic;
+    }
+    return topicShortUrl(subscription.baseUrl, subscription.topic);
+};
 export const userStatsUrl = (baseUrl) => `${baseUrl}/user/stats`;
 export const shortUrl = (url) => url.replaceAll(/https?:\/\//g, "");
 export const expandUrl = (url) => [`https://${url}`, `http://${url}`];
@@ -88,11 +98,15 @@ export const unmatchedTags = (tags) => {
 
 export const maybeWithBasicAuth = (headers, user) => {
     if (user) {
-        headers['Authorization'] = `Basic ${encodeBase64(`${user.username}:${user.password}`)}`;
+        headers['Authorization'] = authHeader(user);
     }
     return headers;
 }
 
+export const authHeader = (user) => {
+    return (user.token) ? `Bearer ${user.token}` : basicAuth(user.username, user.password); // Token from OIDC login
+}
+
 export const basicAuth = (username, password) => {
     return `Basic ${encodeBase64(`${username}:${password}`)}`;
 }
@@ -30,7 +30,7 @@ const ActionBar = (props) => {
     const location = useLocation();
     let title = "ntfy";
     if (props.selected) {
-        title = topicShortUrl(props.selected.baseUrl, props.selected.topic);
+        title = props.selected.displayName || topicShortUrl(props.selected.baseUrl, props.selected.topic);
     } else if (location.pathname === "/settings") {
         title = t("action_bar_settings");
     }
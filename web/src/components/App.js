@@ -75,6 +75,7 @@ const Layout = () => {
 
     useConnectionListeners(subscriptions, users);
     useBackgroundProcesses();
+    useEffect(() => { maybeSaveOIDCLogin() }, []);
     useEffect(() => updateTitle(newNotificationsCount), [newNotificationsCount]);
 
     return (
@@ -106,6 +107,19 @@ const Layout = () => {
     );
 }
 
+// After an OIDC login, the server redirects back to the app with the token in the URL fragment, see server_oidc.go
+const maybeSaveOIDCLogin = async () => {
+    const params = new URLSearchParams(window.location.hash.substring(1));
+    const username = params.get("oidc_username");
+    const token = params.get("oidc_token");
+    if (!username || !token) {
+        return;
+    }
+    window.history.replaceState(null, "", window.location.pathname + window.location.search); // Remove token from URL
+    await userManager.save({baseUrl: window.location.origin, username, token});
+    console.log(`[App] Logged in as user ${username} via OIDC`);
+};
+
 const Main = (props) => {
     return (
         <Box
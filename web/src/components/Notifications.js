@@ -5,10 +5,12 @@ import {
     CardContent,
     CircularProgress,
     Fade,
+    InputAdornment,
     Link,
     Modal,
     Snackbar,
     Stack,
+    TextField,
     Tooltip
 } from "@mui/material";
 import Card from "@mui/material/Card";
@@ -28,11 +30,13 @@ import {
 import IconButton from "@mui/material/IconButton";
 import CheckIcon from '@mui/icons-material/Check';
 import CloseIcon from '@mui/icons-material/Close';
+import SearchIcon from '@mui/icons-material/Search';
 import {LightboxBackdrop, Paragraph, VerticallyCenteredContainer} from "./styles";
 import {useLiveQuery} from "dexie-react-hooks";
 import Box from "@mui/material/Box";
 import Button from "@mui/material/Button";
 import subscriptionManager from "../app/SubscriptionManager";
+import api from "../app/Api";
 import InfiniteScroll from "react-infinite-scroll-component";
 import priority1 from "../img/priority-1.svg";
 import priority2 from "../img/priority-2.svg";
@@ -65,12 +69,62 @@ const AllSubscriptions = (props) => {
 const SingleSubscription = (props) => {
     const subscription = props.subscription;
     const notifications = useLiveQuery(() => subscriptionManager.getNotifications(subscription.id), [subscription]);
+    const [query, setQuery] = useState("");
+    const [results, setResults] = useState(null);
+
+    useEffect(() => {
+        setQuery("");
+    }, [subscription.id]);
+
+    useEffect(() => {
+        if (query.trim() === "") {
+            setResults(null);
+            return;
+        }
+        const timeout = setTimeout(async () => { // Do not hammer the server while the user is typing
+            try {
+                const messages = await api.search(subscription.baseUrl, subscription.topic, query);
+                setResults(messages.reverse()); // Newest first, like the notification list
+            } catch (e) {
+                console.log(`[Notifications] Search failed`, e);
+                setResults([]);
+            }
+        }, 300);
+        return () => clearTimeout(timeout);
+    }, [subscription, query]);
+
+    const search = <SearchField query={query} onChange={setQuery}/>;
     if (notifications === null || notifications === undefined) {
         return <Loading/>;
+    } else if (results) {
+        return <NotificationList id={subscription.id} notifications={results} messageBar={true} search={search} searchResults={true}/>;
     } else if (notifications.length === 0) {
         return <NoNotifications subscription={subscription}/>;
     }
-    return <NotificationList id={subscription.id} notifications={notifications} messageBar={true}/>;
+    return <NotificationList id={subscription.id} notifications={notifications} messageBar={true} search={search}/>;
+}
+
+const SearchField = (props) => {
+    const { t } = useTranslation();
+    return (
+        <TextField
+            value={props.query}
+            onChange={ev => props.onChange(ev.target.value)}
+            placeholder={t("notifications_search_placeholder")}
+            inputProps={{ "aria-label": t("notifications_search_placeholder") }}
+            size="small"
+            fullWidth
+            InputProps={{
+                startAdornment: <InputAdornment position="start"><SearchIcon/></InputAdornment>,
+                endAdornment: props.query &&
+                    <InputAdornment position="end">
+                        <IconButton onClick={() => props.onChange("")} edge="end" aria-label={t("notifications_search_clear")}>
+                            <CloseIcon/>
+                        </IconButton>
+                    </InputAdornment>
+            }}
+        />
+    );
 }
 
 const NotificationList = (props) => {
@@ -107,10 +161,14 @@ const NotificationList = (props) => {
                 }}
             >
                 <Stack spacing={3}>
+                    {props.search}
+                    {props.searchResults && notifications.length === 0 &&
+                        <Typography color="text.secondary" align="center">{t("notifications_search_none")}</Typography>}
                     {notifications.slice(0, count).map(notification =>
                         <NotificationItem
                             key={notification.id}
                             notification={notification}
+                            readOnly={props.searchResults}
                             onShowSnack={() => setSnackOpen(true)}
                         />)}
                     <Snackbar
@@ -152,11 +210,12 @@ const NotificationItem = (props) => {
     return (
         <Card sx={{ minWidth: 275, padding: 1 }} role="listitem" aria-label={t("notifications_list_item")}>
             <CardContent>
-                <Tooltip title={t("notifications_delete")} enterDelay={500}>
+                {!props.readOnly &&
+                  <Tooltip title={t("notifications_delete")} enterDelay={500}>
                     <IconButton onClick={handleDelete} sx={{ float: 'right', marginRight: -1, marginTop: -1 }} aria-label={t("notifications_delete")}>
-                        <CloseIcon />
+                      <CloseIcon />
                     </IconButton>
-                </Tooltip>
+                  </Tooltip>}
                 {notification.new === 1 &&
                   <Tooltip title={t("notifications_mark_read")} enterDelay={500}>
                     <IconButton onClick={handleMarkRead} sx={{ float: 'right', marginRight: -0.5, marginTop: -1 }} aria-label={t("notifications_mark_read")}>
@@ -177,9 +236,11 @@ const NotificationItem = (props) => {
                         </svg>}
                 </Typography>
                 {notification.title && <Typography variant="h5" component="div" role="rowheader">{formatTitle(notification)}</Typography>}
-                <Typography variant="body1" sx={{ whiteSpace: 'pre-line' }}>
-                    {autolink(maybeAppendActionErrors(formatMessage(notification), notification))}
-                </Typography>
+                {notification.html
+                    ? <Typography variant="body1" component="div" dangerouslySetInnerHTML={{ __html: notification.html }}/> /* Sanitized by the server */
+                    : <Typography variant="body1" sx={{ whiteSpace: 'pre-line' }}>
+                        {autolink(maybeAppendActionErrors(formatMessage(notification), notification))}
+                    </Typography>}
                 {attachment && <Attachment attachment={attachment}/>}
                 {tags && <Typography sx={{ fontSize: 14 }} color="text.secondary">{t("notifications_tags")}: {tags}</Typography>}
             </CardContent>
@@ -310,7 +371,7 @@ const Image = (props) => {
         <>
             <Box
                 component="img"
-                src={props.attachment.url}
+                src={props.attachment.thumbnail || props.attachment.url}
                 loading="lazy"
                 alt={t("notifications_attachment_image")}
                 onClick={() => setOpen(true)}
@@ -388,6 +449,16 @@ const UserAction = (props) => {
                 >{label}</Button>
             </Tooltip>
         );
+    } else if (action.action === "publish") {
+        const label = action.label + (ACTION_LABEL_SUFFIX[action.progress ?? 0] ?? "");
+        return (
+            <Tooltip title={t("notifications_actions_publish_title", { topic: action.topic })}>
+                <Button
+                    onClick={() => performPublishAction(notification, action)}
+                    aria-label={t("notifications_actions_publish_title", { topic: action.topic })}
+                >{label}</Button>
+            </Tooltip>
+        );
     }
     return null; // Others
 };
@@ -414,6 +485,19 @@ const performHttpAction = async (notification, action) => {
     }
 };
 
+const performPublishAction = async (notification, action) => {
+    console.log(`[Notifications] Performing publish user action`, action);
+    try {
+        updateActionStatus(notification, action, ACTION_PROGRESS_ONGOING, null);
+        const subscription = await subscriptionManager.get(notification.subscriptionId);
+        await api.publishAction(subscription.baseUrl, action);
+        updateActionStatus(notification, action, ACTION_PROGRESS_SUCCESS, null);
+    } catch (e) {
+        console.log(`[Notifications] Publish action failed`, e);
+        updateActionStatus(notification, action, ACTION_PROGRESS_FAILED, `${action.label}: ${e} Check developer console for details.`);
+    }
+};
+
 const updateActionStatus = (notification, action, progress, error) => {
     notification.actions = notification.actions.map(a => {
         if (a.id !== action.id) {
@@ -8,11 +8,12 @@ import DialogContentText from '@mui/material/DialogContentText';
 import DialogTitle from '@mui/material/DialogTitle';
 import {Autocomplete, Checkbox, FormControlLabel, useMediaQuery} from "@mui/material";
 import theme from "./theme";
-import api from "../app/Api";
+import api, {TOTPRequiredError} from "../app/Api";
 import {topicUrl, validTopic, validUrl} from "../app/utils";
 import userManager from "../app/UserManager";
 import subscriptionManager from "../app/SubscriptionManager";
 import poller from "../app/Poller";
+import config from "../app/config";
 import DialogFooter from "./DialogFooter";
 import {useTranslation} from "react-i18next";
 
@@ -63,7 +64,16 @@ const SubscribePage = (props) => {
     const handleSubscribe = async () => {
         const user = await userManager.get(baseUrl); // May be undefined
         const username = (user) ? user.username : t("subscribe_dialog_error_user_anonymous");
-        const success = await api.auth(baseUrl, topic, user);
+        let success;
+        try {
+            success = await api.auth(baseUrl, topic, user);
+        } catch (e) {
+            if (!(e instanceof TOTPRequiredError)) {
+                throw e;
+            }
+            props.onNeedsLogin(); // Two-factor authentication codes are not stored, so the user has to log in again
+            return;
+        }
         if (!success) {
             console.log(`[SubscribeDialog] Login to ${topicUrl(baseUrl, topic)} failed for user ${username}`);
             if (user) {
@@ -151,12 +161,25 @@ const LoginPage = (props) => {
     const { t } = useTranslation();
     const [username, setUsername] = useState("");
     const [password, setPassword] = useState("");
+    const [totp, setTotp] = useState("");
+    const [showTotp, setShowTotp] = useState(false);
     const [errorText, setErrorText] = useState("");
     const baseUrl = (props.baseUrl) ? props.baseUrl : window.location.origin;
     const topic = props.topic;
     const handleLogin = async () => {
         const user = {baseUrl, username, password};
-        const success = await api.auth(baseUrl, topic, user);
+        let success;
+        try {
+            success = await api.auth(baseUrl, topic, user, totp);
+        } catch (e) {
+            if (!(e instanceof TOTPRequiredError)) {
+                throw e;
+            }
+            console.log(`[SubscribeDialog] Login to ${topicUrl(baseUrl, topic)} requires a two-factor authentication code`);
+            setErrorText((showTotp) ? t("subscribe_dialog_error_totp_invalid") : "");
+            setShowTotp(true);
+            return;
+        }
         if (!success) {
             console.log(`[SubscribeDialog] Login to ${topicUrl(baseUrl, topic)} failed for user ${username}`);
             setErrorText(t("subscribe_dialog_error_user_not_authorized", { username: username }));
@@ -200,9 +223,27 @@ const LoginPage = (props) => {
                         "aria-label": t("subscribe_dialog_login_password_label")
                     }}
                 />
+                {showTotp && <TextField
+                    autoFocus
+                    margin="dense"
+                    id="totp"
+                    label={t("subscribe_dialog_login_totp_label")}
+                    value={totp}
+                    onChange={ev => setTotp(ev.target.value)}
+                    type="text"
+                    fullWidth
+                    variant="standard"
+                    inputProps={{
+                        inputMode: "numeric",
+                        autoComplete: "one-time-code",
+                        "aria-label": t("subscribe_dialog_login_totp_label")
+                    }}
+                />}
             </DialogContent>
             <DialogFooter status={errorText}>
                 <Button onClick={props.onBack}>{t("subscribe_dialog_login_button_back")}</Button>
+                {config.oidcLogin && baseUrl === window.location.origin &&
+                    <Button onClick={() => window.location.href = "/auth/oidc/login"}>{t("subscribe_dialog_login_button_oidc")}</Button>}
                 <Button onClick={handleLogin}>{t("subscribe_dialog_login_button_login")}</Button>
             </DialogFooter>
         </>
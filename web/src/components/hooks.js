@@ -18,6 +18,13 @@ export const useConnectionListeners = (subscriptions, users) => {
 
     useEffect(() => {
             const handleNotification = async (subscriptionId, notification) => {
+                if (notification.event === 'message_updated') {
+                    await subscriptionManager.replaceNotification(notification);
+                    return;
+                } else if (notification.event === 'message_deleted') {
+                    await subscriptionManager.deleteNotification(notification.id);
+                    return;
+                }
                 const added = await subscriptionManager.addNotification(subscriptionId, notification);
                 if (added) {
                     const defaultClickAction = (subscription) => navigate(routes.forSubscription(subscription));